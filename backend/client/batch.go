@@ -0,0 +1,222 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// Batch is a set of files uploaded together (POST /batches), such as a
+// directory tree.
+type Batch struct {
+	BatchID   string      `json:"batchID"`
+	Files     []BatchFile `json:"files"`
+	Complete  int         `json:"complete"`            // files stored so far
+	ExpiresAt *time.Time  `json:"expiresAt,omitempty"` // when the unfinished files are dropped
+}
+
+// BatchFile is one file of a batch, uploaded as the session UploadID.
+type BatchFile struct {
+	FileIndex     int    `json:"fileIndex"`
+	Path          string `json:"path"`     // relative, "/"-separated
+	FileName      string `json:"fileName"` // the name the server stores it under
+	UploadID      string `json:"uploadID"`
+	TotalChunks   int    `json:"totalChunks"`
+	FileSize      int64  `json:"fileSize"`
+	Status        string `json:"status"` // in_progress, complete or failed
+	Received      int64  `json:"received"`
+	MissingChunks []int  `json:"missingChunks"`
+	Size          int64  `json:"size"`
+	Stored        string `json:"stored"`
+}
+
+// Manifest lists the stored files of a completed batch.
+type Manifest struct {
+	BatchID   string          `json:"batchID"`
+	Files     []ManifestEntry `json:"files"`
+	TotalSize int64           `json:"totalSize"`
+}
+
+// ManifestEntry is one stored file of a batch.
+type ManifestEntry struct {
+	Path        string `json:"path"`
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	Stored      string `json:"stored"` // where the server put it
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type batchRequest struct {
+	Files     []batchFileRequest `json:"files"`
+	Retention string             `json:"retention,omitempty"`
+}
+
+type batchFileRequest struct {
+	Path        string `json:"path"`
+	TotalChunks int    `json:"totalChunks"`
+	FileSize    int64  `json:"fileSize"`
+}
+
+// BatchStatus reports every file of a batch (GET /batches/{batchID}).
+func (c *Client) BatchStatus(ctx context.Context, batchID string) (*Batch, error) {
+	var out Batch
+	if err := c.call(ctx, http.MethodGet, "/batches/"+url.PathEscape(batchID), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AbortBatch discards the unfinished files of a batch; files already
+// stored are kept.
+func (c *Client) AbortBatch(ctx context.Context, batchID string) error {
+	return c.call(ctx, http.MethodDelete, "/batches/"+url.PathEscape(batchID), nil, nil)
+}
+
+// UploadDir sends every regular file under dir as one batch, named by its
+// path relative to dir. The files go one after another, each like Upload.
+// On failure after the batch was created the error is an
+// *IncompleteError whose UploadID is the batch ID, for ResumeDir.
+func (u *Uploader) UploadDir(ctx context.Context, dir string) (*Manifest, error) {
+	if err := u.check(0); err != nil {
+		return nil, err
+	}
+	var req batchRequest
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		req.Files = append(req.Files, batchFileRequest{Path: filepath.ToSlash(rel), TotalChunks: u.totalChunks(fi.Size()), FileSize: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Files) == 0 {
+		return nil, fmt.Errorf("upload: no files in %s", dir)
+	}
+	if u.Retention > 0 {
+		req.Retention = u.Retention.String()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var b Batch
+	if err := u.Client.callJSON(ctx, http.MethodPost, "/batches", body, &b); err != nil {
+		return nil, err
+	}
+	return u.sendBatch(ctx, dir, &b, false)
+}
+
+// ResumeDir continues batch batchID from dir, which must hold the same
+// files: it sends only what the server is missing.
+func (u *Uploader) ResumeDir(ctx context.Context, batchID, dir string) (*Manifest, error) {
+	if err := u.check(0); err != nil {
+		return nil, err
+	}
+	b, err := u.Client.BatchStatus(ctx, batchID)
+	if err != nil {
+		return nil, err
+	}
+	return u.sendBatch(ctx, dir, b, true)
+}
+
+// sendBatch uploads the unfinished files of b from dir and completes it.
+// Progress, when set, counts the bytes of the whole batch.
+func (u *Uploader) sendBatch(ctx context.Context, dir string, b *Batch, resume bool) (*Manifest, error) {
+	var total, done int64
+	for _, f := range b.Files {
+		total += f.FileSize
+	}
+	fu := *u
+	if u.Progress != nil {
+		fu.Progress = func(sent, _ int64) { u.Progress(done+sent, total) }
+	}
+	incomplete := func(err error) error {
+		return &IncompleteError{UploadID: b.BatchID, Err: err}
+	}
+	for _, f := range b.Files {
+		switch f.Status {
+		case "complete":
+			done += f.FileSize
+			continue
+		case "failed":
+			return nil, incomplete(fmt.Errorf("%s: its upload was aborted, expired or refused; start a new batch", f.Path))
+		}
+		if err := fu.sendBatchFile(ctx, dir, f, resume); err != nil {
+			var inc *IncompleteError
+			if errors.As(err, &inc) {
+				err = inc.Err
+			}
+			return nil, incomplete(fmt.Errorf("%s: %w", f.Path, err))
+		}
+		done += f.FileSize
+	}
+
+	var m Manifest
+	if err := u.Client.callJSON(ctx, http.MethodPost, "/batches/"+url.PathEscape(b.BatchID)+"/complete", nil, &m); err != nil {
+		return nil, incomplete(err)
+	}
+	return &m, nil
+}
+
+// sendBatchFile uploads file f of a batch from dir, skipping the chunks
+// the server has when resuming.
+func (u *Uploader) sendBatchFile(ctx context.Context, dir string, f BatchFile, resume bool) error {
+	file, fi, err := openFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size := fi.Size()
+	if size != f.FileSize || u.totalChunks(size) != f.TotalChunks {
+		return fmt.Errorf("batch has it in %d chunks of a %d byte file, not %d of %d; use the same files and ChunkSize",
+			f.TotalChunks, f.FileSize, u.totalChunks(size), size)
+	}
+	var have map[int]bool
+	var sent int64
+	if resume {
+		st, err := u.Client.Status(ctx, f.UploadID)
+		if err != nil {
+			return err
+		}
+		have = make(map[int]bool, len(st.ReceivedChunks))
+		for _, i := range st.ReceivedChunks {
+			have[i] = true
+		}
+		sent = st.Received
+	}
+	_, err = u.send(ctx, f.UploadID, file, size, f.TotalChunks, have, sent)
+	return err
+}
+
+// callJSON is call with a JSON body, none when body is nil.
+func (c *Client) callJSON(ctx context.Context, method, path string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	return decode(resp, out)
+}
@@ -0,0 +1,326 @@
+// Package client uploads files to the chunk-upload server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBaseURL    = "http://localhost:8080"
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 500 * time.Millisecond
+)
+
+// Client talks to a chunk-upload server at BaseURL (e.g.
+// "http://localhost:8080", or "https://files.example/t/acme" for a tenant
+// of a server with TENANT_MODE=path).
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	MaxRetries int           // per chunk, on transient failures
+	Backoff    time.Duration // doubled after every retry
+
+	APIKey string // sent as X-API-Key when set
+	Token  string // sent as "Authorization: Bearer <Token>" when set
+}
+
+// New returns a Client with default retry settings.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		MaxRetries: DefaultMaxRetries,
+		Backoff:    DefaultBackoff,
+	}
+}
+
+// Result describes a completed upload.
+type Result struct {
+	Path    string // location reported by the server
+	Hash    string // hex SHA-256 of the file
+	Size    int64
+	Skipped bool  // server already had an identical complete file
+	Reused  int64 // bytes not sent: held by the chunk store (UploadDedup) or taken from the stored version (UploadDelta)
+
+	ExpiresAt *time.Time // when the server deletes the file, if it has a retention period
+	VersionID string     // of the stored file, when the server keeps versions
+
+	Extracted []ExtractedFile // unpacked from the archive, with Uploader.Extract
+}
+
+// ExtractedFile is one file the server unpacked from an uploaded archive.
+type ExtractedFile struct {
+	Path        string `json:"path"`     // in the archive
+	FileName    string `json:"fileName"` // the name the server stores it under
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// APIError is a non-2xx response from the server.
+type APIError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"error"`
+
+	// Retriable is the server's verdict on whether resending the request
+	// may succeed; nil from servers that do not send one.
+	Retriable *bool `json:"retriable"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("upload: HTTP %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// temporary reports whether retrying the same request may succeed: the
+// server's Retriable flag, else a guess from the status.
+func (e *APIError) temporary() bool {
+	if e.Retriable != nil {
+		return *e.Retriable
+	}
+	if e.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	// The chunk was corrupted in transit; the server stored nothing.
+	if e.StatusCode == http.StatusUnprocessableEntity && e.Code == "CHUNK_HASH_MISMATCH" {
+		return true
+	}
+	return e.StatusCode >= 500 && e.StatusCode != http.StatusInsufficientStorage
+}
+
+type successResponse struct {
+	Received int64  `json:"received"`
+	Done     bool   `json:"done"`
+	Path     string `json:"path"`
+
+	ExpiresAt *time.Time      `json:"expiresAt"`
+	Extracted []ExtractedFile `json:"extracted"`
+	VersionID string          `json:"versionId"`
+}
+
+// Upload sends filePath to DefaultBaseURL using a default Client.
+func Upload(ctx context.Context, filePath string, chunkSize int64) (*Result, error) {
+	return New(DefaultBaseURL).Upload(ctx, filePath, chunkSize)
+}
+
+// Upload sends filePath in chunks of chunkSize bytes. If the server already
+// holds a complete file with the same name and hash, nothing is sent.
+// Otherwise it starts a session (POST /upload/init) and sends the chunks
+// in order. Chunks that fail with a network error or an error the server
+// marks retriable (429 or 5xx from servers that do not say) are retried
+// with exponential backoff. On failure after the session was created the
+// error is an *IncompleteError; pass its UploadID to ResumeUpload.
+func (c *Client) Upload(ctx context.Context, filePath string, chunkSize int64) (*Result, error) {
+	f, fi, hash, err := openHashed(filePath, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := filepath.Base(filePath)
+
+	if ok, err := c.hasComplete(ctx, name, hash); err != nil {
+		return nil, err
+	} else if ok {
+		return &Result{Path: name, Hash: hash, Size: fi.Size(), Skipped: true}, nil
+	}
+
+	total := chunkCount(fi.Size(), chunkSize)
+	form := url.Values{"fileName": {name}, "totalChunks": {strconv.Itoa(total)}, "fileSize": {strconv.FormatInt(fi.Size(), 10)}}
+	var init initResponse
+	if err := c.call(ctx, http.MethodPost, "/upload/init", form, &init); err != nil {
+		return nil, err
+	}
+	return c.sendFile(ctx, f, init.UploadID, name, hash, fi.Size(), chunkSize, nil)
+}
+
+// ResumeUpload continues an upload that Upload left incomplete. It asks the
+// server (GET /upload/{uploadID}/status) which chunks it already has and
+// sends the rest; filePath and chunkSize must be the ones Upload was given.
+func (c *Client) ResumeUpload(ctx context.Context, uploadID, filePath string, chunkSize int64) (*Result, error) {
+	f, fi, hash, err := openHashed(filePath, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := c.Status(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if total := chunkCount(fi.Size(), chunkSize); st.TotalChunks != total || st.FileSize != fi.Size() {
+		return nil, fmt.Errorf("upload: session %s has %d chunks of a %d byte file, want %d of %d; use the same file and chunkSize",
+			uploadID, st.TotalChunks, st.FileSize, total, fi.Size())
+	}
+	have := make(map[int]bool, len(st.ReceivedChunks))
+	for _, i := range st.ReceivedChunks {
+		have[i] = true
+	}
+	return c.sendFile(ctx, f, uploadID, st.FileName, hash, fi.Size(), chunkSize, have)
+}
+
+// openHashed opens filePath and hashes its content.
+func openHashed(filePath string, chunkSize int64) (*os.File, os.FileInfo, string, error) {
+	if chunkSize <= 0 {
+		return nil, nil, "", errors.New("upload: chunkSize must be positive")
+	}
+	f, fi, err := openFile(filePath)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		f.Close()
+		return nil, nil, "", err
+	}
+	return f, fi, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// chunkCount is the number of chunks of chunkSize bytes a file of size
+// bytes is sent in.
+func chunkCount(size, chunkSize int64) int {
+	return max(1, int((size+chunkSize-1)/chunkSize)) // empty files still need one (empty) chunk
+}
+
+// sendFile sends the chunks of f not in have, in order, as upload session
+// id. Errors are *IncompleteError.
+func (c *Client) sendFile(ctx context.Context, f *os.File, id, name, hash string, size, chunkSize int64, have map[int]bool) (*Result, error) {
+	total := chunkCount(size, chunkSize)
+	buf := make([]byte, chunkSize)
+	var last *successResponse
+	for i := 0; i < total; i++ {
+		if have[i] {
+			continue
+		}
+		n, err := f.ReadAt(buf, int64(i)*chunkSize)
+		if err != nil && err != io.EOF {
+			return nil, &IncompleteError{UploadID: id, Err: err}
+		}
+		last, err = c.sendWithRetry(ctx, id, name, i, total, buf[:n])
+		if err != nil {
+			return nil, &IncompleteError{UploadID: id, Err: fmt.Errorf("chunk %d/%d: %w", i+1, total, err)}
+		}
+	}
+	if last == nil || !last.Done {
+		return nil, &IncompleteError{UploadID: id, Err: errors.New("upload: server did not report completion")}
+	}
+	return &Result{Path: last.Path, Hash: hash, Size: size, ExpiresAt: last.ExpiresAt, VersionID: last.VersionID}, nil
+}
+
+// hasComplete asks the server (HEAD /upload) whether it already has the file.
+func (c *Client) hasComplete(ctx context.Context, name, hash string) (bool, error) {
+	q := url.Values{"fileName": {name}, "hash": {hash}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.BaseURL+"/upload?"+q.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// do sends req with the configured credentials.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.HTTPClient.Do(req)
+}
+
+func (c *Client) sendWithRetry(ctx context.Context, id, name string, index, total int, chunk []byte) (*successResponse, error) {
+	return c.retry(ctx, func() (*successResponse, error) {
+		return c.sendChunk(ctx, id, name, index, total, chunk)
+	})
+}
+
+// retry calls send until it succeeds, fails permanently or MaxRetries
+// retries are used up, doubling Backoff between attempts.
+func (c *Client) retry(ctx context.Context, send func() (*successResponse, error)) (*successResponse, error) {
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if err == nil {
+			return resp, nil
+		}
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && !apiErr.temporary() {
+			return nil, err
+		}
+		if ctx.Err() != nil || attempt >= c.MaxRetries {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) sendChunk(ctx context.Context, id, name string, index, total int, chunk []byte) (*successResponse, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("uploadID", id)
+	mw.WriteField("index", strconv.Itoa(index))
+	mw.WriteField("totalChunks", strconv.Itoa(total))
+	mw.WriteField("fileName", name)
+	sum := sha256.Sum256(chunk)
+	mw.WriteField("checksumAlgo", "sha256")
+	mw.WriteField("chunkHash", hex.EncodeToString(sum[:]))
+	fw, err := mw.CreateFormFile("chunk", name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/upload", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var out successResponse
+	if err := decode(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// decode reads a 200 response into v, or returns the *APIError.
+func decode(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return apiErr
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,576 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer assembles chunks of session "abc" in memory, fails the first
+// chunk POST with 503 and chunk index fail once with 400.
+type fakeServer struct {
+	mu       sync.Mutex
+	data     bytes.Buffer
+	total    int
+	got      []int
+	posts    int
+	fail     int
+	complete map[string]string // name -> hash
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodHead:
+		if s.complete[r.URL.Query().Get("fileName")] == r.URL.Query().Get("hash") {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case r.URL.Path == "/upload/init":
+		s.total, _ = strconv.Atoi(r.FormValue("totalChunks"))
+		json.NewEncoder(w).Encode(map[string]string{"uploadID": "abc"})
+		return
+	case r.URL.Path == "/upload/abc/status":
+		json.NewEncoder(w).Encode(map[string]any{"fileName": "file.bin", "totalChunks": s.total,
+			"fileSize": 250, "received": s.data.Len(), "receivedChunks": s.got})
+		return
+	}
+
+	s.posts++
+	if s.posts == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "busy", "code": "SERVER_BUSY"})
+		return
+	}
+	index, _ := strconv.Atoi(r.FormValue("index"))
+	if r.FormValue("uploadID") != "abc" || index != len(s.got) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if index == s.fail {
+		s.fail = -1
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "nope", "code": "INVALID_REQUEST"})
+		return
+	}
+	chunk, _, err := r.FormFile("chunk")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	io.Copy(&s.data, chunk)
+	s.got = append(s.got, index)
+	if index == s.total-1 {
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "done": true, "path": "uploads/" + r.FormValue("fileName")})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": "ok", "received": s.data.Len()})
+}
+
+func writeTestFile(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUploadRetriesAndAssembles(t *testing.T) {
+	fs := &fakeServer{fail: -1}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 25)
+	c := New(srv.URL)
+	c.Backoff = 0
+	res, err := c.Upload(context.Background(), writeTestFile(t, content), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	if res.Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("hash = %s", res.Hash)
+	}
+	if res.Path != "uploads/file.bin" || res.Skipped {
+		t.Errorf("result = %+v", res)
+	}
+	if !bytes.Equal(fs.data.Bytes(), content) {
+		t.Errorf("server received %d bytes, want %d", fs.data.Len(), len(content))
+	}
+	if fs.posts != 5 { // 4 chunks + 1 retried
+		t.Errorf("posts = %d, want 5", fs.posts)
+	}
+}
+
+func TestUploadSkipsCompleteFile(t *testing.T) {
+	content := []byte("already there")
+	sum := sha256.Sum256(content)
+	fs := &fakeServer{complete: map[string]string{"file.bin": hex.EncodeToString(sum[:])}}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	res, err := New(srv.URL).Upload(context.Background(), writeTestFile(t, content), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Skipped || fs.posts != 0 {
+		t.Errorf("skipped = %v, posts = %d", res.Skipped, fs.posts)
+	}
+}
+
+func TestUploadResumesFromStatus(t *testing.T) {
+	fs := &fakeServer{fail: 2}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 25)
+	path := writeTestFile(t, content)
+	c := New(srv.URL)
+	c.Backoff = 0
+	_, err := c.Upload(context.Background(), path, 64)
+	var inc *IncompleteError
+	if !errors.As(err, &inc) || inc.UploadID != "abc" {
+		t.Fatalf("err = %v, want *IncompleteError for abc", err)
+	}
+	if len(fs.got) != 2 {
+		t.Fatalf("%d chunks stored, want 2", len(fs.got))
+	}
+
+	posts := fs.posts
+	res, err := c.ResumeUpload(context.Background(), inc.UploadID, path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Path != "uploads/file.bin" || res.Size != int64(len(content)) {
+		t.Errorf("result = %+v", res)
+	}
+	if !bytes.Equal(fs.data.Bytes(), content) {
+		t.Errorf("server received %d bytes, want %d", fs.data.Len(), len(content))
+	}
+	if resent := fs.posts - posts; resent != 2 {
+		t.Errorf("resume sent %d chunks, want the 2 missing", resent)
+	}
+
+	if _, err := c.ResumeUpload(context.Background(), inc.UploadID, path, 32); err == nil {
+		t.Error("resume with another chunkSize succeeded")
+	}
+}
+
+// fakeSessionServer implements the session endpoints the Uploader uses and
+// rejects chunk index fail once with 400.
+type fakeSessionServer struct {
+	mu        sync.Mutex
+	data      []byte
+	chunkSize int64
+	total     int
+	got       map[int]bool
+	puts      int
+	fail      int
+}
+
+func (s *fakeSessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload/init":
+		size, _ := strconv.ParseInt(r.FormValue("fileSize"), 10, 64)
+		s.total, _ = strconv.Atoi(r.FormValue("totalChunks"))
+		s.data, s.got = make([]byte, size), map[int]bool{}
+		json.NewEncoder(w).Encode(map[string]string{"uploadID": "abc"})
+	case r.Method == http.MethodGet && r.URL.Path == "/upload/abc/status":
+		received := []int{}
+		for i := range s.total {
+			if s.got[i] {
+				received = append(received, i)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"totalChunks": s.total, "fileSize": len(s.data),
+			"received": int64(len(received)) * s.chunkSize, "receivedChunks": received})
+	case r.Method == http.MethodPut:
+		s.puts++
+		index, _ := strconv.Atoi(r.PathValue("index"))
+		if index == s.fail {
+			s.fail = -1
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "nope", "code": "INVALID_REQUEST"})
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Upload-ChunkHash") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		s.chunkSize, _ = strconv.ParseInt(r.Header.Get("X-Upload-ChunkSize"), 10, 64)
+		copy(s.data[int64(index)*s.chunkSize:], body)
+		s.got[index] = true
+		if len(s.got) == s.total {
+			json.NewEncoder(w).Encode(map[string]any{"status": "ok", "done": true, "path": "uploads/file.bin"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUploaderResumesAfterFailure(t *testing.T) {
+	fs := &fakeSessionServer{fail: 3}
+	mux := http.NewServeMux()
+	mux.Handle("/upload/init", fs)
+	mux.Handle("/upload/{id}/status", fs)
+	mux.Handle("PUT /upload/{id}/chunk/{index}", fs)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	path := writeTestFile(t, content)
+	u := NewUploader(New(srv.URL))
+	u.ChunkSize, u.Concurrency = 64, 1 // nothing in flight when chunk 3 fails
+
+	_, err := u.UploadFile(context.Background(), path)
+	var inc *IncompleteError
+	if !errors.As(err, &inc) || inc.UploadID != "abc" {
+		t.Fatalf("err = %v, want *IncompleteError for abc", err)
+	}
+	stored, puts := len(fs.got), fs.puts
+	if stored != 3 {
+		t.Fatalf("%d chunks stored, want 3", stored)
+	}
+
+	var last int64
+	u.Concurrency = 3
+	u.Progress = func(sent, total int64) {
+		if sent < last || total != int64(len(content)) {
+			t.Errorf("progress %d/%d after %d", sent, total, last)
+		}
+		last = sent
+	}
+	res, err := u.ResumeFile(context.Background(), inc.UploadID, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	if res.Path != "uploads/file.bin" || res.Hash != hex.EncodeToString(sum[:]) || res.Size != int64(len(content)) {
+		t.Errorf("result = %+v", res)
+	}
+	if !bytes.Equal(fs.data, content) {
+		t.Error("server content differs")
+	}
+	if last != int64(len(content)) {
+		t.Errorf("last progress = %d, want %d", last, len(content))
+	}
+	if resent := fs.puts - puts; resent != fs.total-stored {
+		t.Errorf("resume sent %d chunks, want the %d missing", resent, fs.total-stored)
+	}
+}
+
+func TestAPIErrorTemporary(t *testing.T) {
+	yes, no := true, false
+	for _, tc := range []struct {
+		err  APIError
+		want bool
+	}{
+		{APIError{StatusCode: http.StatusServiceUnavailable}, true},
+		{APIError{StatusCode: http.StatusInsufficientStorage}, false},
+		{APIError{StatusCode: http.StatusUnprocessableEntity, Code: "CHUNK_HASH_MISMATCH"}, true},
+		{APIError{StatusCode: http.StatusBadRequest, Code: "INVALID_INDEX"}, false},
+		// The server's flag wins over the status.
+		{APIError{StatusCode: http.StatusServiceUnavailable, Code: "SCAN_FAILED", Retriable: &no}, false},
+		{APIError{StatusCode: http.StatusBadRequest, Code: "CHUNK_LENGTH_MISMATCH", Retriable: &yes}, true},
+	} {
+		if got := tc.err.temporary(); got != tc.want {
+			t.Errorf("%d %s: temporary() = %v, want %v", tc.err.StatusCode, tc.err.Code, got, tc.want)
+		}
+	}
+}
+
+func TestUploadDirect(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		stored = map[int][]byte{}
+		failed bool
+	)
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("POST /upload/direct", func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.FormValue("fileSize"))
+		up := DirectUpload{UploadID: "d1", PartSize: 400, TotalParts: (size + 399) / 400, URLsExpireAt: time.Now().Add(time.Hour)}
+		for n := 1; n <= up.TotalParts; n++ {
+			up.Parts = append(up.Parts, DirectPart{n, srv.URL + "/bucket/" + strconv.Itoa(n) + "?X-Amz-Signature=x"})
+		}
+		json.NewEncoder(w).Encode(up)
+	})
+	mux.HandleFunc("PUT /bucket/{n}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-API-Key") != "" {
+			t.Error("credentials sent to the bucket")
+		}
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		n, _ := strconv.Atoi(r.PathValue("n"))
+		stored[n], _ = io.ReadAll(r.Body)
+		w.Header().Set("ETag", `"e`+r.PathValue("n")+`"`)
+	})
+	mux.HandleFunc("POST /upload/{id}/complete", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Parts []CompletedPart }
+		json.NewDecoder(r.Body).Decode(&body)
+		var data []byte
+		for i, p := range body.Parts {
+			if p.PartNumber != i+1 || p.ETag != `"e`+strconv.Itoa(i+1)+`"` {
+				t.Errorf("part %d = %+v", i, p)
+			}
+			data = append(data, stored[p.PartNumber]...)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "done": true, "path": "s3://b/file.bin", "size": len(data)})
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	c := New(srv.URL)
+	c.APIKey, c.Backoff = "k", 0
+	res, err := c.UploadDirect(context.Background(), "file.bin", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	if res.Path != "s3://b/file.bin" || res.Hash != hex.EncodeToString(sum[:]) || res.Size != int64(len(content)) {
+		t.Errorf("result = %+v", res)
+	}
+	if got := bytes.Join([][]byte{stored[1], stored[2], stored[3]}, nil); !bytes.Equal(got, content) || len(stored) != 3 {
+		t.Errorf("bucket holds %d parts, %d bytes", len(stored), len(got))
+	}
+}
+
+func TestUploadDedup(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		chunks = map[string][]byte{}
+		puts   int
+		files  = map[string][]byte{}
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /upload/config", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ServerConfig{MaxChunkSize: 256 << 10, ChunkDedup: true})
+	})
+	mux.HandleFunc("POST /chunks/exists", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var body struct{ Hashes []string }
+		json.NewDecoder(r.Body).Decode(&body)
+		missing := []string{}
+		for _, h := range body.Hashes {
+			if chunks[h] == nil {
+				missing = append(missing, h)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"missing": missing})
+	})
+	mux.HandleFunc("PUT /chunks/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != r.PathValue("hash") || len(body) > 256<<10 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		puts++
+		chunks[r.PathValue("hash")] = body
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "received": len(body)})
+	})
+	mux.HandleFunc("POST /chunks/assemble", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var body struct {
+			FileName string
+			Chunks   []string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		var data []byte
+		for _, h := range body.Chunks {
+			data = append(data, chunks[h]...)
+		}
+		files[body.FileName] = data
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "done": true, "path": "uploads/" + body.FileName})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	content := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	u := NewUploader(New(srv.URL))
+	res, err := u.UploadDedup(context.Background(), "backup.img", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	if res.Path != "uploads/backup.img" || res.Hash != hex.EncodeToString(sum[:]) || res.Reused != 0 || !bytes.Equal(files["backup.img"], content) {
+		t.Fatalf("first upload: result = %+v, stored %d bytes", res, len(files["backup.img"]))
+	}
+	if len(chunks) < 10 {
+		t.Fatalf("%d chunks for 3 MiB", len(chunks))
+	}
+
+	// Bytes inserted near the start shift everything after them, yet only
+	// the chunk around them is new.
+	changed := append(append(append([]byte{}, content[:100000]...), "inserted"...), content[100000:]...)
+	first := puts
+	res, err = u.UploadDedup(context.Background(), "backup.img", bytes.NewReader(changed), int64(len(changed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(files["backup.img"], changed) || puts-first > 2 || res.Reused < int64(len(content))*9/10 {
+		t.Fatalf("second upload: %d chunks sent, %d of %d bytes reused", puts-first, res.Reused, len(changed))
+	}
+}
+
+func TestUploadDelta(t *testing.T) {
+	const bs = 1024
+	var (
+		mu      sync.Mutex
+		stored  = map[string][]byte{}
+		literal int64
+	)
+	etag := func(name string) string { return `"` + strconv.Itoa(len(stored[name])) + `"` }
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files/{name}/signature", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		data, ok := stored[r.PathValue("name")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"code": "NOT_FOUND"})
+			return
+		}
+		sig := Signature{Size: int64(len(data)), BlockSize: bs, ETag: etag(r.PathValue("name"))}
+		for off := 0; off < len(data); off += bs {
+			block := data[off:min(off+bs, len(data))]
+			sum := sha256.Sum256(block)
+			sig.Blocks = append(sig.Blocks, SignatureBlock{weak(weakSum(block)), hex.EncodeToString(sum[:16])})
+		}
+		json.NewEncoder(w).Encode(sig)
+	})
+	mux.HandleFunc("POST /files/{name}/patch", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		base := stored[r.PathValue("name")]
+		if r.Header.Get("If-Match") != etag(r.PathValue("name")) || r.URL.Query().Get("blockSize") != strconv.Itoa(bs) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body := bufio.NewReader(r.Body)
+		var data []byte
+		for {
+			op, err := body.ReadByte()
+			if err != nil {
+				break
+			}
+			switch op {
+			case 'C':
+				index, _ := binary.ReadUvarint(body)
+				count, _ := binary.ReadUvarint(body)
+				data = append(data, base[index*bs:min((index+count)*bs, uint64(len(base)))]...)
+			case 'L':
+				n, _ := binary.ReadUvarint(body)
+				buf := make([]byte, n)
+				io.ReadFull(body, buf)
+				data = append(data, buf...)
+				literal += int64(n)
+			}
+		}
+		stored[r.PathValue("name")] = data
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "done": true, "path": "uploads/" + r.PathValue("name")})
+	})
+	mux.HandleFunc("POST /upload/init", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"uploadID": "u1"})
+	})
+	mux.HandleFunc("PUT /upload/u1/chunk/{index}", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		stored["data.csv"], _ = io.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "done": true, "path": "uploads/data.csv"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	content := make([]byte, 100*bs+300)
+	rand.New(rand.NewSource(2)).Read(content)
+	u := NewUploader(New(srv.URL))
+	u.ChunkSize = int64(len(content))
+	if _, err := u.UploadDelta(context.Background(), "data.csv", bytes.NewReader(content), int64(len(content))); err != nil || !bytes.Equal(stored["data.csv"], content) {
+		t.Fatalf("first upload, whole: %v", err)
+	}
+
+	// Rows inserted, changed and dropped.
+	changed := append([]byte("header\n"), content[:20*bs]...)
+	changed = append(changed, "new row\n"...)
+	changed = append(changed, content[20*bs:50*bs+7]...)
+	changed = append(changed, 'x')
+	changed = append(changed, content[50*bs+8:80*bs]...)
+	changed = append(changed, content[90*bs:]...)
+	res, err := u.UploadDelta(context.Background(), "data.csv", bytes.NewReader(changed), int64(len(changed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(changed)
+	if !bytes.Equal(stored["data.csv"], changed) || res.Hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("patched file differs: %d bytes, want %d", len(stored["data.csv"]), len(changed))
+	}
+	if literal > 3*bs || res.Reused != int64(len(changed))-literal {
+		t.Fatalf("%d literal bytes, %d reused", literal, res.Reused)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files/{name}/versions", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("name") != "q3 report.pdf" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not found", "code": "NOT_FOUND"})
+			return
+		}
+		io.WriteString(w, `{"fileName": "q3 report.pdf", "versions": [
+			{"versionId": "00000000000000b2", "size": 20, "storedAt": "2026-10-15T12:00:00Z", "current": true},
+			{"versionId": "00000000000000a1", "size": 10, "storedAt": "2026-10-14T12:00:00Z", "replacedAt": "2026-10-15T12:00:00Z"}]}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL)
+	versions, err := c.Versions(context.Background(), "q3 report.pdf")
+	if err != nil || len(versions) != 2 || !versions[0].Current || versions[0].ReplacedAt != nil ||
+		versions[1].VersionID != "00000000000000a1" || versions[1].ReplacedAt == nil || versions[1].Size != 10 {
+		t.Fatalf("versions = %+v, err = %v", versions, err)
+	}
+	var apiErr *APIError
+	if _, err := c.Versions(context.Background(), "other.pdf"); !errors.As(err, &apiErr) || apiErr.Code != "NOT_FOUND" {
+		t.Fatalf("missing file: err = %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Chunk-level deduplication against a server with CHUNK_DEDUP: the file is
+// cut where its content says, not every ChunkSize bytes, so an insertion
+// only changes the chunks around it and the rest are already on the
+// server.
+
+const (
+	DedupMinChunk = 256 << 10 // no cut before this many bytes
+	DedupMaxChunk = 4 << 20   // always a cut here
+	dedupMaskBits = 20        // a cut every 1 MiB on average past DedupMinChunk
+
+	// maxChunkList is the server's limit on hashes per request.
+	maxChunkList = 100000
+)
+
+// gear maps each byte to a pseudo-random value for the rolling hash. It is
+// fixed (splitmix64 from a constant seed) so every client cuts a file at
+// the same places.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x5eed)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// cdcChunk is a content-defined chunk of a file.
+type cdcChunk struct {
+	off  int64
+	size int
+	hash string // hex SHA-256
+}
+
+// chunker cuts after the byte where the gear hash of the last 64 bytes has
+// its low bits all zero, keeping chunks between min and max bytes.
+type chunker struct {
+	min, max int
+	mask     uint64
+}
+
+// newChunker returns the default chunker, scaled down when the server
+// takes no chunks as large as DedupMaxChunk.
+func newChunker(maxChunk int64) chunker {
+	c := chunker{min: DedupMinChunk, max: DedupMaxChunk, mask: 1<<dedupMaskBits - 1}
+	for maxChunk > 0 && int64(c.max) > maxChunk {
+		c.min, c.max, c.mask = c.min/2, c.max/2, c.mask>>1
+	}
+	return c
+}
+
+// split reads r to the end and returns its chunks and the hex SHA-256 of
+// all of it.
+func (c chunker) split(r io.Reader) ([]cdcChunk, string, error) {
+	var (
+		chunks []cdcChunk
+		off    int64
+		fp     uint64
+	)
+	file := sha256.New()
+	data := make([]byte, 0, c.max)
+	cut := func() {
+		sum := sha256.Sum256(data)
+		file.Write(data)
+		chunks = append(chunks, cdcChunk{off: off, size: len(data), hash: hex.EncodeToString(sum[:])})
+		off += int64(len(data))
+		data = data[:0]
+	}
+	br := bufio.NewReaderSize(r, 1<<20)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		data = append(data, b)
+		fp = fp<<1 + gear[b]
+		if len(data) >= c.max || len(data) >= c.min && fp&c.mask == 0 {
+			cut()
+		}
+	}
+	if len(data) > 0 || len(chunks) == 0 {
+		cut() // an empty file is one empty chunk
+	}
+	return chunks, hex.EncodeToString(file.Sum(nil)), nil
+}
+
+// assembleRequest is the POST /chunks/assemble body.
+type assembleRequest struct {
+	FileName  string   `json:"fileName"`
+	Chunks    []string `json:"chunks"`
+	Hash      string   `json:"hash"`
+	Retention string   `json:"retention,omitempty"`
+}
+
+// UploadFileDedup sends the file at path under its base name, as
+// UploadDedup does.
+func (u *Uploader) UploadFileDedup(ctx context.Context, path string) (*Result, error) {
+	f, fi, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return u.UploadDedup(ctx, fi.Name(), f, fi.Size())
+}
+
+// UploadDedup stores size bytes of r as name through the chunk store of a
+// server with CHUNK_DEDUP: r is cut into content-defined chunks, the
+// server is asked which it lacks (POST /chunks/exists), only those are
+// sent (PUT /chunks/{hash}, up to Concurrency at once) and the server
+// assembles the file (POST /chunks/assemble). Result.Reused counts the
+// bytes that did not have to be sent. Calling it again after a failure
+// resends only the chunks the server still lacks. ChunkSize, Compress and
+// Extract do not apply.
+func (u *Uploader) UploadDedup(ctx context.Context, name string, r io.ReaderAt, size int64) (*Result, error) {
+	if u.Extract {
+		return nil, errors.New("upload: Extract cannot be used with deduplicated uploads")
+	}
+	cfg, err := u.Client.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.ChunkDedup {
+		return nil, errors.New("upload: the server does not deduplicate chunks (CHUNK_DEDUP)")
+	}
+	chunks, hash, err := newChunker(cfg.MaxChunkSize).split(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	req := assembleRequest{FileName: name, Chunks: make([]string, len(chunks)), Hash: hash}
+	if u.Retention > 0 {
+		req.Retention = u.Retention.String()
+	}
+	for i, c := range chunks {
+		req.Chunks[i] = c.hash
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// A chunk the server had may be swept before the assemble; then the
+	// missing ones are sent once more.
+	var sent int64
+	for attempt := 0; ; attempt++ {
+		n, err := u.sendMissing(ctx, r, chunks, size)
+		sent += n
+		if err != nil {
+			return nil, err
+		}
+		var out successResponse
+		err = u.Client.callJSON(ctx, http.MethodPost, "/chunks/assemble", body, &out)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Code == "CHUNKS_MISSING" && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Path: out.Path, Hash: hash, Size: size, Reused: max(size-sent, 0), ExpiresAt: out.ExpiresAt, VersionID: out.VersionID}, nil
+	}
+}
+
+// sendMissing asks the server which of chunks it lacks and sends those,
+// each once, returning the bytes sent.
+func (u *Uploader) sendMissing(ctx context.Context, r io.ReaderAt, chunks []cdcChunk, size int64) (int64, error) {
+	first := make(map[string]cdcChunk, len(chunks))
+	var unique []string
+	for _, c := range chunks {
+		if _, ok := first[c.hash]; !ok {
+			first[c.hash] = c
+			unique = append(unique, c.hash)
+		}
+	}
+	var missing []string
+	for i := 0; i < len(unique); i += maxChunkList {
+		body, err := json.Marshal(map[string][]string{"hashes": unique[i:min(i+maxChunkList, len(unique))]})
+		if err != nil {
+			return 0, err
+		}
+		var out struct {
+			Missing []string `json:"missing"`
+		}
+		if err := u.Client.callJSON(ctx, http.MethodPost, "/chunks/exists", body, &out); err != nil {
+			return 0, err
+		}
+		missing = append(missing, out.Missing...)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var (
+		mu   sync.Mutex
+		sent int64
+		held = size
+		wg   sync.WaitGroup
+	)
+	for _, h := range missing {
+		held -= int64(first[h].size)
+	}
+	if u.Progress != nil {
+		u.Progress(held, size)
+	}
+	jobs := make(chan cdcChunk)
+	for range max(1, u.Concurrency) {
+		wg.Go(func() {
+			for c := range jobs {
+				data := make([]byte, c.size)
+				if _, err := r.ReadAt(data, c.off); err != nil && !(err == io.EOF && c.off+int64(c.size) == size) {
+					cancel(fmt.Errorf("read chunk at %d: %w", c.off, err))
+					continue
+				}
+				_, err := u.Client.retry(ctx, func() (*successResponse, error) {
+					return u.putChunk(ctx, c.hash, data)
+				})
+				if err != nil {
+					cancel(fmt.Errorf("chunk %s: %w", c.hash, err))
+					continue
+				}
+				mu.Lock()
+				sent += int64(c.size)
+				held += int64(c.size)
+				if u.Progress != nil {
+					u.Progress(held, size)
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	func() {
+		defer close(jobs)
+		for _, h := range missing {
+			c, ok := first[h]
+			if !ok {
+				cancel(fmt.Errorf("server asked for chunk %s, which is not in the file", h))
+				return
+			}
+			select {
+			case jobs <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	return sent, context.Cause(ctx)
+}
+
+// putChunk sends one chunk to the server's chunk store.
+func (u *Uploader) putChunk(ctx context.Context, hash string, data []byte) (*successResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.Client.BaseURL+"/chunks/"+hash, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := u.Client.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var out successResponse
+	if err := decode(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// Delta uploads against a server with DELTA_UPLOAD: like rsync, only the
+// parts of a file that are not already in its stored version are sent.
+
+// Signature describes the stored version of a file block by block (GET
+// /files/{name}/signature).
+type Signature struct {
+	FileName  string           `json:"fileName"`
+	Size      int64            `json:"size"`
+	BlockSize int64            `json:"blockSize"`
+	ETag      string           `json:"etag"`
+	Blocks    []SignatureBlock `json:"blocks"`
+}
+
+// SignatureBlock is the rsync weak checksum of a block and the hex of the
+// first 16 bytes of its SHA-256.
+type SignatureBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature fetches the block signature of the stored file name.
+func (c *Client) Signature(ctx context.Context, name string) (*Signature, error) {
+	var sig Signature
+	if err := c.call(ctx, http.MethodGet, "/files/"+url.PathEscape(name)+"/signature", nil, &sig); err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// weakSum is rsync's checksum of p, as the server computes it.
+func weakSum(p []byte) (a, b uint32) {
+	for i, c := range p {
+		a += uint32(c)
+		b += uint32(len(p)-i) * uint32(c)
+	}
+	return a, b
+}
+
+func weak(a, b uint32) uint32 { return a&0xffff | b<<16 }
+
+// deltaEncoder writes the delta ops the server applies: 'C' and uvarint
+// block index and count to copy blocks of the stored file, 'L' and a
+// uvarint length to insert literal bytes.
+type deltaEncoder struct {
+	w       *bufio.Writer
+	r       io.ReaderAt
+	copyAt  int64 // first block of the pending copy
+	copyN   int64 // blocks in it, 0 = none
+	literal int64 // bytes sent as literals
+}
+
+func (e *deltaEncoder) op(code byte, args ...uint64) {
+	e.w.WriteByte(code)
+	for _, v := range args {
+		e.w.Write(binary.AppendUvarint(nil, v))
+	}
+}
+
+// copyBlock adds block to the pending copy, or starts a new one.
+func (e *deltaEncoder) copyBlock(block int64) {
+	if e.copyN > 0 && block == e.copyAt+e.copyN {
+		e.copyN++
+		return
+	}
+	e.flushCopy()
+	e.copyAt, e.copyN = block, 1
+}
+
+func (e *deltaEncoder) flushCopy() {
+	if e.copyN > 0 {
+		e.op('C', uint64(e.copyAt), uint64(e.copyN))
+		e.copyN = 0
+	}
+}
+
+// insert sends bytes [from, to) of the new file as they are.
+func (e *deltaEncoder) insert(from, to int64) error {
+	if to <= from {
+		return nil
+	}
+	e.flushCopy()
+	e.op('L', uint64(to-from))
+	e.literal += to - from
+	_, err := io.Copy(e.w, io.NewSectionReader(e.r, from, to-from))
+	return err
+}
+
+// writeDelta writes to w the delta making size bytes of r from the file
+// sig describes, and returns the literal bytes in it and the hex SHA-256
+// of r. A window of BlockSize bytes rolls over r one byte at a time; where
+// its weak and then strong checksum match a stored block, the block is
+// copied and the window jumps past it.
+func writeDelta(w io.Writer, r io.ReaderAt, size int64, sig *Signature) (int64, string, error) {
+	bs := sig.BlockSize
+	if bs <= 0 {
+		return 0, "", errors.New("upload: signature has no block size")
+	}
+	lastLen := sig.Size - (int64(len(sig.Blocks))-1)*bs
+	byWeak := make(map[uint32][]int64, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		byWeak[b.Weak] = append(byWeak[b.Weak], int64(i))
+	}
+	// match returns the stored block holding the window [pos, pos+n), or -1.
+	window := make([]byte, bs)
+	match := func(pos, n int64, a, b uint32) (int64, error) {
+		candidates := byWeak[weak(a, b)]
+		if len(candidates) == 0 {
+			return -1, nil
+		}
+		if _, err := r.ReadAt(window[:n], pos); err != nil && err != io.EOF {
+			return -1, err
+		}
+		sum := sha256.Sum256(window[:n])
+		strong := hex.EncodeToString(sum[:16])
+		for _, i := range candidates {
+			blockLen := bs
+			if i == int64(len(sig.Blocks))-1 {
+				blockLen = lastLen
+			}
+			if blockLen == n && sig.Blocks[i].Strong == strong {
+				return i, nil
+			}
+		}
+		return -1, nil
+	}
+
+	bw := bufio.NewWriterSize(w, 1<<20)
+	e := &deltaEncoder{w: bw, r: r}
+	file := sha256.New()
+	// in reads the byte entering the window, out the one leaving it.
+	in := bufio.NewReaderSize(io.TeeReader(io.NewSectionReader(r, 0, size), file), 1<<20)
+	out := bufio.NewReaderSize(io.NewSectionReader(r, 0, size), 1<<20)
+	fill := func(pos int64) (int64, uint32, uint32, error) {
+		n := min(bs, size-pos)
+		if _, err := io.ReadFull(in, window[:n]); err != nil {
+			return 0, 0, 0, err
+		}
+		a, b := weakSum(window[:n])
+		return n, a, b, nil
+	}
+
+	var pos, from int64 // window start, start of the bytes not yet sent
+	n, a, b, err := fill(0)
+	for err == nil && n > 0 {
+		var block int64
+		if block, err = match(pos, n, a, b); err != nil {
+			break
+		}
+		if block >= 0 {
+			if err = e.insert(from, pos); err != nil {
+				break
+			}
+			e.copyBlock(block)
+			if _, err = out.Discard(int(n)); err != nil {
+				break
+			}
+			pos += n
+			from = pos
+			n, a, b, err = fill(pos)
+			continue
+		}
+		// Roll one byte: drop the first byte and, unless at the end of r,
+		// take in the next.
+		var c byte
+		if c, err = out.ReadByte(); err != nil {
+			break
+		}
+		a -= uint32(c)
+		b -= uint32(n) * uint32(c)
+		n--
+		pos++
+		if pos+n < size {
+			if c, err = in.ReadByte(); err != nil {
+				break
+			}
+			a += uint32(c)
+			b += a
+			n++
+		}
+	}
+	if err == nil {
+		err = e.insert(from, size)
+	}
+	if err == nil {
+		e.flushCopy()
+		err = bw.Flush()
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return e.literal, hex.EncodeToString(file.Sum(nil)), nil
+}
+
+// UploadFileDelta sends the file at path under its base name, as
+// UploadDelta does.
+func (u *Uploader) UploadFileDelta(ctx context.Context, path string) (*Result, error) {
+	f, fi, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return u.UploadDelta(ctx, fi.Name(), f, fi.Size())
+}
+
+// UploadDelta stores size bytes of r as the new version of name on a
+// server with DELTA_UPLOAD, sending only what is not in the stored
+// version: it fetches the stored file's signature, writes a delta of
+// block copies and new bytes to a temp file, and POSTs it to
+// /files/{name}/patch, retried like a chunk. When the server has no file
+// called name, r is uploaded whole with Upload. Result.Reused counts the
+// bytes taken from the stored version.
+func (u *Uploader) UploadDelta(ctx context.Context, name string, r io.ReaderAt, size int64) (*Result, error) {
+	sig, err := u.Client.Signature(ctx, name)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound && apiErr.Code == "NOT_FOUND" {
+		return u.Upload(ctx, name, io.NewSectionReader(r, 0, size), size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "delta-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	literal, hash, err := writeDelta(tmp, r, size, sig)
+	if err != nil {
+		return nil, err
+	}
+	deltaSize, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if u.Progress != nil {
+		u.Progress(size-literal, size)
+	}
+
+	q := url.Values{"fileSize": {strconv.FormatInt(size, 10)}, "blockSize": {strconv.FormatInt(sig.BlockSize, 10)}, "hash": {hash}}
+	resp, err := u.Client.retry(ctx, func() (*successResponse, error) {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+			u.Client.BaseURL+"/files/"+url.PathEscape(name)+"/patch?"+q.Encode(), io.NopCloser(tmp))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = deltaSize
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("If-Match", sig.ETag)
+		resp, err := u.Client.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var out successResponse
+		if err := decode(resp, &out); err != nil {
+			return nil, err
+		}
+		return &out, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u.Progress != nil {
+		u.Progress(size, size)
+	}
+	return &Result{Path: resp.Path, Hash: hash, Size: size, Reused: size - literal, ExpiresAt: resp.ExpiresAt, VersionID: resp.VersionID}, nil
+}
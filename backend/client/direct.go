@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DirectUpload is a direct upload started by POST /upload/direct: the
+// parts go to the pre-signed URLs, straight to the server's bucket.
+type DirectUpload struct {
+	UploadID     string       `json:"uploadID"`
+	PartSize     int64        `json:"partSize"`
+	TotalParts   int          `json:"totalParts"`
+	Parts        []DirectPart `json:"parts"`
+	URLsExpireAt time.Time    `json:"urlsExpireAt"`
+}
+
+// DirectPart is where to PUT bytes (PartNumber-1)*PartSize onward.
+type DirectPart struct {
+	PartNumber int    `json:"partNumber"`
+	URL        string `json:"url"`
+}
+
+// CompletedPart is a part stored in the bucket, with the ETag it got.
+type CompletedPart struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+// UploadDirect uploads size bytes of r as name through a server with
+// DIRECT_UPLOAD: the server only hands out part URLs and completes the
+// upload, so the bytes never pass through it. Parts are retried like
+// chunks; on failure the session is aborted.
+func (c *Client) UploadDirect(ctx context.Context, name string, r io.ReaderAt, size int64) (*Result, error) {
+	var up DirectUpload
+	form := url.Values{"fileName": {name}, "fileSize": {strconv.FormatInt(size, 10)}}
+	if err := c.call(ctx, http.MethodPost, "/upload/direct", form, &up); err != nil {
+		return nil, err
+	}
+	parts, hash, err := c.putParts(ctx, &up, r, size)
+	if err != nil {
+		c.Abort(context.WithoutCancel(ctx), up.UploadID)
+		return nil, err
+	}
+
+	body, err := json.Marshal(map[string][]CompletedPart{"parts": parts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/upload/"+url.PathEscape(up.UploadID)+"/complete", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var out successResponse
+	if err := decode(resp, &out); err != nil {
+		return nil, err
+	}
+	return &Result{Path: out.Path, Hash: hash, Size: size, ExpiresAt: out.ExpiresAt}, nil
+}
+
+// putParts sends every part of up in order, fetching fresh URLs once they
+// have expired, and returns the parts with their ETags and the hex
+// SHA-256 of the file.
+func (c *Client) putParts(ctx context.Context, up *DirectUpload, r io.ReaderAt, size int64) ([]CompletedPart, string, error) {
+	h := sha256.New()
+	parts := make([]CompletedPart, 0, up.TotalParts)
+	buf := make([]byte, up.PartSize)
+	for i := range up.TotalParts {
+		if time.Until(up.URLsExpireAt) < time.Minute {
+			if err := c.call(ctx, http.MethodGet, "/upload/"+url.PathEscape(up.UploadID)+"/parts", nil, up); err != nil {
+				return nil, "", err
+			}
+		}
+		off := int64(i) * up.PartSize
+		part := buf[:min(up.PartSize, size-off)]
+		if _, err := r.ReadAt(part, off); err != nil && err != io.EOF {
+			return nil, "", err
+		}
+		h.Write(part)
+		var etag string
+		_, err := c.retry(ctx, func() (*successResponse, error) {
+			var err error
+			etag, err = c.putPart(ctx, up.Parts[i].URL, part)
+			return nil, err
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		parts = append(parts, CompletedPart{PartNumber: up.Parts[i].PartNumber, ETag: etag})
+	}
+	return parts, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// putPart PUTs one part to its pre-signed URL, without credentials: the
+// URL carries its own.
+func (c *Client) putPart(ctx context.Context, partURL string, part []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, partURL, bytes.NewReader(part))
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &APIError{StatusCode: resp.StatusCode, Message: "object store: " + resp.Status}
+	}
+	return resp.Header.Get("ETag"), nil
+}
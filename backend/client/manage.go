@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadInfo is one entry of GET /uploads: an unfinished upload or a
+// completed file.
+type UploadInfo struct {
+	ID          string     `json:"id"`
+	FileName    string     `json:"fileName"`
+	Status      string     `json:"status"` // in_progress or complete
+	Owner       string     `json:"owner,omitempty"`
+	Size        int64      `json:"size"`
+	FileSize    int64      `json:"fileSize,omitempty"`
+	TotalChunks int        `json:"totalChunks,omitempty"`
+	CreatedAt   *time.Time `json:"createdAt,omitempty"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	ContentType string     `json:"contentType,omitempty"` // sniffed by the server, for completed files
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`   // when the server deletes it
+
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"` // of completed images, when the server makes them
+}
+
+// Thumbnail is a scaled-down JPEG copy of a completed image.
+type Thumbnail struct {
+	Size string `json:"size"` // the box it fits in, WxH
+	URL  string `json:"url"`  // relative to the server's base URL
+}
+
+// Processing is the transcoding job of a completed video (GET
+// /uploads/{id}/processing).
+type Processing struct {
+	ID         string            `json:"id"`
+	State      string            `json:"state"` // queued, running, done or failed
+	Presets    []string          `json:"presets"`
+	Outputs    []TranscodeOutput `json:"outputs,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	QueuedAt   time.Time         `json:"queuedAt"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+}
+
+// TranscodeOutput is one rendition of a video, in one preset.
+type TranscodeOutput struct {
+	Preset string `json:"preset"`
+	Size   int64  `json:"size"`
+	URL    string `json:"url"` // relative to the server's base URL
+}
+
+// SignedURL is a download link that needs no credentials (POST
+// /files/{name}/sign).
+type SignedURL struct {
+	URL       string    `json:"url"` // relative to the server's base URL
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// UploadList is one page of GET /uploads.
+type UploadList struct {
+	Uploads []UploadInfo `json:"uploads"`
+	Total   int          `json:"total"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+}
+
+// ListOptions filter and page List; zero values are left to the server.
+type ListOptions struct {
+	Status string // in_progress or complete
+	Owner  string
+	Offset int
+	Limit  int
+}
+
+// Status is the state of an upload session (GET /upload/{uploadID}/status).
+type Status struct {
+	UploadID       string     `json:"uploadID"`
+	FileName       string     `json:"fileName"`
+	TotalChunks    int        `json:"totalChunks"`
+	FileSize       int64      `json:"fileSize"`
+	Received       int64      `json:"received"`
+	ReceivedChunks []int      `json:"receivedChunks"`
+	MissingChunks  []int      `json:"missingChunks"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"` // when an unfinished session is dropped
+	Retention      string     `json:"retention,omitempty"` // how long the completed file is kept
+	PausedAt       *time.Time `json:"pausedAt,omitempty"`  // set while the session is paused
+}
+
+// ServerConfig is the chunk sizes and limits the server wants (GET
+// /upload/config); zero limits are off.
+type ServerConfig struct {
+	ChunkSize    int64 `json:"chunkSize"` // suggested
+	MinChunkSize int64 `json:"minChunkSize"`
+	MaxChunkSize int64 `json:"maxChunkSize"`
+	MaxParallel  int   `json:"maxParallel"` // requests in flight per client
+	MaxFileSize  int64 `json:"maxFileSize"`
+
+	Encodings []string `json:"encodings"` // Content-Encodings chunks may be sent with
+
+	ChunkDedup  bool `json:"chunkDedup"`  // the /chunks endpoints of Uploader.UploadDedup are on
+	DeltaUpload bool `json:"deltaUpload"` // the signature and patch endpoints of Uploader.UploadDelta are on
+	Versioning  bool `json:"versioning"`  // uploads keep the files they replace; see Client.Versions
+}
+
+// FileVersion is one version of a stored file, as GET
+// /files/{name}/versions lists them.
+type FileVersion struct {
+	VersionID   string     `json:"versionId"` // "" for a file stored before the server kept versions
+	Size        int64      `json:"size"`
+	ContentType string     `json:"contentType"`
+	StoredAt    time.Time  `json:"storedAt"`
+	ReplacedAt  *time.Time `json:"replacedAt"` // nil for the current version
+	Current     bool       `json:"current"`
+}
+
+// VerifyResult is the server's audit of a stored file (POST /upload/verify).
+type VerifyResult struct {
+	FileName string `json:"fileName"`
+	Status   string `json:"status"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+	Match    *bool  `json:"match"` // nil when no hash was sent
+}
+
+// List returns one page of uploads visible to the caller.
+func (c *Client) List(ctx context.Context, opts ListOptions) (*UploadList, error) {
+	q := url.Values{}
+	if opts.Status != "" {
+		q.Set("status", opts.Status)
+	}
+	if opts.Owner != "" {
+		q.Set("owner", opts.Owner)
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var out UploadList
+	if err := c.call(ctx, http.MethodGet, "/uploads?"+q.Encode(), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Get returns one upload or completed file by its ID.
+func (c *Client) Get(ctx context.Context, id string) (*UploadInfo, error) {
+	var out UploadInfo
+	if err := c.call(ctx, http.MethodGet, "/uploads/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Delete discards an unfinished upload or removes a completed file.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, "/uploads/"+url.PathEscape(id), nil, nil)
+}
+
+// Processing returns the transcoding job of the completed file id; it
+// fails with a 404 APIError when the file is not a video or the server
+// does not transcode.
+func (c *Client) Processing(ctx context.Context, id string) (*Processing, error) {
+	var out Processing
+	if err := c.call(ctx, http.MethodGet, "/uploads/"+url.PathEscape(id)+"/processing", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Sign asks for a signed download URL of the completed file name, to
+// share without credentials; expiresIn 0 takes the server's default.
+func (c *Client) Sign(ctx context.Context, name string, expiresIn time.Duration) (*SignedURL, error) {
+	form := url.Values{}
+	if expiresIn > 0 {
+		form.Set("expiresIn", expiresIn.String())
+	}
+	var out SignedURL
+	if err := c.call(ctx, http.MethodPost, "/files/"+url.PathEscape(name)+"/sign", form, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Abort cancels an unfinished upload session, deleting what it stored,
+// e.g. when the user gives up on a file. Unlike Delete it needs only the
+// upload permission.
+func (c *Client) Abort(ctx context.Context, uploadID string) error {
+	return c.call(ctx, http.MethodDelete, "/upload/"+url.PathEscape(uploadID), nil, nil)
+}
+
+// Config returns the server's chunk sizes and limits, e.g. to set
+// Uploader.ChunkSize and Concurrency.
+func (c *Client) Config(ctx context.Context) (*ServerConfig, error) {
+	var out ServerConfig
+	if err := c.call(ctx, http.MethodGet, "/upload/config", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Status lists the chunks the server holds for an upload session.
+func (c *Client) Status(ctx context.Context, uploadID string) (*Status, error) {
+	var out Status
+	if err := c.call(ctx, http.MethodGet, "/upload/"+url.PathEscape(uploadID)+"/status", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Pause stops an upload session: the server saves which chunks it holds
+// and refuses more until Resume, which may be called later from another
+// process with the same uploadID.
+func (c *Client) Pause(ctx context.Context, uploadID string) (*Status, error) {
+	var out Status
+	if err := c.call(ctx, http.MethodPost, "/upload/"+url.PathEscape(uploadID)+"/pause", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Resume lets a paused session take chunks again. The returned status's
+// MissingChunks are the chunks left to send.
+func (c *Client) Resume(ctx context.Context, uploadID string) (*Status, error) {
+	var out Status
+	if err := c.call(ctx, http.MethodPost, "/upload/"+url.PathEscape(uploadID)+"/resume", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Verify has the server re-hash the stored file name and compare it with
+// hash, the hex SHA-256 the caller expects.
+func (c *Client) Verify(ctx context.Context, name, hash string) (*VerifyResult, error) {
+	form := url.Values{"fileName": {name}, "hash": {hash}}
+	var out VerifyResult
+	if err := c.call(ctx, http.MethodPost, "/upload/verify", form, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Versions lists the versions of the stored file name, newest first, on
+// a server with VERSIONING. Download one from
+// /files/{name}?version=<VersionID>.
+func (c *Client) Versions(ctx context.Context, name string) ([]FileVersion, error) {
+	var out struct {
+		Versions []FileVersion `json:"versions"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/files/"+url.PathEscape(name)+"/versions", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Versions, nil
+}
+
+// call sends a request with form as its urlencoded body, when not nil, and
+// decodes a 200 response into out. A 204 is accepted when out is nil.
+func (c *Client) call(ctx context.Context, method, path string, form url.Values, out any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if out == nil && resp.StatusCode == http.StatusNoContent {
+		resp.Body.Close()
+		return nil
+	}
+	return decode(resp, out)
+}
@@ -0,0 +1,296 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultChunkSize   = 5 << 20
+	DefaultConcurrency = 4
+)
+
+// Uploader sends files as an upload session (POST /upload/init), one raw
+// PUT per chunk with up to Concurrency chunks in flight. The server writes
+// each chunk at its offset, so they may arrive in any order.
+type Uploader struct {
+	Client      *Client
+	ChunkSize   int64 // bytes per chunk; must match when resuming
+	Concurrency int   // chunks in flight at once
+
+	// Retention asks the server to delete the file this long after it is
+	// stored; 0 leaves it to the server.
+	Retention time.Duration
+
+	// Compress gzips each chunk (Content-Encoding: gzip), which pays off
+	// for text such as CSVs and logs on slow links. Chunks gzip does not
+	// shrink are sent as they are.
+	Compress bool
+
+	// Extract asks the server to unpack the uploaded zip once it is
+	// stored, under ExtractTo or by default the archive's name without
+	// its extension. Result.Extracted lists the files.
+	Extract   bool
+	ExtractTo string
+
+	// Progress, when set, is called after every stored chunk with the
+	// bytes the server holds so far. Calls never overlap.
+	Progress func(sent, total int64)
+}
+
+// NewUploader returns an Uploader for c with the default chunk size and
+// concurrency.
+func NewUploader(c *Client) *Uploader {
+	return &Uploader{Client: c, ChunkSize: DefaultChunkSize, Concurrency: DefaultConcurrency}
+}
+
+// IncompleteError is returned when an upload stops part way. Pass UploadID
+// to Uploader.Resume, or for Client.Upload to Client.ResumeUpload, with the
+// same content to send the missing chunks.
+type IncompleteError struct {
+	UploadID string
+	Err      error
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("upload %s incomplete: %v", e.UploadID, e.Err)
+}
+
+func (e *IncompleteError) Unwrap() error { return e.Err }
+
+type initResponse struct {
+	UploadID string `json:"uploadID"`
+}
+
+// UploadFile sends the file at path under its base name.
+func (u *Uploader) UploadFile(ctx context.Context, path string) (*Result, error) {
+	f, fi, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return u.Upload(ctx, filepath.Base(path), f, fi.Size())
+}
+
+// Upload reads size bytes from r and stores them as name. On failure after
+// the session was created the error is an *IncompleteError.
+func (u *Uploader) Upload(ctx context.Context, name string, r io.Reader, size int64) (*Result, error) {
+	if err := u.check(size); err != nil {
+		return nil, err
+	}
+	total := u.totalChunks(size)
+	form := url.Values{"fileName": {name}, "totalChunks": {strconv.Itoa(total)}, "fileSize": {strconv.FormatInt(size, 10)}}
+	if u.Retention > 0 {
+		form.Set("retention", u.Retention.String())
+	}
+	if u.Extract {
+		form.Set("extract", "true")
+		if u.ExtractTo != "" {
+			form.Set("extractTo", u.ExtractTo)
+		}
+	}
+	var init initResponse
+	if err := u.Client.call(ctx, http.MethodPost, "/upload/init", form, &init); err != nil {
+		return nil, err
+	}
+	return u.send(ctx, init.UploadID, r, size, total, nil, 0)
+}
+
+// ResumeFile continues the upload of the file at path.
+func (u *Uploader) ResumeFile(ctx context.Context, uploadID, path string) (*Result, error) {
+	f, fi, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return u.Resume(ctx, uploadID, f, fi.Size())
+}
+
+// Resume asks the server (GET /upload/{uploadID}/status) which chunks of
+// uploadID it already has and sends the rest. r must yield the same
+// content as the interrupted upload; chunks already stored are read and
+// skipped.
+func (u *Uploader) Resume(ctx context.Context, uploadID string, r io.Reader, size int64) (*Result, error) {
+	if err := u.check(size); err != nil {
+		return nil, err
+	}
+	st, err := u.Client.Status(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	total := u.totalChunks(size)
+	if st.TotalChunks != total || st.FileSize != size {
+		return nil, fmt.Errorf("upload: session %s has %d chunks of a %d byte file, want %d of %d; use the same content and ChunkSize",
+			uploadID, st.TotalChunks, st.FileSize, total, size)
+	}
+	have := make(map[int]bool, len(st.ReceivedChunks))
+	for _, i := range st.ReceivedChunks {
+		have[i] = true
+	}
+	return u.send(ctx, uploadID, r, size, total, have, st.Received)
+}
+
+func (u *Uploader) check(size int64) error {
+	if u.ChunkSize <= 0 {
+		return errors.New("upload: ChunkSize must be positive")
+	}
+	if size < 0 {
+		return errors.New("upload: size must not be negative")
+	}
+	return nil
+}
+
+func (u *Uploader) totalChunks(size int64) int {
+	return max(1, int((size+u.ChunkSize-1)/u.ChunkSize)) // empty files still need one (empty) chunk
+}
+
+type chunk struct {
+	index int
+	data  []byte
+}
+
+// send reads r chunk by chunk, skipping the indices in have, and hands the
+// chunks to Concurrency workers. Only the chunks in flight are held in
+// memory.
+func (u *Uploader) send(ctx context.Context, id string, r io.Reader, size int64, total int, have map[int]bool, sent int64) (*Result, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		mu   sync.Mutex
+		done *successResponse
+		wg   sync.WaitGroup
+	)
+	jobs := make(chan chunk)
+	for range max(1, u.Concurrency) {
+		wg.Go(func() {
+			for c := range jobs {
+				resp, err := u.Client.retry(ctx, func() (*successResponse, error) {
+					return u.sendChunk(ctx, id, total, c)
+				})
+				if err != nil {
+					cancel(fmt.Errorf("chunk %d/%d: %w", c.index+1, total, err))
+					continue
+				}
+				mu.Lock()
+				if resp.Done {
+					done = resp
+				}
+				sent += int64(len(c.data))
+				if u.Progress != nil {
+					u.Progress(sent, size)
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	if u.Progress != nil && sent > 0 {
+		u.Progress(sent, size)
+	}
+
+	h := sha256.New()
+	readErr := func() error {
+		defer close(jobs)
+		for i := range total {
+			buf := make([]byte, min(u.ChunkSize, size-int64(i)*u.ChunkSize))
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return fmt.Errorf("read chunk %d/%d: %w", i+1, total, err)
+			}
+			h.Write(buf)
+			if have[i] {
+				continue
+			}
+			select {
+			case jobs <- chunk{i, buf}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	}()
+	wg.Wait()
+
+	err := readErr
+	if err == nil {
+		err = context.Cause(ctx)
+	}
+	if err == nil && done == nil {
+		err = errors.New("server did not report completion")
+	}
+	if err != nil {
+		return nil, &IncompleteError{UploadID: id, Err: err}
+	}
+	return &Result{Path: done.Path, Hash: hex.EncodeToString(h.Sum(nil)), Size: size, ExpiresAt: done.ExpiresAt,
+		Extracted: done.Extracted, VersionID: done.VersionID}, nil
+}
+
+// sendChunk PUTs one chunk with its SHA-256, of the bytes before any
+// compression. X-Upload-ChunkSize makes the server write it at
+// index*ChunkSize, whatever order the chunks arrive in.
+func (u *Uploader) sendChunk(ctx context.Context, id string, total int, c chunk) (*successResponse, error) {
+	body, encoding := c.data, ""
+	if u.Compress {
+		if gz := gzipped(c.data); len(gz) < len(body) {
+			body, encoding = gz, "gzip"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		fmt.Sprintf("%s/upload/%s/chunk/%d", u.Client.BaseURL, url.PathEscape(id), c.index), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(c.data)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	req.Header.Set("X-Upload-ChecksumAlgo", "sha256")
+	req.Header.Set("X-Upload-ChunkHash", hex.EncodeToString(sum[:]))
+	if total > 1 {
+		req.Header.Set("X-Upload-ChunkSize", strconv.FormatInt(u.ChunkSize, 10))
+	}
+	resp, err := u.Client.do(req)
+	if err != nil {
+		return nil, err
+	}
+	var out successResponse
+	if err := decode(resp, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// gzipped returns data compressed with gzip.
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data) // writes to a bytes.Buffer do not fail
+	zw.Close()
+	return buf.Bytes()
+}
+
+func openFile(path string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
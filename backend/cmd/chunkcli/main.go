@@ -0,0 +1,513 @@
+// Command chunkcli uploads files to a chunk-upload server and manages the
+// uploads stored there.
+//
+//	chunkcli [-server URL] [-api-key KEY | -token JWT] <command> [flags] [args]
+//
+// Commands:
+//
+//	upload [-chunk-size 5MiB] [-parallel 4] [-retries 3] [-resume ID] [-extract] [-verify] [-quiet] FILE|DIR...
+//	list   [-status in_progress|complete] [-owner USER] [-offset N] [-limit N] [-json]
+//	status [-json] ID
+//	delete ID...
+//
+// The global flags default to $CHUNK_SERVER, $CHUNK_API_KEY and
+// $CHUNK_TOKEN.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/client"
+)
+
+// Exit codes.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usage = `usage: chunkcli [-server URL] [-api-key KEY | -token JWT] <command> [flags] [args]
+
+commands:
+  upload FILE...   upload files (chunkcli upload -h for flags)
+  list             list unfinished uploads and completed files
+  status ID        show one upload, and the missing chunks of a session
+  delete ID...     discard unfinished uploads or remove completed files
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes one command line and returns the exit code.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("chunkcli", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage, "\nglobal flags:\n")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", envOr("CHUNK_SERVER", client.DefaultBaseURL), "server URL ($CHUNK_SERVER)")
+	apiKey := fs.String("api-key", os.Getenv("CHUNK_API_KEY"), "API key, sent as X-API-Key ($CHUNK_API_KEY)")
+	token := fs.String("token", os.Getenv("CHUNK_TOKEN"), "bearer token ($CHUNK_TOKEN)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := client.New(*server)
+	c.APIKey, c.Token = *apiKey, *token
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "upload":
+		return upload(ctx, c, args, stdout, stderr)
+	case "list":
+		return list(ctx, c, args, stdout, stderr)
+	case "status":
+		return status(ctx, c, args, stdout, stderr)
+	case "delete":
+		return remove(ctx, c, args, stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "chunkcli: unknown command %q\n\n", cmd)
+	fs.Usage()
+	return exitUsage
+}
+
+func upload(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("upload", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, "usage: chunkcli upload [flags] FILE|DIR...\n\n")
+		fs.PrintDefaults()
+	}
+	chunkSize := sizeFlag(client.DefaultChunkSize)
+	fs.Var(&chunkSize, "chunk-size", "chunk size, e.g. 512KiB or 8MiB; must match when resuming")
+	parallel := fs.Int("parallel", client.DefaultConcurrency, "chunks in flight at once")
+	retries := fs.Int("retries", client.DefaultMaxRetries, "retries per chunk on network errors, 429 and 5xx")
+	resume := fs.String("resume", "", "continue the upload session or batch `ID` instead of starting a new one (one FILE or DIR only)")
+	var retention daysFlag
+	fs.Var(&retention, "retention", "ask the server to delete the files after this long, e.g. 36h or 7d")
+	compress := fs.Bool("compress", false, "gzip chunks on the wire; worth it for text such as CSVs and logs")
+	extract := fs.Bool("extract", false, "have the server unpack each uploaded zip next to it")
+	dedup := fs.Bool("dedup", false, "cut files into content-defined chunks and send only those the server lacks (needs CHUNK_DEDUP; not for DIR)")
+	delta := fs.Bool("delta", false, "send only what changed since the stored version of each file (needs DELTA_UPLOAD; not for DIR)")
+	verify := fs.Bool("verify", false, "have the server re-hash each stored file and compare it with the local SHA-256 (not for DIR)")
+	quiet := fs.Bool("quiet", false, "no progress bar")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	files := fs.Args()
+	if len(files) == 0 || (*resume != "" && (len(files) != 1 || *dedup || *delta)) || (*dedup && *delta) || *parallel <= 0 || chunkSize <= 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	c.MaxRetries = *retries
+	u := client.NewUploader(c)
+	u.ChunkSize, u.Concurrency = int64(chunkSize), *parallel
+	u.Retention = time.Duration(retention)
+	u.Compress = *compress
+	u.Extract = *extract
+	showBar := !*quiet && isTerminal(stderr)
+
+	code := exitOK
+	for _, file := range files {
+		name := filepath.Base(file)
+		bar := &progressBar{w: stderr, name: name, start: time.Now()}
+		u.Progress = nil
+		if showBar {
+			u.Progress = bar.update
+		}
+		if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+			if !uploadDir(ctx, u, file, *resume, int64(chunkSize), bar, stdout, stderr) {
+				code = exitError
+			}
+			continue
+		}
+		var res *client.Result
+		var err error
+		switch {
+		case *resume != "":
+			res, err = u.ResumeFile(ctx, *resume, file)
+		case *dedup:
+			res, err = u.UploadFileDedup(ctx, file)
+		case *delta:
+			res, err = u.UploadFileDelta(ctx, file)
+		default:
+			res, err = u.UploadFile(ctx, file)
+		}
+		if showBar {
+			bar.finish()
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "chunkcli: %s: %v\n", file, err)
+			var inc *client.IncompleteError
+			if errors.As(err, &inc) {
+				fmt.Fprintf(stderr, "chunkcli: resume with: chunkcli upload -chunk-size %d -resume %s %s\n", chunkSize, inc.UploadID, file)
+			}
+			code = exitError
+			continue
+		}
+		if *verify {
+			stored := name
+			if res.Path != "" {
+				stored = path.Base(filepath.ToSlash(res.Path))
+			}
+			v, err := c.Verify(ctx, stored, res.Hash)
+			if err == nil && (v.Match == nil || !*v.Match) {
+				err = fmt.Errorf("stored file has SHA-256 %s, local file %s", v.Hash, res.Hash)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "chunkcli: %s: verify: %v\n", file, err)
+				code = exitError
+				continue
+			}
+		}
+		line := fmt.Sprintf("%s\t%s\t%s\tsha256:%s", file, res.Path, formatBytes(res.Size), res.Hash)
+		if *dedup || *delta {
+			line += "\treused " + formatBytes(res.Reused)
+		}
+		if res.ExpiresAt != nil {
+			line += "\texpires " + res.ExpiresAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintln(stdout, line)
+		for _, f := range res.Extracted {
+			fmt.Fprintf(stdout, "  %s\t%s\t%s\n", f.Path, f.FileName, formatBytes(f.Size))
+		}
+	}
+	return code
+}
+
+// uploadDir sends the files under dir as one batch, or resumes batch
+// resume, and prints a line per stored file.
+func uploadDir(ctx context.Context, u *client.Uploader, dir, resume string, chunkSize int64, bar *progressBar, stdout, stderr io.Writer) bool {
+	var m *client.Manifest
+	var err error
+	if resume != "" {
+		m, err = u.ResumeDir(ctx, resume, dir)
+	} else {
+		m, err = u.UploadDir(ctx, dir)
+	}
+	if u.Progress != nil {
+		bar.finish()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "chunkcli: %s: %v\n", dir, err)
+		var inc *client.IncompleteError
+		if errors.As(err, &inc) {
+			fmt.Fprintf(stderr, "chunkcli: resume with: chunkcli upload -chunk-size %d -resume %s %s\n", chunkSize, inc.UploadID, dir)
+		}
+		return false
+	}
+	for _, f := range m.Files {
+		fmt.Fprintf(stdout, "%s\t%s\t%s\n", filepath.Join(dir, filepath.FromSlash(f.Path)), f.Stored, formatBytes(f.Size))
+	}
+	return true
+}
+
+func list(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts client.ListOptions
+	fs.StringVar(&opts.Status, "status", "", "only in_progress or complete uploads")
+	fs.StringVar(&opts.Owner, "owner", "", "only uploads of this user")
+	fs.IntVar(&opts.Offset, "offset", 0, "skip this many uploads")
+	fs.IntVar(&opts.Limit, "limit", 0, "at most this many uploads (server default 100)")
+	asJSON := fs.Bool("json", false, "print the server's JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	page, err := c.List(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "chunkcli: list: %v\n", err)
+		return exitError
+	}
+	if *asJSON {
+		return printJSON(stdout, stderr, page)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tSIZE\tOWNER\tUPDATED\tEXPIRES")
+	for _, u := range page.Uploads {
+		size := formatBytes(u.Size)
+		if u.Status != "complete" && u.FileSize > 0 {
+			size += " / " + formatBytes(u.FileSize)
+		}
+		expires := "-"
+		if u.ExpiresAt != nil {
+			expires = u.ExpiresAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", u.ID, u.FileName, u.Status, size, u.Owner,
+			u.UpdatedAt.Local().Format(time.DateTime), expires)
+	}
+	tw.Flush()
+	if shown := page.Offset + len(page.Uploads); shown < page.Total {
+		fmt.Fprintf(stderr, "%d of %d shown; next page: -offset %d\n", len(page.Uploads), page.Total, shown)
+	}
+	return exitOK
+}
+
+func status(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	asJSON := fs.Bool("json", false, "print the server's JSON")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprint(stderr, "usage: chunkcli status [-json] ID\n")
+		return exitUsage
+	}
+	id := fs.Arg(0)
+
+	info, err := c.Get(ctx, id)
+	if err != nil {
+		fmt.Fprintf(stderr, "chunkcli: status: %v\n", err)
+		return exitError
+	}
+	// Only sessions have a chunk list; tus and session-less uploads do not.
+	var st *client.Status
+	if info.Status != "complete" {
+		st, _ = c.Status(ctx, id)
+	}
+	if *asJSON {
+		return printJSON(stdout, stderr, struct {
+			*client.UploadInfo
+			Chunks *client.Status `json:"chunks,omitempty"`
+		}{info, st})
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", info.ID)
+	fmt.Fprintf(tw, "Name:\t%s\n", info.FileName)
+	fmt.Fprintf(tw, "Status:\t%s\n", info.Status)
+	if info.Owner != "" {
+		fmt.Fprintf(tw, "Owner:\t%s\n", info.Owner)
+	}
+	size := formatBytes(info.Size)
+	if info.Status != "complete" && info.FileSize > 0 {
+		size += fmt.Sprintf(" of %s (%.0f%%)", formatBytes(info.FileSize), 100*float64(info.Size)/float64(info.FileSize))
+	}
+	fmt.Fprintf(tw, "Size:\t%s\n", size)
+	if info.ContentType != "" {
+		fmt.Fprintf(tw, "Type:\t%s\n", info.ContentType)
+	}
+	if info.CreatedAt != nil {
+		fmt.Fprintf(tw, "Created:\t%s\n", info.CreatedAt.Local().Format(time.DateTime))
+	}
+	fmt.Fprintf(tw, "Updated:\t%s\n", info.UpdatedAt.Local().Format(time.DateTime))
+	if info.ExpiresAt != nil {
+		fmt.Fprintf(tw, "Expires:\t%s\n", info.ExpiresAt.Local().Format(time.DateTime))
+	}
+	if st != nil {
+		fmt.Fprintf(tw, "Chunks:\t%d of %d received\n", len(st.ReceivedChunks), st.TotalChunks)
+		if len(st.MissingChunks) > 0 {
+			fmt.Fprintf(tw, "Missing:\t%s\n", formatRanges(st.MissingChunks))
+		}
+	}
+	tw.Flush()
+	return exitOK
+}
+
+func remove(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, "usage: chunkcli delete ID...\n")
+		return exitUsage
+	}
+	code := exitOK
+	for _, id := range args {
+		if err := c.Delete(ctx, id); err != nil {
+			fmt.Fprintf(stderr, "chunkcli: delete %s: %v\n", id, err)
+			code = exitError
+			continue
+		}
+		fmt.Fprintf(stdout, "deleted %s\n", id)
+	}
+	return code
+}
+
+func printJSON(stdout, stderr io.Writer, v any) int {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(stderr, "chunkcli: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// isTerminal reports whether w is a character device, where a redrawn
+// progress bar makes sense.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// daysFlag is a duration that also accepts whole days, e.g. 7d.
+type daysFlag time.Duration
+
+func (d *daysFlag) String() string { return time.Duration(*d).String() }
+
+func (d *daysFlag) Set(v string) error {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*d = daysFlag(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	t, err := time.ParseDuration(v)
+	if err != nil || t <= 0 {
+		return fmt.Errorf("invalid duration %q", v)
+	}
+	*d = daysFlag(t)
+	return nil
+}
+
+// sizeFlag is a byte count written as 1048576, 512K, 512KiB, 8M or 1GB
+// (the units are powers of 1024).
+type sizeFlag int64
+
+func (s *sizeFlag) String() string { return formatBytes(int64(*s)) }
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
+
+func parseSize(v string) (int64, error) {
+	num := strings.TrimRight(v, "KMGTiBkmgtb")
+	unit := strings.ToUpper(v[len(num):])
+	if u, ok := strings.CutSuffix(unit, "IB"); ok {
+		unit = u
+	} else {
+		unit = strings.TrimSuffix(unit, "B")
+	}
+	shift := 0
+	if unit != "" {
+		shift = strings.Index("KMGT", unit) + 1
+		if len(unit) > 1 || shift == 0 {
+			return 0, fmt.Errorf("invalid size %q", v)
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(num), 10, 64)
+	if err != nil || n < 0 || n > 1<<62>>(10*shift) {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return n << (10 * shift), nil
+}
+
+// formatBytes renders n with a binary unit: 512 B, 1.5 KiB, 20.0 MiB.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, unit := float64(n), 0
+	for f >= 1024 && unit < 4 {
+		f /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, "KMGT"[unit-1])
+}
+
+// formatRanges renders sorted chunk indices compactly: 0-3, 7, 9-10.
+func formatRanges(indices []int) string {
+	var b strings.Builder
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		if i == j {
+			fmt.Fprintf(&b, "%d", indices[i])
+		} else {
+			fmt.Fprintf(&b, "%d-%d", indices[i], indices[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// progressBar redraws one line on a terminal, at most every 100ms.
+type progressBar struct {
+	w           io.Writer
+	name        string
+	start, last time.Time
+	drawn       bool
+}
+
+const barWidth = 30
+
+func (p *progressBar) update(sent, total int64) {
+	now := time.Now()
+	if sent < total && now.Sub(p.last) < 100*time.Millisecond {
+		return
+	}
+	p.last, p.drawn = now, true
+	fmt.Fprintf(p.w, "\r\033[K%s", renderBar(p.name, sent, total, now.Sub(p.start)))
+}
+
+func (p *progressBar) finish() {
+	if p.drawn {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// renderBar formats: name [=========>      ]  60%  6.0 MiB / 10.0 MiB  2.1 MiB/s
+func renderBar(name string, sent, total int64, elapsed time.Duration) string {
+	frac := 1.0
+	if total > 0 {
+		frac = float64(sent) / float64(total)
+	}
+	filled := int(frac * barWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	line := fmt.Sprintf("%s [%s] %3.0f%%  %s / %s", name, bar, 100*frac, formatBytes(sent), formatBytes(total))
+	if secs := elapsed.Seconds(); secs > 0 {
+		line += fmt.Sprintf("  %s/s", formatBytes(int64(float64(sent)/secs)))
+	}
+	return line
+}
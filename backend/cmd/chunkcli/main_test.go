@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"1048576": 1 << 20, "512K": 512 << 10, "512k": 512 << 10, "8MiB": 8 << 20,
+		"8MB": 8 << 20, "1G": 1 << 30, "2 GiB": 2 << 30, "100B": 100,
+	} {
+		if got, err := parseSize(in); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "abc", "-1", "5X", "5MM", "1.5M", "99999999999T"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) succeeded", in)
+		}
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	if got := formatRanges([]int{0, 1, 2, 3, 7, 9, 10}); got != "0-3, 7, 9-10" {
+		t.Errorf("formatRanges = %q", got)
+	}
+	if got := formatBytes(1536); got != "1.5 KiB" {
+		t.Errorf("formatBytes = %q", got)
+	}
+	got := renderBar("a.bin", 6<<20, 10<<20, 2*time.Second)
+	want := "a.bin [==================>           ]  60%  6.0 MiB / 10.0 MiB  3.0 MiB/s"
+	if got != want {
+		t.Errorf("renderBar =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestListAndDelete(t *testing.T) {
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "k3y" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"code": "UNAUTHORIZED", "error": "no key"})
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/uploads":
+			if r.URL.Query().Get("status") != "complete" {
+				t.Errorf("query = %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"uploads":[{"id":"a.bin","fileName":"a.bin","status":"complete","size":2048,"updatedAt":"2026-10-15T09:00:00Z"}],"total":3,"offset":0,"limit":1}`))
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	var out, errOut bytes.Buffer
+	code := run(context.Background(), []string{"-server", srv.URL, "-api-key", "k3y", "list", "-status", "complete"}, &out, &errOut)
+	if code != exitOK || !strings.Contains(out.String(), "a.bin") || !strings.Contains(out.String(), "2.0 KiB") {
+		t.Fatalf("list: code %d, stdout %q, stderr %q", code, out.String(), errOut.String())
+	}
+	if !strings.Contains(errOut.String(), "1 of 3 shown; next page: -offset 1") {
+		t.Errorf("list stderr = %q", errOut.String())
+	}
+
+	out.Reset()
+	code = run(context.Background(), []string{"-server", srv.URL, "-api-key", "k3y", "delete", "a.bin", "b c"}, &out, &errOut)
+	if code != exitOK || len(deleted) != 2 || deleted[1] != "/uploads/b c" {
+		t.Errorf("delete: code %d, deleted %q", code, deleted)
+	}
+
+	errOut.Reset()
+	if code := run(context.Background(), []string{"-server", srv.URL, "list"}, &out, &errOut); code != exitError || !strings.Contains(errOut.String(), "UNAUTHORIZED") {
+		t.Errorf("unauthenticated list: code %d, stderr %q", code, errOut.String())
+	}
+	if code := run(context.Background(), []string{"bogus"}, &out, &errOut); code != exitUsage {
+		t.Errorf("unknown command: code %d", code)
+	}
+}
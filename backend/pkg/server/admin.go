@@ -0,0 +1,377 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// /admin: operator endpoints (stats, sessions, disk and tenant usage,
+// force-abort, purge, maintenance mode, audit log) behind ADMIN_TOKEN
+// ---------------------------------------------------------------------
+
+const (
+	// AdminTokenHeader carries ADMIN_TOKEN; API keys and JWTs do not open
+	// /admin, and ADMIN_TOKEN opens nothing else.
+	AdminTokenHeader = "X-Admin-Token"
+	MinAdminToken    = 16 // bytes
+)
+
+// maintenance is maintenance mode, shared by the process's tenants.
+type maintenance struct {
+	sync.Mutex
+	state MaintenanceState
+}
+
+// MaintenanceState is the body of GET and PUT /admin/maintenance.
+type MaintenanceState struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"` // shown in the 503
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+func (m *maintenance) get() MaintenanceState {
+	m.Lock()
+	defer m.Unlock()
+	return m.state
+}
+
+// checkMaintenance answers 503 MAINTENANCE to a request that would start
+// an upload while maintenance mode is on; uploads already started go on.
+func (s *Server) checkMaintenance(w http.ResponseWriter) bool {
+	st := s.maintenance.get()
+	if !st.Enabled {
+		return true
+	}
+	msg := st.Message
+	if msg == "" {
+		msg = "server in maintenance: no new uploads, retry later"
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(MaintenanceRetryAfter))
+	respondError(w, http.StatusServiceUnavailable, CodeMaintenance, "%s", msg)
+	return false
+}
+
+// MaintenanceRetryAfter is the Retry-After of a 503 MAINTENANCE, in
+// seconds.
+const MaintenanceRetryAfter = 60
+
+// withAdmin requires ADMIN_TOKEN in AdminTokenHeader.
+func (s *Server) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get(AdminTokenHeader)
+		if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.AdminToken)) != 1 {
+			logFor(w).Warn("admin auth denied", "present", got != "")
+			respondError(w, http.StatusUnauthorized, CodeUnauthorized, "missing or invalid %s", AdminTokenHeader)
+			return
+		}
+		tagUser(w, "admin")
+		next(w, r)
+	}
+}
+
+// adminRoutes registers the /admin endpoints through handle.
+func (s *Server) adminRoutes(handle func(pattern string, h http.HandlerFunc)) {
+	route := func(method, path string, h http.HandlerFunc) {
+		h = s.withCORS([]string{method}, s.withAdmin(h))
+		handle(method+" "+path, h)
+		handle("OPTIONS "+path, h)
+	}
+	route(http.MethodGet, "/admin/stats", s.adminStatsHandler)
+	route(http.MethodGet, "/admin/sessions", s.adminSessionsHandler)
+	route(http.MethodGet, "/admin/disk", s.adminDiskHandler)
+	route(http.MethodGet, "/admin/tenants", s.adminTenantsHandler)
+	route(http.MethodPost, "/admin/uploads/{id}/abort", s.adminAbortHandler)
+	route(http.MethodPost, "/admin/purge", s.adminPurgeHandler)
+	route(http.MethodGet, "/admin/audit", s.adminAuditHandler)
+	maintenance := s.withCORS([]string{http.MethodGet, http.MethodPut}, s.withAdmin(s.adminMaintenanceHandler))
+	handle("GET /admin/maintenance", maintenance)
+	handle("PUT /admin/maintenance", maintenance)
+	handle("OPTIONS /admin/maintenance", maintenance)
+}
+
+// AdminStats is the body of GET /admin/stats.
+type AdminStats struct {
+	StartedAt         time.Time        `json:"startedAt"`
+	UptimeSeconds     int64            `json:"uptimeSeconds"`
+	Maintenance       MaintenanceState `json:"maintenance"`
+	ChunksReceived    int64            `json:"chunksReceived"`
+	BytesWritten      int64            `json:"bytesWritten"`
+	UploadsCompleted  int64            `json:"uploadsCompleted"`
+	ActiveSessions    int              `json:"activeSessions"`
+	UploadsInProgress int              `json:"uploadsInProgress"` // with chunks received by this process
+	SlotsInUse        int              `json:"slotsInUse"`        // of MAX_CONCURRENT_UPLOADS
+	SlotsLimit        int              `json:"slotsLimit,omitempty"`
+	Janitor           AdminJanitor     `json:"janitor"`
+}
+
+// AdminJanitor is JanitorStats as JSON.
+type AdminJanitor struct {
+	Runs         int64      `json:"runs"`
+	Removed      int64      `json:"removed"`
+	FreedBytes   int64      `json:"freedBytes"`
+	Errors       int64      `json:"errors"`
+	Expired      int64      `json:"expired"`
+	ExpiredBytes int64      `json:"expiredBytes"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+}
+
+func adminJanitor(js JanitorStats) AdminJanitor {
+	a := AdminJanitor{Runs: js.Runs, Removed: js.Removed, FreedBytes: js.FreedBytes, Errors: js.Errors,
+		Expired: js.Expired, ExpiredBytes: js.ExpiredBytes}
+	if !js.LastRun.IsZero() {
+		a.LastRun = &js.LastRun
+	}
+	return a
+}
+
+func (s *Server) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics
+	m.Lock()
+	st := AdminStats{ChunksReceived: m.chunks, BytesWritten: m.bytes, UploadsCompleted: m.completed}
+	m.Unlock()
+	st.StartedAt = s.started.UTC()
+	st.UptimeSeconds = int64(s.now().Sub(s.started).Seconds())
+	st.Maintenance = s.maintenance.get()
+	for _, srv := range s.servers() {
+		st.ActiveSessions += srv.sessions.Len()
+		st.UploadsInProgress += len(srv.received.Keys())
+	}
+	if s.slots != nil {
+		st.SlotsInUse, st.SlotsLimit = len(s.slots), cap(s.slots)
+	}
+	st.Janitor = adminJanitor(s.janitorStats())
+	respondJSON(w, http.StatusOK, st)
+}
+
+// AdminSession is one entry of GET /admin/sessions.
+type AdminSession struct {
+	ID             string    `json:"id"`
+	Tenant         string    `json:"tenant,omitempty"`
+	FileName       string    `json:"fileName"`
+	FileSize       int64     `json:"fileSize,omitempty"`
+	TotalChunks    int       `json:"totalChunks,omitempty"` // 0 for tus
+	ChunksReceived int       `json:"chunksReceived"`
+	Received       int64     `json:"received"` // bytes
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+func (s *Server) adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	list := []AdminSession{}
+	for _, srv := range s.servers() {
+		for _, sess := range srv.sessions.List() {
+			a := AdminSession{ID: sess.ID, Tenant: srv.tenant, FileName: sess.FileName, FileSize: sess.FileSize,
+				TotalChunks: sess.TotalChunks, ChunksReceived: srv.received.Count(sess.ID),
+				Received: srv.received.Bytes(sess.ID), CreatedAt: sess.CreatedAt}
+			if sess.TotalChunks == 0 {
+				a.Received, _ = srv.store.PartSize(sess.ID) // tus: the offset
+			}
+			list = append(list, a)
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"sessions": list})
+}
+
+// AdminDisk is the body of GET /admin/disk. Tenants' directories are
+// inside the process's, so they are counted here too.
+type AdminDisk struct {
+	UploadDir       string `json:"uploadDir"`
+	UploadBytes     int64  `json:"uploadBytes"`
+	TempDir         string `json:"tempDir"`
+	TempBytes       int64  `json:"tempBytes"`       // 0 when TempDir is UploadDir
+	QuarantineBytes int64  `json:"quarantineBytes"` // also in uploadBytes when inside UploadDir
+	FreeBytes       int64  `json:"freeBytes"`       // -1 = unknown
+}
+
+func (s *Server) adminDiskHandler(w http.ResponseWriter, r *http.Request) {
+	d := AdminDisk{UploadDir: s.cfg.UploadDir, TempDir: s.cfg.TempDir, FreeBytes: -1}
+	var err error
+	if d.UploadBytes, err = dirBytes(s.cfg.UploadDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot size %s: %v", s.cfg.UploadDir, err)
+		return
+	}
+	if s.cfg.TempDir != s.cfg.UploadDir {
+		if d.TempBytes, err = dirBytes(s.cfg.TempDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot size %s: %v", s.cfg.TempDir, err)
+			return
+		}
+	}
+	d.QuarantineBytes, _ = dirBytes(s.cfg.QuarantineDir)
+	if avail, err := s.store.Available(); err == nil {
+		d.FreeBytes = avail
+	}
+	respondJSON(w, http.StatusOK, d)
+}
+
+// TenantUsage is one entry of GET /admin/tenants: the process itself
+// without TENANT_MODE, else each tenant.
+type TenantUsage struct {
+	Tenant         string `json:"tenant"`
+	Files          int    `json:"files"`
+	StoredBytes    int64  `json:"storedBytes"`
+	Uploads        int    `json:"uploads"` // in progress
+	PartBytes      int64  `json:"partBytes"`
+	QuotaUsed      int64  `json:"quotaUsed,omitempty"`
+	QuotaLimit     int64  `json:"quotaLimit,omitempty"` // TENANT_QUOTA
+	ActiveSessions int    `json:"activeSessions"`
+}
+
+func (s *Server) adminTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	servers := s.servers()
+	if len(servers) > 1 {
+		servers = servers[1:]
+	}
+	list := []TenantUsage{}
+	for _, srv := range servers {
+		u, err := srv.usage()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot measure tenant %q: %v", srv.tenant, err)
+			return
+		}
+		list = append(list, u)
+	}
+	respondJSON(w, http.StatusOK, map[string]any{"tenants": list})
+}
+
+// usage measures what s stores.
+func (s *Server) usage() (TenantUsage, error) {
+	u := TenantUsage{Tenant: s.tenant, ActiveSessions: s.sessions.Len()}
+	files, err := s.store.List()
+	if err != nil {
+		return u, err
+	}
+	for _, f := range files {
+		if !s.isExpired(f.Name) {
+			u.Files++
+			u.StoredBytes += f.Size
+		}
+	}
+	parts, err := s.store.ListParts()
+	if err != nil {
+		return u, err
+	}
+	u.Uploads = len(parts)
+	for _, p := range parts {
+		u.PartBytes += p.Size
+	}
+	if s.tenant != "" && s.cfg.TenantQuota > 0 {
+		u.QuotaLimit = s.cfg.TenantQuota
+		if u.QuotaUsed, err = s.quotas.total(""); err != nil { // every file
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+// adminServer returns the Server the ?tenant= parameter names: the
+// process itself without TENANT_MODE.
+func (s *Server) adminServer(w http.ResponseWriter, r *http.Request) (*Server, bool) {
+	name := r.URL.Query().Get("tenant")
+	if s.cfg.TenantMode == "" {
+		if name != "" {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "tenant given but TENANT_MODE is off")
+			return nil, false
+		}
+		return s, true
+	}
+	t := s.tenants[name]
+	if t == nil {
+		respondError(w, http.StatusNotFound, CodeUnknownTenant, "unknown tenant %q: pass ?tenant=", name)
+		return nil, false
+	}
+	return t, true
+}
+
+// adminAbortHandler discards an unfinished upload whoever owns it, like
+// DELETE /uploads/{id} by an admin user.
+func (s *Server) adminAbortHandler(w http.ResponseWriter, r *http.Request) {
+	srv, ok := s.adminServer(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	info, part, err := srv.findUpload(id)
+	if err == nil && part == nil {
+		err = fs.ErrNotExist // completed: nothing to abort
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusNotFound, CodeNotFound, "no unfinished upload %q", id)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot look up upload: %v", err)
+		return
+	}
+	if err := srv.discardPart(*part); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot abort %s: %v", id, err)
+		return
+	}
+	logFor(w).Info("upload aborted by admin", "id", id, "tenant", srv.tenant, "size", info.Size)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeResponse is the body of POST /admin/purge.
+type PurgeResponse struct {
+	OlderThan  string `json:"olderThan"`
+	Removed    int64  `json:"removed"`
+	FreedBytes int64  `json:"freedBytes"`
+	Errors     int64  `json:"errors"`
+}
+
+// adminPurgeHandler runs the stale-upload sweep now, on every tenant, for
+// uploads idle longer than ?olderThan= (default STALE_UPLOAD_TTL).
+func (s *Server) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	ttl := s.cfg.StaleTTL
+	if v := r.URL.Query().Get("olderThan"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid olderThan %q: want a positive duration such as 24h", v)
+			return
+		}
+		ttl = d
+	}
+	if ttl <= 0 {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "olderThan required: STALE_UPLOAD_TTL is not set")
+		return
+	}
+	resp := PurgeResponse{OlderThan: ttl.String()}
+	for _, srv := range s.servers() {
+		st := srv.sweepStale(ttl)
+		resp.Removed += st.Removed
+		resp.FreedBytes += st.FreedBytes
+		resp.Errors += st.Errors
+	}
+	logFor(w).Info("stale uploads purged by admin", "older_than", ttl, "removed", resp.Removed, "freed_bytes", resp.FreedBytes)
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// adminMaintenanceHandler shows (GET) or sets (PUT {"enabled": true,
+// "message": "..."}) maintenance mode.
+func (s *Server) adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var in MaintenanceState
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&in); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid body: %v", err)
+			return
+		}
+		m := s.maintenance
+		m.Lock()
+		if in.Enabled && !m.state.Enabled {
+			now := s.now().UTC()
+			m.state.Since = &now
+		}
+		if !in.Enabled {
+			m.state.Since = nil
+		}
+		m.state.Enabled, m.state.Message = in.Enabled, in.Message
+		m.Unlock()
+		logFor(w).Info("maintenance mode set by admin", "enabled", in.Enabled, "message", in.Message)
+	}
+	respondJSON(w, http.StatusOK, s.maintenance.get())
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ---------------------------------------------------------------------
+// Separate chunk files (mode=separate) + POST /upload/complete and
+// POST /upload/{uploadID}/complete
+// ---------------------------------------------------------------------
+const UploadModeSeparate = "separate"
+
+// writeSeparateChunk stores one chunk as its own <key>.chunk.<index> file so
+// chunks may arrive in any order and in parallel.
+func (s *Server) writeSeparateChunk(w http.ResponseWriter, r *http.Request, key, fileName string, index, totalChunks int, fileSize int64, chunk io.Reader, chunkSize int64) {
+	// Lock per chunk, not per file, so different chunks can be written at once.
+	lock := s.locks.Get(key + ".part." + strconv.Itoa(index))
+	lock.Lock()
+	defer lock.Unlock()
+	if s.uploadPaused(w, key) {
+		return
+	}
+
+	// Reserve the chunk's bytes first so parallel chunks can't jointly
+	// overrun the limit; a failed write releases them again.
+	if total, ok := s.received.Reserve(key, index, chunkSize, s.uploadLimit(fileSize)); !ok {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeFileTooLarge,
+			"chunk %d would bring the upload to %d bytes, over its limit of %d", index, total, s.uploadLimit(fileSize))
+		return
+	}
+
+	f, err := s.store.OpenChunk(key, index)
+	if err != nil {
+		s.received.Unmark(key, index)
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open chunk file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	write := spanOf(w).child("storage.write_chunk", "chunk.index", index)
+	written, err := io.Copy(f, s.throttle(r, key, chunk))
+	write.set("storage.bytes_written", written).done(err)
+	if err != nil || written != chunkSize {
+		f.Close()
+		s.received.Unmark(key, index)
+		if rmErr := s.store.RemoveChunks(key, []int{index}); rmErr != nil {
+			logFor(w).Warn("cannot remove chunk file", "index", index, "key", key, "error", rmErr)
+		}
+		switch {
+		case errors.Is(err, errChunkLength):
+			respondError(w, http.StatusBadRequest, CodeChunkLengthMismatch, "chunk %d: %v", index, err)
+		case err != nil:
+			respondError(w, http.StatusInternalServerError, CodeServerError, "write error: %v", err)
+		default:
+			respondError(w, http.StatusInternalServerError, CodeIncompleteWrite,
+				"incomplete write: expected %d, wrote %d", chunkSize, written)
+		}
+		return
+	}
+	logFor(w).Info("wrote chunk", "index", index, "bytes", written, "part", key+".chunk."+strconv.Itoa(index))
+	s.chunkWritten(written)
+	s.recordChunk(r, key, fileName, index, written)
+	s.publishChunk(key, index, written, totalChunks)
+	respondSuccess(w, SuccessResponse{Status: "ok", Received: written})
+}
+
+// completeHandler concatenates <key>.chunk.0..N-1 into the final file,
+// optionally checking the whole-file SHA-256 sent as "hash". The session
+// comes from the path of /upload/{uploadID}/complete, else from the
+// uploadID field.
+func (s *Server) completeHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	fileName := r.FormValue("fileName")
+	totalStr := r.FormValue("totalChunks")
+	wantHash := r.FormValue("hash")
+	key := fileName
+	uploadID := r.PathValue("uploadID")
+	if uploadID == "" {
+		uploadID = r.FormValue("uploadID")
+	}
+	sess, uerr := s.lookupSession(uploadID)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if sess != nil {
+		tagUpload(w, sess.ID)
+		if sess.Direct != "" {
+			s.completeDirect(w, r, sess)
+			return
+		}
+		key, fileName, totalStr = sess.ID, sess.FileName, strconv.Itoa(sess.TotalChunks)
+	}
+	if fileName == "" || totalStr == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "missing fileName or totalChunks")
+		return
+	}
+	fileName, uerr = s.cleanFileName(fileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if sess == nil {
+		key = fileName
+	}
+	totalChunks, err := strconv.Atoi(totalStr)
+	if err != nil || totalChunks <= 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidTotalChunks, "invalid totalChunks")
+		return
+	}
+
+	lock := s.locks.Get(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.uploadPaused(w, key) {
+		return
+	}
+
+	if missing := s.store.MissingChunks(key, totalChunks); len(missing) > 0 {
+		respondError(w, http.StatusBadRequest, CodeIncompleteUpload,
+			"incomplete: received %d of %d chunks, missing %v", totalChunks-len(missing), totalChunks, missing)
+		return
+	}
+
+	sums := fileChecksums(r)
+	if wantHash != "" {
+		sums[ChecksumSHA256] = wantHash
+	}
+	digest := newFileDigest(sums)
+	s.publish(key, UploadEvent{Type: EventAssembling})
+	assemble := spanOf(w).child("storage.assemble", "upload.total_chunks", totalChunks)
+	err = s.store.AssembleChunks(key, totalChunks, digest)
+	assemble.done(err)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot assemble chunks: %v", err)
+		return
+	}
+	if err := digest.check(); err != nil {
+		// Keep the chunk files; only the assembled copy is discarded.
+		if err := s.store.RemovePart(key); err != nil {
+			logFor(w).Warn("cannot remove assembled part", "file", fileName, "error", err)
+		}
+		s.publish(key, UploadEvent{Type: EventFailed, FileName: fileName, Code: CodeFileHashMismatch, Error: err.Error()})
+		respondError(w, http.StatusUnprocessableEntity, CodeFileHashMismatch, "file hash mismatch: %v", err)
+		return
+	}
+
+	finalPath, err := s.finalizeWithRetry(w, key, fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeFinalizeFailed, "cannot move %s into place: %v", fileName, err)
+		return
+	}
+	indices := make([]int, totalChunks)
+	for i := range indices {
+		indices[i] = i
+	}
+	if err := s.store.RemoveChunks(key, indices); err != nil {
+		logFor(w).Warn("cannot remove chunk files", "file", fileName, "error", err)
+	}
+	s.received.Forget(key)
+	s.sessions.Remove(key)
+	logFor(w).Info("upload assembled", "path", finalPath, "total_chunks", totalChunks)
+
+	resp, uerr := s.completedResponse(r, key, fileName, finalPath)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	respondSuccess(w, resp)
+}
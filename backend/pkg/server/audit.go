@@ -0,0 +1,455 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// AUDIT_LOG: an append-only record of who initialised, sent, completed,
+// deleted or downloaded what, from where and with what result, in a
+// rotating JSONL file or METADATA_DB's audit_log table, read back with
+// GET /admin/audit
+// ---------------------------------------------------------------------
+
+const (
+	// AuditDB as AUDIT_LOG writes the records to METADATA_DB.
+	AuditDB = "db"
+
+	DefaultAuditMaxSize  = 100 << 20
+	DefaultAuditMaxFiles = 10
+
+	// AuditFileMode keeps the audit files to the server's user.
+	AuditFileMode = 0o600
+)
+
+// Audited actions.
+const (
+	AuditInit     = "init"
+	AuditChunk    = "chunk"
+	AuditComplete = "complete"
+	AuditDelete   = "delete"
+	AuditDownload = "download"
+)
+
+// Audit results: a request answered with a status below 400 succeeded.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// auditActions is the action of each audited route, by method and
+// ServeMux pattern minus the method, as instrument sees them.
+var auditActions = map[string]string{
+	"POST /upload/init":                    AuditInit,
+	"POST /upload/direct":                  AuditInit,
+	"POST /files/{$}":                      AuditInit,
+	"POST /batches":                        AuditInit,
+	"POST /upload":                         AuditChunk,
+	"PUT /upload/{uploadID}/chunk/{index}": AuditChunk,
+	"PATCH /files/{name}":                  AuditChunk,
+	"PUT /chunks/{hash}":                   AuditChunk,
+	"PUT /batches/{batchID}/files/{fileIndex}/chunks/{index}": AuditChunk,
+	"POST /" + GRPCService + "/UploadChunks":                  AuditChunk,
+	"POST /upload/complete":                                   AuditComplete,
+	"POST /upload/{uploadID}/complete":                        AuditComplete,
+	"POST /batches/{batchID}/complete":                        AuditComplete,
+	"POST /chunks/assemble":                                   AuditComplete,
+	"POST /files/{name}/patch":                                AuditComplete,
+	"DELETE /upload/{uploadID}":                               AuditDelete,
+	"DELETE /uploads/{id}":                                    AuditDelete,
+	"DELETE /files/{name}":                                    AuditDelete,
+	"DELETE /batches/{batchID}":                               AuditDelete,
+	"POST /admin/uploads/{id}/abort":                          AuditDelete,
+	"POST /admin/purge":                                       AuditDelete,
+	"GET /files/{name}":                                       AuditDownload,
+	"GET /files/{name}/thumbnail/{size}":                      AuditDownload,
+	"GET /files/{name}/transcode/{preset}":                    AuditDownload,
+}
+
+// AuditRecord is one line of the audit file, one row of audit_log and
+// one entry of GET /admin/audit.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	User      string    `json:"user,omitempty"` // authenticated subject, "admin" for ADMIN_TOKEN
+	Tenant    string    `json:"tenant,omitempty"`
+	SourceIP  string    `json:"sourceIp"`
+	Action    string    `json:"action"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	UploadID  string    `json:"uploadId,omitempty"`
+	FileName  string    `json:"fileName,omitempty"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"`
+	Code      string    `json:"code,omitempty"`  // ErrorResponse.Code of a failure
+	Bytes     int64     `json:"bytes,omitempty"` // received by a chunk, sent by a download
+}
+
+// audit writes the record of a request to an audited route, once
+// instrument has its response.
+func (s *Server) audit(route, requestID string, r *http.Request, rec *requestRecorder) {
+	if s.cfg.AuditLog == "" {
+		return
+	}
+	action := auditActions[r.Method+" "+route]
+	if action == "" {
+		return
+	}
+	a := AuditRecord{Time: s.now().UTC(), RequestID: requestID, User: rec.user, Tenant: s.tenant,
+		SourceIP: s.clientIP(r), Action: action, Method: r.Method, Path: r.URL.Path,
+		UploadID: rec.upload, Status: rec.status, Result: AuditSuccess, Code: rec.code}
+	if a.Status >= 400 {
+		a.Result = AuditFailure
+	}
+	if a.UploadID == "" {
+		a.UploadID = cmp.Or(r.PathValue("uploadID"), r.PathValue("id"), r.PathValue("batchID"), r.URL.Query().Get("uploadID"))
+	}
+	a.FileName = cmp.Or(r.PathValue("name"), r.URL.Query().Get("fileName"))
+	switch action {
+	case AuditChunk:
+		a.Bytes = max(r.ContentLength, 0)
+	case AuditDownload:
+		a.Bytes = rec.written
+	}
+
+	var err error
+	if s.cfg.AuditLog == AuditDB {
+		err = s.auditDB(a)
+	} else {
+		err = s.auditFile.append(a)
+	}
+	if err != nil {
+		rec.log.Error("audit log: cannot record", "action", action, "error", err)
+	}
+}
+
+// auditDB inserts a into audit_log.
+func (s *Server) auditDB(a AuditRecord) error {
+	if s.db == nil {
+		return nil // NewWithStorage: METADATA_DB not opened
+	}
+	return s.db.exec(context.Background(), `INSERT INTO audit_log (at, request_id, user_name, tenant, source_ip,
+	action, method, path, upload_id, file_name, status, result, code, bytes)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.Time, a.RequestID, a.User, a.Tenant, a.SourceIP, a.Action, a.Method, a.Path,
+		a.UploadID, a.FileName, a.Status, a.Result, a.Code, a.Bytes)
+}
+
+// auditFile appends records to AUDIT_LOG, one JSON object per line. Once
+// the file reaches maxSize it is renamed with the time as a suffix, so
+// the rotated files sort oldest first, and a new one is started; past
+// maxFiles rotated files the oldest are removed. The file is opened on
+// the first record and shared by the process's tenants.
+type auditFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int // 0 = keep all
+	now      func() time.Time
+	f        *os.File
+	size     int64
+}
+
+func newAuditFile(cfg Config, now func() time.Time) *auditFile {
+	if cfg.AuditLog == "" || cfg.AuditLog == AuditDB {
+		return nil
+	}
+	return &auditFile{path: cfg.AuditLog, maxSize: cfg.AuditMaxSize, maxFiles: cfg.AuditMaxFiles, now: now}
+}
+
+func (l *auditFile) append(a AuditRecord) error {
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, AuditFileMode)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// rotate closes the file, renames it and removes the rotated files past
+// maxFiles.
+func (l *auditFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	if err := os.Rename(l.path, l.path+"."+l.now().UTC().Format(auditRotatedTime)); err != nil {
+		return err
+	}
+	if l.maxFiles == 0 {
+		return nil
+	}
+	rotated, err := l.rotated()
+	if err != nil {
+		return err
+	}
+	for _, old := range rotated[:max(len(rotated)-l.maxFiles, 0)] {
+		if err := os.Remove(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditRotatedTime is the suffix of a rotated audit file, sorting in time
+// order.
+const auditRotatedTime = "20060102T150405.000000000Z"
+
+// rotated returns the rotated audit files, oldest first.
+func (l *auditFile) rotated() ([]string, error) {
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	files := matches[:0]
+	for _, m := range matches {
+		if _, err := time.Parse(auditRotatedTime, strings.TrimPrefix(m, l.path+".")); err == nil {
+			files = append(files, m)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// auditFilter is what GET /admin/audit asked for.
+type auditFilter struct {
+	user, tenant, action, result, uploadID, fileName string
+	tenantSet                                        bool
+	since, until                                     time.Time
+	limit                                            int
+}
+
+func (f auditFilter) match(a AuditRecord) bool {
+	return (f.user == "" || a.User == f.user) && (!f.tenantSet || a.Tenant == f.tenant) &&
+		(f.action == "" || a.Action == f.action) && (f.result == "" || a.Result == f.result) &&
+		(f.uploadID == "" || a.UploadID == f.uploadID) && (f.fileName == "" || a.FileName == f.fileName) &&
+		(f.since.IsZero() || !a.Time.Before(f.since)) && (f.until.IsZero() || a.Time.Before(f.until))
+}
+
+// query returns the last f.limit records matching f, newest first,
+// reading the rotated files and then the current one.
+func (l *auditFile) query(f auditFilter) ([]AuditRecord, error) {
+	l.Lock()
+	defer l.Unlock()
+	files, err := l.rotated()
+	if err != nil {
+		return nil, err
+	}
+	var out []AuditRecord
+	for _, name := range append(files, l.path) {
+		if err := readAudit(name, func(a AuditRecord) {
+			if f.match(a) {
+				out = append(out, a)
+				if len(out) > f.limit {
+					out = out[1:]
+				}
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(out)
+	return out, nil
+}
+
+// readAudit calls fn with each record of the audit file name; a missing
+// file has none and a line that is not a record is skipped.
+func readAudit(name string, fn func(AuditRecord)) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var a AuditRecord
+		if json.Unmarshal(sc.Bytes(), &a) == nil {
+			fn(a)
+		}
+	}
+	return sc.Err()
+}
+
+// queryAuditDB is auditFile.query for audit_log.
+func (s *Server) queryAuditDB(ctx context.Context, f auditFilter) ([]AuditRecord, error) {
+	var where []string
+	var args []any
+	cond := func(column string, v any) {
+		where = append(where, column)
+		args = append(args, v)
+	}
+	for column, v := range map[string]string{"user_name = ?": f.user, "action = ?": f.action,
+		"result = ?": f.result, "upload_id = ?": f.uploadID, "file_name = ?": f.fileName} {
+		if v != "" {
+			cond(column, v)
+		}
+	}
+	if f.tenantSet {
+		cond("tenant = ?", f.tenant)
+	}
+	if !f.since.IsZero() {
+		cond("at >= ?", f.since)
+	}
+	if !f.until.IsZero() {
+		cond("at < ?", f.until)
+	}
+	query := `SELECT at, request_id, user_name, tenant, source_ip, action, method, path,
+	upload_id, file_name, status, result, code, bytes FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY at DESC LIMIT ?"
+	args = append(args, f.limit)
+
+	out := []AuditRecord{}
+	err := s.db.query(ctx, func(rows *sql.Rows) error {
+		var a AuditRecord
+		if err := rows.Scan(&a.Time, &a.RequestID, &a.User, &a.Tenant, &a.SourceIP, &a.Action, &a.Method, &a.Path,
+			&a.UploadID, &a.FileName, &a.Status, &a.Result, &a.Code, &a.Bytes); err != nil {
+			return err
+		}
+		a.Time = a.Time.UTC()
+		out = append(out, a)
+		return nil
+	}, query, args...)
+	return out, err
+}
+
+// AuditResponse is the body of GET /admin/audit.
+type AuditResponse struct {
+	Records []AuditRecord `json:"records"`
+}
+
+// adminAuditHandler returns the audit records, newest first, filtered by
+// ?user=, ?tenant=, ?action=, ?result=, ?uploadId=, ?fileName= and the
+// RFC 3339 times ?since= (inclusive) and ?until=, at most ?limit=.
+func (s *Server) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AuditLog == "" {
+		respondError(w, http.StatusNotFound, CodeNotFound, "AUDIT_LOG is off")
+		return
+	}
+	q := r.URL.Query()
+	f := auditFilter{user: q.Get("user"), action: q.Get("action"), result: q.Get("result"),
+		uploadID: q.Get("uploadId"), fileName: q.Get("fileName"), limit: DefaultListLimit}
+	if q.Has("tenant") {
+		srv, ok := s.adminServer(w, r)
+		if !ok {
+			return
+		}
+		f.tenant, f.tenantSet = srv.tenant, true
+	}
+	if f.action != "" && !slices.Contains([]string{AuditInit, AuditChunk, AuditComplete, AuditDelete, AuditDownload}, f.action) {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "action must be %s, %s, %s, %s or %s",
+			AuditInit, AuditChunk, AuditComplete, AuditDelete, AuditDownload)
+		return
+	}
+	if f.result != "" && f.result != AuditSuccess && f.result != AuditFailure {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "result must be %s or %s", AuditSuccess, AuditFailure)
+		return
+	}
+	for param, t := range map[string]*time.Time{"since": &f.since, "until": &f.until} {
+		if v := q.Get(param); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid %s %q: want an RFC 3339 time", param, v)
+				return
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxListLimit {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be 1 to %d", MaxListLimit)
+			return
+		}
+		f.limit = n
+	}
+
+	var records []AuditRecord
+	var err error
+	switch {
+	case s.cfg.AuditLog != AuditDB:
+		records, err = s.auditFile.query(f)
+	case s.db != nil:
+		records, err = s.queryAuditDB(r.Context(), f)
+	default:
+		err = fmt.Errorf("METADATA_DB not open")
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot read audit log: %v", err)
+		return
+	}
+	if records == nil {
+		records = []AuditRecord{}
+	}
+	logFor(w).Info("audit query", "returned", len(records))
+	respondJSON(w, http.StatusOK, AuditResponse{Records: records})
+}
+
+// closeAudit closes the audit file at shutdown.
+func (s *Server) closeAudit() {
+	l := s.auditFile
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			slog.Warn("audit log: close", "error", err)
+		}
+		l.f = nil
+	}
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Authentication: API keys (API_KEYS) and JWT bearer tokens (JWT_*),
+// enabled per route group (AUTH_ROUTES)
+// ---------------------------------------------------------------------
+
+// Route groups AUTH_ROUTES can protect.
+const (
+	AuthUpload   = "upload"   // POST /upload, /upload/init, /upload/complete, DELETE /upload/{id}, tus POST/PATCH/DELETE, gRPC UploadChunks
+	AuthStatus   = "status"   // HEAD /upload, /upload/config, status, preflight, verify, exists, tus HEAD, gRPC GetUploadStatus
+	AuthDownload = "download" // GET/HEAD /files/{name}, thumbnails
+	AuthMetrics  = "metrics"  // GET /metrics and /stats/active (not protected by default)
+	AuthManage   = "manage"   // GET /uploads, GET/DELETE /uploads/{id}
+
+	APIKeyHeader = "X-API-Key"
+	JWTLeeway    = 30 * time.Second // clock skew allowed on exp/nbf
+)
+
+// Principal is who a request was authenticated as.
+type Principal struct {
+	Subject string // API key name or JWT "sub"
+	Method  string // "apikey", "jwt", ...
+	Tenant  string // JWT "tenant" claim, see TENANT_MODE
+}
+
+// Authenticator checks one kind of credential. It returns
+// errNoCredentials when r carries none of its kind, so the next
+// Authenticator in a chain gets a try.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+var errNoCredentials = errors.New("authentication required")
+
+// chainAuth accepts a request any of its Authenticators accepts.
+type chainAuth []Authenticator
+
+func (c chainAuth) Authenticate(r *http.Request) (Principal, error) {
+	var invalid error
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if err == nil {
+			return p, nil
+		}
+		if !errors.Is(err, errNoCredentials) && invalid == nil {
+			invalid = err
+		}
+	}
+	if invalid != nil {
+		return Principal{}, invalid
+	}
+	return Principal{}, errNoCredentials
+}
+
+// apiKeyAuth accepts the X-API-Key header; keys map each key to a name
+// for logs.
+type apiKeyAuth map[string]string
+
+// parseAPIKeys reads API_KEYS: comma-separated "name:key" or bare keys.
+func parseAPIKeys(v string) apiKeyAuth {
+	keys := make(apiKeyAuth)
+	for i, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			name, key = fmt.Sprintf("key%d", i+1), entry
+		}
+		keys[key] = name
+	}
+	return keys
+}
+
+func (a apiKeyAuth) Authenticate(r *http.Request) (Principal, error) {
+	got := r.Header.Get(APIKeyHeader)
+	if got == "" {
+		return Principal{}, errNoCredentials
+	}
+	// Compare against every key in constant time so timing reveals nothing.
+	match := ""
+	for key, name := range a {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+			match = name
+		}
+	}
+	if match == "" {
+		return Principal{}, errors.New("invalid API key")
+	}
+	return Principal{Subject: match, Method: "apikey"}, nil
+}
+
+// jwtAuth accepts "Authorization: Bearer <JWT>" signed with HS256 (secret)
+// or RS256 (public key), checking exp, nbf and, when set, iss and aud.
+type jwtAuth struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	now       func() time.Time
+}
+
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+	Tenant    string      `json:"tenant"`
+}
+
+// jwtAudience is "aud", which may be a string or a list of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (j jwtAuth) Authenticate(r *http.Request) (Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return Principal{}, errNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Principal{}, fmt.Errorf("malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, errors.New("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && j.secret != nil:
+		mac := hmac.New(sha256.New, j.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return Principal{}, errors.New("invalid token signature")
+		}
+	case header.Alg == "RS256" && j.publicKey != nil:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(j.publicKey, crypto.SHA256, digest[:], sig); err != nil {
+			return Principal{}, errors.New("invalid token signature")
+		}
+	default:
+		return Principal{}, fmt.Errorf("token algorithm %q not accepted", header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Principal{}, fmt.Errorf("malformed token claims: %v", err)
+	}
+	now := j.now()
+	if claims.ExpiresAt != nil && now.After(unixTime(*claims.ExpiresAt).Add(JWTLeeway)) {
+		return Principal{}, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(JWTLeeway).Before(unixTime(*claims.NotBefore)) {
+		return Principal{}, errors.New("token not valid yet")
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return Principal{}, fmt.Errorf("token issuer %q not accepted", claims.Issuer)
+	}
+	if j.audience != "" && !containsString(claims.Audience, j.audience) {
+		return Principal{}, errors.New("token audience not accepted")
+	}
+	return Principal{Subject: claims.Subject, Method: "jwt", Tenant: claims.Tenant}, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(0, int64(sec*float64(time.Second)))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRSAPublicKey reads a PEM "PUBLIC KEY" (PKIX) or "RSA PUBLIC KEY"
+// (PKCS#1) file.
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%T is not an RSA key", key)
+	}
+	return rsaKey, nil
+}
+
+// newAuthenticator builds the chain cfg configures, or nil for none.
+func newAuthenticator(cfg Config, now func() time.Time) Authenticator {
+	var chain chainAuth
+	if cfg.APIKeys != "" {
+		chain = append(chain, parseAPIKeys(cfg.APIKeys))
+	}
+	if cfg.JWTSecret != "" || cfg.JWTPublicKey != nil {
+		j := jwtAuth{publicKey: cfg.JWTPublicKey, issuer: cfg.JWTIssuer, audience: cfg.JWTAudience, now: now}
+		if cfg.JWTSecret != "" {
+			j.secret = []byte(cfg.JWTSecret)
+		}
+		chain = append(chain, j)
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain
+}
+
+type principalKey struct{}
+
+// principalFrom returns who the request in ctx was authenticated as.
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// withAuth requires credentials for next when group is listed in
+// AUTH_ROUTES and an Authenticator is configured. It sits inside withCORS
+// so preflights pass and 401s carry CORS headers.
+func (s *Server) withAuth(group string, next http.HandlerFunc) http.HandlerFunc {
+	return s.withAuthBy(func(*http.Request) string { return group }, next)
+}
+
+// withAuthBy is withAuth for paths whose methods belong to different
+// route groups.
+func (s *Server) withAuthBy(group func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil || !s.authRoutes[group(r)] {
+			next(w, r)
+			return
+		}
+		p, err := s.auth.Authenticate(r)
+		if err != nil {
+			logFor(w).Warn("auth denied", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chunk-upload"`)
+			respondError(w, http.StatusUnauthorized, CodeUnauthorized, "%v", err)
+			return
+		}
+		if err := s.checkTenant(p); err != nil {
+			logFor(w).Warn("auth denied", "error", err)
+			respondError(w, http.StatusForbidden, CodeWrongTenant, "%v", err)
+			return
+		}
+		tagUser(w, p.Subject)
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// uploadAuthGroup: HEAD /upload is a status probe, POST uploads a chunk.
+func uploadAuthGroup(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return AuthStatus
+	}
+	return AuthUpload
+}
+
+// batchAuthGroup mirrors batchHandler: GET reports a batch, DELETE
+// aborts it.
+func batchAuthGroup(r *http.Request) string {
+	if r.Method == http.MethodGet {
+		return AuthStatus
+	}
+	return AuthUpload
+}
+
+// filesAuthGroup mirrors filesHandler: GET and plain HEAD download, tus
+// HEAD reads an offset, PATCH and DELETE modify an upload.
+func filesAuthGroup(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead && !isTus(r):
+		return AuthDownload
+	case r.Method == http.MethodHead:
+		return AuthStatus
+	}
+	return AuthUpload
+}
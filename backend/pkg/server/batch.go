@@ -0,0 +1,478 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Batches: POST /batches starts an upload session for every file of a
+// directory tree at once, chunks name their file by its index, and POST
+// /batches/{batchID}/complete returns a manifest of the stored files
+// ---------------------------------------------------------------------
+
+// MaxBatchFiles bounds the files of one batch.
+const MaxBatchFiles = 10000
+
+// BatchPathSeparator joins the directories of a batch file's path into
+// the one name it is stored under: docs/2024/a.txt becomes
+// docs__2024__a.txt.
+const BatchPathSeparator = "__"
+
+// maxBatchBody bounds the JSON body of POST /batches: MaxBatchFiles
+// entries with paths of a few hundred bytes.
+const maxBatchBody = 8 << 20
+
+// Status of a file in BatchFileStatus, besides UploadInProgress and
+// UploadComplete.
+const BatchFileFailed = "failed"
+
+// BatchRequest is the JSON body of POST /batches.
+type BatchRequest struct {
+	Files     []BatchFileRequest `json:"files"`
+	Retention string             `json:"retention,omitempty"` // as at POST /upload/init, for every file
+}
+
+// BatchFileRequest declares one file of a batch, as fileName,
+// totalChunks and fileSize do at POST /upload/init.
+type BatchFileRequest struct {
+	Path        string `json:"path"` // relative, "/"-separated
+	TotalChunks int    `json:"totalChunks"`
+	FileSize    int64  `json:"fileSize,omitempty"`
+}
+
+// BatchResponse is returned by POST /batches and GET /batches/{batchID}.
+type BatchResponse struct {
+	BatchID   string            `json:"batchID"`
+	Files     []BatchFileStatus `json:"files"`
+	Complete  int               `json:"complete"`            // files stored so far
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"` // as in InitResponse
+	Retention string            `json:"retention,omitempty"` // as in InitResponse
+}
+
+// BatchFileStatus is one file of a batch.
+type BatchFileStatus struct {
+	FileIndex   int    `json:"fileIndex"`
+	Path        string `json:"path"`
+	FileName    string `json:"fileName"`
+	UploadID    string `json:"uploadID"`
+	TotalChunks int    `json:"totalChunks"`
+	FileSize    int64  `json:"fileSize,omitempty"`
+
+	// in_progress or complete; GET also reports failed when the file's
+	// session was aborted or expired, or the stored file was refused.
+	Status        string `json:"status"`
+	Received      int64  `json:"received,omitempty"`      // GET, in_progress: bytes stored
+	MissingChunks []int  `json:"missingChunks,omitempty"` // GET, in_progress
+	Size          int64  `json:"size,omitempty"`          // complete
+	Stored        string `json:"stored,omitempty"`        // complete: the final-chunk response's path
+}
+
+// BatchManifest is returned by POST /batches/{batchID}/complete.
+type BatchManifest struct {
+	BatchID   string          `json:"batchID"`
+	Files     []ManifestEntry `json:"files"`
+	TotalSize int64           `json:"totalSize"`
+}
+
+// ManifestEntry is one stored file of a completed batch.
+type ManifestEntry struct {
+	Path        string `json:"path"`
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	Stored      string `json:"stored"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// batchFileRef places an upload in its batch.
+type batchFileRef struct {
+	batch string
+	index int
+}
+
+// trackBatchFile remembers the batch of sess, if it has one, so that
+// completedResponse can record the file there.
+func (s *Server) trackBatchFile(sess *session.Session) {
+	if sess.Batch != "" {
+		s.batched.Store(sess.ID, batchFileRef{sess.Batch, sess.BatchIndex})
+	}
+}
+
+// batchFileDone records in its batch that the upload key, if a batch
+// file, is stored as resp describes.
+func (s *Server) batchFileDone(key string, resp SuccessResponse) {
+	v, ok := s.batched.LoadAndDelete(key)
+	if !ok {
+		return
+	}
+	ref := v.(batchFileRef)
+	lock := s.locks.Get(ref.batch)
+	lock.Lock()
+	defer lock.Unlock()
+	meta, err := s.store.LoadMeta(ref.batch)
+	if err != nil || ref.index >= len(meta.BatchFiles) {
+		slog.Warn("cannot record batch file", "batch", ref.batch, "upload_id", key, "error", err)
+		return
+	}
+	f := &meta.BatchFiles[ref.index]
+	f.Done, f.Size, f.Stored, f.ContentType = true, resp.Size, resp.Path, resp.ContentType
+	if err := s.store.SaveMeta(ref.batch, meta); err != nil {
+		slog.Warn("cannot record batch file", "batch", ref.batch, "upload_id", key, "error", err)
+	}
+}
+
+// batchFileName checks a batch file's relative path, each of whose
+// elements must be a valid file name, and returns it cleaned and the
+// name the file is stored under.
+func (s *Server) batchFileName(path string) (clean, name string, uerr *uploadError) {
+	elems := strings.Split(path, "/")
+	for i, e := range elems {
+		c, err := sanitizeFileName(e, s.cfg.FileNamePolicy)
+		if err != nil {
+			return "", "", &uploadError{http.StatusBadRequest, CodeInvalidFileName, fmt.Sprintf("invalid path %q: %v", path, err)}
+		}
+		elems[i] = c
+	}
+	name, uerr = s.cleanFileName(strings.Join(elems, BatchPathSeparator))
+	return strings.Join(elems, "/"), name, uerr
+}
+
+// batchFiles validates the files of a POST /batches body.
+func (s *Server) batchFiles(req []BatchFileRequest) ([]storage.BatchFile, *uploadError) {
+	if len(req) == 0 || len(req) > MaxBatchFiles {
+		return nil, &uploadError{http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("a batch has 1 to %d files, not %d", MaxBatchFiles, len(req))}
+	}
+	files := make([]storage.BatchFile, len(req))
+	byName := make(map[string]string, len(req))
+	for i, f := range req {
+		path, name, uerr := s.batchFileName(f.Path)
+		if uerr == nil {
+			_, _, _, uerr = s.parseFileParams(name, strconv.Itoa(f.TotalChunks), strconv.FormatInt(f.FileSize, 10))
+		}
+		if uerr == nil {
+			uerr = s.checkChunkLayout(f.TotalChunks, f.FileSize)
+		}
+		if uerr == nil && byName[name] != "" {
+			uerr = &uploadError{http.StatusBadRequest, CodeInvalidFileName,
+				fmt.Sprintf("%q and %q would both be stored as %s", byName[name], path, name)}
+		}
+		if uerr != nil {
+			uerr.msg = fmt.Sprintf("files[%d]: %s", i, uerr.msg)
+			return nil, uerr
+		}
+		byName[name] = path
+		files[i] = storage.BatchFile{Path: path, FileName: name, TotalChunks: f.TotalChunks, FileSize: f.FileSize}
+	}
+	return files, nil
+}
+
+// batchInitHandler starts a batch: a session for every file, each checked
+// as POST /upload/init checks one.
+func (s *Server) batchInitHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid JSON body: %v", err)
+		return
+	}
+	files, uerr := s.batchFiles(req.Files)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	var total int64
+	for _, f := range files {
+		total += f.FileSize
+	}
+	if q := s.checkQuota(r, "", total); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+	retention, uerr := s.requestedRetention(req.Retention)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	id, err := session.NewID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot generate batchID: %v", err)
+		return
+	}
+	meta := &storage.Meta{UploadID: id, Owner: uploadOwner(r), CreatedAt: s.now().UTC(), Retention: retention, BatchFiles: files}
+	s.expireSessions()
+	var started []*session.Session
+	for i, f := range files {
+		sess := &session.Session{FileName: f.FileName, TotalChunks: f.TotalChunks, FileSize: f.FileSize, Retention: retention,
+			Batch: id, BatchIndex: i}
+		if uerr = s.addSession(r, sess); uerr != nil {
+			break
+		}
+		started = append(started, sess)
+		files[i].UploadID = sess.ID
+	}
+	if uerr == nil {
+		if err := s.store.SaveMeta(id, meta); err != nil {
+			uerr = &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot save batch metadata: %v", err)}
+		}
+	}
+	if uerr != nil {
+		for _, sess := range started {
+			s.dropSession(sess)
+		}
+		uerr.respond(w)
+		return
+	}
+
+	resp := s.batchResponse(id, meta)
+	tagUpload(w, id).Info("batch created", "files", len(files), "size", total)
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// batchResponse describes the batch id as it was declared.
+func (s *Server) batchResponse(id string, meta *storage.Meta) BatchResponse {
+	resp := BatchResponse{BatchID: id, Files: make([]BatchFileStatus, len(meta.BatchFiles))}
+	if s.cfg.UploadTTL > 0 {
+		expires := meta.CreatedAt.Add(s.cfg.UploadTTL)
+		resp.ExpiresAt = &expires
+	}
+	if meta.Retention > 0 {
+		resp.Retention = meta.Retention.String()
+	}
+	for i, f := range meta.BatchFiles {
+		resp.Files[i] = BatchFileStatus{FileIndex: i, Path: f.Path, FileName: f.FileName, UploadID: f.UploadID,
+			TotalChunks: f.TotalChunks, FileSize: f.FileSize, Status: UploadInProgress}
+		if f.Done {
+			resp.Files[i].Status, resp.Files[i].Size, resp.Files[i].Stored = UploadComplete, f.Size, f.Stored
+			resp.Complete++
+		}
+	}
+	return resp
+}
+
+// loadBatch reads the record of batch id, dropping it and its unfinished
+// files once past UPLOAD_TTL.
+func (s *Server) loadBatch(id string) (*storage.Meta, *uploadError) {
+	var meta *storage.Meta
+	if session.ValidID(id) {
+		lock := s.locks.Get(id)
+		lock.Lock()
+		if m, err := s.store.LoadMeta(id); err == nil && len(m.BatchFiles) > 0 {
+			meta = m
+		}
+		lock.Unlock()
+	}
+	if meta == nil {
+		return nil, &uploadError{http.StatusNotFound, CodeUnknownUpload, "unknown batchID " + id}
+	}
+	if meta.Expired(s.cfg.UploadTTL, s.now()) {
+		s.dropBatch(id, meta)
+		return nil, &uploadError{http.StatusGone, CodeUploadExpired, "batch expired, call POST /batches again"}
+	}
+	return meta, nil
+}
+
+// dropBatch discards the unfinished files of a batch and its record;
+// stored files are kept.
+func (s *Server) dropBatch(id string, meta *storage.Meta) {
+	for _, f := range meta.BatchFiles {
+		if sess, uerr := s.lookupSession(f.UploadID); uerr == nil {
+			s.dropSession(sess)
+		}
+	}
+	if err := s.store.RemovePart(id); err != nil {
+		slog.Warn("cannot remove batch metadata", "batch", id, "error", err)
+	}
+}
+
+// batchUploadID returns the upload ID of file fileIndex of batch id.
+func (s *Server) batchUploadID(id, fileIndex string) (string, *uploadError) {
+	meta, uerr := s.loadBatch(id)
+	if uerr != nil {
+		return "", uerr
+	}
+	i, err := strconv.Atoi(fileIndex)
+	if err != nil || i < 0 || i >= len(meta.BatchFiles) {
+		return "", &uploadError{http.StatusBadRequest, CodeInvalidIndex,
+			fmt.Sprintf("invalid fileIndex %q: batch %s has files 0 to %d", fileIndex, id, len(meta.BatchFiles)-1)}
+	}
+	return meta.BatchFiles[i].UploadID, nil
+}
+
+// batchChunkHandler stores a chunk of a batch file sent as the request
+// body (PUT /batches/{batchID}/files/{fileIndex}/chunks/{index}), like
+// PUT /upload/{uploadID}/chunk/{index} with the file's uploadID.
+func (s *Server) batchChunkHandler(w http.ResponseWriter, r *http.Request) {
+	id, uerr := s.batchUploadID(r.PathValue("batchID"), r.PathValue("fileIndex"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	r.SetPathValue("uploadID", id)
+	s.rawChunkHandler(w, r)
+}
+
+// batchStatus describes batch id with the state of every file. Each file
+// is looked at under its lock, so one being finished is seen done.
+func (s *Server) batchStatus(id string, meta *storage.Meta) BatchResponse {
+	resp := s.batchResponse(id, meta)
+	for i := range resp.Files {
+		f := &resp.Files[i]
+		if f.Status == UploadComplete {
+			continue
+		}
+		// Rebuilt after a restart, or dropped past UPLOAD_TTL, first:
+		// dropping takes the lock.
+		sess, _ := s.lookupSession(f.UploadID)
+		lock := s.locks.Get(f.UploadID)
+		lock.Lock()
+		if _, ok := s.sessions.Get(f.UploadID); ok && sess != nil {
+			st := s.sessionStatus(sess)
+			f.Received, f.MissingChunks = st.Received, st.MissingChunks
+		} else if done, ok := s.batchFile(id, i); ok && done.Done {
+			f.Status, f.Size, f.Stored = UploadComplete, done.Size, done.Stored
+			resp.Complete++
+		} else {
+			f.Status = BatchFileFailed
+		}
+		lock.Unlock()
+	}
+	return resp
+}
+
+// batchFile rereads file i of batch id.
+func (s *Server) batchFile(id string, i int) (storage.BatchFile, bool) {
+	lock := s.locks.Get(id)
+	lock.Lock()
+	defer lock.Unlock()
+	meta, err := s.store.LoadMeta(id)
+	if err != nil || i >= len(meta.BatchFiles) {
+		return storage.BatchFile{}, false
+	}
+	return meta.BatchFiles[i], true
+}
+
+// batchHandler reports (GET) or aborts (DELETE) a batch. Aborting
+// discards the unfinished files; those already stored are kept.
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	id := r.PathValue("batchID")
+	meta, uerr := s.loadBatch(id)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	tagUpload(w, id)
+	if !s.canManage(r, UploadInfo{Owner: meta.Owner}) {
+		// Don't reveal other users' batches.
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown batchID %s", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		resp := s.batchStatus(id, meta)
+		logFor(w).Info("batch status", "files", len(resp.Files), "complete", resp.Complete)
+		respondJSON(w, http.StatusOK, resp)
+	case http.MethodDelete:
+		s.dropBatch(id, meta)
+		logFor(w).Info("batch aborted", "files", len(meta.BatchFiles))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET and DELETE allowed")
+	}
+}
+
+// batchCompleteHandler ends a batch whose files are all stored and
+// returns its manifest; the batch is then forgotten.
+func (s *Server) batchCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	id := r.PathValue("batchID")
+	meta, uerr := s.loadBatch(id)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	tagUpload(w, id)
+	if !s.canManage(r, UploadInfo{Owner: meta.Owner}) {
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown batchID %s", id)
+		return
+	}
+
+	st := s.batchStatus(id, meta)
+	if st.Complete < len(st.Files) {
+		var missing []string
+		for _, f := range st.Files {
+			if f.Status != UploadComplete && len(missing) < 10 {
+				missing = append(missing, fmt.Sprintf("%s (%s)", f.Path, f.Status))
+			}
+		}
+		respondError(w, http.StatusBadRequest, CodeIncompleteUpload, "incomplete: %d of %d files stored, not %s",
+			st.Complete, len(st.Files), strings.Join(missing, ", "))
+		return
+	}
+
+	// The record is reread for the content types batchStatus leaves out.
+	lock := s.locks.Get(id)
+	lock.Lock()
+	defer lock.Unlock()
+	if m, err := s.store.LoadMeta(id); err == nil && len(m.BatchFiles) == len(meta.BatchFiles) {
+		meta = m
+	}
+	manifest := BatchManifest{BatchID: id, Files: make([]ManifestEntry, len(meta.BatchFiles))}
+	for i, f := range meta.BatchFiles {
+		manifest.Files[i] = ManifestEntry{Path: f.Path, FileName: f.FileName, Size: f.Size, Stored: f.Stored, ContentType: f.ContentType}
+		manifest.TotalSize += f.Size
+	}
+	if err := s.store.RemovePart(id); err != nil {
+		logFor(w).Warn("cannot remove batch metadata", "error", err)
+	}
+	logFor(w).Info("batch completed", "files", len(manifest.Files), "size", manifest.TotalSize)
+	respondJSON(w, http.StatusOK, manifest)
+}
+
+// isBatch reports whether the in-progress key is a batch's record rather
+// than an upload.
+func (s *Server) isBatch(key string) bool {
+	meta, err := s.store.LoadMeta(key)
+	return err == nil && len(meta.BatchFiles) > 0
+}
+
+// batchActive reports whether key is the record of a batch with files
+// still uploading, which the janitor leaves for them.
+func (s *Server) batchActive(key string) bool {
+	meta, err := s.store.LoadMeta(key)
+	if err != nil {
+		return false
+	}
+	for _, f := range meta.BatchFiles {
+		if !f.Done {
+			if _, err := s.store.LoadMeta(f.UploadID); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Chunk-level deduplication (CHUNK_DEDUP=true, off by default): POST
+// /chunks/exists, PUT /chunks/{hash} and POST /chunks/assemble
+// ---------------------------------------------------------------------
+
+// A client cuts the file at content-defined boundaries, asks which of the
+// chunks the server lacks, sends only those, then has the file assembled
+// from the chunk store. Re-uploading a mostly unchanged file costs only
+// the chunks around its changes.
+
+const (
+	ChunkStore      = ".chunks"           // the chunk store's directory inside UploadDir
+	MaxStoredChunk  = 64 << 20            // largest PUT /chunks/{hash} body when MAX_CHUNK_SIZE is unset
+	MaxChunkList    = 100000              // hashes in one /chunks/exists or /chunks/assemble request
+	DefaultChunkTTL = 30 * 24 * time.Hour // CHUNK_TTL
+
+	maxChunkListBody = 8 << 20 // MaxChunkList hex hashes as a JSON array, and then some
+)
+
+// ChunkListRequest is the POST /chunks/exists body.
+type ChunkListRequest struct {
+	Hashes []string `json:"hashes"` // hex SHA-256 of each chunk
+}
+
+// ChunkListResponse lists the asked-for chunks the store lacks, each once
+// and in the order asked.
+type ChunkListResponse struct {
+	Missing []string `json:"missing"`
+}
+
+// AssembleRequest is the POST /chunks/assemble body.
+type AssembleRequest struct {
+	FileName  string   `json:"fileName"`
+	Chunks    []string `json:"chunks"`              // hex SHA-256 of each chunk, in file order
+	Hash      string   `json:"hash,omitempty"`      // hex SHA-256 of the whole file, checked when set
+	Retention string   `json:"retention,omitempty"` // as at POST /upload/init
+}
+
+// MissingChunksResponse is the 409 CHUNKS_MISSING body: ErrorResponse
+// plus the chunks to send before asking again.
+type MissingChunksResponse struct {
+	ErrorResponse
+	Missing []string `json:"missing"`
+}
+
+// errChunkDigest means a chunk's bytes do not hash to the name it was
+// sent under.
+var errChunkDigest = errors.New("chunk does not match its hash")
+
+// chunkStore keeps chunks by content in UploadDir/.chunks, each named by
+// the hex SHA-256 of its bytes and fanned out by the first two digits. A
+// chunk's mtime is when a client last stored or mentioned it; the janitor
+// drops chunks nobody has mentioned for CHUNK_TTL.
+type chunkStore struct {
+	dir     string
+	mode    os.FileMode
+	dirMode os.FileMode
+}
+
+func newChunkStore(cfg Config) chunkStore {
+	return chunkStore{dir: filepath.Join(cfg.UploadDir, ChunkStore), mode: cfg.FileMode, dirMode: cfg.DirMode}
+}
+
+func (c chunkStore) path(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash)
+}
+
+// touch marks hash as used now and returns its size, or an error wrapping
+// fs.ErrNotExist when it is not stored.
+func (c chunkStore) touch(hash string, now time.Time) (int64, error) {
+	p := c.path(hash)
+	if err := os.Chtimes(p, time.Time{}, now); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// put stores the chunk read from src under hash and returns its size. It
+// is written to a temp file that is renamed into place only once its
+// SHA-256 matched, so a chunk in the store is always whole.
+func (c chunkStore) put(hash string, src io.Reader) (int64, error) {
+	dir := filepath.Dir(c.path(hash))
+	if err := os.MkdirAll(dir, c.dirMode); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(dir, "."+hash+"-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); err == nil && got != hash {
+		err = fmt.Errorf("%w: got %s", errChunkDigest, got)
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), c.mode)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(hash))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+	return n, nil
+}
+
+func (c chunkStore) open(hash string) (*os.File, error) {
+	return os.Open(c.path(hash))
+}
+
+// sweep removes every chunk, and every temp file left by an interrupted
+// put, last used before cutoff.
+func (c chunkStore) sweep(cutoff time.Time) (removed, freed int64, err error) {
+	err = filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil || !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+// sweepChunks drops the chunks no client has stored or mentioned for
+// CHUNK_TTL.
+func (s *Server) sweepChunks() {
+	removed, freed, err := s.chunks.sweep(s.now().Add(-s.cfg.ChunkTTL))
+	if err != nil {
+		slog.Warn("janitor: cannot sweep chunk store", "dir", s.chunks.dir, "error", err)
+	}
+	if removed > 0 {
+		slog.Info("janitor: removed unused chunks", "chunks", removed, "freed_bytes", freed)
+	}
+}
+
+// parseChunkHash checks that hash is a hex SHA-256 and lower-cases it.
+func parseChunkHash(hash string) (string, *uploadError) {
+	hash = strings.ToLower(hash)
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return "", &uploadError{http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid chunk hash %q: want a hex SHA-256", hash)}
+	}
+	return hash, nil
+}
+
+// parseChunkHashes checks a list of 1 to MaxChunkList chunk hashes.
+func parseChunkHashes(list []string) ([]string, *uploadError) {
+	if len(list) == 0 || len(list) > MaxChunkList {
+		return nil, &uploadError{http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("a chunk list has 1 to %d hashes, not %d", MaxChunkList, len(list))}
+	}
+	hashes := make([]string, len(list))
+	for i, h := range list {
+		var uerr *uploadError
+		if hashes[i], uerr = parseChunkHash(h); uerr != nil {
+			return nil, uerr
+		}
+	}
+	return hashes, nil
+}
+
+// missingChunks returns the hashes not in the store, each once, and the
+// total size of the file they make when none are; those present are
+// marked used, so the janitor keeps them.
+func (s *Server) missingChunks(hashes []string) ([]string, int64) {
+	var (
+		missing []string
+		size    int64
+		sizes   = make(map[string]int64, len(hashes)) // -1 = missing
+		now     = s.now()
+	)
+	for _, h := range hashes {
+		n, seen := sizes[h]
+		if !seen {
+			var err error
+			if n, err = s.chunks.touch(h, now); err != nil {
+				n = -1
+				missing = append(missing, h)
+			}
+			sizes[h] = n
+		}
+		size += max(n, 0)
+	}
+	return missing, size
+}
+
+// chunksExistHandler tells a client which of its chunks it must send.
+func (s *Server) chunksExistHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var req ChunkListRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxChunkListBody)).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid JSON body: %v", err)
+		return
+	}
+	hashes, uerr := parseChunkHashes(req.Hashes)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	missing, _ := s.missingChunks(hashes)
+	if missing == nil {
+		missing = []string{}
+	}
+	logFor(w).Info("chunk lookup", "chunks", len(hashes), "missing", len(missing))
+	respondJSON(w, http.StatusOK, ChunkListResponse{Missing: missing})
+}
+
+// readErrReader remembers why reading its body failed, telling a client
+// that stopped sending apart from a store that could not write.
+type readErrReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// storeChunkHandler stores one chunk under its hash. A chunk already held
+// is acknowledged as a duplicate without reading the body.
+func (s *Server) storeChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if r.Method != http.MethodPut {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only PUT allowed")
+		return
+	}
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+	hash, uerr := parseChunkHash(r.PathValue("hash"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	limit := s.cfg.MaxChunkSize
+	if limit == 0 {
+		limit = MaxStoredChunk
+	}
+	if r.ContentLength > limit {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeChunkTooLarge, "chunk is %d bytes, limit is %d", r.ContentLength, limit)
+		return
+	}
+	if size, err := s.chunks.touch(hash, s.now()); err == nil {
+		respondSuccess(w, SuccessResponse{Status: "ok", Received: size, Duplicate: true})
+		return
+	}
+
+	body := &readErrReader{r: http.MaxBytesReader(w, r.Body, limit)}
+	n, err := s.chunks.put(hash, s.throttle(r, ChunkStore, body))
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(body.err, &tooBig):
+		respondError(w, http.StatusRequestEntityTooLarge, CodeChunkTooLarge, "chunk is over %d bytes, the limit", limit)
+		return
+	case body.err != nil:
+		respondError(w, http.StatusBadRequest, CodeIncompleteWrite, "cannot read chunk %s: %v", hash, body.err)
+		return
+	case errors.Is(err, errChunkDigest):
+		respondError(w, http.StatusUnprocessableEntity, CodeChunkHashMismatch, "chunk %s: %v", hash, err)
+		return
+	case err != nil:
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot store chunk %s: %v", hash, err)
+		return
+	}
+	logFor(w).Info("stored chunk", "hash", hash, "bytes", n)
+	s.chunkWritten(n)
+	respondSuccess(w, SuccessResponse{Status: "ok", Received: n})
+}
+
+func respondMissingChunks(w http.ResponseWriter, missing []string) {
+	msg := fmt.Sprintf("%d chunks are not stored: send them first", len(missing))
+	respondErrorWith(w, http.StatusConflict, CodeChunksMissing, msg, func(e ErrorResponse) any {
+		return MissingChunksResponse{ErrorResponse: e, Missing: missing}
+	})
+}
+
+// assembleChunksHandler completes an upload from the chunk store: the
+// named chunks are concatenated into the part file, which is then
+// finalized like one sent chunk by chunk.
+func (s *Server) assembleChunksHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+	if err := s.ensureDirs(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot initialise upload directory")
+		return
+	}
+
+	var req AssembleRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxChunkListBody)).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid JSON body: %v", err)
+		return
+	}
+	if req.FileName == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "missing fileName")
+		return
+	}
+	fileName, uerr := s.cleanFileName(req.FileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	hashes, uerr := parseChunkHashes(req.Chunks)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	retention, uerr := s.requestedRetention(req.Retention)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	missing, size := s.missingChunks(hashes)
+	if len(missing) > 0 {
+		respondMissingChunks(w, missing)
+		return
+	}
+	if limit := s.uploadLimit(0); limit > 0 && size > limit {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeFileTooLarge, "file is %d bytes, limit is %d", size, limit)
+		return
+	}
+	if q := s.checkQuota(r, fileName, size); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+
+	key := fileName
+	lock := s.locks.Get(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	meta := &storage.Meta{Owner: uploadOwner(r), CreatedAt: s.now().UTC(), FileName: fileName, FileSize: size, TotalChunks: len(hashes),
+		Retention: retention}
+	if err := s.store.SaveMeta(key, meta); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot save upload metadata: %v", err)
+		return
+	}
+	s.recordUploadStart(r, key, fileName, size, len(hashes), meta.CreatedAt)
+
+	sums := make(map[string]string)
+	if req.Hash != "" {
+		sums[ChecksumSHA256] = req.Hash
+	}
+	digest := newFileDigest(sums)
+	s.publish(key, UploadEvent{Type: EventAssembling})
+	assemble := spanOf(w).child("storage.assemble", "upload.total_chunks", len(hashes))
+	err := s.assembleFromChunks(key, hashes, digest)
+	assemble.done(err)
+	if err == nil {
+		err = digest.check()
+	}
+	if err != nil {
+		if rmErr := s.store.RemovePart(key); rmErr != nil {
+			logFor(w).Warn("cannot remove assembled part", "file", fileName, "error", rmErr)
+		}
+		if errors.Is(err, errChecksumMismatch) {
+			s.publish(key, UploadEvent{Type: EventFailed, FileName: fileName, Code: CodeFileHashMismatch, Error: err.Error()})
+			respondError(w, http.StatusUnprocessableEntity, CodeFileHashMismatch, "file hash mismatch: %v", err)
+			return
+		}
+		s.publish(key, UploadEvent{Type: EventFailed, FileName: fileName, Code: CodeServerError, Error: err.Error()})
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot assemble chunks: %v", err)
+		return
+	}
+
+	finalPath, err := s.finalizeWithRetry(w, key, fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeFinalizeFailed, "cannot move %s into place: %v", fileName, err)
+		return
+	}
+	s.received.Forget(key)
+	logFor(w).Info("upload assembled from chunk store", "path", finalPath, "chunks", len(hashes), "bytes", size)
+
+	resp, uerr := s.completedResponse(r, key, fileName, finalPath)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	respondSuccess(w, resp)
+}
+
+// assembleFromChunks writes the chunks named by hashes, in order, to the
+// part file of key and to digest.
+func (s *Server) assembleFromChunks(key string, hashes []string, digest io.Writer) error {
+	f, err := s.store.OpenPart(key, true)
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		c, err := s.chunks.open(h)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(io.MultiWriter(f, digest), c)
+		c.Close()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("chunk %s: %w", h, err)
+		}
+	}
+	return f.Close()
+}
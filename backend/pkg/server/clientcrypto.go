@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Client-side encryption: the manifest sent as "encryption" to POST
+// /upload/init, kept with the file and returned on download
+// ---------------------------------------------------------------------
+
+// ManifestTable is the encryption manifest table's file inside UploadDir.
+const ManifestTable = ".encryption.json"
+
+// EncryptionManifestHeader carries the manifest of an encrypted file on
+// download, as base64 of its JSON.
+const EncryptionManifestHeader = "X-Encryption-Manifest"
+
+// MaxWrappedKey bounds the decoded size of a manifest's wrapped key.
+const MaxWrappedKey = 1 << 10
+
+// clientCiphers are the AEADs a manifest may name: the bytes each chunk
+// grows by (the tag) and the length of its IV.
+var clientCiphers = map[string]struct{ overhead, ivSize int }{
+	"AES-256-GCM":        {16, 12},
+	"CHACHA20-POLY1305":  {16, 12},
+	"XCHACHA20-POLY1305": {16, 24},
+}
+
+// requestedEncryption parses the optional "encryption" field of an init
+// request and checks it against the upload: one IV per chunk, and with
+// both sizes declared a fileSize that is the plaintext plus one tag per
+// chunk. The contents stay opaque; only their shape is checked.
+func (s *Server) requestedEncryption(r *http.Request, totalChunks int, fileSize int64, extract string) (*storage.EncryptionManifest, *uploadError) {
+	v := r.FormValue("encryption")
+	if v == "" {
+		return nil, nil
+	}
+	invalid := func(format string, args ...any) (*storage.EncryptionManifest, *uploadError) {
+		return nil, &uploadError{http.StatusBadRequest, CodeInvalidManifest, "encryption manifest: " + fmt.Sprintf(format, args...)}
+	}
+	if extract != "" {
+		return invalid("an encrypted archive cannot be extracted")
+	}
+	var m storage.EncryptionManifest
+	dec := json.NewDecoder(strings.NewReader(v))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return invalid("%v", err)
+	}
+	m.Algorithm = strings.ToUpper(m.Algorithm)
+	c, ok := clientCiphers[m.Algorithm]
+	if !ok {
+		names := make([]string, 0, len(clientCiphers))
+		for name := range clientCiphers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return invalid("unsupported algorithm %q, want one of %s", m.Algorithm, strings.Join(names, ", "))
+	}
+	if key, err := base64.StdEncoding.DecodeString(m.WrappedKey); err != nil || len(key) == 0 || len(key) > MaxWrappedKey {
+		return invalid("wrappedKey must be 1 to %d bytes of base64", MaxWrappedKey)
+	}
+	if len(m.IVs) != totalChunks {
+		return invalid("%d IVs for %d chunks", len(m.IVs), totalChunks)
+	}
+	for i, iv := range m.IVs {
+		if b, err := base64.StdEncoding.DecodeString(iv); err != nil || len(b) != c.ivSize {
+			return invalid("IV %d must be %d bytes of base64", i, c.ivSize)
+		}
+	}
+	if m.PlaintextSize < 0 {
+		return invalid("negative plaintextSize")
+	}
+	if want := m.PlaintextSize + int64(totalChunks*c.overhead); m.PlaintextSize > 0 && fileSize > 0 && fileSize != want {
+		return invalid("fileSize %d does not match plaintextSize %d plus %d bytes of tag per chunk", fileSize, m.PlaintextSize, c.overhead)
+	}
+	return &m, nil
+}
+
+// manifestTable records the encryption manifest of each completed file.
+type manifestTable struct {
+	*storage.Table[*storage.EncryptionManifest]
+}
+
+func newManifestTable(dir string, mode os.FileMode) *manifestTable {
+	return &manifestTable{storage.NewTable[*storage.EncryptionManifest]("encryption manifest table", filepath.Join(dir, ManifestTable), mode)}
+}
+
+// set records the manifest of name; nil forgets it.
+func (t *manifestTable) set(name string, m *storage.EncryptionManifest) error {
+	if m == nil {
+		return t.Delete(name)
+	}
+	return t.Set(name, m)
+}
+
+// get returns the manifest of name, nil for a plaintext file.
+func (t *manifestTable) get(name string) (*storage.EncryptionManifest, error) {
+	m, _, err := t.Get(name)
+	return m, err
+}
+
+// recordManifest remembers the manifest of the completed file name; nil
+// forgets one left by an earlier, encrypted upload of the same name.
+func (s *Server) recordManifest(name string, m *storage.EncryptionManifest) {
+	if err := s.manifests.set(name, m); err != nil {
+		slog.Warn("cannot record encryption manifest", "file", name, "error", err)
+	}
+}
+
+// setManifestHeader adds EncryptionManifestHeader to the download of an
+// encrypted file name.
+func (s *Server) setManifestHeader(w http.ResponseWriter, name string) {
+	m, err := s.manifests.get(name)
+	if err != nil {
+		logFor(w).Warn("cannot read encryption manifest", "file", name, "error", err)
+	}
+	if m == nil {
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	w.Header().Set(EncryptionManifestHeader, base64.StdEncoding.EncodeToString(data))
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Gzip completed files at rest (COMPRESS_AT_REST=true, off by default)
+// ---------------------------------------------------------------------
+
+// CompressTable is the compressed file table's file inside UploadDir.
+const CompressTable = ".compressed.json"
+
+// incompressibleExts are formats that are already compressed.
+var incompressibleExts = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".webm": true,
+	".pdf": true,
+}
+
+// shouldCompress skips already-compressed files, judged by extension and
+// by the sniffed content type.
+func shouldCompress(name, contentType string) bool {
+	if incompressibleExts[strings.ToLower(filepath.Ext(name))] {
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip",
+		"application/x-gzip", "application/x-rar-compressed", "application/pdf"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// gzipSizeField is the gzip header extra subfield (RFC 1952 2.3.1.1) in
+// which compressStored records the original size, so downloads can answer
+// Range requests without decompressing the whole file first.
+var gzipSizeField = [2]byte{'C', 'U'}
+
+// gzipSizeExtra encodes size as a header extra field.
+func gzipSizeExtra(size int64) []byte {
+	extra := []byte{gzipSizeField[0], gzipSizeField[1], 8, 0}
+	return binary.LittleEndian.AppendUint64(extra, uint64(size))
+}
+
+// gzipOriginalSize finds the size recorded by gzipSizeExtra; ok is false
+// for files compressed before it was recorded.
+func gzipOriginalSize(extra []byte) (size int64, ok bool) {
+	for len(extra) >= 4 {
+		n := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+n {
+			return 0, false
+		}
+		if extra[0] == gzipSizeField[0] && extra[1] == gzipSizeField[1] && n == 8 {
+			return int64(binary.LittleEndian.Uint64(extra[4:12])), true
+		}
+		extra = extra[4+n:]
+	}
+	return 0, false
+}
+
+// compressStored gzips the completed file name in place and returns the
+// compressed size. The gzip stream is written to the part file of key,
+// which finalizing name has just used up, and finalized over name, so
+// the file keeps its name; the caller records it as compressed.
+func compressStored(st storage.Storage, key, name string) (int64, error) {
+	size, _, err := st.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	in, err := st.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	out, err := st.OpenPart(key, true)
+	if err != nil {
+		in.Close()
+		return 0, err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = name
+	zw.Extra = gzipSizeExtra(size)
+	_, err = io.Copy(zw, in)
+	in.Close()
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		_, err = st.Finalize(key, name)
+	}
+	if err != nil {
+		st.RemovePart(key)
+		return 0, err
+	}
+	gzSize, _, err := st.Stat(name)
+	return gzSize, err
+}
+
+// compressTable records which completed files are gzipped at rest.
+type compressTable struct {
+	*storage.Table[bool]
+}
+
+func newCompressTable(dir string, mode os.FileMode) *compressTable {
+	return &compressTable{storage.NewTable[bool]("compressed file table", filepath.Join(dir, CompressTable), mode)}
+}
+
+// set records whether name is compressed.
+func (t *compressTable) set(name string, gz bool) error {
+	return t.Update(func(files map[string]bool) (bool, error) {
+		if files[name] == gz {
+			return false, nil
+		}
+		if gz {
+			files[name] = true
+		} else {
+			delete(files, name)
+		}
+		return true, nil
+	})
+}
+
+// get reports whether name is compressed.
+func (t *compressTable) get(name string) (bool, error) {
+	gz, _, err := t.Get(name)
+	return gz, err
+}
+
+// isCompressed reports whether the completed file name is gzipped at rest.
+func (s *Server) isCompressed(name string) bool {
+	gz, err := s.compressed.get(name)
+	if err != nil {
+		slog.Warn("cannot read compressed file table", "file", name, "error", err)
+	}
+	return gz
+}
+
+// recordCompressed remembers whether the completed file name is gzipped
+// at rest; false forgets a compressed file of the same name replaced by
+// a new upload.
+func (s *Server) recordCompressed(name string, gz bool) {
+	if err := s.compressed.set(name, gz); err != nil {
+		slog.Warn("cannot record compressed file", "file", name, "error", err)
+	}
+}
+
+// openStored opens the completed file name as the bytes that were
+// uploaded, decompressing one gzipped at rest, and returns their size.
+// The reader seeks, so http.ServeContent can answer Range requests.
+func (s *Server) openStored(name string) (io.ReadSeekCloser, int64, error) {
+	size, _, err := s.store.Stat(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := s.store.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !s.isCompressed(name) {
+		return f, size, nil
+	}
+	if size, err = gzipSize(f); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	var zr *gzip.Reader
+	if err == nil {
+		zr, err = gzip.NewReader(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("cannot decompress %s: %w", name, err)
+	}
+	return &gzipReadSeeker{f: f, zr: zr, size: size}, size, nil
+}
+
+// statStored is s.store.Stat with the original size of a file gzipped at
+// rest.
+func (s *Server) statStored(name string) (int64, time.Time, error) {
+	size, modTime, err := s.store.Stat(name)
+	if err != nil || !s.isCompressed(name) {
+		return size, modTime, err
+	}
+	f, err := s.store.Open(name)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer f.Close()
+	size, err = gzipSize(f)
+	return size, modTime, err
+}
+
+// hashStored returns the hex SHA-256 of the completed file name as
+// uploaded, not of its gzip stream when compressed at rest.
+func (s *Server) hashStored(name string) (string, error) {
+	f, _, err := s.openStored(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// gzipReadSeeker presents a gzip file as its decompressed content of
+// known size. Seeking forward decompresses and discards; seeking backward
+// starts over from the top, which is what http.ServeContent needs for one
+// Range.
+type gzipReadSeeker struct {
+	f    io.ReadSeekCloser
+	zr   *gzip.Reader
+	size int64
+	pos  int64 // where the next Read starts
+	at   int64 // how far zr has decompressed
+}
+
+func (g *gzipReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += g.pos
+	case io.SeekEnd:
+		offset += g.size
+	}
+	if offset < 0 {
+		return 0, errors.New("gzip seek: negative position")
+	}
+	g.pos = offset
+	return offset, nil
+}
+
+func (g *gzipReadSeeker) Read(p []byte) (int, error) {
+	if g.pos >= g.size {
+		return 0, io.EOF
+	}
+	if g.at > g.pos {
+		if _, err := g.f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := g.zr.Reset(g.f); err != nil {
+			return 0, err
+		}
+		g.at = 0
+	}
+	if g.at < g.pos {
+		n, err := io.CopyN(io.Discard, g.zr, g.pos-g.at)
+		g.at += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.zr.Read(p)
+	g.at += int64(n)
+	g.pos += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file.
+func (g *gzipReadSeeker) Close() error {
+	return g.f.Close()
+}
@@ -0,0 +1,1505 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rsa"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ---------------------------------------------------------------------
+// Server configuration (defaults < config file < environment < flags)
+// ---------------------------------------------------------------------
+type Config struct {
+	Addr      string // listen address (PORT)
+	UploadDir string // completed files (UPLOAD_DIR)
+	TempDir   string // .part files while uploading (TEMP_DIR)
+
+	TLSCert, TLSKey  string   // serve HTTPS when both are set (TLS_CERT, TLS_KEY)
+	AutocertHosts    []string // get certificates from Let's Encrypt for these hosts (AUTOCERT_HOSTS)
+	AutocertDir      string   // certificate cache (AUTOCERT_DIR)
+	AutocertEmail    string   // ACME account contact (AUTOCERT_EMAIL)
+	AutocertURL      string   // ACME directory, "" = Let's Encrypt production (AUTOCERT_DIRECTORY_URL)
+	HTTPRedirectAddr string   // plain-HTTP listener redirecting to HTTPS, "" = none (HTTP_REDIRECT_ADDR)
+
+	ReadHeaderTimeout time.Duration // to read a request's headers (READ_HEADER_TIMEOUT)
+	ReadTimeout       time.Duration // to read a whole request, body included, 0 = none (READ_TIMEOUT)
+	H2C               bool          // HTTP/2 with prior knowledge on the plain listener, for gRPC (H2C)
+
+	ShutdownTimeout time.Duration // wait for in-flight uploads on SIGINT/SIGTERM (SHUTDOWN_TIMEOUT)
+	ShutdownDelay   time.Duration // keep serving, failing /readyz, before draining (SHUTDOWN_DELAY)
+
+	StorageBackend string               // disk (default), s3, gcs, azure or sftp (STORAGE_BACKEND)
+	Object         storage.ObjectConfig // bucket settings for s3 / gcs
+	Azure          storage.AzureConfig  // container settings for azure
+	SFTP           storage.SFTPConfig   // server settings for sftp
+
+	DirectUpload       bool          // clients PUT parts straight to the bucket via POST /upload/direct (DIRECT_UPLOAD)
+	DirectUploadURLTTL time.Duration // lifetime of a pre-signed part URL (DIRECT_UPLOAD_URL_TTL)
+
+	MaxMemory    int64 // bytes of a buffered chunk held in memory (MAX_MEMORY)
+	MaxFileSize  int64 // per-upload limit, 0 = none (MAX_FILE_SIZE)
+	MaxChunkSize int64 // per-chunk limit, 0 = none (MAX_CHUNK_SIZE)
+	MinChunkSize int64 // smallest chunk but the last, 0 = none (MIN_CHUNK_SIZE)
+	ChunkSize    int64 // chunk size GET /upload/config suggests, 0 = DefaultChunkSize within the limits (CHUNK_SIZE)
+	UserQuota    int64 // bytes each authenticated user may store, 0 = none (USER_QUOTA)
+	MinFreeSpace int64 // free bytes below which new uploads are refused, 0 = off (MIN_FREE_SPACE)
+
+	FileNamePolicy string // unicode (default), ascii or strict (FILENAME_POLICY)
+	MapFileNames   bool   // store files under generated keys (MAP_FILE_NAMES)
+	StorageLayout  string // flat (default) or content (STORAGE_LAYOUT)
+
+	AllowedTypes []string // sniffed MIME types accepted, e.g. image/*; none = any (ALLOWED_TYPES)
+	BlockedTypes []string // sniffed MIME types refused, checked first (BLOCKED_TYPES)
+
+	FileMode os.FileMode // FILE_MODE
+	DirMode  os.FileMode // DIR_MODE
+	NoFsync  bool        // finalize without fsync: faster, but a crash may lose or truncate files (NO_FSYNC)
+
+	UploadTTL       time.Duration      // part files expire after this, 0 = never (UPLOAD_TTL)
+	StaleTTL        time.Duration      // janitor deletes uploads idle this long, 0 = off (STALE_UPLOAD_TTL)
+	Retention       time.Duration      // completed files are deleted after this, 0 = kept (RETENTION)
+	MaxRetention    time.Duration      // longest retention an upload may ask for, 0 = any (MAX_RETENTION)
+	JanitorEvery    time.Duration      // how often the janitor scans (JANITOR_INTERVAL)
+	CompressAtRest  bool               // gzip completed files (COMPRESS_AT_REST)
+	Thumbnails      []ThumbnailSize    // JPEG thumbnails made of image uploads, none = off (THUMBNAILS)
+	ExtractMaxFiles int                // files one extract=true archive may hold, 0 = any (EXTRACT_MAX_FILES)
+	ExtractMaxSize  int64              // bytes one extract=true archive may unpack to, 0 = any (EXTRACT_MAX_SIZE)
+	EncryptionKey   []byte             // AES-256 master key (ENCRYPTION_KEY or ENCRYPTION_KEY_FILE)
+	KMS             storage.KMSConfig  // wrap data keys with AWS KMS instead (KMS_KEY_ID)
+	KeyWrapper      storage.KeyWrapper // custom key wrapper (e.g. another KMS); overrides both
+	Deduplicate     bool               // keep one copy of identical files (DEDUPLICATE)
+	ChunkDedup      bool               // content-defined chunk store and /chunks endpoints (CHUNK_DEDUP)
+	ChunkTTL        time.Duration      // drop chunks unused this long, 0 = keep (CHUNK_TTL)
+	DeltaUpload     bool               // rsync-style GET /files/{name}/signature and POST /files/{name}/patch (DELTA_UPLOAD)
+	Versioning      bool               // keep the files uploads replace, GET /files/{name}/versions (VERSIONING)
+	MaxVersions     int                // previous versions kept per file, 0 = any number (MAX_VERSIONS)
+	VersionTTL      time.Duration      // drop a version this long after it was replaced, 0 = keep (VERSION_RETENTION)
+	VersionPolicy   []VersionRule      // per-pattern limits overriding the two above (VERSION_POLICY)
+	MetadataDB      string             // SQLite path or postgres:// URL, "" = off (METADATA_DB)
+	AuditLog        string             // JSONL file, or "db" for METADATA_DB's audit_log table, "" = off (AUDIT_LOG)
+	AuditMaxSize    int64              // rotate the audit file past this many bytes (AUDIT_LOG_MAX_SIZE)
+	AuditMaxFiles   int                // rotated audit files kept, 0 = all (AUDIT_LOG_MAX_FILES)
+	LockURL         string             // redis:// or postgres:// URLs for locks shared by replicas, "" = in-process (LOCK_URL)
+	LockTTL         time.Duration      // Redis lock lease, renewed while held (LOCK_TTL)
+	Locker          session.Locker     // custom shared locks; overrides LOCK_URL
+	SessionCache    string             // redis:// URL caching upload metadata, "" = off (SESSION_CACHE)
+	ClamdAddr       string             // clamd socket, "" = no virus scanning (CLAMD_ADDR)
+	ScanTimeout     time.Duration      // per file (SCAN_TIMEOUT)
+	ScanInfected    string             // quarantine or delete rejected files (SCAN_INFECTED)
+	QuarantineDir   string             // where rejected files go, default UploadDir/.quarantine (QUARANTINE_DIR)
+	ScanOnError     string             // reject or accept files the scanner could not check (SCAN_ON_ERROR)
+	Scanner         Scanner            // custom post-assembly hook; overrides CLAMD_ADDR
+	WebhookURLs     []string           // upload event notifications, none = off (WEBHOOK_URL)
+	WebhookSecret   string             // HMAC key signing each delivery (WEBHOOK_SECRET)
+	WebhookAttempts int                // deliveries tried per URL (WEBHOOK_ATTEMPTS)
+	WebhookBackoff  time.Duration      // wait after the first failed attempt, doubled after each (WEBHOOK_BACKOFF)
+
+	TranscodePresets []TranscodePreset // ffmpeg renditions of video uploads, none = off (TRANSCODE_PRESETS)
+	FFmpegPath       string            // FFMPEG_PATH
+	TranscodeWorkers int               // ffmpeg runs at a time per process (TRANSCODE_WORKERS)
+	TranscodeTimeout time.Duration     // per preset (TRANSCODE_TIMEOUT)
+	TranscodeQueue   string            // redis:// URL of a job queue shared by replicas, "" = in-process (TRANSCODE_QUEUE)
+
+	HookCommand []*template.Template // program and arguments over HookData, run after each upload, none = off (POST_UPLOAD_COMMAND)
+	HookTimeout time.Duration        // POST_UPLOAD_TIMEOUT
+
+	MaxConcurrentUploads int     // 0 = unlimited (MAX_CONCURRENT_UPLOADS)
+	MaxUploadsPerClient  int     // per user or client IP, 0 = unlimited (MAX_UPLOADS_PER_CLIENT)
+	RateLimitRPS         float64 // per client IP, 0 = off (RATE_LIMIT_RPS)
+	RateLimitBurst       int     // RATE_LIMIT_BURST
+	RateLimitUserRPS     float64 // per authenticated user, 0 = off (RATE_LIMIT_USER_RPS)
+	RateLimitUserBurst   int     // RATE_LIMIT_USER_BURST
+	BandwidthLimit       int64   // chunk bytes/sec written by all uploads together, 0 = off (BANDWIDTH_LIMIT)
+	UploadBandwidthLimit int64   // chunk bytes/sec written by each upload, 0 = off (UPLOAD_BANDWIDTH_LIMIT)
+	TrustProxy           bool    // take client IP from X-Forwarded-For (TRUST_PROXY)
+
+	AllowedOrigins       []string      // CORS allow-list (ALLOWED_ORIGINS)
+	CORSAllowCredentials bool          // send Access-Control-Allow-Credentials (CORS_ALLOW_CREDENTIALS)
+	CORSMaxAge           time.Duration // preflight cache time (CORS_MAX_AGE)
+
+	RequireUploadID bool // reject chunks without a POST /upload/init session (REQUIRE_UPLOAD_ID, default true)
+
+	LogFormat string     // text (default) or json (LOG_FORMAT)
+	LogLevel  slog.Level // LOG_LEVEL
+
+	OTLPEndpoint     string      // OTLP/HTTP collector traces are sent to, "" = no tracing (OTEL_EXPORTER_OTLP_ENDPOINT)
+	OTLPHeaders      http.Header // sent with every export, e.g. an API key (OTEL_EXPORTER_OTLP_HEADERS)
+	TraceService     string      // service.name of the spans (OTEL_SERVICE_NAME)
+	TraceSampleRatio float64     // of traces started here that are recorded, 0..1 (OTEL_TRACES_SAMPLER_ARG)
+
+	APIKeys      string         // comma-separated "name:key" entries (API_KEYS)
+	JWTSecret    string         // HS256 key for bearer tokens (JWT_SECRET)
+	JWTPublicKey *rsa.PublicKey // RS256 key, read from the PEM file JWT_PUBLIC_KEY
+	JWTIssuer    string         // required "iss" claim, "" = any (JWT_ISSUER)
+	JWTAudience  string         // required "aud" claim, "" = any (JWT_AUDIENCE)
+	AuthRoutes   []string       // route groups needing credentials (AUTH_ROUTES)
+	AdminUsers   []string       // users who manage everyone's uploads (ADMIN_USERS)
+	AdminToken   string         // opens the /admin endpoints, "" = off (ADMIN_TOKEN)
+	Auth         Authenticator  // custom authenticator; overrides API_KEYS and JWT_*
+
+	SigningKey      string        // HMAC key of signed download URLs, "" = off (SIGNING_KEY)
+	SignedURLTTL    time.Duration // default lifetime of a signed URL (SIGNED_URL_TTL)
+	SignedURLMaxTTL time.Duration // longest lifetime one may ask for (SIGNED_URL_MAX_TTL)
+
+	TenantMode  string   // "" = one tenant, apikey or path (TENANT_MODE)
+	Tenants     []string // tenant names; apikey mode defaults to the API key names (TENANTS)
+	TenantQuota int64    // bytes of completed files each tenant may store, 0 = none (TENANT_QUOTA)
+
+	tenant string // set by forTenant
+}
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() Config {
+	return Config{
+		Addr:              Port,
+		ShutdownTimeout:   30 * time.Second,
+		ReadHeaderTimeout: DefaultReadHeaderTimeout,
+		RequireUploadID:   true,
+		JanitorEvery:      time.Hour,
+		UploadDir:         UploadDir,
+		TempDir:           UploadDir,
+		StorageBackend:    storage.BackendDisk,
+		FileNamePolicy:    FileNamePolicyUnicode,
+		StorageLayout:     storage.LayoutFlat,
+		LogFormat:         LogFormatText,
+		LogLevel:          slog.LevelInfo,
+		TraceService:      DefaultTraceService,
+		TraceSampleRatio:  1,
+		MaxMemory:         32 << 20, // 32 MB
+		FileMode:          0o644,
+		DirMode:           0o755,
+		AllowedOrigins:    []string{AllowedOrigin},
+		CORSMaxAge:        DefaultCORSMaxAge,
+		ScanTimeout:       DefaultScanTimeout,
+		ScanInfected:      ScanQuarantine,
+		ScanOnError:       ScanReject,
+		WebhookAttempts:   DefaultWebhookAttempts,
+		WebhookBackoff:    DefaultWebhookBackoff,
+		FFmpegPath:        DefaultFFmpeg,
+		TranscodeWorkers:  DefaultTranscodeWorkers,
+		TranscodeTimeout:  DefaultTranscodeTimeout,
+		HookTimeout:       DefaultHookTimeout,
+		ExtractMaxFiles:   DefaultExtractMaxFiles,
+		ExtractMaxSize:    DefaultExtractMaxSize,
+		AuthRoutes:        []string{AuthUpload, AuthStatus, AuthDownload, AuthManage},
+		AutocertDir:       DefaultAutocertDir,
+		SignedURLTTL:      DefaultSignedURLTTL,
+		SignedURLMaxTTL:   DefaultSignedURLMaxTTL,
+		ChunkTTL:          DefaultChunkTTL,
+		MaxVersions:       DefaultMaxVersions,
+		AuditMaxSize:      DefaultAuditMaxSize,
+		AuditMaxFiles:     DefaultAuditMaxFiles,
+
+		DirectUploadURLTTL: DefaultDirectUploadURLTTL,
+	}
+}
+
+// configKeys lists every setting. Each can come from a config file (key
+// upload_dir), the environment (UPLOAD_DIR) or a flag (-upload-dir);
+// later sources win: defaults < file < env < flags.
+var configKeys = []struct{ name, usage string }{
+	{"PORT", "listen address, \"8080\" or \"host:8080\" (default " + Port + ")"},
+	{"UPLOAD_DIR", "directory for completed files (default " + UploadDir + ")"},
+	{"TEMP_DIR", "directory for .part files (default UPLOAD_DIR)"},
+	{"TLS_CERT", "PEM certificate; with TLS_KEY serves HTTPS"},
+	{"TLS_KEY", "PEM private key"},
+	{"AUTOCERT_HOSTS", "comma-separated host names to get Let's Encrypt certificates for, instead of TLS_CERT"},
+	{"AUTOCERT_DIR", "directory caching the certificates and account key (default " + DefaultAutocertDir + ")"},
+	{"AUTOCERT_EMAIL", "contact address for the ACME account"},
+	{"AUTOCERT_DIRECTORY_URL", "ACME directory URL, e.g. Let's Encrypt staging (default production)"},
+	{"HTTP_REDIRECT_ADDR", "also listen for plain HTTP here, e.g. :80, redirecting to HTTPS and answering ACME challenges"},
+	{"READ_HEADER_TIMEOUT", "how long a client may take to send a request's headers (default 10s)"},
+	{"READ_TIMEOUT", "how long a client may take to send a whole request, body included; 0 = no limit (default 0)"},
+	{"H2C", "also accept unencrypted HTTP/2 with prior knowledge on a plain listener, as gRPC clients speak it (default false)"},
+	{"SHUTDOWN_TIMEOUT", "how long to wait for in-flight uploads on shutdown (default 30s)"},
+	{"SHUTDOWN_DELAY", "how long to keep serving on shutdown, with /readyz failing, before refusing new uploads (default 0)"},
+	{"STORAGE_BACKEND", "disk, s3, gcs, azure or sftp"},
+	{"S3_BUCKET", "object storage bucket"},
+	{"S3_REGION", "object storage region"},
+	{"S3_ENDPOINT", "S3-compatible endpoint URL, e.g. MinIO or Ceph RGW"},
+	{"S3_ADDRESSING", "path or virtual (default path with S3_ENDPOINT, virtual on AWS)"},
+	{"S3_PREFIX", "object key prefix"},
+	{"S3_ACCESS_KEY_ID", "object storage access key (default AWS_ACCESS_KEY_ID)"},
+	{"S3_SECRET_ACCESS_KEY", "object storage secret key (default AWS_SECRET_ACCESS_KEY)"},
+	{"S3_SESSION_TOKEN", "session token of temporary keys (default AWS_SESSION_TOKEN)"},
+	{"S3_CREDENTIALS", "where to look for keys, in order: keys, file, container, imds (default all four on s3, keys,file on gcs)"},
+	{"S3_PROFILE", "profile of the shared credentials file (default AWS_PROFILE or default)"},
+	{"S3_CREDENTIALS_FILE", "shared credentials file (default AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials)"},
+	{"AZURE_STORAGE_ACCOUNT", "Azure storage account"},
+	{"AZURE_CONTAINER", "Azure blob container"},
+	{"AZURE_BLOB_ENDPOINT", "Blob service URL (default https://<account>.blob.core.windows.net), e.g. Azurite's"},
+	{"AZURE_PREFIX", "blob name prefix"},
+	{"AZURE_AUTH", "key, sas or managed-identity (default: key with AZURE_STORAGE_KEY, sas with AZURE_SAS_TOKEN, else managed-identity)"},
+	{"AZURE_STORAGE_KEY", "storage account key, base64"},
+	{"AZURE_SAS_TOKEN", "SAS token with read, write, delete and list on the container"},
+	{"AZURE_CLIENT_ID", "client ID of a user-assigned managed identity"},
+	{"SFTP_ADDR", "SFTP server, host or host:port (port 22 by default)"},
+	{"SFTP_USER", "SFTP login"},
+	{"SFTP_PASSWORD", "SFTP password"},
+	{"SFTP_KEY_FILE", "SSH private key file, instead of or besides SFTP_PASSWORD"},
+	{"SFTP_KEY_PASSPHRASE", "passphrase of an encrypted SFTP_KEY_FILE"},
+	{"SFTP_KNOWN_HOSTS", "known_hosts file with the server's host key (default ~/.ssh/known_hosts)"},
+	{"SFTP_DIR", "remote directory for completed files (default the login directory)"},
+	{"SFTP_CONNECTIONS", "SFTP connections kept open (default 4)"},
+	{"SFTP_RETRIES", "times an SFTP operation is retried after a connection failure (default 3)"},
+	{"DIRECT_UPLOAD", "with STORAGE_BACKEND=s3 or gcs, offer POST /upload/direct: clients PUT parts to pre-signed URLs, bypassing the server"},
+	{"DIRECT_UPLOAD_URL_TTL", "how long a pre-signed part URL works, at most 7d (default 1h)"},
+	{"MAX_MEMORY", "bytes of a buffered (not streamed) chunk held in memory before spilling to a temp file"},
+	{"MAX_FILE_SIZE", "per-upload byte limit, 0 = none"},
+	{"MAX_CHUNK_SIZE", "per-chunk byte limit, 0 = none"},
+	{"MIN_CHUNK_SIZE", "smallest chunk accepted, except an upload's last, 0 = none"},
+	{"CHUNK_SIZE", "chunk size suggested to clients by GET /upload/config (default 5 MiB, kept within MIN/MAX_CHUNK_SIZE)"},
+	{"USER_QUOTA", "bytes of completed files each authenticated user may store, 0 = none"},
+	{"MIN_FREE_SPACE", "free bytes below which new uploads are refused with 507 STORAGE_FULL, 0 = off"},
+	{"FILENAME_POLICY", "allowed file name characters: unicode, ascii or strict"},
+	{"MAP_FILE_NAMES", "store completed files under generated keys instead of their names"},
+	{"STORAGE_LAYOUT", "flat: completed files under their names; content: under their SHA-256 in sharded directories (ab/cd/abcdef...)"},
+	{"ALLOWED_TYPES", "comma-separated MIME types (image/png) or families (image/*) accepted, judged by content; none = any"},
+	{"BLOCKED_TYPES", "comma-separated MIME types or families refused, e.g. application/x-executable"},
+	{"FILE_MODE", "octal mode of stored files"},
+	{"DIR_MODE", "octal mode of created directories"},
+	{"NO_FSYNC", "finalize uploads without fsyncing the file and its directory: faster, but a crash may lose or truncate just-completed files"},
+	{"UPLOAD_TTL", "unfinished uploads expire after this duration, 0 = never"},
+	{"STALE_UPLOAD_TTL", "delete unfinished uploads not written to for this duration, 0 = never"},
+	{"JANITOR_INTERVAL", "how often to scan for stale uploads and expired files (default 1h)"},
+	{"RETENTION", "delete completed files this long after upload, e.g. 7d or 36h, unless the upload asks otherwise; 0 = keep"},
+	{"MAX_RETENTION", "longest retention an upload may ask for; also the default when RETENTION is unset"},
+	{"COMPRESS_AT_REST", "gzip completed files"},
+	{"THUMBNAILS", "store JPEG thumbnails of completed JPEG, PNG and GIF uploads in these comma-separated sizes, WxH or N for NxN, e.g. 128,640x480"},
+	{"EXTRACT_MAX_FILES", "most files an upload with extract=true may unpack, 0 = any (default 1000)"},
+	{"EXTRACT_MAX_SIZE", "most bytes an upload with extract=true may unpack to, 0 = any (default 1 GiB)"},
+	{"ENCRYPTION_KEY", "32-byte master key (hex or base64); encrypts completed files with AES-256-GCM"},
+	{"ENCRYPTION_KEY_FILE", "file holding the master key, instead of ENCRYPTION_KEY"},
+	{"KMS_KEY_ID", "AWS KMS key (ID, ARN or alias/name) wrapping the data keys, instead of a master key"},
+	{"KMS_REGION", "KMS region (default S3_REGION or us-east-1)"},
+	{"KMS_ENDPOINT", "KMS endpoint URL (default https://kms.<region>.amazonaws.com)"},
+	{"DEDUPLICATE", "discard uploads whose content is already stored"},
+	{"CHUNK_DEDUP", "keep uploaded chunks by content hash and assemble files from them (POST /chunks/exists, PUT /chunks/{hash}, POST /chunks/assemble)"},
+	{"CHUNK_TTL", "drop stored chunks no upload has used for this long, 0 = keep (default 30d)"},
+	{"DELTA_UPLOAD", "update stored files from a delta against their block signature (GET /files/{name}/signature, POST /files/{name}/patch)"},
+	{"VERSIONING", "keep the files that uploads of the same name replace (GET /files/{name}/versions, GET /files/{name}?version=)"},
+	{"MAX_VERSIONS", "previous versions kept per file, 0 = any number (default 10)"},
+	{"VERSION_RETENTION", "drop a previous version this long after it was replaced, e.g. 90d; 0 = keep (default)"},
+	{"VERSION_POLICY", "per-file limits: comma-separated pattern=keep or pattern=keep/age rules, e.g. *.log=3,*.db=30/90d; the first match wins"},
+	{"METADATA_DB", "record uploads in SQLite (a path) or Postgres (a postgres:// URL)"},
+	{"AUDIT_LOG", "append an audit record of every init, chunk, complete, delete and download to this JSONL file, or to METADATA_DB with db"},
+	{"AUDIT_LOG_MAX_SIZE", "rotate the audit file once it reaches this many bytes (default 104857600)"},
+	{"AUDIT_LOG_MAX_FILES", "rotated audit files kept, oldest removed first; 0 keeps all (default 10)"},
+	{"LOCK_URL", "lock uploads across replicas: comma-separated redis://[:password@]host[:port][/db] URLs (several = Redlock) or a postgres:// URL"},
+	{"LOCK_TTL", "how long a Redis lock outlives a crashed holder; renewed while held (default 30s)"},
+	{"SESSION_CACHE", "cache upload metadata (received chunks, sessions) in Redis: redis://[:password@]host[:port][/db]"},
+	{"CLAMD_ADDR", "scan completed files with ClamAV: clamd socket as unix:/path or host:port"},
+	{"SCAN_TIMEOUT", "how long a scan may take (default 5m)"},
+	{"SCAN_INFECTED", "quarantine (default) or delete infected files"},
+	{"QUARANTINE_DIR", "where quarantined files go (default UPLOAD_DIR/" + Quarantine + ")"},
+	{"SCAN_ON_ERROR", "reject (default) or accept files the scanner could not check"},
+	{"WEBHOOK_URL", "comma-separated URLs to POST to when an upload completes, fails or is deleted"},
+	{"WEBHOOK_SECRET", "key for the X-Webhook-Signature HMAC-SHA256 of each delivery"},
+	{"WEBHOOK_ATTEMPTS", "deliveries tried per URL before giving up (default 5)"},
+	{"WEBHOOK_BACKOFF", "wait after the first failed delivery, doubled after each (default 2s)"},
+	{"TRANSCODE_PRESETS", "transcode completed video uploads with ffmpeg into these comma-separated presets: 1080p, 720p, 480p, 360p (H.264 MP4) or audio (AAC)"},
+	{"FFMPEG_PATH", "ffmpeg binary (default " + DefaultFFmpeg + ")"},
+	{"TRANSCODE_WORKERS", "transcoding jobs run at a time by this process (default 1)"},
+	{"TRANSCODE_TIMEOUT", "how long ffmpeg may take per preset (default 1h)"},
+	{"TRANSCODE_QUEUE", "queue transcoding jobs in Redis, shared by replicas: redis://[:password@]host[:port][/db]; default in-process"},
+	{"POST_UPLOAD_COMMAND", "command run after each completed upload, e.g. /usr/local/bin/process {{.Path}} {{.UploadID}}; fields: Path, FileName, UploadID, Size, ContentType, Tenant"},
+	{"POST_UPLOAD_TIMEOUT", "how long POST_UPLOAD_COMMAND may run (default 1m)"},
+	{"MAX_CONCURRENT_UPLOADS", "concurrent upload requests, 0 = unlimited"},
+	{"MAX_UPLOADS_PER_CLIENT", "concurrent upload requests per user (or client IP without auth), 0 = unlimited"},
+	{"RATE_LIMIT_RPS", "requests per second per client IP, 0 = off"},
+	{"RATE_LIMIT_BURST", "rate limit bucket size (default RATE_LIMIT_RPS rounded up)"},
+	{"RATE_LIMIT_USER_RPS", "requests per second per authenticated user (API key name or JWT subject), 0 = off"},
+	{"RATE_LIMIT_USER_BURST", "per-user bucket size (default RATE_LIMIT_USER_RPS rounded up)"},
+	{"BANDWIDTH_LIMIT", "bytes per second of chunk data taken in by all uploads together, 0 = off"},
+	{"UPLOAD_BANDWIDTH_LIMIT", "bytes per second of chunk data taken in by each upload, 0 = off"},
+	{"TRUST_PROXY", "take the client IP from X-Forwarded-For"},
+	{"ALLOWED_ORIGINS", "comma-separated CORS origins; https://*.example.com allows subdomains, * allows any (default " + AllowedOrigin + ")"},
+	{"CORS_ALLOW_CREDENTIALS", "let browsers send cookies and credentials cross-origin"},
+	{"CORS_MAX_AGE", "how long browsers may cache a preflight, e.g. 10m"},
+	{"REQUIRE_UPLOAD_ID", "false accepts chunks sent without POST /upload/init, keyed by fileName (default true)"},
+	{"LOG_FORMAT", "text or json"},
+	{"LOG_LEVEL", "debug, info, warn or error (default info)"},
+	{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTLP/HTTP collector for traces, e.g. http://otel-collector:4318; unset = no tracing"},
+	{"OTEL_EXPORTER_OTLP_HEADERS", "comma-separated key=value headers sent to the collector"},
+	{"OTEL_SERVICE_NAME", "service.name of the spans (default " + DefaultTraceService + ")"},
+	{"OTEL_TRACES_SAMPLER_ARG", "fraction of new traces recorded, 0 to 1 (default 1); requests with a traceparent follow the caller"},
+	{"API_KEYS", "comma-separated name:key pairs accepted in the X-API-Key header"},
+	{"JWT_SECRET", "HS256 secret for Authorization: Bearer tokens"},
+	{"JWT_PUBLIC_KEY", "PEM file with the RS256 public key for bearer tokens"},
+	{"JWT_ISSUER", "required JWT iss claim"},
+	{"JWT_AUDIENCE", "required JWT aud claim"},
+	{"AUTH_ROUTES", "route groups that need credentials: upload, status, download, manage, metrics (default upload,status,download,manage)"},
+	{"ADMIN_USERS", "comma-separated users (API key names or JWT subjects) who may list and delete every upload"},
+	{"ADMIN_TOKEN", "token (X-Admin-Token header) for the /admin endpoints, at least 16 characters; unset = no /admin"},
+	{"SIGNING_KEY", "secret, at least 32 characters, for POST /files/{name}/sign: HMAC-signed download URLs that need no credentials; unset = off"},
+	{"SIGNED_URL_TTL", "how long a signed URL works unless the request says otherwise (default 1h)"},
+	{"SIGNED_URL_MAX_TTL", "longest lifetime a signed URL may ask for, e.g. 7d (default 7d)"},
+	{"TENANT_MODE", "isolate uploads per tenant, named by the API key (apikey) or by a /t/{tenant}/ path prefix (path)"},
+	{"TENANTS", "comma-separated tenant names; required with TENANT_MODE=path (default the API key names)"},
+	{"TENANT_QUOTA", "bytes of completed files each tenant may store, 0 = none"},
+}
+
+// flagName turns a setting name into its flag: UPLOAD_DIR -> upload-dir.
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// LoadConfig layers the config file named by -config (or CONFIG_FILE), the
+// environment and the flags in args over DefaultConfig, then validates the
+// result.
+func LoadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("chunk-upload", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON config file (CONFIG_FILE)")
+	for _, k := range configKeys {
+		fs.String(flagName(k.name), "", k.usage+" ("+k.name+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	values := make(map[string]string)
+	if *configFile != "" {
+		fileValues, err := readConfigFile(*configFile)
+		if err != nil {
+			return Config{}, err
+		}
+		for k, v := range fileValues {
+			values[k] = v
+		}
+	}
+	for _, k := range configKeys {
+		if v := os.Getenv(k.name); v != "" {
+			values[k.name] = v
+		}
+	}
+	for k, aws := range awsFallbacks {
+		if values[k] == "" {
+			values[k] = os.Getenv(aws)
+		}
+	}
+	// Set by ECS, EKS and EC2 rather than by hand, so not settings.
+	for _, k := range awsEnvironment {
+		if v := os.Getenv(k); v != "" {
+			values[k] = v
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			values[strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))] = f.Value.String()
+		}
+	})
+	return configFrom(values)
+}
+
+// ConfigFromEnv is LoadConfig without flags.
+func ConfigFromEnv() (Config, error) {
+	return LoadConfig(nil)
+}
+
+// configFrom applies values (keyed by setting name, "" = unset) to
+// DefaultConfig.
+func configFrom(values map[string]string) (Config, error) {
+	cfg := DefaultConfig()
+	var err error
+	get := func(key string) string { return values[key] }
+
+	if v := get("PORT"); v != "" {
+		if !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		if _, port, err := net.SplitHostPort(v); err != nil || port == "" {
+			return cfg, fmt.Errorf("invalid PORT %q", get("PORT"))
+		}
+		cfg.Addr = v
+	}
+	if v := get("UPLOAD_DIR"); v != "" {
+		cfg.UploadDir = v
+		cfg.TempDir = v
+	}
+	if v := get("TEMP_DIR"); v != "" {
+		cfg.TempDir = v
+	}
+	cfg.TLSCert, cfg.TLSKey = get("TLS_CERT"), get("TLS_KEY")
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	for _, h := range strings.Split(get("AUTOCERT_HOSTS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h == "" {
+			continue
+		}
+		if strings.ContainsAny(h, ":/*") || net.ParseIP(h) != nil {
+			return cfg, fmt.Errorf("invalid AUTOCERT_HOSTS entry %q: want a DNS name", h)
+		}
+		cfg.AutocertHosts = append(cfg.AutocertHosts, h)
+	}
+	if len(cfg.AutocertHosts) > 0 && cfg.TLSCert != "" {
+		return cfg, fmt.Errorf("set TLS_CERT/TLS_KEY or AUTOCERT_HOSTS, not both")
+	}
+	if v := get("AUTOCERT_DIR"); v != "" {
+		cfg.AutocertDir = v
+	}
+	cfg.AutocertEmail = get("AUTOCERT_EMAIL")
+	if v := get("AUTOCERT_DIRECTORY_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Scheme != "https" || u.Host == "" {
+			return cfg, fmt.Errorf("invalid AUTOCERT_DIRECTORY_URL %q: want an https URL", v)
+		}
+		cfg.AutocertURL = v
+	}
+	if v := get("HTTP_REDIRECT_ADDR"); v != "" {
+		if !strings.Contains(v, ":") {
+			v = ":" + v
+		}
+		if _, port, err := net.SplitHostPort(v); err != nil || port == "" {
+			return cfg, fmt.Errorf("invalid HTTP_REDIRECT_ADDR %q", get("HTTP_REDIRECT_ADDR"))
+		}
+		if !cfg.TLSEnabled() {
+			return cfg, fmt.Errorf("HTTP_REDIRECT_ADDR needs TLS_CERT/TLS_KEY or AUTOCERT_HOSTS")
+		}
+		cfg.HTTPRedirectAddr = v
+	}
+	if v := get("READ_HEADER_TIMEOUT"); v != "" {
+		if cfg.ReadHeaderTimeout, err = time.ParseDuration(v); err != nil || cfg.ReadHeaderTimeout <= 0 {
+			return cfg, fmt.Errorf("invalid READ_HEADER_TIMEOUT %q: want a positive duration", v)
+		}
+	}
+	if v := get("READ_TIMEOUT"); v != "" {
+		if cfg.ReadTimeout, err = time.ParseDuration(v); err != nil || cfg.ReadTimeout < 0 {
+			return cfg, fmt.Errorf("invalid READ_TIMEOUT %q", v)
+		}
+	}
+	if cfg.H2C, err = parseBool(get, "H2C"); err != nil {
+		return cfg, err
+	}
+	if v := get("SHUTDOWN_TIMEOUT"); v != "" {
+		if cfg.ShutdownTimeout, err = time.ParseDuration(v); err != nil || cfg.ShutdownTimeout < 0 {
+			return cfg, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", v)
+		}
+	}
+	if v := get("SHUTDOWN_DELAY"); v != "" {
+		if cfg.ShutdownDelay, err = time.ParseDuration(v); err != nil || cfg.ShutdownDelay < 0 {
+			return cfg, fmt.Errorf("invalid SHUTDOWN_DELAY %q", v)
+		}
+	}
+	if v := get("STORAGE_BACKEND"); v != "" {
+		cfg.StorageBackend = v
+	}
+	switch cfg.StorageBackend {
+	case storage.BackendDisk:
+	case storage.BackendS3, storage.BackendGCS:
+		cfg.Object = storage.ObjectConfig{
+			Bucket:       get("S3_BUCKET"),
+			Region:       get("S3_REGION"),
+			Endpoint:     get("S3_ENDPOINT"),
+			Addressing:   get("S3_ADDRESSING"),
+			Prefix:       get("S3_PREFIX"),
+			AccessKey:    get("S3_ACCESS_KEY_ID"),
+			SecretKey:    get("S3_SECRET_ACCESS_KEY"),
+			SessionToken: get("S3_SESSION_TOKEN"),
+		}
+		if cfg.Object.Chain, err = credentialConfig(get, cfg.StorageBackend); err != nil {
+			return cfg, err
+		}
+		if e := cfg.Object.Endpoint; e != "" {
+			if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return cfg, fmt.Errorf("invalid S3_ENDPOINT %q: want an http(s) URL", e)
+			}
+		}
+		switch cfg.Object.Addressing {
+		case "", storage.AddressingPath, storage.AddressingVirtual:
+		default:
+			return cfg, fmt.Errorf("invalid S3_ADDRESSING %q: want path or virtual", cfg.Object.Addressing)
+		}
+		if cfg.StorageBackend == storage.BackendGCS {
+			if cfg.Object.Endpoint == "" {
+				cfg.Object.Endpoint = "https://storage.googleapis.com"
+			}
+			if cfg.Object.Region == "" {
+				cfg.Object.Region = "auto"
+			}
+		}
+		if cfg.Object.Region == "" {
+			cfg.Object.Region = "us-east-1"
+		}
+		if cfg.Object.Bucket == "" {
+			return cfg, fmt.Errorf("STORAGE_BACKEND=%s needs S3_BUCKET", cfg.StorageBackend)
+		}
+		if keysOnly(cfg.Object.Chain) && (cfg.Object.AccessKey == "" || cfg.Object.SecretKey == "") {
+			return cfg, fmt.Errorf("STORAGE_BACKEND=%s needs access keys (S3_ACCESS_KEY_ID or AWS_ACCESS_KEY_ID) or another S3_CREDENTIALS source", cfg.StorageBackend)
+		}
+	case storage.BackendAzure:
+		if cfg.Azure, err = azureConfig(get); err != nil {
+			return cfg, err
+		}
+	case storage.BackendSFTP:
+		if cfg.SFTP, err = sftpConfig(get); err != nil {
+			return cfg, err
+		}
+	default:
+		return cfg, fmt.Errorf("invalid STORAGE_BACKEND %q: want disk, s3, gcs, azure or sftp", cfg.StorageBackend)
+	}
+	if v := get("MAX_MEMORY"); v != "" {
+		if cfg.MaxMemory, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.MaxMemory <= 0 {
+			return cfg, fmt.Errorf("invalid MAX_MEMORY %q: must be a positive byte count", v)
+		}
+	}
+	if v := get("MAX_FILE_SIZE"); v != "" {
+		if cfg.MaxFileSize, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.MaxFileSize < 0 {
+			return cfg, fmt.Errorf("invalid MAX_FILE_SIZE %q", v)
+		}
+	}
+	if v := get("MAX_CHUNK_SIZE"); v != "" {
+		if cfg.MaxChunkSize, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.MaxChunkSize < 0 {
+			return cfg, fmt.Errorf("invalid MAX_CHUNK_SIZE %q", v)
+		}
+	}
+	if v := get("MIN_CHUNK_SIZE"); v != "" {
+		if cfg.MinChunkSize, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.MinChunkSize < 0 {
+			return cfg, fmt.Errorf("invalid MIN_CHUNK_SIZE %q", v)
+		}
+	}
+	if cfg.MaxChunkSize > 0 && cfg.MinChunkSize > cfg.MaxChunkSize {
+		return cfg, fmt.Errorf("MIN_CHUNK_SIZE %d is larger than MAX_CHUNK_SIZE %d", cfg.MinChunkSize, cfg.MaxChunkSize)
+	}
+	if v := get("CHUNK_SIZE"); v != "" {
+		if cfg.ChunkSize, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.ChunkSize <= 0 {
+			return cfg, fmt.Errorf("invalid CHUNK_SIZE %q: must be a positive byte count", v)
+		}
+		if cfg.ChunkSize < cfg.MinChunkSize || (cfg.MaxChunkSize > 0 && cfg.ChunkSize > cfg.MaxChunkSize) {
+			return cfg, fmt.Errorf("CHUNK_SIZE %d is outside MIN_CHUNK_SIZE %d and MAX_CHUNK_SIZE %d", cfg.ChunkSize, cfg.MinChunkSize, cfg.MaxChunkSize)
+		}
+	}
+	if v := get("USER_QUOTA"); v != "" {
+		if cfg.UserQuota, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.UserQuota < 0 {
+			return cfg, fmt.Errorf("invalid USER_QUOTA %q", v)
+		}
+	}
+	if v := get("MIN_FREE_SPACE"); v != "" {
+		if cfg.MinFreeSpace, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.MinFreeSpace < 0 {
+			return cfg, fmt.Errorf("invalid MIN_FREE_SPACE %q", v)
+		}
+	}
+	if v := get("FILENAME_POLICY"); v != "" {
+		cfg.FileNamePolicy = v
+	}
+	switch cfg.FileNamePolicy {
+	case FileNamePolicyUnicode, FileNamePolicyASCII, FileNamePolicyStrict:
+	default:
+		return cfg, fmt.Errorf("invalid FILENAME_POLICY %q: want unicode, ascii or strict", cfg.FileNamePolicy)
+	}
+	if cfg.MapFileNames, err = parseBool(get, "MAP_FILE_NAMES"); err != nil {
+		return cfg, err
+	}
+	if v := get("STORAGE_LAYOUT"); v != "" {
+		cfg.StorageLayout = v
+	}
+	switch cfg.StorageLayout {
+	case storage.LayoutFlat:
+	case storage.LayoutContent:
+		if cfg.MapFileNames {
+			return cfg, fmt.Errorf("STORAGE_LAYOUT=content cannot be used with MAP_FILE_NAMES: it already stores files under generated keys")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid STORAGE_LAYOUT %q: want flat or content", cfg.StorageLayout)
+	}
+	if cfg.AllowedTypes, err = parseTypeList(get, "ALLOWED_TYPES"); err != nil {
+		return cfg, err
+	}
+	if cfg.BlockedTypes, err = parseTypeList(get, "BLOCKED_TYPES"); err != nil {
+		return cfg, err
+	}
+	if v := get("FILE_MODE"); v != "" {
+		if cfg.FileMode, err = parseMode(v); err != nil {
+			return cfg, fmt.Errorf("invalid FILE_MODE %q: %v", v, err)
+		}
+	}
+	if v := get("DIR_MODE"); v != "" {
+		if cfg.DirMode, err = parseMode(v); err != nil {
+			return cfg, fmt.Errorf("invalid DIR_MODE %q: %v", v, err)
+		}
+	}
+	if cfg.NoFsync, err = parseBool(get, "NO_FSYNC"); err != nil {
+		return cfg, err
+	}
+	if v := get("UPLOAD_TTL"); v != "" {
+		if cfg.UploadTTL, err = time.ParseDuration(v); err != nil || cfg.UploadTTL < 0 {
+			return cfg, fmt.Errorf("invalid UPLOAD_TTL %q", v)
+		}
+	}
+	if v := get("STALE_UPLOAD_TTL"); v != "" {
+		if cfg.StaleTTL, err = time.ParseDuration(v); err != nil || cfg.StaleTTL < 0 {
+			return cfg, fmt.Errorf("invalid STALE_UPLOAD_TTL %q", v)
+		}
+	}
+	if v := get("JANITOR_INTERVAL"); v != "" {
+		if cfg.JanitorEvery, err = time.ParseDuration(v); err != nil || cfg.JanitorEvery <= 0 {
+			return cfg, fmt.Errorf("invalid JANITOR_INTERVAL %q: must be a positive duration", v)
+		}
+	}
+	if v := get("RETENTION"); v != "" {
+		if cfg.Retention, err = parseRetention(v); err != nil {
+			return cfg, fmt.Errorf("invalid RETENTION %q: want a duration such as 36h or 7d", v)
+		}
+	}
+	if v := get("MAX_RETENTION"); v != "" {
+		if cfg.MaxRetention, err = parseRetention(v); err != nil {
+			return cfg, fmt.Errorf("invalid MAX_RETENTION %q: want a duration such as 36h or 7d", v)
+		}
+	}
+	if cfg.MaxRetention > 0 && cfg.Retention > cfg.MaxRetention {
+		return cfg, fmt.Errorf("RETENTION %s is longer than MAX_RETENTION %s", cfg.Retention, cfg.MaxRetention)
+	}
+	if cfg.CompressAtRest, err = parseBool(get, "COMPRESS_AT_REST"); err != nil {
+		return cfg, err
+	}
+	if cfg.Thumbnails, err = parseThumbnailSizes(get("THUMBNAILS")); err != nil {
+		return cfg, fmt.Errorf("invalid THUMBNAILS: %v", err)
+	}
+	if v := get("EXTRACT_MAX_FILES"); v != "" {
+		if cfg.ExtractMaxFiles, err = strconv.Atoi(v); err != nil || cfg.ExtractMaxFiles < 0 {
+			return cfg, fmt.Errorf("invalid EXTRACT_MAX_FILES %q", v)
+		}
+	}
+	if v := get("EXTRACT_MAX_SIZE"); v != "" {
+		if cfg.ExtractMaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.ExtractMaxSize < 0 {
+			return cfg, fmt.Errorf("invalid EXTRACT_MAX_SIZE %q", v)
+		}
+	}
+	if get("ENCRYPTION_KEY") != "" && get("ENCRYPTION_KEY_FILE") != "" {
+		return cfg, fmt.Errorf("set ENCRYPTION_KEY or ENCRYPTION_KEY_FILE, not both")
+	}
+	if v := get("ENCRYPTION_KEY"); v != "" {
+		if cfg.EncryptionKey, err = storage.ParseEncryptionKey(v); err != nil {
+			return cfg, fmt.Errorf("invalid ENCRYPTION_KEY: %v", err)
+		}
+	}
+	if v := get("ENCRYPTION_KEY_FILE"); v != "" {
+		data, err := os.ReadFile(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ENCRYPTION_KEY_FILE: %v", err)
+		}
+		if cfg.EncryptionKey, err = storage.ParseEncryptionKey(string(data)); err != nil {
+			return cfg, fmt.Errorf("invalid ENCRYPTION_KEY_FILE %q: %v", v, err)
+		}
+	}
+	if v := get("KMS_KEY_ID"); v != "" {
+		if cfg.EncryptionKey != nil {
+			return cfg, fmt.Errorf("set a master key or KMS_KEY_ID, not both")
+		}
+		cfg.KMS = storage.KMSConfig{
+			KeyID:        v,
+			Region:       get("KMS_REGION"),
+			Endpoint:     get("KMS_ENDPOINT"),
+			AccessKey:    get("S3_ACCESS_KEY_ID"),
+			SecretKey:    get("S3_SECRET_ACCESS_KEY"),
+			SessionToken: get("S3_SESSION_TOKEN"),
+		}
+		// Only an explicit S3_CREDENTIALS lets KMS look past the keys.
+		if cfg.KMS.Chain, err = credentialConfig(get, ""); err != nil {
+			return cfg, err
+		}
+		if cfg.KMS.Region == "" {
+			cfg.KMS.Region = cmp.Or(get("S3_REGION"), "us-east-1")
+		}
+		if e := cfg.KMS.Endpoint; e != "" {
+			if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return cfg, fmt.Errorf("invalid KMS_ENDPOINT %q: want an http(s) URL", e)
+			}
+		}
+		if keysOnly(cfg.KMS.Chain) && (cfg.KMS.AccessKey == "" || cfg.KMS.SecretKey == "") {
+			return cfg, fmt.Errorf("KMS_KEY_ID needs access keys (S3_ACCESS_KEY_ID or AWS_ACCESS_KEY_ID) or another S3_CREDENTIALS source")
+		}
+	}
+	if cfg.DirectUpload, err = parseBool(get, "DIRECT_UPLOAD"); err != nil {
+		return cfg, err
+	}
+	if cfg.DirectUpload {
+		switch {
+		case cfg.StorageBackend != storage.BackendS3 && cfg.StorageBackend != storage.BackendGCS:
+			return cfg, fmt.Errorf("DIRECT_UPLOAD needs STORAGE_BACKEND=s3 or gcs")
+		case cfg.EncryptionKey != nil || cfg.KMS.KeyID != "":
+			return cfg, fmt.Errorf("DIRECT_UPLOAD cannot be used with encryption at rest: the server never sees the bytes")
+		case cfg.MapFileNames:
+			return cfg, fmt.Errorf("DIRECT_UPLOAD cannot be used with MAP_FILE_NAMES")
+		case cfg.StorageLayout == storage.LayoutContent:
+			return cfg, fmt.Errorf("DIRECT_UPLOAD cannot be used with STORAGE_LAYOUT=content: the bucket stores the file before the server could hash it")
+		}
+	}
+	if v := get("DIRECT_UPLOAD_URL_TTL"); v != "" {
+		if cfg.DirectUploadURLTTL, err = parseRetention(v); err != nil || cfg.DirectUploadURLTTL <= 0 || cfg.DirectUploadURLTTL > storage.MaxPresignTTL {
+			return cfg, fmt.Errorf("invalid DIRECT_UPLOAD_URL_TTL %q: want a positive duration of at most 7d", v)
+		}
+	}
+	if cfg.Deduplicate, err = parseBool(get, "DEDUPLICATE"); err != nil {
+		return cfg, err
+	}
+	if cfg.ChunkDedup, err = parseBool(get, "CHUNK_DEDUP"); err != nil {
+		return cfg, err
+	}
+	if cfg.ChunkDedup && (cfg.EncryptionKey != nil || cfg.KMS.KeyID != "") {
+		return cfg, fmt.Errorf("CHUNK_DEDUP cannot be used with encryption at rest: the chunk store keeps chunks unencrypted")
+	}
+	if cfg.DeltaUpload, err = parseBool(get, "DELTA_UPLOAD"); err != nil {
+		return cfg, err
+	}
+	if v := get("CHUNK_TTL"); v != "" {
+		if cfg.ChunkTTL, err = parseRetention(v); err != nil || cfg.ChunkTTL < 0 {
+			return cfg, fmt.Errorf("invalid CHUNK_TTL %q: want a duration such as 30d, or 0", v)
+		}
+	}
+	if cfg.Versioning, err = parseBool(get, "VERSIONING"); err != nil {
+		return cfg, err
+	}
+	if cfg.Versioning && cfg.DirectUpload {
+		return cfg, fmt.Errorf("VERSIONING cannot be used with DIRECT_UPLOAD: the bucket replaces the file before the server could keep it")
+	}
+	if v := get("MAX_VERSIONS"); v != "" {
+		if cfg.MaxVersions, err = strconv.Atoi(v); err != nil || cfg.MaxVersions < 0 {
+			return cfg, fmt.Errorf("invalid MAX_VERSIONS %q: want 0 or more", v)
+		}
+	}
+	if v := get("VERSION_RETENTION"); v != "" {
+		if cfg.VersionTTL, err = parseRetention(v); err != nil || cfg.VersionTTL < 0 {
+			return cfg, fmt.Errorf("invalid VERSION_RETENTION %q: want a duration such as 90d, or 0", v)
+		}
+	}
+	if v := get("VERSION_POLICY"); v != "" {
+		if cfg.VersionPolicy, err = parseVersionPolicy(v); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.MetadataDB = get("METADATA_DB"); cfg.MetadataDB != "" {
+		if _, _, err := parseMetadataDB(cfg.MetadataDB); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.AuditLog = get("AUDIT_LOG"); cfg.AuditLog == AuditDB && cfg.MetadataDB == "" {
+		return cfg, fmt.Errorf("AUDIT_LOG=%s needs METADATA_DB", AuditDB)
+	}
+	if v := get("AUDIT_LOG_MAX_SIZE"); v != "" {
+		if cfg.AuditMaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.AuditMaxSize <= 0 {
+			return cfg, fmt.Errorf("invalid AUDIT_LOG_MAX_SIZE %q: want a positive number of bytes", v)
+		}
+	}
+	if v := get("AUDIT_LOG_MAX_FILES"); v != "" {
+		if cfg.AuditMaxFiles, err = strconv.Atoi(v); err != nil || cfg.AuditMaxFiles < 0 {
+			return cfg, fmt.Errorf("invalid AUDIT_LOG_MAX_FILES %q: want 0 or more", v)
+		}
+	}
+	if cfg.LockURL = get("LOCK_URL"); cfg.LockURL != "" {
+		if _, _, err := parseLockURL(cfg.LockURL); err != nil {
+			return cfg, err
+		}
+	}
+	if v := get("LOCK_TTL"); v != "" {
+		if cfg.LockTTL, err = time.ParseDuration(v); err != nil || cfg.LockTTL < time.Second {
+			return cfg, fmt.Errorf("invalid LOCK_TTL %q: must be a duration of at least 1s", v)
+		}
+	}
+	if cfg.SessionCache = get("SESSION_CACHE"); cfg.SessionCache != "" {
+		if _, err := session.ParseRedisURL(cfg.SessionCache); err != nil {
+			return cfg, fmt.Errorf("invalid SESSION_CACHE: %w", err)
+		}
+	}
+	if v := get("CLAMD_ADDR"); v != "" {
+		if _, _, err := parseClamdAddr(v); err != nil {
+			return cfg, err
+		}
+		cfg.ClamdAddr = v
+	}
+	if v := get("SCAN_TIMEOUT"); v != "" {
+		if cfg.ScanTimeout, err = time.ParseDuration(v); err != nil || cfg.ScanTimeout <= 0 {
+			return cfg, fmt.Errorf("invalid SCAN_TIMEOUT %q: must be a positive duration", v)
+		}
+	}
+	if v := get("SCAN_INFECTED"); v != "" {
+		if v != ScanQuarantine && v != ScanDelete {
+			return cfg, fmt.Errorf("invalid SCAN_INFECTED %q: want quarantine or delete", v)
+		}
+		cfg.ScanInfected = v
+	}
+	cfg.QuarantineDir = get("QUARANTINE_DIR")
+	if v := get("SCAN_ON_ERROR"); v != "" {
+		if v != ScanReject && v != ScanAccept {
+			return cfg, fmt.Errorf("invalid SCAN_ON_ERROR %q: want reject or accept", v)
+		}
+		cfg.ScanOnError = v
+	}
+	for _, v := range strings.Split(get("WEBHOOK_URL"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("invalid WEBHOOK_URL %q: want an http(s) URL", v)
+		}
+		cfg.WebhookURLs = append(cfg.WebhookURLs, v)
+	}
+	cfg.WebhookSecret = get("WEBHOOK_SECRET")
+	if v := get("WEBHOOK_ATTEMPTS"); v != "" {
+		if cfg.WebhookAttempts, err = strconv.Atoi(v); err != nil || cfg.WebhookAttempts < 1 {
+			return cfg, fmt.Errorf("invalid WEBHOOK_ATTEMPTS %q: must be at least 1", v)
+		}
+	}
+	if v := get("WEBHOOK_BACKOFF"); v != "" {
+		if cfg.WebhookBackoff, err = time.ParseDuration(v); err != nil || cfg.WebhookBackoff <= 0 {
+			return cfg, fmt.Errorf("invalid WEBHOOK_BACKOFF %q: must be a positive duration", v)
+		}
+	}
+	if cfg.TranscodePresets, err = parseTranscodePresets(get("TRANSCODE_PRESETS")); err != nil {
+		return cfg, fmt.Errorf("invalid TRANSCODE_PRESETS: %v", err)
+	}
+	if v := get("FFMPEG_PATH"); v != "" {
+		cfg.FFmpegPath = v
+	}
+	if v := get("TRANSCODE_WORKERS"); v != "" {
+		if cfg.TranscodeWorkers, err = strconv.Atoi(v); err != nil || cfg.TranscodeWorkers < 1 {
+			return cfg, fmt.Errorf("invalid TRANSCODE_WORKERS %q: must be at least 1", v)
+		}
+	}
+	if v := get("TRANSCODE_TIMEOUT"); v != "" {
+		if cfg.TranscodeTimeout, err = time.ParseDuration(v); err != nil || cfg.TranscodeTimeout <= 0 {
+			return cfg, fmt.Errorf("invalid TRANSCODE_TIMEOUT %q: must be a positive duration", v)
+		}
+	}
+	if cfg.TranscodeQueue = get("TRANSCODE_QUEUE"); cfg.TranscodeQueue != "" {
+		if _, err := session.ParseRedisURL(cfg.TranscodeQueue); err != nil {
+			return cfg, fmt.Errorf("invalid TRANSCODE_QUEUE: %w", err)
+		}
+	}
+	if v := get("POST_UPLOAD_COMMAND"); v != "" {
+		if cfg.HookCommand, err = parseHookCommand(v); err != nil {
+			return cfg, fmt.Errorf("invalid POST_UPLOAD_COMMAND: %v", err)
+		}
+	}
+	if v := get("POST_UPLOAD_TIMEOUT"); v != "" {
+		if cfg.HookTimeout, err = time.ParseDuration(v); err != nil || cfg.HookTimeout <= 0 {
+			return cfg, fmt.Errorf("invalid POST_UPLOAD_TIMEOUT %q: must be a positive duration", v)
+		}
+	}
+	if v := get("MAX_CONCURRENT_UPLOADS"); v != "" {
+		if cfg.MaxConcurrentUploads, err = strconv.Atoi(v); err != nil || cfg.MaxConcurrentUploads < 0 {
+			return cfg, fmt.Errorf("invalid MAX_CONCURRENT_UPLOADS %q", v)
+		}
+	}
+	if v := get("MAX_UPLOADS_PER_CLIENT"); v != "" {
+		if cfg.MaxUploadsPerClient, err = strconv.Atoi(v); err != nil || cfg.MaxUploadsPerClient < 0 {
+			return cfg, fmt.Errorf("invalid MAX_UPLOADS_PER_CLIENT %q", v)
+		}
+	}
+	if v := get("RATE_LIMIT_RPS"); v != "" {
+		if cfg.RateLimitRPS, err = strconv.ParseFloat(v, 64); err != nil || cfg.RateLimitRPS < 0 {
+			return cfg, fmt.Errorf("invalid RATE_LIMIT_RPS %q", v)
+		}
+	}
+	if cfg.RateLimitRPS > 0 {
+		cfg.RateLimitBurst = int(math.Ceil(cfg.RateLimitRPS))
+		if b := get("RATE_LIMIT_BURST"); b != "" {
+			if cfg.RateLimitBurst, err = strconv.Atoi(b); err != nil || cfg.RateLimitBurst < 1 {
+				return cfg, fmt.Errorf("invalid RATE_LIMIT_BURST %q", b)
+			}
+		}
+	}
+	if v := get("RATE_LIMIT_USER_RPS"); v != "" {
+		if cfg.RateLimitUserRPS, err = strconv.ParseFloat(v, 64); err != nil || cfg.RateLimitUserRPS < 0 {
+			return cfg, fmt.Errorf("invalid RATE_LIMIT_USER_RPS %q", v)
+		}
+	}
+	if cfg.RateLimitUserRPS > 0 {
+		cfg.RateLimitUserBurst = int(math.Ceil(cfg.RateLimitUserRPS))
+		if b := get("RATE_LIMIT_USER_BURST"); b != "" {
+			if cfg.RateLimitUserBurst, err = strconv.Atoi(b); err != nil || cfg.RateLimitUserBurst < 1 {
+				return cfg, fmt.Errorf("invalid RATE_LIMIT_USER_BURST %q", b)
+			}
+		}
+	}
+	if v := get("BANDWIDTH_LIMIT"); v != "" {
+		if cfg.BandwidthLimit, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.BandwidthLimit < 0 {
+			return cfg, fmt.Errorf("invalid BANDWIDTH_LIMIT %q: must be bytes per second", v)
+		}
+	}
+	if v := get("UPLOAD_BANDWIDTH_LIMIT"); v != "" {
+		if cfg.UploadBandwidthLimit, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.UploadBandwidthLimit < 0 {
+			return cfg, fmt.Errorf("invalid UPLOAD_BANDWIDTH_LIMIT %q: must be bytes per second", v)
+		}
+	}
+	if cfg.TrustProxy, err = parseBool(get, "TRUST_PROXY"); err != nil {
+		return cfg, err
+	}
+	if v := get("ALLOWED_ORIGINS"); v != "" {
+		cfg.AllowedOrigins = nil
+		for _, o := range strings.Split(v, ",") {
+			if o = strings.TrimSpace(o); o == "" {
+				continue
+			}
+			if err := checkOrigin(o); err != nil {
+				return cfg, err
+			}
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, o)
+		}
+	}
+	if cfg.CORSAllowCredentials, err = parseBool(get, "CORS_ALLOW_CREDENTIALS"); err != nil {
+		return cfg, err
+	}
+	if cfg.CORSAllowCredentials && slices.Contains(cfg.AllowedOrigins, "*") {
+		return cfg, fmt.Errorf("CORS_ALLOW_CREDENTIALS cannot be combined with ALLOWED_ORIGINS=*: list the origins instead")
+	}
+	if v := get("CORS_MAX_AGE"); v != "" {
+		if cfg.CORSMaxAge, err = time.ParseDuration(v); err != nil || cfg.CORSMaxAge < 0 {
+			return cfg, fmt.Errorf("invalid CORS_MAX_AGE %q", v)
+		}
+	}
+	if v := get("REQUIRE_UPLOAD_ID"); v != "" {
+		if cfg.RequireUploadID, err = parseBool(get, "REQUIRE_UPLOAD_ID"); err != nil {
+			return cfg, err
+		}
+	}
+	if v := get("LOG_FORMAT"); v != "" {
+		cfg.LogFormat = v
+	}
+	if cfg.LogFormat != LogFormatText && cfg.LogFormat != LogFormatJSON {
+		return cfg, fmt.Errorf("invalid LOG_FORMAT %q: want text or json", cfg.LogFormat)
+	}
+	if v := get("LOG_LEVEL"); v != "" {
+		if cfg.LogLevel, err = parseLogLevel(v); err != nil {
+			return cfg, err
+		}
+	}
+	if v := get("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return cfg, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q: want an http:// or https:// URL", v)
+		}
+		cfg.OTLPEndpoint = v
+	}
+	if v := get("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		if cfg.OTLPHeaders, err = parseOTLPHeaders(v); err != nil {
+			return cfg, err
+		}
+	}
+	if v := get("OTEL_SERVICE_NAME"); v != "" {
+		cfg.TraceService = v
+	}
+	if v := get("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		if cfg.TraceSampleRatio, err = strconv.ParseFloat(v, 64); err != nil || cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+			return cfg, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q: want a number from 0 to 1", v)
+		}
+	}
+	cfg.APIKeys = get("API_KEYS")
+	cfg.JWTSecret = get("JWT_SECRET")
+	if v := get("JWT_PUBLIC_KEY"); v != "" {
+		if cfg.JWTPublicKey, err = loadRSAPublicKey(v); err != nil {
+			return cfg, fmt.Errorf("invalid JWT_PUBLIC_KEY %q: %v", v, err)
+		}
+	}
+	cfg.JWTIssuer, cfg.JWTAudience = get("JWT_ISSUER"), get("JWT_AUDIENCE")
+	if v := get("AUTH_ROUTES"); v != "" {
+		cfg.AuthRoutes = nil
+		for _, g := range strings.Split(v, ",") {
+			switch g = strings.TrimSpace(g); g {
+			case AuthUpload, AuthStatus, AuthDownload, AuthManage, AuthMetrics:
+				cfg.AuthRoutes = append(cfg.AuthRoutes, g)
+			case "", "none":
+			default:
+				return cfg, fmt.Errorf("invalid AUTH_ROUTES entry %q: want upload, status, download, manage or metrics", g)
+			}
+		}
+	}
+	for _, u := range strings.Split(get("ADMIN_USERS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.AdminUsers = append(cfg.AdminUsers, u)
+		}
+	}
+	if cfg.AdminToken = get("ADMIN_TOKEN"); cfg.AdminToken != "" && len(cfg.AdminToken) < MinAdminToken {
+		return cfg, fmt.Errorf("ADMIN_TOKEN too short: %d characters, need at least %d", len(cfg.AdminToken), MinAdminToken)
+	}
+	if cfg.SigningKey = get("SIGNING_KEY"); cfg.SigningKey != "" && len(cfg.SigningKey) < MinSigningKey {
+		return cfg, fmt.Errorf("SIGNING_KEY too short: %d characters, need at least %d", len(cfg.SigningKey), MinSigningKey)
+	}
+	if v := get("SIGNED_URL_TTL"); v != "" {
+		if cfg.SignedURLTTL, err = parseRetention(v); err != nil || cfg.SignedURLTTL <= 0 {
+			return cfg, fmt.Errorf("invalid SIGNED_URL_TTL %q: want a positive duration such as 1h or 2d", v)
+		}
+	}
+	if v := get("SIGNED_URL_MAX_TTL"); v != "" {
+		if cfg.SignedURLMaxTTL, err = parseRetention(v); err != nil || cfg.SignedURLMaxTTL <= 0 {
+			return cfg, fmt.Errorf("invalid SIGNED_URL_MAX_TTL %q: want a positive duration such as 7d", v)
+		}
+	}
+	if cfg.SignedURLTTL > cfg.SignedURLMaxTTL {
+		return cfg, fmt.Errorf("SIGNED_URL_TTL %s is longer than SIGNED_URL_MAX_TTL %s", cfg.SignedURLTTL, cfg.SignedURLMaxTTL)
+	}
+
+	switch cfg.TenantMode = get("TENANT_MODE"); cfg.TenantMode {
+	case "", TenantByPath:
+	case TenantByAPIKey:
+		if cfg.APIKeys == "" && cfg.JWTSecret == "" && cfg.JWTPublicKey == nil {
+			return cfg, fmt.Errorf("TENANT_MODE=apikey needs API_KEYS or JWT_SECRET / JWT_PUBLIC_KEY")
+		}
+	default:
+		return cfg, fmt.Errorf("invalid TENANT_MODE %q: want apikey or path", cfg.TenantMode)
+	}
+	for _, t := range strings.Split(get("TENANTS"), ",") {
+		if t = strings.TrimSpace(t); t != "" && !slices.Contains(cfg.Tenants, t) {
+			cfg.Tenants = append(cfg.Tenants, t)
+		}
+	}
+	if v := get("TENANT_QUOTA"); v != "" {
+		if cfg.TenantQuota, err = strconv.ParseInt(v, 10, 64); err != nil || cfg.TenantQuota < 0 {
+			return cfg, fmt.Errorf("invalid TENANT_QUOTA %q", v)
+		}
+	}
+	switch {
+	case cfg.TenantMode == "" && (len(cfg.Tenants) > 0 || cfg.TenantQuota > 0):
+		return cfg, fmt.Errorf("TENANTS and TENANT_QUOTA need TENANT_MODE")
+	case cfg.TenantMode == TenantByPath && len(cfg.Tenants) == 0:
+		return cfg, fmt.Errorf("TENANT_MODE=path needs TENANTS")
+	}
+	for _, t := range cfg.tenantNames() {
+		if !validTenant.MatchString(t) {
+			return cfg, fmt.Errorf("invalid tenant name %q: want lower-case letters, digits, - and _", t)
+		}
+	}
+	return cfg, nil
+}
+
+// keyWrapper returns the configured KeyWrapper, nil when encryption is
+// off.
+func (c Config) keyWrapper() storage.KeyWrapper {
+	switch {
+	case c.KeyWrapper != nil:
+		return c.KeyWrapper
+	case c.KMS.KeyID != "":
+		return storage.NewKMSKeyWrapper(c.KMS)
+	case c.EncryptionKey != nil:
+		return storage.NewLocalKeyWrapper(c.EncryptionKey)
+	}
+	return nil
+}
+
+// encrypts reports whether completed files are encrypted at rest.
+func (c Config) encrypts() bool {
+	return c.KeyWrapper != nil || c.EncryptionKey != nil || c.KMS.KeyID != ""
+}
+
+// awsFallbacks are the AWS SDK variables read when a setting is unset.
+var awsFallbacks = map[string]string{
+	"S3_ACCESS_KEY_ID":     "AWS_ACCESS_KEY_ID",
+	"S3_SECRET_ACCESS_KEY": "AWS_SECRET_ACCESS_KEY",
+	"S3_SESSION_TOKEN":     "AWS_SESSION_TOKEN",
+	"S3_PROFILE":           "AWS_PROFILE",
+	"S3_CREDENTIALS_FILE":  "AWS_SHARED_CREDENTIALS_FILE",
+}
+
+// awsEnvironment locates the credentials a container or instance gets,
+// on AWS or Azure.
+var awsEnvironment = []string{
+	"AWS_CONTAINER_CREDENTIALS_FULL_URI",
+	"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+	"AWS_EC2_METADATA_SERVICE_ENDPOINT",
+	"IDENTITY_ENDPOINT", // Azure App Service, Functions and Container Apps
+	"IDENTITY_HEADER",
+}
+
+// credentialConfig reads S3_CREDENTIALS and what its sources need. Unset,
+// the chain of backend is the default one on s3, keys and file on gcs,
+// and the keys alone for "".
+func credentialConfig(get func(string) string, backend string) (storage.CredentialConfig, error) {
+	cc := storage.CredentialConfig{
+		Profile:        get("S3_PROFILE"),
+		File:           get("S3_CREDENTIALS_FILE"),
+		ContainerURI:   get("AWS_CONTAINER_CREDENTIALS_FULL_URI"),
+		ContainerToken: get("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+		TokenFile:      get("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+		MetadataURL:    get("AWS_EC2_METADATA_SERVICE_ENDPOINT"),
+	}
+	switch backend {
+	case storage.BackendS3:
+		cc.Sources = storage.DefaultCredentials
+	case storage.BackendGCS:
+		cc.Sources = []string{storage.CredentialsKeys, storage.CredentialsFile}
+	}
+	if v := get("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); v != "" && cc.ContainerURI == "" {
+		cc.ContainerURI = "http://169.254.170.2" + v
+	}
+	if v := get("S3_CREDENTIALS"); v != "" {
+		cc.Sources = nil
+		for _, source := range strings.Split(v, ",") {
+			switch source = strings.TrimSpace(source); source {
+			case storage.CredentialsKeys, storage.CredentialsFile, storage.CredentialsContainer, storage.CredentialsIMDS:
+				cc.Sources = append(cc.Sources, source)
+			case "":
+			default:
+				return cc, fmt.Errorf("invalid S3_CREDENTIALS entry %q: want keys, file, container or imds", source)
+			}
+		}
+	}
+	return cc, nil
+}
+
+// azureConfig reads the AZURE_* settings of STORAGE_BACKEND=azure.
+func azureConfig(get func(string) string) (storage.AzureConfig, error) {
+	ac := storage.AzureConfig{
+		Account:          get("AZURE_STORAGE_ACCOUNT"),
+		Container:        get("AZURE_CONTAINER"),
+		Endpoint:         get("AZURE_BLOB_ENDPOINT"),
+		Prefix:           get("AZURE_PREFIX"),
+		Auth:             get("AZURE_AUTH"),
+		SASToken:         strings.TrimPrefix(get("AZURE_SAS_TOKEN"), "?"),
+		ClientID:         get("AZURE_CLIENT_ID"),
+		IdentityEndpoint: get("IDENTITY_ENDPOINT"),
+		IdentityHeader:   get("IDENTITY_HEADER"),
+	}
+	if ac.Account == "" || ac.Container == "" {
+		return ac, fmt.Errorf("STORAGE_BACKEND=azure needs AZURE_STORAGE_ACCOUNT and AZURE_CONTAINER")
+	}
+	if e := ac.Endpoint; e != "" {
+		if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ac, fmt.Errorf("invalid AZURE_BLOB_ENDPOINT %q: want an http(s) URL", e)
+		}
+	}
+	if v := get("AZURE_STORAGE_KEY"); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(key) == 0 {
+			return ac, fmt.Errorf("invalid AZURE_STORAGE_KEY: want base64")
+		}
+		ac.AccountKey = key
+	}
+	if _, err := url.ParseQuery(ac.SASToken); err != nil {
+		return ac, fmt.Errorf("invalid AZURE_SAS_TOKEN: %v", err)
+	}
+	if ac.Auth == "" {
+		switch {
+		case ac.AccountKey != nil:
+			ac.Auth = storage.AzureAuthKey
+		case ac.SASToken != "":
+			ac.Auth = storage.AzureAuthSAS
+		default:
+			ac.Auth = storage.AzureAuthIdentity
+		}
+	}
+	switch ac.Auth {
+	case storage.AzureAuthKey:
+		if ac.AccountKey == nil {
+			return ac, fmt.Errorf("AZURE_AUTH=key needs AZURE_STORAGE_KEY")
+		}
+	case storage.AzureAuthSAS:
+		if ac.SASToken == "" {
+			return ac, fmt.Errorf("AZURE_AUTH=sas needs AZURE_SAS_TOKEN")
+		}
+	case storage.AzureAuthIdentity:
+	default:
+		return ac, fmt.Errorf("invalid AZURE_AUTH %q: want key, sas or managed-identity", ac.Auth)
+	}
+	return ac, nil
+}
+
+// sftpConfig reads the SFTP_* settings of STORAGE_BACKEND=sftp. The key
+// and known_hosts files are read here, so a mistake in them stops
+// startup.
+func sftpConfig(get func(string) string) (storage.SFTPConfig, error) {
+	sc := storage.SFTPConfig{
+		Addr:    get("SFTP_ADDR"),
+		User:    get("SFTP_USER"),
+		Dir:     get("SFTP_DIR"),
+		Conns:   storage.DefaultSFTPConns,
+		Retries: storage.DefaultSFTPRetries,
+	}
+	if sc.Addr == "" || sc.User == "" {
+		return sc, fmt.Errorf("STORAGE_BACKEND=sftp needs SFTP_ADDR and SFTP_USER")
+	}
+	if _, _, err := net.SplitHostPort(sc.Addr); err != nil {
+		sc.Addr = net.JoinHostPort(sc.Addr, "22")
+	}
+	if v := get("SFTP_PASSWORD"); v != "" {
+		sc.Auth = append(sc.Auth, ssh.Password(v))
+	}
+	if v := get("SFTP_KEY_FILE"); v != "" {
+		pem, err := os.ReadFile(v)
+		if err != nil {
+			return sc, fmt.Errorf("SFTP_KEY_FILE: %w", err)
+		}
+		var signer ssh.Signer
+		if pass := get("SFTP_KEY_PASSPHRASE"); pass != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(pass))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return sc, fmt.Errorf("invalid SFTP_KEY_FILE %q: %v", v, err)
+		}
+		// Offered before the password, like ssh does.
+		sc.Auth = append([]ssh.AuthMethod{ssh.PublicKeys(signer)}, sc.Auth...)
+	}
+	if len(sc.Auth) == 0 {
+		return sc, fmt.Errorf("STORAGE_BACKEND=sftp needs SFTP_PASSWORD or SFTP_KEY_FILE")
+	}
+	hosts := get("SFTP_KNOWN_HOSTS")
+	if hosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return sc, fmt.Errorf("STORAGE_BACKEND=sftp needs SFTP_KNOWN_HOSTS: %v", err)
+		}
+		hosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	var err error
+	if sc.HostKey, err = knownhosts.New(hosts); err != nil {
+		return sc, fmt.Errorf("SFTP_KNOWN_HOSTS: %w", err)
+	}
+	if v := get("SFTP_CONNECTIONS"); v != "" {
+		if sc.Conns, err = strconv.Atoi(v); err != nil || sc.Conns < 1 {
+			return sc, fmt.Errorf("invalid SFTP_CONNECTIONS %q: want a positive number", v)
+		}
+	}
+	if v := get("SFTP_RETRIES"); v != "" {
+		if sc.Retries, err = strconv.Atoi(v); err != nil || sc.Retries < 0 {
+			return sc, fmt.Errorf("invalid SFTP_RETRIES %q", v)
+		}
+	}
+	return sc, nil
+}
+
+// keysOnly reports whether cc looks nowhere but the static keys.
+func keysOnly(cc storage.CredentialConfig) bool {
+	return len(cc.Sources) == 0 || slices.Equal(cc.Sources, []string{storage.CredentialsKeys})
+}
+
+// parseBool reads an optional boolean setting ("" = false).
+func parseBool(get func(string) string, key string) (bool, error) {
+	v := get(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: want true or false", key, v)
+	}
+	return b, nil
+}
+
+// LogSummary prints the effective settings at startup.
+func (c Config) LogSummary() {
+	switch {
+	case len(c.AutocertHosts) > 0:
+		slog.Info("TLS via ACME", "hosts", strings.Join(c.AutocertHosts, ","), "cache", c.AutocertDir,
+			"directory", cmp.Or(c.AutocertURL, "letsencrypt"), "redirect", c.HTTPRedirectAddr)
+	case c.TLSCert != "":
+		slog.Info("TLS", "cert", c.TLSCert, "redirect", c.HTTPRedirectAddr)
+	}
+	slog.Info("http", "read_header_timeout", c.ReadHeaderTimeout, "read_timeout", c.ReadTimeout, "h2c", c.H2C)
+	slog.Info("storage", "dir", c.UploadDir, "part_dir", c.TempDir, "file_mode", c.FileMode, "dir_mode", c.DirMode)
+	if c.StorageLayout == storage.LayoutContent {
+		slog.Info("content-addressed storage", "layout", c.StorageLayout, "table", storage.FileNameTable)
+	}
+	if c.MinFreeSpace > 0 {
+		slog.Info("free space watermark", "min_free_bytes", c.MinFreeSpace)
+	}
+	if c.NoFsync {
+		slog.Warn("fsync disabled: a crash may lose or truncate just-completed files")
+	}
+	if c.StorageBackend == storage.BackendAzure {
+		slog.Info("blob storage", "backend", c.StorageBackend, "account", c.Azure.Account, "container", c.Azure.Container,
+			"endpoint", c.Azure.Endpoint, "prefix", c.Azure.Prefix, "auth", c.Azure.Auth)
+	} else if c.StorageBackend == storage.BackendSFTP {
+		slog.Info("sftp storage", "backend", c.StorageBackend, "addr", c.SFTP.Addr, "user", c.SFTP.User,
+			"dir", c.SFTP.Dir, "connections", c.SFTP.Conns, "retries", c.SFTP.Retries)
+	} else if c.StorageBackend != storage.BackendDisk {
+		addressing := storage.AddressingVirtual
+		if c.Object.Addressing == storage.AddressingPath || c.Object.Addressing == "" && c.Object.Endpoint != "" {
+			addressing = storage.AddressingPath
+		}
+		slog.Info("object storage", "backend", c.StorageBackend, "bucket", c.Object.Bucket,
+			"region", c.Object.Region, "endpoint", c.Object.Endpoint, "addressing", addressing, "prefix", c.Object.Prefix,
+			"credentials", strings.Join(c.Object.Chain.Sources, ","))
+	}
+	if c.DirectUpload {
+		slog.Info("direct uploads enabled", "path", "/upload/direct", "url_ttl", c.DirectUploadURLTTL)
+	}
+	// Lower = less RAM per request, more temp-file I/O.
+	slog.Info("multipart buffer", "max_memory", c.MaxMemory)
+	if c.MaxFileSize > 0 {
+		slog.Info("max file size", "bytes", c.MaxFileSize)
+	}
+	if c.MaxChunkSize > 0 {
+		slog.Info("max chunk size", "bytes", c.MaxChunkSize)
+	}
+	if c.MinChunkSize > 0 {
+		slog.Info("min chunk size", "bytes", c.MinChunkSize)
+	}
+	slog.Info("suggested chunk size", "bytes", c.chunkSize())
+	if len(c.AllowedTypes) > 0 || len(c.BlockedTypes) > 0 {
+		slog.Info("content types", "allowed", strings.Join(c.AllowedTypes, ","), "blocked", strings.Join(c.BlockedTypes, ","))
+	}
+	if c.UserQuota > 0 {
+		slog.Info("user quota", "bytes", c.UserQuota)
+	}
+	if c.MaxConcurrentUploads > 0 {
+		slog.Info("concurrency limit", "max", c.MaxConcurrentUploads)
+	}
+	if c.MaxUploadsPerClient > 0 {
+		slog.Info("per-client concurrency limit", "max", c.MaxUploadsPerClient)
+	}
+	if c.RateLimitRPS > 0 {
+		slog.Info("rate limit", "rps", c.RateLimitRPS, "burst", c.RateLimitBurst, "trust_proxy", c.TrustProxy)
+	}
+	if c.RateLimitUserRPS > 0 {
+		slog.Info("per-user rate limit", "rps", c.RateLimitUserRPS, "burst", c.RateLimitUserBurst)
+	}
+	if c.BandwidthLimit > 0 || c.UploadBandwidthLimit > 0 {
+		slog.Info("bandwidth limit", "bytes_per_sec", c.BandwidthLimit, "per_upload_bytes_per_sec", c.UploadBandwidthLimit)
+	}
+	if c.UploadTTL > 0 {
+		slog.Info("upload TTL", "ttl", c.UploadTTL)
+	}
+	if c.StaleTTL > 0 {
+		slog.Info("janitor", "stale_ttl", c.StaleTTL, "interval", c.JanitorEvery)
+	}
+	if c.Retention > 0 || c.MaxRetention > 0 {
+		slog.Info("retention", "default", c.Retention, "max", c.MaxRetention, "interval", c.JanitorEvery)
+	}
+	if c.CompressAtRest {
+		slog.Info("compression at rest enabled (gzip)")
+	}
+	if len(c.Thumbnails) > 0 {
+		sizes := make([]string, len(c.Thumbnails))
+		for i, size := range c.Thumbnails {
+			sizes[i] = size.String()
+		}
+		slog.Info("thumbnails", "sizes", strings.Join(sizes, ","))
+	}
+	if c.encrypts() {
+		master := "local"
+		if c.KeyWrapper != nil {
+			master = "custom"
+		} else if c.KMS.KeyID != "" {
+			master = "kms"
+		}
+		slog.Info("encryption at rest enabled (AES-256-GCM)", "master_key", master, "kms_key", c.KMS.KeyID)
+	}
+	if c.Deduplicate {
+		slog.Info("deduplication by SHA-256 enabled")
+	}
+	if c.ChunkDedup {
+		slog.Info("chunk-level deduplication enabled", "chunk_ttl", c.ChunkTTL)
+	}
+	if c.DeltaUpload {
+		slog.Info("delta uploads enabled")
+	}
+	if c.Versioning {
+		slog.Info("file versioning enabled", "max_versions", c.MaxVersions, "version_retention", c.VersionTTL,
+			"policy_rules", len(c.VersionPolicy))
+	}
+	if c.MetadataDB != "" {
+		driver, _, _ := parseMetadataDB(c.MetadataDB)
+		slog.Info("metadata database", "driver", driver)
+	}
+	if c.AuditLog == AuditDB {
+		slog.Info("audit log", "table", "audit_log")
+	} else if c.AuditLog != "" {
+		slog.Info("audit log", "path", c.AuditLog, "max_size", c.AuditMaxSize, "max_files", c.AuditMaxFiles)
+	}
+	if c.Locker != nil {
+		slog.Info("shared upload locks", "backend", "custom")
+	} else if c.LockURL != "" {
+		backend, nodes, _ := parseLockURL(c.LockURL)
+		slog.Info("shared upload locks", "backend", backend, "nodes", max(len(nodes), 1), "ttl", cmp.Or(c.LockTTL, session.RedisTTL))
+	}
+	if c.SessionCache != "" {
+		node, _ := session.ParseRedisURL(c.SessionCache)
+		slog.Info("upload metadata cached in Redis", "addr", node.Addr, "db", node.DB, "ttl", max(c.UploadTTL, c.StaleTTL))
+	}
+	if c.ClamdAddr != "" || c.Scanner != nil {
+		slog.Info("virus scanning enabled", "clamd", c.ClamdAddr, "infected", c.ScanInfected,
+			"quarantine_dir", c.QuarantineDir, "on_error", c.ScanOnError)
+	}
+	if len(c.WebhookURLs) > 0 {
+		slog.Info("webhooks enabled", "urls", strings.Join(c.WebhookURLs, ","), "signed", c.WebhookSecret != "",
+			"attempts", c.WebhookAttempts, "backoff", c.WebhookBackoff)
+	}
+	if len(c.TranscodePresets) > 0 {
+		presets := make([]string, len(c.TranscodePresets))
+		for i, p := range c.TranscodePresets {
+			presets[i] = p.Name
+		}
+		queue := "in-process"
+		if c.TranscodeQueue != "" {
+			queue = "redis"
+		}
+		slog.Info("video transcoding", "presets", strings.Join(presets, ","), "ffmpeg", c.FFmpegPath,
+			"workers", c.TranscodeWorkers, "timeout", c.TranscodeTimeout, "queue", queue)
+		if _, err := exec.LookPath(c.FFmpegPath); err != nil {
+			slog.Warn("ffmpeg not found; transcoding jobs will fail", "ffmpeg", c.FFmpegPath, "error", err)
+		}
+	}
+	if len(c.HookCommand) > 0 {
+		program := c.HookCommand[0].Root.String()
+		slog.Info("post-upload command", "program", program, "args", len(c.HookCommand)-1, "timeout", c.HookTimeout)
+		if _, err := exec.LookPath(program); err != nil {
+			slog.Warn("post-upload command not found; every run will fail", "program", program, "error", err)
+		}
+	}
+	if !c.RequireUploadID {
+		slog.Warn("chunks without an upload session accepted, keyed by fileName: concurrent uploads of one name mix their chunks")
+	}
+	if c.TenantMode != "" {
+		slog.Info("tenants", "mode", c.TenantMode, "tenants", strings.Join(c.tenantNames(), ","), "quota", c.TenantQuota)
+	}
+	if c.APIKeys != "" || c.JWTSecret != "" || c.JWTPublicKey != nil || c.Auth != nil {
+		slog.Info("auth enabled", "api_keys", len(parseAPIKeys(c.APIKeys)),
+			"jwt", c.JWTSecret != "" || c.JWTPublicKey != nil, "routes", strings.Join(c.AuthRoutes, ","))
+	}
+	if c.SigningKey != "" {
+		slog.Info("signed URLs enabled", "path", "/files/{name}/sign", "ttl", c.SignedURLTTL, "max_ttl", c.SignedURLMaxTTL)
+	}
+	if c.AdminToken != "" {
+		slog.Info("admin endpoints enabled", "path", "/admin/", "header", AdminTokenHeader)
+	}
+	if c.OTLPEndpoint != "" {
+		slog.Info("tracing enabled (OTLP/HTTP)", "endpoint", c.OTLPEndpoint, "service", c.TraceService, "sample_ratio", c.TraceSampleRatio)
+	}
+}
+
+// parseMode parses an octal Unix mode such as "0664" or "02775",
+// translating setuid/setgid/sticky bits into their os.FileMode flags.
+func parseMode(s string) (os.FileMode, error) {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if v > 0o7777 {
+		return 0, fmt.Errorf("mode %s out of range", s)
+	}
+	mode := os.FileMode(v & 0o777)
+	if v&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if v&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if v&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
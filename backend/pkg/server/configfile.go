@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------------------------------------------------------------------
+// Config file (-config / CONFIG_FILE): a flat JSON object or YAML mapping
+// of setting names, e.g. upload_dir: /srv/uploads
+// ---------------------------------------------------------------------
+
+// readConfigFile returns the settings in path keyed like configKeys.
+// Unknown keys are an error so typos don't go unnoticed.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]configValue
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s: want a .json, .yaml or .yml extension", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool, len(configKeys))
+	for _, k := range configKeys {
+		known[k.name] = true
+	}
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		name := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if !known[name] {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, k)
+		}
+		values[name] = string(v)
+	}
+	return values, nil
+}
+
+// configValue is one setting of a config file as the environment would
+// spell it: a string, number or boolean as written, or a list of strings
+// (allowed_origins, ...) joined with commas. An empty YAML value is "".
+type configValue string
+
+func (v *configValue) UnmarshalJSON(data []byte) error {
+	var items []string
+	switch data[0] {
+	case '"':
+		return json.Unmarshal(data, (*string)(v))
+	case '[':
+		if err := json.Unmarshal(data, &items); err != nil {
+			return errors.New("list items must be strings")
+		}
+		*v = configValue(strings.Join(items, ","))
+	case '{', 'n':
+		return fmt.Errorf("unsupported value %s", data)
+	default: // a number or boolean
+		*v = configValue(data)
+	}
+	return nil
+}
+
+func (v *configValue) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag != "!!null" {
+			*v = configValue(node.Value)
+		}
+	case yaml.SequenceNode:
+		items := make([]string, len(node.Content))
+		for i, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: list items must be strings", item.Line)
+			}
+			items[i] = item.Value
+		}
+		*v = configValue(strings.Join(items, ","))
+	default:
+		return fmt.Errorf("line %d: nested values are not supported", node.Line)
+	}
+	return nil
+}
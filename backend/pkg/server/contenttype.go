@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Content types: sniffed from the bytes (not the file name), checked
+// against ALLOWED_TYPES / BLOCKED_TYPES and served on download
+// ---------------------------------------------------------------------
+
+// TypeTable is the content type table's file inside UploadDir.
+const TypeTable = ".types.json"
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// signatures are formats http.DetectContentType reports as
+// application/octet-stream but that a blocklist wants to name.
+var signatures = []struct{ magic, contentType string }{
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\x7fELF", "application/x-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+}
+
+// detectContentType returns the MIME type of a file starting with head.
+// The bytes decide; the extension of name only refines a generic answer
+// (text/plain for .csv, application/octet-stream for .docx), so renaming
+// an executable to .png does not make it an image.
+func detectContentType(name string, head []byte) string {
+	for _, sig := range signatures {
+		if bytes.HasPrefix(head, []byte(sig.magic)) {
+			return sig.contentType
+		}
+	}
+	ct := http.DetectContentType(head)
+	byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	switch t := mediaType(ct); {
+	case byExt == "":
+	case t == "application/octet-stream":
+		return byExt
+	case t == "text/plain" && strings.HasPrefix(byExt, "text/") && mediaType(byExt) != "text/html":
+		// HTML is recognized by content; plain text named .html stays text.
+		return byExt
+	}
+	return ct
+}
+
+// mediaType strips the parameters (charset) from a content type.
+func mediaType(ct string) string {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(ct))
+	}
+	return t
+}
+
+// parseTypeList reads a comma-separated list of MIME types (image/png)
+// and families (image/*).
+func parseTypeList(get func(string) string, key string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(get(key), ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t == "" {
+			continue
+		}
+		major, minor, ok := strings.Cut(t, "/")
+		if !ok || major == "" || minor == "" || strings.ContainsAny(minor, "/;") || (major == "*" && minor != "*") {
+			return nil, fmt.Errorf("invalid %s entry %q: want a MIME type such as image/png or image/*", key, t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// matchesType reports whether the media type t is one of patterns.
+func matchesType(patterns []string, t string) bool {
+	for _, p := range patterns {
+		if p == t || p == "*/*" || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// filtersTypes reports whether uploads are checked by content type.
+func (c Config) filtersTypes() bool {
+	return len(c.AllowedTypes) > 0 || len(c.BlockedTypes) > 0
+}
+
+// checkType refuses a file of content type ct that BLOCKED_TYPES names or
+// ALLOWED_TYPES (when set) does not.
+func (s *Server) checkType(fileName, ct string) *uploadError {
+	t := mediaType(ct)
+	if matchesType(s.cfg.BlockedTypes, t) ||
+		(len(s.cfg.AllowedTypes) > 0 && !matchesType(s.cfg.AllowedTypes, t)) {
+		return &uploadError{http.StatusUnsupportedMediaType, CodeTypeNotAllowed,
+			fmt.Sprintf("%s is %s, which this server does not accept", fileName, t)}
+	}
+	return nil
+}
+
+// sniffChunk reads the first bytes of the first chunk for
+// detectContentType and returns a reader that still yields the whole
+// chunk: the same one rewound when it can seek.
+func sniffChunk(fileName string, chunk io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(chunk, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	ct := detectContentType(fileName, head)
+	if rs, ok := chunk.(io.ReadSeeker); ok {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return "", nil, err
+		}
+		return ct, rs, nil
+	}
+	return ct, io.MultiReader(bytes.NewReader(head), chunk), nil
+}
+
+// typeTable records the sniffed content type of each completed file, for
+// the download Content-Type.
+type typeTable struct {
+	*storage.Table[string]
+}
+
+func newTypeTable(dir string, mode os.FileMode) *typeTable {
+	return &typeTable{storage.NewTable[string]("content type table", filepath.Join(dir, TypeTable), mode)}
+}
+
+// set records the content type of name; "" forgets it.
+func (t *typeTable) set(name, ct string) error {
+	return t.Update(func(files map[string]string) (bool, error) {
+		if files[name] == ct {
+			return false, nil
+		}
+		if ct == "" {
+			delete(files, name)
+		} else {
+			files[name] = ct
+		}
+		return true, nil
+	})
+}
+
+// get returns the content type of name, "" when none was recorded.
+func (t *typeTable) get(name string) (string, error) {
+	ct, _, err := t.Get(name)
+	return ct, err
+}
+
+// storedType returns the content type recorded for the completed file
+// name, "" when unknown (e.g. stored before types were recorded).
+func (s *Server) storedType(name string) string {
+	ct, err := s.types.get(name)
+	if err != nil {
+		slog.Warn("cannot read content type", "file", name, "error", err)
+	}
+	return ct
+}
+
+// recordType remembers the content type of the completed file name.
+func (s *Server) recordType(name, ct string) {
+	if err := s.types.set(name, ct); err != nil {
+		slog.Warn("cannot record content type", "file", name, "error", err)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// CORS middleware (ALLOWED_ORIGINS, comma-separated; default AllowedOrigin;
+// CORS_ALLOW_CREDENTIALS, CORS_MAX_AGE)
+// ---------------------------------------------------------------------
+const DefaultCORSMaxAge = 10 * time.Minute // how long browsers may cache a preflight
+
+// corsAllowHeaders are the request headers any route accepts, sent when a
+// preflight does not name the ones it wants.
+var corsAllowHeaders = []string{"Content-Type", "Content-Encoding", "Authorization", "X-API-Key", "X-Admin-Token", "X-Request-ID", "Tus-Resumable", "Upload-Length", "Upload-Metadata",
+	"Upload-Offset", "Upload-Checksum", "Upload-Defer-Length", "X-HTTP-Method-Override"}
+
+var corsExposeHeaders = "ETag, Content-Length, Retry-After, WWW-Authenticate, X-Request-ID, Location, Tus-Resumable, Tus-Version, " +
+	"Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, " + EncryptionManifestHeader + ", " + VersionIDHeader
+
+// checkOrigin validates one ALLOWED_ORIGINS entry: "*", or
+// scheme://host[:port] where host may start with "*." to match any
+// subdomain.
+func checkOrigin(o string) error {
+	if o == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(o, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.User != nil || strings.Contains(u.Host, "*") {
+		return fmt.Errorf("invalid ALLOWED_ORIGINS entry %q: want scheme://host[:port], optionally with *. before the host, or *", o)
+	}
+	return nil
+}
+
+// addOrigin allows origin o: exact, a "*." subdomain pattern, or "*".
+func (s *Server) addOrigin(o string) {
+	switch {
+	case o == "*":
+		s.anyOrigin = true
+	case strings.Contains(o, "://*."):
+		scheme, domain, _ := strings.Cut(o, "://*")
+		s.originPatterns = append(s.originPatterns, [2]string{scheme + "://", domain})
+	default:
+		s.origins[o] = true
+	}
+}
+
+// originAllowed reports whether origin may make cross-origin requests. A
+// pattern https://*.example.com matches https://a.example.com and
+// https://a.b.example.com, but not https://example.com.
+func (s *Server) originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if s.anyOrigin || s.origins[origin] {
+		return true
+	}
+	for _, p := range s.originPatterns {
+		sub, ok := strings.CutPrefix(origin, p[0])
+		if !ok {
+			continue
+		}
+		if sub, ok = strings.CutSuffix(sub, p[1]); ok && sub != "" && !strings.ContainsAny(sub, "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS answers preflight requests for a route supporting methods and
+// adds CORS headers to every response. Only allowed origins are echoed,
+// never "*", so the same header works with credentials.
+func (s *Server) withCORS(methods []string, next http.HandlerFunc) http.HandlerFunc {
+	allowMethods := strings.Join(methods, ", ") + ", " + http.MethodOptions
+	maxAge := strconv.Itoa(int(s.cfg.CORSMaxAge.Seconds()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); s.originAllowed(origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			if s.cfg.CORSAllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if r.Method == http.MethodOptions {
+			h.Add("Vary", "Access-Control-Request-Headers")
+			allowHeaders := strings.Join(corsAllowHeaders, ", ")
+			if want := r.Header.Get("Access-Control-Request-Headers"); want != "" {
+				allowHeaders = want
+			}
+			h.Set("Access-Control-Allow-Methods", allowMethods)
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+			h.Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
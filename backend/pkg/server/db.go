@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// METADATA_DB: a record of every upload (sessions, chunk receipts,
+// owners, checksums, timestamps, final paths) in SQLite or Postgres
+// ---------------------------------------------------------------------
+
+// SQLite, the default, is linked into every build (db_sqlite.go); the
+// Postgres driver only with -tags postgres (db_postgres.go).
+const (
+	DriverSQLite   = "sqlite" // modernc.org/sqlite
+	DriverPostgres = "pgx"    // github.com/jackc/pgx/v5/stdlib
+
+	DBTimeout = 5 * time.Second // per statement
+)
+
+// Upload states in the uploads table.
+const (
+	UploadInProgress = "in_progress"
+	UploadComplete   = "complete"
+	UploadAborted    = "aborted"
+	UploadRejected   = "rejected" // by the virus scanner
+)
+
+var dbSchema = []string{
+	`CREATE TABLE IF NOT EXISTS uploads (
+	id           TEXT PRIMARY KEY,
+	file_name    TEXT NOT NULL,
+	owner        TEXT NOT NULL DEFAULT '',
+	file_size    BIGINT NOT NULL DEFAULT 0,
+	total_chunks INTEGER NOT NULL DEFAULT 0,
+	status       TEXT NOT NULL,
+	size         BIGINT NOT NULL DEFAULT 0,
+	sha256       TEXT NOT NULL DEFAULT '',
+	final_path   TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMP NOT NULL,
+	updated_at   TIMESTAMP NOT NULL,
+	completed_at TIMESTAMP
+)`,
+	`CREATE TABLE IF NOT EXISTS upload_chunks (
+	upload_id   TEXT NOT NULL,
+	chunk_index INTEGER NOT NULL,
+	size        BIGINT NOT NULL,
+	checksums   TEXT NOT NULL DEFAULT '',
+	received_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (upload_id, chunk_index)
+)`,
+	`CREATE INDEX IF NOT EXISTS uploads_owner ON uploads (owner)`,
+	`CREATE TABLE IF NOT EXISTS upload_scans (
+	upload_id  TEXT PRIMARY KEY,
+	status     TEXT NOT NULL,
+	scanner    TEXT NOT NULL DEFAULT '',
+	signature  TEXT NOT NULL DEFAULT '',
+	error      TEXT NOT NULL DEFAULT '',
+	scanned_at TIMESTAMP NOT NULL
+)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+	at         TIMESTAMP NOT NULL,
+	request_id TEXT NOT NULL,
+	user_name  TEXT NOT NULL DEFAULT '',
+	tenant     TEXT NOT NULL DEFAULT '',
+	source_ip  TEXT NOT NULL DEFAULT '',
+	action     TEXT NOT NULL,
+	method     TEXT NOT NULL,
+	path       TEXT NOT NULL,
+	upload_id  TEXT NOT NULL DEFAULT '',
+	file_name  TEXT NOT NULL DEFAULT '',
+	status     INTEGER NOT NULL,
+	result     TEXT NOT NULL,
+	code       TEXT NOT NULL DEFAULT '',
+	bytes      BIGINT NOT NULL DEFAULT 0
+)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_at ON audit_log (at)`,
+}
+
+// parseMetadataDB reads METADATA_DB: a postgres:// URL, or a SQLite file
+// given as sqlite:path or a bare path.
+func parseMetadataDB(v string) (driver, dsn string, err error) {
+	if strings.HasPrefix(v, "postgres://") || strings.HasPrefix(v, "postgresql://") {
+		return DriverPostgres, v, nil
+	}
+	if rest, ok := strings.CutPrefix(v, "sqlite:"); ok {
+		v = strings.TrimPrefix(rest, "//")
+	}
+	if v == "" || strings.Contains(v, "://") {
+		return "", "", fmt.Errorf("invalid METADATA_DB %q: want a SQLite path or a postgres:// URL", v)
+	}
+	return DriverSQLite, v, nil
+}
+
+// metaDB writes upload records; queries are written with ? placeholders
+// and rebound to $n for Postgres.
+type metaDB struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// openMetaDB connects and creates the tables if needed.
+func openMetaDB(driver, dsn string) (*metaDB, error) {
+	if !slices.Contains(sql.Drivers(), driver) {
+		return nil, fmt.Errorf("METADATA_DB: the %s driver is not compiled in (build with -tags postgres)", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	m := &metaDB{db: db, postgres: driver == DriverPostgres}
+	ctx, cancel := context.WithTimeout(context.Background(), DBTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("METADATA_DB: %w", err)
+	}
+	for _, stmt := range dbSchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("METADATA_DB schema: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// rebind rewrites the ? placeholders of query for the driver.
+func (m *metaDB) rebind(query string) string {
+	if !m.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (m *metaDB) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, DBTimeout)
+	defer cancel()
+	_, err := m.db.ExecContext(ctx, m.rebind(query), args...)
+	return err
+}
+
+// query calls scan on each row query returns.
+func (m *metaDB) query(ctx context.Context, scan func(*sql.Rows) error, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, DBTimeout)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, m.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (m *metaDB) Close() error {
+	return m.db.Close()
+}
+
+// openMetaDB connects to METADATA_DB, if configured.
+func (s *Server) openMetaDB() error {
+	if s.cfg.MetadataDB == "" {
+		return nil
+	}
+	driver, dsn, err := parseMetadataDB(s.cfg.MetadataDB)
+	if err != nil {
+		return err
+	}
+	s.db, err = openMetaDB(driver, dsn)
+	return err
+}
+
+// dbContext outlives the request, so a client hanging up right after its
+// last chunk does not lose the record.
+func dbContext(r *http.Request) context.Context {
+	return context.WithoutCancel(r.Context())
+}
+
+func uploadOwner(r *http.Request) string {
+	p, _ := principalFrom(r.Context())
+	return p.Subject
+}
+
+// recordUploadStart records a new upload under key, replacing any earlier
+// upload that used the same key (a file name re-uploaded without a
+// session).
+func (s *Server) recordUploadStart(r *http.Request, key, fileName string, fileSize int64, totalChunks int, createdAt time.Time) {
+	if s.db == nil {
+		return
+	}
+	ctx := dbContext(r)
+	now := s.now().UTC()
+	err := s.db.exec(ctx, `INSERT INTO uploads (id, file_name, owner, file_size, total_chunks, status, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET file_name = excluded.file_name, owner = excluded.owner,
+	file_size = excluded.file_size, total_chunks = excluded.total_chunks, status = excluded.status,
+	size = 0, sha256 = '', final_path = '', created_at = excluded.created_at,
+	updated_at = excluded.updated_at, completed_at = NULL`,
+		s.dbKey(key), fileName, uploadOwner(r), fileSize, totalChunks, UploadInProgress, createdAt.UTC(), now)
+	if err == nil {
+		err = s.db.exec(ctx, `DELETE FROM upload_chunks WHERE upload_id = ?`, s.dbKey(key))
+	}
+	if err != nil {
+		logCtx(r.Context()).Warn("metadata db: cannot record upload", "key", key, "error", err)
+	}
+}
+
+// recordChunk records the receipt of chunk index with the checksums it was
+// verified against.
+func (s *Server) recordChunk(r *http.Request, key, fileName string, index int, size int64) {
+	if s.db == nil {
+		return
+	}
+	sums := chunkChecksums(r, r.FormValue("checksumAlgo"))
+	checksums := make([]string, 0, len(sums))
+	for algo, sum := range sums {
+		checksums = append(checksums, algo+":"+strings.ToLower(sum))
+	}
+	sort.Strings(checksums)
+
+	ctx := dbContext(r)
+	now := s.now().UTC()
+	err := s.db.exec(ctx, `INSERT INTO uploads (id, file_name, owner, status, created_at, updated_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET status = excluded.status, updated_at = excluded.updated_at`,
+		s.dbKey(key), fileName, uploadOwner(r), UploadInProgress, now, now)
+	if err == nil {
+		err = s.db.exec(ctx, `INSERT INTO upload_chunks (upload_id, chunk_index, size, checksums, received_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (upload_id, chunk_index) DO UPDATE SET size = excluded.size,
+	checksums = excluded.checksums, received_at = excluded.received_at`,
+			s.dbKey(key), index, size, strings.Join(checksums, ","), now)
+	}
+	if err != nil {
+		logCtx(r.Context()).Warn("metadata db: cannot record chunk", "key", key, "index", index, "error", err)
+	}
+}
+
+// recordCompletion marks the upload under key as stored at path.
+func (s *Server) recordCompletion(r *http.Request, key, fileName, path string, size int64, sha256 string) {
+	if s.db == nil {
+		return
+	}
+	now := s.now().UTC()
+	err := s.db.exec(dbContext(r), `INSERT INTO uploads (id, file_name, owner, status, size, sha256, final_path, created_at, updated_at, completed_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET status = excluded.status, size = excluded.size, sha256 = excluded.sha256,
+	final_path = excluded.final_path, updated_at = excluded.updated_at, completed_at = excluded.completed_at`,
+		s.dbKey(key), fileName, uploadOwner(r), UploadComplete, size, sha256, path, now, now, now)
+	if err != nil {
+		logCtx(r.Context()).Warn("metadata db: cannot record completion", "key", key, "error", err)
+	}
+}
+
+// recordScan records the virus scan of the upload under key.
+func (s *Server) recordScan(r *http.Request, key string, res ScanResult) {
+	if s.db == nil {
+		return
+	}
+	err := s.db.exec(dbContext(r), `INSERT INTO upload_scans (upload_id, status, scanner, signature, error, scanned_at)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (upload_id) DO UPDATE SET status = excluded.status, scanner = excluded.scanner,
+	signature = excluded.signature, error = excluded.error, scanned_at = excluded.scanned_at`,
+		s.dbKey(key), res.Status, res.Scanner, res.Signature, res.Error, s.now().UTC())
+	if err != nil {
+		logCtx(r.Context()).Warn("metadata db: cannot record scan", "key", key, "error", err)
+	}
+}
+
+// recordRejection marks an upload whose file the scanner rejected.
+func (s *Server) recordRejection(r *http.Request, key string) {
+	if s.db == nil {
+		return
+	}
+	err := s.db.exec(dbContext(r), `UPDATE uploads SET status = ?, updated_at = ? WHERE id = ?`,
+		UploadRejected, s.now().UTC(), s.dbKey(key))
+	if err != nil {
+		logCtx(r.Context()).Warn("metadata db: cannot record rejection", "key", key, "error", err)
+	}
+}
+
+// recordAbort marks an unfinished upload whose files were discarded.
+func (s *Server) recordAbort(key string) {
+	if s.db == nil {
+		return
+	}
+	err := s.db.exec(context.Background(), `UPDATE uploads SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		UploadAborted, s.now().UTC(), s.dbKey(key), UploadInProgress)
+	if err != nil {
+		slog.Warn("metadata db: cannot record abort", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build postgres
+
+package server
+
+// Links the Postgres driver for METADATA_DB and LOCK_URL into builds
+// with -tags postgres.
+import _ "github.com/jackc/pgx/v5/stdlib"
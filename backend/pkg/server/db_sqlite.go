@@ -0,0 +1,4 @@
+package server
+
+// Links the SQLite driver, the default for METADATA_DB, into every build.
+import _ "modernc.org/sqlite"
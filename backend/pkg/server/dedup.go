@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Deduplication by content hash (DEDUPLICATE=true, off by default) and
+// GET /exists?hash=
+// ---------------------------------------------------------------------
+
+// HashTable is the hash index's file inside UploadDir.
+const HashTable = ".hashes.json"
+
+// hashEntry is the completed file holding some content.
+type hashEntry struct {
+	Name   string `json:"name"`   // file name as uploaded
+	Stored string `json:"stored"` // name in storage: Name (files compressed at rest once kept Name + ".gz")
+	Path   string `json:"path"`
+	Size   int64  `json:"size"` // original size
+}
+
+// hashTable maps the SHA-256 of each completed file to where it is stored.
+type hashTable struct {
+	*storage.Table[hashEntry]
+}
+
+func newHashTable(dir string, mode os.FileMode) *hashTable {
+	return &hashTable{storage.NewTable[hashEntry]("hash table", filepath.Join(dir, HashTable), mode)}
+}
+
+// lookup returns the file with content hash, if any.
+func (t *hashTable) lookup(hash string) (hashEntry, bool, error) {
+	return t.Get(hash)
+}
+
+// record notes that e holds content hash. Any other hash recorded for
+// e.Name is dropped, since the file it described has been replaced.
+func (t *hashTable) record(hash string, e hashEntry) error {
+	return t.Update(func(files map[string]hashEntry) (bool, error) {
+		for h, old := range files {
+			if old.Name == e.Name && h != hash {
+				delete(files, h)
+			}
+		}
+		files[hash] = e
+		return true, nil
+	})
+}
+
+// forget drops hash, whose file turned out to be gone.
+func (t *hashTable) forget(hash string) error {
+	return t.Delete(hash)
+}
+
+// dropName forgets the content of a deleted file.
+func (t *hashTable) dropName(name string) error {
+	return t.Update(func(files map[string]hashEntry) (bool, error) {
+		changed := false
+		for h, e := range files {
+			if e.Name == name || e.Stored == name {
+				delete(files, h)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// findHash returns the stored file with content hash. An entry whose file
+// is gone or has changed size is dropped.
+func (s *Server) findHash(hash string) (hashEntry, bool, error) {
+	e, ok, err := s.hashes.lookup(hash)
+	if err != nil || !ok {
+		return e, false, err
+	}
+	size, _, err := s.statStored(e.Stored)
+	if err == nil && size == e.Size {
+		return e, true, nil
+	}
+	if err := s.hashes.forget(hash); err != nil {
+		return e, false, err
+	}
+	return e, false, nil
+}
+
+// deduplicate hashes the just-finalized fileName. When another file
+// already holds the same content, the new copy is removed and that file
+// is returned.
+func (s *Server) deduplicate(r *http.Request, fileName string) (hash string, dup *hashEntry) {
+	lg := logCtx(r.Context())
+	hash, err := s.hashStored(fileName)
+	if err != nil {
+		lg.Warn("dedup: cannot hash", "file", fileName, "error", err)
+		return "", nil
+	}
+	e, ok, err := s.findHash(hash)
+	if err != nil {
+		lg.Warn("dedup: cannot look up hash", "error", err)
+		return hash, nil
+	}
+	if !ok || e.Name == fileName {
+		return hash, nil
+	}
+	if err := s.store.Remove(fileName); err != nil {
+		lg.Warn("dedup: cannot remove duplicate", "file", fileName, "error", err)
+		return hash, nil
+	}
+	lg.Info("duplicate upload", "file", fileName, "duplicate_of", e.Name)
+	return hash, &e
+}
+
+// recordHash adds a completed file to the index.
+func (s *Server) recordHash(r *http.Request, hash string, e hashEntry) {
+	if err := s.hashes.record(hash, e); err != nil {
+		logCtx(r.Context()).Warn("dedup: cannot record hash", "file", e.Name, "error", err)
+	}
+}
+
+// ExistsResponse is returned by GET /exists.
+type ExistsResponse struct {
+	Exists   bool   `json:"exists"`
+	FileName string `json:"fileName,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// existsHandler tells a client whether a file with the SHA-256 in "hash"
+// is already stored, so it can skip the upload.
+func (s *Server) existsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	hash := strings.ToLower(r.URL.Query().Get("hash"))
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "hash must be a hex SHA-256")
+		return
+	}
+	var resp ExistsResponse
+	if s.cfg.Deduplicate {
+		e, ok, err := s.findHash(hash)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot look up hash: %v", err)
+			return
+		}
+		if ok {
+			resp = ExistsResponse{Exists: true, FileName: e.Name, Path: e.Path, Size: e.Size}
+		}
+	}
+	logFor(w).Info("exists", "hash", hash, "exists", resp.Exists)
+	respondJSON(w, http.StatusOK, resp)
+}
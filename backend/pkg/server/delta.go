@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Delta uploads (DELTA_UPLOAD=true, off by default): GET
+// /files/{name}/signature and POST /files/{name}/patch
+// ---------------------------------------------------------------------
+
+// Like rsync, the server describes the stored file block by block, the
+// client looks for those blocks anywhere in its new version and sends a
+// delta of block references and the bytes in between, and the server
+// builds the new version from the old one and the delta.
+
+const (
+	DefaultDeltaBlock = 64 << 10 // block size when the client asks for none
+	MinDeltaBlock     = 512
+	MaxDeltaBlock     = 16 << 20
+	MaxDeltaBlocks    = 1 << 16 // blocks per signature; larger files get larger blocks
+
+	// Delta operations: a copy of count blocks of the stored file from
+	// block index on, or n literal bytes, each as uvarints after the op.
+	DeltaCopy    = 'C'
+	DeltaLiteral = 'L'
+)
+
+// SignatureBlock describes one block of the stored file: the rsync weak
+// checksum, cheap to roll over every offset, and the first 16 bytes of the
+// SHA-256 to confirm a match.
+type SignatureBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature is the GET /files/{name}/signature body.
+type Signature struct {
+	FileName  string           `json:"fileName"`
+	Size      int64            `json:"size"`
+	BlockSize int64            `json:"blockSize"`
+	ETag      string           `json:"etag"` // send as If-Match with the patch
+	Blocks    []SignatureBlock `json:"blocks"`
+}
+
+var (
+	// errInvalidDelta is a delta that cannot be applied to the stored file.
+	errInvalidDelta = errors.New("invalid delta")
+	// errDeltaSize is a delta making other than the declared fileSize.
+	errDeltaSize = errors.New("delta does not make fileSize bytes")
+)
+
+// weakSum is rsync's rolling checksum of p: a, the sum of the bytes, and
+// b, the sum of each byte times its distance from the end, both mod 2^16.
+func weakSum(p []byte) uint32 {
+	var a, b uint32
+	for i, c := range p {
+		a += uint32(c)
+		b += uint32(len(p)-i) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+// deltaBlockSize is the block size asked for in v, or the default, grown
+// until the file has at most MaxDeltaBlocks blocks.
+func deltaBlockSize(v string, size int64) (int64, *uploadError) {
+	bs := int64(DefaultDeltaBlock)
+	if v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < MinDeltaBlock || n > MaxDeltaBlock {
+			return 0, &uploadError{http.StatusBadRequest, CodeInvalidRequest,
+				fmt.Sprintf("invalid blockSize %q: want %d to %d bytes", v, MinDeltaBlock, MaxDeltaBlock)}
+		}
+		bs = n
+	}
+	for (size+bs-1)/bs > MaxDeltaBlocks {
+		bs *= 2
+	}
+	return bs, nil
+}
+
+// deltaBase is the stored version of a file a delta applies to.
+type deltaBase struct {
+	io.ReadSeekCloser
+	size int64
+	etag string
+}
+
+// openDeltaBase opens the stored fileName, decompressing one compressed
+// at rest, and returns it with the ETag downloads give it. The caller
+// holds fileName's lock.
+func (s *Server) openDeltaBase(fileName string) (*deltaBase, *uploadError) {
+	stored, modTime, err := s.store.Stat(fileName)
+	if err == nil && s.isExpired(fileName) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &uploadError{http.StatusNotFound, CodeNotFound, fmt.Sprintf("file %q not found", fileName)}
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), stored)
+	f, size, err := s.openStored(fileName)
+	if err != nil {
+		return nil, &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot open %s: %v", fileName, err)}
+	}
+	return &deltaBase{f, size, etag}, nil
+}
+
+// signatureHandler describes the stored file block by block for a client
+// about to send a delta against it.
+func (s *Server) signatureHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	fileName, uerr := s.cleanFileName(r.PathValue("name"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	lock := s.locks.Get(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	base, uerr := s.openDeltaBase(fileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	defer base.Close()
+	bs, uerr := deltaBlockSize(r.URL.Query().Get("blockSize"), base.size)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	sig := Signature{FileName: fileName, Size: base.size, BlockSize: bs, ETag: base.etag,
+		Blocks: make([]SignatureBlock, 0, (base.size+bs-1)/bs)}
+	buf := make([]byte, bs)
+	br := bufio.NewReaderSize(contextReader{ctx: r.Context(), r: base}, int(min(bs, 1<<20)))
+	for off := int64(0); off < base.size; off += bs {
+		block := buf[:min(bs, base.size-off)]
+		if _, err := io.ReadFull(br, block); err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot read %s: %v", fileName, err)
+			return
+		}
+		sum := sha256.Sum256(block)
+		sig.Blocks = append(sig.Blocks, SignatureBlock{Weak: weakSum(block), Strong: hex.EncodeToString(sum[:16])})
+	}
+	logFor(w).Info("delta signature", "file", fileName, "bytes", base.size, "block_size", bs, "blocks", len(sig.Blocks))
+	w.Header().Set("ETag", base.etag)
+	respondJSON(w, http.StatusOK, sig)
+}
+
+// patchHandler builds a new version of a stored file from the old one and
+// the delta in the body, then finalizes it like a completed upload.
+func (s *Server) patchHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+	if err := s.ensureDirs(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot initialise upload directory")
+		return
+	}
+	q := r.URL.Query()
+	fileName, _, fileSize, uerr := s.parseFileParams(r.PathValue("name"), "1", q.Get("fileSize"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if q.Get("fileSize") == "" || q.Get("blockSize") == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "missing fileSize or blockSize")
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		respondError(w, http.StatusPreconditionRequired, CodeMissingField, "If-Match required: the etag of the signature the delta was made against")
+		return
+	}
+	if quota := s.checkQuota(r, fileName, fileSize); quota != nil {
+		respondQuotaExceeded(w, quota)
+		return
+	}
+
+	key := fileName
+	lock := s.locks.Get(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	base, uerr := s.openDeltaBase(fileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	defer base.Close()
+	if ifMatch != base.etag {
+		respondError(w, http.StatusPreconditionFailed, CodeBaseChanged, "%s changed since its signature was taken: now %s", fileName, base.etag)
+		return
+	}
+	bs, uerr := deltaBlockSize(q.Get("blockSize"), base.size)
+	if uerr == nil && strconv.FormatInt(bs, 10) != q.Get("blockSize") {
+		uerr = &uploadError{http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("blockSize %s is not the %d of the signature", q.Get("blockSize"), bs)}
+	}
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	meta := &storage.Meta{Owner: uploadOwner(r), CreatedAt: s.now().UTC(), FileName: fileName, FileSize: fileSize, TotalChunks: 1}
+	if err := s.store.SaveMeta(key, meta); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot save upload metadata: %v", err)
+		return
+	}
+	s.recordUploadStart(r, key, fileName, fileSize, 1, meta.CreatedAt)
+
+	sums := fileChecksums(r)
+	if v := q.Get("hash"); v != "" {
+		sums[ChecksumSHA256] = v
+	}
+	digest := newFileDigest(sums)
+	s.publish(key, UploadEvent{Type: EventAssembling})
+	apply := spanOf(w).child("storage.apply_delta", "delta.block_size", bs)
+	literal, err := s.applyDelta(r, key, base, bs, fileSize, digest)
+	apply.done(err)
+	if err == nil {
+		err = digest.check()
+	}
+	if err != nil {
+		if rmErr := s.store.RemovePart(key); rmErr != nil {
+			logFor(w).Warn("cannot remove patched part", "file", fileName, "error", rmErr)
+		}
+		var uerr *uploadError
+		switch {
+		case errors.Is(err, errDeltaSize):
+			uerr = &uploadError{http.StatusBadRequest, CodeFileSizeMismatch, err.Error()}
+		case errors.Is(err, errInvalidDelta):
+			uerr = &uploadError{http.StatusBadRequest, CodeInvalidDelta, err.Error()}
+		case errors.Is(err, errChecksumMismatch):
+			uerr = &uploadError{http.StatusUnprocessableEntity, CodeFileHashMismatch, fmt.Sprintf("file hash mismatch: %v", err)}
+		default:
+			uerr = &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot apply delta: %v", err)}
+		}
+		s.publish(key, UploadEvent{Type: EventFailed, FileName: fileName, Code: uerr.code, Error: uerr.msg})
+		uerr.respond(w)
+		return
+	}
+
+	finalPath, err := s.finalizeWithRetry(w, key, fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeFinalizeFailed, "cannot move %s into place: %v", fileName, err)
+		return
+	}
+	s.received.Forget(key)
+	logFor(w).Info("upload patched", "path", finalPath, "bytes", fileSize, "literal_bytes", literal, "base_bytes", base.size)
+
+	resp, uerr := s.completedResponse(r, key, fileName, finalPath)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	resp.Received = literal
+	respondSuccess(w, resp)
+}
+
+// applyDelta writes the new version of base that the delta in r's body
+// describes to the part file of key and to digest, and returns how many
+// literal bytes the delta carried. The new version must come to exactly
+// fileSize bytes.
+func (s *Server) applyDelta(r *http.Request, key string, base *deltaBase, bs, fileSize int64, digest io.Writer) (int64, error) {
+	f, err := s.store.OpenPart(key, true)
+	if err != nil {
+		return 0, err
+	}
+	literal, err := copyDelta(io.MultiWriter(f, digest), bufio.NewReader(s.throttle(r, key, r.Body)), base, bs, fileSize)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	s.chunkWritten(literal)
+	return literal, err
+}
+
+// copyDelta writes to out what the delta read from body makes of base.
+func copyDelta(out io.Writer, body *bufio.Reader, base *deltaBase, bs, fileSize int64) (literal int64, err error) {
+	var written int64
+	blocks := uint64((base.size + bs - 1) / bs)
+	for {
+		op, err := body.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return literal, err
+		}
+		var n int64
+		switch op {
+		case DeltaCopy:
+			index, err1 := binary.ReadUvarint(body)
+			count, err2 := binary.ReadUvarint(body)
+			if err := errors.Join(err1, err2); err != nil {
+				return literal, fmt.Errorf("%w: copy at byte %d: %v", errInvalidDelta, written, err)
+			}
+			if count == 0 || index >= blocks || count > blocks-index {
+				return literal, fmt.Errorf("%w: copy of %d blocks from block %d, the file has %d", errInvalidDelta, count, index, blocks)
+			}
+			off := int64(index) * bs
+			if n = min(int64(count)*bs, base.size-off); written+n > fileSize {
+				break
+			}
+			if _, err := base.Seek(off, io.SeekStart); err != nil {
+				return literal, err
+			}
+			if _, err := io.CopyN(out, base, n); err != nil {
+				return literal, err
+			}
+		case DeltaLiteral:
+			v, err := binary.ReadUvarint(body)
+			if err != nil {
+				return literal, fmt.Errorf("%w: literal at byte %d: %v", errInvalidDelta, written, err)
+			}
+			if v > uint64(fileSize-written) {
+				n = fileSize + 1 // over; reported below
+				break
+			}
+			n = int64(v)
+			m, err := io.CopyN(out, body, n)
+			literal += m
+			if err == io.EOF {
+				return literal, fmt.Errorf("%w: literal at byte %d cut short", errInvalidDelta, written)
+			}
+			if err != nil {
+				return literal, err
+			}
+		default:
+			return literal, fmt.Errorf("%w: unknown op %q at byte %d", errInvalidDelta, op, written)
+		}
+		if written += n; written > fileSize {
+			return literal, fmt.Errorf("%w: more than the %d declared", errDeltaSize, fileSize)
+		}
+	}
+	if written != fileSize {
+		return literal, fmt.Errorf("%w: %d, not the %d declared", errDeltaSize, written, fileSize)
+	}
+	return literal, nil
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Direct uploads (DIRECT_UPLOAD): with object storage, POST /upload/direct
+// hands out pre-signed part URLs so the file goes from the client straight
+// to the bucket; the server only sees the part ETags at completion
+// ---------------------------------------------------------------------
+
+// DefaultDirectUploadURLTTL is how long a pre-signed part URL works when
+// DIRECT_UPLOAD_URL_TTL is unset.
+const DefaultDirectUploadURLTTL = time.Hour
+
+// maxCompleteBody bounds the JSON body of a direct upload's completion:
+// MaxMultipartParts entries of a few dozen bytes each.
+const maxCompleteBody = 1 << 20
+
+// DirectUpload is returned by POST /upload/direct and GET
+// /upload/{uploadID}/parts.
+type DirectUpload struct {
+	UploadID     string       `json:"uploadID"`
+	PartSize     int64        `json:"partSize"` // bytes in every part but the last
+	TotalParts   int          `json:"totalParts"`
+	Parts        []DirectPart `json:"parts"`
+	URLsExpireAt time.Time    `json:"urlsExpireAt"`        // then get new ones from GET /upload/{uploadID}/parts
+	ExpiresAt    *time.Time   `json:"expiresAt,omitempty"` // as in InitResponse
+	Retention    string       `json:"retention,omitempty"` // as in InitResponse
+}
+
+// DirectPart is where to PUT one part: bytes (PartNumber-1)*PartSize on.
+type DirectPart struct {
+	PartNumber int    `json:"partNumber"`
+	URL        string `json:"url"`
+}
+
+// CompletedPart is one entry of the "parts" array that POST
+// /upload/{uploadID}/complete takes for a direct upload.
+type CompletedPart struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"etag"` // the ETag header of the part's PUT response
+}
+
+// directUploader returns the store's DirectUploader, answering 501 when
+// the backend has none (a custom store given to NewWithStorage).
+func (s *Server) directUploader(w http.ResponseWriter) (storage.DirectUploader, bool) {
+	du, ok := storage.DirectUploads(s.store)
+	if !ok {
+		respondError(w, http.StatusNotImplemented, CodeInvalidRequest, "storage backend does not support direct uploads")
+	}
+	return du, ok
+}
+
+// directHandler starts a direct upload of fileName and the required
+// fileSize, validated like POST /upload/init, with the optional
+// retention. The server picks the part size: CHUNK_SIZE, raised to the
+// bucket's 5 MiB minimum and to fit in 10000 parts.
+func (s *Server) directHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+	du, ok := s.directUploader(w)
+	if !ok {
+		return
+	}
+	if r.FormValue("fileSize") == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "missing fileSize")
+		return
+	}
+	fileName, _, fileSize, uerr := s.parseFileParams(r.FormValue("fileName"), "1", r.FormValue("fileSize"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if q := s.checkQuota(r, fileName, fileSize); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+	retention, uerr := s.requestedRetention(r.FormValue("retention"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	partSize, totalParts := storage.MultipartLayout(fileSize, s.cfg.chunkSize())
+	multipartID, err := du.CreateMultipart(fileName)
+	if err != nil {
+		respondError(w, http.StatusBadGateway, CodeServerError, "cannot start multipart upload: %v", err)
+		return
+	}
+	sess := &session.Session{FileName: fileName, TotalChunks: totalParts, FileSize: fileSize, Retention: retention,
+		Direct: multipartID, PartSize: partSize}
+	if uerr := s.startSession(r, sess); uerr != nil {
+		s.abortDirect(fileName, multipartID)
+		uerr.respond(w)
+		return
+	}
+	tagUpload(w, sess.ID).Info("direct upload created", "file", fileName, "parts", totalParts, "part_size", partSize, "size", fileSize)
+	s.respondDirectUpload(w, du, sess)
+}
+
+// partsHandler re-issues the part URLs of a direct upload, e.g. when the
+// first ones expired before every part was sent. It also marks the
+// upload as active for STALE_UPLOAD_TTL.
+func (s *Server) partsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	sess, uerr := s.lookupSession(r.PathValue("uploadID"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	tagUpload(w, sess.ID)
+	meta, err := s.store.LoadMeta(sess.ID)
+	if err == nil && !s.canManage(r, UploadInfo{Owner: meta.Owner}) {
+		// Don't reveal other users' uploads.
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown uploadID %s", sess.ID)
+		return
+	}
+	if sess.Direct == "" {
+		respondError(w, http.StatusBadRequest, CodeUploadMismatch, "upload %s is not direct: send its chunks to POST /upload", sess.ID)
+		return
+	}
+	du, ok := s.directUploader(w)
+	if !ok {
+		return
+	}
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.sessionAborted(w, sess) {
+		return
+	}
+	if err == nil {
+		if err := s.store.SaveMeta(sess.ID, meta); err != nil {
+			logFor(w).Warn("cannot touch upload metadata", "error", err)
+		}
+	}
+	s.respondDirectUpload(w, du, sess)
+}
+
+// respondDirectUpload describes sess with freshly signed part URLs.
+func (s *Server) respondDirectUpload(w http.ResponseWriter, du storage.DirectUploader, sess *session.Session) {
+	ttl := s.cfg.DirectUploadURLTTL
+	resp := DirectUpload{
+		UploadID:     sess.ID,
+		PartSize:     sess.PartSize,
+		TotalParts:   sess.TotalChunks,
+		Parts:        make([]DirectPart, sess.TotalChunks),
+		URLsExpireAt: s.now().Add(ttl).Truncate(time.Second).UTC(),
+		ExpiresAt:    s.sessionExpiry(sess),
+	}
+	for i := range resp.Parts {
+		u, err := du.PresignPart(sess.FileName, sess.Direct, i+1, ttl)
+		if err != nil {
+			respondError(w, http.StatusBadGateway, CodeServerError, "cannot sign part URLs: %v", err)
+			return
+		}
+		resp.Parts[i] = DirectPart{PartNumber: i + 1, URL: u}
+	}
+	if sess.Retention > 0 {
+		resp.Retention = sess.Retention.String()
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// completeDirect finishes a direct upload for completeHandler: the JSON
+// body lists the ETag of every part, the bucket joins them into the
+// completed file, and from there on it is handled like any other.
+func (s *Server) completeDirect(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	var body struct {
+		Parts []CompletedPart `json:"parts"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxCompleteBody)).Decode(&body); err != nil {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid JSON body: %v", err)
+		return
+	}
+	parts, uerr := checkParts(body.Parts, sess.TotalChunks)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	du, ok := s.directUploader(w)
+	if !ok {
+		return
+	}
+
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.sessionAborted(w, sess) {
+		return
+	}
+
+	meta, _ := s.store.LoadMeta(sess.ID)
+	s.publish(sess.ID, UploadEvent{Type: EventAssembling})
+	finalPath, err := du.CompleteMultipart(sess.FileName, sess.Direct, parts)
+	if errors.Is(err, storage.ErrInvalidParts) {
+		// The upload is still open: the client can PUT the parts again.
+		respondError(w, http.StatusBadRequest, CodeIncompleteUpload, "object store refused the parts: %v", err)
+		return
+	}
+	if err != nil {
+		s.publish(sess.ID, UploadEvent{Type: EventFailed, FileName: sess.FileName, Code: CodeFinalizeFailed, Error: err.Error()})
+		respondError(w, http.StatusInternalServerError, CodeFinalizeFailed, "cannot complete multipart upload: %v", err)
+		return
+	}
+	if err := s.store.RemovePart(sess.ID); err != nil {
+		logFor(w).Warn("cannot remove upload metadata", "error", err)
+	}
+	s.received.Forget(sess.ID)
+	s.sessions.Remove(sess.ID)
+
+	if size, _, err := s.store.Stat(sess.FileName); err == nil && size != sess.FileSize {
+		if err := s.store.Remove(sess.FileName); err != nil {
+			logFor(w).Error("cannot remove mis-sized file", "file", sess.FileName, "error", err)
+		}
+		s.recordAbort(sess.ID)
+		s.publish(sess.ID, UploadEvent{Type: EventFailed, FileName: sess.FileName, Code: CodeFileSizeMismatch})
+		respondError(w, http.StatusBadRequest, CodeFileSizeMismatch, "parts add up to %d bytes, not the declared fileSize %d", size, sess.FileSize)
+		return
+	}
+	s.finalized(sess.ID, sess.FileName, meta)
+	logFor(w).Info("direct upload completed", "path", finalPath, "parts", len(parts))
+
+	resp, uerr := s.completedResponse(r, sess.ID, sess.FileName, finalPath)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	respondSuccess(w, resp)
+}
+
+// checkParts sorts the parts a client reports and checks that they are
+// exactly 1..total, each with an ETag.
+func checkParts(reported []CompletedPart, total int) ([]storage.ObjectPart, *uploadError) {
+	etags := make([]string, total)
+	for _, p := range reported {
+		if p.PartNumber < 1 || p.PartNumber > total || p.ETag == "" || etags[p.PartNumber-1] != "" {
+			return nil, &uploadError{http.StatusBadRequest, CodeInvalidRequest,
+				fmt.Sprintf("invalid part %d: want partNumbers 1 to %d once each, with their etag", p.PartNumber, total)}
+		}
+		etags[p.PartNumber-1] = p.ETag
+	}
+	var missing []int
+	parts := make([]storage.ObjectPart, total)
+	for i, etag := range etags {
+		if etag == "" {
+			missing = append(missing, i+1)
+		}
+		parts[i] = storage.ObjectPart{PartNumber: i + 1, ETag: etag}
+	}
+	if len(missing) > 0 {
+		return nil, &uploadError{http.StatusBadRequest, CodeIncompleteUpload,
+			fmt.Sprintf("incomplete: received %d of %d parts, missing %v", total-len(missing), total, missing)}
+	}
+	return parts, nil
+}
+
+// abortDirect discards the bucket's multipart upload multipartID of the
+// file name, if there is one; its parts would otherwise be billed until a
+// lifecycle rule removes them.
+func (s *Server) abortDirect(name, multipartID string) {
+	if multipartID == "" {
+		return
+	}
+	du, ok := storage.DirectUploads(s.store)
+	if !ok {
+		return
+	}
+	if err := du.AbortMultipart(name, multipartID); err != nil {
+		slog.Warn("cannot abort multipart upload", "file", name, "error", err)
+	}
+}
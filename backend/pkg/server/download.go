@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// GET /files/{name} (serve completed uploads)
+// ---------------------------------------------------------------------
+func (s *Server) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := r.PathValue("name")
+	fileName, uerr := s.cleanFileName(fileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	// Hold the per-file lock so a concurrent upload can't swap the file
+	// out from under us mid-response.
+	lock := s.locks.Get(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+	if v := r.URL.Query().Get("version"); v != "" && s.cfg.Versioning && s.serveVersion(w, r, fileName, v) {
+		return
+	}
+
+	// Only completed files are served; a lone .part is still uploading.
+	size, modTime, err := s.store.Stat(fileName)
+	if err == nil && s.isExpired(fileName) {
+		err = fs.ErrNotExist // past its retention, not yet reaped
+	}
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "file %q not found", fileName)
+		return
+	}
+	if s.isCompressed(fileName) {
+		s.serveDecompressed(w, r, fileName, size, modTime)
+		return
+	}
+	f, err := s.store.Open(fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open %s: %v", fileName, err)
+		return
+	}
+	defer f.Close()
+
+	logFor(w).Info("download", "file", fileName, "range", r.Header.Get("Range"))
+	setDownloadHeaders(w, r, fileName, s.storedType(fileName), size, modTime)
+	s.setManifestHeader(w, fileName)
+	s.setVersionHeader(w, fileName)
+	http.ServeContent(w, r, fileName, modTime, f)
+}
+
+// setDownloadHeaders adds the ETag (from the stored size and modification
+// time, so it changes whenever the file is replaced), the Content-Type
+// sniffed at upload and a Content-Disposition: attachment unless
+// ?inline=true. http.ServeContent then answers If-None-Match, If-Range and
+// Range, and for files stored without a recorded type sets Content-Type
+// from the extension or by sniffing the content.
+func setDownloadHeaders(w http.ResponseWriter, r *http.Request, fileName, contentType string, size int64, modTime time.Time) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size))
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	disposition := "attachment"
+	if inline, _ := strconv.ParseBool(r.URL.Query().Get("inline")); inline {
+		disposition = "inline"
+	}
+	// FormatMediaType switches to RFC 2231 filename*= for non-ASCII names.
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": fileName}); v != "" {
+		w.Header().Set("Content-Disposition", v)
+	} else {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+}
+
+// serveDecompressed serves fileName, gzipped at rest, as the original
+// file, Range requests included. The ETag comes from the stored gzip
+// stream, which changes whenever the file is replaced.
+func (s *Server) serveDecompressed(w http.ResponseWriter, r *http.Request, fileName string, gzSize int64, modTime time.Time) {
+	f, _, err := s.openStored(fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "%v", err)
+		return
+	}
+	defer f.Close()
+
+	logFor(w).Info("download", "file", fileName, "decompress", true, "range", r.Header.Get("Range"))
+	setDownloadHeaders(w, r, fileName, s.storedType(fileName), gzSize, modTime)
+	s.setManifestHeader(w, fileName)
+	s.setVersionHeader(w, fileName)
+	http.ServeContent(w, r, fileName, modTime, f)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ---------------------------------------------------------------------
+// Compressed chunk transport: a POST /upload or raw PUT body sent with
+// Content-Encoding gzip or zstd is decompressed as it is read, so text
+// such as CSVs and logs crosses slow links in a fraction of the time.
+// Everything after (sizes, checksums, the stored file) sees the raw bytes.
+// ---------------------------------------------------------------------
+
+// Content-Encodings a chunk body may be sent with.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// zstdMaxWindow is the largest zstd window a body may ask for, which is
+// about the memory decoding it takes: 8 MiB, the most RFC 8878 expects
+// every decoder to support. A frame asking for more is refused.
+const zstdMaxWindow = 8 << 20
+
+// chunkEncodings are the Content-Encodings accepted, for GET
+// /upload/config and the Accept-Encoding of a 415.
+var chunkEncodings = []string{EncodingGzip, EncodingZstd}
+
+// chunkEncoding returns the Content-Encoding of r's body, "" for none.
+func chunkEncoding(r *http.Request) (string, *uploadError) {
+	enc := strings.ToLower(strings.TrimSpace(strings.Join(r.Header.Values("Content-Encoding"), ",")))
+	switch enc {
+	case "", "identity":
+		return "", nil
+	case EncodingGzip, "x-gzip":
+		return EncodingGzip, nil
+	case EncodingZstd:
+		return EncodingZstd, nil
+	}
+	return "", &uploadError{http.StatusUnsupportedMediaType, CodeUnsupportedEncoding,
+		fmt.Sprintf("Content-Encoding %q is not supported: use %s", enc, strings.Join(chunkEncodings, " or "))}
+}
+
+// encodedBody is a request body being decompressed. It counts the bytes
+// read off the wire and the bytes they decompressed to.
+type encodedBody struct {
+	encoding string
+	body     io.ReadCloser // as sent
+	wire     int64
+	wireErr  error // the last error reading body
+	dec      io.Reader
+	close    func() // releases dec, if it needs to be
+	raw      int64
+}
+
+// decodeError is a compressed body that does not decompress: damaged in
+// transit, or not in its Content-Encoding.
+type decodeError struct {
+	encoding string
+	err      error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("cannot decompress %s body: %v", e.encoding, e.err)
+}
+
+func (e *decodeError) Unwrap() error { return e.err }
+
+// wireReader counts what the decompressor reads of the body.
+type wireReader struct{ e *encodedBody }
+
+func (w wireReader) Read(p []byte) (int, error) {
+	n, err := w.e.body.Read(p)
+	w.e.wire += int64(n)
+	if err != nil {
+		w.e.wireErr = err
+	}
+	return n, err
+}
+
+func (e *encodedBody) Read(p []byte) (int, error) {
+	n, err := e.dec.Read(p)
+	e.raw += int64(n)
+	if err != nil && err != io.EOF && !errors.Is(err, e.wireErr) {
+		err = &decodeError{e.encoding, err}
+	}
+	return n, err
+}
+
+func (e *encodedBody) Close() error {
+	if e.close != nil {
+		e.close()
+	}
+	return e.body.Close()
+}
+
+// decodeBody replaces a compressed r.Body with its decompressed bytes,
+// failing with *http.MaxBytesError past limit of them (0: no limit). It
+// returns nil for a body sent as is. Pass the result to recordEncoded
+// once the request is done.
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, limit int64) (*encodedBody, *uploadError) {
+	enc, uerr := chunkEncoding(r)
+	if uerr != nil {
+		w.Header().Set("Accept-Encoding", strings.Join(chunkEncodings, ", "))
+		return nil, uerr
+	}
+	if enc == "" {
+		return nil, nil
+	}
+	e := &encodedBody{encoding: enc, body: r.Body}
+	var err error
+	switch enc {
+	case EncodingGzip:
+		e.dec, err = gzip.NewReader(wireReader{e})
+	case EncodingZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(wireReader{e}, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdMaxWindow), zstd.WithDecoderMaxMemory(zstdMaxWindow))
+		if err == nil {
+			e.dec, e.close = zr, zr.Close
+		}
+	}
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			return nil, &uploadError{http.StatusRequestEntityTooLarge, CodeChunkTooLarge, fmt.Sprintf("request body over %d bytes", tooBig.Limit)}
+		}
+		return nil, &uploadError{http.StatusBadRequest, CodeInvalidEncoding, (&decodeError{enc, err}).Error()}
+	}
+	r.Body = e
+	if limit > 0 {
+		r.Body = http.MaxBytesReader(w, e, limit)
+	}
+	// The length sent is of the compressed body.
+	r.ContentLength = -1
+	return e, nil
+}
+
+// decodeFailure is the 400 INVALID_ENCODING for a body that stopped
+// decompressing part way, or nil for any other error.
+func decodeFailure(err error) *uploadError {
+	var bad *decodeError
+	if !errors.As(err, &bad) {
+		return nil
+	}
+	return &uploadError{http.StatusBadRequest, CodeInvalidEncoding, bad.Error()}
+}
+
+// recordEncoded logs and counts the bytes of a decompressed body.
+func (s *Server) recordEncoded(w http.ResponseWriter, e *encodedBody) {
+	if e == nil {
+		return
+	}
+	logFor(w).Info("compressed body", "encoding", e.encoding, "wire_bytes", e.wire, "raw_bytes", e.raw)
+	s.metrics.bodyDecoded(e.encoding, e.wire, e.raw)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// GET /upload/{uploadID}/events: live progress as Server-Sent Events
+// ---------------------------------------------------------------------
+
+// Event types. A stream starts with a status event and ends after
+// complete or aborted.
+const (
+	EventStatus     = "status"     // progress so far, sent on connect
+	EventChunk      = "chunk"      // a chunk (or tus PATCH) was stored
+	EventAssembling = "assembling" // every byte is in; verifying and moving into place
+	EventFailed     = "failed"     // verification or finalize failed; the upload can be retried
+	EventComplete   = "complete"
+	EventAborted    = "aborted" // discarded: expired, deleted or cleaned up
+	EventPaused     = "paused"  // POST /upload/{uploadID}/pause; chunks are refused
+	EventResumed    = "resumed" // POST /upload/{uploadID}/resume
+)
+
+const (
+	EventsHeartbeat = 15 * time.Second // comment line keeping proxies from closing idle streams
+	EventsBuffer    = 64               // per watcher; a watcher that falls further behind misses events
+)
+
+// UploadEvent is the data of one event.
+type UploadEvent struct {
+	Type        string    `json:"type"`
+	UploadID    string    `json:"uploadID"`
+	FileName    string    `json:"fileName,omitempty"`
+	Index       *int      `json:"index,omitempty"`       // chunk events, except tus
+	Bytes       int64     `json:"bytes,omitempty"`       // size of this chunk
+	Received    int64     `json:"received,omitempty"`    // bytes received so far
+	TotalChunks int       `json:"totalChunks,omitempty"` // 0 for tus
+	FileSize    int64     `json:"fileSize,omitempty"`
+	Path        string    `json:"path,omitempty"` // complete
+	Size        int64     `json:"size,omitempty"` // complete
+	DuplicateOf string    `json:"duplicateOf,omitempty"`
+	Code        string    `json:"code,omitempty"` // failed
+	Error       string    `json:"error,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// eventHub fans events out to the watchers of each upload. Publishing never
+// blocks an upload: a watcher whose buffer is full misses the event.
+type eventHub struct {
+	sync.Mutex
+	watchers map[string]map[chan UploadEvent]struct{}
+	closed   bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{watchers: make(map[string]map[chan UploadEvent]struct{})}
+}
+
+// subscribe returns a channel of key's events and a func to stop. The
+// channel is closed when the hub is.
+func (h *eventHub) subscribe(key string) (<-chan UploadEvent, func()) {
+	h.Lock()
+	defer h.Unlock()
+	ch := make(chan UploadEvent, EventsBuffer)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if h.watchers[key] == nil {
+		h.watchers[key] = make(map[chan UploadEvent]struct{})
+	}
+	h.watchers[key][ch] = struct{}{}
+	return ch, func() {
+		h.Lock()
+		defer h.Unlock()
+		delete(h.watchers[key], ch)
+		if len(h.watchers[key]) == 0 {
+			delete(h.watchers, key)
+		}
+	}
+}
+
+func (h *eventHub) publish(key string, e UploadEvent) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.watchers[key] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// close ends every stream, so Shutdown is not held up by watchers.
+func (h *eventHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	for _, chans := range h.watchers {
+		for ch := range chans {
+			close(ch)
+		}
+	}
+	h.watchers = make(map[string]map[chan UploadEvent]struct{})
+}
+
+// publish sends e to the watchers of the upload under key. Failures and
+// discarded uploads also go to the webhooks; completions are sent by
+// notifyUploadComplete, with the file's hash.
+func (s *Server) publish(key string, e UploadEvent) {
+	e.UploadID = key
+	e.Time = s.now().UTC()
+	s.events.publish(key, e)
+	switch {
+	case e.Type == EventFailed, e.Type == EventAborted && e.Code != "": // rejected by the scanner
+		s.notify(WebhookPayload{Event: WebhookFailed, UploadID: key, FileName: e.FileName, Code: e.Code, Error: e.Error})
+	case e.Type == EventAborted:
+		s.notify(WebhookPayload{Event: WebhookDeleted, UploadID: key, FileName: e.FileName})
+	}
+}
+
+// publishChunk reports chunk index of key, after it was marked received.
+func (s *Server) publishChunk(key string, index int, size int64, totalChunks int) {
+	s.publish(key, UploadEvent{Type: EventChunk, Index: &index, Bytes: size,
+		Received: s.received.Bytes(key), TotalChunks: totalChunks})
+}
+
+// eventsHandler streams the events of an upload session (from POST
+// /upload/init or tus) until it completes or is aborted.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	id := r.PathValue("uploadID")
+	if id == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "missing uploadID")
+		return
+	}
+	sess, uerr := s.lookupSession(id)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if !s.canSee(r, sess) {
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown uploadID %s", sess.ID)
+		return
+	}
+	lg := tagUpload(w, sess.ID)
+
+	// Subscribe before taking the snapshot so nothing falls in between.
+	events, stop := s.events.subscribe(sess.ID)
+	defer stop()
+	info := s.partInfo(storage.PartInfo{Key: sess.ID})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: don't buffer the stream
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	send := func(e UploadEvent) bool {
+		data, err := json.Marshal(e)
+		if err == nil {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil
+	}
+	lg.Info("events stream opened")
+	if !send(UploadEvent{Type: EventStatus, UploadID: sess.ID, FileName: sess.FileName, Received: info.Size,
+		TotalChunks: sess.TotalChunks, FileSize: sess.FileSize, Time: s.now().UTC()}) {
+		return
+	}
+
+	heartbeat := time.NewTicker(EventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			lg.Info("events stream closed by client")
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return // shutting down
+			}
+			if e.FileName == "" {
+				e.FileName = sess.FileName
+			}
+			if !send(e) {
+				return
+			}
+			if e.Type == EventComplete || e.Type == EventAborted {
+				lg.Info("events stream finished", "event", e.Type)
+				return
+			}
+		}
+	}
+}
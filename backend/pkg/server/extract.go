@@ -0,0 +1,239 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------
+// Archive extraction: a zip uploaded with extract=true at POST
+// /upload/init is unpacked next to it once it completes, every file
+// stored as dir__path like a batch file
+// ---------------------------------------------------------------------
+
+// Defaults for EXTRACT_MAX_FILES and EXTRACT_MAX_SIZE.
+const (
+	DefaultExtractMaxFiles = 1000
+	DefaultExtractMaxSize  = 1 << 30
+)
+
+// ExtractedFile is one file unpacked from an uploaded archive.
+type ExtractedFile struct {
+	Path        string `json:"path"`     // in the archive, "/"-separated
+	FileName    string `json:"fileName"` // the name it is stored under
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// requestedExtract reads the extract and extractTo fields of POST
+// /upload/init: the directory the archive fileName is to be unpacked
+// under, by default its name without the extension; "" when extract is
+// not set.
+func (s *Server) requestedExtract(r *http.Request, fileName string) (string, *uploadError) {
+	v := r.FormValue("extract")
+	if v == "" {
+		return "", nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return "", &uploadError{http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("invalid extract %q: want true or false", v)}
+	}
+	if !on {
+		return "", nil
+	}
+	dir := r.FormValue("extractTo")
+	if dir == "" {
+		dir = cmp.Or(strings.TrimSuffix(fileName, path.Ext(fileName)), fileName)
+	}
+	return s.cleanFileName(dir)
+}
+
+// archivePath checks the name of a zip entry and returns it cleaned. A
+// name that is absolute or climbs out with .. (zip-slip) is refused
+// rather than trimmed: the archive was not made for unpacking here.
+func archivePath(name string) (string, error) {
+	p := strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(p) || (len(p) > 1 && p[1] == ':') {
+		return "", fmt.Errorf("%q is an absolute path", name)
+	}
+	var elems []string
+	for _, e := range strings.Split(p, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			return "", fmt.Errorf("%q leads out of the archive", name)
+		default:
+			elems = append(elems, e)
+		}
+	}
+	if len(elems) == 0 {
+		return "", fmt.Errorf("%q names no file", name)
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// extraction is a checked zip entry and the name it is stored under.
+type extraction struct {
+	file *zip.File
+	ExtractedFile
+}
+
+// planExtraction checks every regular file of zr against the limits and
+// the file name rules before anything is written. Directories and
+// symlinks are skipped.
+func (s *Server) planExtraction(zr *zip.Reader, dir string) ([]extraction, int64, *uploadError) {
+	invalid := func(format string, args ...any) *uploadError {
+		return &uploadError{http.StatusUnprocessableEntity, CodeInvalidArchive, fmt.Sprintf(format, args...)}
+	}
+	var plan []extraction
+	var total uint64
+	byName := make(map[string]string)
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		p, err := archivePath(f.Name)
+		if err != nil {
+			return nil, 0, invalid("archive entry %v", err)
+		}
+		_, name, uerr := s.batchFileName(dir + "/" + p)
+		if uerr != nil {
+			return nil, 0, invalid("archive entry %q: %s", f.Name, uerr.msg)
+		}
+		if byName[name] != "" {
+			return nil, 0, invalid("archive entries %q and %q would both be stored as %s", byName[name], p, name)
+		}
+		byName[name] = p
+		if s.cfg.ExtractMaxFiles > 0 && len(plan) >= s.cfg.ExtractMaxFiles {
+			return nil, 0, invalid("archive holds more than %d files (EXTRACT_MAX_FILES)", s.cfg.ExtractMaxFiles)
+		}
+		total += f.UncompressedSize64
+		if s.cfg.ExtractMaxSize > 0 && total > uint64(s.cfg.ExtractMaxSize) {
+			return nil, 0, invalid("archive unpacks to more than %d bytes (EXTRACT_MAX_SIZE)", s.cfg.ExtractMaxSize)
+		}
+		plan = append(plan, extraction{f, ExtractedFile{Path: p, FileName: name, Size: int64(f.UncompressedSize64)}})
+	}
+	return plan, int64(total), nil
+}
+
+// extractArchive unpacks the completed zip fileName under dir and
+// describes the files stored. They get the archive's expiry and count
+// against the uploader's quota. On failure nothing it stored is kept.
+func (s *Server) extractArchive(r *http.Request, fileName, dir string) ([]ExtractedFile, *uploadError) {
+	size, _, err := s.store.Stat(fileName)
+	if err != nil {
+		return nil, &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot open archive: %v", err)}
+	}
+	f, err := s.store.Open(fileName)
+	if err != nil {
+		return nil, &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot open archive: %v", err)}
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(readerAt(f), size)
+	if err != nil {
+		return nil, &uploadError{http.StatusUnprocessableEntity, CodeInvalidArchive, fmt.Sprintf("%s is not a zip archive: %v", fileName, err)}
+	}
+	plan, total, uerr := s.planExtraction(zr, dir)
+	if uerr != nil {
+		return nil, uerr
+	}
+	if q := s.checkQuota(r, dir, total); q != nil {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, CodeQuotaExceeded, q.Error}
+	}
+
+	expiry, _ := s.expiries.get(fileName)
+	files := make([]ExtractedFile, 0, len(plan))
+	for i := range plan {
+		e := &plan[i]
+		if uerr = s.extractFile(e); uerr != nil {
+			for _, done := range files {
+				if err := s.store.Remove(done.FileName); err != nil {
+					logCtx(r.Context()).Warn("cannot remove extracted file", "file", done.FileName, "error", err)
+				}
+				s.recordType(done.FileName, "")
+			}
+			if err := s.store.Remove(e.FileName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				logCtx(r.Context()).Warn("cannot remove extracted file", "file", e.FileName, "error", err)
+			}
+			return nil, uerr
+		}
+		if err := s.expiries.set(e.FileName, expiry); err != nil {
+			logCtx(r.Context()).Warn("cannot record expiry", "file", e.FileName, "error", err)
+		}
+		s.recordType(e.FileName, e.ContentType)
+		s.chargeQuota(r, e.FileName, e.Size)
+		files = append(files, e.ExtractedFile)
+	}
+	logCtx(r.Context()).Info("archive extracted", "file", fileName, "dir", dir, "files", len(files), "size", total)
+	return files, nil
+}
+
+// extractFile stores one planned entry, checking its sniffed type like an
+// upload's and that it unpacks to the size its header declares.
+func (s *Server) extractFile(e *extraction) *uploadError {
+	rc, err := e.file.Open()
+	if err != nil {
+		return &uploadError{http.StatusUnprocessableEntity, CodeInvalidArchive, fmt.Sprintf("archive entry %q: %v", e.Path, err)}
+	}
+	defer rc.Close()
+	// archive/zip fails an entry that runs past its declared size, so
+	// EXTRACT_MAX_SIZE holds for the bytes actually written.
+	br := bufio.NewReaderSize(rc, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return &uploadError{http.StatusUnprocessableEntity, CodeInvalidArchive, fmt.Sprintf("archive entry %q: %v", e.Path, err)}
+	}
+	e.ContentType = detectContentType(e.FileName, head)
+	if uerr := s.checkType(e.FileName, e.ContentType); uerr != nil {
+		return uerr
+	}
+	w, err := s.store.Create(e.FileName)
+	if err != nil {
+		return &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot store %s: %v", e.FileName, err)}
+	}
+	n, err := io.Copy(w, br)
+	if cerr := w.Close(); err == nil && cerr != nil {
+		return &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot store %s: %v", e.FileName, cerr)}
+	}
+	if err != nil || n != e.Size {
+		return &uploadError{http.StatusUnprocessableEntity, CodeInvalidArchive, fmt.Sprintf("archive entry %q: %d of %d bytes: %v", e.Path, n, e.Size, err)}
+	}
+	return nil
+}
+
+// readerAt gives archive/zip the random access it needs over a stored
+// file: directly for a local file, by seeking otherwise.
+func readerAt(f io.ReadSeeker) io.ReaderAt {
+	if ra, ok := f.(io.ReaderAt); ok {
+		return ra
+	}
+	return &seekReaderAt{r: f}
+}
+
+type seekReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
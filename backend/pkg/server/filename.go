@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ---------------------------------------------------------------------
+// File name sanitization (FILENAME_POLICY)
+// ---------------------------------------------------------------------
+const (
+	FileNamePolicyUnicode = "unicode" // any printable character (default)
+	FileNamePolicyASCII   = "ascii"   // printable ASCII except <>:"|?*
+	FileNamePolicyStrict  = "strict"  // A-Z a-z 0-9 . _ - only, no leading . or -
+
+	MaxFileNameBytes = 255 // the usual filesystem limit for one path element
+)
+
+// normalizeFileName makes equivalent spellings of a name identical:
+// invisible format characters (zero-width spaces, bidi overrides, BOM)
+// are dropped, Unicode spaces become ASCII spaces, the name is put in
+// Unicode normal form C and surrounding spaces are trimmed.
+func normalizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.Cf, r):
+			return -1
+		case unicode.Is(unicode.Zs, r):
+			return ' '
+		}
+		return r
+	}, name)
+	return strings.TrimSpace(norm.NFC.String(name))
+}
+
+// isServerState reports whether name is one of the tables the server or
+// its storage keeps in UploadDir, or a temp or lock file of one.
+func isServerState(name string) bool {
+	switch storage.TableFile(name) {
+	case QuotaTable, HashTable, ExpiryTable, TypeTable, CompressTable, ManifestTable, HookTable, VersionTable, Quarantine, ChunkStore:
+		return true
+	}
+	return storage.IsState(name)
+}
+
+// sanitizeFileName normalizes name and checks it against policy. The
+// result is safe to join onto UploadDir.
+func sanitizeFileName(name, policy string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("not valid UTF-8")
+	}
+	clean := normalizeFileName(name)
+	switch {
+	case clean == "":
+		return "", fmt.Errorf("empty")
+	case clean == "." || clean == "..":
+		return "", fmt.Errorf("%q is not a file name", clean)
+	case strings.ContainsAny(clean, `/\`):
+		return "", fmt.Errorf("contains a path separator")
+	case len(clean) > MaxFileNameBytes:
+		return "", fmt.Errorf("longer than %d bytes", MaxFileNameBytes)
+	}
+	if _, _, ok := storage.PartKey(clean); ok {
+		return "", fmt.Errorf("reserved for in-progress uploads")
+	}
+	if isServerState(clean) {
+		return "", fmt.Errorf("reserved for server state")
+	}
+	if isThumbnail(clean) {
+		return "", fmt.Errorf("reserved for thumbnails")
+	}
+	if isTranscoded(clean) {
+		return "", fmt.Errorf("reserved for transcoded videos")
+	}
+	if isVersion(clean) {
+		return "", fmt.Errorf("reserved for file versions")
+	}
+	for _, r := range clean {
+		if !unicode.IsPrint(r) {
+			return "", fmt.Errorf("contains control character %U", r)
+		}
+		switch policy {
+		case FileNamePolicyASCII:
+			if r > unicode.MaxASCII || strings.ContainsRune(`<>:"|?*`, r) {
+				return "", fmt.Errorf("character %q not allowed by the %s policy", r, policy)
+			}
+		case FileNamePolicyStrict:
+			if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-", r)) {
+				return "", fmt.Errorf("character %q not allowed by the %s policy", r, policy)
+			}
+		}
+	}
+	if policy == FileNamePolicyStrict && (clean[0] == '.' || clean[0] == '-') {
+		return "", fmt.Errorf("may not start with %q under the %s policy", clean[0], policy)
+	}
+	return clean, nil
+}
+
+// cleanFileName is sanitizeFileName with the configured policy, reported
+// as a 400 INVALID_FILE_NAME.
+func (s *Server) cleanFileName(name string) (string, *uploadError) {
+	clean, err := sanitizeFileName(name, s.cfg.FileNamePolicy)
+	if err != nil {
+		return "", &uploadError{http.StatusBadRequest, CodeInvalidFileName, fmt.Sprintf("invalid fileName %q: %v", name, err)}
+	}
+	return clean, nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// ---------------------------------------------------------------------
+// Free-space watermark (MIN_FREE_SPACE): while the part directory has
+// less free space, new uploads are refused up front with 507 STORAGE_FULL
+// instead of failing half way with a write error. Uploads already
+// started may finish.
+// ---------------------------------------------------------------------
+
+// StorageFullRetryAfter is the Retry-After of a 507 STORAGE_FULL, in
+// seconds.
+const StorageFullRetryAfter = 300
+
+// spaceWatch remembers whether free space was below the watermark when
+// last sampled, so crossing it is reported once, not on every request.
+type spaceWatch struct {
+	low atomic.Bool
+}
+
+// lowOnSpace samples the free space and reports whether it is below
+// MIN_FREE_SPACE. Dropping below is logged and sent as a storage.low
+// webhook; recovering is logged. Free space that cannot be measured
+// never counts as low.
+func (s *Server) lowOnSpace() (free int64, low bool) {
+	if s.cfg.MinFreeSpace <= 0 {
+		return -1, false
+	}
+	free, err := s.store.Available()
+	if err != nil {
+		slog.Warn("cannot check free space", "error", err)
+		return -1, false
+	}
+	low = free >= 0 && free < s.cfg.MinFreeSpace
+	if s.space.low.Swap(low) == low {
+		return free, low
+	}
+	if low {
+		slog.Warn("free space below MIN_FREE_SPACE: refusing new uploads", "free_bytes", free, "min_free_bytes", s.cfg.MinFreeSpace)
+		s.notify(WebhookPayload{Event: WebhookLowSpace, FreeBytes: free,
+			Error: fmt.Sprintf("%d bytes free, below MIN_FREE_SPACE %d: new uploads are refused", free, s.cfg.MinFreeSpace)})
+	} else {
+		slog.Info("free space back above MIN_FREE_SPACE: accepting new uploads", "free_bytes", free, "min_free_bytes", s.cfg.MinFreeSpace)
+	}
+	return free, low
+}
+
+// checkFreeSpace answers 507 STORAGE_FULL, with a Retry-After, when free
+// space is below MIN_FREE_SPACE. Call it where an upload starts.
+func (s *Server) checkFreeSpace(w http.ResponseWriter) bool {
+	free, low := s.lowOnSpace()
+	if !low {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(StorageFullRetryAfter))
+	respondError(w, http.StatusInsufficientStorage, CodeStorageFull,
+		"storage full: %d bytes free, new uploads need at least %d; retry later", free, s.cfg.MinFreeSpace)
+	return false
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Property: however a file is split, ordered and retried, the completed
+// file equals the original; requests that would corrupt it are refused.
+// Each mode is a fuzz target fed random (data, seed) pairs, where the
+// seed drives the split and the script of requests a flaky client sends,
+// and a property test that runs them over many seeds on every go test.
+
+// reassembly is one upload of data under test against a fresh server.
+type reassembly struct {
+	t      *testing.T
+	srv    *Server
+	rng    *rand.Rand
+	data   []byte
+	chunks [][]byte
+	id     string // uploadID from POST /upload/init
+}
+
+// chunkReply is the body of an upload endpoint, success or error.
+type chunkReply struct {
+	Code      string `json:"code"`
+	Done      bool   `json:"done"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// newReassembly splits data into chunks of random sizes (with equal, of
+// one size but the last) and starts an upload session for it.
+func newReassembly(t *testing.T, data []byte, seed uint64, equal bool) *reassembly {
+	t.Helper()
+	rng := rand.New(rand.NewPCG(seed, seed>>32))
+	ra := &reassembly{t: t, srv: newTestServer(t), rng: rng, data: data}
+
+	total := 1 + rng.IntN(min(len(data), 16))
+	if equal {
+		size := (len(data) + total - 1) / total
+		for rest := data; len(rest) > 0; rest = rest[min(size, len(rest)):] {
+			ra.chunks = append(ra.chunks, rest[:min(size, len(rest))])
+		}
+	} else {
+		cuts := []int{0, len(data)}
+		for range total - 1 {
+			cuts = append(cuts, 1+rng.IntN(len(data)-1))
+		}
+		slices.Sort(cuts)
+		cuts = slices.Compact(cuts)
+		for i := range len(cuts) - 1 {
+			ra.chunks = append(ra.chunks, data[cuts[i]:cuts[i+1]])
+		}
+	}
+
+	form := url.Values{"fileName": {"fuzz.bin"}, "totalChunks": {strconv.Itoa(len(ra.chunks))}, "fileSize": {strconv.Itoa(len(data))}}
+	req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	ra.srv.ServeHTTP(rec, req)
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	ra.id = init.UploadID
+	return ra
+}
+
+// send POSTs chunk as index with the extra form fields.
+func (ra *reassembly) send(index int, chunk []byte, extra url.Values) (int, chunkReply) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("uploadID", ra.id)
+	mw.WriteField("index", strconv.Itoa(index))
+	for k, v := range extra {
+		mw.WriteField(k, v[0])
+	}
+	fw, _ := mw.CreateFormFile("chunk", "blob")
+	fw.Write(chunk)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	ra.srv.ServeHTTP(rec, req)
+	var out chunkReply
+	json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec.Code, out
+}
+
+// pick returns a random chunk index.
+func (ra *reassembly) pick() int { return ra.rng.IntN(len(ra.chunks)) }
+
+// steps returns how many requests a script of retries and reorderings
+// makes: enough that most chunks are sent, some several times.
+func (ra *reassembly) steps() int { return 2*len(ra.chunks) + ra.rng.IntN(2*len(ra.chunks)) }
+
+// check fails unless the completed file equals the original and nothing
+// of the upload is left behind.
+func (ra *reassembly) check() {
+	ra.t.Helper()
+	got, err := os.ReadFile(filepath.Join(ra.srv.cfg.UploadDir, "fuzz.bin"))
+	if err != nil || !bytes.Equal(got, ra.data) {
+		ra.t.Fatalf("completed file differs from the original: %d bytes, want %d (%v); chunk sizes %v",
+			len(got), len(ra.data), err, ra.sizes())
+	}
+	if left, _ := filepath.Glob(filepath.Join(ra.srv.cfg.UploadDir, ra.id+"*")); len(left) > 0 {
+		ra.t.Fatalf("left behind: %v", left)
+	}
+}
+
+func (ra *reassembly) sizes() []int {
+	sizes := make([]int, len(ra.chunks))
+	for i, c := range ra.chunks {
+		sizes[i] = len(c)
+	}
+	return sizes
+}
+
+// checkAppend sends the chunks of an appended upload in a random order
+// with retries, some of them resent with other bytes, checking every
+// answer against what the server has stored, then the rest in order.
+func checkAppend(t *testing.T, data []byte, seed uint64) {
+	ra := newReassembly(t, data, seed, false)
+	total, next := len(ra.chunks), 0
+	for range ra.steps() {
+		i := ra.pick()
+		chunk := ra.chunks[i]
+		if i < next && len(chunk) > 1 && ra.rng.IntN(4) == 0 {
+			// A stored chunk resent with another length is refused.
+			if status, out := ra.send(i, chunk[1:], nil); status != http.StatusConflict || out.Code != CodeChunkConflict {
+				t.Fatalf("chunk %d resent shorter: status = %d, %+v", i, status, out)
+			}
+			continue
+		}
+		status, out := ra.send(i, chunk, nil)
+		switch {
+		case i < next:
+			if status != http.StatusOK || !out.Duplicate {
+				t.Fatalf("chunk %d resent: status = %d, %+v", i, status, out)
+			}
+		case i == next:
+			next++
+			if status != http.StatusOK || out.Done != (next == total) || out.Duplicate {
+				t.Fatalf("chunk %d: status = %d, %+v", i, status, out)
+			}
+		default: // the last chunk too
+			if status != http.StatusConflict || out.Code != CodeChunkOutOfOrder {
+				t.Fatalf("chunk %d before chunk %d: status = %d, %+v", i, next, status, out)
+			}
+		}
+		if next == total {
+			break
+		}
+	}
+	for ; next < total; next++ {
+		if status, out := ra.send(next, ra.chunks[next], nil); status != http.StatusOK || out.Done != (next == total-1) {
+			t.Fatalf("chunk %d: status = %d, %+v", next, status, out)
+		}
+	}
+	ra.check()
+}
+
+// checkPositional sends equal-sized chunks at their offsets in a random
+// order with retries; the upload must finish exactly when the last
+// missing chunk arrives. Middle chunks of the wrong size are refused.
+func checkPositional(t *testing.T, data []byte, seed uint64) {
+	ra := newReassembly(t, data, seed, true)
+	total := len(ra.chunks)
+	extra := url.Values{"fileSize": {strconv.Itoa(len(data))}, "chunkSize": {strconv.Itoa(len(ra.chunks[0]))}}
+	seen := map[int]bool{}
+	for len(seen) < total {
+		i := ra.pick()
+		if ra.rng.IntN(8) == 0 {
+			// Make progress: the first chunk not sent yet.
+			for i = 0; seen[i]; i++ {
+			}
+		}
+		chunk := ra.chunks[i]
+		if i < total-1 && len(chunk) > 1 && ra.rng.IntN(4) == 0 {
+			if status, out := ra.send(i, chunk[1:], extra); status != http.StatusBadRequest || out.Code != CodeInvalidOffset {
+				t.Fatalf("chunk %d shorter than chunkSize: status = %d, %+v", i, status, out)
+			}
+			continue
+		}
+		seen[i] = true
+		if status, out := ra.send(i, chunk, extra); status != http.StatusOK || out.Done != (len(seen) == total) {
+			t.Fatalf("chunk %d (%d of %d sent): status = %d, %+v", i, len(seen), total, status, out)
+		}
+	}
+	ra.check()
+}
+
+// checkSeparate stores chunk files in a random order with retries and
+// asks to complete the upload along the way: that is refused until every
+// chunk is stored.
+func checkSeparate(t *testing.T, data []byte, seed uint64) {
+	ra := newReassembly(t, data, seed, false)
+	total := len(ra.chunks)
+	extra := url.Values{"mode": {UploadModeSeparate}}
+	complete := func() (int, chunkReply) {
+		rec := httptest.NewRecorder()
+		ra.srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload/"+ra.id+"/complete", nil))
+		var out chunkReply
+		json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec.Code, out
+	}
+	seen := map[int]bool{}
+	for range ra.steps() {
+		if ra.rng.IntN(total+1) == 0 {
+			if status, out := complete(); len(seen) < total && (status != http.StatusBadRequest || out.Code != CodeIncompleteUpload) {
+				t.Fatalf("complete with %d of %d chunks: status = %d, %+v", len(seen), total, status, out)
+			} else if len(seen) == total {
+				if status != http.StatusOK || !out.Done {
+					t.Fatalf("complete: status = %d, %+v", status, out)
+				}
+				ra.check()
+				return
+			}
+			continue
+		}
+		i := ra.pick()
+		seen[i] = true
+		if status, out := ra.send(i, ra.chunks[i], extra); status != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, %+v", i, status, out)
+		}
+	}
+	for i, chunk := range ra.chunks {
+		if !seen[i] {
+			if status, out := ra.send(i, chunk, extra); status != http.StatusOK {
+				t.Fatalf("chunk %d: status = %d, %+v", i, status, out)
+			}
+		}
+	}
+	if status, out := complete(); status != http.StatusOK || !out.Done {
+		t.Fatalf("complete: status = %d, %+v", status, out)
+	}
+	ra.check()
+}
+
+// fuzzReassembly runs check as a fuzz target over (data, seed), with
+// data capped so one input stays fast.
+func fuzzReassembly(f *testing.F, check func(*testing.T, []byte, uint64)) {
+	f.Add([]byte("hello, world"), uint64(0))
+	f.Add([]byte("a"), uint64(1))
+	f.Add(bytes.Repeat([]byte("0123456789"), 100), uint64(42))
+	// Logging every request would make the fuzzer crawl.
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	f.Cleanup(func() { slog.SetDefault(prev) })
+	f.Fuzz(func(t *testing.T, data []byte, seed uint64) {
+		if len(data) == 0 {
+			t.Skip("empty files are not uploaded in chunks")
+		}
+		check(t, data[:min(len(data), 1<<16)], seed)
+	})
+}
+
+func FuzzAppendReassembly(f *testing.F)     { fuzzReassembly(f, checkAppend) }
+func FuzzPositionalReassembly(f *testing.F) { fuzzReassembly(f, checkPositional) }
+func FuzzSeparateReassembly(f *testing.F)   { fuzzReassembly(f, checkSeparate) }
+
+func TestReassemblyProperty(t *testing.T) {
+	rounds := 100
+	if testing.Short() {
+		rounds = 10
+	}
+	for name, check := range map[string]func(*testing.T, []byte, uint64){
+		"append": checkAppend, "positional": checkPositional, "separate": checkSeparate,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for seed := range uint64(rounds) {
+				rng := rand.New(rand.NewPCG(seed, 1))
+				data := make([]byte, 1+rng.IntN(4096))
+				for i := range data {
+					data[i] = byte(rng.Uint32())
+				}
+				t.Run(strconv.FormatUint(seed, 10), func(t *testing.T) { check(t, data, seed) })
+			}
+		})
+	}
+}
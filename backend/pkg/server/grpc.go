@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	uploadv1 "github.com/navneetshukl/Chunk-Upload/backend/proto/chunkupload/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // grpc-encoding: gzip
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//go:generate protoc -I ../../proto --go_out=../../proto --go_opt=paths=source_relative --go-grpc_out=../../proto --go-grpc_opt=paths=source_relative chunkupload/v1/upload.proto
+
+// ---------------------------------------------------------------------
+// gRPC: chunkupload.v1.UploadService (proto/chunkupload/v1/upload.proto)
+// served by google.golang.org/grpc over HTTP/2 next to the HTTP
+// endpoints, every chunk going through the same session and storage code
+// as PUT /upload/{id}/chunk
+// ---------------------------------------------------------------------
+
+// GRPCService is the full name of the gRPC service; its methods are
+// routed as POST /chunkupload.v1.UploadService/<Method>.
+const GRPCService = "chunkupload.v1.UploadService"
+
+// GRPCErrorCodeTrailer carries ErrorResponse.Code in the trailers of a
+// failed call, next to grpc-status and grpc-message.
+const GRPCErrorCodeTrailer = "X-Upload-Error-Code"
+
+// DefaultGRPCMaxMessage bounds a request message when MAX_CHUNK_SIZE is
+// unset; with it, a message may be MAX_CHUNK_SIZE plus MultipartOverhead.
+const DefaultGRPCMaxMessage = 64 << 20
+
+// grpcError is a call's failure: its gRPC status and, when it came from
+// the upload code, the ErrorResponse code.
+type grpcError struct {
+	status codes.Code
+	code   string
+	msg    string
+}
+
+// grpcFailure maps an upload failure to a gRPC status. Failures marked
+// retriable become UNAVAILABLE, the status gRPC clients retry.
+func grpcFailure(status int, code, msg string) *grpcError {
+	g := &grpcError{codes.Unknown, code, msg}
+	switch {
+	case code == CodeCanceled:
+		g.status = codes.Canceled
+	case retriableCodes[code] && code != CodeServerError:
+		g.status = codes.Unavailable
+	case status == http.StatusBadRequest, status == http.StatusUnprocessableEntity:
+		g.status = codes.InvalidArgument
+	case status == http.StatusUnauthorized:
+		g.status = codes.Unauthenticated
+	case status == http.StatusForbidden:
+		g.status = codes.PermissionDenied
+	case status == http.StatusNotFound:
+		g.status = codes.NotFound
+	case status == http.StatusConflict, status == http.StatusGone:
+		g.status = codes.FailedPrecondition
+	case status == http.StatusRequestEntityTooLarge, status == http.StatusTooManyRequests, status == http.StatusInsufficientStorage:
+		g.status = codes.ResourceExhausted
+	case status == http.StatusServiceUnavailable:
+		g.status = codes.Unavailable
+	case status >= 500:
+		g.status = codes.Internal
+	}
+	return g
+}
+
+// grpcHTTPStatus is the HTTP status logLevelFor judges a gRPC status by.
+func grpcHTTPStatus(status codes.Code) int {
+	switch status {
+	case codes.Unknown, codes.Internal:
+		return http.StatusInternalServerError
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// grpcMaxMessage is the largest request message accepted.
+func (s *Server) grpcMaxMessage() int64 {
+	if s.cfg.MaxChunkSize > 0 {
+		return s.cfg.MaxChunkSize + MultipartOverhead
+	}
+	return DefaultGRPCMaxMessage
+}
+
+// newGRPCServer returns the gRPC server of s. It is served through
+// ServeHTTP on the routes of its methods, behind the same middleware as
+// the HTTP endpoints.
+func (s *Server) newGRPCServer() *grpc.Server {
+	g := grpc.NewServer(grpc.MaxRecvMsgSize(int(min(s.grpcMaxMessage(), 1<<31-1))))
+	uploadv1.RegisterUploadServiceServer(g, grpcService{s: s})
+	return g
+}
+
+// grpcCall is the HTTP request a call came in, which its handler runs
+// the HTTP handlers against; grpcCallKey finds it in the call's context.
+type grpcCall struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+type grpcCallKey struct{}
+
+func callOf(ctx context.Context) grpcCall {
+	call, _ := ctx.Value(grpcCallKey{}).(grpcCall)
+	return call
+}
+
+// serveGRPC hands r to the gRPC server.
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), grpcCallKey{}, grpcCall{w, r}))
+	s.grpc.ServeHTTP(flushWriter{w}, r)
+}
+
+// flushWriter lets the gRPC server flush through the middleware's
+// writers, which only reach the connection's Flush by Unwrap.
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (f flushWriter) Flush() {
+	http.NewResponseController(f.ResponseWriter).Flush()
+}
+
+// fail ends a call with g: it is logged, its code set as the
+// GRPCErrorCodeTrailer trailer and its status returned.
+func (g *grpcError) fail(ctx context.Context) error {
+	w := callOf(ctx).w
+	logFor(w).Log(ctx, logLevelFor(grpcHTTPStatus(g.status)), "grpc error", "grpc_status", int(g.status), "code", g.code, "error", g.msg)
+	if g.code != "" {
+		noteErrorCode(w, g.code)
+		grpc.SetTrailer(ctx, metadata.Pairs(GRPCErrorCodeTrailer, g.code))
+	}
+	return status.Error(g.status, g.msg)
+}
+
+// serveInProcess runs h as if r, with form as its fields, had been sent
+// to it, and returns the status and body it answered with. The calls map
+// onto the HTTP handlers this way, so every check of theirs applies. Each
+// runs in a child span of the call's named name.
+func serveInProcess(w http.ResponseWriter, r *http.Request, name string, form url.Values, h http.HandlerFunc) (int, []byte) {
+	reply := &bufferedReply{header: make(http.Header)}
+	rec := &requestRecorder{ResponseWriter: reply, log: logFor(w)}
+	if outer, ok := w.(*requestRecorder); ok {
+		rec.upload = outer.upload
+		rec.span = outer.span.child(name)
+		if rec.upload != "" {
+			rec.span.set("upload.id", rec.upload)
+		}
+	}
+	req := r.Clone(context.WithValue(r.Context(), recorderKey{}, rec))
+	req.Method, req.Body, req.ContentLength = http.MethodPost, http.NoBody, 0
+	req.Form, req.PostForm = form, url.Values{}
+	h(rec, req)
+	status := cmp.Or(reply.status, http.StatusOK)
+	rec.span.set("http.response.status_code", status)
+	if rec.code != "" {
+		rec.span.set("error.code", rec.code)
+	}
+	if status >= 500 {
+		rec.span.fail(http.StatusText(status))
+	}
+	rec.span.finish()
+	return status, reply.body.Bytes()
+}
+
+// bufferedReply is the http.ResponseWriter of serveInProcess.
+type bufferedReply struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedReply) Header() http.Header { return b.header }
+
+func (b *bufferedReply) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *bufferedReply) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// decodeReply decodes what serveInProcess returned into out, or the
+// failure it describes.
+func decodeReply(status int, body []byte, out any) *grpcError {
+	if status != http.StatusOK {
+		var e ErrorResponse
+		if err := json.Unmarshal(body, &e); err != nil {
+			return &grpcError{codes.Internal, CodeServerError, fmt.Sprintf("status %d: %s", status, body)}
+		}
+		return grpcFailure(status, e.Code, e.Error)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return &grpcError{codes.Internal, CodeServerError, fmt.Sprintf("cannot decode reply: %v", err)}
+	}
+	return nil
+}
+
+// grpcService implements uploadv1.UploadServiceServer on s.
+type grpcService struct {
+	uploadv1.UnimplementedUploadServiceServer
+	s *Server
+}
+
+// grpcUploadChunks serves UploadChunks, holding an upload slot for the
+// whole call.
+func (s *Server) grpcUploadChunks(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if err := s.ensureDirs(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot initialise upload directory")
+		return
+	}
+	s.serveGRPC(w, r)
+}
+
+// grpcGetUploadStatus serves GetUploadStatus.
+func (s *Server) grpcGetUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	s.serveGRPC(w, r)
+}
+
+// UploadChunks stores a stream of chunks, each as a raw chunk PUT would
+// be, and answers with the upload's state once the client closes the
+// stream or the last chunk completes the file. The first chunk names the
+// session: an upload_id from POST /upload/init or an earlier call, or a
+// file_name and total_chunks to start one.
+func (g grpcService) UploadChunks(stream uploadv1.UploadService_UploadChunksServer) error {
+	ctx := stream.Context()
+	result := &uploadv1.UploadResult{}
+	for n := 0; ; n++ {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			if n == 0 {
+				return (&grpcError{codes.InvalidArgument, CodeMissingChunk, "no chunks sent"}).fail(ctx)
+			}
+			return stream.SendAndClose(result)
+		}
+		if status.Code(err) == codes.ResourceExhausted {
+			return (&grpcError{codes.ResourceExhausted, CodeChunkTooLarge, status.Convert(err).Message()}).fail(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if result.Done {
+			return (&grpcError{codes.InvalidArgument, CodeInvalidIndex, fmt.Sprintf("upload %s is complete: chunk after the last", result.UploadId)}).fail(ctx)
+		}
+		if n == 0 {
+			if gerr := g.s.grpcSession(ctx, chunk, result); gerr != nil {
+				return gerr.fail(ctx)
+			}
+		}
+		if gerr := g.s.grpcChunk(ctx, chunk, result); gerr != nil {
+			return gerr.fail(ctx)
+		}
+	}
+}
+
+// grpcSession resolves the session the first chunk names, starting one
+// through POST /upload/init when it has no upload_id.
+func (s *Server) grpcSession(ctx context.Context, c *uploadv1.Chunk, result *uploadv1.UploadResult) *grpcError {
+	call := callOf(ctx)
+	id := c.UploadId
+	if id == "" {
+		form := url.Values{"fileName": {c.FileName}, "totalChunks": {strconv.Itoa(int(c.TotalChunks))}}
+		if c.FileSize > 0 {
+			form.Set("fileSize", strconv.FormatInt(c.FileSize, 10))
+		}
+		if c.Retention != "" {
+			form.Set("retention", c.Retention)
+		}
+		var init InitResponse
+		status, body := serveInProcess(call.w, call.r, "grpc.init", form, s.initHandler)
+		if gerr := decodeReply(status, body, &init); gerr != nil {
+			return gerr
+		}
+		id = init.UploadID
+	}
+	sess, uerr := s.lookupSession(id)
+	if uerr != nil {
+		return grpcFailure(uerr.status, uerr.code, uerr.msg)
+	}
+	result.UploadId, result.FileName = sess.ID, sess.FileName
+	tagUpload(call.w, sess.ID)
+	return nil
+}
+
+// grpcChunk stores chunk c of result's session through receiveChunk.
+func (s *Server) grpcChunk(ctx context.Context, c *uploadv1.Chunk, result *uploadv1.UploadResult) *grpcError {
+	call := callOf(ctx)
+	form := url.Values{"uploadID": {result.UploadId}, "index": {strconv.Itoa(int(c.Index))}}
+	if c.Sha256 != "" {
+		form.Set(ChecksumSHA256, c.Sha256)
+	}
+	if c.FileSha256 != "" {
+		form.Set("fileSha256", c.FileSha256)
+	}
+	status, body := serveInProcess(call.w, call.r, "grpc.chunk", form, func(w http.ResponseWriter, r *http.Request) {
+		s.receiveChunk(w, r, func(*http.Request, bool) (io.Reader, int64, *uploadError) {
+			return bytes.NewReader(c.Data), int64(len(c.Data)), nil
+		})
+	})
+	var resp SuccessResponse
+	if gerr := decodeReply(status, body, &resp); gerr != nil {
+		return gerr
+	}
+	result.Received = resp.Received
+	if resp.Done {
+		result.Done, result.Path, result.Size = true, resp.Path, resp.Size
+		result.ContentType, result.DuplicateOf = resp.ContentType, resp.DuplicateOf
+	}
+	return nil
+}
+
+// GetUploadStatus answers as GET /upload/{uploadID}/status does.
+func (g grpcService) GetUploadStatus(ctx context.Context, req *uploadv1.StatusRequest) (*uploadv1.UploadStatus, error) {
+	s, call := g.s, callOf(ctx)
+	sess, uerr := s.lookupSession(req.UploadId)
+	if uerr != nil {
+		return nil, grpcFailure(uerr.status, uerr.code, uerr.msg).fail(ctx)
+	}
+	if !s.canSee(call.r, sess) {
+		return nil, grpcFailure(http.StatusNotFound, CodeUnknownUpload, "unknown uploadID "+sess.ID).fail(ctx)
+	}
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	st := s.sessionStatus(sess)
+	lock.Unlock()
+	tagUpload(call.w, sess.ID).Info("status", "received_chunks", len(st.ReceivedChunks), "total_chunks", sess.TotalChunks)
+	return &uploadv1.UploadStatus{
+		UploadId:       st.UploadID,
+		FileName:       st.FileName,
+		TotalChunks:    int32(st.TotalChunks),
+		FileSize:       st.FileSize,
+		Received:       st.Received,
+		ReceivedChunks: int32s(st.ReceivedChunks),
+		MissingChunks:  int32s(st.MissingChunks),
+	}, nil
+}
+
+func int32s(vs []int) []int32 {
+	out := make([]int32, len(vs))
+	for i, v := range vs {
+		out[i] = int32(v)
+	}
+	return out
+}
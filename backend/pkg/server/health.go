@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Probes: GET /healthz (the process is alive) and GET /readyz (it can
+// take uploads), both with the build's version; /readyz fails from the
+// moment Shutdown begins
+// ---------------------------------------------------------------------
+
+// Version is the server's version, set at build time with
+// -ldflags "-X github.com/navneetshukl/Chunk-Upload/backend/pkg/server.Version=v1.2.3".
+// Empty means the module version recorded by the Go toolchain.
+var Version string
+
+// ReadyCheckTimeout bounds the checks of one GET /readyz; a check still
+// running then fails.
+const ReadyCheckTimeout = 5 * time.Second
+
+// Probe statuses in HealthResponse.Status.
+const (
+	HealthOK      = "ok"
+	HealthReady   = "ready"
+	HealthUnready = "not_ready"
+	HealthStopped = "shutting_down"
+)
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`  // VCS commit
+	Time      string `json:"time,omitempty"`      // commit time
+	Modified  bool   `json:"modified,omitempty"`  // built from a tree with uncommitted changes
+	GoVersion string `json:"goVersion,omitempty"` // toolchain
+}
+
+// Build returns the version and VCS stamp of the running binary.
+func Build() BuildInfo {
+	return buildInfo()
+}
+
+var buildInfo = sync.OnceValue(func() BuildInfo {
+	b := BuildInfo{Version: Version}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if b.Version == "" {
+			b.Version = "unknown"
+		}
+		return b
+	}
+	b.GoVersion = info.GoVersion
+	if b.Version == "" {
+		b.Version = info.Main.Version
+	}
+	for _, kv := range info.Settings {
+		switch kv.Key {
+		case "vcs.revision":
+			b.Revision = kv.Value
+		case "vcs.time":
+			b.Time = kv.Value
+		case "vcs.modified":
+			b.Modified = kv.Value == "true"
+		}
+	}
+	return b
+})
+
+// HealthResponse is returned by GET /healthz and GET /readyz.
+type HealthResponse struct {
+	Status        string            `json:"status"`
+	Checks        map[string]string `json:"checks,omitempty"` // by name: "ok" or why it failed
+	UptimeSeconds int64             `json:"uptimeSeconds"`
+	Build         BuildInfo         `json:"build"`
+}
+
+// healthzHandler answers liveness probes. It checks nothing beyond the
+// process serving requests: a full disk or an unreachable bucket makes
+// the instance unready, but restarting it would not help.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.probeMethod(w, r) {
+		return
+	}
+	respondJSON(w, http.StatusOK, s.health(HealthOK, nil))
+}
+
+// readyzHandler answers readiness probes: 200 when every storage backend
+// (each tenant's too) can store a file and METADATA_DB answers, 503
+// otherwise, and 503 from the start of Shutdown so that load balancers
+// stop routing new uploads here while those in flight finish.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.probeMethod(w, r) {
+		return
+	}
+	if s.stopping() {
+		w.Header().Set("Connection", "close")
+		respondJSON(w, http.StatusServiceUnavailable, s.health(HealthStopped, nil))
+		return
+	}
+	checks, ok := s.readyChecks(r.Context())
+	if !ok {
+		logFor(w).Warn("not ready", "checks", checks)
+		respondJSON(w, http.StatusServiceUnavailable, s.health(HealthUnready, checks))
+		return
+	}
+	respondJSON(w, http.StatusOK, s.health(HealthReady, checks))
+}
+
+// probeMethod allows GET and HEAD and keeps probe answers out of caches.
+func (s *Server) probeMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return true
+}
+
+func (s *Server) health(status string, checks map[string]string) HealthResponse {
+	return HealthResponse{Status: status, Checks: checks, UptimeSeconds: int64(s.now().Sub(s.started).Seconds()), Build: Build()}
+}
+
+// readyChecks runs the readiness checks side by side, each failing that
+// has not finished within ReadyCheckTimeout.
+func (s *Server) readyChecks(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, ReadyCheckTimeout)
+	defer cancel()
+	checks := make(map[string]func() error)
+	for _, srv := range s.servers() {
+		name := "storage"
+		if srv.tenant != "" {
+			name += ":" + srv.tenant
+		} else if s.cfg.TenantMode != "" {
+			continue // the process stores nothing of its own
+		}
+		checks[name] = srv.store.Check
+	}
+	if s.db != nil {
+		checks["metadataDB"] = func() error { return s.db.db.PingContext(ctx) }
+	}
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for name, check := range checks {
+		go func() { results <- result{name, check()} }()
+	}
+	out := make(map[string]string, len(checks))
+	ok := true
+	for range checks {
+		select {
+		case res := <-results:
+			out[res.name] = HealthOK
+			if res.err != nil {
+				out[res.name], ok = res.err.Error(), false
+			}
+		case <-ctx.Done():
+			for name := range checks {
+				if _, done := out[name]; !done {
+					out[name], ok = "timed out after "+ReadyCheckTimeout.String(), false
+				}
+			}
+			return out, ok
+		}
+	}
+	return out, ok
+}
+
+// stopping reports whether Shutdown has begun.
+func (s *Server) stopping() bool {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	return s.unready
+}
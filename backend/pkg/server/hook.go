@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// POST_UPLOAD_COMMAND: an external command run after each completed
+// upload, with arguments filled in from the file; the outcome is kept
+// with the file
+// ---------------------------------------------------------------------
+
+const (
+	// HookTable is the post-upload command results' file inside
+	// UploadDir.
+	HookTable = ".hooks.json"
+
+	DefaultHookTimeout = time.Minute
+	hookOutputLen      = 4096 // of stdout and of stderr, logged and kept on failure
+)
+
+// HookData is what the arguments of POST_UPLOAD_COMMAND can refer to,
+// e.g. {{.Path}}.
+type HookData struct {
+	Path        string // of the stored file: on disk, or the object key
+	FileName    string
+	UploadID    string // the session's ID, else the file name
+	Size        int64
+	ContentType string
+	Tenant      string
+	Compressed  bool // the file at Path is gzipped (COMPRESS_AT_REST)
+}
+
+// HookResult is how the post-upload command of a completed file went.
+type HookResult struct {
+	State      string     `json:"state"` // running, done or failed
+	ExitCode   int        `json:"exitCode"`
+	Error      string     `json:"error,omitempty"` // failed: why, with the end of stderr
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// parseHookCommand reads POST_UPLOAD_COMMAND: the program and its
+// arguments separated by spaces, quoted with ' or " to contain spaces,
+// each a text/template over HookData.
+func parseHookCommand(v string) ([]*template.Template, error) {
+	args, err := splitCommand(v)
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]*template.Template, len(args))
+	for i, arg := range args {
+		t, err := template.New(fmt.Sprintf("arg%d", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		// Executing once finds references to fields HookData lacks.
+		if err := t.Execute(new(strings.Builder), HookData{}); err != nil {
+			return nil, err
+		}
+		cmd[i] = t
+	}
+	return cmd, nil
+}
+
+// splitCommand splits v at unquoted spaces. There is no shell: for
+// pipes or redirection, run sh -c '...'.
+func splitCommand(v string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range v {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// runHook starts POST_UPLOAD_COMMAND for the completed file fileName,
+// stored as storedName, in the background; the result is recorded under
+// storedName. The response to the upload does not wait for it.
+func (s *Server) runHook(r *http.Request, key, fileName, storedName, path string, size int64, contentType string) {
+	if len(s.cfg.HookCommand) == 0 {
+		return
+	}
+	data := HookData{Path: path, FileName: fileName, UploadID: key, Size: size, ContentType: contentType, Tenant: s.tenant,
+		Compressed: s.isCompressed(storedName)}
+	args := make([]string, len(s.cfg.HookCommand))
+	for i, t := range s.cfg.HookCommand {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			now := s.now()
+			s.recordHook(storedName, HookResult{State: ProcessingFailed, ExitCode: -1, Error: err.Error(), StartedAt: now, FinishedAt: &now})
+			return
+		}
+		args[i] = b.String()
+	}
+	lg := logCtx(r.Context()).With("file", storedName)
+	// Replaces the result of an earlier file of the same name at once.
+	s.recordHook(storedName, HookResult{State: ProcessingRunning, StartedAt: s.now()})
+	s.hookRuns.Add(1)
+	go func() {
+		defer s.hookRuns.Done()
+		s.recordHook(storedName, s.execHook(lg, args))
+	}()
+}
+
+// execHook runs args within POST_UPLOAD_TIMEOUT, logging its output.
+func (s *Server) execHook(lg *slog.Logger, args []string) HookResult {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.HookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	res := HookResult{State: ProcessingDone, StartedAt: s.now()}
+	err := cmd.Run()
+	finished := s.now()
+	res.FinishedAt = &finished
+	out, errOut := hookOutput(stdout.String()), hookOutput(stderr.String())
+	if err != nil {
+		res.State, res.ExitCode, res.Error = ProcessingFailed, -1, err.Error()
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			res.ExitCode = exit.ExitCode()
+		}
+		if ctx.Err() != nil {
+			res.Error = fmt.Sprintf("timed out after %s", s.cfg.HookTimeout)
+		}
+		if errOut != "" {
+			res.Error += ": " + errOut
+		}
+		lg.Warn("post-upload command failed", "command", args[0], "exit_code", res.ExitCode, "error", err,
+			"stdout", out, "stderr", errOut, "duration", finished.Sub(res.StartedAt))
+		return res
+	}
+	lg.Info("post-upload command done", "command", args[0], "stdout", out, "stderr", errOut,
+		"duration", finished.Sub(res.StartedAt))
+	return res
+}
+
+// hookOutput returns the last hookOutputLen bytes of the trimmed output.
+func hookOutput(out string) string {
+	out = strings.TrimSpace(out)
+	if len(out) > hookOutputLen {
+		out = "…" + out[len(out)-hookOutputLen:]
+	}
+	return out
+}
+
+// hookTable records the post-upload command result of each completed
+// file.
+type hookTable struct {
+	*storage.Table[HookResult]
+}
+
+func newHookTable(dir string, mode os.FileMode) *hookTable {
+	return &hookTable{storage.NewTable[HookResult]("hook table", filepath.Join(dir, HookTable), mode)}
+}
+
+// set records the result for name; nil forgets it.
+func (t *hookTable) set(name string, res *HookResult) error {
+	if res == nil {
+		return t.Delete(name)
+	}
+	return t.Set(name, *res)
+}
+
+// get returns the result for name, nil when no command ran for it.
+func (t *hookTable) get(name string) (*HookResult, error) {
+	res, ok, err := t.Get(name)
+	if !ok {
+		return nil, err
+	}
+	return &res, err
+}
+
+func (s *Server) recordHook(name string, res HookResult) {
+	if err := s.hooks.set(name, &res); err != nil {
+		slog.Warn("cannot record post-upload command result", "file", name, "error", err)
+	}
+}
+
+// storedHook returns the post-upload command result of the completed
+// file name, nil when none ran.
+func (s *Server) storedHook(name string) *HookResult {
+	res, err := s.hooks.get(name)
+	if err != nil {
+		slog.Warn("cannot read post-upload command result", "file", name, "error", err)
+	}
+	return res
+}
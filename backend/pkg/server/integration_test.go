@@ -0,0 +1,500 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/client"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/server"
+)
+
+// These tests drive a real listener over HTTP, the way browsers and the Go
+// client do, and check the bytes of every assembled file.
+
+// harness is a Server behind an httptest.Server, storing under dir.
+type harness struct {
+	t   *testing.T
+	dir string
+	srv *server.Server
+	ts  *httptest.Server
+}
+
+// reply is the JSON body of an upload endpoint, success or error.
+type reply struct {
+	Done      bool   `json:"done"`
+	Duplicate bool   `json:"duplicate"`
+	Received  int64  `json:"received"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Code      string `json:"code"`
+	Error     string `json:"error"`
+}
+
+func newHarness(t *testing.T, opts ...func(*server.Config)) *harness {
+	t.Helper()
+	h := &harness{t: t, dir: t.TempDir()}
+	h.start(opts...)
+	return h
+}
+
+// start (re)starts the server on h.dir, as after a process restart.
+func (h *harness) start(opts ...func(*server.Config)) {
+	h.t.Helper()
+	if h.ts != nil {
+		h.ts.Close()
+	}
+	cfg := server.DefaultConfig()
+	cfg.UploadDir, cfg.TempDir = h.dir, h.dir
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	srv, err := server.New(cfg)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.srv, h.ts = srv, httptest.NewServer(srv)
+	h.t.Cleanup(h.ts.Close)
+}
+
+// chunk POSTs one chunk to /upload with fields (fileName, index,
+// totalChunks, uploadID, mode...) as multipart form fields.
+func (h *harness) chunk(fields map[string]string, data []byte) (int, reply) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("chunk", "blob")
+	fw.Write(data)
+	mw.Close()
+	resp, err := http.Post(h.ts.URL+"/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		h.t.Error(err)
+		return 0, reply{}
+	}
+	return decodeReply(h.t, resp)
+}
+
+// form POSTs a urlencoded form to path.
+func (h *harness) form(path string, values url.Values) (int, reply) {
+	resp, err := http.PostForm(h.ts.URL+path, values)
+	if err != nil {
+		h.t.Error(err)
+		return 0, reply{}
+	}
+	return decodeReply(h.t, resp)
+}
+
+// init starts an upload session and returns its uploadID.
+func (h *harness) init(name string, total int, size int) string {
+	h.t.Helper()
+	resp, err := http.PostForm(h.ts.URL+"/upload/init", url.Values{
+		"fileName": {name}, "totalChunks": {strconv.Itoa(total)}, "fileSize": {strconv.Itoa(size)}})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out server.InitResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("POST /upload/init: status %d, %v", resp.StatusCode, err)
+	}
+	return out.UploadID
+}
+
+// checkFile fails the test unless the completed file name equals want,
+// over HTTP and as stored on disk, and no part files are left.
+func (h *harness) checkFile(name string, want []byte) {
+	h.t.Helper()
+	resp, err := http.Get(h.ts.URL + "/files/" + url.PathEscape(name))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, want) {
+		h.t.Errorf("GET /files/%s: status %d, %d bytes, want %d bytes", name, resp.StatusCode, len(got), len(want))
+	}
+	if onDisk, err := os.ReadFile(filepath.Join(h.dir, name)); err != nil || !bytes.Equal(onDisk, want) {
+		h.t.Errorf("%s on disk: %d bytes (%v), want %d bytes", name, len(onDisk), err, len(want))
+	}
+	if parts, _ := filepath.Glob(filepath.Join(h.dir, "*.part*")); len(parts) > 0 {
+		h.t.Errorf("part files left behind: %v", parts)
+	}
+}
+
+func decodeReply(t *testing.T, resp *http.Response) (int, reply) {
+	defer resp.Body.Close()
+	var out reply
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil && resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status %d: cannot decode body: %v", resp.StatusCode, err)
+	}
+	return resp.StatusCode, out
+}
+
+// testFile returns size bytes that differ for every seed, so misplaced or
+// duplicated chunks show up.
+func testFile(seed uint64, size int) []byte {
+	r := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+// split cuts data into total chunks, the last one shorter.
+func split(data []byte, total int) [][]byte {
+	size := (len(data) + total - 1) / total
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := min(size, len(data))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestIntegrationInOrder(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(1, 10_000)
+	chunks := split(data, 4)
+	id := h.init("in-order.bin", 4, len(data))
+	for i, c := range chunks {
+		status, out := h.chunk(map[string]string{"uploadID": id, "index": strconv.Itoa(i)}, c)
+		if status != http.StatusOK || out.Done != (i == 3) {
+			t.Fatalf("chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+	h.checkFile("in-order.bin", data)
+}
+
+func TestIntegrationOutOfOrder(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(2, 10_000)
+	chunks := split(data, 5)
+	order := []int{3, 0, 4, 2, 1}
+
+	// Appended chunks must come in order.
+	id := h.init("append.bin", 5, len(data))
+	if status, out := h.chunk(map[string]string{"uploadID": id, "index": "0"}, chunks[0]); status != http.StatusOK {
+		t.Fatalf("chunk 0: status %d, %+v", status, out)
+	}
+	if status, out := h.chunk(map[string]string{"uploadID": id, "index": "2"}, chunks[2]); status != http.StatusConflict || out.Code != server.CodeChunkOutOfOrder {
+		t.Errorf("chunk 2 after 0: status %d, %+v", status, out)
+	}
+	for i := 1; i < 5; i++ {
+		if status, out := h.chunk(map[string]string{"uploadID": id, "index": strconv.Itoa(i)}, chunks[i]); status != http.StatusOK {
+			t.Fatalf("chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+	h.checkFile("append.bin", data)
+
+	// Separate chunk files, joined by POST /upload/{uploadID}/complete.
+	id = h.init("separate.bin", 5, len(data))
+	for _, i := range order {
+		fields := map[string]string{"uploadID": id, "index": strconv.Itoa(i), "mode": server.UploadModeSeparate}
+		if status, out := h.chunk(fields, chunks[i]); status != http.StatusOK {
+			t.Fatalf("separate chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+	if status, out := h.form("/upload/"+id+"/complete", url.Values{}); status != http.StatusOK || !out.Done {
+		t.Fatalf("complete: status %d, %+v", status, out)
+	}
+	h.checkFile("separate.bin", data)
+
+	// Positional writes into a sparse part file, finished by the last to arrive.
+	id = h.init("positional.bin", 5, len(data))
+	chunkSize := strconv.Itoa(len(chunks[0]))
+	for n, i := range order {
+		fields := map[string]string{"uploadID": id, "index": strconv.Itoa(i), "chunkSize": chunkSize}
+		status, out := h.chunk(fields, chunks[i])
+		if status != http.StatusOK || out.Done != (n == len(order)-1) {
+			t.Fatalf("positional chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+	h.checkFile("positional.bin", data)
+}
+
+func TestIntegrationDuplicateChunks(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(3, 9_000)
+	chunks := split(data, 3)
+	id := h.init("dup.bin", 3, len(data))
+	send := func(i int) (int, reply) {
+		return h.chunk(map[string]string{"uploadID": id, "index": strconv.Itoa(i)}, chunks[i])
+	}
+	for _, i := range []int{0, 1, 1, 1} {
+		if status, out := send(i); status != http.StatusOK {
+			t.Fatalf("chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+	// A resend after a lost response is acknowledged without writing.
+	if status, out := send(1); status != http.StatusOK || !out.Duplicate || out.Received != int64(len(chunks[0])+len(chunks[1])) {
+		t.Errorf("resent chunk 1: status %d, %+v", status, out)
+	}
+	// The same index with other bytes is refused.
+	status, out := h.chunk(map[string]string{"uploadID": id, "index": "1"}, chunks[1][1:])
+	if status != http.StatusConflict || out.Code != server.CodeChunkConflict {
+		t.Errorf("conflicting chunk 1: status %d, %+v", status, out)
+	}
+	if status, out := send(2); status != http.StatusOK || !out.Done {
+		t.Fatalf("chunk 2: status %d, %+v", status, out)
+	}
+	h.checkFile("dup.bin", data)
+
+	// Separate chunk files may be resent any number of times.
+	id = h.init("dup-separate.bin", 3, len(data))
+	for _, i := range []int{2, 0, 2, 1, 0} {
+		fields := map[string]string{"uploadID": id, "index": strconv.Itoa(i), "mode": server.UploadModeSeparate}
+		if status, out := h.chunk(fields, chunks[i]); status != http.StatusOK {
+			t.Fatalf("separate chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+	if status, out := h.form("/upload/"+id+"/complete", url.Values{}); status != http.StatusOK {
+		t.Fatalf("complete: status %d, %+v", status, out)
+	}
+	h.checkFile("dup-separate.bin", data)
+}
+
+func TestIntegrationResumeAfterRestart(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(4, 12_000)
+	chunks := split(data, 4)
+	id := h.init("resume.bin", 4, len(data))
+	for _, i := range []int{0, 1} {
+		if status, out := h.chunk(map[string]string{"uploadID": id, "index": strconv.Itoa(i)}, chunks[i]); status != http.StatusOK {
+			t.Fatalf("chunk %d: status %d, %+v", i, status, out)
+		}
+	}
+
+	// The process dies; a new one finds the session in its metadata.
+	h.start()
+	resp, err := http.Get(h.ts.URL + "/upload/" + id + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st server.StatusResponse
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !slices.Equal(st.MissingChunks, []int{2, 3}) || st.Received != int64(len(chunks[0])+len(chunks[1])) {
+		t.Fatalf("status after restart: %d, %+v", resp.StatusCode, st)
+	}
+	for _, i := range st.MissingChunks {
+		status, out := h.chunk(map[string]string{"uploadID": id, "index": strconv.Itoa(i)}, chunks[i])
+		if status != http.StatusOK || out.Done != (i == 3) {
+			t.Fatalf("chunk %d after restart: status %d, %+v", i, status, out)
+		}
+	}
+	h.checkFile("resume.bin", data)
+}
+
+func TestIntegrationInterruptedChunk(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(5, 8_000)
+	chunks := split(data, 2)
+	id := h.init("cut.bin", 2, len(data))
+	if status, out := h.chunk(map[string]string{"uploadID": id, "index": "0"}, chunks[0]); status != http.StatusOK {
+		t.Fatalf("chunk 0: status %d, %+v", status, out)
+	}
+
+	// Chunk 1's connection drops half way through the body.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("uploadID", id)
+	mw.WriteField("index", "1")
+	fw, _ := mw.CreateFormFile("chunk", "blob")
+	fw.Write(chunks[1])
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, h.ts.URL+"/upload", io.MultiReader(
+		bytes.NewReader(body.Bytes()[:body.Len()/2]), errReader{}))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.ContentLength = int64(body.Len())
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	// Nothing of the cut chunk was kept: sending it again completes the file.
+	status, out := h.chunk(map[string]string{"uploadID": id, "index": "1"}, chunks[1])
+	if status != http.StatusOK || !out.Done {
+		t.Fatalf("chunk 1 resent: status %d, %+v", status, out)
+	}
+	h.checkFile("cut.bin", data)
+}
+
+// errReader fails, cutting the request body it ends.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, fmt.Errorf("connection reset") }
+
+func TestIntegrationConcurrentSameFileName(t *testing.T) {
+	h := newHarness(t)
+	const uploads, total = 4, 6
+	files := make([][]byte, uploads)
+	var wg sync.WaitGroup
+	for u := range uploads {
+		files[u] = testFile(uint64(10+u), 30_000)
+		id := h.init("same.bin", total, len(files[u]))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, c := range split(files[u], total) {
+				status, out := h.chunk(map[string]string{"uploadID": id, "index": strconv.Itoa(i)}, c)
+				if status != http.StatusOK || out.Done != (i == total-1) {
+					t.Errorf("upload %d chunk %d: status %d, %+v", u, i, status, out)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every upload finished into the same name; the file is exactly one of
+	// them, never a mix.
+	got, err := os.ReadFile(filepath.Join(h.dir, "same.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(files, func(f []byte) bool { return bytes.Equal(f, got) }) {
+		t.Errorf("same.bin (%d bytes) matches none of the uploads", len(got))
+	}
+	if parts, _ := filepath.Glob(filepath.Join(h.dir, "*.part*")); len(parts) > 0 {
+		t.Errorf("part files left behind: %v", parts)
+	}
+}
+
+func TestIntegrationConcurrentChunks(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(6, 64_000)
+	chunks := split(data, 16)
+	id := h.init("parallel.bin", len(chunks), len(data))
+	var wg sync.WaitGroup
+	for i, c := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fields := map[string]string{"uploadID": id, "index": strconv.Itoa(i), "mode": server.UploadModeSeparate}
+			if status, out := h.chunk(fields, c); status != http.StatusOK {
+				t.Errorf("chunk %d: status %d, %+v", i, status, out)
+			}
+		}()
+	}
+	wg.Wait()
+	if status, out := h.form("/upload/"+id+"/complete", url.Values{}); status != http.StatusOK || out.Size != int64(len(data)) {
+		t.Fatalf("complete: status %d, %+v", status, out)
+	}
+	h.checkFile("parallel.bin", data)
+}
+
+func TestIntegrationGoClient(t *testing.T) {
+	h := newHarness(t)
+	data := testFile(7, 50_000)
+	path := filepath.Join(t.TempDir(), "client.bin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u := client.NewUploader(client.New(h.ts.URL))
+	u.ChunkSize, u.Concurrency = 4096, 4
+	res, err := u.UploadFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Size != int64(len(data)) {
+		t.Errorf("result = %+v", res)
+	}
+	h.checkFile("client.bin", data)
+
+	// Compressed, text goes over the wire in gzip; the random bytes above
+	// did not shrink, so they went as they were.
+	var csv bytes.Buffer
+	for i := range 2000 {
+		fmt.Fprintf(&csv, "%d,2026-01-01T00:00:%02dZ,INFO,request served\n", i, i%60)
+	}
+	path = filepath.Join(t.TempDir(), "log.csv")
+	if err := os.WriteFile(path, csv.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u.Compress = true
+	if _, err := u.UploadFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	h.checkFile("log.csv", csv.Bytes())
+	resp, err := http.Get(h.ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	metrics, _ := io.ReadAll(resp.Body)
+	chunks := (csv.Len() + 4095) / 4096
+	if want := fmt.Sprintf("chunkupload_compressed_bodies_total{encoding=\"gzip\"} %d\n", chunks); !strings.Contains(string(metrics), want) {
+		t.Errorf("metrics lack %s", want)
+	}
+}
+
+func TestIntegrationGoClientDir(t *testing.T) {
+	h := newHarness(t)
+	dir := t.TempDir()
+	files := map[string][]byte{"top.bin": testFile(8, 9000), "sub/deep.bin": testFile(9, 20_000), "sub/empty": {}}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := client.NewUploader(client.New(h.ts.URL))
+	u.ChunkSize, u.Concurrency = 4096, 3
+	var last, total int64
+	u.Progress = func(sent, of int64) { last, total = sent, of }
+	m, err := u.UploadDir(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 3 || m.TotalSize != 29_000 || last != 29_000 || total != 29_000 {
+		t.Errorf("manifest = %+v, progress %d/%d", m, last, total)
+	}
+	h.checkFile("top.bin", files["top.bin"])
+	h.checkFile("sub__deep.bin", files["sub/deep.bin"])
+	h.checkFile("sub__empty", nil)
+
+	// A batch created elsewhere is finished by ResumeDir from the same tree.
+	os.Remove(filepath.Join(dir, "sub", "empty"))
+	os.Rename(filepath.Join(dir, "top.bin"), filepath.Join(dir, "sub", "top.bin"))
+	body := `{"files":[{"path":"sub/deep.bin","totalChunks":5,"fileSize":20000},{"path":"sub/top.bin","totalChunks":3,"fileSize":9000}]}`
+	resp, err := http.Post(h.ts.URL+"/batches", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b client.Batch
+	json.NewDecoder(resp.Body).Decode(&b)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(b.Files) != 2 {
+		t.Fatalf("POST /batches: status %d, %+v", resp.StatusCode, b)
+	}
+	if m, err = u.ResumeDir(context.Background(), b.BatchID, dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 || m.Files[1].FileName != "sub__top.bin" {
+		t.Errorf("manifest = %+v", m)
+	}
+	h.checkFile("sub__top.bin", files["top.bin"])
+	if _, err := u.Client.BatchStatus(context.Background(), b.BatchID); err == nil {
+		t.Error("batch still there after complete")
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Chunk integrity verification
+// ---------------------------------------------------------------------
+const (
+	ChecksumNone   = "none"
+	ChecksumCRC32  = "crc32"  // CRC32 (Castagnoli), cheap transmission check
+	ChecksumSHA256 = "sha256" // cryptographic, more CPU on the client
+	ChecksumMD5    = "md5"    // what browsers and S3 tooling commonly have at hand
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errChecksumMissing  = errors.New("checksum missing")
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
+
+func isSupportedChecksum(algo string) bool {
+	switch algo {
+	case "", ChecksumNone, ChecksumCRC32, ChecksumSHA256, ChecksumMD5:
+		return true
+	}
+	return false
+}
+
+func newChecksum(algo string) hash.Hash {
+	switch algo {
+	case ChecksumCRC32:
+		return crc32.New(crc32cTable)
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumMD5:
+		return md5.New()
+	}
+	return nil
+}
+
+// chunkChecksums collects the hex digests sent with one chunk: the
+// checksumAlgo pair (chunkCrc / chunkHash) plus the md5 and sha256 fields.
+func chunkChecksums(r *http.Request, algo string) map[string]string {
+	sums := make(map[string]string)
+	if algo != "" && algo != ChecksumNone {
+		expected := r.FormValue("chunkHash")
+		if algo == ChecksumCRC32 {
+			expected = r.FormValue("chunkCrc")
+		}
+		sums[algo] = expected
+	}
+	for _, a := range []string{ChecksumMD5, ChecksumSHA256} {
+		if v := r.FormValue(a); v != "" {
+			sums[a] = v
+		}
+	}
+	return sums
+}
+
+// verifyChunk hashes the chunk with the declared algorithm, compares it to
+// the hex digest sent by the client and rewinds the chunk for copying.
+func verifyChunk(chunk io.ReadSeeker, algo, expected string) error {
+	h := newChecksum(algo)
+	if h == nil {
+		return nil
+	}
+	if expected == "" {
+		return errChecksumMissing
+	}
+	if _, err := io.Copy(h, chunk); err != nil {
+		return err
+	}
+	if _, err := chunk.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(got, expected) {
+		return fmt.Errorf("%w: expected %s, got %s", errChecksumMismatch, expected, got)
+	}
+	return nil
+}
+
+// fileChecksums returns the whole-file digests (fileMd5 / fileSha256)
+// sent with the request that completes an upload.
+func fileChecksums(r *http.Request) map[string]string {
+	sums := make(map[string]string)
+	if v := r.FormValue("fileMd5"); v != "" {
+		sums[ChecksumMD5] = v
+	}
+	if v := r.FormValue("fileSha256"); v != "" {
+		sums[ChecksumSHA256] = v
+	}
+	return sums
+}
+
+// fileDigest hashes a stream with every algorithm in want at once.
+type fileDigest struct {
+	want map[string]string
+	got  map[string]hash.Hash
+}
+
+func newFileDigest(want map[string]string) *fileDigest {
+	d := &fileDigest{want: want, got: make(map[string]hash.Hash, len(want))}
+	for algo := range want {
+		d.got[algo] = newChecksum(algo)
+	}
+	return d
+}
+
+func (d *fileDigest) Write(p []byte) (int, error) {
+	for _, h := range d.got {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// check compares every digest with the one the client sent.
+func (d *fileDigest) check() error {
+	for algo, expected := range d.want {
+		got := hex.EncodeToString(d.got[algo].Sum(nil))
+		if !strings.EqualFold(got, expected) {
+			return fmt.Errorf("%w: %s expected %s, got %s", errChecksumMismatch, algo, expected, got)
+		}
+	}
+	return nil
+}
+
+// verifyPart checks the part file stored under key against want before it
+// is finalized.
+func verifyPart(st storage.Storage, key string, want map[string]string) error {
+	if len(want) == 0 {
+		return nil
+	}
+	f, err := st.ReadPart(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := newFileDigest(want)
+	if _, err := io.Copy(d, f); err != nil {
+		return err
+	}
+	return d.check()
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Janitor: deletes unfinished uploads idle longer than STALE_UPLOAD_TTL
+// and completed files past their retention
+// ---------------------------------------------------------------------
+
+// JanitorStats are cumulative cleanup counters since startup.
+type JanitorStats struct {
+	Runs       int64
+	Removed    int64 // uploads deleted
+	FreedBytes int64
+	Errors     int64
+	LastRun    time.Time
+
+	Expired      int64 // completed files deleted after their retention
+	ExpiredBytes int64
+}
+
+// janitorStats returns a copy of the cleanup counters, summed over the
+// tenants; every tenant is swept on each run.
+func (s *Server) janitorStats() JanitorStats {
+	s.janitorMu.Lock()
+	st := s.janitor
+	s.janitorMu.Unlock()
+	for _, t := range s.tenants {
+		ts := t.janitorStats()
+		st.Runs = max(st.Runs, ts.Runs)
+		if ts.LastRun.After(st.LastRun) {
+			st.LastRun = ts.LastRun
+		}
+		st.Removed += ts.Removed
+		st.FreedBytes += ts.FreedBytes
+		st.Errors += ts.Errors
+		st.Expired += ts.Expired
+		st.ExpiredBytes += ts.ExpiredBytes
+	}
+	return st
+}
+
+// RunJanitor sweeps at startup and then every cfg.JanitorEvery until ctx
+// is done. Stale uploads are only swept when cfg.StaleTTL is set; expired
+// files always are, since any upload may ask for a retention period.
+// Each run also samples free space against MIN_FREE_SPACE, so dropping
+// below it is reported even while no upload starts.
+func (s *Server) RunJanitor(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.JanitorEvery)
+	defer ticker.Stop()
+	for {
+		s.lowOnSpace()
+		for _, srv := range s.servers() {
+			if s.cfg.StaleTTL > 0 {
+				srv.sweepStale(s.cfg.StaleTTL)
+			}
+			srv.sweepExpired()
+			if s.cfg.ChunkDedup && s.cfg.ChunkTTL > 0 {
+				srv.sweepChunks()
+			}
+			if s.cfg.Versioning {
+				srv.sweepVersions()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discardPart deletes the files of an unfinished upload and forgets its
+// session.
+func (s *Server) discardPart(p storage.PartInfo) error {
+	lock := s.locks.Get(p.Key)
+	lock.Lock()
+	fileName, direct := p.Key, ""
+	if meta, err := s.store.LoadMeta(p.Key); err == nil && meta.FileName != "" {
+		fileName, direct = meta.FileName, meta.DirectUploadID
+	}
+	err := s.store.RemovePart(p.Key)
+	if err == nil {
+		s.abortDirect(fileName, direct)
+	}
+	if err == nil {
+		err = s.store.RemoveChunks(p.Key, p.Chunks)
+	}
+	s.received.Forget(p.Key)
+	lock.Unlock()
+	s.sessions.Remove(p.Key)
+	if err == nil {
+		s.recordAbort(p.Key)
+		s.publish(p.Key, UploadEvent{Type: EventAborted, FileName: fileName})
+	}
+	return err
+}
+
+// sweepStale deletes every in-progress upload whose files have not been
+// written to for ttl (cfg.StaleTTL, or what POST /admin/purge asked for),
+// along with its session, and returns what this sweep did.
+func (s *Server) sweepStale(ttl time.Duration) JanitorStats {
+	cutoff := s.now().Add(-ttl)
+	parts, err := s.store.ListParts()
+	if err != nil {
+		slog.Warn("janitor: cannot list part files", "error", err)
+		s.janitorMu.Lock()
+		s.janitor.Runs++
+		s.janitor.Errors++
+		s.janitor.LastRun = s.now()
+		s.janitorMu.Unlock()
+		return JanitorStats{Runs: 1, Errors: 1, LastRun: s.now()}
+	}
+
+	var removed, freed, failed int64
+	for _, p := range parts {
+		if !p.ModTime.Before(cutoff) || s.batchActive(p.Key) {
+			continue
+		}
+		if err := s.discardPart(p); err != nil {
+			slog.Warn("janitor: cannot remove stale upload", "key", p.Key, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("janitor: removed stale upload", "key", p.Key, "bytes", p.Size, "idle_since", p.ModTime)
+		removed++
+		freed += p.Size
+	}
+
+	s.janitorMu.Lock()
+	s.janitor.Runs++
+	s.janitor.Removed += removed
+	s.janitor.FreedBytes += freed
+	s.janitor.Errors += failed
+	s.janitor.LastRun = s.now()
+	total, totalFreed := s.janitor.Removed, s.janitor.FreedBytes
+	s.janitorMu.Unlock()
+	slog.Info("janitor: sweep done", "scanned", len(parts), "removed", removed, "freed_bytes", freed,
+		"total_removed", total, "total_freed_bytes", totalFreed)
+	return JanitorStats{Runs: 1, Removed: removed, FreedBytes: freed, Errors: failed, LastRun: s.now()}
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Per-upload size limits (MAX_FILE_SIZE, MIN_CHUNK_SIZE, MAX_CHUNK_SIZE)
+// ---------------------------------------------------------------------
+
+// MultipartOverhead is the room left above MAX_CHUNK_SIZE for the form
+// fields and part headers of a chunk request.
+const MultipartOverhead = 64 << 10
+
+// uploadLimit is the most bytes one upload may store: its declared
+// fileSize, capped by MAX_FILE_SIZE. 0 means no limit.
+func (s *Server) uploadLimit(fileSize int64) int64 {
+	if fileSize > 0 && (s.cfg.MaxFileSize == 0 || fileSize < s.cfg.MaxFileSize) {
+		return fileSize
+	}
+	return s.cfg.MaxFileSize
+}
+
+// checkChunkLayout rejects a declared fileSize/totalChunks pair no honest
+// client sends, or one outside the negotiated chunk sizes: more chunks
+// than bytes, chunks that would have to be larger than MAX_CHUNK_SIZE, or
+// smaller than MIN_CHUNK_SIZE.
+func (s *Server) checkChunkLayout(totalChunks int, fileSize int64) *uploadError {
+	if fileSize <= 0 {
+		return nil
+	}
+	if int64(totalChunks) > fileSize {
+		return &uploadError{http.StatusBadRequest, CodeInvalidTotalChunks,
+			fmt.Sprintf("totalChunks %d is more than fileSize %d", totalChunks, fileSize)}
+	}
+	if s.cfg.MaxChunkSize > 0 && fileSize > int64(totalChunks)*s.cfg.MaxChunkSize {
+		return &uploadError{http.StatusRequestEntityTooLarge, CodeChunkTooLarge,
+			fmt.Sprintf("fileSize %d in %d chunks needs chunks over the %d byte limit", fileSize, totalChunks, s.cfg.MaxChunkSize)}
+	}
+	// Every chunk but the last needs MIN_CHUNK_SIZE bytes, the last at least one.
+	if s.cfg.MinChunkSize > 0 && totalChunks > 1 && int64(totalChunks-1)*s.cfg.MinChunkSize >= fileSize {
+		return &uploadError{http.StatusBadRequest, CodeChunkTooSmall,
+			fmt.Sprintf("fileSize %d in %d chunks needs chunks under the %d byte minimum", fileSize, totalChunks, s.cfg.MinChunkSize)}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// Upload concurrency limits: server-wide (MAX_CONCURRENT_UPLOADS) and per
+// client (MAX_UPLOADS_PER_CLIENT), 0 = off
+// ---------------------------------------------------------------------
+const BusyRetryAfter = 1 // seconds suggested to clients on 503 and 429
+
+// clientUploads counts the upload requests each client has in flight.
+type clientUploads struct {
+	sync.Mutex
+	m map[string]int
+}
+
+// acquire counts one more upload for client unless it already has max.
+func (c *clientUploads) acquire(client string, max int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.m[client] >= max {
+		return false
+	}
+	c.m[client]++
+	return true
+}
+
+func (c *clientUploads) release(client string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.m[client]--; c.m[client] <= 0 {
+		delete(c.m, client)
+	}
+}
+
+// acquireUploadSlot takes a slot without blocking. On success the caller
+// must invoke the returned release func; on failure a 503 (server busy) or
+// 429 (client busy) has been sent. Every upload counts as in flight for
+// graceful shutdown, even when there is no concurrency limit.
+func (s *Server) acquireUploadSlot(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	done, ok := s.trackUpload(w)
+	if !ok {
+		return nil, false
+	}
+	if s.cfg.MaxUploadsPerClient > 0 {
+		client := s.clientKey(r)
+		if !s.perClient.acquire(client, s.cfg.MaxUploadsPerClient) {
+			done()
+			w.Header().Set("Retry-After", strconv.Itoa(BusyRetryAfter))
+			respondError(w, http.StatusTooManyRequests, CodeTooManyUploads,
+				"too many uploads in flight for %s: limit is %d", client, s.cfg.MaxUploadsPerClient)
+			return nil, false
+		}
+		trackDone := done
+		done = func() { s.perClient.release(client); trackDone() }
+	}
+	if s.slots == nil {
+		return done, true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots; done() }, true
+	default:
+		done()
+		w.Header().Set("Retry-After", strconv.Itoa(BusyRetryAfter))
+		respondError(w, http.StatusServiceUnavailable, CodeServerBusy, "server busy: %d uploads in progress", cap(s.slots))
+		return nil, false
+	}
+}
+
+// ---------------------------------------------------------------------
+// Rate limiting per client IP (RATE_LIMIT_RPS / RATE_LIMIT_BURST) and per
+// authenticated user (RATE_LIMIT_USER_RPS / RATE_LIMIT_USER_BURST)
+// ---------------------------------------------------------------------
+const (
+	RateLimitIdleTTL   = 10 * time.Minute
+	RateLimitSweepTick = time.Minute
+)
+
+// tokenBucket refills at rate tokens/sec up to burst.
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	rate  float64
+	burst float64
+	m     map[string]*tokenBucket
+}
+
+// newRateLimiter returns a limiter and starts its idle-bucket sweeper.
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	l := &rateLimiter{
+		rate:  rps,
+		burst: float64(burst),
+		m:     make(map[string]*tokenBucket),
+	}
+	go l.sweep()
+	return l
+}
+
+// allow takes one token for client. When the bucket is empty it returns
+// false and the wait until the next token is available.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.m[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.m[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	b.lastSeen = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) sweep() {
+	for range time.Tick(RateLimitSweepTick) {
+		cutoff := time.Now().Add(-RateLimitIdleTTL)
+		l.Lock()
+		for client, b := range l.m {
+			if b.lastSeen.Before(cutoff) {
+				delete(l.m, client)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+// clientIP returns the caller's address, preferring the first
+// X-Forwarded-For hop when running behind a trusted proxy.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.cfg.TrustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientKey identifies the caller for per-client limits: the
+// authenticated user, else the client IP.
+func (s *Server) clientKey(r *http.Request) string {
+	if p, ok := principalFrom(r.Context()); ok && p.Subject != "" {
+		return "user " + p.Subject
+	}
+	return s.clientIP(r)
+}
+
+// checkRateLimit sends a 429 and returns false when the client IP or the
+// authenticated user is over its budget.
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	now := s.now()
+	if s.limiter != nil {
+		ip := s.clientIP(r)
+		if ok, wait := s.limiter.allow(ip, now); !ok {
+			rateLimited(w, wait, "rate limit exceeded for %s", ip)
+			return false
+		}
+	}
+	if p, ok := principalFrom(r.Context()); ok && s.userLimiter != nil && p.Subject != "" {
+		if ok, wait := s.userLimiter.allow(p.Subject, now); !ok {
+			rateLimited(w, wait, "rate limit exceeded for user %s", p.Subject)
+			return false
+		}
+	}
+	return true
+}
+
+// rateLimited sends a 429 with Retry-After rounded up to whole seconds.
+func rateLimited(w http.ResponseWriter, wait time.Duration, format string, args ...any) {
+	retry := int(math.Ceil(wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	respondError(w, http.StatusTooManyRequests, CodeRateLimited, format, args...)
+}
+
+// ---------------------------------------------------------------------
+// Ingest bandwidth limits: server-wide (BANDWIDTH_LIMIT) and per upload
+// (UPLOAD_BANDWIDTH_LIMIT), in bytes per second of chunk data, 0 = off
+// ---------------------------------------------------------------------
+
+// ThrottleReadSize caps one read of a throttled chunk, so that the
+// bytes a reader waits for stay small next to the limit.
+const ThrottleReadSize = 32 << 10
+
+// byteBucket refills at rate bytes/sec up to burst. Readers take what they
+// read and may drive it negative; the debt is the wait of the next reader,
+// so concurrent uploads share the rate in turn.
+type byteBucket struct {
+	sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	lastSeen time.Time
+}
+
+func newByteBucket(rate int64, now time.Time) *byteBucket {
+	// One second's worth, but at least a read's.
+	burst := float64(max(rate, ThrottleReadSize))
+	return &byteBucket{rate: float64(rate), burst: burst, tokens: burst, last: now, lastSeen: now}
+}
+
+// take removes n bytes and returns how long the reader must wait until
+// the bucket is out of debt.
+func (b *byteBucket) take(n int, now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last, b.lastSeen = now, now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bandwidth holds the buckets chunk writes wait on. It is shared by the
+// tenants, so BANDWIDTH_LIMIT covers the whole process.
+type bandwidth struct {
+	global    *byteBucket // nil = no server-wide limit
+	perUpload int64       // 0 = no per-upload limit
+
+	mu      sync.Mutex
+	uploads map[string]*byteBucket // by tenant and upload key
+}
+
+// newBandwidth returns the limits cfg asks for, nil when both are off.
+func newBandwidth(cfg Config) *bandwidth {
+	if cfg.BandwidthLimit <= 0 && cfg.UploadBandwidthLimit <= 0 {
+		return nil
+	}
+	bw := &bandwidth{perUpload: cfg.UploadBandwidthLimit, uploads: make(map[string]*byteBucket)}
+	if cfg.BandwidthLimit > 0 {
+		bw.global = newByteBucket(cfg.BandwidthLimit, time.Now())
+	}
+	if bw.perUpload > 0 {
+		go bw.sweep()
+	}
+	return bw
+}
+
+// buckets returns the buckets a chunk of upload key waits on.
+func (bw *bandwidth) buckets(key string) []*byteBucket {
+	var out []*byteBucket
+	if bw.perUpload > 0 {
+		bw.mu.Lock()
+		b, ok := bw.uploads[key]
+		if !ok {
+			b = newByteBucket(bw.perUpload, time.Now())
+			bw.uploads[key] = b
+		}
+		bw.mu.Unlock()
+		out = append(out, b)
+	}
+	if bw.global != nil {
+		out = append(out, bw.global)
+	}
+	return out
+}
+
+// sweep drops the buckets of uploads idle for RateLimitIdleTTL.
+func (bw *bandwidth) sweep() {
+	for range time.Tick(RateLimitSweepTick) {
+		cutoff := time.Now().Add(-RateLimitIdleTTL)
+		bw.mu.Lock()
+		for key, b := range bw.uploads {
+			b.Lock()
+			idle := b.lastSeen.Before(cutoff)
+			b.Unlock()
+			if idle {
+				delete(bw.uploads, key)
+			}
+		}
+		bw.mu.Unlock()
+	}
+}
+
+// throttledReader reads from r no faster than its buckets allow, giving
+// up when ctx ends.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*byteBucket
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if len(p) > ThrottleReadSize {
+		p = p[:ThrottleReadSize]
+	}
+	n, err := t.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range t.buckets {
+		wait = max(wait, b.take(n, now))
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// throttle returns the chunk body src of upload key limited to
+// BANDWIDTH_LIMIT and UPLOAD_BANDWIDTH_LIMIT, and stopped by the end of
+// r's context like contextReader.
+func (s *Server) throttle(r *http.Request, key string, src io.Reader) io.Reader {
+	src = contextReader{ctx: r.Context(), r: src}
+	if s.bandwidth == nil {
+		return src
+	}
+	return throttledReader{ctx: r.Context(), r: src, buckets: s.bandwidth.buckets(s.tenant + "/" + key)}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+)
+
+// ---------------------------------------------------------------------
+// LOCK_URL: per-upload locks shared by replicas behind a load balancer
+// ---------------------------------------------------------------------
+
+// Lock backends.
+const (
+	LockRedis    = "redis"
+	LockPostgres = "postgres"
+)
+
+// parseLockURL reads LOCK_URL: comma-separated redis:// URLs (several make
+// a Redlock quorum) or one postgres:// URL.
+func parseLockURL(v string) (backend string, nodes []session.RedisNode, err error) {
+	if strings.HasPrefix(v, "postgres://") || strings.HasPrefix(v, "postgresql://") {
+		if strings.Contains(v, ",") {
+			return "", nil, fmt.Errorf("invalid LOCK_URL %q: one postgres:// URL only", v)
+		}
+		return LockPostgres, nil, nil
+	}
+	for _, u := range strings.Split(v, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		n, err := session.ParseRedisURL(u)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid LOCK_URL: %w", err)
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return "", nil, fmt.Errorf("invalid LOCK_URL %q: want redis:// or postgres:// URLs", v)
+	}
+	return LockRedis, nodes, nil
+}
+
+// openLocker connects to LOCK_URL, if configured and no Config.Locker
+// overrides it.
+func (s *Server) openLocker() error {
+	if s.cfg.LockURL == "" || s.cfg.Locker != nil {
+		return nil
+	}
+	backend, nodes, err := parseLockURL(s.cfg.LockURL)
+	if err != nil {
+		return err
+	}
+	if backend == LockRedis {
+		l := session.NewRedisLocks(nodes)
+		if s.cfg.LockTTL > 0 {
+			l.TTL = s.cfg.LockTTL
+		}
+		s.setLocker(l)
+		return nil
+	}
+	if !slices.Contains(sql.Drivers(), DriverPostgres) {
+		return fmt.Errorf("LOCK_URL: the %s driver is not compiled in (build with -tags postgres)", DriverPostgres)
+	}
+	db, err := sql.Open(DriverPostgres, s.cfg.LockURL)
+	if err != nil {
+		return err
+	}
+	s.setLocker(session.NewPostgresLocks(db))
+	return nil
+}
+
+// setLocker makes l the locker of s and, under their name, of its
+// tenants.
+func (s *Server) setLocker(l session.Locker) {
+	s.locks = l
+	for name, t := range s.tenants {
+		t.locks = session.Prefixed(l, name+"/")
+	}
+}
+
+// closeLocker releases the connections of a LOCK_URL locker.
+func (s *Server) closeLocker() error {
+	if c, ok := s.locks.(io.Closer); ok && s.cfg.Locker == nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// restoreReceived seeds the chunks tracked for key from those persisted in
+// its metadata. With locks shared by other processes, the metadata wins:
+// another replica may have stored chunks since this one last saw the
+// upload.
+func (s *Server) restoreReceived(key string, chunks map[int]int64) {
+	if _, local := s.locks.(*session.Locks); local {
+		s.received.Restore(key, chunks)
+		return
+	}
+	s.received.Replace(key, chunks)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+)
+
+// ---------------------------------------------------------------------
+// Structured logging (LOG_FORMAT, LOG_LEVEL) with a request ID on every
+// line logged while serving a request, and an upload ID once known
+// ---------------------------------------------------------------------
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	RequestIDHeader = "X-Request-ID"
+)
+
+// validRequestID accepts a caller's X-Request-ID only if it is short and
+// cannot forge log structure.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// NewLogger returns the process logger for format and level.
+func NewLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// parseLogLevel reads LOG_LEVEL: debug, info, warn or error.
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("invalid LOG_LEVEL %q: want debug, info, warn or error", v)
+	}
+	return level, nil
+}
+
+// requestRecorder is per-request state shared by the middleware and the
+// handlers: the request's logger and span, and the status and error code
+// of its response for the access log and metrics.
+type requestRecorder struct {
+	http.ResponseWriter
+	log     *slog.Logger
+	span    *span // nil = not traced
+	status  int
+	code    string // ErrorResponse.Code, set by noteErrorCode
+	upload  string // upload_id already attached to log
+	user    string // set by tagUser, for the audit log
+	written int64  // body bytes sent
+}
+
+func (rec *requestRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *requestRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (rec *requestRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type recorderKey struct{}
+
+// logFor returns the logger of the request w answers, or the default
+// logger outside of a request (and in tests calling handlers directly).
+func logFor(w http.ResponseWriter) *slog.Logger {
+	if rec, ok := w.(*requestRecorder); ok {
+		return rec.log
+	}
+	return slog.Default()
+}
+
+// logCtx is logFor for code that has the request but not its writer.
+func logCtx(ctx context.Context) *slog.Logger {
+	if rec, ok := ctx.Value(recorderKey{}).(*requestRecorder); ok {
+		return rec.log
+	}
+	return slog.Default()
+}
+
+// tagUpload adds upload_id to every later log line of the request w
+// answers and upload.id to its span, so all chunks of one upload can be
+// correlated, and returns the tagged logger.
+func tagUpload(w http.ResponseWriter, id string) *slog.Logger {
+	rec, ok := w.(*requestRecorder)
+	if !ok {
+		return slog.Default().With("upload_id", id)
+	}
+	if rec.upload == "" {
+		rec.log = rec.log.With("upload_id", id)
+		rec.upload = id
+		rec.span.set("upload.id", id)
+	}
+	return rec.log
+}
+
+// tagUser adds the authenticated user to every later log line of the
+// request w answers.
+func tagUser(w http.ResponseWriter, subject string) {
+	if rec, ok := w.(*requestRecorder); ok {
+		rec.log = rec.log.With("user", subject)
+		rec.user = subject
+	}
+}
+
+// noteErrorCode records why a request failed, for the access log and
+// metrics.
+func noteErrorCode(w http.ResponseWriter, code string) {
+	if rec, ok := w.(*requestRecorder); ok {
+		rec.code = code
+	}
+}
+
+// instrument is the outermost middleware of every route: it assigns the
+// request ID (the caller's X-Request-ID if valid, else a new one), echoes
+// it in the response, starts the request's span, logs one access line per
+// request, feeds the metrics for route (the ServeMux pattern minus the
+// method) and writes the audit record of the audited routes.
+func (s *Server) instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := s.now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = session.NewID(); err != nil {
+				id = "-"
+			}
+		}
+		w.Header().Set(RequestIDHeader, id)
+		log := slog.Default().With("request_id", id)
+		if s.tenant != "" {
+			log = log.With("tenant", s.tenant)
+		}
+		sp := s.tracer.startRequest(r, route)
+		if sp != nil {
+			log = log.With("trace_id", sp.traceIDHex())
+			sp.set("http.request_id", id)
+		}
+		rec := &requestRecorder{ResponseWriter: w, log: log, span: sp}
+		next(rec, r.WithContext(context.WithValue(r.Context(), recorderKey{}, rec)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		sp.set("http.response.status_code", rec.status)
+		if rec.code != "" {
+			sp.set("error.code", rec.code)
+		}
+		if rec.status >= 500 {
+			sp.fail(http.StatusText(rec.status))
+		}
+		sp.finish()
+		took := s.now().Sub(start)
+		s.metrics.request(route, r.Method, rec.status, rec.code, took)
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "status", rec.status, "duration_ms", took.Milliseconds()}
+		if rec.code != "" {
+			attrs = append(attrs, "code", rec.code)
+		}
+		rec.log.Info("request", attrs...)
+		s.audit(route, id, r, rec)
+	}
+}
+
+// logLevelFor is the level for an error response: server faults are
+// errors, client mistakes warnings.
+func logLevelFor(status int) slog.Level {
+	if status >= 500 && status != http.StatusServiceUnavailable {
+		return slog.LevelError
+	}
+	return slog.LevelWarn
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Per-upload metadata (storage.Meta, stored next to the .part file)
+// ---------------------------------------------------------------------
+
+// saveReceived persists the chunks tracked for key into meta (nil = an
+// upload without metadata, nothing to do).
+func (s *Server) saveReceived(key string, meta *storage.Meta) {
+	if meta == nil {
+		return
+	}
+	meta.Received = s.received.Snapshot(key)
+	if err := s.store.SaveMeta(key, meta); err != nil {
+		slog.Warn("cannot save received chunks", "key", key, "error", err)
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// GET /metrics: Prometheus text exposition format, written by hand since
+// a few counters and histograms need no client library
+// ---------------------------------------------------------------------
+
+// Histogram buckets, in seconds.
+var (
+	requestBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	uploadBuckets  = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 4 * 3600, 24 * 3600}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []int64 // per bucket, not cumulative
+	sum     float64
+	count   int64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+}
+
+// write prints h as name with the extra labels (`route="/upload",` or "").
+func (h *histogram) write(w *bufio.Writer, name, labels string) {
+	var cum int64
+	for i, le := range h.buckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, le, cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type requestKey struct{ route, method, status string }
+type failureKey struct{ route, reason string }
+
+// metrics holds the counters and histograms since startup.
+type metrics struct {
+	sync.Mutex
+	chunks       int64
+	bytes        int64
+	completed    int64
+	requests     map[requestKey]int64
+	failures     map[failureKey]int64
+	requestTimes map[string]*histogram // by route
+	uploadTimes  *histogram            // first chunk to finalized file
+	encoded      map[string]*encodedBytes
+}
+
+// encodedBytes counts the compressed request bodies of one encoding.
+type encodedBytes struct {
+	bodies, wire, raw int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     make(map[requestKey]int64),
+		failures:     make(map[failureKey]int64),
+		requestTimes: make(map[string]*histogram),
+		uploadTimes:  newHistogram(uploadBuckets),
+		encoded:      map[string]*encodedBytes{EncodingGzip: {}, EncodingZstd: {}},
+	}
+}
+
+// chunkWritten counts one stored chunk (or tus PATCH) of n bytes.
+func (m *metrics) chunkWritten(n int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.chunks++
+	m.bytes += n
+}
+
+// bodyDecoded counts a compressed body of wire bytes that decompressed to
+// raw bytes.
+func (m *metrics) bodyDecoded(encoding string, wire, raw int64) {
+	m.Lock()
+	defer m.Unlock()
+	e := m.encoded[encoding]
+	e.bodies++
+	e.wire += wire
+	e.raw += raw
+}
+
+// uploadCompleted counts a finalized file; d is 0 when its start time is
+// unknown.
+func (m *metrics) uploadCompleted(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.completed++
+	if d > 0 {
+		m.uploadTimes.observe(d.Seconds())
+	}
+}
+
+func (m *metrics) request(route, method string, status int, reason string, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[requestKey{route, method, strconv.Itoa(status)}]++
+	if status >= 400 {
+		if reason == "" {
+			reason = "HTTP_" + strconv.Itoa(status)
+		}
+		m.failures[failureKey{route, reason}]++
+	}
+	h, ok := m.requestTimes[route]
+	if !ok {
+		h = newHistogram(requestBuckets)
+		m.requestTimes[route] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// dirBytes sums the sizes of the regular files under dir, leaving out the
+// server's own tables.
+func dirBytes(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && !isServerState(d.Name()) {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total, err
+}
+
+// metricsHandler writes every metric; gauges are sampled at scrape time.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	m := s.metrics
+	m.Lock()
+	metric("chunkupload_chunks_received_total", "counter", "Chunks (and tus PATCH requests) stored.")
+	fmt.Fprintf(out, "chunkupload_chunks_received_total %d\n", m.chunks)
+	metric("chunkupload_bytes_written_total", "counter", "Bytes of upload data stored.")
+	fmt.Fprintf(out, "chunkupload_bytes_written_total %d\n", m.bytes)
+	metric("chunkupload_uploads_completed_total", "counter", "Uploads moved into place.")
+	fmt.Fprintf(out, "chunkupload_uploads_completed_total %d\n", m.completed)
+
+	metric("chunkupload_compressed_bodies_total", "counter", "Chunk bodies sent with a Content-Encoding, by encoding.")
+	for _, enc := range chunkEncodings {
+		fmt.Fprintf(out, "chunkupload_compressed_bodies_total{encoding=%q} %d\n", enc, m.encoded[enc].bodies)
+	}
+	metric("chunkupload_compressed_wire_bytes_total", "counter", "Bytes of compressed chunk bodies as received.")
+	for _, enc := range chunkEncodings {
+		fmt.Fprintf(out, "chunkupload_compressed_wire_bytes_total{encoding=%q} %d\n", enc, m.encoded[enc].wire)
+	}
+	metric("chunkupload_compressed_raw_bytes_total", "counter", "Bytes that compressed chunk bodies decompressed to.")
+	for _, enc := range chunkEncodings {
+		fmt.Fprintf(out, "chunkupload_compressed_raw_bytes_total{encoding=%q} %d\n", enc, m.encoded[enc].raw)
+	}
+
+	metric("chunkupload_requests_total", "counter", "HTTP requests by route, method and status.")
+	reqKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	sort.Slice(reqKeys, func(i, j int) bool {
+		a, b := reqKeys[i], reqKeys[j]
+		return a.route+" "+a.method+" "+a.status < b.route+" "+b.method+" "+b.status
+	})
+	for _, k := range reqKeys {
+		fmt.Fprintf(out, "chunkupload_requests_total{route=%q,method=%q,status=%q} %d\n", k.route, k.method, k.status, m.requests[k])
+	}
+
+	metric("chunkupload_request_failures_total", "counter", "Failed requests by route and error code (the reason).")
+	failKeys := make([]failureKey, 0, len(m.failures))
+	for k := range m.failures {
+		failKeys = append(failKeys, k)
+	}
+	sort.Slice(failKeys, func(i, j int) bool {
+		a, b := failKeys[i], failKeys[j]
+		return a.route+" "+a.reason < b.route+" "+b.reason
+	})
+	for _, k := range failKeys {
+		fmt.Fprintf(out, "chunkupload_request_failures_total{route=%q,reason=%q} %d\n", k.route, k.reason, m.failures[k])
+	}
+
+	metric("chunkupload_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	routes := make([]string, 0, len(m.requestTimes))
+	for route := range m.requestTimes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		m.requestTimes[route].write(out, "chunkupload_request_duration_seconds", fmt.Sprintf("route=%q,", route))
+	}
+	metric("chunkupload_upload_duration_seconds", "histogram", "Time from an upload's start to its file being stored.")
+	m.uploadTimes.write(out, "chunkupload_upload_duration_seconds", "")
+	m.Unlock()
+
+	var sessions, inProgress int
+	for _, srv := range s.servers() {
+		sessions += srv.sessions.Len()
+		inProgress += len(srv.received.Keys())
+	}
+	metric("chunkupload_active_sessions", "gauge", "Upload sessions (POST /upload/init and tus) not yet finished.")
+	fmt.Fprintf(out, "chunkupload_active_sessions %d\n", sessions)
+	metric("chunkupload_uploads_in_progress", "gauge", "Unfinished uploads with chunks received by this process.")
+	fmt.Fprintf(out, "chunkupload_uploads_in_progress %d\n", inProgress)
+
+	metric("chunkupload_dir_bytes", "gauge", "Bytes of files in the upload and part directories.")
+	for _, d := range []struct{ label, path string }{{"temp", s.cfg.TempDir}, {"upload", s.cfg.UploadDir}} {
+		if d.label == "temp" && s.cfg.TempDir == s.cfg.UploadDir {
+			continue // counted once, as "upload"
+		}
+		n, err := dirBytes(d.path)
+		if err != nil {
+			slog.Warn("metrics: cannot size directory", "dir", d.path, "error", err)
+			continue
+		}
+		fmt.Fprintf(out, "chunkupload_dir_bytes{dir=%q} %d\n", d.label, n)
+	}
+	if avail, err := s.store.Available(); err == nil && avail >= 0 {
+		metric("chunkupload_free_bytes", "gauge", "Free space for uploads.")
+		fmt.Fprintf(out, "chunkupload_free_bytes %d\n", avail)
+	}
+	if s.cfg.MinFreeSpace > 0 {
+		metric("chunkupload_min_free_bytes", "gauge", "MIN_FREE_SPACE: free space below which new uploads are refused.")
+		fmt.Fprintf(out, "chunkupload_min_free_bytes %d\n", s.cfg.MinFreeSpace)
+		low := 0
+		if _, ok := s.lowOnSpace(); ok {
+			low = 1
+		}
+		metric("chunkupload_storage_low", "gauge", "1 while free space is below MIN_FREE_SPACE and new uploads are refused.")
+		fmt.Fprintf(out, "chunkupload_storage_low %d\n", low)
+	}
+
+	js := s.janitorStats()
+	metric("chunkupload_janitor_runs_total", "counter", "Stale upload scans.")
+	fmt.Fprintf(out, "chunkupload_janitor_runs_total %d\n", js.Runs)
+	metric("chunkupload_janitor_removed_total", "counter", "Stale uploads deleted.")
+	fmt.Fprintf(out, "chunkupload_janitor_removed_total %d\n", js.Removed)
+	metric("chunkupload_janitor_freed_bytes_total", "counter", "Bytes freed by deleting stale uploads.")
+	fmt.Fprintf(out, "chunkupload_janitor_freed_bytes_total %d\n", js.FreedBytes)
+	metric("chunkupload_janitor_errors_total", "counter", "Stale uploads the janitor failed to delete.")
+	fmt.Fprintf(out, "chunkupload_janitor_errors_total %d\n", js.Errors)
+	metric("chunkupload_janitor_expired_total", "counter", "Completed files deleted after their retention period.")
+	fmt.Fprintf(out, "chunkupload_janitor_expired_total %d\n", js.Expired)
+	metric("chunkupload_janitor_expired_bytes_total", "counter", "Bytes freed by deleting expired files.")
+	fmt.Fprintf(out, "chunkupload_janitor_expired_bytes_total %d\n", js.ExpiredBytes)
+}
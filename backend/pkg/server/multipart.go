@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// ---------------------------------------------------------------------
+// Streaming multipart chunks: fields are read as they arrive and the
+// "chunk" part goes straight from the socket to storage when possible
+// ---------------------------------------------------------------------
+
+// errChunkLength means a streamed chunk did not match its chunkLength.
+var errChunkLength = errors.New("chunk does not match chunkLength")
+
+// chunkForm is a POST /upload body read with r.MultipartReader. The chunk
+// part is streamed when the client declared its size in a chunkLength
+// field sent before it and no chunk checksum has to be verified first;
+// otherwise it is buffered, MAX_MEMORY bytes in memory and the rest in the
+// OS temp dir, and the fields after it are read too.
+type chunkForm struct {
+	streamed io.Reader // the unread chunk part, limited to length
+	length   int64
+	buffered io.ReadSeeker
+	spooled  *spooledChunk
+}
+
+// readChunkForm reads r's multipart body up to the chunk (or to its end)
+// and sets r.Form to the URL query plus the fields read. The caller must
+// Close the form.
+func (s *Server) readChunkForm(r *http.Request) (*chunkForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := r.URL.Query()
+	r.Form, r.PostForm = form, url.Values{}
+	c := &chunkForm{}
+	fieldBudget := int64(MultipartOverhead) // shared by every field
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return c, nil
+		}
+		if err != nil {
+			return c, err
+		}
+		if part.FormName() != "chunk" {
+			var v bytes.Buffer
+			n, err := io.Copy(&v, io.LimitReader(part, fieldBudget+1))
+			if err != nil {
+				return c, err
+			}
+			if fieldBudget -= n; fieldBudget < 0 {
+				return c, fmt.Errorf("form fields over %d bytes", MultipartOverhead)
+			}
+			form.Add(part.FormName(), v.String())
+			r.PostForm.Add(part.FormName(), v.String())
+			continue
+		}
+		if c.streamed != nil || c.buffered != nil {
+			return c, errors.New("more than one chunk part")
+		}
+		n, err := parseChunkLength(form.Get("chunkLength"))
+		if err != nil {
+			return c, err
+		}
+		if n >= 0 && len(chunkChecksums(r, form.Get("checksumAlgo"))) == 0 {
+			c.streamed, c.length = &exactReader{r: part, n: n}, n
+			return c, nil
+		}
+		if err := c.buffer(part, s.cfg.MaxMemory); err != nil {
+			return c, err
+		}
+	}
+}
+
+// parseChunkLength reads the optional chunkLength field; -1 when unset.
+func parseChunkLength(v string) (int64, error) {
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid chunkLength %q", v)
+	}
+	return n, nil
+}
+
+// buffer reads the chunk part into memory, spilling to a temp file past
+// maxMemory bytes.
+func (c *chunkForm) buffer(part io.Reader, maxMemory int64) error {
+	var mem bytes.Buffer
+	n, err := io.CopyN(&mem, part, maxMemory+1)
+	if err == io.EOF {
+		c.buffered, c.length = bytes.NewReader(mem.Bytes()), n
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "chunk-*")
+	if err != nil {
+		return err
+	}
+	c.spooled = &spooledChunk{f}
+	if _, err := f.Write(mem.Bytes()); err != nil {
+		return err
+	}
+	rest, err := io.Copy(f, part)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	c.buffered, c.length = f, n+rest
+	return nil
+}
+
+// source hands the chunk to receiveChunk.
+func (c *chunkForm) source(_ *http.Request, seekable bool) (io.Reader, int64, *uploadError) {
+	switch {
+	case c.buffered != nil:
+		return c.buffered, c.length, nil
+	case c.streamed != nil && !seekable:
+		return c.streamed, c.length, nil
+	case c.streamed != nil:
+		return nil, 0, &uploadError{http.StatusBadRequest, CodeInvalidRequest, "chunk checksum fields must come before a streamed chunk"}
+	}
+	return nil, 0, &uploadError{http.StatusBadRequest, CodeMissingChunk, "missing chunk: no chunk part"}
+}
+
+// Close removes the temp file of a spilled chunk.
+func (c *chunkForm) Close() error {
+	if c == nil || c.spooled == nil {
+		return nil
+	}
+	return c.spooled.Close()
+}
+
+// exactReader reads exactly n bytes from r, failing with errChunkLength
+// when r ends early or holds more.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		var one [1]byte
+		if n, _ := io.ReadFull(e.r, one[:]); n > 0 {
+			return 0, fmt.Errorf("%w: more data follows", errChunkLength)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		return n, fmt.Errorf("%w: %d bytes short", errChunkLength, e.n)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"html/template"
+	"maps"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// GET /openapi.json: an OpenAPI 3 description of the upload API, built
+// from apiOperations and the Go types of its requests and responses; GET
+// /docs renders it with Swagger UI
+// ---------------------------------------------------------------------
+
+// OpenAPIVersion is the version of the OpenAPI specification served.
+const OpenAPIVersion = "3.0.3"
+
+// SwaggerUIVersion is the swagger-ui-dist release /docs loads from
+// SwaggerUICDN.
+const (
+	SwaggerUIVersion = "5.17.14"
+	SwaggerUICDN     = "https://unpkg.com/swagger-ui-dist@" + SwaggerUIVersion
+)
+
+// apiOperation documents one method of a route registered in Routes.
+// Form, Query and JSON are structs whose json-tagged fields are the
+// parameters; a field without omitempty is required and its doc tag
+// describes it.
+type apiOperation struct {
+	Method, Path string
+	ID, Summary  string
+	Group        string // auth group, see AuthRoutes
+
+	Query any    // query parameters
+	Form  any    // urlencoded or multipart form fields
+	JSON  any    // JSON request body
+	Raw   string // description of a raw request body
+	Reply any    // JSON response; nil answers 204 No Content
+}
+
+type initForm struct {
+	FileName    string `json:"fileName" doc:"name the completed file is stored under"`
+	TotalChunks int    `json:"totalChunks" doc:"number of chunks the file is sent in"`
+	FileSize    int64  `json:"fileSize,omitempty" doc:"size of the whole file in bytes"`
+	Retention   string `json:"retention,omitempty" doc:"delete the completed file after this long, e.g. 36h or 7d"`
+	Extract     bool   `json:"extract,omitempty" doc:"unpack the completed zip next to it"`
+	ExtractTo   string `json:"extractTo,omitempty" doc:"directory to unpack it under, default the archive's name without its extension"`
+	Encryption  string `json:"encryption,omitempty" doc:"client-side encryption manifest as JSON: algorithm, wrappedKey, one base64 IV per chunk and optional keyID and plaintextSize"`
+}
+
+type postChunkForm struct {
+	Chunk        []byte `json:"chunk" doc:"the chunk's bytes"`
+	Index        int    `json:"index" doc:"0-based chunk index"`
+	TotalChunks  int    `json:"totalChunks"`
+	FileName     string `json:"fileName"`
+	UploadID     string `json:"uploadID,omitempty" doc:"session from POST /upload/init"`
+	BatchID      string `json:"batchID,omitempty" doc:"batch from POST /batches, with fileIndex instead of uploadID"`
+	FileIndex    int    `json:"fileIndex,omitempty"`
+	FileSize     int64  `json:"fileSize,omitempty" doc:"size of the whole file; required with offset or chunkSize"`
+	Offset       int64  `json:"offset,omitempty" doc:"byte offset of the chunk, for chunks sent in any order"`
+	ChunkSize    int64  `json:"chunkSize,omitempty" doc:"size of every chunk but the last, instead of offset"`
+	Mode         string `json:"mode,omitempty" doc:"separate stores each chunk on its own until POST /upload/{uploadID}/complete"`
+	ChecksumAlgo string `json:"checksumAlgo,omitempty" doc:"crc32, md5 or sha256"`
+	ChunkHash    string `json:"chunkHash,omitempty" doc:"hex checksum of the chunk in checksumAlgo"`
+	FileMd5      string `json:"fileMd5,omitempty" doc:"hex MD5 of the whole file, checked on the last chunk"`
+	FileSha256   string `json:"fileSha256,omitempty" doc:"hex SHA-256 of the whole file, checked on the last chunk"`
+}
+
+type completeForm struct {
+	Hash string `json:"hash,omitempty" doc:"hex SHA-256 of the whole file"`
+}
+
+type listQuery struct {
+	Status string `json:"status,omitempty" doc:"in_progress or complete"`
+	Owner  string `json:"owner,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+	Limit  int    `json:"limit,omitempty" doc:"1 to 1000, default 100"`
+}
+
+type existsQuery struct {
+	Hash string `json:"hash" doc:"hex SHA-256 of the whole file"`
+}
+
+type activeStatsQuery struct {
+	Top int `json:"top,omitempty" doc:"how many of the largest uploads to list, 0 to 100, default 10"`
+}
+
+// rawChunk describes the body of the PUT chunk routes.
+const rawChunk = "The chunk's bytes. The other POST /upload fields may be sent as X-Upload-<field> headers."
+
+// apiOperations are the operations /openapi.json describes.
+var apiOperations = []apiOperation{
+	{Method: http.MethodPost, Path: "/upload/init", ID: "initUpload", Summary: "Start an upload session",
+		Group: AuthUpload, Form: initForm{}, Reply: InitResponse{}},
+	{Method: http.MethodGet, Path: "/upload/config", ID: "getUploadConfig", Summary: "Chunk sizes and limits to upload with",
+		Group: AuthStatus, Reply: UploadConfig{}},
+	{Method: http.MethodPost, Path: "/upload", ID: "uploadChunk", Summary: "Send one chunk as a multipart form",
+		Group: AuthUpload, Form: postChunkForm{}, Reply: SuccessResponse{}},
+	{Method: http.MethodPut, Path: "/upload/{uploadID}/chunk/{index}", ID: "putChunk", Summary: "Send one chunk of a session as the request body",
+		Group: AuthUpload, Raw: rawChunk, Reply: SuccessResponse{}},
+	{Method: http.MethodGet, Path: "/upload/{uploadID}/status", ID: "getUploadStatus", Summary: "List the chunks of a session received so far",
+		Group: AuthStatus, Reply: StatusResponse{}},
+	{Method: http.MethodPost, Path: "/upload/{uploadID}/pause", ID: "pauseUpload", Summary: "Save a session's state and refuse its chunks until resumed",
+		Group: AuthUpload, Reply: StatusResponse{}},
+	{Method: http.MethodPost, Path: "/upload/{uploadID}/resume", ID: "resumeUpload", Summary: "Take chunks of a paused session again",
+		Group: AuthUpload, Reply: StatusResponse{}},
+	{Method: http.MethodPost, Path: "/upload/{uploadID}/complete", ID: "completeUpload", Summary: "Assemble a mode=separate upload",
+		Group: AuthUpload, Form: completeForm{}, Reply: SuccessResponse{}},
+	{Method: http.MethodDelete, Path: "/upload/{uploadID}", ID: "abortUpload", Summary: "Abort an unfinished session",
+		Group: AuthUpload},
+	{Method: http.MethodPost, Path: "/batches", ID: "startBatch", Summary: "Start sessions for a set of files",
+		Group: AuthUpload, JSON: BatchRequest{}, Reply: BatchResponse{}},
+	{Method: http.MethodGet, Path: "/batches/{batchID}", ID: "getBatch", Summary: "Report every file of a batch",
+		Group: AuthStatus, Reply: BatchResponse{}},
+	{Method: http.MethodDelete, Path: "/batches/{batchID}", ID: "abortBatch", Summary: "Abort the unfinished files of a batch",
+		Group: AuthUpload},
+	{Method: http.MethodPut, Path: "/batches/{batchID}/files/{fileIndex}/chunks/{index}", ID: "putBatchChunk", Summary: "Send one chunk of a batch file",
+		Group: AuthUpload, Raw: rawChunk, Reply: SuccessResponse{}},
+	{Method: http.MethodPost, Path: "/batches/{batchID}/complete", ID: "completeBatch", Summary: "Finish a batch and get its manifest",
+		Group: AuthUpload, Reply: BatchManifest{}},
+	{Method: http.MethodGet, Path: "/exists", ID: "fileExists", Summary: "Ask whether a file with this content is stored",
+		Group: AuthStatus, Query: existsQuery{}, Reply: ExistsResponse{}},
+	{Method: http.MethodGet, Path: "/uploads", ID: "listUploads", Summary: "List unfinished uploads and completed files",
+		Group: AuthManage, Query: listQuery{}, Reply: UploadListResponse{}},
+	{Method: http.MethodGet, Path: "/uploads/{id}", ID: "getUpload", Summary: "Describe one upload or file",
+		Group: AuthManage, Reply: UploadInfo{}},
+	{Method: http.MethodDelete, Path: "/uploads/{id}", ID: "deleteUpload", Summary: "Delete an upload or a completed file",
+		Group: AuthManage},
+	{Method: http.MethodGet, Path: "/stats/active", ID: "getActiveStats", Summary: "Totals of the uploads in progress, for dashboards",
+		Group: AuthMetrics, Query: activeStatsQuery{}, Reply: ActiveStats{}},
+}
+
+// openAPISpec builds the OpenAPI document, with its server at prefix.
+func (s *Server) openAPISpec(prefix string) map[string]any {
+	sb := schemaBuilder{defs: map[string]any{}}
+	errorReply := map[string]any{"description": "Error; branch on code",
+		"content": jsonContent(sb.schema(reflect.TypeOf(ErrorResponse{})))}
+	paths := map[string]any{}
+	for _, op := range apiOperations {
+		o := map[string]any{"operationId": op.ID, "summary": op.Summary, "tags": []string{op.Group}}
+		var params []any
+		for _, name := range pathParams(op.Path) {
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		if op.Query != nil {
+			for _, f := range sb.fields(reflect.TypeOf(op.Query)) {
+				params = append(params, map[string]any{"name": f.name, "in": "query", "required": f.required, "schema": withDoc(f.schema, f.doc)})
+			}
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		switch {
+		case op.Form != nil:
+			form := sb.schema(reflect.TypeOf(op.Form))
+			content := map[string]any{"multipart/form-data": map[string]any{"schema": form}}
+			if _, ok := op.Form.(postChunkForm); !ok {
+				content["application/x-www-form-urlencoded"] = map[string]any{"schema": form}
+			}
+			o["requestBody"] = map[string]any{"required": true, "content": content}
+		case op.JSON != nil:
+			o["requestBody"] = map[string]any{"required": true, "content": jsonContent(sb.schema(reflect.TypeOf(op.JSON)))}
+		case op.Raw != "":
+			o["requestBody"] = map[string]any{"required": true, "description": op.Raw,
+				"content": map[string]any{"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}}
+		}
+		responses := map[string]any{"default": errorReply}
+		if op.Reply != nil {
+			responses["200"] = map[string]any{"description": "OK", "content": jsonContent(sb.schema(reflect.TypeOf(op.Reply)))}
+		} else {
+			responses["204"] = map[string]any{"description": "Done"}
+		}
+		o["responses"] = responses
+		if s.auth != nil && s.authRoutes[op.Group] {
+			o["security"] = []any{map[string]any{"apiKey": []string{}}, map[string]any{"bearer": []string{}}}
+		}
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	server := map[string]any{"url": prefix + "/"}
+	if s.cfg.TenantMode == TenantByPath && prefix == "" {
+		names := s.cfg.tenantNames()
+		server = map[string]any{"url": TenantPathPrefix + "{tenant}/",
+			"variables": map[string]any{"tenant": map[string]any{"default": names[0], "enum": names}}}
+	}
+	return map[string]any{
+		"openapi": OpenAPIVersion,
+		"info": map[string]any{"title": "Chunk Upload API", "version": "1",
+			"description": "Chunked, resumable file uploads. Errors carry a stable code and whether resending may succeed."},
+		"servers": []any{server},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": sb.defs,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// pathParams returns the {name} wildcards of a route pattern.
+func pathParams(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(seg, "{"); ok {
+			names = append(names, strings.TrimSuffix(name, "}"))
+		}
+	}
+	return names
+}
+
+// schemaBuilder turns Go types into JSON schemas, following encoding/json.
+// Exported struct types become components in defs and are referenced.
+type schemaBuilder struct {
+	defs map[string]any
+}
+
+// schemaField is one JSON property of a struct.
+type schemaField struct {
+	name, doc string
+	required  bool
+	schema    map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (sb *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return sb.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "binary"}
+		}
+		return map[string]any{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if !isExported(t.Name()) {
+			return sb.object(t)
+		}
+		if _, ok := sb.defs[t.Name()]; !ok {
+			sb.defs[t.Name()] = map[string]any{} // a type that refers to itself finds the ref
+			sb.defs[t.Name()] = sb.object(t)
+		}
+		return ref
+	}
+	return map[string]any{}
+}
+
+// object is the schema of struct type t.
+func (sb *schemaBuilder) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	for _, f := range sb.fields(t) {
+		props[f.name] = withDoc(f.schema, f.doc)
+		if f.required {
+			required = append(required, f.name)
+		}
+	}
+	obj := map[string]any{"type": "object", "properties": props}
+	if required != nil {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// withDoc adds a description to schema; a $ref allows no siblings, so it
+// is wrapped.
+func withDoc(schema map[string]any, doc string) map[string]any {
+	if doc == "" {
+		return schema
+	}
+	if _, ok := schema["$ref"]; ok {
+		return map[string]any{"allOf": []any{schema}, "description": doc}
+	}
+	out := maps.Clone(schema)
+	out["description"] = doc
+	return out
+}
+
+// fields lists the JSON properties of struct type t, with those of
+// embedded structs, as encoding/json would marshal them.
+func (sb *schemaBuilder) fields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, sb.fields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, schemaField{name: name, doc: f.Tag.Get("doc"),
+			required: !strings.Contains(opts, "omitempty"), schema: sb.schema(f.Type)})
+	}
+	return fields
+}
+
+func isExported(name string) bool {
+	return name != "" && strings.ToUpper(name[:1]) == name[:1]
+}
+
+// openAPIHandler serves the OpenAPI document.
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	respondJSON(w, http.StatusOK, s.openAPISpec(mountPrefix(r)))
+}
+
+var docsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Chunk Upload API</title>
+<link rel="stylesheet" href="{{.CDN}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.CDN}}/swagger-ui-bundle.js" crossorigin></script>
+<script>
+window.ui = SwaggerUIBundle({ url: {{.Spec}}, dom_id: "#swagger-ui" });
+</script>
+</body>
+</html>
+`))
+
+// docsHandler serves Swagger UI for /openapi.json. The UI's scripts come
+// from SwaggerUICDN, so the browser needs to reach it.
+func (s *Server) docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := docsPage.Execute(w, struct{ CDN, Spec string }{SwaggerUICDN, mountPrefix(r) + "/openapi.json"}); err != nil {
+		logFor(w).Warn("cannot render docs page", "error", err)
+	}
+}
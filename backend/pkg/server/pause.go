@@ -0,0 +1,95 @@
+package server
+
+import "net/http"
+
+// ---------------------------------------------------------------------
+// Pause and resume: POST /upload/{uploadID}/pause saves where a session
+// stands and refuses its chunks until POST /upload/{uploadID}/resume,
+// which any client holding the uploadID (and the owner's credentials)
+// may send, hours later and from another device
+// ---------------------------------------------------------------------
+
+// pauseHandler waits for the session's chunks in flight, saves which
+// chunks are stored to its metadata, drops the in-memory state and
+// answers with the session's status.
+func (s *Server) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, true)
+}
+
+// resumeHandler lets a paused session take chunks again and answers with
+// its status, whose missingChunks are what is left to send.
+func (s *Server) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, false)
+}
+
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, pause bool) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	sess, uerr := s.lookupSession(r.PathValue("uploadID"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	tagUpload(w, sess.ID)
+	if sess.Direct != "" {
+		respondError(w, http.StatusBadRequest, CodeUploadMismatch,
+			"upload %s is direct: its parts go to the bucket, not through the server", sess.ID)
+		return
+	}
+
+	// Taking the lock lets the chunk being written finish first.
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.sessionAborted(w, sess) {
+		return
+	}
+	meta, err := s.store.LoadMeta(sess.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot load upload metadata: %v", err)
+		return
+	}
+	if !s.canManage(r, UploadInfo{Owner: meta.Owner}) {
+		// Don't reveal other users' uploads.
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown uploadID %s", sess.ID)
+		return
+	}
+
+	s.restoreReceived(sess.ID, meta.Received)
+	switch {
+	case pause && meta.PausedAt == nil:
+		at := s.now().UTC()
+		meta.PausedAt = &at
+	case !pause:
+		meta.PausedAt = nil
+	}
+	meta.Received = s.received.Snapshot(sess.ID)
+	if err := s.store.SaveMeta(sess.ID, meta); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot save upload metadata: %v", err)
+		return
+	}
+	resp := s.sessionStatus(sess)
+	if pause {
+		s.paused.Store(sess.ID, *meta.PausedAt)
+		// The metadata now holds the state; whoever resumes reloads it.
+		s.received.Forget(sess.ID)
+		s.publish(sess.ID, UploadEvent{Type: EventPaused, FileName: sess.FileName, Received: resp.Received})
+		logFor(w).Info("upload paused", "received_chunks", len(resp.ReceivedChunks), "total_chunks", sess.TotalChunks)
+	} else {
+		s.paused.Delete(sess.ID)
+		s.publish(sess.ID, UploadEvent{Type: EventResumed, FileName: sess.FileName, Received: resp.Received})
+		logFor(w).Info("upload resumed", "missing_chunks", len(resp.MissingChunks), "total_chunks", sess.TotalChunks)
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// uploadPaused refuses, to a request holding the lock of upload key, a
+// write to a paused session.
+func (s *Server) uploadPaused(w http.ResponseWriter, key string) bool {
+	if _, ok := s.paused.Load(key); !ok {
+		return false
+	}
+	respondError(w, http.StatusConflict, CodeUploadPaused, "upload %s is paused: POST /upload/%s/resume first", key, key)
+	return true
+}
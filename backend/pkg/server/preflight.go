@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ---------------------------------------------------------------------
+// POST /upload/preflight (validate parameters without storing anything)
+// ---------------------------------------------------------------------
+type PreflightResponse struct {
+	Accepted   bool   `json:"accepted"`
+	Exists     bool   `json:"exists"`               // complete file already stored
+	InProgress bool   `json:"inProgress,omitempty"` // a .part file is present
+	Code       string `json:"code,omitempty"`       // rejection code, as in ErrorResponse
+	Reason     string `json:"reason,omitempty"`
+}
+
+func (s *Server) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	fileName, totalChunks, fileSize, uerr := s.parseFileParams(r.FormValue("fileName"), r.FormValue("totalChunks"), r.FormValue("fileSize"))
+	if uerr == nil {
+		uerr = s.checkChunkLayout(totalChunks, fileSize)
+	}
+	if uerr != nil {
+		respondPreflight(w, fileName, PreflightResponse{Code: uerr.code, Reason: uerr.msg})
+		return
+	}
+
+	if q := s.checkQuota(r, fileName, fileSize); q != nil {
+		respondPreflight(w, fileName, PreflightResponse{Code: q.Code, Reason: q.Error})
+		return
+	}
+
+	resp := PreflightResponse{Accepted: true}
+	if size, _, err := s.statStored(fileName); err == nil {
+		resp.Exists = true
+		if wantHash := r.FormValue("hash"); wantHash != "" {
+			hash, err := s.hashStored(fileName)
+			resp.Exists = err == nil && strings.EqualFold(hash, wantHash)
+		} else if fileSize > 0 {
+			resp.Exists = size == fileSize
+		}
+	}
+	if _, err := s.store.PartSize(fileName); err == nil {
+		resp.InProgress = true
+	}
+	if !resp.Exists && fileSize > 0 {
+		if avail, err := s.store.Available(); err == nil && avail >= 0 && avail < fileSize {
+			resp = PreflightResponse{
+				Code:   CodeInsufficientStorage,
+				Reason: fmt.Sprintf("insufficient storage: need %d bytes, %d available", fileSize, avail),
+			}
+		}
+	}
+	respondPreflight(w, fileName, resp)
+}
+
+func respondPreflight(w http.ResponseWriter, fileName string, resp PreflightResponse) {
+	logFor(w).Info("preflight", "file", fileName, "accepted", resp.Accepted, "exists", resp.Exists, "code", resp.Code)
+	respondJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Per-user storage quotas (USER_QUOTA): bytes of completed files owned by
+// each authenticated Principal; per-tenant quotas (TENANT_QUOTA): bytes of
+// all a tenant's completed files
+// ---------------------------------------------------------------------
+
+// QuotaTable is the usage table's file inside UploadDir.
+const QuotaTable = ".quotas.json"
+
+// QuotaExceededResponse is the 413 QUOTA_EXCEEDED body: ErrorResponse plus
+// the numbers a client needs to tell the user how much to free.
+type QuotaExceededResponse struct {
+	ErrorResponse
+	User      string `json:"user"`
+	Tenant    string `json:"tenant,omitempty"` // set when the tenant's quota is the one exceeded
+	Used      int64  `json:"used"`             // bytes already stored
+	Requested int64  `json:"requested"`        // bytes the rejected upload needs
+	Limit     int64  `json:"limit"`
+}
+
+// fileOwner is who stored a completed file, and its size.
+type fileOwner struct {
+	User string `json:"user"`
+	Size int64  `json:"size"`
+}
+
+// quotaTable records the owner of every completed file uploaded with
+// credentials (of every file, for a tenant).
+type quotaTable struct {
+	*storage.Table[fileOwner]
+}
+
+func newQuotaTable(dir string, mode os.FileMode) *quotaTable {
+	return &quotaTable{storage.NewTable[fileOwner]("quota table", filepath.Join(dir, QuotaTable), mode)}
+}
+
+// usage returns the bytes user stores, not counting file name (which an
+// upload of that name would replace).
+func (t *quotaTable) usage(user, name string) (int64, error) {
+	var used int64
+	err := t.View(func(files map[string]fileOwner) {
+		for file, o := range files {
+			if o.User == user && file != name {
+				used += o.Size
+			}
+		}
+	})
+	return used, err
+}
+
+// total returns the bytes of every recorded file but name.
+func (t *quotaTable) total(name string) (int64, error) {
+	var used int64
+	err := t.View(func(files map[string]fileOwner) {
+		for file, o := range files {
+			if file != name {
+				used += o.Size
+			}
+		}
+	})
+	return used, err
+}
+
+// charge records that user now owns name with size bytes. A file
+// replaced by another user moves to the new owner.
+func (t *quotaTable) charge(name, user string, size int64) error {
+	return t.Set(name, fileOwner{User: user, Size: size})
+}
+
+// release forgets name once its file is deleted.
+func (t *quotaTable) release(name string) error {
+	return t.Delete(name)
+}
+
+// owner returns who stored name, or "" if it was stored without
+// credentials.
+func (t *quotaTable) owner(name string) (string, error) {
+	o, _, err := t.Get(name)
+	return o.User, err
+}
+
+// checkQuota returns a QUOTA_EXCEEDED response when storing size bytes as
+// name would take the tenant past TENANT_QUOTA or the authenticated user
+// past USER_QUOTA, or nil. Without a Principal (auth off for the route)
+// only the tenant is limited.
+func (s *Server) checkQuota(r *http.Request, name string, size int64) *QuotaExceededResponse {
+	if q := s.checkTenantQuota(r, name, size); q != nil {
+		return q
+	}
+	p, ok := principalFrom(r.Context())
+	if !ok || s.cfg.UserQuota <= 0 {
+		return nil
+	}
+	used, err := s.quotas.usage(p.Subject, name)
+	if err != nil {
+		// Fail open: an unreadable table must not block every upload.
+		logCtx(r.Context()).Warn("cannot check quota", "error", err)
+		return nil
+	}
+	if used+size <= s.cfg.UserQuota {
+		return nil
+	}
+	return &QuotaExceededResponse{
+		ErrorResponse: ErrorResponse{
+			Code:  CodeQuotaExceeded,
+			Error: fmt.Sprintf("quota exceeded: %d bytes stored + %d requested > %d", used, size, s.cfg.UserQuota),
+		},
+		User:      p.Subject,
+		Used:      used,
+		Requested: size,
+		Limit:     s.cfg.UserQuota,
+	}
+}
+
+func (s *Server) checkTenantQuota(r *http.Request, name string, size int64) *QuotaExceededResponse {
+	if s.tenant == "" || s.cfg.TenantQuota <= 0 {
+		return nil
+	}
+	used, err := s.quotas.total(name)
+	if err != nil {
+		logCtx(r.Context()).Warn("cannot check tenant quota", "error", err)
+		return nil
+	}
+	if used+size <= s.cfg.TenantQuota {
+		return nil
+	}
+	p, _ := principalFrom(r.Context())
+	return &QuotaExceededResponse{
+		ErrorResponse: ErrorResponse{
+			Code:  CodeQuotaExceeded,
+			Error: fmt.Sprintf("tenant quota exceeded: %d bytes stored + %d requested > %d", used, size, s.cfg.TenantQuota),
+		},
+		User:      p.Subject,
+		Tenant:    s.tenant,
+		Used:      used,
+		Requested: size,
+		Limit:     s.cfg.TenantQuota,
+	}
+}
+
+func respondQuotaExceeded(w http.ResponseWriter, q *QuotaExceededResponse) {
+	respondErrorWith(w, http.StatusRequestEntityTooLarge, q.Code, q.Error, func(e ErrorResponse) any {
+		q.ErrorResponse = e
+		return q
+	})
+}
+
+// chargeQuota records a completed file against the authenticated user
+// and, for a tenant, against the tenant even without one.
+func (s *Server) chargeQuota(r *http.Request, name string, size int64) {
+	p, ok := principalFrom(r.Context())
+	if !ok && s.tenant == "" {
+		return
+	}
+	if err := s.quotas.charge(name, p.Subject, size); err != nil {
+		logCtx(r.Context()).Warn("cannot record quota usage", "file", name, "bytes", size, "error", err)
+	}
+}
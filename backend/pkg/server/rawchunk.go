@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// ---------------------------------------------------------------------
+// PUT /upload/{uploadID}/chunk/{index}: the chunk as the raw request body,
+// streamed to storage without multipart parsing
+// ---------------------------------------------------------------------
+
+// RawFieldHeader prefixes the headers carrying the form fields of a raw
+// chunk: X-Upload-ChecksumAlgo for checksumAlgo, X-Upload-Mode for mode.
+const RawFieldHeader = "X-Upload-"
+
+// rawChunkFields are the POST /upload form fields a raw chunk may send as
+// headers; uploadID and index come from the path.
+var rawChunkFields = []string{"fileName", "totalChunks", "fileSize", "mode", "offset", "chunkSize",
+	"checksumAlgo", "chunkHash", "chunkCrc", ChecksumMD5, ChecksumSHA256, "fileMd5", "fileSha256"}
+
+// rawChunkHandler stores one chunk of a session sent as the request body.
+// It accepts everything a multipart chunk POST does.
+func (s *Server) rawChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if r.Method != http.MethodPut {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only PUT allowed")
+		return
+	}
+	if err := s.ensureDirs(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot initialise upload directory")
+		return
+	}
+	if s.cfg.MaxChunkSize > 0 && r.ContentLength > s.cfg.MaxChunkSize {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeChunkTooLarge,
+			"chunk is %d bytes, limit is %d", r.ContentLength, s.cfg.MaxChunkSize)
+		return
+	}
+	// A compressed chunk's size is known once it is decompressed.
+	enc, uerr := s.decodeBody(w, r, 0)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	defer s.recordEncoded(w, enc)
+	if enc == nil && r.ContentLength < 0 {
+		respondError(w, http.StatusLengthRequired, CodeInvalidRequest, "Content-Length required")
+		return
+	}
+
+	// The fields are set directly, so FormValue never parses the body.
+	form := url.Values{"uploadID": {r.PathValue("uploadID")}, "index": {r.PathValue("index")}}
+	for _, field := range rawChunkFields {
+		if v := r.Header.Get(RawFieldHeader + field); v != "" {
+			form.Set(field, v)
+		}
+	}
+	r.Form, r.PostForm = form, url.Values{}
+
+	// A chunk whose checksum must be verified before it touches the part
+	// file, or that is compressed, is first spooled to the OS temp dir,
+	// like a large multipart chunk; otherwise the body is streamed.
+	var spooled *spooledChunk
+	defer func() {
+		if spooled != nil {
+			if err := spooled.Close(); err != nil {
+				logFor(w).Warn("cannot remove chunk temp file", "error", err)
+			}
+		}
+	}()
+	s.receiveChunk(w, r, func(r *http.Request, seekable bool) (io.Reader, int64, *uploadError) {
+		if !seekable && enc == nil {
+			return r.Body, r.ContentLength, nil
+		}
+		f, err := os.CreateTemp("", "chunk-*")
+		if err != nil {
+			return nil, 0, &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot spool chunk: %v", err)}
+		}
+		spooled = &spooledChunk{f}
+		body := io.Reader(r.Body)
+		if enc != nil && s.cfg.MaxChunkSize > 0 {
+			body = io.LimitReader(body, s.cfg.MaxChunkSize+1)
+		}
+		n, err := io.Copy(f, contextReader{ctx: r.Context(), r: body})
+		if err == nil && enc == nil && n != r.ContentLength {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if uerr := decodeFailure(err); uerr != nil {
+			return nil, 0, uerr
+		}
+		if err != nil {
+			return nil, 0, &uploadError{http.StatusBadRequest, CodeIncompleteWrite, fmt.Sprintf("cannot read chunk: %v", err)}
+		}
+		if enc != nil && s.cfg.MaxChunkSize > 0 && n > s.cfg.MaxChunkSize {
+			return nil, 0, &uploadError{http.StatusRequestEntityTooLarge, CodeChunkTooLarge,
+				fmt.Sprintf("chunk decompresses to over %d bytes, the limit", s.cfg.MaxChunkSize)}
+		}
+		return f, n, nil
+	})
+}
+
+// spooledChunk removes its temp file on Close.
+type spooledChunk struct {
+	*os.File
+}
+
+func (c spooledChunk) Close() error {
+	c.File.Close()
+	return os.Remove(c.Name())
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Retention: completed files deleted after RETENTION (or the retention
+// requested at POST /upload/init), e.g. for a file-drop deployment
+// ---------------------------------------------------------------------
+
+// ExpiryTable is the expiry table's file inside UploadDir.
+const ExpiryTable = ".expiry.json"
+
+// parseRetention reads a retention period: a Go duration ("36h") or a
+// whole number of days ("7d").
+func parseRetention(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid retention %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid retention %q: want a duration such as 36h or 7d", v)
+	}
+	return d, nil
+}
+
+// requestedRetention resolves the retention field of POST /upload/init
+// (or tus metadata): "" takes RETENTION, or MAX_RETENTION when only that
+// is set; longer than MAX_RETENTION is refused. 0 = keep the file.
+func (s *Server) requestedRetention(v string) (time.Duration, *uploadError) {
+	if v == "" {
+		return cmp.Or(s.cfg.Retention, s.cfg.MaxRetention), nil
+	}
+	d, err := parseRetention(v)
+	if err != nil || d == 0 {
+		return 0, &uploadError{http.StatusBadRequest, CodeInvalidRetention, fmt.Sprintf("invalid retention %q: want a positive duration such as 36h or 7d", v)}
+	}
+	if m := s.cfg.MaxRetention; m > 0 && d > m {
+		return 0, &uploadError{http.StatusBadRequest, CodeInvalidRetention,
+			fmt.Sprintf("retention %s is longer than the server allows (%s)", v, m)}
+	}
+	return d, nil
+}
+
+// expiryTable records when each completed file with a retention period is
+// due for deletion.
+type expiryTable struct {
+	*storage.Table[time.Time]
+}
+
+func newExpiryTable(dir string, mode os.FileMode) *expiryTable {
+	return &expiryTable{storage.NewTable[time.Time]("expiry table", filepath.Join(dir, ExpiryTable), mode)}
+}
+
+// set records that name expires at; the zero time keeps it forever.
+func (t *expiryTable) set(name string, at time.Time) error {
+	if at.IsZero() {
+		return t.Delete(name)
+	}
+	return t.Set(name, at.UTC())
+}
+
+// get returns when name expires, the zero time for never.
+func (t *expiryTable) get(name string) (time.Time, error) {
+	at, _, err := t.Get(name)
+	return at, err
+}
+
+// due lists the files expired at now.
+func (t *expiryTable) due(now time.Time) ([]string, error) {
+	var names []string
+	err := t.View(func(files map[string]time.Time) {
+		for name, at := range files {
+			if !now.Before(at) {
+				names = append(names, name)
+			}
+		}
+	})
+	return names, err
+}
+
+// expiresAt returns when the completed file name will be deleted, or nil.
+func (s *Server) expiresAt(name string) *time.Time {
+	at, err := s.expiries.get(name)
+	if err != nil {
+		slog.Warn("cannot read expiry", "file", name, "error", err)
+	}
+	if at.IsZero() {
+		return nil
+	}
+	return &at
+}
+
+// isExpired reports whether the completed file name is past its expiry
+// but not yet reaped; it is then treated as gone.
+func (s *Server) isExpired(name string) bool {
+	at, _ := s.expiries.get(name)
+	return !at.IsZero() && !s.now().Before(at)
+}
+
+// setRetention starts the retention period of a file just stored as name;
+// 0 keeps it forever, replacing any expiry of an earlier file of that name.
+func (s *Server) setRetention(name string, retention time.Duration) {
+	var at time.Time
+	if retention > 0 {
+		at = s.now().Add(retention)
+	}
+	if err := s.expiries.set(name, at); err != nil {
+		slog.Warn("cannot record expiry", "file", name, "error", err)
+	}
+}
+
+// moveExpiry carries the expiry of from over to the file to, e.g. after
+// compression renamed it.
+func (s *Server) moveExpiry(from, to string) {
+	at, err := s.expiries.get(from)
+	if err == nil && !at.IsZero() {
+		err = s.expiries.set(to, at)
+		if err == nil {
+			err = s.expiries.set(from, time.Time{})
+		}
+	}
+	if err != nil {
+		slog.Warn("cannot move expiry", "file", from, "to", to, "error", err)
+	}
+}
+
+// extendExpiry keeps an existing file, which a new upload deduplicated
+// into, at least until that upload's expiry want; zero = forever.
+func (s *Server) extendExpiry(name string, want time.Time) {
+	at, err := s.expiries.get(name)
+	if err != nil || at.IsZero() || (!want.IsZero() && !want.After(at)) {
+		return
+	}
+	if err := s.expiries.set(name, want); err != nil {
+		slog.Warn("cannot extend expiry", "file", name, "error", err)
+	}
+}
+
+// sweepExpired deletes every completed file past its expiry.
+func (s *Server) sweepExpired() {
+	names, err := s.expiries.due(s.now())
+	if err != nil {
+		slog.Warn("janitor: cannot read expiry table", "error", err)
+		s.janitorMu.Lock()
+		s.janitor.Errors++
+		s.janitorMu.Unlock()
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+	var removed, freed, failed int64
+	for _, name := range names {
+		size, _, _ := s.store.Stat(name)
+		if err := s.removeCompleted(name); err != nil {
+			slog.Warn("janitor: cannot remove expired file", "file", name, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("janitor: removed expired file", "file", name, "bytes", size)
+		removed++
+		freed += size
+	}
+	s.janitorMu.Lock()
+	s.janitor.Expired += removed
+	s.janitor.ExpiredBytes += freed
+	s.janitor.Errors += failed
+	s.janitorMu.Unlock()
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Virus scanning of completed files (CLAMD_ADDR, off by default)
+// ---------------------------------------------------------------------
+
+// Scan verdicts, in ScanResult.Status.
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanError    = "error" // the scanner failed; see SCAN_ON_ERROR
+)
+
+// What happens to a rejected file (SCAN_INFECTED) and to one the scanner
+// could not check (SCAN_ON_ERROR).
+const (
+	ScanQuarantine = "quarantine"
+	ScanDelete     = "delete"
+
+	ScanReject = "reject"
+	ScanAccept = "accept"
+)
+
+const (
+	DefaultScanTimeout = 5 * time.Minute
+	Quarantine         = ".quarantine" // default QUARANTINE_DIR, inside UploadDir
+
+	clamdChunkSize = 64 << 10 // bytes per INSTREAM chunk
+)
+
+// ScanResult is the verdict on one completed file.
+type ScanResult struct {
+	Status    string `json:"status"`
+	Scanner   string `json:"scanner,omitempty"`
+	Signature string `json:"signature,omitempty"` // infected: what was found
+	Error     string `json:"error,omitempty"`     // error: why the scan failed
+}
+
+// Scanner is the post-assembly hook: it reads every completed file before
+// it is hashed, compressed or announced. An error means the file could not
+// be scanned. Set Config.Scanner to use one other than clamd.
+type Scanner interface {
+	Scan(ctx context.Context, name string, r io.Reader) (ScanResult, error)
+}
+
+// parseClamdAddr reads CLAMD_ADDR: unix:/path, tcp:host:port, a socket
+// path or host:port.
+func parseClamdAddr(v string) (network, addr string, err error) {
+	switch {
+	case strings.HasPrefix(v, "unix:"):
+		network, addr = "unix", strings.TrimPrefix(v, "unix:")
+	case strings.HasPrefix(v, "/"):
+		network, addr = "unix", v
+	default:
+		network, addr = "tcp", strings.TrimPrefix(v, "tcp:")
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return "", "", fmt.Errorf("invalid CLAMD_ADDR %q: want unix:/path or host:port", v)
+		}
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("invalid CLAMD_ADDR %q: want unix:/path or host:port", v)
+	}
+	return network, addr, nil
+}
+
+// clamdScanner streams files to a ClamAV daemon with the INSTREAM command.
+type clamdScanner struct {
+	network, addr string
+}
+
+func (c clamdScanner) Scan(ctx context.Context, name string, r io.Reader) (ScanResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	sendErr := c.send(conn, r)
+	// clamd answers early (and stops reading) when the stream exceeds its
+	// StreamMaxLength, so read the reply even after a failed send.
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	if reply == "" {
+		if sendErr != nil {
+			return ScanResult{}, fmt.Errorf("clamd: %w", sendErr)
+		}
+		return ScanResult{}, fmt.Errorf("clamd: no reply: %w", err)
+	}
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{Status: ScanClean, Scanner: "clamav"}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Status: ScanInfected, Scanner: "clamav", Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// send writes the INSTREAM command, r as length-prefixed chunks and the
+// zero-length terminator.
+func (c clamdScanner) send(conn net.Conn, r io.Reader) error {
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// scanCompleted runs the Scanner over fileName, just stored for the
+// upload under key. An infected file, or with SCAN_ON_ERROR=reject one
+// that could not be scanned, is quarantined or deleted and the upload
+// fails. The result is nil when scanning is off.
+func (s *Server) scanCompleted(r *http.Request, key, fileName string) (*ScanResult, *uploadError) {
+	if s.scanner == nil {
+		return nil, nil
+	}
+	lg := logCtx(r.Context())
+	// Like the metadata database, the scan outlives a client hanging up.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), s.cfg.ScanTimeout)
+	defer cancel()
+	start := s.now()
+	res, err := s.scanFile(ctx, fileName)
+	if err != nil {
+		res = ScanResult{Status: ScanError, Error: err.Error()}
+	}
+	s.recordScan(r, key, res)
+
+	switch {
+	case res.Status == ScanClean:
+		lg.Info("scan clean", "file", fileName, "scanner", res.Scanner, "duration", s.now().Sub(start))
+		return &res, nil
+	case res.Status == ScanError && s.cfg.ScanOnError == ScanAccept:
+		lg.Warn("scan failed, file accepted", "file", fileName, "error", err)
+		return &res, nil
+	}
+
+	action, rerr := s.rejectFile(fileName)
+	if rerr != nil {
+		lg.Error("cannot remove rejected file", "file", fileName, "error", rerr)
+	}
+	if s.cfg.Versioning {
+		s.restoreVersion(fileName)
+	}
+	s.recordRejection(r, key)
+	uerr := &uploadError{http.StatusUnprocessableEntity, CodeFileInfected,
+		fmt.Sprintf("file rejected: %s found (%s)", res.Signature, action)}
+	if res.Status == ScanError {
+		lg.Warn("scan failed, file rejected", "file", fileName, "action", action, "error", err)
+		uerr = &uploadError{http.StatusServiceUnavailable, CodeScanFailed,
+			fmt.Sprintf("file rejected: cannot scan it (%s): %v", action, err)}
+	} else {
+		lg.Warn("infected upload", "file", fileName, "signature", res.Signature, "action", action)
+	}
+	s.publish(key, UploadEvent{Type: EventAborted, FileName: fileName, Code: uerr.code, Error: uerr.msg})
+	return &res, uerr
+}
+
+func (s *Server) scanFile(ctx context.Context, fileName string) (ScanResult, error) {
+	f, err := s.store.Open(fileName)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer f.Close()
+	return s.scanner.Scan(ctx, fileName, f)
+}
+
+// rejectFile moves a rejected file into QUARANTINE_DIR, readable by the
+// server's user only, or deletes it with SCAN_INFECTED=delete. It returns
+// what was done.
+func (s *Server) rejectFile(fileName string) (string, error) {
+	if s.cfg.ScanInfected == ScanDelete {
+		return "deleted", s.store.Remove(fileName)
+	}
+	if err := s.quarantine(fileName); err != nil {
+		// Never leave a rejected file where it can be downloaded.
+		return "deleted", errors.Join(err, s.store.Remove(fileName))
+	}
+	return "quarantined", s.store.Remove(fileName)
+}
+
+// quarantine copies fileName to QUARANTINE_DIR as <time>-<name>.
+func (s *Server) quarantine(fileName string) error {
+	if err := os.MkdirAll(s.cfg.QuarantineDir, 0o700); err != nil {
+		return err
+	}
+	in, err := s.store.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	path := filepath.Join(s.cfg.QuarantineDir, s.now().UTC().Format("20060102T150405.000000000Z")+"-"+fileName)
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
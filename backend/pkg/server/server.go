@@ -0,0 +1,382 @@
+// Package server implements the chunk-upload HTTP API: chunked and tus
+// uploads, downloads and upload management. New returns a Server, which is
+// the http.Handler for every endpoint.
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+	"google.golang.org/grpc"
+)
+
+// ---------------------------------------------------------------------
+// Server: configuration plus all per-process state used by the handlers
+// ---------------------------------------------------------------------
+type Server struct {
+	cfg      Config
+	store    storage.Storage
+	locks    session.Locker
+	received *session.Tracker
+	sessions *session.Store
+
+	slots       chan struct{} // nil = no concurrency limit
+	perClient   *clientUploads
+	limiter     *rateLimiter // per client IP, nil = no rate limit
+	userLimiter *rateLimiter // per authenticated user, nil = no rate limit
+	bandwidth   *bandwidth   // nil = no ingest bandwidth limit
+	origins     map[string]bool
+	// originPatterns are "*." subdomain patterns from ALLOWED_ORIGINS, as
+	// scheme:// and .domain[:port]; anyOrigin is "*".
+	originPatterns [][2]string
+	anyOrigin      bool
+
+	auth       Authenticator   // nil = no authentication
+	authRoutes map[string]bool // route groups auth applies to
+	quotas     *quotaTable
+	hashes     *hashTable
+	expiries   *expiryTable
+	types      *typeTable
+	compressed *compressTable
+	manifests  *manifestTable
+	hooks      *hookTable
+	versions   *versionTable
+	chunks     chunkStore  // CHUNK_DEDUP
+	db         *metaDB     // nil = METADATA_DB off
+	scanner    Scanner     // nil = no virus scanning
+	transcoder *transcoder // nil = TRANSCODE_PRESETS off
+	events     *eventHub
+	grpc       *grpc.Server
+	batched    sync.Map // upload ID of a batch file → batchFileRef
+	extracting sync.Map // upload key of a finalized archive → directory to unpack it under
+	paused     sync.Map // upload ID of a paused session → time.Time it was paused
+
+	metrics   *metrics
+	ingest    *ingestRate // this tenant's alone
+	tracer    *tracer     // nil = OTEL_EXPORTER_OTLP_ENDPOINT unset
+	auditFile *auditFile  // nil = AUDIT_LOG unset or db; shared with the tenants
+
+	maintenance *maintenance // shared with the tenants
+	space       *spaceWatch  // shared with the tenants
+	started     time.Time
+
+	drainMu  sync.Mutex
+	draining bool           // set by Shutdown after SHUTDOWN_DELAY: refuse new uploads
+	unready  bool           // set as Shutdown begins: GET /readyz fails
+	inflight sync.WaitGroup // uploads holding a slot
+	hookRuns sync.WaitGroup // POST_UPLOAD_COMMAND runs
+
+	janitorMu sync.Mutex
+	janitor   JanitorStats
+
+	tenant  string             // this Server's tenant, "" for the process
+	tenants map[string]*Server // by name, in tenant mode
+
+	now func() time.Time
+
+	handler func() http.Handler // Routes, built on first use
+}
+
+// New builds a Server from cfg with the storage backend it names, creates
+// the upload directories and opens METADATA_DB and LOCK_URL. A Server is
+// the http.Handler for every endpoint, so it can be mounted in another
+// mux; call RunJanitor, RunTranscoder and Shutdown as a standalone server
+// does.
+func New(cfg Config) (*Server, error) {
+	s := NewWithStorage(cfg, nil)
+	for _, srv := range s.servers() {
+		if err := srv.ensureDirs(); err != nil {
+			return nil, fmt.Errorf("cannot create upload directory: %w", err)
+		}
+	}
+	if err := s.openMetaDB(); err != nil {
+		return nil, fmt.Errorf("cannot open metadata database: %w", err)
+	}
+	if err := s.openLocker(); err != nil {
+		return nil, fmt.Errorf("cannot open lock backend: %w", err)
+	}
+	for _, t := range s.tenants {
+		t.db = s.db
+	}
+	return s, nil
+}
+
+// NewWithStorage builds a Server from cfg without touching the disk. A nil
+// store means the backend named by cfg.StorageBackend, with part files
+// under cfg.TempDir and, with cfg.MapFileNames, completed files under
+// generated keys or, with STORAGE_LAYOUT=content, under their hash. In
+// tenant mode each tenant gets such a store of its own and store is
+// unused.
+func NewWithStorage(cfg Config, store storage.Storage) *Server {
+	if cfg.TempDir == "" {
+		cfg.TempDir = cfg.UploadDir
+	}
+	if cfg.QuarantineDir == "" {
+		cfg.QuarantineDir = filepath.Join(cfg.UploadDir, Quarantine)
+	}
+	if store == nil {
+		disk := storage.Disk{Dir: cfg.UploadDir, TempDir: cfg.TempDir, FileMode: cfg.FileMode, NoSync: cfg.NoFsync, Hidden: isServerState, DirMode: cfg.DirMode}
+		store = disk
+		// The wrappers below finalize parts under other names or with
+		// other bytes, so the bucket only gets parts (and the
+		// container blocks) as they grow without.
+		stream := !cfg.encrypts() && !cfg.MapFileNames && cfg.StorageLayout != storage.LayoutContent
+		switch cfg.StorageBackend {
+		case storage.BackendS3, storage.BackendGCS:
+			obj := storage.NewObject(cfg.StorageBackend, cfg.Object, disk)
+			obj.StreamParts = stream
+			store = obj
+		case storage.BackendAzure:
+			az := storage.NewAzure(cfg.Azure, disk)
+			az.StreamBlocks = stream
+			store = az
+		case storage.BackendSFTP:
+			store = storage.NewSFTP(cfg.SFTP, disk)
+		}
+		if wrapper := cfg.keyWrapper(); wrapper != nil {
+			store = storage.NewEncrypted(store, wrapper, cfg.UploadDir, cfg.FileMode)
+		}
+		if cfg.MapFileNames {
+			store = storage.NewMapped(store, cfg.UploadDir, cfg.FileMode)
+		}
+		if cfg.StorageLayout == storage.LayoutContent {
+			store = storage.NewAddressed(store, cfg.UploadDir, cfg.FileMode)
+		}
+		if cache := cfg.metaCache(); cache != nil {
+			store = storage.NewCached(store, cache)
+		}
+	}
+	s := &Server{
+		cfg:       cfg,
+		store:     store,
+		locks:     session.NewLocks(),
+		received:  session.NewTracker(),
+		sessions:  session.NewStore(),
+		perClient: &clientUploads{m: make(map[string]int)},
+		origins:   make(map[string]bool),
+		now:       time.Now,
+		started:   time.Now(),
+
+		authRoutes: make(map[string]bool),
+		quotas:     newQuotaTable(cfg.UploadDir, cfg.FileMode),
+		hashes:     newHashTable(cfg.UploadDir, cfg.FileMode),
+		expiries:   newExpiryTable(cfg.UploadDir, cfg.FileMode),
+		types:      newTypeTable(cfg.UploadDir, cfg.FileMode),
+		compressed: newCompressTable(cfg.UploadDir, cfg.FileMode),
+		manifests:  newManifestTable(cfg.UploadDir, cfg.FileMode),
+		hooks:      newHookTable(cfg.UploadDir, cfg.FileMode),
+		versions:   newVersionTable(cfg.UploadDir, cfg.FileMode),
+		chunks:     newChunkStore(cfg),
+		events:     newEventHub(),
+
+		metrics:     newMetrics(),
+		ingest:      &ingestRate{},
+		tracer:      newTracer(cfg),
+		maintenance: &maintenance{},
+		space:       &spaceWatch{},
+	}
+	s.handler = sync.OnceValue(s.Routes)
+	s.grpc = s.newGRPCServer()
+	if cfg.MaxConcurrentUploads > 0 {
+		s.slots = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	if cfg.RateLimitRPS > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	}
+	if cfg.RateLimitUserRPS > 0 {
+		s.userLimiter = newRateLimiter(cfg.RateLimitUserRPS, cfg.RateLimitUserBurst)
+	}
+	s.bandwidth = newBandwidth(cfg)
+	s.auditFile = newAuditFile(cfg, func() time.Time { return s.now() })
+	if cfg.Locker != nil {
+		s.locks = cfg.Locker
+	}
+	s.auth = cfg.Auth
+	s.transcoder = newTranscoder(cfg)
+	s.scanner = cfg.Scanner
+	if s.scanner == nil && cfg.ClamdAddr != "" {
+		network, addr, _ := parseClamdAddr(cfg.ClamdAddr)
+		s.scanner = clamdScanner{network: network, addr: addr}
+	}
+	if s.auth == nil {
+		s.auth = newAuthenticator(cfg, func() time.Time { return s.now() })
+	}
+	for _, g := range cfg.AuthRoutes {
+		s.authRoutes[g] = true
+	}
+	for _, o := range cfg.AllowedOrigins {
+		if o = strings.TrimSpace(o); o != "" {
+			s.addOrigin(o)
+		}
+	}
+	if cfg.TenantMode != "" {
+		s.tenants = make(map[string]*Server)
+		for _, name := range cfg.tenantNames() {
+			s.tenants[name] = s.newTenant(name)
+		}
+		if cfg.Locker != nil {
+			s.setLocker(cfg.Locker)
+		}
+	}
+	return s
+}
+
+// Routes returns the HTTP handler for every endpoint.
+func (s *Server) Routes() http.Handler {
+	mux := http.NewServeMux()
+	// handle registers h under pattern, logged and counted in /metrics by
+	// its path.
+	handle := func(pattern string, h http.HandlerFunc) {
+		route := pattern[strings.Index(pattern, " ")+1:]
+		mux.HandleFunc(pattern, s.instrument(route, h))
+	}
+	handle("/upload", s.withCORS([]string{http.MethodPost, http.MethodHead}, s.withAuthBy(uploadAuthGroup, s.uploadHandler)))
+	handle("/upload/init", s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.initHandler)))
+	handle("/upload/config", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthStatus, s.uploadConfigHandler)))
+	handle("/upload/{uploadID}", s.withCORS([]string{http.MethodDelete}, s.withAuth(AuthUpload, s.abortHandler)))
+	status := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthStatus, s.statusHandler))
+	handle("GET /upload/{uploadID}/status", status)
+	handle("OPTIONS /upload/{uploadID}/status", status)
+	pause := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.pauseHandler))
+	handle("POST /upload/{uploadID}/pause", pause)
+	handle("OPTIONS /upload/{uploadID}/pause", pause)
+	resume := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.resumeHandler))
+	handle("POST /upload/{uploadID}/resume", resume)
+	handle("OPTIONS /upload/{uploadID}/resume", resume)
+	events := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthStatus, s.eventsHandler))
+	handle("GET /upload/{uploadID}/events", events)
+	handle("OPTIONS /upload/{uploadID}/events", events)
+	raw := s.withCORS([]string{http.MethodPut}, s.withAuth(AuthUpload, s.rawChunkHandler))
+	handle("PUT /upload/{uploadID}/chunk/{index}", raw)
+	handle("OPTIONS /upload/{uploadID}/chunk/{index}", raw)
+	complete := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.completeHandler))
+	handle("/upload/complete", complete)
+	handle("POST /upload/{uploadID}/complete", complete)
+	handle("OPTIONS /upload/{uploadID}/complete", complete)
+	if s.cfg.DirectUpload {
+		handle("/upload/direct", s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.directHandler)))
+		parts := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthUpload, s.partsHandler))
+		handle("GET /upload/{uploadID}/parts", parts)
+		handle("OPTIONS /upload/{uploadID}/parts", parts)
+	}
+	if s.cfg.ChunkDedup {
+		exists := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.chunksExistHandler))
+		handle("POST /chunks/exists", exists)
+		handle("OPTIONS /chunks/exists", exists)
+		chunk := s.withCORS([]string{http.MethodPut}, s.withAuth(AuthUpload, s.storeChunkHandler))
+		handle("PUT /chunks/{hash}", chunk)
+		handle("OPTIONS /chunks/{hash}", chunk)
+		assemble := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.assembleChunksHandler))
+		handle("POST /chunks/assemble", assemble)
+		handle("OPTIONS /chunks/assemble", assemble)
+	}
+	handle("/batches", s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.batchInitHandler)))
+	handle("/batches/{batchID}", s.withCORS([]string{http.MethodGet, http.MethodDelete}, s.withAuthBy(batchAuthGroup, s.batchHandler)))
+	batchChunk := s.withCORS([]string{http.MethodPut}, s.withAuth(AuthUpload, s.batchChunkHandler))
+	handle("PUT /batches/{batchID}/files/{fileIndex}/chunks/{index}", batchChunk)
+	handle("OPTIONS /batches/{batchID}/files/{fileIndex}/chunks/{index}", batchChunk)
+	batchComplete := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.batchCompleteHandler))
+	handle("POST /batches/{batchID}/complete", batchComplete)
+	handle("OPTIONS /batches/{batchID}/complete", batchComplete)
+	handle("/upload/preflight", s.withCORS([]string{http.MethodPost}, s.withAuth(AuthStatus, s.preflightHandler)))
+	handle("/upload/verify", s.withCORS([]string{http.MethodPost}, s.withAuth(AuthStatus, s.verifyHandler)))
+	handle("/uploads", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthManage, s.uploadsHandler)))
+	handle("/uploads/{id}", s.withCORS([]string{http.MethodGet, http.MethodDelete}, s.withAuth(AuthManage, s.manageUploadHandler)))
+	processing := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthManage, s.processingHandler))
+	handle("GET /uploads/{id}/processing", processing)
+	handle("OPTIONS /uploads/{id}/processing", processing)
+	thumbnail := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthDownload, s.thumbnailHandler))
+	handle("GET /files/{name}/thumbnail/{size}", thumbnail)
+	handle("OPTIONS /files/{name}/thumbnail/{size}", thumbnail)
+	transcoded := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthDownload, s.transcodedHandler))
+	handle("GET /files/{name}/transcode/{preset}", transcoded)
+	handle("OPTIONS /files/{name}/transcode/{preset}", transcoded)
+	if s.cfg.DeltaUpload {
+		signature := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthDownload, s.signatureHandler))
+		handle("GET /files/{name}/signature", signature)
+		handle("OPTIONS /files/{name}/signature", signature)
+		patch := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.patchHandler))
+		handle("POST /files/{name}/patch", patch)
+		handle("OPTIONS /files/{name}/patch", patch)
+	}
+	if s.cfg.Versioning {
+		versions := s.withCORS([]string{http.MethodGet}, s.withAuth(AuthDownload, s.versionsHandler))
+		handle("GET /files/{name}/versions", versions)
+		handle("OPTIONS /files/{name}/versions", versions)
+	}
+	if s.cfg.SigningKey != "" {
+		sign := s.withCORS([]string{http.MethodPost}, s.withAuth(AuthDownload, s.signHandler))
+		handle("POST /files/{name}/sign", sign)
+		handle("OPTIONS /files/{name}/sign", sign)
+	}
+	handle("/exists", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthStatus, s.existsHandler)))
+	handle("/files/{$}", s.withTus(s.withCORS([]string{http.MethodPost}, s.withAuth(AuthUpload, s.tusCreateHandler))))
+	handle("/files/{name}", s.withTus(s.withCORS(
+		[]string{http.MethodGet, http.MethodHead, http.MethodPatch, http.MethodDelete},
+		s.withSignature(s.withAuthBy(filesAuthGroup, s.filesHandler)))))
+	handle("POST /"+GRPCService+"/UploadChunks", s.withAuth(AuthUpload, s.grpcUploadChunks))
+	handle("POST /"+GRPCService+"/GetUploadStatus", s.withAuth(AuthStatus, s.grpcGetUploadStatus))
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/metrics", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthMetrics, s.metricsHandler)))
+	handle("/stats/active", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthMetrics, s.activeStatsHandler)))
+	handle("/openapi.json", s.withCORS([]string{http.MethodGet}, s.openAPIHandler))
+	handle("/docs", s.docsHandler)
+	if s.cfg.AdminToken != "" {
+		s.adminRoutes(handle)
+	}
+	if s.cfg.TenantMode != "" {
+		return s.tenantRoutes(mux)
+	}
+	return mux
+}
+
+// ServeHTTP serves every endpoint, as Routes does.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler().ServeHTTP(w, r)
+}
+
+// ensureDirs creates the upload and part directories with cfg.DirMode.
+func (s *Server) ensureDirs() error {
+	for _, dir := range []string{s.cfg.UploadDir, s.cfg.TempDir} {
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, s.cfg.DirMode); err != nil {
+			slog.Error("cannot create upload directory", "dir", dir, "error", err)
+			return err
+		}
+		// MkdirAll is subject to the umask; apply the exact mode.
+		if err := os.Chmod(dir, s.cfg.DirMode); err != nil {
+			slog.Error("cannot chmod upload directory", "dir", dir, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Origins returns the CORS allow-list, sorted, with wildcard patterns
+// written back as configured and "*" if any origin is allowed.
+func (s *Server) Origins() []string {
+	list := make([]string, 0, len(s.origins))
+	for o := range s.origins {
+		list = append(list, o)
+	}
+	for _, p := range s.originPatterns {
+		list = append(list, p[0]+"*"+p[1])
+	}
+	if s.anyOrigin {
+		list = append(list, "*")
+	}
+	sort.Strings(list)
+	return list
+}
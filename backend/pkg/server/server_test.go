@@ -0,0 +1,5657 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/navneetshukl/Chunk-Upload/backend/client"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+	uploadv1 "github.com/navneetshukl/Chunk-Upload/backend/proto/chunkupload/v1"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newUploadRequest builds a multipart POST for one chunk.
+func newUploadRequest(t *testing.T, fileName string, index, total int, chunk []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("index", strconv.Itoa(index))
+	mw.WriteField("totalChunks", strconv.Itoa(total))
+	mw.WriteField("fileName", fileName)
+	fw, err := mw.CreateFormFile("chunk", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(chunk)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// newTestServer returns a Server storing files under a fresh temp dir;
+// opts adjust the default config before the server is built.
+func newTestServer(t *testing.T, opts ...func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.UploadDir = t.TempDir()
+	cfg.TempDir = cfg.UploadDir
+	cfg.RequireUploadID = false // most tests send fileName-keyed chunks
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return NewWithStorage(cfg, nil)
+}
+
+func TestUploadRemovesMultipartTempFiles(t *testing.T) {
+	srv := newTestServer(t)
+	osTmp := t.TempDir()
+	t.Setenv("TMPDIR", osTmp)
+
+	chunk := bytes.Repeat([]byte("x"), int(srv.cfg.MaxMemory)+1024)
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "big.bin", 0, 2, chunk))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	entries, err := os.ReadDir(osTmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("multipart temp file left behind: %s", e.Name())
+	}
+}
+
+func TestDownloadServesOnlyCompletedFiles(t *testing.T) {
+	mux := newTestServer(t).Routes()
+
+	get := func(name, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+name, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	mux.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, "doc.txt", 0, 2, []byte("hello ")))
+	if rec := get("doc.txt", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("part-only file: status = %d, want 404", rec.Code)
+	}
+
+	mux.ServeHTTP(httptest.NewRecorder(), newUploadRequest(t, "doc.txt", 1, 2, []byte("world")))
+	rec := get("doc.txt", "bytes=6-")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "world" {
+		t.Fatalf("range: status = %d, body = %q", rec.Code, rec.Body)
+	}
+
+	if rec := get("..%5Cmain.go", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("traversal: status = %d, want 400", rec.Code)
+	}
+}
+
+// cancelAfterFirstRead cancels the request context once the first block
+// has been read, simulating a client that disconnects mid-copy.
+type cancelAfterFirstRead struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfterFirstRead) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p[:min(len(p), 4)])
+	c.cancel()
+	return n, err
+}
+
+func TestContextReaderStopsMidCopy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	src := &cancelAfterFirstRead{r: strings.NewReader("0123456789"), cancel: cancel}
+
+	var dst bytes.Buffer
+	n, err := io.Copy(&dst, contextReader{ctx: ctx, r: src})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if n != 4 {
+		t.Fatalf("copied %d bytes, want 4", n)
+	}
+}
+
+func TestCanceledChunkDoesNotExtendPartFile(t *testing.T) {
+	srv := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "c.bin", 0, 3, []byte("first")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d", rec.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "c.bin", 1, 3, []byte("second")).WithContext(ctx))
+	if rec.Code != http.StatusRequestTimeout {
+		t.Fatalf("canceled chunk: status = %d, want 408", rec.Code)
+	}
+
+	fi, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "c.bin.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len("first")) {
+		t.Fatalf("part size = %d, want %d", fi.Size(), len("first"))
+	}
+}
+
+func TestFinalChunkRequiresAllChunks(t *testing.T) {
+	srv := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "gap.bin", 0, 3, []byte("aaa")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "gap.bin", 2, 3, []byte("ccc")))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"expectedIndex":1`) {
+		t.Fatalf("skipped chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if fi, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "gap.bin.part")); err != nil || fi.Size() != 3 {
+		t.Fatalf("part file not left intact: %v", err)
+	}
+
+	for i, chunk := range []string{"bbb", "ccc"} {
+		rec = httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, "gap.bin", i+1, 3, []byte(chunk)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "gap.bin"))
+	if err != nil || string(got) != "aaabbbccc" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+}
+
+func TestRetriedChunkIsNotAppendedTwice(t *testing.T) {
+	srv := newTestServer(t)
+	send := func(srv *Server, index int, chunk, uploadID string) (*httptest.ResponseRecorder, SuccessResponse) {
+		req := newUploadRequest(t, "retry.bin", index, 3, []byte(chunk))
+		if uploadID != "" {
+			req.URL.RawQuery = url.Values{"uploadID": {uploadID}}.Encode()
+		}
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		var resp SuccessResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	send(srv, 0, "aaa", "")
+	send(srv, 1, "bbb", "")
+	rec, resp := send(srv, 1, "bbb", "")
+	if rec.Code != http.StatusOK || !resp.Duplicate || resp.Received != 6 {
+		t.Fatalf("retried chunk 1: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec, _ := send(srv, 1, "bbbb", ""); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), CodeChunkConflict) {
+		t.Fatalf("chunk 1 with other size: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	// After a restart the received chunks come from the .part.meta file.
+	srv = NewWithStorage(srv.cfg, nil)
+	if _, resp := send(srv, 1, "bbb", ""); !resp.Duplicate {
+		t.Fatal("retry after restart was not recognized")
+	}
+	if rec, _ := send(srv, 2, "ccc", ""); rec.Code != http.StatusOK {
+		t.Fatalf("last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "retry.bin"))
+	if err != nil || string(got) != "aaabbbccc" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+
+	// Within a session a retried chunk 0 is a no-op too, not a restart.
+	form := url.Values{"fileName": {"retry.bin"}, "totalChunks": {"3"}}
+	req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	srv.initHandler(rec, req)
+	var init InitResponse
+	json.Unmarshal(rec.Body.Bytes(), &init)
+	send(srv, 0, "AAA", init.UploadID)
+	send(srv, 1, "BBB", init.UploadID)
+	if _, resp := send(srv, 0, "AAA", init.UploadID); !resp.Duplicate || resp.Received != 6 {
+		t.Fatalf("retried chunk 0: %+v", resp)
+	}
+	if rec, _ := send(srv, 2, "CCC", init.UploadID); rec.Code != http.StatusOK {
+		t.Fatalf("session last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "retry.bin")); string(got) != "AAABBBCCC" {
+		t.Fatalf("session file = %q", got)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"0644", 0o644, false},
+		{"664", 0o664, false},
+		{"02775", os.ModeSetgid | 0o775, false},
+		{"0999", 0, true},
+		{"rwx", 0, true},
+		{"017777", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseMode(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseMode(%q) = %v, %v; want %v, err=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExpiredUploadMustRestart(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.UploadTTL = time.Hour })
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "old.bin", 0, 3, []byte("v1")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d", rec.Code)
+	}
+	later := time.Now().Add(2 * time.Hour)
+	srv.now = func() time.Time { return later }
+
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "old.bin", 1, 3, []byte("v2")))
+	if rec.Code != http.StatusGone {
+		t.Fatalf("stale resume: status = %d, want 410", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "old.bin.part")); !os.IsNotExist(err) {
+		t.Fatalf("stale part file not removed: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "old.bin", 0, 3, []byte("v2")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restart: status = %d", rec.Code)
+	}
+}
+
+func TestSeparateChunksAssembleOnComplete(t *testing.T) {
+	srv := newTestServer(t)
+
+	complete := func(total, hash string) *httptest.ResponseRecorder {
+		form := url.Values{"fileName": {"p.zip"}, "totalChunks": {total}, "hash": {hash}}
+		req := httptest.NewRequest(http.MethodPost, "/upload/complete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		srv.completeHandler(rec, req)
+		return rec
+	}
+	send := func(index int, chunk string) {
+		req := newUploadRequest(t, "p.zip", index, 3, []byte(chunk))
+		q := req.URL.Query()
+		q.Set("mode", UploadModeSeparate)
+		req.URL.RawQuery = q.Encode()
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", index, rec.Code, rec.Body)
+		}
+	}
+
+	send(2, "ccc")
+	send(0, "aaa")
+	if rec := complete("3", ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing [1]") {
+		t.Fatalf("missing chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	send(1, "bbb")
+
+	if rec := complete("3", "deadbeef"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("bad hash: status = %d, want 422", rec.Code)
+	}
+	sum := sha256.Sum256([]byte("aaabbbccc"))
+	if rec := complete("3", hex.EncodeToString(sum[:])); rec.Code != http.StatusOK {
+		t.Fatalf("complete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "p.zip"))
+	if err != nil || string(got) != "aaabbbccc" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, "p.zip.part*")); len(left) != 0 {
+		t.Fatalf("chunk files left behind: %v", left)
+	}
+}
+
+func TestFinalizeFailureKeepsPartForRetry(t *testing.T) {
+	srv := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "r.bin", 0, 2, []byte("keep")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d", rec.Code)
+	}
+	// A non-empty directory at the final path makes every rename fail.
+	blocker := filepath.Join(srv.cfg.UploadDir, "r.bin", "x")
+	if err := os.MkdirAll(blocker, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "r.bin", 1, 2, []byte("last")))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("blocked finalize: status = %d, want 500", rec.Code)
+	}
+	var errResp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &errResp); err != nil || errResp.Code != CodeFinalizeFailed || errResp.Done || !errResp.Retriable {
+		t.Fatalf("error response = %+v, %v", errResp, err)
+	}
+	if fi, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "r.bin.part")); err != nil || fi.Size() != 4 {
+		t.Fatalf("part file not kept at 4 bytes: %v", err)
+	}
+
+	os.RemoveAll(filepath.Join(srv.cfg.UploadDir, "r.bin"))
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "r.bin", 1, 2, []byte("last")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("retry: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "r.bin"))
+	if err != nil || string(got) != "keeplast" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+}
+
+func TestAppendChunkOutOfOrder(t *testing.T) {
+	srv := newTestServer(t)
+	send := func(index int, chunk string) OutOfOrderResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, "o.bin", index, 4, []byte(chunk)))
+		var resp OutOfOrderResponse
+		if rec.Code != http.StatusOK {
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+		}
+		return resp
+	}
+
+	send(0, "aa")
+	if resp := send(2, "cc"); resp.Code != CodeChunkOutOfOrder || resp.Retriable || resp.ExpectedIndex != 1 {
+		t.Fatalf("chunk 2 before 1: %+v, want non-retriable %s expecting 1", resp, CodeChunkOutOfOrder)
+	}
+	if resp := send(3, "dd"); resp.Code != CodeChunkOutOfOrder || resp.ExpectedIndex != 1 {
+		t.Fatalf("last chunk before 1: %+v, want %s expecting 1", resp, CodeChunkOutOfOrder)
+	}
+	for i, chunk := range []string{"bb", "cc", "dd"} {
+		if resp := send(i+1, chunk); resp.Code != "" {
+			t.Fatalf("chunk %d: %+v", i+1, resp)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "o.bin"))
+	if err != nil || string(got) != "aabbccdd" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+}
+
+func TestDeclaredFileSize(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.MaxFileSize = 10 })
+
+	withSize := func(req *http.Request, size string) *http.Request {
+		req.URL.RawQuery = url.Values{"fileSize": {size}}.Encode()
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, withSize(newUploadRequest(t, "s.bin", 0, 2, []byte("abc")), "11"))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too large: status = %d, want 413", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "s.bin.part")); !os.IsNotExist(err) {
+		t.Fatalf("part file created for rejected upload: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, withSize(newUploadRequest(t, "s.bin", 0, 2, []byte("abc")), "7"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "s.bin", 1, 2, []byte("de")))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeFileSizeMismatch) {
+		t.Fatalf("short file: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "s.bin", 1, 2, []byte("defg")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("resent last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	srv := newTestServer(t)
+	if err := os.WriteFile(filepath.Join(srv.cfg.UploadDir, "have.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("data"))
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantAccept bool
+		wantExists bool
+		wantCode   string
+	}{
+		{"new file", url.Values{"fileName": {"new.txt"}, "totalChunks": {"2"}}, true, false, ""},
+		{"bad name", url.Values{"fileName": {"../x"}, "totalChunks": {"2"}}, false, false, CodeInvalidFileName},
+		{"bad total", url.Values{"fileName": {"a"}, "totalChunks": {"0"}}, false, false, CodeInvalidTotalChunks},
+		{"same hash", url.Values{"fileName": {"have.txt"}, "totalChunks": {"1"}, "hash": {hex.EncodeToString(sum[:])}}, true, true, ""},
+		{"other hash", url.Values{"fileName": {"have.txt"}, "totalChunks": {"1"}, "hash": {"00"}}, true, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/upload/preflight", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			srv.preflightHandler(rec, req)
+
+			var resp PreflightResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK || resp.Accepted != tt.wantAccept || resp.Exists != tt.wantExists || resp.Code != tt.wantCode {
+				t.Fatalf("status = %d, resp = %+v", rec.Code, resp)
+			}
+		})
+	}
+	if parts, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, "*.part")); len(parts) != 0 {
+		t.Fatalf("preflight created part files: %v", parts)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := newTestServer(t).withCORS([]string{http.MethodPost}, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("preflight reached the handler")
+	})
+
+	req := httptest.NewRequest(http.MethodOptions, "/upload", nil)
+	req.Header.Set("Origin", AllowedOrigin)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != AllowedOrigin {
+		t.Errorf("allowed origin: Access-Control-Allow-Origin = %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "POST, OPTIONS" {
+		t.Errorf("Access-Control-Allow-Methods = %q", got)
+	}
+	if rec.Header().Get("Access-Control-Max-Age") == "" {
+		t.Error("missing Access-Control-Max-Age")
+	}
+
+	req.Header.Set("Origin", "http://evil.example")
+	rec = httptest.NewRecorder()
+	h(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin echoed: %q", got)
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) {
+		c.AllowedOrigins = []string{"https://app.example.com", "https://*.example.org", "http://*.localhost:5173"}
+		c.CORSAllowCredentials = true
+		c.CORSMaxAge = time.Hour
+	})
+	h := srv.Routes()
+	for origin, want := range map[string]bool{
+		"https://app.example.com":       true,
+		"https://a.example.org":         true,
+		"https://a.b.example.org":       true,
+		"http://x.localhost:5173":       true,
+		"https://example.org":           false,
+		"http://a.example.org":          false,
+		"https://a.example.org.evil.io": false,
+		"https://evil.io/.example.org":  false,
+		"http://x.localhost:5174":       false,
+	} {
+		// Every route, /metrics included, answers preflights.
+		for _, target := range []string{"/upload", "/upload/abc/events", "/metrics"} {
+			req := httptest.NewRequest(http.MethodOptions, target, nil)
+			req.Header.Set("Origin", origin)
+			req.Header.Set("Access-Control-Request-Headers", "x-custom, content-type")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			got := rec.Header().Get("Access-Control-Allow-Origin") == origin
+			if got != want || rec.Code != http.StatusNoContent {
+				t.Errorf("%s from %s: status = %d, allowed = %v, want %v", target, origin, rec.Code, got, want)
+			}
+			if want && rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("%s from %s: no Access-Control-Allow-Credentials", target, origin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "x-custom, content-type" {
+				t.Errorf("%s: Access-Control-Allow-Headers = %q, want the requested ones", target, got)
+			}
+			if got := rec.Header().Get("Access-Control-Max-Age"); got != "3600" {
+				t.Errorf("%s: Access-Control-Max-Age = %q", target, got)
+			}
+		}
+	}
+
+	for env, bad := range map[string]string{
+		"ALLOWED_ORIGINS":        "ftp://files.example",
+		"CORS_MAX_AGE":           "soon",
+		"CORS_ALLOW_CREDENTIALS": "true",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, bad)
+			if env == "CORS_ALLOW_CREDENTIALS" {
+				t.Setenv("ALLOWED_ORIGINS", "*")
+			}
+			if _, err := LoadConfig(nil); err == nil {
+				t.Errorf("%s=%s accepted", env, bad)
+			}
+		})
+	}
+	for _, bad := range []string{"https://a.*.example", "https://app.example/path", "app.example"} {
+		if checkOrigin(bad) == nil {
+			t.Errorf("origin %q accepted", bad)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	srv := newTestServer(t)
+
+	verify := func(form url.Values) (int, VerifyResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/upload/verify", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		srv.verifyHandler(rec, req)
+		var resp VerifyResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "v.bin", 0, 3, []byte("one")))
+	code, resp := verify(url.Values{"fileName": {"v.bin"}})
+	if code != http.StatusOK || resp.Status != VerifyInProgress || resp.Received != 3 ||
+		fmt.Sprint(resp.MissingChunks) != "[1 2]" {
+		t.Fatalf("in progress: %d %+v", code, resp)
+	}
+
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "v.bin", 1, 3, []byte("two")))
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "v.bin", 2, 3, []byte("six")))
+	sum := sha256.Sum256([]byte("onetwosix"))
+	code, resp = verify(url.Values{"fileName": {"v.bin"}, "hash": {hex.EncodeToString(sum[:])}})
+	if code != http.StatusOK || resp.Status != VerifyComplete || resp.Match == nil || !*resp.Match || resp.Size != 9 {
+		t.Fatalf("complete: %d %+v", code, resp)
+	}
+
+	if code, _ := verify(url.Values{"fileName": {"nope"}}); code != http.StatusNotFound {
+		t.Fatalf("unknown file: status = %d, want 404", code)
+	}
+}
+
+func TestCompressAtRest(t *testing.T) {
+	hooks := make(chan WebhookPayload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		hooks <- p
+	}))
+	defer receiver.Close()
+	srv := newTestServer(t, func(c *Config) { c.CompressAtRest = true; c.WebhookURLs = []string{receiver.URL} })
+
+	text := strings.Repeat("compress me please ", 200)
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "notes.txt", 0, 1, []byte(text)))
+	var resp SuccessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if resp.Size != int64(len(text)) || resp.CompressedSize == 0 || resp.CompressedSize >= resp.Size {
+		t.Fatalf("sizes: original %d, compressed %d", resp.Size, resp.CompressedSize)
+	}
+	stored, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "notes.txt"))
+	if err != nil || int64(len(stored)) != resp.CompressedSize || !srv.isCompressed("notes.txt") {
+		t.Fatalf("stored: %d bytes, flagged %v, %v", len(stored), srv.isCompressed("notes.txt"), err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/notes.txt", nil)
+	req.SetPathValue("name", "notes.txt")
+	rec = httptest.NewRecorder()
+	srv.downloadHandler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != text {
+		t.Fatalf("download: status = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	req.Header.Set("Range", "bytes=9-16")
+	rec = httptest.NewRecorder()
+	srv.downloadHandler(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != text[9:17] {
+		t.Fatalf("ranged download: status = %d, body = %q", rec.Code, rec.Body)
+	}
+
+	// The webhook reports the content as uploaded, not as stored.
+	sum := sha256.Sum256([]byte(text))
+	select {
+	case p := <-hooks:
+		if p.Size != int64(len(text)) || p.Hash != hex.EncodeToString(sum[:]) {
+			t.Fatalf("webhook = %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no upload.completed webhook")
+	}
+
+	// A compressed file and a real .gz of the same stem stay apart.
+	gz := gzipped([]byte("already gzipped"))
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "notes.txt.gz", 0, 1, gz))
+	if stored, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "notes.txt.gz")); err != nil || !bytes.Equal(stored, gz) || srv.isCompressed("notes.txt.gz") {
+		t.Fatalf("notes.txt.gz: %v, flagged %v", err, srv.isCompressed("notes.txt.gz"))
+	}
+	req.Header.Del("Range")
+	rec = httptest.NewRecorder()
+	srv.downloadHandler(rec, req)
+	if rec.Body.String() != text {
+		t.Fatalf("notes.txt after notes.txt.gz: %d bytes", rec.Body.Len())
+	}
+
+	if shouldCompress("movie.mp4", "video/mp4") || shouldCompress("blob", "application/zip") {
+		t.Error("already-compressed content should be skipped")
+	}
+}
+
+func TestOutOfOrderChunksWithOffset(t *testing.T) {
+	srv := newTestServer(t)
+
+	send := func(index int, chunk string, extra url.Values) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, "o.bin", index, 3, []byte(chunk))
+		q := url.Values{"fileSize": {"8"}}
+		for k, v := range extra {
+			q[k] = v
+		}
+		req.URL.RawQuery = q.Encode()
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		return rec
+	}
+	bySize := url.Values{"chunkSize": {"3"}}
+
+	if rec := send(1, "dd", bySize); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidOffset) {
+		t.Fatalf("short middle chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for _, c := range []struct {
+		index int
+		chunk string
+	}{{2, "gh"}, {0, "xxx"}, {0, "abc"}} {
+		if rec := send(c.index, c.chunk, bySize); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", c.index, rec.Code, rec.Body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "o.bin")); !os.IsNotExist(err) {
+		t.Fatalf("finalized before every chunk arrived: %v", err)
+	}
+
+	if rec := send(1, "def", url.Values{"offset": {"6"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("overrun: status = %d, want 400", rec.Code)
+	}
+	rec := send(1, "def", url.Values{"offset": {"3"}})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"done":true`) {
+		t.Fatalf("last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "o.bin"))
+	if err != nil || string(got) != "abcdefgh" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+}
+
+func TestUploadSessionsKeepSameNameApart(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.RequireUploadID = true })
+
+	initUpload := func() string {
+		form := url.Values{"fileName": {"photo.jpg"}, "totalChunks": {"2"}}
+		req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		srv.initHandler(rec, req)
+		var resp InitResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK || resp.UploadID == "" {
+			t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return resp.UploadID
+	}
+	send := func(id string, index int, chunk string) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, "photo.jpg", index, 2, []byte(chunk))
+		if id != "" {
+			req.URL.RawQuery = url.Values{"uploadID": {id}}.Encode()
+		}
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		return rec
+	}
+
+	if rec := send("", 0, "x"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeUploadIDRequired) {
+		t.Fatalf("no uploadID: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := send("feedface", 0, "x"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown uploadID: status = %d, want 404", rec.Code)
+	}
+
+	alice, bob := initUpload(), initUpload()
+	send(alice, 0, "AAAA")
+	send(bob, 0, "bbbb")
+	if rec := send(alice, 1, "aaaa"); rec.Code != http.StatusOK {
+		t.Fatalf("alice last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "photo.jpg"))
+	if err != nil || string(got) != "AAAAaaaa" {
+		t.Fatalf("alice's file = %q, %v", got, err)
+	}
+	if rec := send(alice, 1, "aaaa"); rec.Code != http.StatusNotFound {
+		t.Fatalf("finished session reused: status = %d, want 404", rec.Code)
+	}
+	if rec := send(bob, 1, "BBBB"); rec.Code != http.StatusOK {
+		t.Fatalf("bob last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	got, _ = os.ReadFile(filepath.Join(srv.cfg.UploadDir, "photo.jpg"))
+	if string(got) != "bbbbBBBB" {
+		t.Fatalf("bob's file = %q", got)
+	}
+}
+
+func TestConcurrentSessionsForOneName(t *testing.T) {
+	cfg, err := configFrom(map[string]string{})
+	if err != nil || !cfg.RequireUploadID {
+		t.Fatalf("REQUIRE_UPLOAD_ID is off by default (%v)", err)
+	}
+	srv := newTestServer(t, func(c *Config) { c.RequireUploadID = true })
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+
+	// Both clients send report.csv at once, chunk by chunk; neither file
+	// may pick up the other's chunks.
+	const total = 20
+	contents := [][]byte{bytes.Repeat([]byte("A"), total*100), bytes.Repeat([]byte("b"), total*100)}
+	var wg sync.WaitGroup
+	for _, content := range contents {
+		wg.Go(func() {
+			form := url.Values{"fileName": {"report.csv"}, "totalChunks": {strconv.Itoa(total)}, "fileSize": {strconv.Itoa(len(content))}}
+			resp, err := http.PostForm(ts.URL+"/upload/init", form)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var init InitResponse
+			json.NewDecoder(resp.Body).Decode(&init)
+			resp.Body.Close()
+			for i := range total {
+				req := newUploadRequest(t, "report.csv", i, total, content[i*100:(i+1)*100])
+				req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+				req.RequestURI, req.URL.Scheme, req.URL.Host = "", "http", strings.TrimPrefix(ts.URL, "http://")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("session %s chunk %d: status = %d, body = %s", init.UploadID, i, resp.StatusCode, body)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "report.csv"))
+	if err != nil || !(bytes.Equal(got, contents[0]) || bytes.Equal(got, contents[1])) {
+		t.Fatalf("report.csv = %.40q..., %v; want one client's file whole", got, err)
+	}
+}
+
+func TestSessionStatusSurvivesRestart(t *testing.T) {
+	srv := newTestServer(t)
+
+	form := url.Values{"fileName": {"big.iso"}, "totalChunks": {"4"}}
+	req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	var initResp InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &initResp); err != nil {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	id := initResp.UploadID
+
+	for _, i := range []int{0, 1} {
+		req := newUploadRequest(t, "big.iso", i, 4, []byte("data"))
+		req.URL.RawQuery = url.Values{"uploadID": {id}}.Encode()
+		srv.uploadHandler(httptest.NewRecorder(), req)
+	}
+
+	// A new Server over the same directory stands in for a restart.
+	restarted := NewWithStorage(srv.cfg, nil)
+	status := func(id string) (int, StatusResponse) {
+		rec := httptest.NewRecorder()
+		restarted.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/upload/"+id+"/status", nil))
+		var resp StatusResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	code, resp := status(id)
+	if code != http.StatusOK || resp.FileName != "big.iso" || resp.Received != 8 ||
+		fmt.Sprint(resp.ReceivedChunks, resp.MissingChunks) != "[0 1] [2 3]" {
+		t.Fatalf("status: %d %+v", code, resp)
+	}
+	if code, _ := status("0123456789abcdef0123456789abcdef"); code != http.StatusNotFound {
+		t.Fatalf("unknown id: status = %d, want 404", code)
+	}
+
+	for _, i := range []int{2, 3} {
+		req := newUploadRequest(t, "big.iso", i, 4, []byte("data"))
+		req.URL.RawQuery = url.Values{"uploadID": {id}}.Encode()
+		rec := httptest.NewRecorder()
+		restarted.uploadHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d after restart: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "big.iso")); err != nil || len(got) != 16 {
+		t.Fatalf("final file = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestChunkAndFileChecksums(t *testing.T) {
+	srv := newTestServer(t)
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	send := func(index int, chunk string, fields url.Values) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, "m.txt", index, 2, []byte(chunk))
+		req.URL.RawQuery = fields.Encode()
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		return rec
+	}
+
+	rec := send(0, "hello ", url.Values{"md5": {md5hex("hellO ")}})
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeChunkHashMismatch) {
+		t.Fatalf("corrupt chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := send(0, "hello ", url.Values{"md5": {md5hex("hello ")}}); rec.Code != http.StatusOK {
+		t.Fatalf("resent chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	rec = send(1, "world", url.Values{"fileMd5": {md5hex("hello there")}})
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeFileHashMismatch) {
+		t.Fatalf("whole-file mismatch: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "m.txt")); !os.IsNotExist(err) {
+		t.Fatalf("mismatched file was stored: %v", err)
+	}
+
+	send(0, "hello ", nil)
+	if rec := send(1, "world", url.Values{"fileMd5": {md5hex("hello world")}}); rec.Code != http.StatusOK {
+		t.Fatalf("matching file: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+// fakeS3 is just enough of the S3 API for storage.Object: PUT, GET with
+// Range, HEAD, DELETE and multipart uploads, all path-style, signed in a
+// header or pre-signed in the query.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	pending map[string][][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	q := r.URL.Query()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") && !q.Has("X-Amz-Signature") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.pending[key] = nil
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts := f.pending[key]
+		for len(parts) < n {
+			parts = append(parts, nil)
+		}
+		parts[n-1] = body
+		f.pending[key] = parts
+		w.Header().Set("ETag", `"p`+q.Get("partNumber")+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		var complete struct {
+			Parts []struct{ PartNumber, ETag string } `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		for i, p := range complete.Parts {
+			if p.ETag != `"p`+p.PartNumber+`"` || p.PartNumber != strconv.Itoa(i+1) || len(complete.Parts) != len(f.pending[key]) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>bad part</Message></Error>")
+				return
+			}
+		}
+		f.objects[key] = bytes.Join(f.pending[key], nil)
+		delete(f.pending, key)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.pending, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default: // GET, HEAD
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	}
+}
+
+func TestObjectStorageBackend(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte), pending: make(map[string][][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	srv := newTestServer(t, func(c *Config) {
+		c.StorageBackend = storage.BackendS3
+		c.Object = storage.ObjectConfig{Bucket: "b", Region: "us-east-1", Endpoint: ts.URL, Prefix: "up/", AccessKey: "k", SecretKey: "s"}
+	})
+	big := bytes.Repeat([]byte("0123456789abcdef"), (storage.ObjectPartSize+1024)/16)
+	chunks := [][]byte{big[:storage.ObjectPartSize/2], big[storage.ObjectPartSize/2 : storage.ObjectPartSize], big[storage.ObjectPartSize:]}
+	for i, chunk := range chunks {
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, "big.bin", i, len(chunks), chunk))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+		// The first part is in the bucket as soon as its bytes are.
+		if i == 1 {
+			fake.mu.Lock()
+			parts := fake.pending["/b/up/big.bin"]
+			fake.mu.Unlock()
+			if len(parts) != 1 || !bytes.Equal(parts[0], big[:storage.ObjectPartSize]) {
+				t.Fatalf("after chunk 1: %d parts in the bucket", len(parts))
+			}
+		}
+	}
+	if !bytes.Equal(fake.objects["/b/up/big.bin"], big) {
+		t.Fatalf("multipart object has %d bytes, want %d", len(fake.objects["/b/up/big.bin"]), len(big))
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.TempDir, "big.bin*")); len(left) != 0 {
+		t.Fatalf("local files left behind: %v", left)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files/big.bin", nil)
+	req.Header.Set("Range", "bytes=16-31")
+	rec := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "0123456789abcdef" {
+		t.Fatalf("ranged download: status = %d, body = %q", rec.Code, rec.Body)
+	}
+}
+
+func TestObjectStorageConfig(t *testing.T) {
+	base := map[string]string{"STORAGE_BACKEND": "s3", "S3_BUCKET": "b", "S3_ENDPOINT": "http://minio:9000", "S3_REGION": "home"}
+	with := func(kv ...string) map[string]string {
+		m := maps.Clone(base)
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return m
+	}
+	// Without keys the chain looks further, unless told to use only keys.
+	cfg, err := configFrom(with("S3_ADDRESSING", "virtual", "S3_PROFILE", "minio", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/creds"))
+	if err != nil || cfg.Object.Addressing != storage.AddressingVirtual || cfg.Object.Region != "home" ||
+		cfg.Object.Chain.Profile != "minio" || cfg.Object.Chain.ContainerURI != "http://169.254.170.2/v2/creds" ||
+		!slices.Equal(cfg.Object.Chain.Sources, storage.DefaultCredentials) {
+		t.Fatalf("s3 without keys: %+v, %v", cfg.Object, err)
+	}
+	if cfg, err = configFrom(with("S3_CREDENTIALS", "file, imds")); err != nil || !slices.Equal(cfg.Object.Chain.Sources, []string{"file", "imds"}) {
+		t.Fatalf("S3_CREDENTIALS: %v, %v", cfg.Object.Chain.Sources, err)
+	}
+	for _, bad := range []map[string]string{
+		with("S3_CREDENTIALS", "keys"),
+		with("S3_CREDENTIALS", "sso"),
+		with("S3_ADDRESSING", "dns"),
+		with("S3_ENDPOINT", "minio:9000"),
+		with("S3_BUCKET", ""),
+	} {
+		if _, err := configFrom(bad); err == nil {
+			t.Errorf("%v accepted", bad)
+		}
+	}
+
+	azure := map[string]string{"STORAGE_BACKEND": "azure", "AZURE_STORAGE_ACCOUNT": "acct", "AZURE_CONTAINER": "c"}
+	if cfg, err := configFrom(azure); err != nil || cfg.Azure.Auth != storage.AzureAuthIdentity {
+		t.Fatalf("azure: %+v, %v", cfg.Azure, err)
+	}
+	azure["AZURE_STORAGE_KEY"] = base64.StdEncoding.EncodeToString([]byte("key"))
+	if cfg, err := configFrom(azure); err != nil || cfg.Azure.Auth != storage.AzureAuthKey || string(cfg.Azure.AccountKey) != "key" {
+		t.Fatalf("azure with a key: %+v, %v", cfg.Azure, err)
+	}
+	for k, v := range map[string]string{"AZURE_STORAGE_KEY": "not base64!", "AZURE_AUTH": "sas", "AZURE_CONTAINER": "",
+		"AZURE_BLOB_ENDPOINT": "blob.local", "DIRECT_UPLOAD": "true"} {
+		bad := maps.Clone(azure)
+		bad[k] = v
+		if _, err := configFrom(bad); err == nil {
+			t.Errorf("azure with %s=%q accepted", k, v)
+		}
+	}
+
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "known_hosts")
+	os.WriteFile(hosts, nil, 0o600)
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, _ := ssh.MarshalPrivateKey(priv, "")
+	keyFile := filepath.Join(dir, "id_ed25519")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600)
+	sftp := map[string]string{"STORAGE_BACKEND": "sftp", "SFTP_ADDR": "files.local", "SFTP_USER": "ingest",
+		"SFTP_KEY_FILE": keyFile, "SFTP_KNOWN_HOSTS": hosts, "SFTP_DIR": "/incoming"}
+	cfg, err = configFrom(sftp)
+	if err != nil || cfg.SFTP.Addr != "files.local:22" || len(cfg.SFTP.Auth) != 1 || cfg.SFTP.HostKey == nil ||
+		cfg.SFTP.Conns != storage.DefaultSFTPConns || cfg.SFTP.Retries != storage.DefaultSFTPRetries {
+		t.Fatalf("sftp: %+v, %v", cfg.SFTP, err)
+	}
+	if tc := cfg.forTenant("acme"); tc.SFTP.Dir != "/incoming/acme" {
+		t.Errorf("tenant SFTP_DIR = %q", tc.SFTP.Dir)
+	}
+	for k, v := range map[string]string{"SFTP_KEY_FILE": "", "SFTP_USER": "", "SFTP_KNOWN_HOSTS": filepath.Join(dir, "none"),
+		"SFTP_CONNECTIONS": "0", "SFTP_RETRIES": "-1", "SFTP_KEY_PASSPHRASE": "not encrypted", "DIRECT_UPLOAD": "true"} {
+		bad := maps.Clone(sftp)
+		bad[k] = v
+		if _, err := configFrom(bad); err == nil {
+			t.Errorf("sftp with %s=%q accepted", k, v)
+		}
+	}
+}
+
+func TestDirectUpload(t *testing.T) {
+	s3 := map[string]string{"STORAGE_BACKEND": "s3", "S3_BUCKET": "b", "S3_ACCESS_KEY_ID": "k", "S3_SECRET_ACCESS_KEY": "s"}
+	if _, err := configFrom(map[string]string{"DIRECT_UPLOAD": "true"}); err == nil {
+		t.Error("DIRECT_UPLOAD accepted with disk storage")
+	}
+	for k, v := range map[string]string{"MAP_FILE_NAMES": "true", "DIRECT_UPLOAD_URL_TTL": "8d"} {
+		bad := map[string]string{"DIRECT_UPLOAD": "true", k: v}
+		for sk, sv := range s3 {
+			bad[sk] = sv
+		}
+		if _, err := configFrom(bad); err == nil {
+			t.Errorf("DIRECT_UPLOAD with %s=%s accepted", k, v)
+		}
+	}
+	s3["DIRECT_UPLOAD"] = "true"
+	if cfg, err := configFrom(s3); err != nil || !cfg.DirectUpload || cfg.DirectUploadURLTTL != DefaultDirectUploadURLTTL {
+		t.Fatalf("DIRECT_UPLOAD with s3: %+v, %v", cfg.DirectUpload, err)
+	}
+
+	fake := &fakeS3{objects: make(map[string][]byte), pending: make(map[string][][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	srv := newTestServer(t, func(c *Config) {
+		c.StorageBackend = storage.BackendS3
+		c.Object = storage.ObjectConfig{Bucket: "b", Region: "us-east-1", Endpoint: ts.URL, Prefix: "up/", AccessKey: "k", SecretKey: "s"}
+		c.DirectUpload = true
+	})
+	h := srv.Routes()
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	start := func(name string, size int) DirectUpload {
+		t.Helper()
+		rec := do(http.MethodPost, "/upload/direct", "application/x-www-form-urlencoded",
+			url.Values{"fileName": {name}, "fileSize": {strconv.Itoa(size)}}.Encode())
+		var up DirectUpload
+		if err := json.Unmarshal(rec.Body.Bytes(), &up); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("POST /upload/direct: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return up
+	}
+	complete := func(id string, parts []CompletedPart) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"parts": parts})
+		return do(http.MethodPost, "/upload/"+id+"/complete", "application/json", string(body))
+	}
+
+	if rec := do(http.MethodPost, "/upload/direct", "application/x-www-form-urlencoded", "fileName=a.bin"); rec.Code != http.StatusBadRequest {
+		t.Errorf("no fileSize: status = %d", rec.Code)
+	}
+	data := bytes.Repeat([]byte("direct!"), (storage.MinMultipartPart+100)/7)
+	up := start("movie.bin", len(data))
+	if up.PartSize != storage.MinMultipartPart || up.TotalParts != 2 || len(up.Parts) != 2 || up.URLsExpireAt.IsZero() {
+		t.Fatalf("direct upload = %+v", up)
+	}
+
+	// The parts go to the bucket, not to the server.
+	var parts []CompletedPart
+	for _, p := range up.Parts {
+		from := int64(p.PartNumber-1) * up.PartSize
+		req, _ := http.NewRequest(http.MethodPut, p.URL, bytes.NewReader(data[from:min(from+up.PartSize, int64(len(data)))]))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("PUT part %d: %v %v", p.PartNumber, resp, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, CompletedPart{p.PartNumber, resp.Header.Get("ETag")})
+	}
+	if rec := do(http.MethodPut, "/upload/"+up.UploadID+"/chunk/0", "", string(data[:10])); rec.Code != http.StatusBadRequest {
+		t.Errorf("chunk POST to a direct upload: status = %d", rec.Code)
+	}
+	rec := do(http.MethodGet, "/upload/"+up.UploadID+"/parts", "", "")
+	var again DirectUpload
+	if json.Unmarshal(rec.Body.Bytes(), &again); rec.Code != http.StatusOK || len(again.Parts) != 2 {
+		t.Fatalf("GET parts: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	if rec := complete(up.UploadID, parts[:1]); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INCOMPLETE_UPLOAD") {
+		t.Errorf("missing part: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	wrong := []CompletedPart{parts[0], {2, `"nope"`}}
+	if rec := complete(up.UploadID, wrong); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INCOMPLETE_UPLOAD") {
+		t.Errorf("wrong ETag: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = complete(up.UploadID, parts)
+	var done SuccessResponse
+	if json.Unmarshal(rec.Body.Bytes(), &done); rec.Code != http.StatusOK || !done.Done || done.Size != int64(len(data)) {
+		t.Fatalf("complete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(fake.objects["/b/up/movie.bin"], data) {
+		t.Fatalf("object has %d bytes, want %d", len(fake.objects["/b/up/movie.bin"]), len(data))
+	}
+	if rec := do(http.MethodGet, "/upload/"+up.UploadID+"/parts", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("parts of a completed upload: status = %d", rec.Code)
+	}
+
+	// Aborting the session aborts the multipart upload.
+	up = start("dropped.bin", 10)
+	if _, ok := fake.pending["/b/up/dropped.bin"]; !ok {
+		t.Fatal("multipart upload not started")
+	}
+	if rec := do(http.MethodDelete, "/upload/"+up.UploadID, "", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("abort: status = %d", rec.Code)
+	}
+	if _, ok := fake.pending["/b/up/dropped.bin"]; ok {
+		t.Error("multipart upload left open after abort")
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Routes()
+	do := func(method, target string, body string, hdr map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", TusVersion)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	patch := func(loc, offset, body string, hdr map[string]string) *httptest.ResponseRecorder {
+		all := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+		for k, v := range hdr {
+			all[k] = v
+		}
+		return do(http.MethodPatch, loc, body, all)
+	}
+
+	rec := do(http.MethodOptions, "/files/", "", nil)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Tus-Version") != TusVersion ||
+		!strings.Contains(rec.Header().Get("Tus-Extension"), "checksum") {
+		t.Fatalf("OPTIONS: status = %d, headers = %v", rec.Code, rec.Header())
+	}
+
+	rec = do(http.MethodPost, "/files/", "", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("tus.txt")) + ",filetype dGV4dC9wbGFpbg==",
+	})
+	loc := rec.Header().Get("Location")
+	if rec.Code != http.StatusCreated || !strings.HasPrefix(loc, "/files/") {
+		t.Fatalf("create: status = %d, Location = %q, body = %s", rec.Code, loc, rec.Body)
+	}
+
+	if rec = do(http.MethodHead, loc, "", nil); rec.Header().Get("Upload-Offset") != "0" || rec.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("HEAD: status = %d, headers = %v", rec.Code, rec.Header())
+	}
+	if rec = patch(loc, "0", "hello ", nil); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("PATCH 1: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec = patch(loc, "0", "world", nil); rec.Code != http.StatusConflict {
+		t.Fatalf("stale offset: status = %d, want 409", rec.Code)
+	}
+	if rec = patch(loc, "6", "world", map[string]string{"Content-Encoding": "gzip"}); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("compressed PATCH: status = %d, want 415", rec.Code)
+	}
+	if rec = patch(loc, "6", "world", map[string]string{"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(make([]byte, 20))}); rec.Code != tusChecksumMismatch {
+		t.Fatalf("bad checksum: status = %d, want 460", rec.Code)
+	}
+	if rec = do(http.MethodHead, loc, "", nil); rec.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("offset after rejected PATCH = %q, want 6", rec.Header().Get("Upload-Offset"))
+	}
+	sum := sha1.Sum([]byte("world"))
+	if rec = patch(loc, "6", "world", map[string]string{"Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(sum[:])}); rec.Code != http.StatusNoContent {
+		t.Fatalf("PATCH 2: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "tus.txt"))
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("stored file = %q, %v", got, err)
+	}
+	if rec = do(http.MethodHead, loc, "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("HEAD after completion: status = %d, want 404", rec.Code)
+	}
+	// A plain GET on the same prefix still downloads completed files.
+	req := httptest.NewRequest(http.MethodGet, "/files/tus.txt", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+		t.Fatalf("download: status = %d, body = %q", rec.Code, rec.Body)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := writeTemp(t, dir, "upload.yaml", `# deployment settings
+upload_dir: /srv/uploads
+max_file_size: 1000
+port: "9000"
+allowed_origins:
+  - https://a.example
+  - https://b.example # staging
+`)
+	t.Setenv("MAX_FILE_SIZE", "2000")
+
+	cfg, err := LoadConfig([]string{"-config", yamlFile, "-port", "127.0.0.1:9100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UploadDir != "/srv/uploads" || cfg.TempDir != "/srv/uploads" {
+		t.Errorf("dirs from file = %q, %q", cfg.UploadDir, cfg.TempDir)
+	}
+	if cfg.MaxFileSize != 2000 {
+		t.Errorf("MaxFileSize = %d, env should beat the file", cfg.MaxFileSize)
+	}
+	if cfg.Addr != "127.0.0.1:9100" {
+		t.Errorf("Addr = %q, flag should beat the file", cfg.Addr)
+	}
+	if strings.Join(cfg.AllowedOrigins, " ") != "https://a.example https://b.example" {
+		t.Errorf("AllowedOrigins = %q", cfg.AllowedOrigins)
+	}
+
+	// Full YAML: a # inside quotes is not a comment, block scalars fold.
+	for src, want := range map[string]string{
+		`webhook_secret: "s3cr#t # not a comment"`:       "s3cr#t # not a comment",
+		"webhook_secret: >-\n  folded\n  secret # too\n": "folded secret # too",
+		"webhook_secret: |\n  two\n  lines\n":            "two\nlines\n",
+	} {
+		cfg, err := LoadConfig([]string{"-config", writeTemp(t, dir, "secret.yaml", src)})
+		if err != nil || cfg.WebhookSecret != want {
+			t.Errorf("%q: WebhookSecret = %q, %v; want %q", src, cfg.WebhookSecret, err, want)
+		}
+	}
+
+	jsonFile := writeTemp(t, dir, "upload.json", `{"upload_ttl": "24h", "compress_at_rest": true, "allowed_origins": ["https://c.example"]}`)
+	t.Setenv("CONFIG_FILE", jsonFile)
+	if cfg, err = LoadConfig(nil); err != nil || cfg.UploadTTL != 24*time.Hour || !cfg.CompressAtRest || cfg.Addr != Port {
+		t.Errorf("JSON config = %+v, %v", cfg, err)
+	}
+
+	for name, args := range map[string][]string{
+		"bad mode":    {"-file-mode", "0999"},
+		"bad bool":    {"-compress-at-rest", "yes please"},
+		"bad port":    {"-port", "host:"},
+		"bad webhook": {"-webhook-url", "ftp://x"},
+		"unknown key": {"-config", writeTemp(t, dir, "bad.yml", "upload_dri: /tmp\n")},
+		"nested key":  {"-config", writeTemp(t, dir, "nested.yml", "upload_dir:\n  path: /tmp\n")},
+		"bad yaml":    {"-config", writeTemp(t, dir, "unclosed.yml", "upload_dir: [/tmp\n")},
+		"json object": {"-config", writeTemp(t, dir, "nested.json", `{"upload_dir": {"path": "/tmp"}}`)},
+	} {
+		if _, err := LoadConfig(args); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+func TestTLSServesHTTP2AndRedirects(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir)
+	cfg, err := configFrom(map[string]string{"PORT": "8443", "TLS_CERT": certFile, "TLS_KEY": keyFile, "HTTP_REDIRECT_ADDR": "80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, redirect, err := cfg.TLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	ts.TLS = tlsConfig
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("served over %s, want HTTP/2.0", body)
+	}
+
+	for target, want := range map[string]string{
+		"http://files.example/upload?x=1":     "https://files.example:8443/upload?x=1",
+		"http://files.example:80/files/a.txt": "https://files.example:8443/files/a.txt",
+		"http://[::1]/":                       "https://[::1]:8443/",
+	} {
+		rec := httptest.NewRecorder()
+		redirect.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != want {
+			t.Errorf("%s: %d to %q, want 308 to %q", target, rec.Code, rec.Header().Get("Location"), want)
+		}
+	}
+
+	if cfg, _ := configFrom(nil); cfg.TLSEnabled() {
+		t.Error("TLS enabled without settings")
+	}
+	for name, values := range map[string]map[string]string{
+		"cert only":         {"TLS_CERT": certFile},
+		"cert and autocert": {"TLS_CERT": certFile, "TLS_KEY": keyFile, "AUTOCERT_HOSTS": "files.example"},
+		"autocert address":  {"AUTOCERT_HOSTS": "files.example:443"},
+		"autocert wildcard": {"AUTOCERT_HOSTS": "*.example"},
+		"directory scheme":  {"AUTOCERT_HOSTS": "files.example", "AUTOCERT_DIRECTORY_URL": "http://acme.test/dir"},
+		"redirect no TLS":   {"HTTP_REDIRECT_ADDR": ":80"},
+	} {
+		if _, err := configFrom(values); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+	cfg, err = configFrom(map[string]string{"AUTOCERT_HOSTS": "Files.example, www.files.example", "HTTP_REDIRECT_ADDR": ":80"})
+	if err != nil || strings.Join(cfg.AutocertHosts, " ") != "files.example www.files.example" || cfg.AutocertDir != DefaultAutocertDir {
+		t.Fatalf("autocert config = %q in %q, %v", cfg.AutocertHosts, cfg.AutocertDir, err)
+	}
+	if tlsConfig, _, err = cfg.TLS(); err != nil || !slices.Contains(tlsConfig.NextProtos, "h2") || tlsConfig.GetCertificate == nil {
+		t.Errorf("autocert TLS config = %+v, %v", tlsConfig, err)
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	cfg, err := configFrom(nil)
+	if err != nil || cfg.ReadHeaderTimeout != DefaultReadHeaderTimeout || cfg.ReadTimeout != 0 || cfg.H2C {
+		t.Fatalf("defaults = %v, %v, %v, %v", cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.H2C, err)
+	}
+	if hs := cfg.HTTPServer(http.NotFoundHandler(), nil); hs.ReadHeaderTimeout != DefaultReadHeaderTimeout || hs.Protocols.UnencryptedHTTP2() {
+		t.Fatalf("default server: ReadHeaderTimeout = %v, h2c = %v", hs.ReadHeaderTimeout, hs.Protocols.UnencryptedHTTP2())
+	}
+	for _, bad := range []string{"0", "-1s", "soon"} {
+		if _, err := configFrom(map[string]string{"READ_HEADER_TIMEOUT": bad}); err == nil {
+			t.Errorf("READ_HEADER_TIMEOUT=%s accepted", bad)
+		}
+	}
+	cfg, err = configFrom(map[string]string{"READ_HEADER_TIMEOUT": "100ms", "READ_TIMEOUT": "5m", "H2C": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := cfg.HTTPServer(http.NotFoundHandler(), nil)
+	if hs.ReadTimeout != 5*time.Minute || !hs.Protocols.UnencryptedHTTP2() || !hs.Protocols.HTTP1() {
+		t.Fatalf("server: ReadTimeout = %v, protocols = %v", hs.ReadTimeout, hs.Protocols)
+	}
+
+	// A client that never finishes its headers is cut off.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve(ln)
+	defer hs.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection held open: %v", err)
+	}
+}
+
+// writeSelfSigned writes a certificate for localhost and 127.0.0.1 and its
+// key as PEM files in dir.
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeTemp(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeTemp(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func writeTemp(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStatusProbeTakesNoUploadSlot(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.MaxConcurrentUploads = 1 })
+	h := srv.Routes()
+	srv.slots <- struct{}{} // an upload in progress holds the only slot
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/upload?fileName=busy.bin", nil))
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Fatalf("HEAD while busy: status = %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "busy.bin", 0, 2, []byte("x")))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST while busy: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	<-srv.slots
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/upload?fileName=busy.bin", nil))
+	if len(srv.slots) != 0 {
+		t.Fatalf("HEAD kept a slot: %d in use", len(srv.slots))
+	}
+}
+
+func TestShutdownDrainsInFlightUploads(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.MaxConcurrentUploads = 1 })
+	hs := &http.Server{Handler: srv.Routes()}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve(ln)
+
+	// Send chunk 0 of 2 in two halves so it is still in flight at shutdown.
+	// The first half must outgrow the client's write buffer to be sent.
+	chunk := bytes.Repeat([]byte("x"), 64<<10)
+	req := newUploadRequest(t, "drain.bin", 0, 2, chunk)
+	body, _ := io.ReadAll(req.Body)
+	split := len(body) / 2
+	started, release := make(chan struct{}), make(chan struct{})
+	post, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/upload",
+		&stallingReader{data: body, split: split, started: started, release: release})
+	post.Header.Set("Content-Type", req.Header.Get("Content-Type"))
+	post.ContentLength = int64(len(body))
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(post)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		done <- result{code: resp.StatusCode}
+	}()
+	<-started
+	for len(srv.slots) == 0 { // wait for the handler to take its slot
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Shutdown(hs, 5*time.Second) }()
+	for draining := false; !draining; {
+		time.Sleep(5 * time.Millisecond)
+		srv.drainMu.Lock()
+		draining = srv.draining
+		srv.drainMu.Unlock()
+	}
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "late.bin", 0, 1, []byte("x")))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), CodeShuttingDown) {
+		t.Fatalf("upload while draining: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	close(release)
+	if res := <-done; res.err != nil || res.code != http.StatusOK {
+		t.Fatalf("in-flight chunk: status = %d, err = %v", res.code, res.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	meta, err := srv.store.LoadMeta("drain.bin")
+	if err != nil || meta.Received[0] != int64(len(chunk)) {
+		t.Fatalf("persisted chunks = %v, %v", meta, err)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	probe := func(h http.Handler, path string) (int, HealthResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body)
+		}
+		return rec.Code, resp
+	}
+
+	srv := newTestServer(t, func(c *Config) {
+		c.APIKeys = "ci:k"
+		c.ShutdownDelay = 100 * time.Millisecond
+	})
+	if code, resp := probe(srv, "/healthz"); code != http.StatusOK || resp.Status != HealthOK || resp.Build.Version == "" {
+		t.Fatalf("healthz: %d %+v", code, resp)
+	}
+	if code, resp := probe(srv, "/readyz"); code != http.StatusOK || resp.Status != HealthReady || resp.Checks["storage"] != HealthOK {
+		t.Fatalf("readyz: %d %+v", code, resp)
+	}
+	if files, _ := os.ReadDir(srv.cfg.UploadDir); len(files) != 0 {
+		t.Fatalf("check left %v behind", files)
+	}
+
+	// A part directory that cannot be written makes the instance unready
+	// but not dead.
+	broken := newTestServer(t, func(c *Config) { c.TempDir = filepath.Join(c.UploadDir, "missing", "parts") })
+	if code, resp := probe(broken, "/readyz"); code != http.StatusServiceUnavailable || resp.Status != HealthUnready || resp.Checks["storage"] == HealthOK {
+		t.Fatalf("unwritable readyz: %d %+v", code, resp)
+	}
+	if code, _ := probe(broken, "/healthz"); code != http.StatusOK {
+		t.Fatalf("unwritable healthz: %d", code)
+	}
+
+	tenants := newTestServer(t, func(c *Config) { c.TenantMode, c.Tenants = TenantByPath, []string{"acme"} })
+	for _, t2 := range tenants.servers() {
+		t2.ensureDirs()
+	}
+	if code, resp := probe(tenants, "/readyz"); code != http.StatusOK || resp.Checks["storage:acme"] != HealthOK || len(resp.Checks) != 1 {
+		t.Fatalf("tenant readyz: %d %+v", code, resp)
+	}
+
+	// Readiness fails as Shutdown begins, while uploads are still taken
+	// for SHUTDOWN_DELAY.
+	hs := &http.Server{Handler: srv}
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Shutdown(hs, time.Second) }()
+	for !srv.stopping() {
+		time.Sleep(time.Millisecond)
+	}
+	if code, resp := probe(srv, "/readyz"); code != http.StatusServiceUnavailable || resp.Status != HealthStopped {
+		t.Fatalf("readyz while stopping: %d %+v", code, resp)
+	}
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "during-delay.bin", 0, 1, []byte("x")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload during SHUTDOWN_DELAY: %d %s", rec.Code, rec.Body)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := probe(srv, "/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz after shutdown: %d", code)
+	}
+}
+
+// stallingReader returns data[:split], then blocks until release is closed
+// before returning the rest together with io.EOF.
+type stallingReader struct {
+	data             []byte
+	split, off       int
+	started, release chan struct{}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if r.off == r.split {
+		close(r.started)
+		<-r.release
+	}
+	end := len(r.data)
+	if r.off < r.split {
+		end = r.split
+	}
+	n := copy(p, r.data[r.off:end])
+	r.off += n
+	if r.off == len(r.data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestJanitorRemovesStaleUploads(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.StaleTTL = time.Hour })
+	upload := func(name string, separate bool) {
+		req := newUploadRequest(t, name, 0, 2, []byte("data"))
+		if separate {
+			req.URL.RawQuery = url.Values{"mode": {UploadModeSeparate}}.Encode()
+		}
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+	}
+	upload("stale.bin", false)
+	upload("chunks.bin", true)
+	upload("fresh.bin", false)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"stale.bin.part", "stale.bin.part.meta", "chunks.bin.chunk.0"} {
+		if err := os.Chtimes(filepath.Join(srv.cfg.TempDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.sweepStale(srv.cfg.StaleTTL)
+	left, _ := filepath.Glob(filepath.Join(srv.cfg.TempDir, "*"))
+	for i := range left {
+		left[i] = filepath.Base(left[i])
+	}
+	if strings.Join(left, " ") != "fresh.bin.part fresh.bin.part.meta" {
+		t.Fatalf("files after sweep = %v", left)
+	}
+	if st := srv.janitorStats(); st.Runs != 1 || st.Removed != 2 || st.FreedBytes == 0 {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	for name, ok := range map[string]bool{"x.part": false, "x.part.3": false, "x.chunk.3": false, "x.chunk": true, "x.partial": true} {
+		if _, err := sanitizeFileName(name, FileNamePolicyUnicode); (err == nil) != ok {
+			t.Errorf("sanitizeFileName(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.Retention = 7 * 24 * time.Hour; c.MaxRetention = 30 * 24 * time.Hour })
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	srv.now = func() time.Time { return now }
+	h := srv.Routes()
+	initUpload := func(retention string) *httptest.ResponseRecorder {
+		form := url.Values{"fileName": {"drop.txt"}, "totalChunks": {"1"}, "retention": {retention}}
+		req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := initUpload("60d"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidRetention) {
+		t.Fatalf("retention over MAX_RETENTION: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec := initUpload("1h")
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || init.Retention != "1h0m0s" {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req := newUploadRequest(t, "drop.txt", 0, 1, []byte("short-lived"))
+	req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var done SuccessResponse
+	json.Unmarshal(rec.Body.Bytes(), &done)
+	if !done.Done || done.ExpiresAt == nil || !done.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("final chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Without a session the server default applies.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "week.txt", 0, 1, []byte("kept a week")))
+	json.Unmarshal(rec.Body.Bytes(), &done)
+	if done.ExpiresAt == nil || !done.ExpiresAt.Equal(now.Add(7*24*time.Hour)) {
+		t.Fatalf("default retention: body = %s", rec.Body)
+	}
+
+	list := func() map[string]UploadInfo {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads", nil))
+		var page UploadListResponse
+		json.Unmarshal(rec.Body.Bytes(), &page)
+		byName := make(map[string]UploadInfo)
+		for _, u := range page.Uploads {
+			byName[u.FileName] = u
+		}
+		return byName
+	}
+	if u := list()["drop.txt"]; u.ExpiresAt == nil || !u.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("listed = %+v", u)
+	}
+
+	// Past its expiry the file is gone at once, and reaped by the janitor.
+	now = now.Add(2 * time.Hour)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/drop.txt", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expired download: status = %d", rec.Code)
+	}
+	if _, ok := list()["drop.txt"]; ok {
+		t.Fatal("expired file still listed")
+	}
+	srv.sweepExpired()
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "drop.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired file not deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "week.txt")); err != nil {
+		t.Fatalf("unexpired file deleted: %v", err)
+	}
+	if st := srv.janitorStats(); st.Expired != 1 || st.ExpiredBytes != int64(len("short-lived")) {
+		t.Fatalf("stats = %+v", st)
+	}
+
+	// The expiry survives a restart.
+	srv = NewWithStorage(srv.cfg, nil)
+	srv.now = func() time.Time { return now.Add(8 * 24 * time.Hour) }
+	srv.sweepExpired()
+	h = srv.Routes()
+	if left := list(); len(left) != 0 {
+		t.Fatalf("left after restart and sweep: %v", left)
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	for _, tc := range []struct {
+		in, policy, want string // want "" = rejected
+	}{
+		{"report.pdf", FileNamePolicyUnicode, "report.pdf"},
+		{"../../etc/cron.d/x", FileNamePolicyUnicode, ""},
+		{`..\boot.ini`, FileNamePolicyUnicode, ""},
+		{"..", FileNamePolicyUnicode, ""},
+		{"  padded.txt ", FileNamePolicyUnicode, "padded.txt"},
+		{"cafe\u0301.txt", FileNamePolicyUnicode, "caf\u00e9.txt"},        // NFD -> NFC
+		{"Vie\u0323\u0302t.txt", FileNamePolicyUnicode, "Vi\u1ec7t.txt"},  // two marks
+		{"\u03b1\u0301.txt", FileNamePolicyUnicode, "\u03ac.txt"},         // Greek
+		{"\u0438\u0306.txt", FileNamePolicyUnicode, "\u0439.txt"},         // Cyrillic
+		{"\u1100\u1161.txt", FileNamePolicyUnicode, "\uac00.txt"},         // Hangul jamo
+		{"invoice\u202Egpj.exe", FileNamePolicyUnicode, "invoicegpj.exe"}, // bidi override dropped
+		{"zero\u200Bwidth", FileNamePolicyUnicode, "zerowidth"},
+		{"no\u00a0break", FileNamePolicyUnicode, "no break"},
+		{"bell\a.txt", FileNamePolicyUnicode, ""},
+		{"bad\xff.txt", FileNamePolicyUnicode, ""},
+		{strings.Repeat("a", 256), FileNamePolicyUnicode, ""},
+		{"r\u00e9sum\u00e9.pdf", FileNamePolicyASCII, ""},
+		{"a:b.txt", FileNamePolicyASCII, ""},
+		{"notes (1).txt", FileNamePolicyASCII, "notes (1).txt"},
+		{"notes (1).txt", FileNamePolicyStrict, ""},
+		{".hidden", FileNamePolicyStrict, ""},
+		{"build-42_final.tar.gz", FileNamePolicyStrict, "build-42_final.tar.gz"},
+	} {
+		got, err := sanitizeFileName(tc.in, tc.policy)
+		if tc.want == "" && err == nil {
+			t.Errorf("%s %q: accepted as %q, want rejection", tc.policy, tc.in, got)
+		} else if tc.want != "" && got != tc.want {
+			t.Errorf("%s %q = %q, %v; want %q", tc.policy, tc.in, got, err, tc.want)
+		}
+	}
+
+	// Both spellings of a name reach the same stored file.
+	srv := newTestServer(t)
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "cafe\u0301.txt", 0, 1, []byte("menu")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "caf\u00e9.txt")); err != nil || string(got) != "menu" {
+		t.Fatalf("stored file = %q, %v", got, err)
+	}
+}
+
+func TestMapFileNames(t *testing.T) {
+	opt := func(c *Config) { c.MapFileNames = true }
+	srv := newTestServer(t, opt)
+	for _, body := range []string{"v1", "version 2"} {
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, "report.pdf", 0, 1, []byte(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "report.pdf")); !os.IsNotExist(err) {
+		t.Fatalf("user file name reached the disk: %v", err)
+	}
+	stored, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, "[0-9a-f]*"))
+	if len(stored) != 1 || !session.ValidID(filepath.Base(stored[0])) {
+		t.Fatalf("stored files = %v, want one generated key (re-upload replaces)", stored)
+	}
+
+	// A new server on the same directory finds the file through the table.
+	restarted := NewWithStorage(srv.cfg, nil)
+	req := httptest.NewRequest(http.MethodGet, "/files/report.pdf", nil)
+	req.SetPathValue("name", "report.pdf")
+	rec := httptest.NewRecorder()
+	restarted.downloadHandler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "version 2" {
+		t.Fatalf("download: status = %d, body = %q", rec.Code, rec.Body)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/files/other.pdf", nil)
+	req.SetPathValue("name", "other.pdf")
+	rec = httptest.NewRecorder()
+	restarted.downloadHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown name: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestContentAddressedLayout(t *testing.T) {
+	for _, env := range []map[string]string{{"STORAGE_LAYOUT": "sharded"}, {"STORAGE_LAYOUT": "content", "MAP_FILE_NAMES": "true"}} {
+		if _, err := configFrom(env); err == nil {
+			t.Errorf("%v accepted", env)
+		}
+	}
+
+	opt := func(c *Config) { c.StorageLayout = storage.LayoutContent }
+	srv := newTestServer(t, opt)
+	for _, name := range []string{"report.pdf", "copy.pdf"} {
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, name, 0, 1, []byte("same bytes")))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload %s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+	}
+	sum := sha256.Sum256([]byte("same bytes"))
+	object := filepath.Join(srv.cfg.UploadDir, filepath.FromSlash(storage.ContentKey(sum[:])))
+	if stored, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, "*", "*", "*")); len(stored) != 1 || stored[0] != object {
+		t.Fatalf("stored files = %v, want only %s", stored, object)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "report.pdf")); !os.IsNotExist(err) {
+		t.Fatalf("file stored under its name: %v", err)
+	}
+
+	// A new server on the same directory finds both names through the table,
+	// and deleting one leaves the other's content in place.
+	restarted := NewWithStorage(srv.cfg, nil)
+	req := httptest.NewRequest(http.MethodDelete, "/uploads/report.pdf", nil)
+	rec := httptest.NewRecorder()
+	restarted.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for name, want := range map[string]int{"report.pdf": http.StatusNotFound, "copy.pdf": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		restarted.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/"+name, nil))
+		if rec.Code != want || (want == http.StatusOK && rec.Body.String() != "same bytes") {
+			t.Errorf("GET %s: status = %d, body = %q", name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestChunkAndCumulativeSizeLimits(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.MaxChunkSize = 4; c.MaxFileSize = 10 })
+	send := func(name string, index, total int, chunk []byte, q url.Values) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, name, index, total, chunk)
+		req.URL.RawQuery = q.Encode()
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, req)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if rec.Code != status || !strings.Contains(rec.Body.String(), code) {
+			t.Fatalf("status = %d, body = %s; want %d %s", rec.Code, rec.Body, status, code)
+		}
+	}
+
+	expect(send("a.bin", 0, 3, []byte("12345"), nil), http.StatusRequestEntityTooLarge, CodeChunkTooLarge)
+	expect(send("a.bin", 0, 3, bytes.Repeat([]byte("x"), 100<<10), nil), http.StatusRequestEntityTooLarge, CodeChunkTooLarge)
+	expect(send("a.bin", 0, 2, []byte("1234"), url.Values{"fileSize": {"9"}}), http.StatusRequestEntityTooLarge, CodeChunkTooLarge)
+	expect(send("a.bin", 0, 9, []byte("1"), url.Values{"fileSize": {"8"}}), http.StatusBadRequest, CodeInvalidTotalChunks)
+
+	// A client claiming 100 chunks is still stopped at MAX_FILE_SIZE...
+	expect(send("lie.bin", 0, 100, []byte("1234"), nil), http.StatusOK, "ok")
+	expect(send("lie.bin", 1, 100, []byte("5678"), nil), http.StatusOK, "ok")
+	expect(send("lie.bin", 2, 100, []byte("9abc"), nil), http.StatusRequestEntityTooLarge, CodeFileTooLarge)
+	// ...or its own declared fileSize.
+	expect(send("decl.bin", 0, 3, []byte("1234"), url.Values{"fileSize": {"6"}}), http.StatusOK, "ok")
+	expect(send("decl.bin", 1, 3, []byte("5678"), nil), http.StatusRequestEntityTooLarge, CodeFileTooLarge)
+
+	// The same holds for separate chunk files, whatever order they arrive in.
+	sep := url.Values{"mode": {UploadModeSeparate}}
+	expect(send("sep.bin", 7, 100, []byte("1234"), sep), http.StatusOK, "ok")
+	expect(send("sep.bin", 3, 100, []byte("5678"), sep), http.StatusOK, "ok")
+	expect(send("sep.bin", 3, 100, []byte("56"), sep), http.StatusOK, "ok") // resend replaces
+	expect(send("sep.bin", 9, 100, []byte("9abc"), sep), http.StatusOK, "ok")
+	expect(send("sep.bin", 0, 100, []byte("d"), sep), http.StatusRequestEntityTooLarge, CodeFileTooLarge)
+	if _, err := os.Stat(filepath.Join(srv.cfg.TempDir, "sep.bin.chunk.0")); !os.IsNotExist(err) {
+		t.Fatalf("rejected chunk was stored: %v", err)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	srv := newTestServer(t, func(c *Config) {
+		c.APIKeys = "ci:k3y"
+		c.JWTSecret = "s3cret"
+		c.JWTIssuer = "issuer"
+		c.AuthRoutes = []string{AuthUpload}
+	})
+	srv.now = func() time.Time { return now }
+	routes := srv.Routes()
+
+	token := func(alg string, claims map[string]interface{}) string {
+		enc := func(v interface{}) string {
+			data, _ := json.Marshal(v)
+			return base64.RawURLEncoding.EncodeToString(data)
+		}
+		signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	valid := map[string]interface{}{"sub": "alice", "iss": "issuer", "exp": now.Add(time.Minute).Unix()}
+	send := func(header, value string) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, "auth.bin", 0, 1, []byte("data"))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for name, tc := range map[string]struct {
+		header, value string
+		status        int
+	}{
+		"no credentials": {"", "", http.StatusUnauthorized},
+		"wrong key":      {"X-API-Key", "nope", http.StatusUnauthorized},
+		"api key":        {"X-API-Key", "k3y", http.StatusOK},
+		"jwt":            {"Authorization", "Bearer " + token("HS256", valid), http.StatusOK},
+		"alg none":       {"Authorization", "Bearer " + token("none", valid), http.StatusUnauthorized},
+		"expired jwt": {"Authorization", "Bearer " + token("HS256", map[string]interface{}{
+			"sub": "alice", "iss": "issuer", "exp": now.Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		"wrong issuer": {"Authorization", "Bearer " + token("HS256", map[string]interface{}{
+			"sub": "alice", "iss": "other"}), http.StatusUnauthorized},
+		"tampered jwt": {"Authorization", "Bearer " + token("HS256", valid) + "A", http.StatusUnauthorized},
+	} {
+		rec := send(tc.header, tc.value)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status = %d, body = %s; want %d", name, rec.Code, rec.Body, tc.status)
+		}
+		if tc.status == http.StatusUnauthorized && (!strings.Contains(rec.Body.String(), CodeUnauthorized) ||
+			rec.Header().Get("WWW-Authenticate") == "") {
+			t.Errorf("%s: 401 without UNAUTHORIZED code or WWW-Authenticate: %v %s", name, rec.Header(), rec.Body)
+		}
+	}
+
+	// Routes outside AUTH_ROUTES and CORS preflights stay open.
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/auth.bin", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("download without credentials: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req := httptest.NewRequest(http.MethodOptions, "/upload", nil)
+	req.Header.Set("Origin", AllowedOrigin)
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("preflight: status = %d", rec.Code)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.APIKeys = "alice:ka,bob:kb"; c.UserQuota = 10 })
+	send := func(key, name string, data []byte) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, name, 0, 1, data)
+		req.Header.Set(APIKeyHeader, key)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("ka", "a.bin", []byte("123456")); rec.Code != http.StatusOK {
+		t.Fatalf("first upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec := send("ka", "b.bin", []byte("123456"))
+	var q QuotaExceededResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &q); err != nil || rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("over quota: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if q.Code != CodeQuotaExceeded || q.User != "alice" || q.Used != 6 || q.Requested != 6 || q.Limit != 10 {
+		t.Fatalf("quota response = %+v", q)
+	}
+	// Replacing a file only counts its new size; other users are separate.
+	if rec := send("ka", "a.bin", []byte("12345678")); rec.Code != http.StatusOK {
+		t.Fatalf("replace: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := send("kb", "c.bin", []byte("123456")); rec.Code != http.StatusOK {
+		t.Fatalf("bob: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Usage survives a restart.
+	restarted := NewWithStorage(srv.cfg, nil)
+	req := httptest.NewRequest(http.MethodPost, "/upload/init?fileName=d.bin&totalChunks=1&fileSize=3", nil)
+	req.Header.Set(APIKeyHeader, "ka")
+	rec = httptest.NewRecorder()
+	restarted.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), `"used":8`) {
+		t.Fatalf("after restart: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := restarted.cleanFileName(QuotaTable); err == nil {
+		t.Fatalf("%s accepted as a file name", QuotaTable)
+	}
+}
+
+func TestDownloadHeadersAndRanges(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		srv := newTestServer(t, func(c *Config) { c.CompressAtRest = compress })
+		text := strings.Repeat("0123456789", 100)
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, "résumé.txt", 0, 1, []byte(text)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		get := func(query string, header ...string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/files/r%C3%A9sum%C3%A9.txt"+query, nil)
+			for i := 0; i < len(header); i += 2 {
+				req.Header.Set(header[i], header[i+1])
+			}
+			rec := httptest.NewRecorder()
+			srv.Routes().ServeHTTP(rec, req)
+			return rec
+		}
+
+		rec = get("")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || rec.Body.String() != text || etag == "" ||
+			!strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") ||
+			rec.Header().Get("Content-Disposition") != "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.txt" {
+			t.Fatalf("compress=%v: full GET: status = %d, headers = %v", compress, rec.Code, rec.Header())
+		}
+		if rec = get("?inline=true"); !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "inline") {
+			t.Errorf("compress=%v: inline: %q", compress, rec.Header().Get("Content-Disposition"))
+		}
+		if rec = get("", "If-None-Match", etag); rec.Code != http.StatusNotModified {
+			t.Errorf("compress=%v: If-None-Match: status = %d", compress, rec.Code)
+		}
+		if rec = get("", "Range", "bytes=995-"); rec.Code != http.StatusPartialContent || rec.Body.String() != "56789" ||
+			rec.Header().Get("Content-Range") != "bytes 995-999/1000" {
+			t.Errorf("compress=%v: open range: status = %d, body = %q, %v", compress, rec.Code, rec.Body, rec.Header())
+		}
+		// Two ranges, the second before the first, need a backward seek.
+		rec = get("", "Range", "bytes=512-514,3-5")
+		if body := rec.Body.String(); rec.Code != http.StatusPartialContent ||
+			!strings.Contains(body, "\r\n\r\n234\r\n") || !strings.Contains(body, "\r\n\r\n345\r\n") {
+			t.Errorf("compress=%v: multi-range: status = %d, body = %q", compress, rec.Code, body)
+		}
+		if rec = get("", "Range", "bytes=2000-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("compress=%v: unsatisfiable range: status = %d", compress, rec.Code)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	routes := srv.Routes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+	serve(newUploadRequest(t, "m.bin", 0, 2, []byte("hello ")))
+	serve(newUploadRequest(t, "m.bin", 1, 2, []byte("world")))
+	serve(newUploadRequest(t, "m.bin", 5, 2, []byte("bad")))
+
+	rec := serve(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("status = %d, headers = %v", rec.Code, rec.Header())
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"chunkupload_chunks_received_total 2\n",
+		"chunkupload_bytes_written_total 11\n",
+		"chunkupload_uploads_completed_total 1\n",
+		`chunkupload_requests_total{route="/upload",method="POST",status="200"} 2` + "\n",
+		`chunkupload_request_failures_total{route="/upload",reason="INVALID_INDEX"} 1` + "\n",
+		`chunkupload_request_duration_seconds_count{route="/upload"} 3` + "\n",
+		`chunkupload_upload_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"chunkupload_active_sessions 0\n",
+		`chunkupload_dir_bytes{dir="upload"} 11` + "\n",
+		"# TYPE chunkupload_janitor_removed_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestRequestIDLogging(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(NewLogger(&logs, LogFormatJSON, slog.LevelInfo))
+	defer slog.SetDefault(prev)
+
+	routes := newTestServer(t).Routes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/init?fileName=l.bin&totalChunks=2", nil)
+	req.Header.Set(RequestIDHeader, "client-req-1")
+	rec := serve(req)
+	if rec.Code != http.StatusOK || rec.Header().Get(RequestIDHeader) != "client-req-1" {
+		t.Fatalf("status = %d, request ID = %q", rec.Code, rec.Header().Get(RequestIDHeader))
+	}
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil {
+		t.Fatal(err)
+	}
+
+	req = newUploadRequest(t, "l.bin", 0, 2, []byte("abc"))
+	req.Header.Set(RequestIDHeader, "bad id\n{")
+	req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+	rec = serve(req)
+	generated := rec.Header().Get(RequestIDHeader)
+	if rec.Code != http.StatusOK || generated == "" || generated == "bad id\n{" {
+		t.Fatalf("status = %d, request ID = %q", rec.Code, generated)
+	}
+
+	var chunkLines int
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["request_id"] != "client-req-1" && entry["request_id"] != generated {
+			t.Errorf("log line without request_id: %s", line)
+		}
+		if entry["msg"] == "wrote chunk" {
+			chunkLines++
+			if entry["upload_id"] != init.UploadID || entry["request_id"] != generated {
+				t.Errorf("chunk line = %s, want upload_id %s", line, init.UploadID)
+			}
+		}
+	}
+	if chunkLines != 1 {
+		t.Errorf("got %d chunk lines, want 1:\n%s", chunkLines, logs.String())
+	}
+}
+
+func TestCompleteByUploadID(t *testing.T) {
+	srv := newTestServer(t)
+	routes := srv.Routes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := serve(httptest.NewRequest(http.MethodPost, "/upload/init?fileName=par.bin&totalChunks=4", nil))
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	id := init.UploadID
+	complete := func() *httptest.ResponseRecorder {
+		return serve(httptest.NewRequest(http.MethodPost, "/upload/"+id+"/complete", nil))
+	}
+
+	// Chunks in parallel, in any order; chunk 1 is left over from an older
+	// server under its legacy name.
+	if err := os.WriteFile(filepath.Join(srv.cfg.TempDir, id+".part.1"), []byte("BB"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for _, c := range []struct {
+		index int
+		data  string
+	}{{3, "DD"}, {0, "AA"}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := newUploadRequest(t, "par.bin", c.index, 4, []byte(c.data))
+			req.URL.RawQuery = url.Values{"uploadID": {id}, "mode": {UploadModeSeparate}}.Encode()
+			if rec := serve(req); rec.Code != http.StatusOK {
+				t.Errorf("chunk %d: status = %d, body = %s", c.index, rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := os.Stat(filepath.Join(srv.cfg.TempDir, id+".chunk.3")); err != nil {
+		t.Fatalf("chunk file: %v", err)
+	}
+
+	if rec := complete(); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing [2]") {
+		t.Fatalf("incomplete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req := newUploadRequest(t, "par.bin", 2, 4, []byte("CC"))
+	req.URL.RawQuery = url.Values{"uploadID": {id}, "mode": {UploadModeSeparate}}.Encode()
+	serve(req)
+
+	if rec := complete(); rec.Code != http.StatusOK {
+		t.Fatalf("complete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "par.bin")); err != nil || string(data) != "AABBCCDD" {
+		t.Fatalf("file = %q, %v", data, err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.TempDir, id+".*")); len(left) != 0 {
+		t.Fatalf("left behind: %v", left)
+	}
+	if rec := complete(); rec.Code != http.StatusNotFound {
+		t.Fatalf("second complete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.Deduplicate = true })
+	routes := srv.Routes()
+	upload := func(name, data string) SuccessResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, newUploadRequest(t, name, 0, 1, []byte(data)))
+		var resp SuccessResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK || !resp.Done {
+			t.Fatalf("upload %s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+		return resp
+	}
+	exists := func(hash string) (int, ExistsResponse) {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/exists?hash="+hash, nil))
+		var resp ExistsResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	sum := sha256.Sum256([]byte("same bytes"))
+	hash := hex.EncodeToString(sum[:])
+
+	if code, resp := exists(hash); code != http.StatusOK || resp.Exists {
+		t.Fatalf("before upload: %d %+v", code, resp)
+	}
+	first := upload("a.bin", "same bytes")
+	if first.DuplicateOf != "" {
+		t.Fatalf("first upload = %+v", first)
+	}
+	second := upload("b.bin", "same bytes")
+	if second.DuplicateOf != "a.bin" || second.Path != first.Path || second.Size != 10 {
+		t.Fatalf("duplicate upload = %+v", second)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "b.bin")); !os.IsNotExist(err) {
+		t.Fatalf("duplicate was stored: %v", err)
+	}
+	if code, resp := exists(strings.ToUpper(hash)); code != http.StatusOK || !resp.Exists || resp.FileName != "a.bin" || resp.Size != 10 {
+		t.Fatalf("exists: %d %+v", code, resp)
+	}
+	if code, _ := exists("abc"); code != http.StatusBadRequest {
+		t.Fatalf("bad hash: status = %d", code)
+	}
+
+	// Replacing a.bin retires its old hash.
+	upload("a.bin", "other bytes")
+	if _, resp := exists(hash); resp.Exists {
+		t.Fatalf("stale hash still indexed: %+v", resp)
+	}
+	if third := upload("c.bin", "same bytes"); third.DuplicateOf != "" {
+		t.Fatalf("upload after replace = %+v", third)
+	}
+}
+
+// recordingDriver is a database/sql driver that only logs the statements
+// it executes, for TestMetadataDB.
+type recordingDriver struct {
+	mu    sync.Mutex
+	execs []string // query, then args, space-separated
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c recordingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c recordingConn) Close() error                        { return nil }
+func (c recordingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	line := strings.Join(strings.Fields(query), " ")
+	for _, a := range args {
+		line += fmt.Sprintf(" [%v]", a.Value)
+	}
+	c.d.mu.Lock()
+	c.d.execs = append(c.d.execs, line)
+	c.d.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+
+var testDriver = &recordingDriver{}
+
+func init() { sql.Register("chunkupload-recording", testDriver) }
+
+func TestMetadataDB(t *testing.T) {
+	for _, tc := range []struct{ in, driver, dsn string }{
+		{"uploads.db", DriverSQLite, "uploads.db"},
+		{"sqlite:///var/lib/uploads.db", DriverSQLite, "/var/lib/uploads.db"},
+		{"postgres://u:p@db/uploads?sslmode=disable", DriverPostgres, "postgres://u:p@db/uploads?sslmode=disable"},
+		{"mysql://db", "", ""},
+		{"sqlite:", "", ""},
+	} {
+		driver, dsn, err := parseMetadataDB(tc.in)
+		if driver != tc.driver || dsn != tc.dsn || (err != nil) != (tc.driver == "") {
+			t.Errorf("parseMetadataDB(%q) = %q, %q, %v", tc.in, driver, dsn, err)
+		}
+	}
+	if _, err := openMetaDB("no-such-driver", "x"); err == nil {
+		t.Fatal("opened a database without its driver")
+	}
+
+	db, err := openMetaDB("chunkupload-recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t)
+	srv.db = db
+	routes := srv.Routes()
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload/init?fileName=db.bin&totalChunks=2&fileSize=6", nil))
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("abc"))
+	for i, data := range []string{"abc", "def"} {
+		req := newUploadRequest(t, "db.bin", i, 2, []byte(data))
+		q := url.Values{"uploadID": {init.UploadID}}
+		if i == 0 {
+			q.Set(ChecksumSHA256, hex.EncodeToString(sum[:]))
+		}
+		req.URL.RawQuery = q.Encode()
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+	}
+
+	testDriver.mu.Lock()
+	execs := strings.Join(testDriver.execs, "\n")
+	testDriver.mu.Unlock()
+	for _, want := range []string{
+		"CREATE TABLE IF NOT EXISTS uploads",
+		"INSERT INTO uploads (id, file_name, owner, file_size, total_chunks, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		fmt.Sprintf("[%s] [db.bin] [] [6] [2] [in_progress]", init.UploadID),
+		"INSERT INTO upload_chunks",
+		fmt.Sprintf("[%s] [0] [3] [sha256:%x]", init.UploadID, sum),
+		fmt.Sprintf("[%s] [1] [3] []", init.UploadID),
+		fmt.Sprintf("[%s] [db.bin] [] [complete] [6] [] [%s]", init.UploadID, filepath.Join(srv.cfg.UploadDir, "db.bin")),
+	} {
+		if !strings.Contains(execs, want) {
+			t.Errorf("no statement with %q in:\n%s", want, execs)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	const token = "0123456789abcdef"
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	srv := newTestServer(t, func(c *Config) { c.AuditLog = path; c.APIKeys = "alice:ka"; c.AdminToken = token })
+	h := srv.Routes()
+	do := func(req *http.Request, key string) *httptest.ResponseRecorder {
+		t.Helper()
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		req.RemoteAddr = "192.0.2.7:4242"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	query := func(params string) []AuditRecord {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/admin/audit?"+params, nil)
+		req.Header.Set(AdminTokenHeader, token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var resp AuditResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("audit %s: status = %d, body = %s", params, rec.Code, rec.Body)
+		}
+		return resp.Records
+	}
+
+	rec := do(httptest.NewRequest(http.MethodPost, "/upload/init?fileName=a.bin&totalChunks=1&fileSize=5", nil), "ka")
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(newUploadRequest(t, "a.bin", 0, 1, []byte("hello")), ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("chunk without key: status = %d", rec.Code)
+	}
+	req := newUploadRequest(t, "a.bin", 0, 1, []byte("hello"))
+	req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+	if rec := do(req, "ka"); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(httptest.NewRequest(http.MethodGet, "/files/a.bin", nil), "ka"); rec.Body.String() != "hello" {
+		t.Fatalf("download: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	do(httptest.NewRequest(http.MethodGet, "/upload/config", nil), "ka") // not audited
+
+	all := query("")
+	if len(all) != 4 {
+		t.Fatalf("records = %+v", all)
+	}
+	if got := all[0]; got.Action != AuditDownload || got.User != "alice" || got.FileName != "a.bin" ||
+		got.Bytes != 5 || got.Result != AuditSuccess || got.SourceIP != "192.0.2.7" || got.RequestID == "" {
+		t.Errorf("newest = %+v", got)
+	}
+	if got := all[3]; got.Action != AuditInit || got.UploadID != init.UploadID || got.FileName != "a.bin" {
+		t.Errorf("oldest = %+v", got)
+	}
+	failed := query("result=failure")
+	if len(failed) != 1 || failed[0].Action != AuditChunk || failed[0].User != "" ||
+		failed[0].Status != http.StatusUnauthorized || failed[0].Code != CodeUnauthorized {
+		t.Errorf("failures = %+v", failed)
+	}
+	if got := query("user=alice&action=chunk"); len(got) != 1 || got[0].UploadID != init.UploadID || got[0].Bytes == 0 {
+		t.Errorf("alice's chunks = %+v", got)
+	}
+	if got := query("limit=2"); len(got) != 2 || got[0] != all[0] || got[1] != all[1] {
+		t.Errorf("limit=2 = %+v", got)
+	}
+	if got := query("since=" + all[0].Time.Add(time.Second).Format(time.RFC3339)); len(got) != 0 {
+		t.Errorf("since after the last = %+v", got)
+	}
+	for _, bad := range []string{"action=list", "result=maybe", "since=yesterday", "limit=0", "tenant=x"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/audit?"+bad, nil)
+		req.Header.Set(AdminTokenHeader, token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d", bad, rec.Code)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != AuditFileMode {
+		t.Errorf("audit file: %v, %v", fi, err)
+	}
+
+	// Rotation keeps the newest AUDIT_LOG_MAX_FILES files besides the
+	// current one.
+	rotating := newAuditFile(Config{AuditLog: filepath.Join(t.TempDir(), "r.jsonl"), AuditMaxSize: 300, AuditMaxFiles: 2}, time.Now)
+	for i := range 10 {
+		if err := rotating.append(AuditRecord{RequestID: strconv.Itoa(i), Action: AuditChunk}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, err := rotating.rotated(); err != nil || len(files) != 2 {
+		t.Fatalf("rotated = %v, %v", files, err)
+	}
+	kept, err := rotating.query(auditFilter{limit: MaxListLimit})
+	if err != nil || len(kept) == 0 || len(kept) >= 10 || kept[0].RequestID != "9" {
+		t.Fatalf("kept = %+v, %v", kept, err)
+	}
+
+	// AUDIT_LOG=db writes to METADATA_DB instead.
+	db, err := openMetaDB("chunkupload-recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbSrv := newTestServer(t, func(c *Config) { c.AuditLog = AuditDB })
+	dbSrv.db = db
+	dbSrv.Routes().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload/init?fileName=d.bin&totalChunks=1", nil))
+	testDriver.mu.Lock()
+	execs := strings.Join(testDriver.execs, "\n")
+	testDriver.mu.Unlock()
+	if !strings.Contains(execs, "INSERT INTO audit_log") || !strings.Contains(execs, "[init] [POST] [/upload/init]") {
+		t.Errorf("no audit_log insert in:\n%s", execs)
+	}
+}
+
+func TestManageUploads(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.APIKeys = "alice:ka,bob:kb,root:kr"; c.AdminUsers = []string{"root"} })
+	h := srv.Routes()
+	do := func(method, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set(APIKeyHeader, key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(target, key string) UploadListResponse {
+		t.Helper()
+		rec := do(http.MethodGet, target, key)
+		var resp UploadListResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, body = %s", target, rec.Code, rec.Body)
+		}
+		return resp
+	}
+
+	req := newUploadRequest(t, "a.bin", 0, 1, []byte("hello"))
+	req.Header.Set(APIKeyHeader, "ka")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodPost, "/upload/init?fileName=b.bin&totalChunks=2&fileSize=10", "kb")
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || init.UploadID == "" {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Users see only their own uploads; admins see everything.
+	if got := list("/uploads", "ka"); got.Total != 1 || got.Uploads[0].ID != "a.bin" || got.Uploads[0].Status != UploadComplete || got.Uploads[0].Owner != "alice" || got.Uploads[0].Size != 5 {
+		t.Fatalf("alice's list = %+v", got)
+	}
+	if got := list("/uploads", "kb"); got.Total != 1 || got.Uploads[0].ID != init.UploadID || got.Uploads[0].FileName != "b.bin" || got.Uploads[0].TotalChunks != 2 {
+		t.Fatalf("bob's list = %+v", got)
+	}
+	if got := list("/uploads", "kr"); got.Total != 2 {
+		t.Fatalf("admin list = %+v", got)
+	}
+	if got := list("/uploads?status=in_progress", "kr"); got.Total != 1 || got.Uploads[0].Owner != "bob" {
+		t.Fatalf("in_progress list = %+v", got)
+	}
+	if got := list("/uploads?owner=alice", "kr"); got.Total != 1 || got.Uploads[0].ID != "a.bin" {
+		t.Fatalf("owner list = %+v", got)
+	}
+	if got := list("/uploads?limit=1&offset=1", "kr"); got.Total != 2 || len(got.Uploads) != 1 || got.Offset != 1 || got.Limit != 1 {
+		t.Fatalf("paged list = %+v", got)
+	}
+	if got := list("/uploads?offset=5", "kr"); got.Total != 2 || len(got.Uploads) != 0 {
+		t.Fatalf("past the end = %+v", got)
+	}
+	for _, target := range []string{"/uploads?status=done", "/uploads?limit=0", "/uploads?offset=-1"} {
+		if rec := do(http.MethodGet, target, "kr"); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status = %d", target, rec.Code)
+		}
+	}
+
+	// Other users' uploads are not found, as are names outside the directory.
+	if rec := do(http.MethodGet, "/uploads/"+init.UploadID, "ka"); rec.Code != http.StatusNotFound {
+		t.Fatalf("alice GET bob's upload: status = %d", rec.Code)
+	}
+	for _, target := range []string{"/upload/" + init.UploadID + "/status", "/upload/" + init.UploadID + "/events"} {
+		if rec := do(http.MethodGet, target, "ka"); rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "b.bin") {
+			t.Fatalf("alice GET %s: status = %d, body = %s", target, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(http.MethodGet, "/upload/"+init.UploadID+"/status", "kb"); rec.Code != http.StatusOK {
+		t.Fatalf("bob GET his status: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for _, id := range []string{"missing.bin", "../a.bin", HashTable} {
+		if rec := do(http.MethodGet, "/uploads/"+url.PathEscape(id), "kr"); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %q: status = %d, body = %s", id, rec.Code, rec.Body)
+		}
+	}
+	rec = do(http.MethodGet, "/uploads/"+init.UploadID, "kb")
+	var info UploadInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.Status != UploadInProgress || info.FileSize != 10 || info.CreatedAt == nil {
+		t.Fatalf("bob GET: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Deleting discards the session or the stored file.
+	if rec := do(http.MethodDelete, "/uploads/"+init.UploadID, "kb"); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE session: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/upload/"+init.UploadID+"/status", "kb"); rec.Code != http.StatusNotFound {
+		t.Fatalf("session survived delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/uploads/a.bin", "kb"); rec.Code != http.StatusNotFound {
+		t.Fatalf("bob DELETE alice's file: status = %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/uploads/a.bin", "kr"); rec.Code != http.StatusNoContent {
+		t.Fatalf("admin DELETE: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "a.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a.bin still stored: %v", err)
+	}
+	if got := list("/uploads", "kr"); got.Total != 0 {
+		t.Fatalf("after delete = %+v", got)
+	}
+	if used, _ := srv.quotas.usage("alice", ""); used != 0 {
+		t.Fatalf("alice's usage after delete = %d", used)
+	}
+}
+
+func TestUploadEvents(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Routes()
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload/init?fileName=e.bin&totalChunks=2&fileSize=9", nil))
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || init.UploadID == "" {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if resp, err := http.Get(ts.URL + "/upload/0123456789abcdef0123456789abcdef/events"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown upload: %v %v", resp, err)
+	}
+
+	resp, err := http.Get(ts.URL + "/upload/" + init.UploadID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("events: status = %d, Content-Type = %q", resp.StatusCode, ct)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	next := func() UploadEvent {
+		t.Helper()
+		var typ string
+		for sc.Scan() {
+			line := sc.Text()
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				typ = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				var e UploadEvent
+				if err := json.Unmarshal([]byte(v), &e); err != nil || e.Type != typ {
+					t.Fatalf("bad event %q / %q: %v", typ, v, err)
+				}
+				return e
+			}
+		}
+		t.Fatalf("stream ended: %v", sc.Err())
+		return UploadEvent{}
+	}
+
+	if e := next(); e.Type != EventStatus || e.UploadID != init.UploadID || e.FileName != "e.bin" || e.TotalChunks != 2 || e.FileSize != 9 {
+		t.Fatalf("first event = %+v", e)
+	}
+	for i, chunk := range []string{"hello", "abcd"} {
+		req := newUploadRequest(t, "e.bin", i, 2, []byte(chunk))
+		req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+	}
+	if e := next(); e.Type != EventChunk || e.Index == nil || *e.Index != 0 || e.Bytes != 5 || e.Received != 5 {
+		t.Fatalf("chunk 0 event = %+v", e)
+	}
+	if e := next(); e.Type != EventChunk || *e.Index != 1 || e.Received != 9 {
+		t.Fatalf("chunk 1 event = %+v", e)
+	}
+	if e := next(); e.Type != EventAssembling {
+		t.Fatalf("assembling event = %+v", e)
+	}
+	if e := next(); e.Type != EventComplete || e.Size != 9 || !strings.HasSuffix(e.Path, "e.bin") {
+		t.Fatalf("complete event = %+v", e)
+	}
+	for sc.Scan() {
+		if sc.Text() != "" {
+			t.Fatalf("stream continued after complete: %q", sc.Text())
+		}
+	}
+}
+
+func TestRateAndClientLimits(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv := newTestServer(t, func(c *Config) {
+		c.APIKeys = "alice:ka,bob:kb"
+		c.RateLimitRPS, c.RateLimitBurst = 1, 3
+		c.RateLimitUserRPS, c.RateLimitUserBurst = 1, 2
+		c.MaxUploadsPerClient = 1
+	})
+	srv.now = func() time.Time { return now }
+	h := srv.Routes()
+	init := func(key, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload/init?fileName=r.bin&totalChunks=1", nil)
+		req.Header.Set(APIKeyHeader, key)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// alice's bucket holds 2, the IP's 3.
+	for i := 0; i < 2; i++ {
+		if rec := init("ka", "192.0.2.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("alice %d: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+	}
+	rec := init("ka", "192.0.2.9:1000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" || !strings.Contains(rec.Body.String(), "user alice") {
+		t.Fatalf("alice over budget: status = %d, Retry-After = %q, body = %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+	}
+	if rec := init("kb", "192.0.2.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("bob: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := init("kb", "192.0.2.1:1000"); rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "192.0.2.1") {
+		t.Fatalf("IP over budget: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	now = now.Add(2 * time.Second)
+	if rec := init("ka", "192.0.2.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("after refill: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// One upload in flight per user.
+	slot := func(user string) (func(), *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		req = req.WithContext(context.WithValue(req.Context(), principalKey{}, Principal{Subject: user}))
+		rec := httptest.NewRecorder()
+		release, _ := srv.acquireUploadSlot(rec, req)
+		return release, rec
+	}
+	release, _ := slot("alice")
+	if r, rec := slot("alice"); r != nil || rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" || !strings.Contains(rec.Body.String(), CodeTooManyUploads) {
+		t.Fatalf("second alice upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	bob, _ := slot("bob")
+	if bob == nil {
+		t.Fatal("bob refused")
+	}
+	release()
+	if again, rec := slot("alice"); again == nil {
+		t.Fatalf("alice after release: status = %d, body = %s", rec.Code, rec.Body)
+	} else {
+		again()
+	}
+	bob()
+}
+
+func TestRawChunkUpload(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Routes()
+	init := func(name string, total, size int) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost,
+			fmt.Sprintf("/upload/init?fileName=%s&totalChunks=%d&fileSize=%d", name, total, size), nil))
+		var resp InitResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.UploadID == "" {
+			t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return resp.UploadID
+	}
+	put := func(id string, index int, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/upload/%s/chunk/%d", id, index), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	sha := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	id := init("raw.bin", 3, 11)
+	if rec := put(id, 0, "hello"); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec := put(id, 1, " wo", "X-Upload-ChecksumAlgo", ChecksumSHA256, "X-Upload-ChunkHash", sha("bad"))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeChunkHashMismatch) {
+		t.Fatalf("bad checksum: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := put(id, 1, " wo", "X-Upload-ChecksumAlgo", ChecksumSHA256, "X-Upload-ChunkHash", sha(" wo")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 1: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = put(id, 2, "rld", "X-Upload-FileSha256", sha("hello world"))
+	var done SuccessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &done); err != nil || !done.Done || done.Size != 11 {
+		t.Fatalf("last chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "raw.bin")); err != nil || string(data) != "hello world" {
+		t.Fatalf("stored %q, %v", data, err)
+	}
+
+	// Out of order, as separate chunk files.
+	id = init("sep.bin", 2, 6)
+	for _, c := range []struct {
+		index int
+		body  string
+	}{{1, "def"}, {0, "abc"}} {
+		if rec := put(id, c.index, c.body, "X-Upload-Mode", UploadModeSeparate); rec.Code != http.StatusOK {
+			t.Fatalf("separate chunk %d: status = %d, body = %s", c.index, rec.Code, rec.Body)
+		}
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload/"+id+"/complete", nil))
+	if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "sep.bin")); rec.Code != http.StatusOK || string(data) != "abcdef" {
+		t.Fatalf("complete: status = %d, body = %s, stored %q, %v", rec.Code, rec.Body, data, err)
+	}
+
+	if rec := put("0123456789abcdef0123456789abcdef", 0, "x"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown upload: status = %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/upload/"+init("len.bin", 1, 1)+"/chunk/0", strings.NewReader("x"))
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusLengthRequired {
+		t.Fatalf("no Content-Length: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestStreamedMultipartChunks(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	srv := newTestServer(t, func(c *Config) { c.MaxMemory = 4 })
+	h := srv.Routes()
+	// post sends fields and the chunk in the given order; "chunk" marks the
+	// chunk's place.
+	post := func(chunk string, fields ...string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for i := 0; i < len(fields); i += 2 {
+			if fields[i] == "chunk" {
+				fw, _ := mw.CreateFormFile("chunk", "blob")
+				fw.Write([]byte(chunk))
+				i--
+				continue
+			}
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	stored := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(srv.cfg.UploadDir, name))
+		return string(data)
+	}
+
+	// Fields first with chunkLength: streamed. A wrong length is rejected
+	// and rolled back.
+	base := []string{"fileName", "s.bin", "totalChunks", "2"}
+	if rec := post("hello", append(base, "index", "0", "chunkLength", "5", "chunk")...); rec.Code != http.StatusOK {
+		t.Fatalf("streamed chunk 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for _, length := range []string{"4", "9"} {
+		rec := post(" world", append(base, "index", "1", "chunkLength", length, "chunk")...)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeChunkLengthMismatch) {
+			t.Fatalf("chunkLength %s: status = %d, body = %s", length, rec.Code, rec.Body)
+		}
+	}
+	if size, _ := srv.store.PartSize("s.bin"); size != 5 {
+		t.Fatalf("part size after bad chunks = %d, want 5", size)
+	}
+	if rec := post(" world", append(base, "index", "1", "chunkLength", "6", "chunk")...); rec.Code != http.StatusOK || stored("s.bin") != "hello world" {
+		t.Fatalf("streamed chunk 1: status = %d, body = %s, stored %q", rec.Code, rec.Body, stored("s.bin"))
+	}
+
+	// The chunk first, as browsers' FormData often sends it: buffered (and
+	// spilled past MAX_MEMORY), then the fields after it are read.
+	if rec := post("buffered!", "chunk", "index", "0", "totalChunks", "1", "fileName", "b.bin"); rec.Code != http.StatusOK || stored("b.bin") != "buffered!" {
+		t.Fatalf("chunk first: status = %d, body = %s, stored %q", rec.Code, rec.Body, stored("b.bin"))
+	}
+	// A chunk checksum is verified before writing, so that chunk is buffered too.
+	sum := sha256.Sum256([]byte("checked"))
+	if rec := post("checked", "fileName", "c.bin", "totalChunks", "1", "index", "0", "chunkLength", "7",
+		"checksumAlgo", ChecksumSHA256, "chunkHash", hex.EncodeToString(sum[:]), "chunk"); rec.Code != http.StatusOK || stored("c.bin") != "checked" {
+		t.Fatalf("checksummed: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if left, _ := filepath.Glob(filepath.Join(tmp, "chunk-*")); len(left) != 0 {
+		t.Fatalf("temp files left behind: %v", left)
+	}
+
+	if rec := post("x", "fileName", "x.bin", "totalChunks", "1", "index", "0", "chunkLength", "-1", "chunk"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad chunkLength: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := post("", "fileName", "x.bin", "totalChunks", "1", "index", "0"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeMissingChunk) {
+		t.Fatalf("no chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	master := bytes.Repeat([]byte{7}, 32)
+	srv := newTestServer(t, func(c *Config) { c.EncryptionKey = master })
+	h := srv.Routes()
+	get := func(h http.Handler, name, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files/"+name, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The stored format: "CUE1", a 16-byte file ID, then 64 KiB segments
+	// sealed with a 16-byte tag each.
+	const encSegmentSize, encHeaderSize, encTagSize = 64 << 10, 4 + 16, 16
+
+	// Three segments, the last one partial.
+	data := make([]byte, 2*encSegmentSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	half := len(data) / 2
+	for i, chunk := range [][]byte{data[:half], data[half:]} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newUploadRequest(t, "pii.csv", i, 2, chunk))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "pii.csv")); !os.IsNotExist(err) {
+		t.Fatalf("plaintext reached the disk: %v", err)
+	}
+	ct, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "pii.csv.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ct) != encHeaderSize+len(data)+3*encTagSize || bytes.Contains(ct, data[1000:1100]) {
+		t.Fatalf("stored %d bytes, want %d of ciphertext", len(ct), encHeaderSize+len(data)+3*encTagSize)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.TempDir, "*.part")); len(left) != 0 {
+		t.Fatalf("parts left behind: %v", left)
+	}
+
+	if rec := get(h, "pii.csv", ""); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatalf("download: status = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	// A range across a segment boundary.
+	from, to := encSegmentSize-10, encSegmentSize+9
+	rec := get(h, "pii.csv", fmt.Sprintf("bytes=%d-%d", from, to))
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[from:to+1]) {
+		t.Fatalf("range: status = %d, body = %x", rec.Code, rec.Body)
+	}
+	if size, _, err := srv.store.Stat("pii.csv"); err != nil || size != int64(len(data)) {
+		t.Fatalf("Stat = %d, %v; want the plaintext size %d", size, err, len(data))
+	}
+
+	// A tampered segment fails rather than serving garbage.
+	tampered := bytes.Clone(ct)
+	tampered[encHeaderSize+10] ^= 1
+	os.WriteFile(filepath.Join(srv.cfg.UploadDir, "pii.csv.enc"), tampered, 0o644)
+	if rec := get(h, "pii.csv", "bytes=0-9"); rec.Code == http.StatusPartialContent && bytes.Equal(rec.Body.Bytes(), data[:10]) {
+		t.Fatal("tampered ciphertext served")
+	}
+	os.WriteFile(filepath.Join(srv.cfg.UploadDir, "pii.csv.enc"), ct, 0o644)
+
+	// Another master key cannot unwrap the data key.
+	wrong := NewWithStorage(func() Config { c := srv.cfg; c.EncryptionKey = bytes.Repeat([]byte{8}, 32); return c }(), nil)
+	if rec := get(wrong.Routes(), "pii.csv", ""); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("wrong master key: status = %d, want 500", rec.Code)
+	}
+
+	// Files stored before encryption was enabled are still served.
+	os.WriteFile(filepath.Join(srv.cfg.UploadDir, "old.txt"), []byte("legacy"), 0o644)
+	if rec := get(h, "old.txt", ""); rec.Code != http.StatusOK || rec.Body.String() != "legacy" {
+		t.Fatalf("legacy file: status = %d, body = %q", rec.Code, rec.Body)
+	}
+
+	// Deleting drops the file and its data key.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/uploads/pii.csv", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "pii.csv.enc")); !os.IsNotExist(err) {
+		t.Fatalf("encrypted file kept: %v", err)
+	}
+	if table, _ := os.ReadFile(filepath.Join(srv.cfg.UploadDir, storage.KeyTable)); strings.Contains(string(table), "pii.csv") {
+		t.Fatalf("data key kept: %s", table)
+	}
+
+	// Compression happens before encryption.
+	zsrv := newTestServer(t, func(c *Config) { c.EncryptionKey = master; c.CompressAtRest = true })
+	text := strings.Repeat("name,email\n", 500)
+	rec = httptest.NewRecorder()
+	zsrv.uploadHandler(rec, newUploadRequest(t, "list.csv", 0, 1, []byte(text)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("compressed upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(zsrv.cfg.UploadDir, "list.csv.enc")); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(zsrv.Routes(), "list.csv", "bytes=11-20"); rec.Code != http.StatusPartialContent || rec.Body.String() != "name,email" {
+		t.Fatalf("compressed download: status = %d, body = %q", rec.Code, rec.Body)
+	}
+}
+
+// fakeKMS wraps keys by prefixing them, checking each request is signed
+// for the kms service.
+func fakeKMS(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/kms/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var in struct {
+			KeyId                     string
+			Plaintext, CiphertextBlob []byte
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		if in.KeyId != "alias/uploads" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"NotFoundException","message":"no such key"}`)
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": append([]byte("kms:"), in.Plaintext...)})
+		case "TrentService.Decrypt":
+			json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": bytes.TrimPrefix(in.CiphertextBlob, []byte("kms:"))})
+		default:
+			t.Errorf("unexpected target %q", r.Header.Get("X-Amz-Target"))
+		}
+	}))
+}
+
+func TestEncryptionWithKMS(t *testing.T) {
+	kms := fakeKMS(t)
+	defer kms.Close()
+	cfg, err := configFrom(map[string]string{"KMS_KEY_ID": "alias/uploads", "KMS_ENDPOINT": kms.URL,
+		"S3_ACCESS_KEY_ID": "k", "S3_SECRET_ACCESS_KEY": "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, func(c *Config) { c.KMS = cfg.KMS })
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "a.txt", 0, 1, []byte("secret")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/files/a.txt", nil)
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "secret" {
+		t.Fatalf("download: status = %d, body = %q", rec.Code, rec.Body)
+	}
+
+	for _, values := range []map[string]string{
+		{"ENCRYPTION_KEY": "abcd"},
+		{"ENCRYPTION_KEY": strings.Repeat("ab", 32), "KMS_KEY_ID": "alias/uploads"},
+		{"KMS_KEY_ID": "alias/uploads"}, // no credentials
+	} {
+		if _, err := configFrom(values); err == nil {
+			t.Errorf("configFrom(%v) accepted", values)
+		}
+	}
+	hexKey, b64Key := strings.Repeat("ab", 32), base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xab}, 32))
+	for _, v := range []string{hexKey, b64Key} {
+		if cfg, err := configFrom(map[string]string{"ENCRYPTION_KEY": v}); err != nil || !bytes.Equal(cfg.EncryptionKey, bytes.Repeat([]byte{0xab}, 32)) {
+			t.Errorf("ENCRYPTION_KEY %q: %v", v, err)
+		}
+	}
+}
+
+// fakeClamd answers INSTREAM scans, finding "EICAR" in any stream that
+// contains it.
+func fakeClamd(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if cmd, _ := br.ReadString(0); cmd != "zINSTREAM\x00" {
+					fmt.Fprint(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var data []byte
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(br, size[:]); err != nil {
+						return
+					}
+					n := int(size[0])<<24 | int(size[1])<<16 | int(size[2])<<8 | int(size[3])
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(br, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				if bytes.Contains(data, []byte("EICAR")) {
+					fmt.Fprint(conn, "stream: Eicar-Test-Signature FOUND\x00")
+					return
+				}
+				fmt.Fprint(conn, "stream: OK\x00")
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestVirusScanning(t *testing.T) {
+	clamd := fakeClamd(t)
+	defer clamd.Close()
+	upload := func(srv *Server, name, body string) (*httptest.ResponseRecorder, SuccessResponse) {
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, name, 0, 1, []byte(body)))
+		var resp SuccessResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	db, err := openMetaDB("chunkupload-recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, func(c *Config) { c.ClamdAddr = clamd.Addr().String() })
+	srv.db = db
+	if rec, resp := upload(srv, "clean.txt", "hello"); rec.Code != http.StatusOK || resp.Scan == nil ||
+		resp.Scan.Status != ScanClean || resp.Scan.Scanner != "clamav" {
+		t.Fatalf("clean: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	rec, _ := upload(srv, "bad.exe", "X5O!P%@AP EICAR test file")
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeFileInfected) ||
+		!strings.Contains(rec.Body.String(), "Eicar-Test-Signature") {
+		t.Fatalf("infected: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "bad.exe")); !os.IsNotExist(err) {
+		t.Fatalf("infected file still downloadable: %v", err)
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, Quarantine, "*-bad.exe"))
+	if len(quarantined) != 1 {
+		t.Fatalf("quarantined = %v", quarantined)
+	}
+	if fi, err := os.Stat(quarantined[0]); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("quarantined file: %v, %v", fi, err)
+	}
+	testDriver.mu.Lock()
+	execs := strings.Join(testDriver.execs, "\n")
+	testDriver.mu.Unlock()
+	for _, want := range []string{"INSERT INTO upload_scans", "[bad.exe] [infected] [clamav] [Eicar-Test-Signature]",
+		"[clean.txt] [clean] [clamav]", "UPDATE uploads SET status = ?, updated_at = ? WHERE id = ? [rejected]"} {
+		if !strings.Contains(execs, want) {
+			t.Errorf("no statement with %q in:\n%s", want, execs)
+		}
+	}
+
+	del := newTestServer(t, func(c *Config) { c.ClamdAddr = clamd.Addr().String(); c.ScanInfected = ScanDelete })
+	if rec, _ := upload(del, "bad.exe", "EICAR"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(del.cfg.UploadDir, Quarantine)); !os.IsNotExist(err) {
+		t.Fatalf("quarantine used with SCAN_INFECTED=delete: %v", err)
+	}
+
+	// A scanner that is down rejects the file, unless SCAN_ON_ERROR=accept.
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	reject := newTestServer(t, func(c *Config) { c.ClamdAddr = down.Addr().String() })
+	if rec, _ := upload(reject, "a.txt", "hi"); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), CodeScanFailed) {
+		t.Fatalf("scanner down: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	accept := newTestServer(t, func(c *Config) { c.ClamdAddr = down.Addr().String(); c.ScanOnError = ScanAccept })
+	if rec, resp := upload(accept, "a.txt", "hi"); rec.Code != http.StatusOK || resp.Scan == nil || resp.Scan.Status != ScanError {
+		t.Fatalf("scanner down, accept: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	for _, tc := range []struct{ in, network, addr string }{
+		{"unix:/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"/run/clamd.sock", "unix", "/run/clamd.sock"},
+		{"tcp:clamav:3310", "tcp", "clamav:3310"},
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"clamav", "", ""},
+		{"unix:", "", ""},
+	} {
+		network, addr, err := parseClamdAddr(tc.in)
+		if network != tc.network || addr != tc.addr || (err != nil) != (tc.network == "") {
+			t.Errorf("parseClamdAddr(%q) = %q, %q, %v", tc.in, network, addr, err)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	type delivery struct {
+		header  http.Header
+		payload WebhookPayload
+		body    []byte
+	}
+	var (
+		mu       sync.Mutex
+		attempts = map[string]int{} // by X-Webhook-ID, at the flaky receiver
+		rejected int
+	)
+	got := make(chan delivery, 10)
+	// flaky fails each delivery's first attempt.
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		attempts[r.Header.Get(WebhookIDHeader)]++
+		first := attempts[r.Header.Get(WebhookIDHeader)] == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p WebhookPayload
+		json.Unmarshal(body, &p)
+		got <- delivery{r.Header, p, body}
+	}))
+	defer flaky.Close()
+	// gone answers 410, which is not retried.
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		rejected++
+		mu.Unlock()
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer gone.Close()
+
+	srv := newTestServer(t, func(c *Config) {
+		c.WebhookURLs = []string{flaky.URL, gone.URL}
+		c.WebhookSecret = "s3cret"
+		c.WebhookBackoff = time.Millisecond
+	})
+	h := srv.Routes()
+	next := func(event string) delivery {
+		t.Helper()
+		select {
+		case d := <-got:
+			if d.payload.Event != event || d.header.Get(WebhookEventHeader) != event {
+				t.Fatalf("got %s delivery, want %s: %s", d.payload.Event, event, d.body)
+			}
+			ts := d.header.Get(WebhookTimestampHeader)
+			mac := hmac.New(sha256.New, []byte("s3cret"))
+			mac.Write([]byte(ts + "." + string(d.body)))
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.header.Get(WebhookSignatureHeader) != want {
+				t.Fatalf("signature = %q, want %q", d.header.Get(WebhookSignatureHeader), want)
+			}
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s delivery", event)
+		}
+		return delivery{}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "report.csv", 0, 1, []byte("a,b\n")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	d := next(WebhookCompleted)
+	sum := sha256.Sum256([]byte("a,b\n"))
+	if d.payload.FileName != "report.csv" || d.payload.Size != 4 || d.payload.Hash != hex.EncodeToString(sum[:]) ||
+		d.payload.ID != d.header.Get(WebhookIDHeader) {
+		t.Fatalf("completed payload = %s", d.body)
+	}
+
+	req := newUploadRequest(t, "bad.csv", 0, 1, []byte("x"))
+	req.URL.RawQuery = "fileSha256=" + strings.Repeat("0", 64)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("bad hash: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if d := next(WebhookFailed); d.payload.FileName != "bad.csv" || d.payload.Code != CodeFileHashMismatch {
+		t.Fatalf("failed payload = %s", d.body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/uploads/report.csv", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if d := next(WebhookDeleted); d.payload.FileName != "report.csv" {
+		t.Fatalf("deleted payload = %s", d.body)
+	}
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return rejected
+	}
+	for deadline := time.Now().Add(5 * time.Second); count() < 3 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // room for an unwanted retry
+	mu.Lock()
+	defer mu.Unlock()
+	for id, n := range attempts {
+		if n != 2 {
+			t.Errorf("delivery %s attempted %d times, want 2 (one retry)", id, n)
+		}
+	}
+	if rejected != 3 {
+		t.Errorf("410 receiver got %d requests, want 3 (no retries)", rejected)
+	}
+}
+
+func TestClientUploaderAgainstServer(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+
+	content := bytes.Repeat([]byte("chunked upload "), 700)
+	u := client.NewUploader(client.New(ts.URL))
+	u.ChunkSize, u.Concurrency = 1000, 4
+	var sent int64
+	u.Progress = func(n, total int64) { sent = n }
+	res, err := u.Upload(context.Background(), "sdk.bin", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "sdk.bin"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("stored file: %d bytes, err = %v", len(got), err)
+	}
+	if sent != int64(len(content)) || res.Size != int64(len(content)) {
+		t.Errorf("progress = %d, result = %+v", sent, res)
+	}
+
+	empty, err := u.Upload(context.Background(), "empty.bin", bytes.NewReader(nil), 0)
+	if err != nil || empty.Size != 0 {
+		t.Fatalf("empty upload: %+v, %v", empty, err)
+	}
+
+	// Client.Upload: multipart chunks in a session.
+	path := filepath.Join(t.TempDir(), "plain.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := client.New(ts.URL).Upload(context.Background(), path, 1000); err != nil || res.Skipped {
+		t.Fatalf("Client.Upload: %+v, %v", res, err)
+	}
+	if got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "plain.bin")); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("stored plain.bin: %d bytes, err = %v", len(got), err)
+	}
+}
+
+func TestNewMountsInAnotherMux(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UploadDir = filepath.Join(t.TempDir(), "nested", "uploads")
+	cfg.RequireUploadID = false
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", srv))
+
+	rec := httptest.NewRecorder()
+	req := newUploadRequest(t, "embedded.txt", 0, 1, []byte("hi"))
+	req.URL.Path = "/api/upload"
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if got, err := os.ReadFile(filepath.Join(cfg.UploadDir, "embedded.txt")); err != nil || string(got) != "hi" {
+		t.Fatalf("stored file = %q, %v", got, err)
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) {
+		c.AllowedTypes = []string{"image/*", "text/*"}
+		c.BlockedTypes = []string{"application/x-executable", "text/x-shellscript"}
+	})
+	h := srv.Routes()
+	upload := func(name string, index, total int, chunk []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newUploadRequest(t, name, index, total, chunk))
+		return rec
+	}
+
+	// The bytes decide, not the extension.
+	elf := append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 600)...)
+	if rec := upload("photo.png", 0, 2, elf); rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), CodeTypeNotAllowed) {
+		t.Fatalf("ELF as .png: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := upload("doc.pdf", 0, 1, []byte("%PDF-1.7\n")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("PDF not in ALLOWED_TYPES: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "photo.png.part")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("refused chunk was stored: %v", err)
+	}
+
+	// A first chunk too short to tell is checked again once assembled.
+	if rec := upload("run.txt", 0, 2, []byte("#")); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := upload("run.txt", 1, 2, []byte("!/bin/sh\nrm -rf /\n")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("assembled script: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "run.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("refused file kept: %v", err)
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)
+	for name, want := range map[string]string{
+		"pic.bin":  "image/png",
+		"data.csv": "text/csv; charset=utf-8",
+	} {
+		chunk := png
+		if name == "data.csv" {
+			chunk = []byte("a,b\n1,2\n")
+		}
+		rec := upload(name, 0, 1, chunk)
+		var done SuccessResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &done); err != nil || !done.Done || done.ContentType != want {
+			t.Fatalf("%s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/"+name, nil))
+		if got := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || got != want {
+			t.Fatalf("download %s: status = %d, Content-Type = %q, want %q", name, rec.Code, got, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads?status=complete", nil))
+	var page UploadListResponse
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	for _, u := range page.Uploads {
+		if u.FileName == "pic.bin" && u.ContentType != "image/png" {
+			t.Fatalf("listed = %+v", u)
+		}
+	}
+
+	if _, err := configFrom(map[string]string{"ALLOWED_TYPES": "image"}); err == nil {
+		t.Fatal("ALLOWED_TYPES=image accepted")
+	}
+	cfg, err := configFrom(map[string]string{"BLOCKED_TYPES": " Application/X-Executable, video/* "})
+	if err != nil || !slices.Equal(cfg.BlockedTypes, []string{"application/x-executable", "video/*"}) {
+		t.Fatalf("BLOCKED_TYPES = %q, %v", cfg.BlockedTypes, err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) {
+		c.TenantMode = TenantByAPIKey
+		c.APIKeys = "acme:acme-key,globex:globex-key,acme:acme-ci"
+		c.TenantQuota = 10
+	})
+	h := srv.Routes()
+	as := func(key string, req *http.Request) *httptest.ResponseRecorder {
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The same name is a different file for each tenant.
+	if rec := as("acme-key", newUploadRequest(t, "a.txt", 0, 1, []byte("acme!!"))); rec.Code != http.StatusOK {
+		t.Fatalf("acme upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := as("globex-key", newUploadRequest(t, "a.txt", 0, 1, []byte("globex"))); rec.Code != http.StatusOK {
+		t.Fatalf("globex upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "acme", "a.txt")); err != nil || string(data) != "acme!!" {
+		t.Fatalf("acme file = %q, %v", data, err)
+	}
+	if rec := as("globex-key", httptest.NewRequest(http.MethodGet, "/files/a.txt", nil)); rec.Body.String() != "globex" {
+		t.Fatalf("globex download: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Both acme keys see acme's uploads, and only those.
+	rec := as("acme-ci", httptest.NewRequest(http.MethodGet, "/uploads", nil))
+	var page UploadListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || page.Total != 1 || page.Uploads[0].Owner != "acme" {
+		t.Fatalf("acme list: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// TENANT_QUOTA counts every file of the tenant.
+	rec = as("acme-ci", newUploadRequest(t, "b.txt", 0, 1, []byte("123456")))
+	var q QuotaExceededResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &q); err != nil || rec.Code != http.StatusRequestEntityTooLarge ||
+		q.Tenant != "acme" || q.Used != 6 || q.Limit != 10 {
+		t.Fatalf("over tenant quota: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	if rec := as("", newUploadRequest(t, "c.txt", 0, 1, []byte("x"))); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no key: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	preflight := httptest.NewRequest(http.MethodOptions, "/upload", nil)
+	preflight.Header.Set("Origin", AllowedOrigin)
+	if rec := as("", preflight); rec.Code != http.StatusNoContent {
+		t.Fatalf("preflight: status = %d", rec.Code)
+	}
+
+	// Path mode: /t/{tenant}/ selects the tenant, and tus hands out
+	// Locations under it.
+	srv = newTestServer(t, func(c *Config) {
+		c.TenantMode = TenantByPath
+		c.Tenants = []string{"acme"}
+	})
+	h = srv.Routes()
+	if rec := as("", httptest.NewRequest(http.MethodGet, "/t/other/uploads", nil)); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), CodeUnknownTenant) {
+		t.Fatalf("unknown tenant: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := as("", newUploadRequest(t, "a.txt", 0, 1, []byte("x"))); rec.Code != http.StatusNotFound {
+		t.Fatalf("no tenant: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/t/acme/files/", nil)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Upload-Length", "3")
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("tus.txt")))
+	rec = as("", req)
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusCreated || !strings.HasPrefix(loc, "/t/acme/files/") {
+		t.Fatalf("tus create: status = %d, Location = %q", rec.Code, loc)
+	}
+
+	// In path mode an API key is bound to the tenant of its name, like in
+	// apikey mode: acme's key cannot reach /t/globex/.
+	srv = newTestServer(t, func(c *Config) {
+		c.TenantMode = TenantByPath
+		c.Tenants = []string{"acme", "globex"}
+		c.APIKeys = "acme:acme-key,globex:globex-key"
+	})
+	h = srv.Routes()
+	req = newUploadRequest(t, "g.txt", 0, 1, []byte("globex"))
+	req.URL.Path = "/t/globex/upload"
+	if rec := as("globex-key", req); rec.Code != http.StatusOK {
+		t.Fatalf("globex upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/t/globex/files/g.txt", nil),
+		httptest.NewRequest(http.MethodGet, "/t/globex/uploads", nil),
+		func() *http.Request {
+			req := newUploadRequest(t, "x.txt", 0, 1, []byte("acme"))
+			req.URL.Path = "/t/globex/upload"
+			return req
+		}(),
+	} {
+		if rec := as("acme-key", req); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), CodeWrongTenant) {
+			t.Errorf("acme key on %s %s: status = %d, body = %s", req.Method, req.URL.Path, rec.Code, rec.Body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "globex", "x.txt")); !os.IsNotExist(err) {
+		t.Errorf("acme's upload stored under globex: %v", err)
+	}
+	req = newUploadRequest(t, "a.txt", 0, 1, []byte("acme"))
+	req.URL.Path = "/t/acme/upload"
+	if rec := as("acme-key", req); rec.Code != http.StatusOK {
+		t.Errorf("acme upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	for _, env := range []map[string]string{
+		{"TENANT_MODE": "path"},
+		{"TENANT_MODE": "apikey", "API_KEYS": "Alice:k"},
+		{"TENANT_MODE": "apikey"},
+		{"TENANTS": "acme"},
+	} {
+		if _, err := configFrom(env); err == nil {
+			t.Errorf("%v accepted", env)
+		}
+	}
+}
+
+func TestSharedLocks(t *testing.T) {
+	// Two replicas on the same directory, with a stand-in for LOCK_URL.
+	shared := session.Prefixed(session.NewLocks(), "")
+	a := newTestServer(t, func(c *Config) { c.Locker = shared })
+	b := newTestServer(t, func(c *Config) {
+		c.UploadDir, c.TempDir = a.cfg.UploadDir, a.cfg.TempDir
+		c.Locker = shared
+	})
+	send := func(srv *Server, index int, chunk string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, newUploadRequest(t, "shared.txt", index, 3, []byte(chunk)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: status = %d, body = %s", index, rec.Code, rec.Body)
+		}
+	}
+	send(a, 0, "one,")
+	send(b, 1, "two,")
+	// A retry of chunk 1 reaching the other replica must not append it
+	// again: a learns from the metadata that b stored it.
+	send(a, 1, "two,")
+	send(b, 2, "three")
+
+	data, err := os.ReadFile(filepath.Join(a.cfg.UploadDir, "shared.txt"))
+	if err != nil || string(data) != "one,two,three" {
+		t.Errorf("file = %q, %v", data, err)
+	}
+
+	if _, err := configFrom(map[string]string{"LOCK_URL": "redis://cache:6379, redis://cache2/1", "LOCK_TTL": "10s"}); err != nil {
+		t.Errorf("redis LOCK_URL: %v", err)
+	}
+	for _, env := range []map[string]string{
+		{"LOCK_URL": "memcached://cache"},
+		{"LOCK_URL": "postgres://a/db,postgres://b/db"},
+		{"LOCK_URL": "redis://cache", "LOCK_TTL": "10ms"},
+	} {
+		if _, err := configFrom(env); err == nil {
+			t.Errorf("%v accepted", env)
+		}
+	}
+}
+
+func TestSharedEncryptionKeys(t *testing.T) {
+	// Two replicas encrypting into the same directory each add data keys
+	// to the one key table; neither may lose the other's.
+	master := bytes.Repeat([]byte{7}, 32)
+	a := newTestServer(t, func(c *Config) { c.EncryptionKey = master })
+	b := newTestServer(t, func(c *Config) {
+		c.UploadDir, c.TempDir = a.cfg.UploadDir, a.cfg.TempDir
+		c.EncryptionKey = master
+	})
+	for i, srv := range []*Server{a, b, a, b} {
+		rec := httptest.NewRecorder()
+		name := fmt.Sprintf("f%d.txt", i)
+		srv.Routes().ServeHTTP(rec, newUploadRequest(t, name, 0, 1, []byte(name)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+	}
+	for _, srv := range []*Server{a, b} {
+		for i := range 4 {
+			name := fmt.Sprintf("f%d.txt", i)
+			rec := httptest.NewRecorder()
+			srv.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/"+name, nil))
+			if rec.Code != http.StatusOK || rec.Body.String() != name {
+				t.Errorf("%s: status = %d, body = %q", name, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+// spaceStore reports free bytes as set by the test.
+type spaceStore struct {
+	storage.Storage
+	free *atomic.Int64
+}
+
+func (s spaceStore) Available() (int64, error) { return s.free.Load(), nil }
+
+func TestFreeSpaceWatermark(t *testing.T) {
+	if _, err := configFrom(map[string]string{"MIN_FREE_SPACE": "-1"}); err == nil {
+		t.Error("negative MIN_FREE_SPACE accepted")
+	}
+	hooks := make(chan WebhookPayload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		hooks <- p
+	}))
+	defer receiver.Close()
+
+	cfg := DefaultConfig()
+	cfg.UploadDir = t.TempDir()
+	cfg.MinFreeSpace = 1000
+	cfg.WebhookURLs = []string{receiver.URL}
+	cfg.RequireUploadID = false
+	free := &atomic.Int64{}
+	free.Store(1 << 30)
+	srv := NewWithStorage(cfg, spaceStore{storage.Disk{Dir: cfg.UploadDir, TempDir: cfg.UploadDir, FileMode: 0o644}, free})
+	upload := func(name string, index, total int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, newUploadRequest(t, name, index, total, []byte("data")))
+		return rec
+	}
+	if rec := upload("started.bin", 0, 2); rec.Code != http.StatusOK {
+		t.Fatalf("first chunk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Below the watermark new uploads are refused, started ones go on.
+	free.Store(999)
+	for range 2 {
+		rec := upload("new.bin", 0, 1)
+		if rec.Code != http.StatusInsufficientStorage || !strings.Contains(rec.Body.String(), CodeStorageFull) ||
+			!strings.Contains(rec.Body.String(), `"retriable":true`) || rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("new upload: status = %d, body = %s", rec.Code, rec.Body)
+		}
+	}
+	form := url.Values{"fileName": {"init.bin"}, "totalChunks": {"1"}}
+	req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Errorf("POST /upload/init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := upload("started.bin", 1, 2); rec.Code != http.StatusOK {
+		t.Errorf("started upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "chunkupload_storage_low 1\n") || !strings.Contains(rec.Body.String(), "chunkupload_min_free_bytes 1000\n") {
+		t.Errorf("metrics lack the low-space gauges:\n%s", rec.Body)
+	}
+
+	// One storage.low webhook per drop below the watermark; deliveries
+	// are concurrent, so started.bin's upload.completed may come first.
+	for low := false; !low; {
+		select {
+		case p := <-hooks:
+			if low = p.Event == WebhookLowSpace; low && p.FreeBytes != 999 {
+				t.Errorf("webhook = %+v", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no storage.low webhook")
+		}
+	}
+
+	free.Store(1000)
+	if rec := upload("new.bin", 0, 1); rec.Code != http.StatusOK {
+		t.Errorf("new upload once space is back: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for {
+		select {
+		case p := <-hooks:
+			if p.Event == WebhookLowSpace {
+				t.Errorf("second storage.low webhook: %+v", p)
+			}
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	const token = "0123456789abcdef"
+	srv := newTestServer(t, func(c *Config) { c.AdminToken = token })
+	h := srv.Routes()
+	do := func(method, target, body string, withToken bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if withToken {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload/init?fileName=s.bin&totalChunks=2", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var sess InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &sess); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "a.bin", 0, 2, []byte("half")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(http.MethodGet, "/admin/stats", "", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("stats without token: status = %d", rec.Code)
+	}
+	var stats AdminStats
+	rec = do(http.MethodGet, "/admin/stats", "", true)
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil || stats.ActiveSessions != 1 || stats.ChunksReceived != 1 {
+		t.Fatalf("stats: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/admin/sessions", "", true)
+	if !strings.Contains(rec.Body.String(), `"fileName":"s.bin"`) {
+		t.Errorf("sessions: %s", rec.Body)
+	}
+	var disk AdminDisk
+	rec = do(http.MethodGet, "/admin/disk", "", true)
+	if err := json.Unmarshal(rec.Body.Bytes(), &disk); err != nil || disk.UploadBytes < 4 {
+		t.Errorf("disk: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var usage struct{ Tenants []TenantUsage }
+	rec = do(http.MethodGet, "/admin/tenants", "", true)
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil || len(usage.Tenants) != 1 || usage.Tenants[0].Uploads != 2 {
+		t.Errorf("tenants: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// Maintenance refuses new uploads but lets started ones go on.
+	if rec := do(http.MethodPut, "/admin/maintenance", `{"enabled":true,"message":"back at noon"}`, true); rec.Code != http.StatusOK {
+		t.Fatalf("maintenance on: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "new.bin", 0, 1, []byte("x")))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), CodeMaintenance) ||
+		!strings.Contains(rec.Body.String(), "back at noon") {
+		t.Errorf("new upload in maintenance: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "a.bin", 1, 2, []byte("done")))
+	if rec.Code != http.StatusOK {
+		t.Errorf("started upload in maintenance: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	do(http.MethodPut, "/admin/maintenance", `{"enabled":false}`, true)
+
+	if rec := do(http.MethodPost, "/admin/uploads/"+sess.UploadID+"/abort", "", true); rec.Code != http.StatusNoContent {
+		t.Errorf("abort: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/admin/uploads/a.bin/abort", "", true); rec.Code != http.StatusNotFound {
+		t.Errorf("abort of a completed file: status = %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newUploadRequest(t, "stale.bin", 0, 2, []byte("old")))
+	if rec := do(http.MethodPost, "/admin/purge", "", true); rec.Code != http.StatusBadRequest {
+		t.Errorf("purge without olderThan or STALE_UPLOAD_TTL: status = %d", rec.Code)
+	}
+	srv.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	var purged PurgeResponse
+	rec = do(http.MethodPost, "/admin/purge?olderThan=1h", "", true)
+	if err := json.Unmarshal(rec.Body.Bytes(), &purged); err != nil || purged.Removed != 1 {
+		t.Errorf("purge: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	if _, err := configFrom(map[string]string{"ADMIN_TOKEN": "short"}); err == nil {
+		t.Error("short ADMIN_TOKEN accepted")
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	srv := newTestServer(t)
+	h := srv.Routes()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/upload/init", "fileName=gone.bin&totalChunks=2&fileSize=6")
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || init.UploadID == "" {
+		t.Fatalf("init: %s", rec.Body)
+	}
+	id := init.UploadID
+	if rec := do(http.MethodPut, "/upload/"+id+"/chunk/0?chunkSize=3", "abc"); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	events, stop := srv.events.subscribe(id)
+	defer stop()
+
+	if rec := do(http.MethodDelete, "/upload/"+id, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("abort: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.TempDir, id+"*")); len(left) != 0 {
+		t.Fatalf("files left behind: %v", left)
+	}
+	if e := <-events; e.Type != EventAborted || e.FileName != "gone.bin" {
+		t.Fatalf("event = %+v, want %s", e, EventAborted)
+	}
+	if srv.locks.(*session.Locks).Len() != 0 {
+		t.Fatal("lock still held after abort")
+	}
+
+	// The session is gone: its chunks and a second abort are refused.
+	for _, rec := range []*httptest.ResponseRecorder{
+		do(http.MethodPut, "/upload/"+id+"/chunk/1?chunkSize=3", "def"),
+		do(http.MethodDelete, "/upload/"+id, ""),
+	} {
+		var resp ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusNotFound || resp.Code != CodeUnknownUpload {
+			t.Fatalf("after abort: status = %d, body = %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestUploadConfig(t *testing.T) {
+	for _, values := range []map[string]string{
+		{"MIN_CHUNK_SIZE": "-1"},
+		{"MIN_CHUNK_SIZE": "10", "MAX_CHUNK_SIZE": "5"},
+		{"CHUNK_SIZE": "0"},
+		{"CHUNK_SIZE": "4", "MIN_CHUNK_SIZE": "5"},
+		{"CHUNK_SIZE": "6", "MAX_CHUNK_SIZE": "5"},
+	} {
+		if _, err := configFrom(values); err == nil {
+			t.Errorf("configFrom(%v) accepted", values)
+		}
+	}
+	if cfg, _ := configFrom(map[string]string{"MAX_CHUNK_SIZE": "1048576"}); cfg.chunkSize() != 1<<20 {
+		t.Errorf("default chunk size under MAX_CHUNK_SIZE = %d", cfg.chunkSize())
+	}
+
+	srv := newTestServer(t, func(c *Config) {
+		c.MinChunkSize, c.MaxChunkSize, c.ChunkSize = 3, 8, 4
+		c.MaxUploadsPerClient, c.MaxFileSize = 2, 100
+	})
+	rec := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/upload/config", nil))
+	var got UploadConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	want := UploadConfig{ChunkSize: 4, MinChunkSize: 3, MaxChunkSize: 8, MaxParallel: 2, MaxFileSize: 100, Encodings: []string{"gzip", "zstd"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("config = %+v, want %+v", got, want)
+	}
+
+	// The minimum holds for every chunk but the last.
+	send := func(index, total int, chunk string) ErrorResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.uploadHandler(rec, newUploadRequest(t, "min.bin", index, total, []byte(chunk)))
+		var resp ErrorResponse
+		if rec.Code != http.StatusOK {
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+		}
+		return resp
+	}
+	if resp := send(0, 2, "ab"); resp.Code != CodeChunkTooSmall {
+		t.Fatalf("short first chunk: %+v, want %s", resp, CodeChunkTooSmall)
+	}
+	if resp := send(0, 2, "abc"); resp.Code != "" {
+		t.Fatalf("chunk 0: %+v", resp)
+	}
+	if resp := send(1, 2, "d"); resp.Code != "" {
+		t.Fatalf("short last chunk: %+v", resp)
+	}
+	if uerr := srv.checkChunkLayout(4, 9); uerr == nil || uerr.code != CodeChunkTooSmall {
+		t.Fatalf("9 bytes in 4 chunks: %v, want %s", uerr, CodeChunkTooSmall)
+	}
+	if uerr := srv.checkChunkLayout(4, 10); uerr != nil {
+		t.Fatalf("10 bytes in 4 chunks: %v", uerr)
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	cfg, err := configFrom(map[string]string{"THUMBNAILS": "128, 64x32"})
+	if err != nil || !slices.Equal(cfg.Thumbnails, []ThumbnailSize{{128, 128}, {64, 32}}) {
+		t.Fatalf("THUMBNAILS: %v, %v", cfg.Thumbnails, err)
+	}
+	for _, v := range []string{"0", "10x", "5000x10", "big"} {
+		if _, err := configFrom(map[string]string{"THUMBNAILS": v}); err == nil {
+			t.Errorf("THUMBNAILS=%q accepted", v)
+		}
+	}
+
+	srv := newTestServer(t, func(c *Config) { c.Thumbnails = []ThumbnailSize{{100, 100}, {50, 50}} })
+	h := srv.Routes()
+
+	// A 300x150 PNG, its right half transparent.
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 150))
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 150; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var pic bytes.Buffer
+	png.Encode(&pic, img)
+
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "pic.png", 0, 1, pic.Bytes()))
+	var resp SuccessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	want := []Thumbnail{{"100x100", "/files/pic.png/thumbnail/100x100"}, {"50x50", "/files/pic.png/thumbnail/50x50"}}
+	if !slices.Equal(resp.Thumbnails, want) {
+		t.Fatalf("thumbnails = %+v, want %+v", resp.Thumbnails, want)
+	}
+	for _, tc := range []struct {
+		url  string
+		w, h int
+	}{{want[0].URL, 100, 50}, {want[1].URL, 50, 25}} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("GET %s: status = %d, type = %q", tc.url, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		thumb, err := jpeg.Decode(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := thumb.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Fatalf("%s is %dx%d, want %dx%d", tc.url, b.Dx(), b.Dy(), tc.w, tc.h)
+		}
+		// Red on the left, transparent turned white on the right.
+		if r, g, _, _ := thumb.At(tc.w/4, tc.h/2).RGBA(); r>>8 < 200 || g>>8 > 50 {
+			t.Errorf("%s: left pixel = %v", tc.url, thumb.At(tc.w/4, tc.h/2))
+		}
+		if r, g, b, _ := thumb.At(tc.w*3/4, tc.h/2).RGBA(); r>>8 < 200 || g>>8 < 200 || b>>8 < 200 {
+			t.Errorf("%s: right pixel = %v", tc.url, thumb.At(tc.w*3/4, tc.h/2))
+		}
+	}
+
+	// Listed with the file, not as files of their own.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads", nil))
+	var list UploadListResponse
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Uploads) != 1 || list.Uploads[0].ID != "pic.png" || !slices.Equal(list.Uploads[0].Thumbnails, want) {
+		t.Fatalf("list = %+v", list)
+	}
+
+	// Their names are reserved.
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "pic.png.thumb-50x50.jpg", 0, 1, []byte("fake")))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("upload under a thumbnail name: status = %d", rec.Code)
+	}
+
+	// Replaced by a file that is not an image, or deleted: they go too.
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "pic.png", 0, 1, []byte("not an image")))
+	resp = SuccessResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Thumbnails != nil {
+		t.Fatalf("text upload: status = %d, thumbnails = %+v", rec.Code, resp.Thumbnails)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "pic.png.thumb-50x50.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("stale thumbnail kept: %v", err)
+	}
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "pic.png", 0, 1, pic.Bytes()))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/uploads/pic.png", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, "pic.png*")); len(left) != 0 {
+		t.Fatalf("left behind: %v", left)
+	}
+}
+
+// fakeFFmpeg writes a shell script that copies the -i input to the last
+// argument, tagged with the preset's first option. It fails on inputs
+// containing "broken".
+func fakeFFmpeg(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	script := `#!/bin/sh
+while [ $# -gt 1 ]; do
+	case "$1" in -i) in=$2 ;; -vf|-vn) opt=$1 ;; esac
+	shift
+done
+grep -q broken "$in" && { echo "Invalid data found when processing input" >&2; exit 1; }
+{ echo "$opt"; cat "$in"; } > "$1"
+`
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTranscode(t *testing.T) {
+	cfg, err := configFrom(map[string]string{"TRANSCODE_PRESETS": "720p, audio", "TRANSCODE_QUEUE": "redis://cache"})
+	if err != nil || len(cfg.TranscodePresets) != 2 || cfg.TranscodePresets[1].Ext != "m4a" {
+		t.Fatalf("TRANSCODE_PRESETS: %+v, %v", cfg.TranscodePresets, err)
+	}
+	for k, v := range map[string]string{"TRANSCODE_PRESETS": "4k", "TRANSCODE_WORKERS": "0", "TRANSCODE_QUEUE": "cache:6379"} {
+		if _, err := configFrom(map[string]string{k: v}); err == nil {
+			t.Errorf("%s=%q accepted", k, v)
+		}
+	}
+
+	presets, _ := parseTranscodePresets("720p,audio")
+	srv := newTestServer(t, func(c *Config) {
+		c.TranscodePresets = presets
+		c.FFmpegPath = fakeFFmpeg(t)
+	})
+	h := srv.Routes()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.RunTranscoder(ctx)
+
+	video := append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), bytes.Repeat([]byte{1}, 100)...)
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "clip.mp4", 0, 1, video))
+	var resp SuccessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK || resp.Processing != ProcessingQueued {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	processing := func(id string) (int, ProcessingStatus) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads/"+id+"/processing", nil))
+		var st ProcessingStatus
+		json.Unmarshal(rec.Body.Bytes(), &st)
+		return rec.Code, st
+	}
+	waitDone := func(id string) ProcessingStatus {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			code, st := processing(id)
+			if code != http.StatusOK {
+				t.Fatalf("GET processing of %s: status = %d", id, code)
+			}
+			if st.State == ProcessingDone || st.State == ProcessingFailed {
+				return st
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s still %s", id, st.State)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	st := waitDone("clip.mp4")
+	if st.State != ProcessingDone || !slices.Equal(st.Presets, []string{"720p", "audio"}) || len(st.Outputs) != 2 ||
+		st.Outputs[0].URL != "/files/clip.mp4/transcode/720p" || st.StartedAt == nil || st.FinishedAt == nil {
+		t.Fatalf("processing = %+v", st)
+	}
+	for _, out := range st.Outputs {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, out.URL, nil))
+		wantOpt := map[string]string{"720p": "-vf\n", "audio": "-vn\n"}[out.Preset]
+		if rec.Code != http.StatusOK || rec.Body.String() != wantOpt+string(video) || int64(rec.Body.Len()) != out.Size {
+			t.Fatalf("GET %s: status = %d, %d bytes", out.URL, rec.Code, rec.Body.Len())
+		}
+	}
+	if ct := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, st.Outputs[0].URL, nil))
+		return rec.Header().Get("Content-Type")
+	}(); ct != "video/mp4" {
+		t.Errorf("rendition content type = %q", ct)
+	}
+
+	// Renditions are not files of their own, and their names are reserved.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads", nil))
+	var list UploadListResponse
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Uploads) != 1 || list.Uploads[0].ID != "clip.mp4" {
+		t.Fatalf("list = %+v", list)
+	}
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "clip.mp4.transcode-720p.mp4", 0, 1, video))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("upload under a rendition name: status = %d", rec.Code)
+	}
+
+	// Files that are not videos get no job.
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "notes.txt", 0, 1, []byte("text")))
+	resp = SuccessResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Processing != "" {
+		t.Fatalf("text upload: processing = %q", resp.Processing)
+	}
+	if code, _ := processing("notes.txt"); code != http.StatusNotFound {
+		t.Fatalf("GET processing of a text file: status = %d", code)
+	}
+
+	// An ffmpeg failure fails the job with its message.
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "broken.mp4", 0, 1, append(video, "broken"...)))
+	if st := waitDone("broken.mp4"); st.State != ProcessingFailed || !strings.Contains(st.Error, "Invalid data found") {
+		t.Fatalf("failed job = %+v", st)
+	}
+
+	// Deleting the file deletes its renditions and its job.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/uploads/clip.mp4", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d", rec.Code)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.UploadDir, "clip.mp4*")); len(left) != 0 {
+		t.Fatalf("left behind: %v", left)
+	}
+	if code, _ := processing("clip.mp4"); code != http.StatusNotFound {
+		t.Fatalf("GET processing after delete: status = %d", code)
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	for k, v := range map[string]string{"SIGNING_KEY": "short", "SIGNED_URL_TTL": "0", "SIGNED_URL_MAX_TTL": "30m"} {
+		if _, err := configFrom(map[string]string{k: v}); err == nil {
+			t.Errorf("%s=%q accepted", k, v)
+		}
+	}
+
+	srv := newTestServer(t, func(c *Config) {
+		c.APIKeys = "ci:k3y"
+		c.SigningKey = strings.Repeat("s", MinSigningKey)
+	})
+	now := time.Now()
+	srv.now = func() time.Time { return now }
+	h := srv.Routes()
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "report.txt", 0, 1, []byte("quarterly")))
+	srv.uploadHandler(httptest.NewRecorder(), newUploadRequest(t, "other.txt", 0, 1, []byte("secret")))
+
+	do := func(method, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	code := func(rec *httptest.ResponseRecorder) string {
+		var e ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &e)
+		return e.Code
+	}
+
+	if rec := do(http.MethodPost, "/files/report.txt/sign", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("sign without credentials: status = %d", rec.Code)
+	}
+	for target, want := range map[string]int{
+		"/files/missing.txt/sign":               http.StatusNotFound,
+		"/files/report.txt/sign?expiresIn=8d":   http.StatusBadRequest,
+		"/files/report.txt/sign?expiresIn=soon": http.StatusBadRequest,
+	} {
+		if rec := do(http.MethodPost, target, "k3y"); rec.Code != want {
+			t.Errorf("POST %s: status = %d, want %d", target, rec.Code, want)
+		}
+	}
+	rec := do(http.MethodPost, "/files/report.txt/sign?expiresIn=30m", "k3y")
+	var signed SignedURL
+	if err := json.Unmarshal(rec.Body.Bytes(), &signed); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("sign: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if want := now.Add(30 * time.Minute).Truncate(time.Second); !signed.ExpiresAt.Equal(want) {
+		t.Errorf("expiresAt = %v, want %v", signed.ExpiresAt, want)
+	}
+
+	// The link downloads without credentials.
+	if rec := do(http.MethodGet, signed.URL, ""); rec.Code != http.StatusOK || rec.Body.String() != "quarterly" {
+		t.Fatalf("GET signed URL: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodHead, signed.URL, ""); rec.Code != http.StatusOK {
+		t.Fatalf("HEAD signed URL: status = %d", rec.Code)
+	}
+
+	// Only that file, only as signed, only until it expires.
+	u, _ := url.Parse(signed.URL)
+	q := u.Query()
+	exp, _ := strconv.ParseInt(q.Get("exp"), 10, 64)
+	for name, target := range map[string]string{
+		"other file":  "/files/other.txt?" + q.Encode(),
+		"later exp":   "/files/report.txt?exp=" + strconv.FormatInt(exp+3600, 10) + "&sig=" + q.Get("sig"),
+		"forged sig":  "/files/report.txt?exp=" + q.Get("exp") + "&sig=AAAA",
+		"missing exp": "/files/report.txt?sig=" + q.Get("sig"),
+	} {
+		if rec := do(http.MethodGet, target, ""); rec.Code != http.StatusForbidden || code(rec) != CodeSignatureInvalid {
+			t.Errorf("%s: status = %d, code = %s", name, rec.Code, code(rec))
+		}
+	}
+	if rec := do(http.MethodGet, "/files/report.txt", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET without sig: status = %d", rec.Code)
+	}
+	now = now.Add(31 * time.Minute)
+	if rec := do(http.MethodGet, signed.URL, ""); rec.Code != http.StatusForbidden || code(rec) != CodeSignatureExpired {
+		t.Errorf("expired link: status = %d, code = %s", rec.Code, code(rec))
+	}
+
+	// With tenants named by API keys, the link names its tenant, which
+	// another tenant's link cannot claim.
+	srv = newTestServer(t, func(c *Config) {
+		c.TenantMode = TenantByAPIKey
+		c.APIKeys = "acme:acme-key,globex:globex-key"
+		c.SigningKey = strings.Repeat("s", MinSigningKey)
+	})
+	h = srv.Routes()
+	for _, key := range []string{"acme-key", "globex-key"} {
+		req := newUploadRequest(t, "a.txt", 0, 1, []byte(key))
+		req.Header.Set(APIKeyHeader, key)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	rec = do(http.MethodPost, "/files/a.txt/sign", "acme-key")
+	signed = SignedURL{}
+	json.Unmarshal(rec.Body.Bytes(), &signed)
+	if !strings.Contains(signed.URL, "tenant=acme") {
+		t.Fatalf("tenant sign: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, signed.URL, ""); rec.Code != http.StatusOK || rec.Body.String() != "acme-key" {
+		t.Fatalf("GET tenant link: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, strings.Replace(signed.URL, "tenant=acme", "tenant=globex", 1), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("link moved to another tenant: status = %d", rec.Code)
+	}
+}
+
+func zstded(data []byte) []byte {
+	zw, _ := zstd.NewWriter(nil)
+	defer zw.Close()
+	return zw.EncodeAll(data, nil)
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestCompressedChunks(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.MaxChunkSize = 1 << 10 })
+	h := srv.Routes()
+	send := func(req *http.Request, encoding string, compress func([]byte) []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = compress(body)
+		req.Body, req.ContentLength = io.NopCloser(bytes.NewReader(body)), int64(len(body))
+		req.Header.Set("Content-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	put := func(id string, headers ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodPut, "/upload/"+id+"/chunk/0", strings.NewReader(""))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+	init := func(name string, size int) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/upload/init?fileName=%s&totalChunks=1&fileSize=%d", name, size), nil))
+		var resp InitResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.UploadID == "" {
+			t.Fatalf("init: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return resp.UploadID
+	}
+	stored := func(name string, want []byte) {
+		t.Helper()
+		if got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, name)); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	// A multipart POST, gzipped as a whole.
+	csv := bytes.Repeat([]byte("id,name,score\n1,alpha,0.5\n"), 30)
+	if rec := send(newUploadRequest(t, "data.csv", 0, 1, csv), "gzip", gzipped); rec.Code != http.StatusOK {
+		t.Fatalf("gzip POST: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	stored("data.csv", csv)
+
+	// A raw PUT in zstd; the checksum is of the bytes before compression.
+	log := []byte("INFO request served\nWARN slow request\n")
+	sum := sha256.Sum256(log)
+	id := init("app.log", len(log))
+	req := put(id, "X-Upload-ChecksumAlgo", ChecksumSHA256, "X-Upload-ChunkHash", hex.EncodeToString(sum[:]))
+	req.Body = io.NopCloser(bytes.NewReader(log))
+	if rec := send(req, "zstd", zstded); rec.Code != http.StatusOK {
+		t.Fatalf("zstd PUT: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	stored("app.log", log)
+
+	// Refused: other encodings, bodies that do not decompress and bodies
+	// that decompress past MAX_CHUNK_SIZE.
+	rec := send(newUploadRequest(t, "a.txt", 0, 1, csv), "br", func(b []byte) []byte { return b })
+	if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), CodeUnsupportedEncoding) ||
+		rec.Header().Get("Accept-Encoding") != "gzip, zstd" {
+		t.Fatalf("br: status = %d, headers = %v, body = %s", rec.Code, rec.Header(), rec.Body)
+	}
+	id = init("bad.csv", len(csv))
+	req = put(id)
+	req.Body = io.NopCloser(bytes.NewReader(csv))
+	rec = send(req, "gzip", func(b []byte) []byte {
+		gz := gzipped(b)
+		gz[len(gz)-8] ^= 1 // the CRC-32
+		return gz
+	})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidEncoding) ||
+		!strings.Contains(rec.Body.String(), `"retriable":true`) {
+		t.Fatalf("damaged gzip: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	zeros := make([]byte, 256<<10)
+	if rec := send(newUploadRequest(t, "bomb.bin", 0, 1, zeros), "gzip", gzipped); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("gzip bomb POST: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req = put(init("bomb.bin", 1000))
+	req.Body = io.NopCloser(bytes.NewReader(zeros))
+	if rec := send(req, "gzip", gzipped); rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), CodeChunkTooLarge) {
+		t.Fatalf("gzip bomb PUT: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`chunkupload_compressed_bodies_total{encoding="gzip"} 4`,
+		`chunkupload_compressed_bodies_total{encoding="zstd"} 1`,
+		fmt.Sprintf(`chunkupload_compressed_wire_bytes_total{encoding="zstd"} %d`, len(zstded(log))),
+		fmt.Sprintf(`chunkupload_compressed_raw_bytes_total{encoding="zstd"} %d`, len(log)),
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %s", line)
+		}
+	}
+
+	// A zstd frame asking for a 1 GiB window, more than it may use.
+	rec = send(newUploadRequest(t, "wide.txt", 0, 1, csv), "zstd", func(b []byte) []byte {
+		frame := []byte{0x28, 0xB5, 0x2F, 0xFD, 0x00, 20 << 3}
+		h := len(b)<<3 | 1 // the last block, raw
+		return append(append(frame, byte(h), byte(h>>8), byte(h>>16)), b...)
+	})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidEncoding) {
+		t.Fatalf("zstd window over the limit: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestBatchUpload(t *testing.T) {
+	srv := newTestServer(t)
+	do := func(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	start := func(body string) BatchResponse {
+		t.Helper()
+		rec := do(srv, http.MethodPost, "/batches", body)
+		var resp BatchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.BatchID == "" {
+			t.Fatalf("start: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return resp
+	}
+	status := func(h http.Handler, id string) BatchResponse {
+		t.Helper()
+		rec := do(h, http.MethodGet, "/batches/"+id, "")
+		var resp BatchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("status: status = %d, body = %s", rec.Code, rec.Body)
+		}
+		return resp
+	}
+
+	for _, body := range []string{
+		`{"files": []}`,
+		`{"files": [{"path": "../etc/passwd", "totalChunks": 1}]}`,
+		`{"files": [{"path": "/abs.txt", "totalChunks": 1}]}`,
+		`{"files": [{"path": "a/b__c", "totalChunks": 1}, {"path": "a__b/c", "totalChunks": 1}]}`,
+		`{"files": [{"path": "ok.txt", "totalChunks": 0}]}`,
+		`{"files": [{"path": "ok.txt"`,
+	} {
+		if rec := do(srv, http.MethodPost, "/batches", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, body = %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	b := start(`{"files": [
+		{"path": "docs/a.txt", "totalChunks": 2, "fileSize": 10},
+		{"path": "docs/sub/b.txt", "totalChunks": 1, "fileSize": 3},
+		{"path": "c.txt", "totalChunks": 1}]}`)
+	if len(b.Files) != 3 || b.Files[0].FileName != "docs__a.txt" || b.Files[1].Path != "docs/sub/b.txt" ||
+		b.Files[1].FileName != "docs__sub__b.txt" || b.Files[2].Status != UploadInProgress {
+		t.Fatalf("files = %+v", b.Files)
+	}
+	if rec := do(srv, http.MethodPut, "/batches/"+b.BatchID+"/files/0/chunks/0?chunkSize=5", "hello"); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0 of file 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(srv, http.MethodPut, "/batches/"+b.BatchID+"/files/3/chunks/0", "x"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("file 3: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	st := status(srv, b.BatchID)
+	if st.Complete != 0 || st.Files[0].Received != 5 || fmt.Sprint(st.Files[0].MissingChunks) != "[1]" {
+		t.Fatalf("status = %+v", st)
+	}
+	rec := do(srv, http.MethodPost, "/batches/"+b.BatchID+"/complete", "")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeIncompleteUpload) {
+		t.Fatalf("early complete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = do(srv, http.MethodGet, "/uploads", "")
+	var list UploadListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || list.Total != 3 {
+		t.Fatalf("uploads: %s", rec.Body)
+	}
+
+	// The rest after a restart, one file as a multipart POST.
+	restarted := NewWithStorage(srv.cfg, nil)
+	if rec := do(restarted, http.MethodPut, "/batches/"+b.BatchID+"/files/0/chunks/1?chunkSize=5", "world"); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 1 of file 0: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	req := newUploadRequest(t, "", 0, 1, []byte("bee"))
+	req.URL.RawQuery = url.Values{"batchID": {b.BatchID}, "fileIndex": {"1"}}.Encode()
+	rec = httptest.NewRecorder()
+	restarted.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("file 1: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(restarted, http.MethodPut, "/batches/"+b.BatchID+"/files/2/chunks/0", ""); rec.Code != http.StatusOK {
+		t.Fatalf("file 2: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if st := status(restarted, b.BatchID); st.Complete != 3 || st.Files[1].Status != UploadComplete || st.Files[1].Size != 3 {
+		t.Fatalf("status = %+v", st)
+	}
+
+	rec = do(restarted, http.MethodPost, "/batches/"+b.BatchID+"/complete", "")
+	var manifest BatchManifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("complete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var got []string
+	for _, f := range manifest.Files {
+		got = append(got, fmt.Sprintf("%s=%s:%d", f.Path, f.FileName, f.Size))
+	}
+	if strings.Join(got, " ") != "docs/a.txt=docs__a.txt:10 docs/sub/b.txt=docs__sub__b.txt:3 c.txt=c.txt:0" || manifest.TotalSize != 13 {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+	for name, want := range map[string]string{"docs__a.txt": "helloworld", "docs__sub__b.txt": "bee", "c.txt": ""} {
+		if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, name)); err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v", name, data, err)
+		}
+	}
+	if rec := do(restarted, http.MethodGet, "/batches/"+b.BatchID, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("after complete: status = %d", rec.Code)
+	}
+
+	// Aborting discards the unfinished files and keeps the stored ones.
+	b = start(`{"files": [{"path": "x/done.txt", "totalChunks": 1}, {"path": "x/part.txt", "totalChunks": 2}]}`)
+	do(srv, http.MethodPut, "/batches/"+b.BatchID+"/files/0/chunks/0", "done")
+	do(srv, http.MethodPut, "/batches/"+b.BatchID+"/files/1/chunks/0?chunkSize=4", "part")
+	if rec := do(srv, http.MethodDelete, "/batches/"+b.BatchID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("abort: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if left, _ := filepath.Glob(filepath.Join(srv.cfg.TempDir, "*.part*")); len(left) != 0 {
+		t.Fatalf("files left behind: %v", left)
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "x__done.txt")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.ExtractMaxFiles, c.ExtractMaxSize = 3, 1000 })
+	zipOf := func(files ...string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for i := 0; i < len(files); i += 2 {
+			w, err := zw.Create(files[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, files[i+1])
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+	upload := func(name string, form url.Values, data []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		form.Set("fileName", name)
+		form.Set("totalChunks", "1")
+		req := httptest.NewRequest(http.MethodPost, "/upload/init", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		var init InitResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || rec.Code != http.StatusOK {
+			return rec
+		}
+		rec = httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/upload/"+init.UploadID+"/chunk/0", bytes.NewReader(data)))
+		return rec
+	}
+	stored := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, name))
+		if err != nil {
+			return "<" + err.Error() + ">"
+		}
+		return string(data)
+	}
+
+	if rec := upload("a.zip", url.Values{"extract": {"maybe"}}, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("extract=maybe: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	rec := upload("site.zip", url.Values{"extract": {"true"}}, zipOf("index.html", "<html></html>", "css/main.css", "body{}", "css/", ""))
+	var resp SuccessResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("site.zip: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if len(resp.Extracted) != 2 || resp.Extracted[1] != (ExtractedFile{Path: "css/main.css", FileName: "site__css__main.css", Size: 6, ContentType: "text/css; charset=utf-8"}) {
+		t.Fatalf("extracted = %+v", resp.Extracted)
+	}
+	if stored("site__index.html") != "<html></html>" || stored("site__css__main.css") != "body{}" || !strings.HasPrefix(stored("site.zip"), "PK") {
+		t.Fatal("extracted files not stored")
+	}
+
+	rec = upload("b.zip", url.Values{"extract": {"1"}, "extractTo": {"www"}}, zipOf("a.txt", "a"))
+	if rec.Code != http.StatusOK || stored("www__a.txt") != "a" {
+		t.Fatalf("extractTo: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := upload("plain.zip", url.Values{}, zipOf("p.txt", "p")); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "extracted") {
+		t.Fatalf("without extract: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	for name, data := range map[string][]byte{
+		"slip.zip":    zipOf("ok.txt", "x", "../../evil.txt", "x"),
+		"abs.zip":     zipOf("/etc/evil.txt", "x"),
+		"many.zip":    zipOf("1", "x", "2", "x", "3", "x", "4", "x"),
+		"big.zip":     zipOf("big.bin", strings.Repeat("x", 1001)),
+		"clash.zip":   zipOf("a/b", "x", "a__b", "y"),
+		"notazip.zip": []byte("just text"),
+	} {
+		rec := upload(name, url.Values{"extract": {"true"}}, data)
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeInvalidArchive) {
+			t.Errorf("%s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+		if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s kept after refusal: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(srv.cfg.UploadDir, "slip__ok.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("entry of a refused archive stored: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(srv.cfg.UploadDir))
+	for _, e := range entries {
+		if e.Name() == "evil.txt" {
+			t.Error("zip-slip entry written outside UPLOAD_DIR")
+		}
+	}
+
+	// Entries are checked against BLOCKED_TYPES as they are written; the
+	// ones stored before a refused entry are removed again.
+	srv.cfg.BlockedTypes = []string{"text/html"}
+	rec = upload("mixed.zip", url.Values{"extract": {"true"}}, zipOf("a.txt", "fine", "b.html", "<html></html>"))
+	if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), CodeTypeNotAllowed) {
+		t.Fatalf("mixed.zip: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if got := stored("mixed__a.txt"); !strings.HasPrefix(got, "<") {
+		t.Errorf("mixed__a.txt kept after refusal: %q", got)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.APIKeys = "ci:k3y" })
+	get := func(h http.Handler, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get(srv, "/openapi.json")
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Servers []struct{ URL string }                `json:"servers"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil || rec.Code != http.StatusOK || spec.OpenAPI != OpenAPIVersion {
+		t.Fatalf("GET /openapi.json: status = %d, body = %.200s", rec.Code, rec.Body)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/" {
+		t.Errorf("servers = %+v", spec.Servers)
+	}
+	// Every $ref resolves, and routes needing credentials say so.
+	for _, ref := range regexp.MustCompile(`"\$ref":"#/components/schemas/(\w+)"`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		if !strings.Contains(rec.Body.String(), `"`+ref[1]+`":{`) {
+			t.Errorf("no schema %s", ref[1])
+		}
+	}
+	if !strings.Contains(string(spec.Paths["/uploads"]["get"]), `"apiKey"`) {
+		t.Errorf("GET /uploads without security: %s", spec.Paths["/uploads"]["get"])
+	}
+	var init struct {
+		RequestBody struct {
+			Content map[string]struct {
+				Schema struct {
+					Required   []string
+					Properties map[string]struct{ Type, Description string }
+				}
+			}
+		}
+	}
+	json.Unmarshal(spec.Paths["/upload/init"]["post"], &init)
+	form := init.RequestBody.Content["application/x-www-form-urlencoded"].Schema
+	if fmt.Sprint(form.Required) != "[fileName totalChunks]" || form.Properties["fileSize"].Type != "integer" || form.Properties["extract"].Description == "" {
+		t.Errorf("POST /upload/init form = %+v", form)
+	}
+
+	// The spec follows the routes: each operation reaches its handler,
+	// which answers in JSON, rather than the mux's plain-text 404 or 405.
+	for _, op := range apiOperations {
+		if len(spec.Paths[op.Path][strings.ToLower(op.Method)]) == 0 {
+			t.Errorf("%s %s missing from the spec", op.Method, op.Path)
+		}
+		target := regexp.MustCompile(`\{\w+\}`).ReplaceAllString(op.Path, "0")
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(op.Method, target, nil)
+		req.Header.Set(APIKeyHeader, "k3y")
+		srv.ServeHTTP(rec, req)
+		if strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s %s is not routed: %d %s", op.Method, op.Path, rec.Code, rec.Body)
+		}
+	}
+
+	rec = get(srv, "/docs")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "SwaggerUIBundle") || !strings.Contains(rec.Body.String(), `url: "/openapi.json"`) {
+		t.Fatalf("GET /docs: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := get(http.StripPrefix("/api", srv), "/api/docs"); !strings.Contains(rec.Body.String(), `url: "/api/openapi.json"`) {
+		t.Errorf("mounted under /api: %s", rec.Body)
+	}
+
+	tenants := newTestServer(t, func(c *Config) { c.TenantMode, c.Tenants = TenantByPath, []string{"acme", "globex"} })
+	if rec := get(tenants, "/openapi.json"); !strings.Contains(rec.Body.String(), `"url":"/t/{tenant}/"`) {
+		t.Errorf("tenant template: %.300s", rec.Body)
+	}
+	if rec := get(tenants, "/t/acme/openapi.json"); !strings.Contains(rec.Body.String(), `"url":"/t/acme/"`) {
+		t.Errorf("tenant spec: %.300s", rec.Body)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.MaxChunkSize = 1 << 10 })
+	ts := httptest.NewUnstartedServer(srv)
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+	conn, err := grpc.NewClient(ts.Listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor("gzip")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := uploadv1.NewUploadServiceClient(conn)
+	ctx := context.Background()
+
+	// upload sends chunks in one UploadChunks call and returns the
+	// reply, its status and the error code trailer.
+	upload := func(chunks ...*uploadv1.Chunk) (*uploadv1.UploadResult, codes.Code, string) {
+		t.Helper()
+		var tr metadata.MD
+		stream, err := client.UploadChunks(ctx, grpc.Trailer(&tr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range chunks {
+			if stream.Send(c) != nil {
+				break // the server has answered
+			}
+		}
+		reply, err := stream.CloseAndRecv()
+		return reply, status.Code(err), strings.Join(tr.Get(GRPCErrorCodeTrailer), ",")
+	}
+	chunk := func(uploadID string, index int, data []byte) *uploadv1.Chunk {
+		sum := sha256.Sum256(data)
+		return &uploadv1.Chunk{UploadId: uploadID, Index: int32(index), Data: data, Sha256: hex.EncodeToString(sum[:])}
+	}
+
+	// Chunk 0 starts the session; closing the stream early leaves it
+	// open for a later call.
+	first := chunk("", 0, []byte("aaaa"))
+	first.FileName, first.TotalChunks, first.FileSize = "grpc.txt", 3, 10
+	reply, code, _ := upload(first)
+	if code != codes.OK || reply.Done || reply.Received != 4 {
+		t.Fatalf("first call: %v, %v", reply, code)
+	}
+	id := reply.UploadId
+	if !session.ValidID(id) || reply.FileName != "grpc.txt" {
+		t.Fatalf("first call: %v", reply)
+	}
+
+	st, err := client.GetUploadStatus(ctx, &uploadv1.StatusRequest{UploadId: id})
+	if err != nil || st.TotalChunks != 3 || st.Received != 4 ||
+		!slices.Equal(st.ReceivedChunks, []int32{0}) || !slices.Equal(st.MissingChunks, []int32{1, 2}) {
+		t.Fatalf("status: %v, %v", st, err)
+	}
+
+	// A damaged chunk is refused as retriable, naming the HTTP API's code.
+	bad := chunk(id, 1, []byte("bbbb"))
+	bad.Sha256 = strings.Repeat("0", 64)
+	if _, code, errCode := upload(bad); code != codes.Unavailable || errCode != CodeChunkHashMismatch {
+		t.Fatalf("bad hash: %v, %q", code, errCode)
+	}
+	if _, code, errCode := upload(chunk(id, 2, []byte("cc"))); code != codes.FailedPrecondition || errCode != CodeChunkOutOfOrder {
+		t.Fatalf("last chunk early: %v, %q", code, errCode)
+	}
+
+	reply, code, _ = upload(chunk(id, 1, []byte("bbbb")), chunk("", 2, []byte("cc")))
+	if code != codes.OK || !reply.Done || reply.Size != 10 {
+		t.Fatalf("resume: %v, %v", reply, code)
+	}
+	if got, _ := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "grpc.txt")); string(got) != "aaaabbbbcc" {
+		t.Fatalf("stored %q", got)
+	}
+
+	var tr metadata.MD
+	_, err = client.GetUploadStatus(ctx, &uploadv1.StatusRequest{UploadId: id}, grpc.Trailer(&tr))
+	if status.Code(err) != codes.NotFound || strings.Join(tr.Get(GRPCErrorCodeTrailer), ",") != CodeUnknownUpload {
+		t.Fatalf("completed upload status: %v, trailers %v", err, tr)
+	}
+	if _, code, _ := upload(); code != codes.InvalidArgument {
+		t.Fatalf("empty stream: %v", code)
+	}
+	if _, code, errCode := upload(&uploadv1.Chunk{TotalChunks: 1}); code != codes.InvalidArgument || errCode == "" {
+		t.Fatalf("no file name: %v, %q", code, errCode)
+	}
+	big := make([]byte, 1<<10+MultipartOverhead+1)
+	rand.Read(big)
+	if _, code, errCode := upload(&uploadv1.Chunk{FileName: "big", TotalChunks: 1, Data: big}); code != codes.ResourceExhausted || errCode != CodeChunkTooLarge {
+		t.Fatalf("message over the limit: %v, %q", code, errCode)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	type otlpSpan struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Attributes   []struct {
+			Key   string         `json:"key"`
+			Value map[string]any `json:"value"`
+		} `json:"attributes"`
+	}
+	var (
+		mu    sync.Mutex
+		spans []otlpSpan
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer k" {
+			t.Errorf("export to %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	srv := newTestServer(t, func(c *Config) {
+		c.OTLPEndpoint = collector.URL
+		c.OTLPHeaders = http.Header{"Authorization": {"Bearer k"}}
+	})
+	routes := srv.Routes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(httptest.NewRequest(http.MethodPost, "/upload/init?fileName=t.bin&totalChunks=2", nil))
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil {
+		t.Fatalf("init: %d %s", rec.Code, rec.Body)
+	}
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parent  = "00f067aa0ba902b7"
+	)
+	for i, part := range []string{"abc", "de"} {
+		req := newUploadRequest(t, "t.bin", i, 2, []byte(part))
+		req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+		req.Header.Set(TraceparentHeader, "00-"+traceID+"-"+parent+"-01")
+		if rec := serve(req); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	// An unsampled caller's trace is not recorded.
+	req := httptest.NewRequest(http.MethodGet, "/upload/"+init.UploadID+"/status", nil)
+	req.Header.Set(TraceparentHeader, "00-"+traceID+"-"+parent+"-00")
+	serve(req)
+	srv.tracer.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	attr := func(sp otlpSpan, key string) any {
+		for _, a := range sp.Attributes {
+			if a.Key == key {
+				for _, v := range a.Value {
+					return v
+				}
+			}
+		}
+		return nil
+	}
+	chunkSpans := make(map[string]otlpSpan)
+	names := make(map[string]int)
+	for _, sp := range spans {
+		names[sp.Name]++
+		if sp.Name == "POST /upload" {
+			if sp.TraceID != traceID || sp.ParentSpanID != parent {
+				t.Errorf("chunk span not in the caller's trace: %+v", sp)
+			}
+			if attr(sp, "upload.id") != init.UploadID {
+				t.Errorf("chunk span upload.id = %v, want %s", attr(sp, "upload.id"), init.UploadID)
+			}
+			chunkSpans[sp.SpanID] = sp
+		}
+	}
+	if len(chunkSpans) != 2 || names["POST /upload/init"] != 1 || names["GET /upload/{uploadID}/status"] != 0 {
+		t.Fatalf("spans by name: %v", names)
+	}
+	for _, name := range []string{"storage.write_chunk", "upload.verify", "storage.finalize", "upload.scan"} {
+		if names[name] == 0 {
+			t.Errorf("no %s span: %v", name, names)
+		}
+	}
+	for _, sp := range spans {
+		if sp.Name == "storage.write_chunk" || sp.Name == "storage.finalize" {
+			if _, ok := chunkSpans[sp.ParentSpanID]; !ok || sp.TraceID != traceID {
+				t.Errorf("%s not under a chunk span: %+v", sp.Name, sp)
+			}
+		}
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	start := time.Now()
+	b := newByteBucket(100<<10, start)
+	if wait := b.take(100<<10, start); wait != 0 {
+		t.Fatalf("burst: wait %v", wait)
+	}
+	if wait := b.take(50<<10, start); wait != 500*time.Millisecond {
+		t.Fatalf("over burst: wait %v, want 500ms", wait)
+	}
+	if wait := b.take(50<<10, start.Add(time.Second)); wait != 0 {
+		t.Fatalf("after refill: wait %v", wait)
+	}
+
+	// 96 KiB at 64 KiB/s: the second 32 KiB wait half a second.
+	srv := newTestServer(t, func(c *Config) { c.UploadBandwidthLimit = 64 << 10 })
+	chunk := bytes.Repeat([]byte("b"), 96<<10)
+	began := time.Now()
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "slow.bin", 0, 2, chunk))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if took := time.Since(began); took < 400*time.Millisecond {
+		t.Fatalf("96 KiB at 64 KiB/s took %v", took)
+	}
+	// Another upload has a bucket of its own.
+	began = time.Now()
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "other.bin", 0, 1, chunk[:32<<10]))
+	if rec.Code != http.StatusOK || time.Since(began) > 300*time.Millisecond {
+		t.Fatalf("other upload: %d in %v", rec.Code, time.Since(began))
+	}
+	if srv.bandwidth.global != nil || len(srv.bandwidth.uploads) != 2 {
+		t.Fatalf("buckets: global %v, uploads %d", srv.bandwidth.global, len(srv.bandwidth.uploads))
+	}
+
+	// A client that goes away stops waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newUploadRequest(t, "gone.bin", 0, 1, bytes.Repeat([]byte("g"), 256<<10)).WithContext(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, req)
+	if rec.Code != http.StatusRequestTimeout {
+		t.Fatalf("canceled upload: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.APIKeys = "alice:ka,bob:kb" })
+	routes := srv.Routes()
+	do := func(h http.Handler, method, path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	chunk := func(h http.Handler, id string, i int) *httptest.ResponseRecorder {
+		req := newUploadRequest(t, "p.bin", i, 3, []byte("data"))
+		req.URL.RawQuery = url.Values{"uploadID": {id}}.Encode()
+		req.Header.Set("X-API-Key", "ka")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(routes, http.MethodPost, "/upload/init?fileName=p.bin&totalChunks=3", "ka")
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil {
+		t.Fatalf("init: %d %s", rec.Code, rec.Body)
+	}
+	id := init.UploadID
+	if rec := chunk(routes, id, 0); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(routes, http.MethodPost, "/upload/"+id+"/pause", "kb"); rec.Code != http.StatusNotFound {
+		t.Fatalf("pause by another user: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(routes, http.MethodPost, "/upload/"+id+"/pause", "ka")
+	var paused StatusResponse
+	json.Unmarshal(rec.Body.Bytes(), &paused)
+	if rec.Code != http.StatusOK || paused.PausedAt == nil || fmt.Sprint(paused.ReceivedChunks, paused.MissingChunks) != "[0] [1 2]" {
+		t.Fatalf("pause: %d %s", rec.Code, rec.Body)
+	}
+	if rec := chunk(routes, id, 1); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), CodeUploadPaused) {
+		t.Fatalf("chunk while paused: %d %s", rec.Code, rec.Body)
+	}
+	if _, tracked := srv.received.Snapshot(id)[0]; tracked {
+		t.Fatal("paused upload still tracked in memory")
+	}
+
+	// Another process over the same storage, as another device would
+	// reach after a restart or through another replica, sees the pause.
+	other := NewWithStorage(srv.cfg, nil).Routes()
+	if rec := chunk(other, id, 1); rec.Code != http.StatusConflict {
+		t.Fatalf("chunk while paused, other process: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(other, http.MethodPost, "/upload/"+id+"/resume", "ka")
+	var resumed StatusResponse
+	json.Unmarshal(rec.Body.Bytes(), &resumed)
+	if rec.Code != http.StatusOK || resumed.PausedAt != nil || resumed.Received != 4 || fmt.Sprint(resumed.MissingChunks) != "[1 2]" {
+		t.Fatalf("resume: %d %s", rec.Code, rec.Body)
+	}
+	for _, i := range resumed.MissingChunks {
+		if rec := chunk(other, id, i); rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d after resume: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "p.bin")); err != nil || string(got) != "datadatadata" {
+		t.Fatalf("final file = %q, %v", got, err)
+	}
+}
+
+func TestEncryptionManifest(t *testing.T) {
+	routes := newTestServer(t).Routes()
+	iv := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	manifest := func(ivs ...string) string {
+		b, _ := json.Marshal(map[string]any{"algorithm": "AES-256-GCM", "keyID": "k1",
+			"wrappedKey": base64.StdEncoding.EncodeToString([]byte("wrapped")), "ivs": ivs, "plaintextSize": 8})
+		return string(b)
+	}
+	initWith := func(fileSize, enc string) *httptest.ResponseRecorder {
+		form := url.Values{"fileName": {"secret.bin"}, "totalChunks": {"2"}, "fileSize": {fileSize}, "encryption": {enc}}
+		req := httptest.NewRequest(http.MethodPost, "/upload/init?"+form.Encode(), nil)
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Each of the 2 chunks carries 4 bytes of plaintext and a 16-byte tag.
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"one IV for two chunks": initWith("40", manifest(iv)),
+		"short IV":              initWith("40", manifest(iv, iv[:8])),
+		"size without tags":     initWith("8", manifest(iv, iv)),
+		"not JSON":              initWith("40", "{"),
+	} {
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidManifest) {
+			t.Errorf("%s: %d %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	rec := initWith("40", manifest(iv, iv))
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("init: %d %s", rec.Code, rec.Body)
+	}
+	statusRec := httptest.NewRecorder()
+	routes.ServeHTTP(statusRec, httptest.NewRequest(http.MethodGet, "/upload/"+init.UploadID+"/status", nil))
+	var status StatusResponse
+	json.Unmarshal(statusRec.Body.Bytes(), &status)
+	if status.Encryption == nil || status.Encryption.KeyID != "k1" || len(status.Encryption.IVs) != 2 {
+		t.Fatalf("status encryption = %+v", status.Encryption)
+	}
+	for i := range 2 {
+		req := newUploadRequest(t, "secret.bin", i, 2, bytes.Repeat([]byte{byte(i)}, 20))
+		req.URL.RawQuery = url.Values{"uploadID": {init.UploadID}}.Encode()
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/secret.bin", nil))
+	raw, err := base64.StdEncoding.DecodeString(rec.Header().Get(EncryptionManifestHeader))
+	var got storage.EncryptionManifest
+	if err != nil || json.Unmarshal(raw, &got) != nil || got.Algorithm != "AES-256-GCM" || got.PlaintextSize != 8 || rec.Body.Len() != 40 {
+		t.Fatalf("download: %d, manifest %q", rec.Code, raw)
+	}
+
+	// A plaintext upload of the same name forgets the manifest.
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, newUploadRequest(t, "secret.bin", 0, 1, []byte("plain")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("plaintext upload: %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/secret.bin", nil))
+	if v := rec.Header().Get(EncryptionManifestHeader); v != "" || rec.Body.String() != "plain" {
+		t.Fatalf("plaintext download: manifest %q, body %q", v, rec.Body)
+	}
+}
+
+func TestActiveStats(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.TenantMode, c.Tenants = TenantByPath, []string{"acme", "globex"} })
+	for _, tenant := range srv.tenants {
+		tenant.ensureDirs() // as New does
+	}
+	h := srv.Routes()
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(httptest.NewRequest(http.MethodPost, "/t/acme/upload/init?fileName=big.bin&totalChunks=2&fileSize=10", nil))
+	var init InitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &init); err != nil {
+		t.Fatalf("init: %d %s", rec.Code, rec.Body)
+	}
+	req := newUploadRequest(t, "big.bin", 0, 2, []byte("01234"))
+	req.URL.Path, req.URL.RawQuery = "/t/acme/upload", url.Values{"uploadID": {init.UploadID}}.Encode()
+	if rec := serve(req); rec.Code != http.StatusOK {
+		t.Fatalf("acme chunk: %d %s", rec.Code, rec.Body)
+	}
+	req = newUploadRequest(t, "small.bin", 0, 2, []byte("abc"))
+	req.URL.Path = "/t/globex/upload"
+	if rec := serve(req); rec.Code != http.StatusOK {
+		t.Fatalf("globex chunk: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(httptest.NewRequest(http.MethodGet, "/stats/active?top=1", nil))
+	var st ActiveStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("stats: %d %s", rec.Code, rec.Body)
+	}
+	if st.Uploads != 2 || st.ReceivedBytes != 8 || st.IngestBytesPerSecond != 8.0/IngestWindow {
+		t.Fatalf("totals = %+v", st)
+	}
+	if len(st.Largest) != 1 || st.Largest[0].ID != init.UploadID || st.Largest[0].Tenant != "acme" || st.Largest[0].Size != 10 || st.Largest[0].Received != 5 {
+		t.Fatalf("largest = %+v", st.Largest)
+	}
+	if fmt.Sprint(st.Tenants) != fmt.Sprint([]TenantActivity{{"acme", 1, 5, 5.0 / IngestWindow}, {"globex", 1, 3, 3.0 / IngestWindow}}) {
+		t.Fatalf("tenants = %+v", st.Tenants)
+	}
+	if rec := serve(httptest.NewRequest(http.MethodGet, "/stats/active?top=500", nil)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("top=500: %d", rec.Code)
+	}
+
+	// Bytes older than the window no longer count.
+	g := &ingestRate{}
+	now := time.Unix(1000, 0)
+	g.add(now, 120)
+	if got := g.perSecond(now.Add(IngestWindow * time.Second)); got != 0 {
+		t.Fatalf("rate after the window = %v", got)
+	}
+}
+
+func TestPostUploadCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command runs sh")
+	}
+	cfg, err := configFrom(map[string]string{"POST_UPLOAD_COMMAND": `sh -c "echo {{.UploadID}} {{.Size}} > '{{.Path}}.done'"`, "POST_UPLOAD_TIMEOUT": "5s"})
+	if err != nil || len(cfg.HookCommand) != 3 || cfg.HookTimeout != 5*time.Second {
+		t.Fatalf("POST_UPLOAD_COMMAND: %d args, %v", len(cfg.HookCommand), err)
+	}
+	for k, v := range map[string]string{"POST_UPLOAD_COMMAND": "run {{.Nope}}", "POST_UPLOAD_TIMEOUT": "0s"} {
+		if _, err := configFrom(map[string]string{k: v}); err == nil {
+			t.Errorf("%s=%q accepted", k, v)
+		}
+	}
+	if _, err := configFrom(map[string]string{"POST_UPLOAD_COMMAND": `run "unterminated`}); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+
+	srv := newTestServer(t, func(c *Config) { c.HookCommand, c.HookTimeout = cfg.HookCommand, cfg.HookTimeout })
+	h := srv.Routes()
+	info := func(name string) *HookResult {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads/"+name, nil))
+		var u UploadInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &u); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET /uploads/%s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+		return u.Hook
+	}
+	rec := httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "a.txt", 0, 1, []byte("hello")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	srv.hookRuns.Wait()
+	if res := info("a.txt"); res == nil || res.State != ProcessingDone || res.ExitCode != 0 || res.FinishedAt == nil {
+		t.Fatalf("hook = %+v", res)
+	}
+	out, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "a.txt.done"))
+	if err != nil || string(out) != "a.txt 5\n" {
+		t.Fatalf("command output = %q, %v", out, err)
+	}
+
+	// A failing command is reported with its exit code and stderr.
+	srv.cfg.HookCommand, _ = parseHookCommand(`sh -c "echo boom >&2; exit 3"`)
+	rec = httptest.NewRecorder()
+	srv.uploadHandler(rec, newUploadRequest(t, "b.txt", 0, 1, []byte("hello")))
+	srv.hookRuns.Wait()
+	if res := info("b.txt"); res == nil || res.State != ProcessingFailed || res.ExitCode != 3 || !strings.Contains(res.Error, "boom") {
+		t.Fatalf("hook = %+v", res)
+	}
+
+	// Deleting the file forgets the result.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/uploads/b.txt", nil))
+	if rec.Code != http.StatusOK && rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: status = %d", rec.Code)
+	}
+	if res, _ := srv.hooks.get("b.txt"); res != nil {
+		t.Fatalf("hook after delete = %+v", res)
+	}
+}
+
+func TestChunkDedup(t *testing.T) {
+	if _, err := configFrom(map[string]string{"CHUNK_DEDUP": "true", "ENCRYPTION_KEY": strings.Repeat("ab", 32)}); err == nil {
+		t.Fatal("CHUNK_DEDUP with ENCRYPTION_KEY accepted")
+	}
+	if cfg, err := configFrom(map[string]string{"CHUNK_DEDUP": "true", "CHUNK_TTL": "7d"}); err != nil || !cfg.ChunkDedup || cfg.ChunkTTL != 7*24*time.Hour {
+		t.Fatalf("cfg = %+v, err = %v", cfg, err)
+	}
+	off := httptest.NewRecorder()
+	newTestServer(t).ServeHTTP(off, httptest.NewRequest(http.MethodPost, "/chunks/exists", strings.NewReader(`{"hashes": []}`)))
+	if off.Code != http.StatusNotFound {
+		t.Fatalf("off: status = %d", off.Code)
+	}
+
+	srv := newTestServer(t, func(c *Config) { c.ChunkDedup = true; c.MaxChunkSize = 16 })
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	parts := []string{"hello ", "chunk ", "world", "hello "}
+	hashes := make([]string, len(parts))
+	for i, p := range parts {
+		hashes[i] = sum(p)
+	}
+	list, _ := json.Marshal(ChunkListRequest{Hashes: hashes})
+
+	rec := do(http.MethodPost, "/chunks/exists", string(list))
+	var exists ChunkListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &exists); err != nil || len(exists.Missing) != 3 || exists.Missing[2] != hashes[2] {
+		t.Fatalf("exists: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/chunks/exists", `{"hashes": ["nothex"]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad hash: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	assemble, _ := json.Marshal(AssembleRequest{FileName: "doc.txt", Chunks: hashes, Hash: sum(strings.Join(parts, ""))})
+	rec = do(http.MethodPost, "/chunks/assemble", string(assemble))
+	var missing MissingChunksResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &missing); err != nil || rec.Code != http.StatusConflict ||
+		missing.Code != CodeChunksMissing || len(missing.Missing) != 3 {
+		t.Fatalf("assemble before upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(http.MethodPut, "/chunks/"+hashes[0], "tampered"); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), CodeChunkHashMismatch) {
+		t.Fatalf("tampered: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/chunks/"+sum("this is over sixteen"), "this is over sixteen"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("too large: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	for _, p := range parts[:3] {
+		if rec := do(http.MethodPut, "/chunks/"+strings.ToUpper(sum(p)), p); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "duplicate") {
+			t.Fatalf("chunk %q: status = %d, body = %s", p, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(http.MethodPut, "/chunks/"+hashes[3], parts[3]); !strings.Contains(rec.Body.String(), `"duplicate":true`) {
+		t.Fatalf("stored twice: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodPost, "/chunks/exists", string(list))
+	if err := json.Unmarshal(rec.Body.Bytes(), &exists); err != nil || len(exists.Missing) != 0 {
+		t.Fatalf("exists after upload: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	wrong, _ := json.Marshal(AssembleRequest{FileName: "doc.txt", Chunks: hashes, Hash: sum("other")})
+	if rec := do(http.MethodPost, "/chunks/assemble", string(wrong)); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("wrong hash: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodPost, "/chunks/assemble", string(assemble))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"done":true`) {
+		t.Fatalf("assemble: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "doc.txt")); err != nil || string(data) != "hello chunk worldhello " {
+		t.Fatalf("assembled %q, %v", data, err)
+	}
+
+	// Chunks unused for CHUNK_TTL go; one just asked about stays.
+	srv.cfg.ChunkTTL = time.Hour
+	old := srv.now().Add(-2 * time.Hour)
+	for _, h := range hashes {
+		os.Chtimes(srv.chunks.path(h), old, old)
+	}
+	one, _ := json.Marshal(ChunkListRequest{Hashes: hashes[2:3]})
+	do(http.MethodPost, "/chunks/exists", string(one))
+	srv.sweepChunks()
+	rec = do(http.MethodPost, "/chunks/exists", string(list))
+	if err := json.Unmarshal(rec.Body.Bytes(), &exists); err != nil || len(exists.Missing) != 2 || slices.Contains(exists.Missing, hashes[2]) {
+		t.Fatalf("after sweep: %s", rec.Body)
+	}
+}
+
+func TestDeltaUpload(t *testing.T) {
+	off := httptest.NewRecorder()
+	newTestServer(t).ServeHTTP(off, httptest.NewRequest(http.MethodGet, "/files/doc.txt/signature", nil))
+	if off.Code != http.StatusNotFound {
+		t.Fatalf("off: status = %d", off.Code)
+	}
+
+	srv := newTestServer(t, func(c *Config) { c.DeltaUpload = true })
+	do := func(method, target, ifMatch string, body []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do(http.MethodGet, "/files/doc.txt/signature", "", nil); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), CodeNotFound) {
+		t.Fatalf("no base: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	base := bytes.Repeat([]byte("0123456789abcdef"), 96) // three 512-byte blocks
+	copy(base[512:], "second block")
+	copy(base[1024:], "third block")
+	os.MkdirAll(srv.cfg.UploadDir, 0o755)
+	os.WriteFile(filepath.Join(srv.cfg.UploadDir, "doc.txt"), base, 0o644)
+
+	rec := do(http.MethodGet, "/files/doc.txt/signature?blockSize=512", "", nil)
+	var sig Signature
+	if err := json.Unmarshal(rec.Body.Bytes(), &sig); err != nil || rec.Code != http.StatusOK ||
+		sig.BlockSize != 512 || sig.Size != int64(len(base)) || len(sig.Blocks) != 3 || sig.ETag == "" {
+		t.Fatalf("signature: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	strong := sha256.Sum256(base[512:1024])
+	if sig.Blocks[1].Weak != weakSum(base[512:1024]) || sig.Blocks[1].Strong != hex.EncodeToString(strong[:16]) {
+		t.Fatalf("block 1 = %+v", sig.Blocks[1])
+	}
+	if rec := do(http.MethodGet, "/files/doc.txt/signature?blockSize=100", "", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("small block: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// New version: block 2, "new", blocks 0 and 1.
+	delta := binary.AppendUvarint(binary.AppendUvarint([]byte{DeltaCopy}, 2), 1)
+	delta = append(binary.AppendUvarint(append(delta, DeltaLiteral), 3), "new"...)
+	delta = binary.AppendUvarint(binary.AppendUvarint(append(delta, DeltaCopy), 0), 2)
+	want := slices.Concat(base[1024:], []byte("new"), base[:1024])
+	sum := sha256.Sum256(want)
+	target := fmt.Sprintf("/files/doc.txt/patch?fileSize=%d&blockSize=512&hash=%x", len(want), sum)
+
+	if rec := do(http.MethodPost, target, "", delta); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("no If-Match: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, target, `"stale"`, delta); rec.Code != http.StatusPreconditionFailed || !strings.Contains(rec.Body.String(), CodeBaseChanged) {
+		t.Fatalf("stale If-Match: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, target, sig.ETag, append(slices.Clip(delta), DeltaCopy, 9, 1)); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeInvalidDelta) {
+		t.Fatalf("copy past the end: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, target, sig.ETag, delta[:len(delta)-3]); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), CodeFileSizeMismatch) {
+		t.Fatalf("short delta: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	bad := fmt.Sprintf("/files/doc.txt/patch?fileSize=%d&blockSize=512&hash=%s", len(want), strings.Repeat("0", 64))
+	if rec := do(http.MethodPost, bad, sig.ETag, delta); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("wrong hash: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "doc.txt")); !bytes.Equal(data, base) {
+		t.Fatal("failed patches changed the stored file")
+	}
+
+	rec = do(http.MethodPost, target, sig.ETag, delta)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"done":true`) {
+		t.Fatalf("patch: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if data, err := os.ReadFile(filepath.Join(srv.cfg.UploadDir, "doc.txt")); err != nil || !bytes.Equal(data, want) {
+		t.Fatalf("patched %d bytes, %v", len(data), err)
+	}
+	if rec := do(http.MethodPost, target, sig.ETag, delta); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("replayed against the new version: status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	rules, err := parseVersionPolicy("*.log=1, *.db=0/90d")
+	if err != nil || len(rules) != 2 || rules[0] != (VersionRule{"*.log", 1, 0}) || rules[1] != (VersionRule{"*.db", 0, 90 * 24 * time.Hour}) {
+		t.Fatalf("rules = %+v, err = %v", rules, err)
+	}
+	for _, bad := range []string{"*.log", "=3", "*.log=-1", "*.log=3/soon", "[=3"} {
+		if _, err := parseVersionPolicy(bad); err == nil {
+			t.Errorf("VERSION_POLICY %q accepted", bad)
+		}
+	}
+	if _, err := sanitizeFileName("a.txt.v-0123456789abcdef", FileNamePolicyUnicode); err == nil {
+		t.Error("version name accepted as an upload name")
+	}
+
+	srv := newTestServer(t, func(c *Config) {
+		c.Versioning = true
+		c.MaxVersions = 2
+		c.VersionPolicy = []VersionRule{{Pattern: "*.log", Keep: 1}}
+	})
+	upload := func(name, content string) SuccessResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, newUploadRequest(t, name, 0, 1, []byte(content)))
+		var resp SuccessResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK || resp.VersionID == "" {
+			t.Fatalf("upload %s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+		return resp
+	}
+	versions := func(name string) VersionList {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/"+name+"/versions", nil))
+		var list VersionList
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("versions of %s: status = %d, body = %s", name, rec.Code, rec.Body)
+		}
+		return list
+	}
+	download := func(name, version string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/"+name+"?version="+version, nil))
+		return rec
+	}
+
+	ids := make([]string, 4)
+	for i := range ids {
+		ids[i] = upload("a.txt", fmt.Sprintf("version %d", i)).VersionID
+	}
+	list := versions("a.txt")
+	if len(list.Versions) != 3 || !list.Versions[0].Current || list.Versions[0].VersionID != ids[3] ||
+		list.Versions[1].VersionID != ids[2] || list.Versions[2].VersionID != ids[1] || list.Versions[1].ReplacedAt == nil {
+		t.Fatalf("versions = %+v, ids = %v", list.Versions, ids)
+	}
+	if rec := download("a.txt", ids[2]); rec.Code != http.StatusOK || rec.Body.String() != "version 2" || rec.Header().Get(VersionIDHeader) != ids[2] {
+		t.Fatalf("version 2: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := download("a.txt", ids[3]); rec.Body.String() != "version 3" || rec.Header().Get(VersionIDHeader) != ids[3] {
+		t.Fatalf("current: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := download("a.txt", ids[0]); rec.Code != http.StatusNotFound {
+		t.Fatalf("pruned version: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, _, err := srv.store.Stat(versionName("a.txt", ids[0])); err == nil {
+		t.Fatal("pruned version still stored")
+	}
+
+	// A rule for the name overrides MAX_VERSIONS; listings hide versions.
+	for i := range 3 {
+		upload("app.log", strings.Repeat("x", i+1))
+	}
+	if list := versions("app.log"); len(list.Versions) != 2 || list.Versions[1].Size != 2 {
+		t.Fatalf("app.log versions = %+v", list.Versions)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads", nil))
+	if strings.Contains(rec.Body.String(), ".v-") {
+		t.Fatalf("versions listed: %s", rec.Body)
+	}
+
+	// VERSION_RETENTION drops versions replaced longer ago.
+	srv.cfg.VersionTTL = time.Hour
+	now := srv.now
+	srv.now = func() time.Time { return now().Add(2 * time.Hour) }
+	srv.sweepVersions()
+	srv.now = now
+	if list := versions("a.txt"); len(list.Versions) != 1 || list.Versions[0].VersionID != ids[3] {
+		t.Fatalf("after sweep: %+v", list.Versions)
+	}
+
+	// An upload refused once stored gives way to the version it replaced.
+	upload("a.txt", "refused")
+	srv.refuseCompleted(httptest.NewRequest(http.MethodPost, "/upload", nil), "a.txt", "a.txt",
+		&uploadError{http.StatusUnprocessableEntity, CodeFileInfected, "infected"})
+	if rec := download("a.txt", ids[3]); rec.Body.String() != "version 3" || rec.Header().Get(VersionIDHeader) != ids[3] {
+		t.Fatalf("restored: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if list := versions("a.txt"); len(list.Versions) != 1 {
+		t.Fatalf("after restore: %+v", list.Versions)
+	}
+
+	// Deleting the file deletes its versions.
+	upload("a.txt", "version 4")
+	if err := srv.removeCompleted("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/a.txt/versions", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("after delete: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if _, _, err := srv.store.Stat(versionName("a.txt", ids[3])); err == nil {
+		t.Fatal("version of a deleted file still stored")
+	}
+}
+
+func TestVersioningCompressed(t *testing.T) {
+	srv := newTestServer(t, func(c *Config) { c.Versioning = true; c.CompressAtRest = true })
+	var first string
+	for i := range 2 {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, newUploadRequest(t, "notes.txt", 0, 1, []byte(strings.Repeat(fmt.Sprintf("line %d\n", i), 100))))
+		var resp SuccessResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.CompressedSize == 0 {
+			t.Fatalf("upload %d: status = %d, body = %s", i, rec.Code, rec.Body)
+		}
+		if i == 0 {
+			first = resp.VersionID
+		}
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/notes.txt/versions", nil))
+	var list VersionList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Versions) != 2 || list.Versions[0].Size != 700 || list.Versions[1].Size != 700 {
+		t.Fatalf("versions: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/files/notes.txt?version="+first, nil)
+	req.Header.Set("Range", "bytes=700-") // past the end
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("range past the end: status = %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/notes.txt?version="+first, nil))
+	if rec.Body.String() != strings.Repeat("line 0\n", 100) {
+		t.Fatalf("first version: status = %d, body = %.40q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Upload sessions: POST /upload/init hands out an uploadID so uploads of
+// the same fileName no longer share a part file
+// ---------------------------------------------------------------------
+
+// lookupSession resolves the uploadID form field. It returns a nil session
+// when none was sent and sessions are optional.
+func (s *Server) lookupSession(uploadID string) (*session.Session, *uploadError) {
+	if uploadID == "" {
+		if s.cfg.RequireUploadID {
+			return nil, &uploadError{http.StatusBadRequest, CodeUploadIDRequired, "uploadID required: call POST /upload/init first"}
+		}
+		return nil, nil
+	}
+	sess, ok := s.sessions.Get(uploadID)
+	if !ok && session.ValidID(uploadID) {
+		// Not in memory after a restart: rebuild it from the metadata that
+		// POST /upload/init saved. A fileName-keyed upload has key == FileName.
+		if meta, err := s.store.LoadMeta(uploadID); err == nil && meta.FileName != "" && meta.FileName != uploadID {
+			sess = &session.Session{ID: uploadID, FileName: meta.FileName, TotalChunks: meta.TotalChunks,
+				FileSize: meta.FileSize, CreatedAt: meta.CreatedAt, Retention: meta.Retention,
+				Direct: meta.DirectUploadID, PartSize: meta.PartSize, Batch: meta.Batch, BatchIndex: meta.BatchIndex, Extract: meta.Extract,
+				Encryption: meta.Encryption}
+			s.sessions.Add(sess)
+			s.trackBatchFile(sess)
+			if meta.PausedAt != nil {
+				s.paused.Store(uploadID, *meta.PausedAt)
+			}
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, &uploadError{http.StatusNotFound, CodeUnknownUpload, "unknown uploadID " + uploadID}
+	}
+	if s.cfg.UploadTTL > 0 && s.now().Sub(sess.CreatedAt) > s.cfg.UploadTTL {
+		s.dropSession(sess)
+		return nil, &uploadError{http.StatusGone, CodeUploadExpired, "upload expired, call POST /upload/init again"}
+	}
+	return sess, nil
+}
+
+// dropSession forgets a session and discards whatever it stored so far.
+func (s *Server) dropSession(sess *session.Session) {
+	s.sessions.Remove(sess.ID)
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := s.store.RemovePart(sess.ID); err != nil {
+		slog.Warn("cannot remove part", "upload_id", sess.ID, "error", err)
+	}
+	indices := make([]int, sess.TotalChunks)
+	for i := range indices {
+		indices[i] = i
+	}
+	if err := s.store.RemoveChunks(sess.ID, indices); err != nil {
+		slog.Warn("cannot remove chunk files", "upload_id", sess.ID, "error", err)
+	}
+	s.received.Forget(sess.ID)
+	s.batched.Delete(sess.ID)
+	s.paused.Delete(sess.ID)
+	s.abortDirect(sess.FileName, sess.Direct)
+	s.recordAbort(sess.ID)
+	s.publish(sess.ID, UploadEvent{Type: EventAborted, FileName: sess.FileName})
+}
+
+// sessionAborted reports, to a request that has just taken the lock of
+// sess, whether the session was dropped while it waited, e.g. by DELETE
+// /upload/{uploadID}. Its files are gone; writing now would leave an
+// orphaned part.
+func (s *Server) sessionAborted(w http.ResponseWriter, sess *session.Session) bool {
+	if sess == nil {
+		return false
+	}
+	if _, ok := s.sessions.Get(sess.ID); ok {
+		return false
+	}
+	respondError(w, http.StatusNotFound, CodeUnknownUpload, "upload %s was aborted", sess.ID)
+	return true
+}
+
+// abortHandler cancels an unfinished upload session (DELETE
+// /upload/{uploadID}): once chunks in flight are done its part and chunk
+// files are deleted, and its event streams end with an aborted event.
+func (s *Server) abortHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only DELETE allowed")
+		return
+	}
+	sess, uerr := s.lookupSession(r.PathValue("uploadID"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	tagUpload(w, sess.ID)
+	if !s.canSee(r, sess) {
+		// Don't reveal other users' uploads.
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown uploadID %s", sess.ID)
+		return
+	}
+	s.dropSession(sess)
+	logFor(w).Info("upload aborted", "file", sess.FileName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InitResponse is returned by POST /upload/init.
+type InitResponse struct {
+	UploadID  string     `json:"uploadID"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // set when UPLOAD_TTL is configured
+	Retention string     `json:"retention,omitempty"` // how long the completed file is kept, unset = forever
+	Extract   string     `json:"extract,omitempty"`   // with extract=true, the directory the archive is unpacked under
+}
+
+// initHandler starts an upload session for fileName/totalChunks and the
+// optional fileSize, validated exactly like a chunk POST, retention,
+// extract and the client-side encryption manifest.
+func (s *Server) initHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+
+	fileName, totalChunks, fileSize, uerr := s.parseFileParams(r.FormValue("fileName"), r.FormValue("totalChunks"), r.FormValue("fileSize"))
+	if uerr == nil {
+		uerr = s.checkChunkLayout(totalChunks, fileSize)
+	}
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if q := s.checkQuota(r, fileName, fileSize); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+	retention, uerr := s.requestedRetention(r.FormValue("retention"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	extract, uerr := s.requestedExtract(r, fileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	enc, uerr := s.requestedEncryption(r, totalChunks, fileSize, extract)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	sess := &session.Session{FileName: fileName, TotalChunks: totalChunks, FileSize: fileSize, Retention: retention, Extract: extract,
+		Encryption: enc}
+	if uerr := s.startSession(r, sess); uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	resp := InitResponse{UploadID: sess.ID, ExpiresAt: s.sessionExpiry(sess), Extract: extract}
+	if retention > 0 {
+		resp.Retention = retention.String()
+	}
+	tagUpload(w, sess.ID).Info("upload session created", "file", fileName, "total_chunks", totalChunks, "size", fileSize)
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// startSession gives sess an ID and creation time, saves its metadata
+// and registers it, first dropping sessions past UPLOAD_TTL.
+func (s *Server) startSession(r *http.Request, sess *session.Session) *uploadError {
+	s.expireSessions()
+	return s.addSession(r, sess)
+}
+
+// expireSessions drops the sessions past UPLOAD_TTL.
+func (s *Server) expireSessions() {
+	if s.cfg.UploadTTL <= 0 {
+		return
+	}
+	for _, old := range s.sessions.Expire(s.now().Add(-s.cfg.UploadTTL)) {
+		s.dropSession(old)
+	}
+}
+
+// addSession is startSession without the sweep, for a batch's files.
+func (s *Server) addSession(r *http.Request, sess *session.Session) *uploadError {
+	id, err := session.NewID()
+	if err != nil {
+		return &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot generate uploadID: %v", err)}
+	}
+	sess.ID, sess.CreatedAt = id, s.now().UTC()
+	meta := &storage.Meta{UploadID: id, Owner: uploadOwner(r), CreatedAt: sess.CreatedAt, FileName: sess.FileName, FileSize: sess.FileSize,
+		TotalChunks: sess.TotalChunks, Retention: sess.Retention, DirectUploadID: sess.Direct, PartSize: sess.PartSize,
+		Batch: sess.Batch, BatchIndex: sess.BatchIndex, Extract: sess.Extract,
+		Encryption: sess.Encryption}
+	if err := s.store.SaveMeta(id, meta); err != nil {
+		return &uploadError{http.StatusInternalServerError, CodeServerError, fmt.Sprintf("cannot save upload metadata: %v", err)}
+	}
+	s.sessions.Add(sess)
+	s.trackBatchFile(sess)
+	s.recordUploadStart(r, id, sess.FileName, sess.FileSize, sess.TotalChunks, sess.CreatedAt)
+	return nil
+}
+
+// sessionExpiry returns when an unfinished session is dropped, nil
+// without UPLOAD_TTL.
+func (s *Server) sessionExpiry(sess *session.Session) *time.Time {
+	if s.cfg.UploadTTL <= 0 {
+		return nil
+	}
+	expires := sess.CreatedAt.Add(s.cfg.UploadTTL)
+	return &expires
+}
+
+// StatusResponse is returned by GET /upload/{uploadID}/status.
+type StatusResponse struct {
+	UploadID       string     `json:"uploadID"`
+	FileName       string     `json:"fileName"`
+	TotalChunks    int        `json:"totalChunks"`
+	FileSize       int64      `json:"fileSize,omitempty"`
+	Received       int64      `json:"received"` // bytes in the received chunks
+	ReceivedChunks []int      `json:"receivedChunks"`
+	MissingChunks  []int      `json:"missingChunks"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"` // as in InitResponse
+	Retention      string     `json:"retention,omitempty"` // as in InitResponse
+	PausedAt       *time.Time `json:"pausedAt,omitempty"`  // set while POST /upload/{uploadID}/pause holds the upload
+
+	// Encryption is the manifest sent at init, so another device can
+	// resume an encrypted upload.
+	Encryption *storage.EncryptionManifest `json:"encryption,omitempty"`
+}
+
+// statusHandler lists which chunks of a session are stored, so a client
+// that lost its connection resends only the missing ones.
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	sess, uerr := s.lookupSession(r.PathValue("uploadID"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if !s.canSee(r, sess) {
+		respondError(w, http.StatusNotFound, CodeUnknownUpload, "unknown uploadID %s", sess.ID)
+		return
+	}
+
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	resp := s.sessionStatus(sess)
+	tagUpload(w, sess.ID).Info("status", "received_chunks", len(resp.ReceivedChunks), "total_chunks", sess.TotalChunks)
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// canSee reports whether the caller may see sess, by canManage on the
+// owner recorded in its .part.meta.
+func (s *Server) canSee(r *http.Request, sess *session.Session) bool {
+	meta, err := s.store.LoadMeta(sess.ID)
+	return err != nil || s.canManage(r, UploadInfo{Owner: meta.Owner})
+}
+
+// sessionStatus describes which chunks of sess are stored. The caller
+// holds the session's lock.
+func (s *Server) sessionStatus(sess *session.Session) StatusResponse {
+	var pausedAt *time.Time
+	if meta, err := s.store.LoadMeta(sess.ID); err == nil {
+		s.restoreReceived(sess.ID, meta.Received)
+		pausedAt = meta.PausedAt
+	}
+	chunks := s.received.Snapshot(sess.ID)
+	if len(chunks) == 0 {
+		// mode=separate keeps no tracking; its chunk files are the record
+		// (their sizes are not counted in Received).
+		missing := s.store.MissingChunks(sess.ID, sess.TotalChunks)
+		chunks = make(map[int]int64, sess.TotalChunks-len(missing))
+		for i, m := 0, 0; i < sess.TotalChunks; i++ {
+			if m < len(missing) && missing[m] == i {
+				m++
+				continue
+			}
+			chunks[i] = 0
+		}
+	}
+
+	resp := StatusResponse{
+		UploadID:       sess.ID,
+		FileName:       sess.FileName,
+		TotalChunks:    sess.TotalChunks,
+		FileSize:       sess.FileSize,
+		ReceivedChunks: []int{},
+		MissingChunks:  []int{},
+		ExpiresAt:      s.sessionExpiry(sess),
+		PausedAt:       pausedAt,
+		Encryption:     sess.Encryption,
+	}
+	if sess.Retention > 0 {
+		resp.Retention = sess.Retention.String()
+	}
+	for i := 0; i < sess.TotalChunks; i++ {
+		if size, ok := chunks[i]; ok {
+			resp.ReceivedChunks = append(resp.ReceivedChunks, i)
+			resp.Received += size
+		} else {
+			resp.MissingChunks = append(resp.MissingChunks, i)
+		}
+	}
+	return resp
+}
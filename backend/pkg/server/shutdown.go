@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Graceful shutdown: report unready (SHUTDOWN_DELAY), refuse new uploads,
+// drain in-flight ones, persist what was received (SHUTDOWN_TIMEOUT)
+// ---------------------------------------------------------------------
+
+// ShutdownGrace is how long aborted writes get to unwind once
+// SHUTDOWN_TIMEOUT has passed and connections were closed.
+const ShutdownGrace = 5 * time.Second
+
+// trackUpload counts an upload as in flight, or answers 503 once Shutdown
+// has begun. The caller must invoke the returned func when done.
+func (s *Server) trackUpload(w http.ResponseWriter) (func(), bool) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.draining {
+		w.Header().Set("Retry-After", strconv.Itoa(BusyRetryAfter))
+		w.Header().Set("Connection", "close")
+		respondError(w, http.StatusServiceUnavailable, CodeShuttingDown, "server shutting down, retry shortly")
+		return nil, false
+	}
+	s.inflight.Add(1)
+	return s.inflight.Done, true
+}
+
+// Shutdown stops hs: GET /readyz fails at once and, after SHUTDOWN_DELAY
+// for load balancers to notice, new uploads get 503, in-flight chunk
+// writes get up to timeout to finish, then remaining connections are
+// closed (aborting their writes, which clients resend). Finally the
+// received chunks of every unfinished upload are saved so resumable
+// uploads survive the restart.
+func (s *Server) Shutdown(hs *http.Server, timeout time.Duration) error {
+	s.drainMu.Lock()
+	s.unready = true
+	s.drainMu.Unlock()
+	if s.cfg.ShutdownDelay > 0 {
+		slog.Info("not ready; serving on until load balancers notice", "delay", s.cfg.ShutdownDelay)
+		time.Sleep(s.cfg.ShutdownDelay)
+	}
+
+	servers := s.servers()
+	for _, srv := range servers {
+		srv.drainMu.Lock()
+		srv.draining = true
+		srv.drainMu.Unlock()
+		srv.events.close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := hs.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("shutdown timeout exceeded; aborting remaining uploads", "timeout", timeout)
+		hs.Close() // cancels request contexts, which stops contextReader
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for _, srv := range servers {
+			srv.inflight.Wait()
+			srv.hookRuns.Wait()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(ShutdownGrace):
+		slog.Warn("uploads still writing after grace period", "grace", ShutdownGrace)
+	}
+
+	for _, srv := range servers {
+		srv.persistReceived()
+	}
+	if s.db != nil {
+		if dbErr := s.db.Close(); dbErr != nil {
+			slog.Warn("metadata db: close", "error", dbErr)
+		}
+	}
+	if s.transcoder != nil {
+		s.transcoder.close()
+	}
+	s.closeAudit()
+	s.tracer.flush()
+	if lockErr := s.closeLocker(); lockErr != nil {
+		slog.Warn("lock backend: close", "error", lockErr)
+	}
+	return err
+}
+
+// persistReceived saves the tracked chunks of every unfinished upload to
+// its metadata file.
+func (s *Server) persistReceived() {
+	saved := 0
+	for _, key := range s.received.Keys() {
+		lock := s.locks.Get(key)
+		lock.Lock()
+		if meta, err := s.store.LoadMeta(key); err == nil {
+			s.saveReceived(key, meta)
+			saved++
+		}
+		lock.Unlock()
+	}
+	slog.Info("persisted state of unfinished uploads", "uploads", saved)
+}
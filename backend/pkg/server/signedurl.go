@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Signed URLs (SIGNING_KEY): POST /files/{name}/sign mints a link to a
+// completed file that downloads without credentials until it expires
+// ---------------------------------------------------------------------
+
+// Defaults for signed URLs.
+const (
+	MinSigningKey          = 32 // bytes
+	DefaultSignedURLTTL    = time.Hour
+	DefaultSignedURLMaxTTL = 7 * 24 * time.Hour
+)
+
+// SignedURL is the response of POST /files/{name}/sign.
+type SignedURL struct {
+	URL       string    `json:"url"` // GET or HEAD it without credentials
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// signature is the HMAC-SHA256 under SIGNING_KEY of this Server's tenant,
+// the file name and the expiry in Unix seconds, so a link opens one file
+// of one tenant until exp.
+func (s *Server) signature(name string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg.SigningKey))
+	fmt.Fprintf(mac, "%s\n%s\n%d", s.tenant, name, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature validates the exp and sig query parameters of a signed
+// URL for name.
+func (s *Server) checkSignature(name, expStr, sig string) *uploadError {
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(s.signature(name, exp))) {
+		return &uploadError{http.StatusForbidden, CodeSignatureInvalid, "invalid URL signature"}
+	}
+	if !s.now().Before(time.Unix(exp, 0)) {
+		return &uploadError{http.StatusForbidden, CodeSignatureExpired, "signed URL expired"}
+	}
+	return nil
+}
+
+// withSignature serves a download carrying sig without credentials when
+// its signature checks out, and hands every other request to authed.
+// Without SIGNING_KEY, sig is ignored.
+func (s *Server) withSignature(authed http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		download := r.Method == http.MethodGet || r.Method == http.MethodHead && !isTus(r)
+		if s.cfg.SigningKey == "" || !q.Has("sig") || !download {
+			authed(w, r)
+			return
+		}
+		if !s.checkRateLimit(w, r) {
+			return
+		}
+		if uerr := s.checkSignature(r.PathValue("name"), q.Get("exp"), q.Get("sig")); uerr != nil {
+			logFor(w).Warn("signed URL refused", "file", r.PathValue("name"), "code", uerr.code)
+			uerr.respond(w)
+			return
+		}
+		s.downloadHandler(w, r)
+	}
+}
+
+// signHandler serves POST /files/{name}/sign: a signed URL for the
+// completed file name, valid for the expiresIn parameter (a duration such
+// as 30m or 2d, default SIGNED_URL_TTL, at most SIGNED_URL_MAX_TTL).
+func (s *Server) signHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	fileName, uerr := s.cleanFileName(r.PathValue("name"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	ttl := s.cfg.SignedURLTTL
+	if v := r.FormValue("expiresIn"); v != "" {
+		d, err := parseRetention(v)
+		if err != nil || d <= 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid expiresIn %q: want a duration such as 30m or 2d", v)
+			return
+		}
+		ttl = d
+	}
+	if ttl > s.cfg.SignedURLMaxTTL {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "expiresIn %s is longer than the %s allowed", ttl, s.cfg.SignedURLMaxTTL)
+		return
+	}
+	if _, _, err := s.store.Stat(fileName); err != nil || s.isExpired(fileName) {
+		respondError(w, http.StatusNotFound, CodeNotFound, "file %q not found", fileName)
+		return
+	}
+
+	expiresAt := s.now().Add(ttl).Truncate(time.Second)
+	exp := expiresAt.Unix()
+	q := url.Values{"exp": {strconv.FormatInt(exp, 10)}, "sig": {s.signature(fileName, exp)}}
+	if s.tenant != "" && s.cfg.TenantMode != TenantByPath {
+		q.Set("tenant", s.tenant) // routes the request, which has no credentials
+	}
+	link := mountPrefix(r) + "/files/" + url.PathEscape(fileName) + "?" + q.Encode()
+	logFor(w).Info("signed URL issued", "file", fileName, "expires_at", expiresAt)
+	respondJSON(w, http.StatusOK, SignedURL{URL: link, ExpiresAt: expiresAt.UTC()})
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// Out-of-order chunks written in place (offset / chunkSize form fields)
+// ---------------------------------------------------------------------
+
+// chunkOffset works out where a chunk of chunkLen bytes belongs: at the
+// explicit offset if one was sent, otherwise at index*chunkSize.
+func chunkOffset(offsetStr, chunkSizeStr string, index, totalChunks int, fileSize, chunkLen int64) (int64, *uploadError) {
+	var offset int64
+	if offsetStr != "" {
+		v, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || v < 0 {
+			return 0, &uploadError{http.StatusBadRequest, CodeInvalidOffset, "offset must be a non-negative number"}
+		}
+		offset = v
+	} else {
+		size, err := strconv.ParseInt(chunkSizeStr, 10, 64)
+		if err != nil || size <= 0 {
+			return 0, &uploadError{http.StatusBadRequest, CodeInvalidOffset, "chunkSize must be a positive number"}
+		}
+		// Only the last chunk may be shorter than chunkSize.
+		if index < totalChunks-1 && chunkLen != size {
+			return 0, &uploadError{http.StatusBadRequest, CodeInvalidOffset,
+				fmt.Sprintf("chunk %d is %d bytes, chunkSize is %d", index, chunkLen, size)}
+		}
+		offset = int64(index) * size
+	}
+	if offset+chunkLen > fileSize {
+		return 0, &uploadError{http.StatusBadRequest, CodeInvalidOffset,
+			fmt.Sprintf("chunk %d at offset %d overruns fileSize %d", index, offset, fileSize)}
+	}
+	return offset, nil
+}
+
+// writeChunkAt writes one chunk at its offset in a part file pre-sized to
+// fileSize, so chunks may arrive in any order and a failed chunk can be
+// resent on its own. The upload finishes once every index has arrived.
+func (s *Server) writeChunkAt(w http.ResponseWriter, r *http.Request, sess *session.Session, key, fileName string, index, totalChunks int, fileSize int64, chunk io.Reader, chunkSize int64) {
+	if fileSize <= 0 {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "fileSize is required with offset or chunkSize")
+		return
+	}
+	offset, uerr := chunkOffset(r.FormValue("offset"), r.FormValue("chunkSize"), index, totalChunks, fileSize, chunkSize)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	lock := s.locks.Get(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.sessionAborted(w, sess) || s.uploadPaused(w, key) {
+		return
+	}
+
+	// ----- Existing upload of the same shape, or a fresh one? -----
+	meta, err := s.store.LoadMeta(key)
+	if err == nil && meta.Expired(s.cfg.UploadTTL, s.now()) {
+		logFor(w).Info("upload expired", "file", fileName, "created", meta.CreatedAt)
+		if err := s.store.RemovePart(key); err != nil {
+			logFor(w).Warn("cannot remove stale part", "file", fileName, "error", err)
+		}
+		s.received.Forget(key)
+		respondError(w, http.StatusGone, CodeUploadExpired, "upload expired, restart")
+		return
+	}
+	_, partErr := s.store.PartSize(key)
+	fresh := err != nil || partErr != nil || meta.FileSize != fileSize || meta.TotalChunks != totalChunks
+	if fresh {
+		if avail, err := s.store.Available(); err != nil {
+			logFor(w).Warn("cannot check free space", "error", err)
+		} else if avail >= 0 && avail < fileSize {
+			respondError(w, http.StatusInsufficientStorage, CodeInsufficientStorage,
+				"insufficient storage: need ~%d bytes, %d available", fileSize, avail)
+			return
+		}
+		if err := s.store.RemovePart(key); err != nil {
+			logFor(w).Warn("cannot remove old part", "file", fileName, "error", err)
+		}
+		s.received.Forget(key)
+		var retention time.Duration
+		if meta != nil {
+			retention = meta.Retention // chosen at POST /upload/init
+		}
+		meta = &storage.Meta{CreatedAt: s.now().UTC(), FileName: fileName, FileSize: fileSize, TotalChunks: totalChunks, Retention: retention}
+		if sess != nil {
+			meta.Batch, meta.BatchIndex = sess.Batch, sess.BatchIndex
+			meta.Extract = sess.Extract
+		}
+		if err := s.store.SaveMeta(key, meta); err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot save upload metadata: %v", err)
+			return
+		}
+	} else {
+		s.restoreReceived(key, meta.Received)
+	}
+
+	f, err := s.store.OpenPartAt(key, fileSize)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open part file: %v", err)
+		return
+	}
+	defer f.Close()
+	if fresh {
+		if err := s.store.ReservePart(key, fileSize); err != nil {
+			logFor(w).Warn("cannot pre-allocate", "file", fileName, "bytes", fileSize, "error", err)
+		}
+	}
+
+	// A chunk that fails part-way is simply not marked; resending it
+	// overwrites the same byte range, so there is nothing to roll back.
+	write := spanOf(w).child("storage.write_chunk", "chunk.index", index, "storage.offset", offset)
+	written, err := io.Copy(io.NewOffsetWriter(f, offset), s.throttle(r, key, chunk))
+	write.set("storage.bytes_written", written).done(err)
+	if ctxErr := r.Context().Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		respondError(w, http.StatusRequestTimeout, CodeCanceled, "chunk %d canceled by client", index)
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		f.Close()
+		if rmErr := s.store.RemovePart(key); rmErr != nil {
+			logFor(w).Warn("cannot remove part file", "file", fileName, "error", rmErr)
+		}
+		s.received.Forget(key)
+		respondError(w, http.StatusInsufficientStorage, CodeInsufficientStorage, "insufficient storage: disk full, upload discarded")
+		return
+	}
+	if errors.Is(err, errChunkLength) {
+		respondError(w, http.StatusBadRequest, CodeChunkLengthMismatch, "chunk %d: %v", index, err)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "write error: %v", err)
+		return
+	}
+	if written != chunkSize {
+		respondError(w, http.StatusInternalServerError, CodeIncompleteWrite,
+			"incomplete write: expected %d, wrote %d", chunkSize, written)
+		return
+	}
+	logFor(w).Info("wrote chunk", "index", index, "bytes", written, "offset", offset, "part", key+".part")
+	s.chunkWritten(written)
+	s.recordChunk(r, key, fileName, index, written)
+	s.received.Mark(key, index, written)
+	s.saveReceived(key, meta)
+	s.publishChunk(key, index, written, totalChunks)
+
+	received := s.received.Bytes(key)
+	if s.received.Count(key) < totalChunks {
+		resp := SuccessResponse{Status: "ok", Received: received}
+		resp.BytesPerSec, resp.ETASeconds = meta.Progress(received, fileSize, s.now())
+		respondSuccess(w, resp)
+		return
+	}
+
+	// ----- Every chunk is in: finalize -----
+	if received != fileSize {
+		s.received.Unmark(key, index)
+		s.saveReceived(key, meta)
+		respondError(w, http.StatusBadRequest, CodeFileSizeMismatch,
+			"size mismatch: declared fileSize %d, received %d", fileSize, received)
+		return
+	}
+	if err := f.Close(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot close part file: %v", err)
+		return
+	}
+	s.publish(key, UploadEvent{Type: EventAssembling})
+	if !s.verifyAssembled(w, key, fileName, fileChecksums(r)) {
+		return
+	}
+	finalPath, err := s.finalizeWithRetry(w, key, fileName)
+	if err != nil {
+		// The part file is complete; unmarking this chunk lets a resend of it
+		// retry the finalize.
+		s.received.Unmark(key, index)
+		s.saveReceived(key, meta)
+		respondError(w, http.StatusInternalServerError, CodeFinalizeFailed,
+			"file not stored: cannot move %s into place: %v; resend chunk %d to retry", fileName, err, index)
+		return
+	}
+	s.received.Forget(key)
+	s.sessions.Remove(key)
+	logFor(w).Info("upload finished", "path", finalPath, "total_chunks", totalChunks, "out_of_order", true)
+	resp, uerr := s.completedResponse(r, key, fileName, finalPath)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	respondSuccess(w, resp)
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// SESSION_CACHE: upload metadata kept in Redis, so resume and status
+// queries and the resent-chunk check need no metadata file read
+// ---------------------------------------------------------------------
+
+// metaCache returns the cache SESSION_CACHE names, nil when it is off.
+// Entries live as long as an upload may (UPLOAD_TTL or STALE_UPLOAD_TTL);
+// a tenant's keys start with its name.
+func (c Config) metaCache() storage.MetaCache {
+	if c.SessionCache == "" {
+		return nil
+	}
+	node, _ := session.ParseRedisURL(c.SessionCache)
+	cache := session.NewRedisCache(node)
+	cache.TTL = max(c.UploadTTL, c.StaleTTL)
+	if c.tenant != "" {
+		cache.Prefix += c.tenant + "/"
+	}
+	return cache
+}
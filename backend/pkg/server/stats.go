@@ -0,0 +1,176 @@
+package server
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// GET /stats/active: live totals of the uploads in flight, for dashboards
+// ---------------------------------------------------------------------
+
+const (
+	IngestWindow    = 60 // seconds the ingest rate is averaged over
+	DefaultStatsTop = 10
+	MaxStatsTop     = 100
+)
+
+// ingestRate counts the bytes stored in each of the last IngestWindow
+// seconds.
+type ingestRate struct {
+	sync.Mutex
+	bytes [IngestWindow]int64
+	at    [IngestWindow]int64 // unix second each slot counts
+}
+
+func (g *ingestRate) add(now time.Time, n int64) {
+	g.Lock()
+	defer g.Unlock()
+	sec := now.Unix()
+	i := sec % IngestWindow
+	if g.at[i] != sec {
+		g.at[i], g.bytes[i] = sec, 0
+	}
+	g.bytes[i] += n
+}
+
+// perSecond returns the bytes per second stored over the window ending
+// at now.
+func (g *ingestRate) perSecond(now time.Time) float64 {
+	g.Lock()
+	defer g.Unlock()
+	var total int64
+	sec := now.Unix()
+	for i, at := range g.at {
+		if at > sec-IngestWindow && at <= sec {
+			total += g.bytes[i]
+		}
+	}
+	return float64(total) / IngestWindow
+}
+
+// chunkWritten counts a stored chunk (or tus PATCH) of n bytes in
+// /metrics and the ingest rate.
+func (s *Server) chunkWritten(n int64) {
+	s.metrics.chunkWritten(n)
+	s.ingest.add(s.now(), n)
+}
+
+// ActiveStats is the body of GET /stats/active.
+type ActiveStats struct {
+	Uploads              int              `json:"uploads"`       // in progress on this process
+	Paused               int              `json:"paused"`        // of Uploads
+	ReceivedBytes        int64            `json:"receivedBytes"` // stored so far by the uploads in progress
+	IngestBytesPerSecond float64          `json:"ingestBytesPerSecond"`
+	WindowSeconds        int              `json:"windowSeconds"` // the rate is averaged over
+	Largest              []ActiveUpload   `json:"largest"`       // by size, at most ?top=
+	Tenants              []TenantActivity `json:"tenants,omitempty"`
+}
+
+// ActiveUpload is an upload in progress. Size is the declared FileSize,
+// else what was received so far.
+type ActiveUpload struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	FileName    string    `json:"fileName"`
+	Size        int64     `json:"size"`
+	Received    int64     `json:"received"`
+	TotalChunks int       `json:"totalChunks,omitempty"` // 0 for tus and uploads without a session
+	Paused      bool      `json:"paused,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// TenantActivity is one tenant's share of ActiveStats.
+type TenantActivity struct {
+	Tenant               string  `json:"tenant"`
+	Uploads              int     `json:"uploads"`
+	ReceivedBytes        int64   `json:"receivedBytes"`
+	IngestBytesPerSecond float64 `json:"ingestBytesPerSecond"`
+}
+
+// activeStatsHandler sums the uploads in progress of every tenant. Only
+// this process is counted; behind a load balancer, add up the replicas.
+func (s *Server) activeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	top := DefaultStatsTop
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > MaxStatsTop {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid top %q: want 0 to %d", v, MaxStatsTop)
+			return
+		}
+		top = n
+	}
+
+	now := s.now()
+	st := ActiveStats{WindowSeconds: IngestWindow, Largest: []ActiveUpload{}}
+	var all []ActiveUpload
+	for _, srv := range s.servers() {
+		uploads := srv.activeUploads()
+		rate := srv.ingest.perSecond(now)
+		t := TenantActivity{Tenant: srv.tenant, Uploads: len(uploads), IngestBytesPerSecond: rate}
+		for _, u := range uploads {
+			t.ReceivedBytes += u.Received
+			if u.Paused {
+				st.Paused++
+			}
+		}
+		st.Uploads += t.Uploads
+		st.ReceivedBytes += t.ReceivedBytes
+		st.IngestBytesPerSecond += rate
+		if srv.tenant != "" {
+			st.Tenants = append(st.Tenants, t)
+		}
+		all = append(all, uploads...)
+	}
+	slices.SortFunc(all, func(a, b ActiveUpload) int {
+		return cmp.Or(cmp.Compare(b.Size, a.Size), cmp.Compare(a.ID, b.ID))
+	})
+	st.Largest = append(st.Largest, all[:min(top, len(all))]...)
+	respondJSON(w, http.StatusOK, st)
+}
+
+// activeUploads lists the sessions of s and the uploads without one that
+// have chunks stored.
+func (s *Server) activeUploads() []ActiveUpload {
+	var list []ActiveUpload
+	seen := make(map[string]bool)
+	for _, sess := range s.sessions.List() {
+		seen[sess.ID] = true
+		u := ActiveUpload{ID: sess.ID, Tenant: s.tenant, FileName: sess.FileName, TotalChunks: sess.TotalChunks,
+			Received: s.received.Bytes(sess.ID), CreatedAt: sess.CreatedAt}
+		if sess.TotalChunks == 0 {
+			u.Received, _ = s.store.PartSize(sess.ID) // tus: the offset
+		}
+		if _, u.Paused = s.paused.Load(sess.ID); u.Paused {
+			// Pausing dropped the tracking; the metadata has the chunks.
+			if meta, err := s.store.LoadMeta(sess.ID); err == nil {
+				for _, n := range meta.Received {
+					u.Received += n
+				}
+			}
+		}
+		u.Size = cmp.Or(sess.FileSize, u.Received)
+		list = append(list, u)
+	}
+	for _, key := range s.received.Keys() {
+		if seen[key] {
+			continue
+		}
+		u := ActiveUpload{ID: key, Tenant: s.tenant, FileName: key, Received: s.received.Bytes(key)}
+		if meta, err := s.store.LoadMeta(key); err == nil {
+			u.FileName = cmp.Or(meta.FileName, key)
+			u.Size, u.CreatedAt = meta.FileSize, meta.CreatedAt
+		}
+		u.Size = cmp.Or(u.Size, u.Received)
+		list = append(list, u)
+	}
+	return list
+}
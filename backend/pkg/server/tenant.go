@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Tenants (TENANT_MODE): one process serving several applications, each
+// with its own directories, tables, sessions, listing and quota
+// ---------------------------------------------------------------------
+
+// Tenant modes: how a request's tenant is found.
+const (
+	TenantByAPIKey = "apikey" // the API key's name, or a JWT's "tenant" claim
+	TenantByPath   = "path"   // the path prefix /t/{tenant}/
+
+	TenantPathPrefix = "/t/"
+)
+
+// validTenant is what a tenant name may look like: it names a directory
+// and an object key prefix.
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// tenantNames returns the configured tenants: TENANTS, or in apikey mode
+// without it, the names of API_KEYS.
+func (c Config) tenantNames() []string {
+	if len(c.Tenants) > 0 || c.TenantMode != TenantByAPIKey {
+		return c.Tenants
+	}
+	var names []string
+	for _, name := range parseAPIKeys(c.APIKeys) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// forTenant is the config of tenant name's Server: the same settings,
+// with its files in a subdirectory (or under a key prefix) of its own.
+func (c Config) forTenant(name string) Config {
+	c.TenantMode, c.Tenants = "", nil
+	c.AdminToken = "" // /admin is the process's
+	c.tenant = name
+	c.UploadDir = filepath.Join(c.UploadDir, name)
+	c.TempDir = filepath.Join(c.TempDir, name)
+	c.QuarantineDir = filepath.Join(c.QuarantineDir, name)
+	c.Object.Prefix += name + "/"
+	c.Azure.Prefix += name + "/"
+	c.SFTP.Dir = path.Join(c.SFTP.Dir, name)
+	return c
+}
+
+// newTenant builds the Server for tenant name. Limits, authentication,
+// metrics, the audit log and maintenance mode are the process's, shared
+// with s; the metadata database is shared too, with the tenant's upload
+// IDs prefixed by its name.
+func (s *Server) newTenant(name string) *Server {
+	t := NewWithStorage(s.cfg.forTenant(name), nil)
+	t.tenant = name
+	t.now = func() time.Time { return s.now() }
+	t.slots, t.perClient = s.slots, s.perClient
+	t.limiter, t.userLimiter = s.limiter, s.userLimiter
+	t.bandwidth = s.bandwidth
+	t.auth = s.auth
+	t.metrics, t.tracer, t.auditFile = s.metrics, s.tracer, s.auditFile
+	t.maintenance, t.started = s.maintenance, s.started
+	t.space = s.space
+	t.transcoder = s.transcoder
+	return t
+}
+
+// servers returns s and, in tenant mode, every tenant's Server.
+func (s *Server) servers() []*Server {
+	all := []*Server{s}
+	for _, name := range s.cfg.tenantNames() {
+		all = append(all, s.tenants[name])
+	}
+	return all
+}
+
+// dbKey is key as recorded in METADATA_DB, which all tenants share.
+func (s *Server) dbKey(key string) string {
+	if s.tenant == "" {
+		return key
+	}
+	return s.tenant + "/" + key
+}
+
+// tenantOf returns the tenant a principal belongs to in apikey mode.
+func tenantOf(p Principal) string {
+	if p.Method == "apikey" {
+		return p.Subject
+	}
+	return p.Tenant
+}
+
+// tenantRoutes hands each request to its tenant's Server; mux is s's own
+// routes, used for CORS preflights, which carry no credentials, and for
+// /admin. /metrics, /admin and the probes cover every tenant.
+func (s *Server) tenantRoutes(mux http.Handler) http.Handler {
+	top := http.NewServeMux()
+	top.HandleFunc("/healthz", s.healthzHandler)
+	top.HandleFunc("/readyz", s.readyzHandler)
+	top.HandleFunc("/metrics", s.instrument("/metrics", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthMetrics, s.metricsHandler))))
+	top.HandleFunc("/stats/active", s.instrument("/stats/active", s.withCORS([]string{http.MethodGet}, s.withAuth(AuthMetrics, s.activeStatsHandler))))
+	top.HandleFunc("/openapi.json", s.instrument("/openapi.json", s.withCORS([]string{http.MethodGet}, s.openAPIHandler)))
+	top.HandleFunc("/docs", s.instrument("/docs", s.docsHandler))
+	if s.cfg.AdminToken != "" {
+		top.Handle("/admin/", mux)
+	}
+	// fail answers a request no tenant took, logged and counted like the
+	// tenants' own routes.
+	fail := func(route string, status int, code, format string, args ...any) http.HandlerFunc {
+		return s.instrument(route, s.withCORS([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chunk-upload"`)
+			}
+			respondError(w, status, code, format, args...)
+		}))
+	}
+
+	if s.cfg.TenantMode == TenantByPath {
+		top.HandleFunc(TenantPathPrefix+"{tenant}/", func(w http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("tenant")
+			t := s.tenants[name]
+			if t == nil {
+				fail(TenantPathPrefix+"{tenant}/", http.StatusNotFound, CodeUnknownTenant, "unknown tenant %q", name)(w, r)
+				return
+			}
+			http.StripPrefix(TenantPathPrefix+name, t).ServeHTTP(w, r)
+		})
+		top.HandleFunc("/", fail("/", http.StatusNotFound, CodeNotFound, "no tenant in path: use %s{tenant}/...", TenantPathPrefix))
+		return top
+	}
+
+	top.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		// A signed URL names its tenant, which its signature covers.
+		if q := r.URL.Query(); q.Has("sig") && s.tenants[q.Get("tenant")] != nil {
+			s.tenants[q.Get("tenant")].ServeHTTP(w, r)
+			return
+		}
+		p, err := Principal{}, errNoCredentials
+		if s.auth != nil {
+			p, err = s.auth.Authenticate(r)
+		}
+		if err != nil {
+			fail("/", http.StatusUnauthorized, CodeUnauthorized, "%v", err)(w, r)
+			return
+		}
+		t := s.tenants[tenantOf(p)]
+		if t == nil {
+			fail("/", http.StatusForbidden, CodeUnknownTenant, "%s belongs to no tenant", p.Subject)(w, r)
+			return
+		}
+		t.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+	return top
+}
+
+// checkTenant refuses a principal tied to another tenant than the one
+// its request was routed to: by a JWT "tenant" claim, or for an API key
+// by its name, as in TENANT_MODE=apikey.
+func (s *Server) checkTenant(p Principal) error {
+	if want := tenantOf(p); s.tenant != "" && want != "" && want != s.tenant {
+		return fmt.Errorf("%s is for tenant %q, not %q", p.Subject, want, s.tenant)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// THUMBNAILS: scaled-down JPEG copies of completed image uploads, served
+// at GET /files/{name}/thumbnail/{size}
+// ---------------------------------------------------------------------
+
+const (
+	ThumbnailQuality   = 85       // JPEG quality of thumbnails
+	MaxThumbnailSide   = 4096     // largest width or height THUMBNAILS may ask for
+	MaxThumbnailPixels = 40 << 20 // larger images are not decoded, to bound memory
+)
+
+// ThumbnailSize is a box a thumbnail is scaled to fit in.
+type ThumbnailSize struct {
+	Width, Height int
+}
+
+func (t ThumbnailSize) String() string {
+	return fmt.Sprintf("%dx%d", t.Width, t.Height)
+}
+
+// parseThumbnailSize reads WxH, or N for an N×N box.
+func parseThumbnailSize(v string) (ThumbnailSize, error) {
+	ws, hs, found := strings.Cut(strings.ToLower(strings.TrimSpace(v)), "x")
+	if !found {
+		hs = ws
+	}
+	w, werr := strconv.Atoi(ws)
+	h, herr := strconv.Atoi(hs)
+	if werr != nil || herr != nil || w <= 0 || h <= 0 || w > MaxThumbnailSide || h > MaxThumbnailSide {
+		return ThumbnailSize{}, fmt.Errorf("invalid thumbnail size %q: want WxH or N, 1 to %d pixels", v, MaxThumbnailSide)
+	}
+	return ThumbnailSize{w, h}, nil
+}
+
+// parseThumbnailSizes reads THUMBNAILS: comma-separated sizes.
+func parseThumbnailSizes(v string) ([]ThumbnailSize, error) {
+	var sizes []ThumbnailSize
+	for _, f := range strings.Split(v, ",") {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		size, err := parseThumbnailSize(f)
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// Thumbnail is one stored thumbnail of a completed file.
+type Thumbnail struct {
+	Size string `json:"size"` // the box it fits in, WxH
+	URL  string `json:"url"`
+}
+
+// thumbnailName is where the thumbnail of name in size is stored, next to
+// it. Such names are reserved: uploads cannot use them.
+func thumbnailName(name string, size ThumbnailSize) string {
+	return name + ".thumb-" + size.String() + ".jpg"
+}
+
+var thumbnailNameRe = regexp.MustCompile(`\.thumb-[0-9]+x[0-9]+\.jpg$`)
+
+// isThumbnail reports whether name is a thumbnail of another file.
+func isThumbnail(name string) bool {
+	return thumbnailNameRe.MatchString(name)
+}
+
+// thumbnailTypes are the sniffed content types thumbnails are made of.
+var thumbnailTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true}
+
+// makeThumbnails stores a thumbnail of the completed file name in every
+// THUMBNAILS size, if it is an image, and describes them. A failure is
+// logged and leaves the upload alone. Thumbnails of an earlier file of the
+// same name that is not an image are removed.
+func (s *Server) makeThumbnails(r *http.Request, name, contentType string) []Thumbnail {
+	if len(s.cfg.Thumbnails) == 0 {
+		return nil
+	}
+	if !thumbnailTypes[contentType] {
+		s.removeThumbnails(name)
+		return nil
+	}
+	img, err := decodeStored(s.store, name)
+	if err != nil {
+		logCtx(r.Context()).Warn("cannot make thumbnails", "file", name, "error", err)
+		s.removeThumbnails(name)
+		return nil
+	}
+	var thumbs []Thumbnail
+	for _, size := range s.cfg.Thumbnails {
+		if err := storeJPEG(s.store, thumbnailName(name, size), scaleToFit(img, size)); err != nil {
+			logCtx(r.Context()).Warn("cannot store thumbnail", "file", name, "size", size, "error", err)
+			continue
+		}
+		thumbs = append(thumbs, thumbnailOf(r, name, size))
+	}
+	logCtx(r.Context()).Info("thumbnails stored", "file", name, "count", len(thumbs))
+	return thumbs
+}
+
+// thumbnails describes the stored thumbnails of name.
+func (s *Server) thumbnails(r *http.Request, name string) []Thumbnail {
+	var thumbs []Thumbnail
+	for _, size := range s.cfg.Thumbnails {
+		if _, _, err := s.store.Stat(thumbnailName(name, size)); err == nil {
+			thumbs = append(thumbs, thumbnailOf(r, name, size))
+		}
+	}
+	return thumbs
+}
+
+// removeThumbnails deletes the thumbnails of name.
+func (s *Server) removeThumbnails(name string) {
+	for _, size := range s.cfg.Thumbnails {
+		if err := s.store.Remove(thumbnailName(name, size)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("cannot remove thumbnail", "file", name, "size", size, "error", err)
+		}
+	}
+}
+
+func thumbnailOf(r *http.Request, name string, size ThumbnailSize) Thumbnail {
+	return Thumbnail{Size: size.String(),
+		URL: mountPrefix(r) + "/files/" + url.PathEscape(name) + "/thumbnail/" + size.String()}
+}
+
+// thumbnailHandler serves GET /files/{name}/thumbnail/{size}.
+func (s *Server) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	fileName, uerr := s.cleanFileName(r.PathValue("name"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	size, err := parseThumbnailSize(r.PathValue("size"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "%v", err)
+		return
+	}
+	lock := s.locks.Get(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	name := thumbnailName(fileName, size)
+	n, modTime, err := s.store.Stat(name)
+	if err == nil && s.isExpired(fileName) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "no %s thumbnail of %q", size, fileName)
+		return
+	}
+	f, err := s.store.Open(name)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open thumbnail: %v", err)
+		return
+	}
+	defer f.Close()
+	setDownloadHeaders(w, r, name, "image/jpeg", n, modTime)
+	w.Header().Set("Content-Disposition", "inline")
+	http.ServeContent(w, r, name, modTime, f)
+}
+
+// decodeStored decodes the image stored as name, refusing ones over
+// MaxThumbnailPixels before decoding them.
+func decodeStored(st storage.Storage, name string) (image.Image, error) {
+	f, err := st.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxThumbnailPixels {
+		return nil, fmt.Errorf("%dx%d image is over %d pixels", cfg.Width, cfg.Height, MaxThumbnailPixels)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// scaleToFit shrinks img to fit in box, keeping its aspect ratio, by
+// averaging the pixels under each thumbnail pixel. Transparent areas turn
+// white. An image that already fits keeps its size.
+func scaleToFit(img image.Image, box ThumbnailSize) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	scale := min(float64(box.Width)/float64(w), float64(box.Height)/float64(h), 1)
+	dw, dh := max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := y * h / dh
+		y1 := max((y+1)*h/dh, y0+1)
+		for x := 0; x < dw; x++ {
+			x0 := x * w / dw
+			x1 := max((x+1)*w/dw, x0+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := range sum {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			// The pixels are alpha-premultiplied, so over white each
+			// channel gains what alpha lacks.
+			n := (y1 - y0) * (x1 - x0)
+			white := 255*n - sum[3]
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				dst.Pix[i+c] = uint8((sum[c] + white) / n)
+			}
+			dst.Pix[i+3] = 255
+		}
+	}
+	return dst
+}
+
+// storeJPEG writes img to st as the completed file name.
+func storeJPEG(st storage.Storage, name string, img image.Image) error {
+	out, err := st.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: ThumbnailQuality}); err != nil {
+		out.Close()
+		st.Remove(name)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		st.Remove(name)
+		return err
+	}
+	return nil
+}
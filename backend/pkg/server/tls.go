@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultAutocertDir caches ACME certificates when AUTOCERT_DIR is unset.
+// Keep it on a persistent volume: Let's Encrypt rate-limits reissuing.
+const DefaultAutocertDir = "./autocert"
+
+// DefaultReadHeaderTimeout bounds how long a connection may sit before
+// its request headers are in, so slow clients cannot pin connections.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// HTTPServer returns the server for h on Addr: with tlsConfig (from TLS)
+// it serves HTTPS and HTTP/2; without, HTTP/1.1 and, with H2C, HTTP/2
+// with prior knowledge. READ_TIMEOUT is off by default, since a chunk can
+// take a while to arrive on a slow link.
+func (c Config) HTTPServer(h http.Handler, tlsConfig *tls.Config) *http.Server {
+	hs := &http.Server{Addr: c.Addr, Handler: h, TLSConfig: tlsConfig, Protocols: new(http.Protocols),
+		ReadHeaderTimeout: c.ReadHeaderTimeout, ReadTimeout: c.ReadTimeout}
+	hs.Protocols.SetHTTP1(true)
+	hs.Protocols.SetHTTP2(true)
+	hs.Protocols.SetUnencryptedHTTP2(c.H2C && tlsConfig == nil)
+	return hs
+}
+
+// TLSEnabled reports whether the server listens for HTTPS.
+func (c Config) TLSEnabled() bool {
+	return c.TLSCert != "" || len(c.AutocertHosts) > 0
+}
+
+// TLS returns the HTTPS listener config and the handler for the plain-HTTP
+// listener on HTTPRedirectAddr, or nil, nil when TLS is off. The config
+// offers HTTP/2, so a browser sends parallel chunks over one connection.
+//
+// With AutocertHosts, certificates are requested from the ACME directory on
+// the first handshake for each host and renewed before they expire. The
+// tls-alpn-01 challenge is answered on the HTTPS port itself; the redirect
+// handler also answers http-01, which needs HTTPRedirectAddr on port 80.
+func (c Config) TLS() (*tls.Config, http.Handler, error) {
+	if !c.TLSEnabled() {
+		return nil, nil, nil
+	}
+	redirect := redirectHTTPS(c.Addr)
+	if len(c.AutocertHosts) == 0 {
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+			MinVersion:   tls.VersionTLS12,
+		}, redirect, nil
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.AutocertDir),
+		HostPolicy: autocert.HostWhitelist(c.AutocertHosts...),
+		Email:      c.AutocertEmail,
+	}
+	if c.AutocertURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.AutocertURL}
+	}
+	cfg := m.TLSConfig() // h2, http/1.1 and acme-tls/1
+	cfg.MinVersion = tls.VersionTLS12
+	return cfg, m.HTTPHandler(redirect), nil
+}
+
+// redirectHTTPS sends plain-HTTP requests to the same URL on the HTTPS
+// listener at addr. 308 keeps the method and body, so a client that posts
+// a chunk to http:// retries it against https://.
+func redirectHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]") // IPv6 literal without a port
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
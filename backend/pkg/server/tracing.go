@@ -0,0 +1,396 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Tracing (OTEL_EXPORTER_OTLP_ENDPOINT): a span per request, continuing
+// the caller's W3C traceparent, with child spans for storage writes,
+// assembly and post-processing, exported as OTLP/HTTP JSON
+// ---------------------------------------------------------------------
+
+const (
+	DefaultTraceService = "chunk-upload"
+
+	TraceExportInterval = 5 * time.Second // how often ended spans are sent
+	TraceBatchSize      = 512             // sent at once when this many are waiting
+	TraceMaxQueued      = 8192            // ended spans held while the collector is slow; more are dropped
+	TraceExportTimeout  = 10 * time.Second
+
+	traceScope = "github.com/navneetshukl/Chunk-Upload/backend/pkg/server"
+)
+
+// Span kinds and status codes of OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+
+	spanStatusError = 2
+)
+
+// tracer records spans and sends them to the collector.
+type tracer struct {
+	url     string // .../v1/traces
+	headers http.Header
+	service string
+	ratio   float64 // of new traces recorded; traces with a parent follow its sampled flag
+	client  *http.Client
+	now     func() time.Time
+
+	mu      sync.Mutex
+	queue   []*span
+	dropped int64
+	kick    chan struct{} // a full batch is waiting
+	start   sync.Once
+}
+
+// newTracer returns the tracer cfg asks for, nil when tracing is off.
+func newTracer(cfg Config) *tracer {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	return &tracer{
+		url:     strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/traces",
+		headers: cfg.OTLPHeaders,
+		service: cmp.Or(cfg.TraceService, DefaultTraceService),
+		ratio:   cfg.TraceSampleRatio,
+		client:  &http.Client{Timeout: TraceExportTimeout},
+		now:     time.Now,
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// parseOTLPHeaders reads OTEL_EXPORTER_OTLP_HEADERS: key=value pairs
+// separated by commas, values URL-encoded.
+func parseOTLPHeaders(v string) (http.Header, error) {
+	h := make(http.Header)
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q: want key=value", pair)
+		}
+		if unescaped, err := url.PathUnescape(strings.TrimSpace(value)); err == nil {
+			value = unescaped
+		}
+		h.Add(strings.TrimSpace(key), value)
+	}
+	return h, nil
+}
+
+// span is one timed operation. A nil *span is a span not recorded, so
+// callers never check whether tracing is on.
+type span struct {
+	t       *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []any // key, value, key, value...
+	status int
+	msg    string
+}
+
+// TraceparentHeader is the W3C header carrying a trace's context.
+const TraceparentHeader = "Traceparent"
+
+// parseTraceparent reads a version 00 traceparent header; a missing or
+// malformed one starts a new trace.
+func parseTraceparent(v string) (traceID [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return traceID, parent, false, false
+	}
+	t, err1 := hex.DecodeString(parts[1])
+	p, err2 := hex.DecodeString(parts[2])
+	f, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(t) != 16 || len(p) != 8 || len(f) != 1 {
+		return traceID, parent, false, false
+	}
+	copy(traceID[:], t)
+	copy(parent[:], p)
+	if traceID == ([16]byte{}) || parent == ([8]byte{}) {
+		return traceID, parent, false, false
+	}
+	return traceID, parent, f[0]&1 == 1, true
+}
+
+// startRequest starts the server span of r, continuing the trace of its
+// traceparent header if it has a valid one; nil when the trace is not
+// sampled.
+func (t *tracer) startRequest(r *http.Request, route string) *span {
+	if t == nil {
+		return nil
+	}
+	traceID, parent, sampled, ok := parseTraceparent(r.Header.Get(TraceparentHeader))
+	if !ok {
+		rand.Read(traceID[:])
+		sampled = t.ratio >= 1 || t.ratio > 0 && sampleTrace(traceID, t.ratio)
+	}
+	if !sampled {
+		return nil
+	}
+	sp := &span{t: t, traceID: traceID, parent: parent, name: r.Method + " " + route, kind: spanServer, start: t.now()}
+	rand.Read(sp.spanID[:])
+	sp.set("http.request.method", r.Method, "http.route", route, "url.path", r.URL.Path)
+	return sp
+}
+
+// sampleTrace decides from the trace ID, as OTel's TraceIdRatioBased
+// sampler does, so every service sampling at ratio agrees.
+func sampleTrace(traceID [16]byte, ratio float64) bool {
+	var v uint64
+	for _, b := range traceID[8:] {
+		v = v<<8 | uint64(b)
+	}
+	return v>>1 < uint64(ratio*math.MaxInt64)
+}
+
+// child starts a span under sp.
+func (sp *span) child(name string, kv ...any) *span {
+	if sp == nil {
+		return nil
+	}
+	c := &span{t: sp.t, traceID: sp.traceID, parent: sp.spanID, name: name, kind: spanInternal, start: sp.t.now()}
+	rand.Read(c.spanID[:])
+	return c.set(kv...)
+}
+
+// set adds attributes, given as key, value pairs.
+func (sp *span) set(kv ...any) *span {
+	if sp == nil {
+		return nil
+	}
+	sp.mu.Lock()
+	sp.attrs = append(sp.attrs, kv...)
+	sp.mu.Unlock()
+	return sp
+}
+
+// fail marks sp as failed with msg.
+func (sp *span) fail(msg string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.status, sp.msg = spanStatusError, msg
+	sp.mu.Unlock()
+}
+
+// done ends sp, failed if err is set.
+func (sp *span) done(err error) {
+	if err != nil {
+		sp.fail(err.Error())
+	}
+	sp.finish()
+}
+
+// refused ends sp, failed with the code of uerr if set.
+func (sp *span) refused(uerr *uploadError) {
+	if uerr != nil {
+		sp.set("error.code", uerr.code)
+		sp.fail(uerr.msg)
+	}
+	sp.finish()
+}
+
+// finish ends sp and queues it for export.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if !sp.end.IsZero() {
+		sp.mu.Unlock()
+		return
+	}
+	sp.end = sp.t.now()
+	sp.mu.Unlock()
+	sp.t.enqueue(sp)
+}
+
+// traceIDHex is sp's trace ID in hex, for log lines.
+func (sp *span) traceIDHex() string {
+	return hex.EncodeToString(sp.traceID[:])
+}
+
+func (t *tracer) enqueue(sp *span) {
+	t.start.Do(func() { go t.run() })
+	t.mu.Lock()
+	if len(t.queue) >= TraceMaxQueued {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.queue = append(t.queue, sp)
+	full := len(t.queue) >= TraceBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the queued spans every TraceExportInterval, or sooner once a
+// batch is full.
+func (t *tracer) run() {
+	tick := time.NewTicker(TraceExportInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.kick:
+		}
+		t.flush()
+	}
+}
+
+// flush sends every queued span; Shutdown calls it for those ended last.
+// Spans the collector refuses are dropped.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+	for {
+		t.mu.Lock()
+		batch := t.queue[:min(len(t.queue), TraceBatchSize)]
+		t.queue = t.queue[len(batch):]
+		dropped := t.dropped
+		t.dropped = 0
+		t.mu.Unlock()
+		if dropped > 0 {
+			slog.Warn("trace queue full: spans dropped", "spans", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			slog.Warn("cannot export spans", "url", t.url, "spans", len(batch), "error", err)
+			return
+		}
+	}
+}
+
+// export posts batch as an OTLP/HTTP JSON ExportTraceServiceRequest.
+func (t *tracer) export(batch []*span) error {
+	spans := make([]map[string]any, len(batch))
+	for i, sp := range batch {
+		spans[i] = sp.otlp()
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttrs([]any{"service.name", t.service, "service.version", Build().Version})},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": traceScope},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp is sp as an OTLP JSON Span.
+func (sp *span) otlp() map[string]any {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	m := map[string]any{
+		"traceId":           hex.EncodeToString(sp.traceID[:]),
+		"spanId":            hex.EncodeToString(sp.spanID[:]),
+		"name":              sp.name,
+		"kind":              sp.kind,
+		"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+		"attributes":        otlpAttrs(sp.attrs),
+	}
+	if sp.parent != ([8]byte{}) {
+		m["parentSpanId"] = hex.EncodeToString(sp.parent[:])
+	}
+	if sp.status != 0 {
+		m["status"] = map[string]any{"code": sp.status, "message": sp.msg}
+	}
+	return m
+}
+
+// otlpAttrs converts key, value pairs to OTLP KeyValues.
+func otlpAttrs(kv []any) []map[string]any {
+	attrs := make([]map[string]any, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		var v map[string]any
+		switch x := kv[i+1].(type) {
+		case string:
+			v = map[string]any{"stringValue": x}
+		case bool:
+			v = map[string]any{"boolValue": x}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		attrs = append(attrs, map[string]any{"key": fmt.Sprint(kv[i]), "value": v})
+	}
+	return attrs
+}
+
+// spanOf returns the span of the request w answers, nil when it is not
+// traced.
+func spanOf(w http.ResponseWriter) *span {
+	if rec, ok := w.(*requestRecorder); ok {
+		return rec.span
+	}
+	return nil
+}
+
+// spanCtx is spanOf for code that has the request but not its writer.
+func spanCtx(ctx context.Context) *span {
+	if rec, ok := ctx.Value(recorderKey{}).(*requestRecorder); ok {
+		return rec.span
+	}
+	return nil
+}
@@ -0,0 +1,586 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// TRANSCODE_PRESETS: completed video uploads are queued for ffmpeg, which
+// renders each preset; GET /uploads/{id}/processing follows the job and
+// GET /files/{name}/transcode/{preset} serves the results
+// ---------------------------------------------------------------------
+
+// Defaults for transcoding.
+const (
+	DefaultFFmpeg           = "ffmpeg"
+	DefaultTranscodeWorkers = 1
+	DefaultTranscodeTimeout = time.Hour
+	TranscodeQueueSize      = 1000 // jobs waiting in the in-process queue
+	transcodeErrorLen       = 1024 // of ffmpeg's output kept in ProcessingStatus.Error
+)
+
+// Processing states, in ProcessingStatus.State.
+const (
+	ProcessingQueued  = "queued"
+	ProcessingRunning = "running"
+	ProcessingDone    = "done"
+	ProcessingFailed  = "failed"
+)
+
+// TranscodePreset is one rendition ffmpeg makes of a video upload.
+type TranscodePreset struct {
+	Name string   // in URLs and output names: lowercase letters and digits
+	Ext  string   // of the output, which selects its container, e.g. mp4
+	Args []string // ffmpeg output options, between the input and the output file
+}
+
+// h264Preset renders H.264/AAC MP4 at most height pixels high.
+func h264Preset(name string, height int) TranscodePreset {
+	return TranscodePreset{Name: name, Ext: "mp4", Args: []string{
+		"-vf", fmt.Sprintf("scale=-2:'min(%d,trunc(ih/2)*2)'", height),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23",
+		"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart",
+	}}
+}
+
+// transcodePresets are the presets TRANSCODE_PRESETS can name.
+var transcodePresets = map[string]TranscodePreset{
+	"1080p": h264Preset("1080p", 1080),
+	"720p":  h264Preset("720p", 720),
+	"480p":  h264Preset("480p", 480),
+	"360p":  h264Preset("360p", 360),
+	"audio": {Name: "audio", Ext: "m4a", Args: []string{"-vn", "-c:a", "aac", "-b:a", "128k"}},
+}
+
+// parseTranscodePresets reads TRANSCODE_PRESETS: comma-separated names
+// of transcodePresets.
+func parseTranscodePresets(v string) ([]TranscodePreset, error) {
+	var presets []TranscodePreset
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		p, ok := transcodePresets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q: want %s", name,
+				strings.Join(slices.Sorted(maps.Keys(transcodePresets)), ", "))
+		}
+		presets = append(presets, p)
+	}
+	return presets, nil
+}
+
+// preset returns the configured preset name.
+func (c Config) preset(name string) (TranscodePreset, bool) {
+	i := slices.IndexFunc(c.TranscodePresets, func(p TranscodePreset) bool { return p.Name == name })
+	if i < 0 {
+		return TranscodePreset{}, false
+	}
+	return c.TranscodePresets[i], true
+}
+
+// transcodedName is where preset p of name is stored, next to it. Such
+// names are reserved: uploads cannot use them.
+func transcodedName(name string, p TranscodePreset) string {
+	return name + ".transcode-" + p.Name + "." + p.Ext
+}
+
+var transcodedNameRe = regexp.MustCompile(`\.transcode-[a-z0-9]+\.[a-z0-9]+$`)
+
+// isTranscoded reports whether name is a transcoded copy of another file.
+func isTranscoded(name string) bool {
+	return transcodedNameRe.MatchString(name)
+}
+
+// ProcessingStatus is the transcoding job of a completed file (GET
+// /uploads/{id}/processing).
+type ProcessingStatus struct {
+	ID         string            `json:"id"`
+	State      string            `json:"state"` // queued, running, done or failed
+	Presets    []string          `json:"presets"`
+	Outputs    []TranscodeOutput `json:"outputs,omitempty"` // rendered so far
+	Error      string            `json:"error,omitempty"`   // failed: why
+	QueuedAt   time.Time         `json:"queuedAt"`
+	StartedAt  *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+}
+
+// TranscodeOutput is one stored rendition.
+type TranscodeOutput struct {
+	Preset string `json:"preset"`
+	Size   int64  `json:"size"`
+	URL    string `json:"url,omitempty"`
+}
+
+// transcodeJob is a ProcessingStatus as queued and stored: Token tells the
+// job of a re-uploaded file from the older one it replaced.
+type transcodeJob struct {
+	ProcessingStatus
+	Tenant string `json:"tenant,omitempty"`
+	Token  string `json:"token"`
+}
+
+// jobQueue hands transcode jobs to the workers.
+type jobQueue interface {
+	Push(job []byte) error
+	Pop() ([]byte, error) // waits a little for a job; nil when none came
+}
+
+// transcoder is the job queue and the job statuses, by dbKey of the file.
+// It is in-process, or in Redis with TRANSCODE_QUEUE so that any replica
+// may run a job and report on it. The tenants share it.
+type transcoder struct {
+	queue  jobQueue
+	status storage.MetaCache
+	close  func()
+}
+
+// newTranscoder returns the transcoder cfg asks for, nil when
+// TRANSCODE_PRESETS is off.
+func newTranscoder(cfg Config) *transcoder {
+	if len(cfg.TranscodePresets) == 0 {
+		return nil
+	}
+	if cfg.TranscodeQueue == "" {
+		return &transcoder{queue: make(memQueue, TranscodeQueueSize), status: &memCache{m: make(map[string][]byte)}, close: func() {}}
+	}
+	node, _ := session.ParseRedisURL(cfg.TranscodeQueue)
+	queue := session.NewRedisQueue(node, "transcode")
+	status := session.NewRedisCache(node)
+	status.Prefix = "chunk-upload:transcode:"
+	return &transcoder{queue: queue, status: status, close: func() { queue.Close(); status.Close() }}
+}
+
+var errQueueFull = errors.New("transcode queue full")
+
+// memQueue is the in-process jobQueue.
+type memQueue chan []byte
+
+func (q memQueue) Push(job []byte) error {
+	select {
+	case q <- job:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (q memQueue) Pop() ([]byte, error) {
+	select {
+	case job := <-q:
+		return job, nil
+	case <-time.After(session.RedisQueuePoll):
+		return nil, nil
+	}
+}
+
+// memCache is the in-process job status store.
+type memCache struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (c *memCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[key], nil
+}
+
+func (c *memCache) Set(key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = value
+	return nil
+}
+
+func (c *memCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, key)
+	return nil
+}
+
+// loadJob returns the job of the completed file name, nil when it has none.
+func (s *Server) loadJob(name string) (*transcodeJob, error) {
+	data, err := s.transcoder.status.Get(s.dbKey(name))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var job transcodeJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *Server) saveJob(job *transcodeJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.transcoder.status.Set(s.dbKey(job.ID), data)
+}
+
+// enqueueTranscode queues the completed file name for every
+// TRANSCODE_PRESETS preset, if it is a video, and returns the job state;
+// "" means no job. Renditions of an earlier file of the same name are
+// removed: the new job makes its own.
+func (s *Server) enqueueTranscode(r *http.Request, name, contentType string) string {
+	if s.transcoder == nil {
+		return ""
+	}
+	s.removeTranscoded(name)
+	if !strings.HasPrefix(contentType, "video/") {
+		return ""
+	}
+	token, err := session.NewID()
+	if err != nil {
+		logCtx(r.Context()).Warn("cannot queue transcoding", "file", name, "error", err)
+		return ""
+	}
+	job := &transcodeJob{Tenant: s.tenant, Token: token, ProcessingStatus: ProcessingStatus{
+		ID: name, State: ProcessingQueued, QueuedAt: s.now()}}
+	for _, p := range s.cfg.TranscodePresets {
+		job.Presets = append(job.Presets, p.Name)
+	}
+	data, _ := json.Marshal(job)
+	if err = s.saveJob(job); err == nil {
+		err = s.transcoder.queue.Push(data)
+	}
+	if err != nil {
+		logCtx(r.Context()).Warn("cannot queue transcoding", "file", name, "error", err)
+		s.finishJob(job, nil, fmt.Errorf("cannot queue: %w", err))
+		return ProcessingFailed
+	}
+	logCtx(r.Context()).Info("transcoding queued", "file", name, "presets", strings.Join(job.Presets, ","))
+	return ProcessingQueued
+}
+
+// removeTranscoded deletes the renditions of name and forgets its job.
+func (s *Server) removeTranscoded(name string) {
+	if s.transcoder == nil {
+		return
+	}
+	for _, p := range s.cfg.TranscodePresets {
+		if err := s.store.Remove(transcodedName(name, p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("cannot remove transcoded file", "file", name, "preset", p.Name, "error", err)
+		}
+	}
+	if err := s.transcoder.status.Delete(s.dbKey(name)); err != nil {
+		slog.Warn("cannot forget transcode job", "file", name, "error", err)
+	}
+}
+
+// RunTranscoder runs TRANSCODE_WORKERS workers taking jobs off the
+// transcode queue until ctx is done. A job cut short is queued again. It
+// returns at once when TRANSCODE_PRESETS is off.
+func (s *Server) RunTranscoder(ctx context.Context) {
+	if s.transcoder == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for range s.cfg.TranscodeWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.transcodeWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) transcodeWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		data, err := s.transcoder.queue.Pop()
+		if err != nil {
+			slog.Warn("transcode queue", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(session.RedisQueuePoll):
+			}
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		var job transcodeJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			slog.Warn("transcode queue: bad job", "error", err)
+			continue
+		}
+		srv := s
+		if job.Tenant != "" {
+			if srv = s.tenants[job.Tenant]; srv == nil {
+				slog.Warn("transcode queue: unknown tenant", "tenant", job.Tenant, "file", job.ID)
+				continue
+			}
+		}
+		srv.transcode(ctx, &job)
+	}
+}
+
+// transcode runs job: it copies the file out of storage, has ffmpeg
+// render each preset and stores the results next to it. A job whose file
+// was replaced or deleted meanwhile is dropped.
+func (s *Server) transcode(ctx context.Context, job *transcodeJob) {
+	lg := slog.With("file", job.ID, "tenant", job.Tenant)
+	if !s.currentJob(job) {
+		lg.Info("transcode job superseded")
+		return
+	}
+	dir, err := os.MkdirTemp("", "chunk-upload-transcode-")
+	if err != nil {
+		s.finishJob(job, nil, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input"+filepath.Ext(job.ID))
+	modTime, err := s.copyOut(job.ID, input)
+	if err != nil {
+		s.finishJob(job, nil, fmt.Errorf("cannot read file: %w", err))
+		return
+	}
+
+	start := s.now()
+	job.State, job.StartedAt = ProcessingRunning, &start
+	s.saveJob(job)
+	lg.Info("transcoding", "presets", strings.Join(job.Presets, ","))
+	var outputs []string
+	for _, name := range job.Presets {
+		p, ok := s.cfg.preset(name)
+		if !ok {
+			s.finishJob(job, nil, fmt.Errorf("preset %q is no longer configured", name))
+			return
+		}
+		out := filepath.Join(dir, "output-"+p.Name+"."+p.Ext)
+		if err := s.runFFmpeg(ctx, input, out, p); err != nil {
+			if ctx.Err() != nil {
+				// Shutting down: leave the job to the next worker.
+				job.State, job.StartedAt = ProcessingQueued, nil
+				data, _ := json.Marshal(job)
+				s.saveJob(job)
+				if err := s.transcoder.queue.Push(data); err != nil {
+					lg.Warn("cannot requeue transcode job", "error", err)
+				}
+				return
+			}
+			s.finishJob(job, nil, fmt.Errorf("%s: %w", p.Name, err))
+			return
+		}
+		outputs = append(outputs, out)
+	}
+	if err := s.storeTranscoded(job, modTime, outputs); err != nil {
+		s.finishJob(job, nil, err)
+		return
+	}
+	lg.Info("transcoded", "presets", strings.Join(job.Presets, ","), "duration", s.now().Sub(start))
+}
+
+// currentJob reports whether job is still the one recorded for its file.
+func (s *Server) currentJob(job *transcodeJob) bool {
+	cur, err := s.loadJob(job.ID)
+	return err == nil && cur != nil && cur.Token == job.Token
+}
+
+// copyOut writes the completed file name to the local file path, for
+// ffmpeg, and returns the file's modification time.
+func (s *Server) copyOut(name, path string) (time.Time, error) {
+	lock := s.locks.Get(name)
+	lock.Lock()
+	defer lock.Unlock()
+	_, modTime, err := s.store.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	in, err := s.store.Open(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer in.Close()
+	out, err := os.Create(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return time.Time{}, err
+	}
+	return modTime, out.Close()
+}
+
+// runFFmpeg renders input as preset p into out, within TRANSCODE_TIMEOUT.
+func (s *Server) runFFmpeg(ctx context.Context, input, out string, p TranscodePreset) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.TranscodeTimeout)
+	defer cancel()
+	args := append([]string{"-nostdin", "-y", "-loglevel", "error", "-i", input}, p.Args...)
+	cmd := exec.CommandContext(ctx, s.cfg.FFmpegPath, append(args, out)...)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(output.String())
+		if len(msg) > transcodeErrorLen {
+			msg = "…" + msg[len(msg)-transcodeErrorLen:]
+		}
+		if msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// storeTranscoded moves the rendered outputs, in job.Presets order, into
+// storage and marks job done, unless the file changed since modTime.
+func (s *Server) storeTranscoded(job *transcodeJob, modTime time.Time, outputs []string) error {
+	lock := s.locks.Get(job.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if _, mt, err := s.store.Stat(job.ID); err != nil || !mt.Equal(modTime) || !s.currentJob(job) {
+		slog.Info("transcode job superseded", "file", job.ID, "tenant", job.Tenant)
+		return nil
+	}
+	var results []TranscodeOutput
+	for i, name := range job.Presets {
+		p, _ := s.cfg.preset(name)
+		size, err := storeLocal(s.store, transcodedName(job.ID, p), outputs[i])
+		if err != nil {
+			return fmt.Errorf("cannot store %s: %w", p.Name, err)
+		}
+		results = append(results, TranscodeOutput{Preset: p.Name, Size: size})
+	}
+	s.finishJob(job, results, nil)
+	return nil
+}
+
+// storeLocal copies the local file path into st as the completed file name
+// and returns its size.
+func storeLocal(st storage.Storage, name, path string) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := st.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		st.Remove(name)
+		return 0, err
+	}
+	return n, nil
+}
+
+// finishJob records job as done with outputs, or failed with err.
+func (s *Server) finishJob(job *transcodeJob, outputs []TranscodeOutput, err error) {
+	now := s.now()
+	job.State, job.Outputs, job.FinishedAt, job.Error = ProcessingDone, outputs, &now, ""
+	if err != nil {
+		job.State, job.Error = ProcessingFailed, err.Error()
+		slog.Warn("transcoding failed", "file", job.ID, "tenant", job.Tenant, "error", err)
+	}
+	if err := s.saveJob(job); err != nil {
+		slog.Warn("cannot record transcode job", "file", job.ID, "error", err)
+	}
+}
+
+// processingHandler serves GET /uploads/{id}/processing: the transcoding
+// job of a completed file the caller may manage.
+func (s *Server) processingHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	info, part, err := s.findUpload(id)
+	if err == nil && (part != nil || !s.canManage(r, info)) {
+		err = fs.ErrNotExist
+	}
+	var job *transcodeJob
+	if err == nil && s.transcoder != nil {
+		job, err = s.loadJob(id)
+	}
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && job == nil) {
+		respondError(w, http.StatusNotFound, CodeNotFound, "no processing job for %q", id)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot look up processing job: %v", err)
+		return
+	}
+	st := job.ProcessingStatus
+	for i := range st.Outputs {
+		st.Outputs[i].URL = mountPrefix(r) + "/files/" + url.PathEscape(id) + "/transcode/" + st.Outputs[i].Preset
+	}
+	respondJSON(w, http.StatusOK, st)
+}
+
+// transcodedHandler serves GET /files/{name}/transcode/{preset}.
+func (s *Server) transcodedHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	fileName, uerr := s.cleanFileName(r.PathValue("name"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	p, ok := s.cfg.preset(r.PathValue("preset"))
+	if !ok {
+		respondError(w, http.StatusNotFound, CodeNotFound, "no preset %q", r.PathValue("preset"))
+		return
+	}
+	lock := s.locks.Get(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	name := transcodedName(fileName, p)
+	n, modTime, err := s.store.Stat(name)
+	if err == nil && s.isExpired(fileName) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "no %s rendition of %q", p.Name, fileName)
+		return
+	}
+	f, err := s.store.Open(name)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open rendition: %v", err)
+		return
+	}
+	defer f.Close()
+	contentType := mime.TypeByExtension("." + p.Ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	setDownloadHeaders(w, r, name, contentType, n, modTime)
+	w.Header().Set("Content-Disposition", "inline")
+	http.ServeContent(w, r, name, modTime, f)
+}
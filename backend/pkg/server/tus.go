@@ -0,0 +1,443 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// tus 1.0.0 resumable uploads under /files/ (https://tus.io/protocols/resumable-upload)
+// ---------------------------------------------------------------------
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,checksum,termination"
+	TusChecksums  = "md5,sha1,sha256"
+
+	// tusChecksumMismatch is the status the checksum extension defines.
+	tusChecksumMismatch = 460
+)
+
+// tusHashes are the Upload-Checksum algorithms accepted on PATCH.
+var tusHashes = map[string]func() hash.Hash{
+	ChecksumMD5:    md5.New,
+	"sha1":         sha1.New,
+	ChecksumSHA256: sha256.New,
+}
+
+// withTus sets the headers every tus response carries, honours
+// X-HTTP-Method-Override and answers OPTIONS with the server's
+// capabilities before CORS handles it.
+func (s *Server) withTus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m := r.Header.Get("X-HTTP-Method-Override"); m != "" && r.Method == http.MethodPost {
+			r.Method = strings.ToUpper(m)
+		}
+		h := w.Header()
+		h.Set("Tus-Resumable", TusVersion)
+		if r.Method == http.MethodOptions {
+			h.Set("Tus-Version", TusVersion)
+			h.Set("Tus-Extension", TusExtensions)
+			h.Set("Tus-Checksum-Algorithm", TusChecksums)
+			if s.cfg.MaxFileSize > 0 {
+				h.Set("Tus-Max-Size", strconv.FormatInt(s.cfg.MaxFileSize, 10))
+			}
+		}
+		next(w, r)
+	}
+}
+
+// mountPrefix is the path an enclosing handler stripped before r got here
+// (http.StripPrefix, or a tenant's /t/{tenant}), so that URLs the server
+// hands out still resolve.
+func mountPrefix(r *http.Request) string {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return ""
+	}
+	if prefix, ok := strings.CutSuffix(u.Path, r.URL.Path); ok {
+		return prefix
+	}
+	return ""
+}
+
+// isTus reports whether r speaks tus, i.e. carries Tus-Resumable.
+func isTus(r *http.Request) bool {
+	return r.Header.Get("Tus-Resumable") != ""
+}
+
+// checkTusVersion rejects requests for a protocol version we don't serve.
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if v := r.Header.Get("Tus-Resumable"); v != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		respondError(w, http.StatusPreconditionFailed, CodeInvalidRequest, "unsupported Tus-Resumable %q, want %s", v, TusVersion)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes Upload-Metadata: comma-separated "key base64"
+// pairs, the value being optional.
+func parseTusMetadata(header string) (map[string]string, bool) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, enc, _ := strings.Cut(pair, " ")
+		val, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, false
+		}
+		meta[key] = string(val)
+	}
+	return meta, true
+}
+
+// ---------------------------------------------------------------------
+// POST /files/ (creation): Upload-Length + Upload-Metadata filename
+// ---------------------------------------------------------------------
+func (s *Server) tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if !s.checkMaintenance(w) || !s.checkFreeSpace(w) {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	lengthStr := r.Header.Get("Upload-Length")
+	if lengthStr == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "Upload-Length required")
+		return
+	}
+	meta, ok := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if !ok {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "malformed Upload-Metadata")
+		return
+	}
+	fileName := meta["filename"]
+	if fileName == "" {
+		fileName = meta["name"] // Uppy sends both
+	}
+	// A tus upload is one "chunk" of the whole file as far as validation goes.
+	fileName, _, length, uerr := s.parseFileParams(fileName, "1", lengthStr)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	retention, uerr := s.requestedRetention(meta["retention"])
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if err := s.ensureDirs(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot create upload directory: %v", err)
+		return
+	}
+	if q := s.checkQuota(r, fileName, length); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+	if avail, err := s.store.Available(); err != nil {
+		logFor(w).Warn("cannot check free space", "error", err)
+	} else if avail >= 0 && avail < length {
+		respondError(w, http.StatusInsufficientStorage, CodeInsufficientStorage,
+			"insufficient storage: need ~%d bytes, %d available", length, avail)
+		return
+	}
+
+	id, err := session.NewID()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot generate uploadID: %v", err)
+		return
+	}
+	// TotalChunks stays 0: that is what marks a session as tus.
+	sess := &session.Session{ID: id, FileName: fileName, FileSize: length, CreatedAt: s.now().UTC(), Retention: retention}
+	if err := s.store.SaveMeta(id, &storage.Meta{UploadID: id, Owner: uploadOwner(r), CreatedAt: sess.CreatedAt, FileName: fileName,
+		FileSize: length, Retention: retention}); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot save upload metadata: %v", err)
+		return
+	}
+	f, err := s.store.OpenPart(id, true)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot create part file: %v", err)
+		return
+	}
+	f.Close()
+	s.sessions.Add(sess)
+	s.recordUploadStart(r, id, fileName, length, 0, sess.CreatedAt)
+	tagUpload(w, id).Info("tus create", "file", fileName, "size", length)
+
+	w.Header().Set("Location", mountPrefix(r)+"/files/"+id)
+	if length == 0 {
+		// Nothing will ever be PATCHed: store the empty file now.
+		if !s.tusFinish(w, r, sess) {
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusSession resolves the upload ID in the path to a tus session.
+func (s *Server) tusSession(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	sess, uerr := s.lookupSession(r.PathValue("name"))
+	if uerr == nil && sess.TotalChunks != 0 {
+		// An /upload/init session; those speak the multipart protocol.
+		uerr = &uploadError{http.StatusNotFound, CodeUnknownUpload, "unknown tus upload " + sess.ID}
+	}
+	if uerr != nil {
+		uerr.respond(w)
+		return nil, false
+	}
+	tagUpload(w, sess.ID)
+	return sess, true
+}
+
+// ---------------------------------------------------------------------
+// /files/{name}: tus HEAD/PATCH/DELETE on an upload ID; plain GET/HEAD
+// still download a completed file
+// ---------------------------------------------------------------------
+func (s *Server) filesHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet, r.Method == http.MethodHead && !isTus(r):
+		s.downloadHandler(w, r)
+	case r.Method == http.MethodHead:
+		s.tusHeadHandler(w, r)
+	case r.Method == http.MethodPatch:
+		s.tusPatchHandler(w, r)
+	case r.Method == http.MethodDelete:
+		s.tusDeleteHandler(w, r)
+	default:
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// tusHeadHandler reports how many bytes of the upload are stored.
+func (s *Server) tusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) || !checkTusVersion(w, r) {
+		return
+	}
+	sess, ok := s.tusSession(w, r)
+	if !ok {
+		return
+	}
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	offset, err := s.store.PartSize(sess.ID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "upload %s has no data: %v", sess.ID, err)
+		return
+	}
+	h := w.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(sess.FileSize, 10))
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatchHandler appends the body at Upload-Offset, which must match what
+// is already stored.
+func (s *Server) tusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/offset+octet-stream" {
+		respondError(w, http.StatusUnsupportedMediaType, CodeInvalidRequest, "Content-Type must be application/offset+octet-stream, got %q", ct)
+		return
+	}
+	// Upload-Offset counts the bytes stored, so the body is taken as is.
+	if enc, uerr := chunkEncoding(r); uerr != nil || enc != "" {
+		respondError(w, http.StatusUnsupportedMediaType, CodeUnsupportedEncoding, "tus PATCH bodies cannot have a Content-Encoding")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidOffset, "Upload-Offset must be a non-negative number")
+		return
+	}
+	var (
+		sum  hash.Hash
+		want []byte
+	)
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		algo, enc, _ := strings.Cut(v, " ")
+		newHash, ok := tusHashes[algo]
+		if !ok {
+			respondError(w, http.StatusBadRequest, CodeUnsupportedChecksum, "unsupported Upload-Checksum algorithm %q", algo)
+			return
+		}
+		if want, err = base64.StdEncoding.DecodeString(enc); err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "malformed Upload-Checksum")
+			return
+		}
+		sum = newHash()
+	}
+	sess, ok := s.tusSession(w, r)
+	if !ok {
+		return
+	}
+
+	lock := s.locks.Get(sess.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.uploadPaused(w, sess.ID) {
+		return
+	}
+
+	current, err := s.store.PartSize(sess.ID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, CodeNotFound, "upload %s has no data: %v", sess.ID, err)
+		return
+	}
+	if offset != current {
+		respondError(w, http.StatusConflict, CodeInvalidOffset, "Upload-Offset %d does not match stored %d bytes", offset, current)
+		return
+	}
+	remaining := sess.FileSize - offset
+	if r.ContentLength > remaining {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeFileTooLarge, "%d bytes would exceed Upload-Length %d", r.ContentLength, sess.FileSize)
+		return
+	}
+	var body io.Reader = r.Body
+	if offset == 0 && s.cfg.filtersTypes() {
+		contentType, rest, err := sniffChunk(sess.FileName, r.Body)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "cannot read body: %v", err)
+			return
+		}
+		if uerr := s.checkType(sess.FileName, contentType); uerr != nil {
+			logFor(w).Warn("content type refused", "file", sess.FileName, "content_type", contentType)
+			uerr.respond(w)
+			return
+		}
+		body = rest
+	}
+
+	f, err := s.store.OpenPart(sess.ID, false)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open part file: %v", err)
+		return
+	}
+	var dst io.Writer = f
+	if sum != nil {
+		dst = io.MultiWriter(f, sum)
+	}
+	write := spanOf(w).child("storage.write_chunk", "storage.offset", offset)
+	written, err := io.Copy(dst, io.LimitReader(s.throttle(r, sess.ID, body), remaining))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	write.set("storage.bytes_written", written).done(err)
+	// Without a checksum whatever arrived is kept, so an interrupted PATCH
+	// resumes from the new offset; with one, unverified bytes are dropped.
+	rollback := func() {
+		if terr := s.store.TruncatePart(sess.ID, offset); terr != nil {
+			logFor(w).Warn("cannot roll back tus upload", "offset", offset, "error", terr)
+		}
+	}
+	if ctxErr := r.Context().Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		if sum != nil {
+			rollback()
+		}
+		respondError(w, http.StatusRequestTimeout, CodeCanceled, "PATCH canceled by client after %d bytes", written)
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		rollback()
+		respondError(w, http.StatusInsufficientStorage, CodeInsufficientStorage, "insufficient storage: disk full")
+		return
+	}
+	if err != nil {
+		if sum != nil {
+			rollback()
+		}
+		respondError(w, http.StatusInternalServerError, CodeServerError, "write error: %v", err)
+		return
+	}
+	if sum != nil && !bytes.Equal(sum.Sum(nil), want) {
+		rollback()
+		respondError(w, tusChecksumMismatch, CodeChunkHashMismatch, "Upload-Checksum mismatch, %d bytes discarded", written)
+		return
+	}
+
+	offset += written
+	s.chunkWritten(written)
+	s.publish(sess.ID, UploadEvent{Type: EventChunk, Bytes: written, Received: offset, FileSize: sess.FileSize})
+	logFor(w).Info("tus PATCH", "bytes", written, "offset", offset, "size", sess.FileSize)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset == sess.FileSize {
+		if !s.tusFinish(w, r, sess) {
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusFinish moves a fully received tus upload into place. The caller holds
+// the upload's lock (or owns the session exclusively).
+func (s *Server) tusFinish(w http.ResponseWriter, r *http.Request, sess *session.Session) bool {
+	s.publish(sess.ID, UploadEvent{Type: EventAssembling})
+	finalPath, err := s.finalizeWithRetry(w, sess.ID, sess.FileName)
+	if err != nil {
+		// The part file is complete; the next PATCH (of zero bytes) retries.
+		respondError(w, http.StatusInternalServerError, CodeFinalizeFailed,
+			"file not stored: cannot move %s into place: %v", sess.FileName, err)
+		return false
+	}
+	s.sessions.Remove(sess.ID)
+	logFor(w).Info("upload finished", "path", finalPath, "tus", true)
+	// Compression, scanning and the webhook.
+	if _, uerr := s.completedResponse(r, sess.ID, sess.FileName, finalPath); uerr != nil {
+		uerr.respond(w)
+		return false
+	}
+	return true
+}
+
+// tusDeleteHandler (termination) discards an unfinished upload.
+func (s *Server) tusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) || !checkTusVersion(w, r) {
+		return
+	}
+	sess, ok := s.tusSession(w, r)
+	if !ok {
+		return
+	}
+	s.dropSession(sess)
+	logFor(w).Info("tus terminate")
+	w.WriteHeader(http.StatusNoContent)
+}
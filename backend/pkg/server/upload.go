@@ -0,0 +1,1014 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// Defaults; see LoadConfig for overriding them.
+const (
+	UploadDir     = "./uploads"
+	Port          = ":8080"
+	AllowedOrigin = "http://localhost:5173"
+)
+
+const (
+	FinalizeAttempts = 3
+	FinalizeBackoff  = 200 * time.Millisecond
+)
+
+// uploadError is a rejection shared by uploadHandler and the preflight
+// endpoint.
+type uploadError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *uploadError) respond(w http.ResponseWriter) {
+	respondError(w, e.status, e.code, e.msg)
+}
+
+// parseFileParams validates the per-file form fields common to every
+// chunk: fileName (returned sanitized), totalChunks and the optional
+// fileSize.
+func (s *Server) parseFileParams(fileName, totalStr, fileSizeStr string) (string, int, int64, *uploadError) {
+	if totalStr == "" || fileName == "" {
+		return "", 0, 0, &uploadError{http.StatusBadRequest, CodeMissingField, "missing index, totalChunks or fileName"}
+	}
+	totalChunks, err := strconv.Atoi(totalStr)
+	if err != nil || totalChunks <= 0 {
+		return "", 0, 0, &uploadError{http.StatusBadRequest, CodeInvalidTotalChunks, "invalid totalChunks"}
+	}
+	fileName, uerr := s.cleanFileName(fileName)
+	if uerr != nil {
+		return "", 0, 0, uerr
+	}
+	var fileSize int64
+	if fileSizeStr != "" {
+		fileSize, err = strconv.ParseInt(fileSizeStr, 10, 64)
+		if err != nil || fileSize < 0 {
+			return "", 0, 0, &uploadError{http.StatusBadRequest, CodeInvalidFileSize, "invalid fileSize"}
+		}
+	}
+	if s.cfg.MaxFileSize > 0 && fileSize > s.cfg.MaxFileSize {
+		return "", 0, 0, &uploadError{http.StatusRequestEntityTooLarge, CodeFileTooLarge,
+			fmt.Sprintf("fileSize %d exceeds limit of %d bytes", fileSize, s.cfg.MaxFileSize)}
+	}
+	return fileName, totalChunks, fileSize, nil
+}
+
+// completedResponse builds the final-chunk response for a finished file:
+// it checks its content type against ALLOWED_TYPES / BLOCKED_TYPES and
+// scans it for viruses (failing the upload when either rejects it),
+// replaces it by an identical stored file when deduplicating, charges it
+// to the uploader's quota, compresses it at rest when enabled, makes its
+// thumbnails, queues it for transcoding, records it in METADATA_DB and
+// its batch, tells event watchers and fires the webhook.
+func (s *Server) completedResponse(r *http.Request, key, fileName, finalPath string) (SuccessResponse, *uploadError) {
+	resp := SuccessResponse{
+		Status:    "ok",
+		Done:      true,
+		Path:      finalPath,
+		VersionID: s.currentVersion(fileName),
+	}
+	size, contentType, err := describeFile(s.store, fileName)
+	if err != nil {
+		logCtx(r.Context()).Warn("cannot describe stored file", "path", finalPath, "error", err)
+	} else {
+		resp.Size = size
+		resp.ContentType = contentType
+		// Chunk 0 was checked as it arrived; a tiny one may not have
+		// shown enough of the file.
+		if uerr := s.checkType(fileName, contentType); uerr != nil {
+			logCtx(r.Context()).Warn("content type refused", "file", fileName, "content_type", contentType)
+			s.refuseCompleted(r, key, fileName, uerr)
+			return resp, uerr
+		}
+	}
+	sp := spanCtx(r.Context())
+	done := sp.child("upload.scan")
+	scan, uerr := s.scanCompleted(r, key, fileName)
+	done.refused(uerr)
+	if uerr != nil {
+		return resp, uerr
+	}
+	resp.Scan = scan
+	if v, ok := s.extracting.LoadAndDelete(key); ok {
+		done = sp.child("upload.extract")
+		resp.Extracted, uerr = s.extractArchive(r, fileName, v.(string))
+		done.set("extract.files", len(resp.Extracted)).refused(uerr)
+		if uerr != nil {
+			logCtx(r.Context()).Warn("archive refused", "file", fileName, "error", uerr.msg)
+			s.refuseCompleted(r, key, fileName, uerr)
+			return resp, uerr
+		}
+	}
+
+	var hash string
+	if s.cfg.Deduplicate && err == nil {
+		var dup *hashEntry
+		done = sp.child("upload.deduplicate")
+		hash, dup = s.deduplicate(r, fileName)
+		done.set("dedup.duplicate", dup != nil).finish()
+		if dup != nil {
+			resp.Path = dup.Path
+			resp.Size = dup.Size
+			resp.DuplicateOf = dup.Name
+			// The new copy is gone; the file it matched must last as long.
+			at, _ := s.expiries.get(fileName)
+			s.setRetention(fileName, 0)
+			s.recordType(fileName, "")
+			s.extendExpiry(dup.Stored, at)
+			resp.ExpiresAt = s.expiresAt(dup.Stored)
+			resp.Thumbnails = s.thumbnails(r, dup.Name)
+			s.recordCompletion(r, key, fileName, dup.Path, dup.Size, hash)
+			s.batchFileDone(key, resp)
+			s.publish(key, UploadEvent{Type: EventComplete, Path: dup.Path, Size: dup.Size, DuplicateOf: dup.Name})
+			s.notifyUploadComplete(key, dup.Stored, dup.Path, dup.Size, dup.Name)
+			s.runHook(r, key, fileName, dup.Stored, dup.Path, dup.Size, contentType)
+			return resp, nil
+		}
+	}
+	if err == nil {
+		s.chargeQuota(r, fileName, size)
+	}
+
+	if s.cfg.CompressAtRest && err == nil && shouldCompress(fileName, contentType) {
+		done = sp.child("upload.compress")
+		compSize, err := compressStored(s.store, key, fileName)
+		done.set("storage.bytes_written", compSize).done(err)
+		if err != nil {
+			logCtx(r.Context()).Warn("cannot compress", "path", finalPath, "error", err)
+		} else {
+			logCtx(r.Context()).Info("compressed", "path", finalPath, "size", size, "compressed_size", compSize)
+			s.recordCompressed(fileName, true)
+			resp.CompressedSize = compSize
+		}
+	}
+	if hash != "" {
+		s.recordHash(r, hash, hashEntry{Name: fileName, Stored: fileName, Path: resp.Path, Size: size})
+	}
+	if err == nil {
+		s.recordType(fileName, contentType)
+		done = nil
+		if len(s.cfg.Thumbnails) > 0 && thumbnailTypes[contentType] {
+			done = sp.child("upload.thumbnails")
+		}
+		resp.Thumbnails = s.makeThumbnails(r, fileName, contentType)
+		done.set("thumbnails.count", len(resp.Thumbnails)).finish()
+		resp.Processing = s.enqueueTranscode(r, fileName, contentType)
+	}
+	resp.ExpiresAt = s.expiresAt(fileName)
+	s.recordCompletion(r, key, fileName, resp.Path, resp.Size, hash)
+	s.batchFileDone(key, resp)
+	s.publish(key, UploadEvent{Type: EventComplete, Path: resp.Path, Size: resp.Size})
+	s.notifyUploadComplete(key, fileName, resp.Path, resp.Size, "")
+	s.runHook(r, key, fileName, fileName, resp.Path, resp.Size, resp.ContentType)
+	return resp, nil
+}
+
+// refuseCompleted removes the completed file fileName, which failed a
+// check, and reports the upload key as rejected. With VERSIONING the
+// version it replaced is put back.
+func (s *Server) refuseCompleted(r *http.Request, key, fileName string, uerr *uploadError) {
+	if err := s.store.Remove(fileName); err != nil {
+		logCtx(r.Context()).Error("cannot remove refused file", "file", fileName, "error", err)
+	}
+	s.setRetention(fileName, 0)
+	if s.cfg.Versioning {
+		s.restoreVersion(fileName)
+	}
+	s.recordRejection(r, key)
+	s.publish(key, UploadEvent{Type: EventAborted, FileName: fileName, Code: uerr.code, Error: uerr.msg})
+}
+
+// contextReader stops reading once ctx is canceled (client disconnect).
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// describeFile returns the size of a completed file and the MIME type
+// sniffed from its first 512 bytes (see detectContentType).
+func describeFile(st storage.Storage, name string) (int64, string, error) {
+	size, _, err := st.Stat(name)
+	if err != nil {
+		return 0, "", err
+	}
+	f, err := st.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, "", err
+	}
+	return size, detectContentType(name, buf[:n]), nil
+}
+
+// ---------------------------------------------------------------------
+// JSON response structs
+// ---------------------------------------------------------------------
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	Done  bool   `json:"done"` // always false: nothing was completed
+
+	// Whether sending the same request again, after any Retry-After, may
+	// succeed. Set from Code; see retriableCodes.
+	Retriable bool `json:"retriable"`
+}
+
+// OutOfOrderResponse is the 409 CHUNK_OUT_OF_ORDER body: ErrorResponse
+// plus the index to send next, so a client can resume from there.
+type OutOfOrderResponse struct {
+	ErrorResponse
+	ExpectedIndex int `json:"expectedIndex"`
+}
+
+// Stable, machine-readable error codes returned in ErrorResponse.Code.
+const (
+	CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	CodeInvalidRequest      = "INVALID_REQUEST"
+	CodeMissingField        = "MISSING_FIELD"
+	CodeInvalidIndex        = "INVALID_INDEX"
+	CodeInvalidOffset       = "INVALID_OFFSET"
+	CodeInvalidTotalChunks  = "INVALID_TOTAL_CHUNKS"
+	CodeInvalidFileName     = "INVALID_FILE_NAME"
+	CodeInvalidFileSize     = "INVALID_FILE_SIZE"
+	CodeFileTooLarge        = "FILE_TOO_LARGE"
+	CodeChunkTooLarge       = "CHUNK_TOO_LARGE"
+	CodeChunkTooSmall       = "CHUNK_TOO_SMALL"
+	CodeQuotaExceeded       = "QUOTA_EXCEEDED"
+	CodeFileSizeMismatch    = "FILE_SIZE_MISMATCH"
+	CodeUnsupportedChecksum = "UNSUPPORTED_CHECKSUM"
+	CodeUnsupportedEncoding = "UNSUPPORTED_ENCODING"
+	CodeInvalidEncoding     = "INVALID_ENCODING"
+	CodeMissingChunk        = "MISSING_CHUNK"
+	CodeChecksumMissing     = "CHECKSUM_MISSING"
+	CodeChunkHashMismatch   = "CHUNK_HASH_MISMATCH"
+	CodeIncompleteWrite     = "INCOMPLETE_WRITE"
+	CodeChunkLengthMismatch = "CHUNK_LENGTH_MISMATCH"
+	CodeChunkConflict       = "CHUNK_CONFLICT"
+	CodeChunkOutOfOrder     = "CHUNK_OUT_OF_ORDER"
+	CodeIncompleteUpload    = "INCOMPLETE_UPLOAD"
+	CodeChunksMissing       = "CHUNKS_MISSING"
+	CodeFileHashMismatch    = "FILE_HASH_MISMATCH"
+	CodeInvalidDelta        = "INVALID_DELTA"
+	CodeBaseChanged         = "BASE_CHANGED"
+	CodeUploadExpired       = "UPLOAD_EXPIRED"
+	CodeUnknownUpload       = "UNKNOWN_UPLOAD"
+	CodeUnknownTenant       = "UNKNOWN_TENANT"
+	CodeWrongTenant         = "WRONG_TENANT"
+	CodeUploadIDRequired    = "UPLOAD_ID_REQUIRED"
+	CodeUploadMismatch      = "UPLOAD_MISMATCH"
+	CodeUploadPaused        = "UPLOAD_PAUSED"
+	CodeInvalidRetention    = "INVALID_RETENTION"
+	CodeInvalidManifest     = "INVALID_MANIFEST"
+	CodeTypeNotAllowed      = "TYPE_NOT_ALLOWED"
+	CodeInsufficientStorage = "INSUFFICIENT_STORAGE"
+	CodeStorageFull         = "STORAGE_FULL"
+	CodeFinalizeFailed      = "FINALIZE_FAILED"
+	CodeFileInfected        = "FILE_INFECTED"
+	CodeScanFailed          = "SCAN_FAILED"
+	CodeInvalidArchive      = "INVALID_ARCHIVE"
+	CodeNotFound            = "NOT_FOUND"
+	CodeCanceled            = "CANCELED"
+	CodeServerBusy          = "SERVER_BUSY"
+	CodeShuttingDown        = "SHUTTING_DOWN"
+	CodeMaintenance         = "MAINTENANCE"
+	CodeRateLimited         = "RATE_LIMITED"
+	CodeTooManyUploads      = "TOO_MANY_UPLOADS"
+	CodeUnauthorized        = "UNAUTHORIZED"
+	CodeSignatureInvalid    = "SIGNATURE_INVALID"
+	CodeSignatureExpired    = "SIGNATURE_EXPIRED"
+	CodeServerError         = "SERVER_ERROR"
+)
+
+// retriableCodes are the codes of failures that are not the request's
+// fault: the chunk was damaged in transit, or the server was busy, going
+// down or failing. Nothing of the request was kept, so it can be resent
+// as is. Any other code needs the client to change something first.
+var retriableCodes = map[string]bool{
+	CodeChunkHashMismatch:   true,
+	CodeInvalidEncoding:     true,
+	CodeChunkLengthMismatch: true,
+	CodeIncompleteWrite:     true,
+	CodeFinalizeFailed:      true,
+	CodeCanceled:            true,
+	CodeServerBusy:          true,
+	CodeShuttingDown:        true,
+	CodeMaintenance:         true,
+	CodeStorageFull:         true,
+	CodeRateLimited:         true,
+	CodeTooManyUploads:      true,
+	CodeServerError:         true,
+}
+
+type SuccessResponse struct {
+	Status   string `json:"status"`
+	Received int64  `json:"received,omitempty"`
+	Done     bool   `json:"done,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Note     string `json:"note,omitempty"`
+
+	// Set when the chunk had already been stored (a client retry); nothing
+	// was written.
+	Duplicate bool `json:"duplicate,omitempty"`
+
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// Set when the file was gzipped at rest; Size is then the original size.
+	CompressedSize int64 `json:"compressedSize,omitempty"`
+
+	// Set when DEDUPLICATE found the same content already stored under this
+	// name; the upload was discarded and Path is that file's.
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+
+	// The virus scan verdict, when scanning is on.
+	Scan *ScanResult `json:"scan,omitempty"`
+
+	// Set when THUMBNAILS is on and the file is an image.
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+
+	// The transcoding job's state (queued, or failed when it could not be
+	// queued) when TRANSCODE_PRESETS is on and the file is a video; follow
+	// it at GET /uploads/{id}/processing.
+	Processing string `json:"processing,omitempty"`
+
+	// The files unpacked from the archive, when the upload asked for
+	// extract=true.
+	Extracted []ExtractedFile `json:"extracted,omitempty"`
+
+	// When the janitor deletes the file, if it has a retention period.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// The stored file's version, with VERSIONING.
+	VersionID string `json:"versionId,omitempty"`
+
+	BytesPerSec float64 `json:"bytesPerSec,omitempty"`
+	ETASeconds  float64 `json:"etaSeconds,omitempty"`
+}
+
+// ---------------------------------------------------------------------
+// JSON helpers
+// ---------------------------------------------------------------------
+func respondJSON(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logFor(w).Error("JSON encode failed", "error", err)
+	}
+}
+
+func respondError(w http.ResponseWriter, code int, errCode, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	respondErrorWith(w, code, errCode, msg, nil)
+}
+
+// respondErrorWith is respondError for a body with fields beyond
+// ErrorResponse: with builds it around the ErrorResponse respondError
+// would send. A nil with sends that ErrorResponse alone.
+func respondErrorWith(w http.ResponseWriter, code int, errCode, msg string, with func(ErrorResponse) any) {
+	logFor(w).Log(context.Background(), logLevelFor(code), "error response", "status", code, "code", errCode, "error", msg)
+	noteErrorCode(w, errCode)
+	var body any = ErrorResponse{Error: msg, Code: errCode, Retriable: retriableCodes[errCode]}
+	if with != nil {
+		body = with(body.(ErrorResponse))
+	}
+	respondJSON(w, code, body)
+}
+
+// respondOutOfOrder refuses an appended chunk that is not the next one
+// with 409 CHUNK_OUT_OF_ORDER, naming the chunk the part file ends at.
+func respondOutOfOrder(w http.ResponseWriter, index, expected int) {
+	msg := fmt.Sprintf("chunk %d out of order: expected chunk %d", index, expected)
+	respondErrorWith(w, http.StatusConflict, CodeChunkOutOfOrder, msg, func(e ErrorResponse) any {
+		return OutOfOrderResponse{ErrorResponse: e, ExpectedIndex: expected}
+	})
+}
+
+func respondSuccess(w http.ResponseWriter, data SuccessResponse) {
+	logFor(w).Info("success", "received", data.Received, "done", data.Done)
+	respondJSON(w, http.StatusOK, data)
+}
+
+// ---------------------------------------------------------------------
+// Main handler
+// ---------------------------------------------------------------------
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	// ----- Rate limit (CORS preflight is answered by withCORS) -----
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		s.headHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+
+	// ----- Concurrency limit (chunk POSTs only: status probes stay free) -----
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// ----- Init upload dir -----
+	if err := s.ensureDirs(); err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot initialise upload directory")
+		return
+	}
+
+	// ----- Read the multipart form (never more than one chunk's worth) -----
+	// A compressed body is held to the limit before and after decompressing.
+	var limit int64
+	if s.cfg.MaxChunkSize > 0 {
+		limit = s.cfg.MaxChunkSize + MultipartOverhead
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	enc, uerr := s.decodeBody(w, r, limit)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	defer s.recordEncoded(w, enc)
+	form, err := s.readChunkForm(r)
+	// A chunk that spilled to the OS temp dir is removed.
+	defer func() {
+		if err := form.Close(); err != nil {
+			logFor(w).Warn("cannot remove chunk temp file", "error", err)
+		}
+	}()
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			respondError(w, http.StatusRequestEntityTooLarge, CodeChunkTooLarge,
+				"request body over %d bytes: chunks are limited to %d", tooBig.Limit, s.cfg.MaxChunkSize)
+			return
+		}
+		if uerr := decodeFailure(err); uerr != nil {
+			uerr.respond(w)
+			return
+		}
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "multipart parse error: %v", err)
+		return
+	}
+	s.receiveChunk(w, r, form.source)
+}
+
+// chunkSource supplies the chunk's bytes once its fields are validated: the
+// "chunk" part of a multipart POST or the body of a raw PUT. When seekable
+// is set (a chunk checksum is to be verified) the chunk must also be an
+// io.ReadSeeker.
+type chunkSource func(r *http.Request, seekable bool) (io.Reader, int64, *uploadError)
+
+// receiveChunk validates a chunk's form fields and stores it; it is shared
+// by the multipart POST /upload and the raw PUT /upload/{uploadID}/chunk/{index}.
+func (s *Server) receiveChunk(w http.ResponseWriter, r *http.Request, source chunkSource) {
+	// ----- Form fields -----
+	indexStr := r.FormValue("index")
+	totalStr := r.FormValue("totalChunks")
+	fileName := r.FormValue("fileName")
+	checksumAlgo := r.FormValue("checksumAlgo")
+
+	if indexStr == "" {
+		respondError(w, http.StatusBadRequest, CodeMissingField, "missing index, totalChunks or fileName")
+		return
+	}
+
+	// ----- Upload session: part file, lock and chunk tracking use key -----
+	key := fileName
+	fileSizeStr := r.FormValue("fileSize")
+	uploadID := r.FormValue("uploadID")
+	if batchID := r.FormValue("batchID"); batchID != "" && uploadID == "" {
+		var uerr *uploadError
+		if uploadID, uerr = s.batchUploadID(batchID, r.FormValue("fileIndex")); uerr != nil {
+			uerr.respond(w)
+			return
+		}
+	}
+	sess, uerr := s.lookupSession(uploadID)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if sess != nil {
+		key = sess.ID
+		if fileName == "" {
+			fileName = sess.FileName
+		}
+		if totalStr == "" {
+			totalStr = strconv.Itoa(sess.TotalChunks)
+		}
+		if fileSizeStr == "" && sess.FileSize > 0 {
+			fileSizeStr = strconv.FormatInt(sess.FileSize, 10)
+		}
+	}
+
+	fileName, totalChunks, fileSize, uerr := s.parseFileParams(fileName, totalStr, fileSizeStr)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if sess == nil {
+		key = fileName
+	} else {
+		tagUpload(w, sess.ID)
+	}
+	if sess != nil && sess.Direct != "" {
+		respondError(w, http.StatusBadRequest, CodeUploadMismatch,
+			"upload %s is direct: PUT its parts to the URLs of GET /upload/%s/parts", sess.ID, sess.ID)
+		return
+	}
+	if uerr := s.checkChunkLayout(totalChunks, fileSize); uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	if sess != nil && (fileName != sess.FileName || totalChunks != sess.TotalChunks) {
+		respondError(w, http.StatusBadRequest, CodeUploadMismatch,
+			"upload %s is for %s in %d chunks", sess.ID, sess.FileName, sess.TotalChunks)
+		return
+	}
+
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 {
+		respondError(w, http.StatusBadRequest, CodeInvalidIndex, "invalid index")
+		return
+	}
+	if index >= totalChunks {
+		respondError(w, http.StatusBadRequest, CodeInvalidIndex, "index >= totalChunks")
+		return
+	}
+	spanOf(w).set("chunk.index", index, "upload.total_chunks", totalChunks, "file.name", fileName)
+	// Chunk 0 without a session starts an upload.
+	if index == 0 && sess == nil && (!s.checkMaintenance(w) || !s.checkFreeSpace(w)) {
+		return
+	}
+	if !isSupportedChecksum(checksumAlgo) {
+		respondError(w, http.StatusBadRequest, CodeUnsupportedChecksum, "unsupported checksumAlgo %q", checksumAlgo)
+		return
+	}
+
+	// ----- Chunk file -----
+	sums := chunkChecksums(r, checksumAlgo)
+	chunkFile, chunkSize, uerr := source(r, len(sums) > 0)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+
+	if s.cfg.MaxChunkSize > 0 && chunkSize > s.cfg.MaxChunkSize {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeChunkTooLarge,
+			"chunk %d is %d bytes, limit is %d", index, chunkSize, s.cfg.MaxChunkSize)
+		return
+	}
+	if s.cfg.MinChunkSize > 0 && chunkSize < s.cfg.MinChunkSize && index < totalChunks-1 {
+		respondError(w, http.StatusBadRequest, CodeChunkTooSmall,
+			"chunk %d is %d bytes, minimum is %d for all but the last chunk", index, chunkSize, s.cfg.MinChunkSize)
+		return
+	}
+	logFor(w).Info("chunk received", "file", fileName, "index", index, "total_chunks", totalChunks, "size", chunkSize)
+
+	// ----- Integrity check (before touching the part file) -----
+	for algo, expected := range sums {
+		if err := verifyChunk(chunkFile.(io.ReadSeeker), algo, expected); err != nil {
+			switch {
+			case errors.Is(err, errChecksumMissing):
+				respondError(w, http.StatusBadRequest, CodeChecksumMissing, "missing checksum for %s", algo)
+			case errors.Is(err, errChecksumMismatch):
+				// Corrupted in transit: nothing was written, resend the chunk.
+				respondError(w, http.StatusUnprocessableEntity, CodeChunkHashMismatch, "chunk %d %s: %v", index, algo, err)
+			default:
+				respondError(w, http.StatusInternalServerError, CodeServerError, "cannot read chunk: %v", err)
+			}
+			return
+		}
+	}
+
+	// ----- Content type (judged by the bytes of chunk 0) -----
+	if index == 0 && s.cfg.filtersTypes() {
+		contentType, rest, err := sniffChunk(fileName, chunkFile)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot read chunk: %v", err)
+			return
+		}
+		if uerr := s.checkType(fileName, contentType); uerr != nil {
+			logFor(w).Warn("content type refused", "file", fileName, "content_type", contentType)
+			uerr.respond(w)
+			return
+		}
+		chunkFile = rest
+	}
+
+	// ----- Per-user quota -----
+	if q := s.checkQuota(r, fileName, max(fileSize, s.received.Bytes(key)+chunkSize)); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+
+	// ----- Separate chunk files (any order, finalized via /upload/complete) -----
+	if r.FormValue("mode") == UploadModeSeparate {
+		s.writeSeparateChunk(w, r, key, fileName, index, totalChunks, fileSize, chunkFile, chunkSize)
+		return
+	}
+
+	// ----- Positional writes (any order, into a sparse part file) -----
+	if r.FormValue("offset") != "" || r.FormValue("chunkSize") != "" {
+		s.writeChunkAt(w, r, sess, key, fileName, index, totalChunks, fileSize, chunkFile, chunkSize)
+		return
+	}
+
+	// ----- Per-file lock -----
+	lock := s.locks.Get(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.sessionAborted(w, sess) || s.uploadPaused(w, key) {
+		return
+	}
+
+	// ----- Stale upload? (older than UploadTTL) -----
+	meta, _ := s.store.LoadMeta(key)
+	if meta != nil && meta.Expired(s.cfg.UploadTTL, s.now()) {
+		logFor(w).Info("upload expired", "file", fileName, "created", meta.CreatedAt)
+		if err := s.store.RemovePart(key); err != nil {
+			logFor(w).Warn("cannot remove stale part", "file", fileName, "error", err)
+		}
+		s.received.Forget(key)
+		meta = nil
+		if index != 0 {
+			respondError(w, http.StatusGone, CodeUploadExpired, "upload expired, restart")
+			return
+		}
+	}
+	if meta != nil {
+		s.restoreReceived(key, meta.Received)
+		if meta.UploadID != "" && index > 0 {
+			tagUpload(w, meta.UploadID)
+		}
+	}
+
+	// ----- Chunk already stored? (a retry after a lost response) -----
+	// Appending it again would duplicate its bytes. Without a session a
+	// new chunk 0 restarts the upload instead.
+	if size, ok := s.received.Size(key, index); ok && (index > 0 || sess != nil) {
+		if size != chunkSize {
+			respondError(w, http.StatusConflict, CodeChunkConflict,
+				"chunk %d already stored with %d bytes, got %d", index, size, chunkSize)
+			return
+		}
+		logFor(w).Info("duplicate chunk ignored", "file", fileName, "index", index)
+		received, _ := s.store.PartSize(key)
+		respondSuccess(w, SuccessResponse{Status: "ok", Received: received, Duplicate: true})
+		return
+	}
+
+	// ----- Is this the next chunk? -----
+	// Chunks are appended as they come, so one that skips ahead would land
+	// at the wrong offset. Checked before writing, so the .part stays
+	// intact for the missing chunks; this also covers a last chunk that
+	// arrives before all the others.
+	if index > 0 {
+		if got := s.received.Count(key); got != index {
+			respondOutOfOrder(w, index, got)
+			return
+		}
+	}
+
+	// ----- Disk space pre-check (first chunk only) -----
+	if index == 0 {
+		needed := chunkSize * int64(totalChunks)
+		if fileSize > 0 {
+			needed = fileSize
+		}
+		if avail, err := s.store.Available(); err != nil {
+			logFor(w).Warn("cannot check free space", "error", err)
+		} else if avail >= 0 && avail < needed {
+			respondError(w, http.StatusInsufficientStorage, CodeInsufficientStorage,
+				"insufficient storage: need ~%d bytes, %d available", needed, avail)
+			return
+		}
+	}
+
+	// ----- Open part file (truncate on first chunk) -----
+	var before int64 // part size to roll back to if the copy is aborted
+	if index > 0 {
+		before, _ = s.store.PartSize(key)
+	}
+	// Cumulative bytes, not totalChunks, bound the upload: a client can't
+	// keep appending past its declared fileSize or MAX_FILE_SIZE.
+	declared := fileSize
+	if index > 0 && meta != nil && meta.FileSize > 0 {
+		declared = meta.FileSize
+	}
+	if limit := s.uploadLimit(declared); limit > 0 && before+chunkSize > limit {
+		respondError(w, http.StatusRequestEntityTooLarge, CodeFileTooLarge,
+			"chunk %d would bring the upload to %d bytes, over its limit of %d", index, before+chunkSize, limit)
+		return
+	}
+	if q := s.checkQuota(r, fileName, max(declared, before+chunkSize)); q != nil {
+		respondQuotaExceeded(w, q)
+		return
+	}
+	f, err := s.store.OpenPart(key, index == 0)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open part file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if index == 0 {
+		meta = &storage.Meta{Owner: uploadOwner(r), CreatedAt: s.now().UTC(), FileName: fileName, FileSize: fileSize, TotalChunks: totalChunks}
+		// Without a session, chunk 0 names the upload for the logs of
+		// every later chunk.
+		if sess != nil {
+			meta.UploadID = sess.ID
+			meta.Retention = sess.Retention
+			meta.Batch, meta.BatchIndex = sess.Batch, sess.BatchIndex
+			meta.Extract, meta.Encryption = sess.Extract, sess.Encryption
+		} else if id, err := session.NewID(); err == nil {
+			meta.UploadID = id
+			tagUpload(w, id)
+		}
+		if err := s.store.SaveMeta(key, meta); err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot save upload metadata: %v", err)
+			return
+		}
+		if sess == nil {
+			s.recordUploadStart(r, key, fileName, fileSize, totalChunks, meta.CreatedAt)
+		}
+		if fileSize > 0 {
+			if err := s.store.ReservePart(key, fileSize); err != nil {
+				logFor(w).Warn("cannot pre-allocate", "file", fileName, "bytes", fileSize, "error", err)
+			}
+		}
+	}
+
+	// ----- **FIXED** copy: destination = file, source = chunkFile -----
+	write := spanOf(w).child("storage.write_chunk", "chunk.index", index, "storage.offset", before)
+	written, err := io.Copy(f, s.throttle(r, key, chunkFile)) // <-- correct signature
+	write.set("storage.bytes_written", written).done(err)
+	if ctxErr := r.Context().Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		// Client went away: don't leave a half-written chunk committed.
+		f.Close()
+		if tErr := s.store.TruncatePart(key, before); tErr != nil {
+			logFor(w).Warn("cannot roll back part file", "file", fileName, "error", tErr)
+		}
+		respondError(w, http.StatusRequestTimeout, CodeCanceled, "chunk %d canceled by client", index)
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		// Drop the truncated part file so a later retry starts clean.
+		f.Close()
+		if rmErr := s.store.RemovePart(key); rmErr != nil {
+			logFor(w).Warn("cannot remove part file", "file", fileName, "error", rmErr)
+		}
+		respondError(w, http.StatusInsufficientStorage, CodeInsufficientStorage, "insufficient storage: disk full, upload discarded")
+		return
+	}
+	if err != nil || written != chunkSize {
+		f.Close()
+		if tErr := s.store.TruncatePart(key, before); tErr != nil {
+			logFor(w).Warn("cannot roll back part file", "file", fileName, "error", tErr)
+		}
+		switch {
+		case errors.Is(err, errChunkLength):
+			respondError(w, http.StatusBadRequest, CodeChunkLengthMismatch, "chunk %d: %v", index, err)
+		case err != nil:
+			respondError(w, http.StatusInternalServerError, CodeServerError, "write error: %v", err)
+		default:
+			respondError(w, http.StatusInternalServerError, CodeIncompleteWrite,
+				"incomplete write: expected %d, wrote %d", chunkSize, written)
+		}
+		return
+	}
+	logFor(w).Info("wrote chunk", "index", index, "bytes", written, "part", key+".part")
+	s.chunkWritten(written)
+	s.recordChunk(r, key, fileName, index, written)
+	if index == 0 {
+		s.received.Forget(key) // chunk 0 starts a fresh upload
+	}
+	s.received.Mark(key, index, written)
+	s.saveReceived(key, meta)
+	s.publishChunk(key, index, written, totalChunks)
+
+	// ----- Final chunk? -----
+	if index == totalChunks-1 {
+		if meta != nil && meta.FileSize > 0 && before+written != meta.FileSize {
+			f.Close()
+			if tErr := s.store.TruncatePart(key, before); tErr != nil {
+				logFor(w).Warn("cannot roll back part file", "file", fileName, "error", tErr)
+			}
+			s.received.Unmark(key, index)
+			s.saveReceived(key, meta)
+			respondError(w, http.StatusBadRequest, CodeFileSizeMismatch,
+				"size mismatch: declared fileSize %d, received %d", meta.FileSize, before+written)
+			return
+		}
+		// Close before finalizing so every byte is flushed to the backend.
+		if err := f.Close(); err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot close part file: %v", err)
+			return
+		}
+		s.publish(key, UploadEvent{Type: EventAssembling})
+		if !s.verifyAssembled(w, key, fileName, fileChecksums(r)) {
+			return
+		}
+		finalPath, err := s.finalizeWithRetry(w, key, fileName)
+		if err != nil {
+			// Roll back the last chunk so resending it retries the finalize;
+			// everything before it stays in the .part file.
+			if tErr := s.store.TruncatePart(key, before); tErr != nil {
+				logFor(w).Warn("cannot roll back part file", "file", fileName, "error", tErr)
+			}
+			s.received.Unmark(key, index)
+			s.saveReceived(key, meta)
+			respondError(w, http.StatusInternalServerError, CodeFinalizeFailed,
+				"file not stored: cannot move %s into place: %v; resend the last chunk to retry", fileName, err)
+			return
+		}
+		s.received.Forget(key)
+		s.sessions.Remove(key)
+		logFor(w).Info("upload finished", "path", finalPath, "total_chunks", totalChunks)
+		resp, uerr := s.completedResponse(r, key, fileName, finalPath)
+		if uerr != nil {
+			uerr.respond(w)
+			return
+		}
+		respondSuccess(w, resp)
+		return
+	}
+
+	// ----- Intermediate progress -----
+	received, err := s.store.PartSize(key)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "stat error after write: %v", err)
+		return
+	}
+	resp := SuccessResponse{
+		Status:   "ok",
+		Received: received,
+	}
+	// Throughput/ETA need at least one chunk after the start time.
+	if meta != nil && index > 0 {
+		// Prefer the client's declared size; otherwise extrapolate from the
+		// average chunk so far.
+		expected := meta.FileSize
+		if expected <= 0 {
+			expected = received / int64(index+1) * int64(totalChunks)
+		}
+		resp.BytesPerSec, resp.ETASeconds = meta.Progress(received, expected, s.now())
+	}
+	respondSuccess(w, resp)
+}
+
+// verifyAssembled checks the finished part file against the whole-file
+// checksums. A mismatch cannot be pinned on one chunk, so the upload is
+// discarded and a 422 sent; it returns false whenever it responded.
+func (s *Server) verifyAssembled(w http.ResponseWriter, key, fileName string, want map[string]string) bool {
+	sp := spanOf(w).child("upload.verify", "file.name", fileName)
+	err := verifyPart(s.store, key, want)
+	sp.done(err)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, errChecksumMismatch) {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot verify %s: %v", fileName, err)
+		return false
+	}
+	if rmErr := s.store.RemovePart(key); rmErr != nil {
+		logFor(w).Warn("cannot remove part file", "file", fileName, "error", rmErr)
+	}
+	s.received.Forget(key)
+	s.publish(key, UploadEvent{Type: EventFailed, FileName: fileName, Code: CodeFileHashMismatch, Error: err.Error()})
+	respondError(w, http.StatusUnprocessableEntity, CodeFileHashMismatch, "file %s: %v; upload discarded, restart it", fileName, err)
+	return false
+}
+
+// finalizeWithRetry retries s.store.Finalize to ride out transient failures
+// (e.g. a briefly unavailable network volume), logging and tracing to the
+// request w answers. The stored file's retention period starts here. With
+// VERSIONING the file it replaces is kept first.
+func (s *Server) finalizeWithRetry(w http.ResponseWriter, key, name string) (string, error) {
+	var (
+		finalPath string
+		err       error
+	)
+	sp := spanOf(w).child("storage.finalize", "file.name", name)
+	meta, _ := s.store.LoadMeta(key) // gone once finalized
+	if s.cfg.Versioning {
+		lock := s.lockVersions(name)
+		defer lock.Unlock()
+		if err := s.keepVersion(name); err != nil {
+			sp.done(err)
+			s.publish(key, UploadEvent{Type: EventFailed, FileName: name, Code: CodeFinalizeFailed, Error: err.Error()})
+			return "", err
+		}
+	}
+	for attempt := 1; attempt <= FinalizeAttempts; attempt++ {
+		if finalPath, err = s.store.Finalize(key, name); err == nil {
+			sp.set("finalize.attempts", attempt).finish()
+			s.finalized(key, name, meta)
+			if s.cfg.Versioning {
+				s.versionStored(name)
+			}
+			return finalPath, nil
+		}
+		logFor(w).Warn("finalize failed", "file", name, "attempt", attempt, "attempts", FinalizeAttempts, "error", err)
+		if attempt < FinalizeAttempts {
+			time.Sleep(FinalizeBackoff * time.Duration(attempt))
+		}
+	}
+	sp.set("finalize.attempts", FinalizeAttempts).done(err)
+	s.publish(key, UploadEvent{Type: EventFailed, FileName: name, Code: CodeFinalizeFailed, Error: err.Error()})
+	return finalPath, err
+}
+
+// finalized counts the completed upload key described by meta (nil when
+// unknown) and starts the retention period of its file name and records
+// its encryption manifest. An archive to extract is noted for
+// completedResponse.
+func (s *Server) finalized(key, name string, meta *storage.Meta) {
+	var (
+		took     time.Duration
+		manifest *storage.EncryptionManifest
+	)
+	retention := cmp.Or(s.cfg.Retention, s.cfg.MaxRetention)
+	if meta != nil {
+		took = s.now().Sub(meta.CreatedAt)
+		retention = cmp.Or(meta.Retention, retention)
+		if meta.Extract != "" {
+			s.extracting.Store(key, meta.Extract)
+		}
+		manifest = meta.Encryption
+	}
+	s.metrics.uploadCompleted(took)
+	s.setRetention(name, retention)
+	s.recordManifest(name, manifest)
+	s.recordCompressed(name, false)
+}
+
+// ---------------------------------------------------------------------
+// HEAD /upload?fileName=foo&hash=... (skip already-complete uploads)
+// ---------------------------------------------------------------------
+func (s *Server) headHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("fileName")
+	wantHash := r.URL.Query().Get("hash")
+	fileName, uerr := s.cleanFileName(fileName)
+	if uerr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	size, _, err := s.statStored(fileName)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hash, err := s.hashStored(fileName)
+	if err != nil {
+		logFor(w).Error("cannot hash", "file", fileName, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if wantHash != "" && !strings.EqualFold(hash, wantHash) {
+		logFor(w).Info("HEAD hash mismatch", "file", fileName)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logFor(w).Info("HEAD complete", "file", fileName, "size", size)
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,67 @@
+package server
+
+import "net/http"
+
+// ---------------------------------------------------------------------
+// GET /upload/config: the chunk sizes and limits clients should use
+// ---------------------------------------------------------------------
+
+// DefaultChunkSize is the chunk size suggested when CHUNK_SIZE is unset.
+const DefaultChunkSize = 5 << 20
+
+// UploadConfig is returned by GET /upload/config. Zero limits are off.
+type UploadConfig struct {
+	ChunkSize    int64 `json:"chunkSize"`    // suggested size of every chunk but the last
+	MinChunkSize int64 `json:"minChunkSize"` // smaller non-final chunks get CHUNK_TOO_SMALL
+	MaxChunkSize int64 `json:"maxChunkSize"` // larger chunks get CHUNK_TOO_LARGE
+	MaxParallel  int   `json:"maxParallel"`  // requests in flight per client; more get TOO_MANY_UPLOADS
+	MaxFileSize  int64 `json:"maxFileSize"`  // larger uploads get FILE_TOO_LARGE
+
+	// Encodings are the Content-Encodings chunk bodies may be sent with.
+	Encodings []string `json:"encodings"`
+
+	// ChunkDedup is set when the /chunks endpoints of CHUNK_DEDUP are on,
+	// DeltaUpload when the signature and patch ones of DELTA_UPLOAD are.
+	ChunkDedup  bool `json:"chunkDedup,omitempty"`
+	DeltaUpload bool `json:"deltaUpload,omitempty"`
+
+	// Versioning is set when uploading a stored name keeps the file it
+	// replaces (VERSIONING).
+	Versioning bool `json:"versioning,omitempty"`
+}
+
+// chunkSize is CHUNK_SIZE, or DefaultChunkSize kept within MIN_CHUNK_SIZE
+// and MAX_CHUNK_SIZE.
+func (c Config) chunkSize() int64 {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	size := max(int64(DefaultChunkSize), c.MinChunkSize)
+	if c.MaxChunkSize > 0 {
+		size = min(size, c.MaxChunkSize)
+	}
+	return size
+}
+
+// uploadConfigHandler reports the limits that uploadHandler enforces, so
+// clients need not hard-code a chunk size.
+func (s *Server) uploadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	respondJSON(w, http.StatusOK, UploadConfig{
+		ChunkSize:    s.cfg.chunkSize(),
+		MinChunkSize: s.cfg.MinChunkSize,
+		MaxChunkSize: s.cfg.MaxChunkSize,
+		MaxParallel:  s.cfg.MaxUploadsPerClient,
+		MaxFileSize:  s.cfg.MaxFileSize,
+		Encodings:    chunkEncodings,
+		ChunkDedup:   s.cfg.ChunkDedup,
+		DeltaUpload:  s.cfg.DeltaUpload,
+		Versioning:   s.cfg.Versioning,
+	})
+}
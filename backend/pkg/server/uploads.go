@@ -0,0 +1,310 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// GET /uploads, GET /uploads/{id}, DELETE /uploads/{id}: upload history
+// and cleanup for admin UIs and client apps
+// ---------------------------------------------------------------------
+
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// UploadInfo describes one unfinished upload or completed file. An
+// unfinished upload's ID is its uploadID (or file name without a session);
+// a completed file's ID is its name in storage.
+type UploadInfo struct {
+	ID          string      `json:"id"`
+	FileName    string      `json:"fileName"`
+	Status      string      `json:"status"` // in_progress or complete
+	Owner       string      `json:"owner,omitempty"`
+	Size        int64       `json:"size"`                  // bytes received so far, or of the stored file
+	FileSize    int64       `json:"fileSize,omitempty"`    // declared by the client
+	TotalChunks int         `json:"totalChunks,omitempty"` // 0 for tus
+	CreatedAt   *time.Time  `json:"createdAt,omitempty"`   // unknown for completed files
+	UpdatedAt   time.Time   `json:"updatedAt"`
+	ContentType string      `json:"contentType,omitempty"` // sniffed, for completed files
+	Thumbnails  []Thumbnail `json:"thumbnails,omitempty"`  // of completed images, with THUMBNAILS
+	Hook        *HookResult `json:"hook,omitempty"`        // of completed files, with POST_UPLOAD_COMMAND
+
+	// When it is deleted automatically: an unfinished upload after
+	// UPLOAD_TTL, a completed file after its retention period.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// UploadListResponse is returned by GET /uploads.
+type UploadListResponse struct {
+	Uploads []UploadInfo `json:"uploads"`
+	Total   int          `json:"total"` // matching uploads, across all pages
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+}
+
+// listUploads describes every unfinished upload and completed file,
+// most recently updated first.
+func (s *Server) listUploads() ([]UploadInfo, error) {
+	parts, err := s.store.ListParts()
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]UploadInfo, 0, len(parts)+len(files))
+	for _, p := range parts {
+		if s.isBatch(p.Key) {
+			continue // its files are listed
+		}
+		uploads = append(uploads, s.partInfo(p))
+	}
+	for _, f := range files {
+		if s.isExpired(f.Name) || isThumbnail(f.Name) || isTranscoded(f.Name) || isVersion(f.Name) {
+			continue // the janitor has not got to it yet, or not an upload
+		}
+		uploads = append(uploads, s.fileInfo(f.Name, f.Size, f.ModTime))
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		a, b := uploads[i], uploads[j]
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.After(b.UpdatedAt)
+		}
+		return a.ID < b.ID
+	})
+	return uploads, nil
+}
+
+// partInfo describes an unfinished upload from its metadata.
+func (s *Server) partInfo(p storage.PartInfo) UploadInfo {
+	info := UploadInfo{ID: p.Key, FileName: p.Key, Status: UploadInProgress, UpdatedAt: p.ModTime}
+	meta, err := s.store.LoadMeta(p.Key)
+	if err != nil {
+		meta = &storage.Meta{}
+	} else {
+		info.FileName = meta.FileName
+		info.Owner = meta.Owner
+		info.FileSize = meta.FileSize
+		info.TotalChunks = meta.TotalChunks
+		info.CreatedAt = &meta.CreatedAt
+		if s.cfg.UploadTTL > 0 {
+			expires := meta.CreatedAt.Add(s.cfg.UploadTTL)
+			info.ExpiresAt = &expires
+		}
+	}
+	if info.Size = s.received.Bytes(p.Key); info.Size == 0 {
+		for _, n := range meta.Received {
+			info.Size += n
+		}
+	}
+	if info.Size == 0 {
+		info.Size, _ = s.store.PartSize(p.Key) // tus, or not yet tracked
+	}
+	return info
+}
+
+// addThumbnails lists the thumbnails of u, if it is a completed file.
+func (s *Server) addThumbnails(r *http.Request, u *UploadInfo) {
+	if u.Status == UploadComplete && len(s.cfg.Thumbnails) > 0 {
+		u.Thumbnails = s.thumbnails(r, u.ID)
+	}
+}
+
+// fileInfo describes a completed file; size is as stored, and replaced by
+// the original size when the file is compressed at rest.
+func (s *Server) fileInfo(name string, size int64, modTime time.Time) UploadInfo {
+	if s.isCompressed(name) {
+		size, _, _ = s.statStored(name)
+	}
+	owner, _ := s.quotas.owner(name)
+	return UploadInfo{ID: name, FileName: name, Status: UploadComplete, Owner: owner, Size: size,
+		ContentType: s.storedType(name), UpdatedAt: modTime, ExpiresAt: s.expiresAt(name), Hook: s.storedHook(name)}
+}
+
+// canManage reports whether the caller may see and delete u: everyone
+// when the route is not authenticated, ADMIN_USERS always, other users
+// only their own uploads.
+func (s *Server) canManage(r *http.Request, u UploadInfo) bool {
+	p, ok := principalFrom(r.Context())
+	return !ok || s.isAdmin(p) || u.Owner == p.Subject
+}
+
+func (s *Server) isAdmin(p Principal) bool {
+	return slices.Contains(s.cfg.AdminUsers, p.Subject)
+}
+
+// uploadsHandler lists uploads, filtered by ?status= and ?owner= and
+// paginated by ?offset= and ?limit=.
+func (s *Server) uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	status, owner := q.Get("status"), q.Get("owner")
+	if status != "" && status != UploadInProgress && status != UploadComplete {
+		respondError(w, http.StatusBadRequest, CodeInvalidRequest, "status must be %s or %s", UploadInProgress, UploadComplete)
+		return
+	}
+	offset, limit := 0, DefaultListLimit
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "invalid offset %q", v)
+			return
+		}
+		offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxListLimit {
+			respondError(w, http.StatusBadRequest, CodeInvalidRequest, "limit must be 1 to %d", MaxListLimit)
+			return
+		}
+		limit = n
+	}
+
+	all, err := s.listUploads()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot list uploads: %v", err)
+		return
+	}
+	matched := []UploadInfo{}
+	for _, u := range all {
+		if (status == "" || u.Status == status) && (owner == "" || u.Owner == owner) && s.canManage(r, u) {
+			matched = append(matched, u)
+		}
+	}
+	resp := UploadListResponse{Uploads: []UploadInfo{}, Total: len(matched), Offset: offset, Limit: limit}
+	if offset < len(matched) {
+		resp.Uploads = matched[offset:min(offset+limit, len(matched))]
+	}
+	for i := range resp.Uploads {
+		s.addThumbnails(r, &resp.Uploads[i])
+	}
+	logFor(w).Info("list uploads", "status", status, "owner", owner, "total", resp.Total, "returned", len(resp.Uploads))
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// findUpload returns the unfinished upload with id, else the completed
+// file of that name.
+func (s *Server) findUpload(id string) (info UploadInfo, part *storage.PartInfo, err error) {
+	parts, err := s.store.ListParts()
+	if err != nil {
+		return UploadInfo{}, nil, err
+	}
+	for i := range parts {
+		if parts[i].Key == id {
+			return s.partInfo(parts[i]), &parts[i], nil
+		}
+	}
+	if clean, err := sanitizeFileName(id, FileNamePolicyUnicode); err != nil || clean != id {
+		return UploadInfo{}, nil, fs.ErrNotExist // not a name a file could be stored under
+	}
+	if s.isExpired(id) {
+		return UploadInfo{}, nil, fs.ErrNotExist
+	}
+	size, modTime, err := s.store.Stat(id)
+	if err != nil {
+		return UploadInfo{}, nil, err
+	}
+	return s.fileInfo(id, size, modTime), nil, nil
+}
+
+// manageUploadHandler shows (GET) or deletes (DELETE) one upload.
+// Deleting an unfinished upload discards its part and chunk files and its
+// session; deleting a completed file also drops it from the quota and
+// hash tables.
+func (s *Server) manageUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only GET and DELETE allowed")
+		return
+	}
+	id := r.PathValue("id")
+	info, part, err := s.findUpload(id)
+	if err == nil && !s.canManage(r, info) {
+		err = fs.ErrNotExist // don't reveal other users' uploads
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusNotFound, CodeNotFound, "upload %q not found", id)
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot look up upload: %v", err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.addThumbnails(r, &info)
+		respondJSON(w, http.StatusOK, info)
+		return
+	}
+
+	if part != nil {
+		err = s.discardPart(*part)
+	} else {
+		err = s.removeCompleted(id)
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot delete %s: %v", id, err)
+		return
+	}
+	logFor(w).Info("upload deleted", "id", id, "status", info.Status, "size", info.Size)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeCompleted deletes a stored file, its thumbnails, transcoded
+// copies and kept versions and its quota, hash and expiry records, and
+// tells the webhooks.
+func (s *Server) removeCompleted(name string) error {
+	lock := s.locks.Get(name)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := s.store.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.removeThumbnails(name)
+	s.removeTranscoded(name)
+	if err := s.removeVersions(name); err != nil {
+		return err
+	}
+	if err := s.quotas.release(name); err != nil {
+		return err
+	}
+	if err := s.hashes.dropName(name); err != nil {
+		return err
+	}
+	if err := s.expiries.set(name, time.Time{}); err != nil {
+		return err
+	}
+	if err := s.types.set(name, ""); err != nil {
+		return err
+	}
+	if err := s.compressed.set(name, false); err != nil {
+		return err
+	}
+	if err := s.manifests.set(name, nil); err != nil {
+		return err
+	}
+	if err := s.hooks.set(name, nil); err != nil {
+		return err
+	}
+	s.notify(WebhookPayload{Event: WebhookDeleted, FileName: name})
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// POST /upload/verify (on-demand integrity / completeness audit)
+// ---------------------------------------------------------------------
+const (
+	VerifyComplete   = "complete"
+	VerifyInProgress = "in_progress"
+)
+
+type VerifyResponse struct {
+	FileName string     `json:"fileName"`
+	Status   string     `json:"status"`
+	Size     int64      `json:"size,omitempty"`
+	ModTime  *time.Time `json:"modTime,omitempty"`
+	Hash     string     `json:"hash,omitempty"`
+	Match    *bool      `json:"match,omitempty"` // only when a hash was supplied
+
+	Received      int64 `json:"received,omitempty"`
+	TotalChunks   int   `json:"totalChunks,omitempty"`
+	MissingChunks []int `json:"missingChunks,omitempty"`
+}
+
+func (s *Server) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		respondError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "only POST allowed")
+		return
+	}
+	fileName := r.FormValue("fileName")
+	wantHash := r.FormValue("hash")
+	fileName, uerr := s.cleanFileName(fileName)
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	// totalChunks is optional; it lets separate-mode uploads be audited.
+	totalChunks, _ := strconv.Atoi(r.FormValue("totalChunks"))
+
+	lock := s.locks.Get(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	resp := VerifyResponse{FileName: fileName}
+
+	// ----- Completed file: recompute the hash -----
+	if size, modTime, err := s.statStored(fileName); err == nil {
+		hash, err := s.hashStored(fileName)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot hash %s: %v", fileName, err)
+			return
+		}
+		resp.Status = VerifyComplete
+		resp.Size = size
+		resp.ModTime = &modTime
+		resp.Hash = hash
+		if wantHash != "" {
+			match := strings.EqualFold(hash, wantHash)
+			resp.Match = &match
+		}
+		logFor(w).Info("verify", "file", fileName, "size", size, "match", resp.Match != nil && *resp.Match)
+		respondJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	// ----- In-progress upload: report what is still missing -----
+	if meta, err := s.store.LoadMeta(fileName); err == nil {
+		if totalChunks == 0 {
+			totalChunks = meta.TotalChunks
+		}
+		s.restoreReceived(fileName, meta.Received)
+	}
+	if received, err := s.store.PartSize(fileName); err == nil {
+		resp.Status = VerifyInProgress
+		resp.Received = received
+		resp.TotalChunks = totalChunks
+		if totalChunks > 0 {
+			resp.MissingChunks, _ = s.received.Missing(fileName, totalChunks)
+		}
+		respondJSON(w, http.StatusOK, resp)
+		return
+	}
+	if totalChunks > 0 {
+		if missing := s.store.MissingChunks(fileName, totalChunks); len(missing) < totalChunks {
+			resp.Status = VerifyInProgress
+			resp.TotalChunks = totalChunks
+			resp.MissingChunks = missing
+			respondJSON(w, http.StatusOK, resp)
+			return
+		}
+	}
+
+	respondError(w, http.StatusNotFound, CodeNotFound, "file %q not found", fileName)
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// ---------------------------------------------------------------------
+// File versioning (VERSIONING=true): uploading a stored name again keeps
+// the file it replaces. GET /files/{name}/versions lists the versions
+// and GET /files/{name}?version=<id> serves one.
+// ---------------------------------------------------------------------
+
+const (
+	// VersionTable is the version history's file inside UploadDir.
+	VersionTable = ".versions.json"
+
+	DefaultMaxVersions = 10
+
+	// VersionIDHeader names the version a download or upload response is
+	// about.
+	VersionIDHeader = "X-Version-Id"
+
+	versionIDBytes = 8
+)
+
+// VersionRule is one VERSION_POLICY entry: how many previous versions of
+// the files whose name matches Pattern are kept, and for how long.
+type VersionRule struct {
+	Pattern string        // path.Match pattern, e.g. *.log
+	Keep    int           // previous versions kept, 0 = any number
+	MaxAge  time.Duration // drop a version this long after it was replaced, 0 = never
+}
+
+// parseVersionPolicy reads VERSION_POLICY: comma-separated
+// pattern=keep or pattern=keep/age rules, e.g. *.log=3,*.db=30/90d.
+func parseVersionPolicy(v string) ([]VersionRule, error) {
+	var rules []VersionRule
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		i := strings.LastIndex(f, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid VERSION_POLICY rule %q: want pattern=keep or pattern=keep/age", f)
+		}
+		rule := VersionRule{Pattern: f[:i]}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid VERSION_POLICY pattern %q: %v", rule.Pattern, err)
+		}
+		keep, age, hasAge := strings.Cut(f[i+1:], "/")
+		var err error
+		if rule.Keep, err = strconv.Atoi(keep); err != nil || rule.Keep < 0 {
+			return nil, fmt.Errorf("invalid VERSION_POLICY rule %q: keep must be 0 or more versions", f)
+		}
+		if hasAge {
+			if rule.MaxAge, err = parseRetention(age); err != nil || rule.MaxAge < 0 {
+				return nil, fmt.Errorf("invalid VERSION_POLICY rule %q: age must be a duration such as 90d", f)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// versionPolicy returns how many previous versions of name to keep and
+// for how long: the first VERSION_POLICY rule that matches, else
+// MAX_VERSIONS and VERSION_RETENTION.
+func (s *Server) versionPolicy(name string) (keep int, maxAge time.Duration) {
+	for _, r := range s.cfg.VersionPolicy {
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			return r.Keep, r.MaxAge
+		}
+	}
+	return s.cfg.MaxVersions, s.cfg.VersionTTL
+}
+
+// FileVersion describes one version of a stored file.
+type FileVersion struct {
+	VersionID   string     `json:"versionId"` // "" for a file stored before VERSIONING
+	Size        int64      `json:"size"`
+	ContentType string     `json:"contentType,omitempty"`
+	StoredAt    time.Time  `json:"storedAt"`
+	ReplacedAt  *time.Time `json:"replacedAt,omitempty"` // unset for the current version
+	Current     bool       `json:"current"`
+}
+
+// VersionList is the GET /files/{name}/versions body, newest first.
+type VersionList struct {
+	FileName string        `json:"fileName"`
+	Versions []FileVersion `json:"versions"`
+}
+
+// versionHistory is what the version table keeps of one file name.
+type versionHistory struct {
+	Current  string          `json:"current,omitempty"` // the stored file's version ID
+	StoredAt time.Time       `json:"storedAt"`
+	Previous []storedVersion `json:"previous,omitempty"` // oldest first
+}
+
+// storedVersion is a replaced file, kept under versionName.
+type storedVersion struct {
+	ID          string                      `json:"id"`
+	Size        int64                       `json:"size"` // before any compression at rest
+	ContentType string                      `json:"contentType,omitempty"`
+	StoredAt    time.Time                   `json:"storedAt"`
+	ReplacedAt  time.Time                   `json:"replacedAt"`
+	Gzip        bool                        `json:"gzip,omitempty"` // kept as compressed at rest
+	Encryption  *storage.EncryptionManifest `json:"encryption,omitempty"`
+}
+
+// versionName is where version id of name is stored, next to it. Such
+// names are reserved: uploads cannot use them.
+func versionName(name, id string) string {
+	return name + ".v-" + id
+}
+
+var versionNameRe = regexp.MustCompile(`\.v-[0-9a-f]{16}$`)
+
+// isVersion reports whether name is a kept version of another file.
+func isVersion(name string) bool {
+	return versionNameRe.MatchString(name)
+}
+
+func newVersionID() string {
+	b := make([]byte, versionIDBytes)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// versionTable records the version history of each file name.
+type versionTable struct {
+	*storage.Table[versionHistory]
+}
+
+func newVersionTable(dir string, mode os.FileMode) *versionTable {
+	return &versionTable{storage.NewTable[versionHistory]("version table", filepath.Join(dir, VersionTable), mode)}
+}
+
+// set records the history of name; nil forgets it.
+func (t *versionTable) set(name string, h *versionHistory) error {
+	if h == nil {
+		return t.Delete(name)
+	}
+	return t.Set(name, *h)
+}
+
+// get returns a copy of the history of name, empty when none is kept.
+func (t *versionTable) get(name string) (versionHistory, error) {
+	h, _, err := t.Get(name)
+	h.Previous = slices.Clone(h.Previous)
+	return h, err
+}
+
+// names lists the file names with a history.
+func (t *versionTable) names() ([]string, error) {
+	var names []string
+	err := t.View(func(files map[string]versionHistory) {
+		for name := range files {
+			names = append(names, name)
+		}
+	})
+	return names, err
+}
+
+// lockVersions serializes changes to the versions of name. It is taken
+// after the file's own lock, never before it.
+func (s *Server) lockVersions(name string) sync.Locker {
+	lock := s.locks.Get(VersionTable + "/" + name)
+	lock.Lock()
+	return lock
+}
+
+// storedObject returns the stored size and modification time of the
+// completed file name; ok is false when there is none, or only an
+// expired one.
+func (s *Server) storedObject(name string) (size int64, modTime time.Time, ok bool) {
+	size, modTime, err := s.store.Stat(name)
+	if err != nil || s.isExpired(name) {
+		return 0, time.Time{}, false
+	}
+	return size, modTime, true
+}
+
+// keepVersion copies the stored file name, about to be replaced, to a
+// version of its own. The caller holds lockVersions(name).
+func (s *Server) keepVersion(name string) error {
+	size, modTime, ok := s.storedObject(name)
+	if !ok {
+		return nil
+	}
+	h, err := s.versions.get(name)
+	if err != nil {
+		return err
+	}
+	v := storedVersion{
+		ID:          h.Current,
+		Size:        size,
+		ContentType: s.storedType(name),
+		StoredAt:    h.StoredAt,
+		ReplacedAt:  s.now().UTC(),
+		Gzip:        s.isCompressed(name),
+	}
+	if v.ID == "" {
+		v.ID, v.StoredAt = newVersionID(), modTime.UTC()
+	}
+	if v.Encryption, err = s.manifests.get(name); err != nil {
+		return err
+	}
+	if v.Size, err = copyStored(s.store, name, versionName(name, v.ID), v.Gzip); err != nil {
+		return fmt.Errorf("cannot keep the replaced version: %w", err)
+	}
+	h.Current, h.Previous = "", append(h.Previous, v)
+	if err := s.versions.set(name, &h); err != nil {
+		s.store.Remove(versionName(name, v.ID))
+		return err
+	}
+	return nil
+}
+
+// copyStored copies the completed file from to the completed file to and
+// returns its size, decompressed when gz.
+func copyStored(st storage.Storage, from, to string, gz bool) (int64, error) {
+	in, err := st.Open(from)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := st.Create(to)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && gz {
+		n, err = gzipSize(in)
+	}
+	if err != nil {
+		st.Remove(to)
+		return 0, err
+	}
+	return n, nil
+}
+
+// gzipSize returns the original size of the gzip stream in f, read from
+// its header or, for files compressed before it was recorded, by
+// decompressing it.
+func gzipSize(f io.ReadSeeker) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	if size, ok := gzipOriginalSize(zr.Header.Extra); ok {
+		return size, nil
+	}
+	return io.Copy(io.Discard, zr)
+}
+
+// versionStored records the file just finalized as the current version
+// of name and drops the previous versions its policy no longer keeps.
+// The caller holds lockVersions(name).
+func (s *Server) versionStored(name string) {
+	h, err := s.versions.get(name)
+	if err == nil {
+		h.Current, h.StoredAt = newVersionID(), s.now().UTC()
+		s.pruneVersions(name, &h)
+		err = s.versions.set(name, &h)
+	}
+	if err != nil {
+		slog.Warn("cannot record file version", "file", name, "error", err)
+	}
+}
+
+// pruneVersions removes from h, and from storage, the previous versions
+// of name past its policy, and returns how many went.
+func (s *Server) pruneVersions(name string, h *versionHistory) int {
+	keep, maxAge := s.versionPolicy(name)
+	cutoff := s.now().Add(-maxAge)
+	n := 0
+	for _, v := range h.Previous {
+		if (keep > 0 && len(h.Previous)-n > keep) || (maxAge > 0 && v.ReplacedAt.Before(cutoff)) {
+			if err := s.store.Remove(versionName(name, v.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Warn("cannot remove old version", "file", name, "version", v.ID, "error", err)
+				break
+			}
+			n++
+			continue
+		}
+		break
+	}
+	h.Previous = h.Previous[n:]
+	return n
+}
+
+// sweepVersions drops the previous versions of every file that its
+// policy no longer keeps, e.g. once they are older than
+// VERSION_RETENTION.
+func (s *Server) sweepVersions() {
+	names, err := s.versions.names()
+	if err != nil {
+		slog.Warn("version sweep: cannot read the version table", "error", err)
+		return
+	}
+	removed := 0
+	for _, name := range names {
+		lock := s.lockVersions(name)
+		h, err := s.versions.get(name)
+		if err == nil {
+			if n := s.pruneVersions(name, &h); n > 0 {
+				removed += n
+				err = s.versions.set(name, &h)
+			}
+		}
+		lock.Unlock()
+		if err != nil {
+			slog.Warn("version sweep", "file", name, "error", err)
+		}
+	}
+	if removed > 0 {
+		slog.Info("version sweep", "removed", removed)
+	}
+}
+
+// removeVersions deletes every kept version of name along with its
+// history, when the file itself is deleted.
+func (s *Server) removeVersions(name string) error {
+	lock := s.lockVersions(name)
+	defer lock.Unlock()
+	h, err := s.versions.get(name)
+	if err != nil {
+		return err
+	}
+	for _, v := range h.Previous {
+		if err := s.store.Remove(versionName(name, v.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return s.versions.set(name, nil)
+}
+
+// restoreVersion puts the newest previous version of name back in place
+// of a completed file that was refused after it replaced it.
+func (s *Server) restoreVersion(name string) {
+	lock := s.lockVersions(name)
+	defer lock.Unlock()
+	h, err := s.versions.get(name)
+	if err != nil || len(h.Previous) == 0 {
+		return
+	}
+	v := h.Previous[len(h.Previous)-1]
+	if _, err := copyStored(s.store, versionName(name, v.ID), name, false); err != nil {
+		slog.Warn("cannot restore the previous version", "file", name, "version", v.ID, "error", err)
+		return
+	}
+	s.store.Remove(versionName(name, v.ID))
+	h.Current, h.StoredAt, h.Previous = v.ID, v.StoredAt, h.Previous[:len(h.Previous)-1]
+	if err := s.versions.set(name, &h); err != nil {
+		slog.Warn("cannot record the restored version", "file", name, "error", err)
+	}
+	s.recordType(name, v.ContentType)
+	s.recordCompressed(name, v.Gzip)
+	s.recordManifest(name, v.Encryption)
+	slog.Info("previous version restored", "file", name, "version", v.ID)
+}
+
+// currentVersion returns the version ID of the stored file name, "" when
+// it has none.
+func (s *Server) currentVersion(name string) string {
+	if !s.cfg.Versioning {
+		return ""
+	}
+	h, err := s.versions.get(name)
+	if err != nil {
+		slog.Warn("cannot read version table", "file", name, "error", err)
+	}
+	return h.Current
+}
+
+// setVersionHeader names the version of the stored file name served.
+func (s *Server) setVersionHeader(w http.ResponseWriter, name string) {
+	if id := s.currentVersion(name); id != "" {
+		w.Header().Set(VersionIDHeader, id)
+	}
+}
+
+// versionsHandler lists the versions of a stored file, newest first.
+func (s *Server) versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.checkRateLimit(w, r) {
+		return
+	}
+	fileName, uerr := s.cleanFileName(r.PathValue("name"))
+	if uerr != nil {
+		uerr.respond(w)
+		return
+	}
+	lock := s.locks.Get(fileName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	h, err := s.versions.get(fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot read versions of %s: %v", fileName, err)
+		return
+	}
+	list := VersionList{FileName: fileName, Versions: make([]FileVersion, 0, len(h.Previous)+1)}
+	if _, modTime, ok := s.storedObject(fileName); ok {
+		cur := FileVersion{VersionID: h.Current, ContentType: s.storedType(fileName), StoredAt: h.StoredAt, Current: true}
+		if h.Current == "" {
+			cur.StoredAt = modTime.UTC()
+		}
+		cur.Size, _, _ = s.statStored(fileName)
+		list.Versions = append(list.Versions, cur)
+	}
+	for _, v := range slices.Backward(h.Previous) {
+		list.Versions = append(list.Versions, FileVersion{VersionID: v.ID, Size: v.Size, ContentType: v.ContentType,
+			StoredAt: v.StoredAt, ReplacedAt: &v.ReplacedAt})
+	}
+	if len(list.Versions) == 0 {
+		respondError(w, http.StatusNotFound, CodeNotFound, "file %q not found", fileName)
+		return
+	}
+	respondJSON(w, http.StatusOK, list)
+}
+
+// serveVersion serves version id of fileName for GET
+// /files/{name}?version=<id> and reports whether it did; the current
+// version is left to the caller. The caller holds fileName's lock.
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request, fileName, id string) bool {
+	h, err := s.versions.get(fileName)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot read versions of %s: %v", fileName, err)
+		return true
+	}
+	if id == h.Current {
+		return false
+	}
+	i := slices.IndexFunc(h.Previous, func(v storedVersion) bool { return v.ID == id })
+	if i < 0 {
+		respondError(w, http.StatusNotFound, CodeNotFound, "version %q of %q not found", id, fileName)
+		return true
+	}
+	v := h.Previous[i]
+	f, err := s.store.Open(versionName(fileName, v.ID))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, CodeServerError, "cannot open version %s of %s: %v", v.ID, fileName, err)
+		return true
+	}
+	defer f.Close()
+	var content io.ReadSeeker = f
+	if v.Gzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, CodeServerError, "cannot decompress version %s of %s: %v", v.ID, fileName, err)
+			return true
+		}
+		defer zr.Close()
+		content = &gzipReadSeeker{f: f, zr: zr, size: v.Size}
+	}
+
+	logFor(w).Info("download", "file", fileName, "version", v.ID, "range", r.Header.Get("Range"))
+	setDownloadHeaders(w, r, fileName, v.ContentType, v.Size, v.StoredAt)
+	w.Header().Set(VersionIDHeader, v.ID)
+	if v.Encryption != nil {
+		if data, err := json.Marshal(v.Encryption); err == nil {
+			w.Header().Set(EncryptionManifestHeader, base64.StdEncoding.EncodeToString(data))
+		}
+	}
+	http.ServeContent(w, r, fileName, v.StoredAt, content)
+	return true
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/session"
+)
+
+// ---------------------------------------------------------------------
+// Webhooks (WEBHOOK_URL, disabled when empty): a JSON POST to every
+// configured URL when an upload completes, fails or is deleted, and when
+// free space drops below MIN_FREE_SPACE
+// ---------------------------------------------------------------------
+const (
+	WebhookTimeout         = 10 * time.Second
+	DefaultWebhookAttempts = 5
+	DefaultWebhookBackoff  = 2 * time.Second // doubled after each failed attempt
+	WebhookMaxBackoff      = 5 * time.Minute
+)
+
+// Webhook events, in WebhookPayload.Event and the X-Webhook-Event header.
+const (
+	WebhookCompleted = "upload.completed"
+	WebhookFailed    = "upload.failed"  // verification, finalize or the virus scan failed
+	WebhookDeleted   = "upload.deleted" // deleted, expired or cleaned up
+	WebhookLowSpace  = "storage.low"    // free space dropped below MIN_FREE_SPACE
+)
+
+// Delivery headers. With WEBHOOK_SECRET, X-Webhook-Signature is
+// "sha256=" and the hex HMAC-SHA256 of the timestamp, a dot and the body.
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookIDHeader        = "X-Webhook-ID" // the same on every retry
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+var webhookClient = &http.Client{Timeout: WebhookTimeout}
+
+type WebhookPayload struct {
+	Event       string    `json:"event"`
+	ID          string    `json:"id"`
+	UploadID    string    `json:"uploadID,omitempty"`
+	FileName    string    `json:"fileName"`
+	Path        string    `json:"path,omitempty"`
+	Size        int64     `json:"size"`
+	Hash        string    `json:"hash,omitempty"`
+	DuplicateOf string    `json:"duplicateOf,omitempty"`
+	Code        string    `json:"code,omitempty"` // failed
+	Error       string    `json:"error,omitempty"`
+	FreeBytes   int64     `json:"freeBytes,omitempty"` // storage.low
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// webhookError is a failed delivery; retry is false for responses that
+// will not change on a retry.
+type webhookError struct {
+	err        error
+	retry      bool
+	retryAfter time.Duration // from a 429 or 503, 0 = use the backoff
+}
+
+func (e *webhookError) Error() string { return e.err.Error() }
+
+// notifyUploadComplete sends upload.completed for the upload under key,
+// stored as fileName, with its SHA-256.
+func (s *Server) notifyUploadComplete(key, fileName, path string, size int64, duplicateOf string) {
+	if len(s.cfg.WebhookURLs) == 0 {
+		return
+	}
+	p := WebhookPayload{Event: WebhookCompleted, UploadID: key, FileName: fileName, Path: path,
+		Size: size, DuplicateOf: duplicateOf, Timestamp: s.now().UTC()}
+	go func() {
+		hash, err := s.hashStored(fileName)
+		if err != nil {
+			slog.Warn("webhook: cannot hash file", "file", fileName, "error", err)
+		}
+		p.Hash = hash
+		s.deliverWebhooks(p)
+	}()
+}
+
+// notify sends p in the background; failures are logged and never affect
+// the request that caused it.
+func (s *Server) notify(p WebhookPayload) {
+	if len(s.cfg.WebhookURLs) == 0 {
+		return
+	}
+	p.Timestamp = s.now().UTC()
+	go s.deliverWebhooks(p)
+}
+
+// deliverWebhooks posts p to every URL, each with its own retries.
+func (s *Server) deliverWebhooks(p WebhookPayload) {
+	id, err := session.NewID()
+	if err != nil {
+		slog.Error("webhook dropped", "event", p.Event, "error", err)
+		return
+	}
+	p.ID = id
+	body, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("webhook dropped", "event", p.Event, "error", err)
+		return
+	}
+	for _, url := range s.cfg.WebhookURLs {
+		go s.deliverWebhook(url, p, body)
+	}
+}
+
+// deliverWebhook retries with exponential backoff (and jitter) on network
+// errors, 408, 429 and 5xx responses.
+func (s *Server) deliverWebhook(url string, p WebhookPayload, body []byte) {
+	lg := slog.With("url", url, "event", p.Event, "file", p.FileName, "webhook_id", p.ID)
+	backoff := s.cfg.WebhookBackoff
+	for attempt := 1; attempt <= s.cfg.WebhookAttempts; attempt++ {
+		err := s.postWebhook(url, p, body)
+		if err == nil {
+			lg.Info("webhook delivered", "attempt", attempt)
+			return
+		}
+		lg.Warn("webhook attempt failed", "attempt", attempt, "attempts", s.cfg.WebhookAttempts, "error", err)
+		if !err.retry {
+			break
+		}
+		if attempt < s.cfg.WebhookAttempts {
+			wait := backoff + rand.N(backoff/5+1)
+			if err.retryAfter > 0 {
+				wait = min(err.retryAfter, WebhookMaxBackoff)
+			}
+			time.Sleep(wait)
+			backoff = min(2*backoff, WebhookMaxBackoff)
+		}
+	}
+	lg.Error("webhook dropped", "attempts", s.cfg.WebhookAttempts)
+}
+
+func (s *Server) postWebhook(url string, p WebhookPayload, body []byte) *webhookError {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return &webhookError{err: err}
+	}
+	ts := strconv.FormatInt(s.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chunk-upload-webhook")
+	req.Header.Set(WebhookEventHeader, p.Event)
+	req.Header.Set(WebhookIDHeader, p.ID)
+	req.Header.Set(WebhookTimestampHeader, ts)
+	if s.cfg.WebhookSecret != "" {
+		req.Header.Set(WebhookSignatureHeader, signWebhook(s.cfg.WebhookSecret, ts, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return &webhookError{err: err, retry: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	e := &webhookError{err: fmt.Errorf("unexpected status %s", resp.Status)}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			e.retryAfter = time.Duration(secs) * time.Second
+		}
+		e.retry = true
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode >= 500:
+		e.retry = true
+	}
+	return e
+}
+
+// signWebhook returns the X-Webhook-Signature of body sent at ts. The
+// timestamp is signed too, so receivers can reject replays.
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Locks shared by several server processes (LOCK_URL): Redis or Postgres
+// ---------------------------------------------------------------------
+
+// Locker hands out the lock for an upload key. Locks serves one process;
+// RedisLocks and PostgresLocks serve replicas behind a load balancer that
+// share their storage, so two of them never write the same upload at once.
+//
+// Lock on a shared lock blocks until it is held; while the backend is
+// unreachable it keeps retrying and logs the failures.
+type Locker interface {
+	Get(name string) sync.Locker
+}
+
+// Prefixed returns a Locker whose keys all start with prefix, e.g. a
+// tenant's name, so that equal names elsewhere are not serialized with
+// them.
+func Prefixed(l Locker, prefix string) Locker {
+	return prefixed{l, prefix}
+}
+
+type prefixed struct {
+	Locker
+	prefix string
+}
+
+func (p prefixed) Get(name string) sync.Locker {
+	return p.Locker.Get(p.prefix + name)
+}
+
+// LockPrefix starts the names of shared locks, keeping them apart from
+// other users of the same Redis or Postgres.
+const LockPrefix = "chunk-upload:lock:"
+
+// RetryDelay is the base wait between attempts to take a shared lock; the
+// actual wait is jittered so that waiters do not retry in step.
+const RetryDelay = 50 * time.Millisecond
+
+// twoLevel is a shared lock behind the process's own lock for the same
+// name: goroutines of one process queue locally, and only the one at the
+// front polls the backend.
+type twoLevel struct {
+	local  sync.Locker
+	remote sync.Locker
+}
+
+func (t twoLevel) Lock() {
+	t.local.Lock()
+	t.remote.Lock()
+}
+
+func (t twoLevel) Unlock() {
+	t.remote.Unlock()
+	t.local.Unlock()
+}
+
+// retry calls try until it succeeds, logging failures (not contention) at
+// most every 10 seconds.
+func retry(backend, name string, try func() (bool, error)) {
+	var lastLog time.Time
+	for {
+		ok, err := try()
+		if ok {
+			return
+		}
+		if err != nil && time.Since(lastLog) > 10*time.Second {
+			slog.Error("cannot take lock", "backend", backend, "key", name, "error", err)
+			lastLog = time.Now()
+		}
+		time.Sleep(RetryDelay/2 + rand.N(RetryDelay))
+	}
+}
+
+// newToken returns a random value identifying one holder of a lock.
+func newToken() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
@@ -0,0 +1,80 @@
+package session
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// PostgresTimeout bounds each statement of PostgresLocks.
+const PostgresTimeout = 5 * time.Second
+
+// PostgresLocks is a Locker made of Postgres session advisory locks, keyed
+// by a 64-bit hash of Prefix and the name. Each held lock keeps one
+// connection of DB; a process that dies loses its connections and so its
+// locks.
+type PostgresLocks struct {
+	DB     *sql.DB
+	Prefix string // default LockPrefix
+
+	local *Locks
+}
+
+// NewPostgresLocks returns PostgresLocks on db.
+func NewPostgresLocks(db *sql.DB) *PostgresLocks {
+	return &PostgresLocks{DB: db, Prefix: LockPrefix, local: NewLocks()}
+}
+
+// Get returns the lock for name.
+func (l *PostgresLocks) Get(name string) sync.Locker {
+	h := fnv.New64a()
+	h.Write([]byte(l.Prefix + name))
+	return twoLevel{l.local.Get(name), &pgLock{db: l.DB, name: name, key: int64(h.Sum64())}}
+}
+
+// Close closes DB.
+func (l *PostgresLocks) Close() error {
+	return l.DB.Close()
+}
+
+type pgLock struct {
+	db   *sql.DB
+	name string
+	key  int64
+	conn *sql.Conn
+}
+
+func (k *pgLock) Lock() {
+	retry("postgres", k.name, func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), PostgresTimeout)
+		defer cancel()
+		conn, err := k.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		var ok bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", k.key).Scan(&ok); err != nil || !ok {
+			conn.Close()
+			return false, err
+		}
+		k.conn = conn
+		return true, nil
+	})
+}
+
+func (k *pgLock) Unlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), PostgresTimeout)
+	defer cancel()
+	if _, err := k.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", k.key); err != nil {
+		slog.Warn("cannot release lock", "backend", "postgres", "key", k.name, "error", err)
+		// Drop the connection rather than pool it still holding the lock;
+		// closing it ends the session, which releases the lock.
+		k.conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	k.conn.Close()
+	k.conn = nil
+}
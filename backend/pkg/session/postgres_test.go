@@ -0,0 +1,92 @@
+//go:build postgres
+
+package session
+
+import (
+	"database/sql"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// openTestPostgres connects to TEST_POSTGRES_URL, skipping the test
+// without it.
+func openTestPostgres(t *testing.T) *sql.DB {
+	dsn := os.Getenv("TEST_POSTGRES_URL")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_URL not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPostgresLocks(t *testing.T) {
+	// Two PostgresLocks stand for two server processes.
+	a, b := NewPostgresLocks(openTestPostgres(t)), NewPostgresLocks(openTestPostgres(t))
+	defer a.Close()
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	held, overlaps := 0, 0
+	var mu sync.Mutex
+	for i := range 8 {
+		locks := a
+		if i%2 == 1 {
+			locks = b
+		}
+		wg.Go(func() {
+			lock := locks.Get("file.bin")
+			lock.Lock()
+			mu.Lock()
+			if held++; held > 1 {
+				overlaps++
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			held--
+			mu.Unlock()
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+	if overlaps > 0 {
+		t.Errorf("lock held by %d holders at once", overlaps+1)
+	}
+
+	// Every lock was released: a third process takes it at once.
+	c := NewPostgresLocks(openTestPostgres(t))
+	defer c.Close()
+	lockWithin(t, c.Get("file.bin"), time.Second).Unlock()
+
+	// Prefixed keys (tenants) do not contend with each other.
+	lock := lockWithin(t, Prefixed(a, "acme/").Get("file.bin"), time.Second)
+	lockWithin(t, b.Get("file.bin"), time.Second).Unlock()
+	lock.Unlock()
+}
+
+// lockWithin locks l, failing the test if that takes longer than d.
+func lockWithin(t *testing.T, l sync.Locker, d time.Duration) sync.Locker {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return l
+	case <-time.After(d):
+		t.Fatalf("lock not taken within %v", d)
+		return nil
+	}
+}
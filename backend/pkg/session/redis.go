@@ -0,0 +1,408 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for RedisLocks.
+const (
+	RedisTTL     = 30 * time.Second
+	redisTimeout = 2 * time.Second // per command
+	redisIdle    = 8               // idle connections kept per node
+)
+
+// Scripts that touch the key only while it still holds the caller's
+// token, so a holder whose lease ran out cannot release or extend a lock
+// that another process has since taken.
+const (
+	redisUnlock = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisExtend = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// RedisNode is one Redis server.
+type RedisNode struct {
+	Addr     string // host:port
+	Password string
+	DB       int
+}
+
+// ParseRedisURL reads redis://[:password@]host[:port][/db].
+func ParseRedisURL(s string) (RedisNode, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "redis" || u.Hostname() == "" {
+		return RedisNode{}, fmt.Errorf("invalid Redis URL %q: want redis://[:password@]host[:port][/db]", s)
+	}
+	n := RedisNode{Addr: u.Host}
+	if u.Port() == "" {
+		n.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		n.Password, _ = u.User.Password()
+		if n.Password == "" {
+			n.Password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if n.DB, err = strconv.Atoi(db); err != nil || n.DB < 0 {
+			return RedisNode{}, fmt.Errorf("invalid Redis URL %q: database %q is not a number", s, db)
+		}
+	}
+	return n, nil
+}
+
+// RedisLocks is a Locker kept in Redis: SET key token NX PX ttl takes a
+// lock, which is extended every TTL/3 while held and deleted on Unlock.
+// With several nodes it is Redlock: a lock is held once a majority of
+// them granted it within its TTL.
+//
+// A process that dies leaves its locks to expire after TTL.
+type RedisLocks struct {
+	Prefix string        // key prefix, default LockPrefix
+	TTL    time.Duration // lease, default RedisTTL
+
+	nodes []*redisNode
+	local *Locks
+}
+
+// NewRedisLocks returns RedisLocks on nodes.
+func NewRedisLocks(nodes []RedisNode) *RedisLocks {
+	l := &RedisLocks{Prefix: LockPrefix, TTL: RedisTTL, local: NewLocks()}
+	for _, n := range nodes {
+		l.nodes = append(l.nodes, &redisNode{RedisNode: n})
+	}
+	return l
+}
+
+// Get returns the lock for name.
+func (l *RedisLocks) Get(name string) sync.Locker {
+	return twoLevel{l.local.Get(name), &redisLock{l: l, key: l.Prefix + name}}
+}
+
+// Close closes the idle connections.
+func (l *RedisLocks) Close() error {
+	for _, n := range l.nodes {
+		n.close()
+	}
+	return nil
+}
+
+func (l *RedisLocks) quorum() int {
+	return len(l.nodes)/2 + 1
+}
+
+// each runs cmd on every node and counts the replies ok accepts; err is
+// the last failure, if any.
+func (l *RedisLocks) each(ok func(any) bool, cmd ...string) (n int, err error) {
+	for _, node := range l.nodes {
+		reply, e := node.do(cmd...)
+		if e != nil {
+			err = fmt.Errorf("%s: %w", node.Addr, e)
+			continue
+		}
+		if ok(reply) {
+			n++
+		}
+	}
+	return n, err
+}
+
+func isOK(reply any) bool  { return reply == "OK" }
+func isOne(reply any) bool { return reply == int64(1) }
+
+// redisLock is one acquisition of a key.
+type redisLock struct {
+	l     *RedisLocks
+	key   string
+	token string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func (k *redisLock) Lock() {
+	ttl := strconv.FormatInt(k.l.TTL.Milliseconds(), 10)
+	retry("redis", k.key, func() (bool, error) {
+		k.token = newToken()
+		start := time.Now()
+		n, err := k.l.each(isOK, "SET", k.key, k.token, "NX", "PX", ttl)
+		// Allow for clock drift between the nodes, as Redlock does.
+		validity := k.l.TTL - time.Since(start) - k.l.TTL/100 - 2*time.Millisecond
+		if n >= k.l.quorum() && validity > 0 {
+			return true, nil
+		}
+		if n > 0 {
+			k.l.each(isOne, "EVAL", redisUnlock, "1", k.key, k.token)
+		}
+		return false, err
+	})
+	k.stop, k.done = make(chan struct{}), make(chan struct{})
+	go k.renew()
+}
+
+// renew extends the lease every TTL/3 until Unlock.
+func (k *redisLock) renew() {
+	defer close(k.done)
+	ticker := time.NewTicker(k.l.TTL / 3)
+	defer ticker.Stop()
+	ttl := strconv.FormatInt(k.l.TTL.Milliseconds(), 10)
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+			if n, err := k.l.each(isOne, "EVAL", redisExtend, "1", k.key, k.token, ttl); n < k.l.quorum() {
+				slog.Error("cannot extend lock", "backend", "redis", "key", k.key, "error", err)
+			}
+		}
+	}
+}
+
+func (k *redisLock) Unlock() {
+	close(k.stop)
+	<-k.done
+	if _, err := k.l.each(isOne, "EVAL", redisUnlock, "1", k.key, k.token); err != nil {
+		// It expires after TTL.
+		slog.Warn("cannot release lock", "backend", "redis", "key", k.key, "error", err)
+	}
+}
+
+// CachePrefix starts the keys of RedisCache.
+const CachePrefix = "chunk-upload:meta:"
+
+// RedisCache keeps upload metadata in Redis (SESSION_CACHE), shared by the
+// replicas that use it. It is a storage.MetaCache.
+type RedisCache struct {
+	Prefix string        // key prefix, default CachePrefix
+	TTL    time.Duration // entries expire this long after their last write, 0 = never
+
+	node *redisNode
+}
+
+// NewRedisCache returns a RedisCache on node.
+func NewRedisCache(node RedisNode) *RedisCache {
+	return &RedisCache{Prefix: CachePrefix, node: &redisNode{RedisNode: node}}
+}
+
+// Get returns the value of key, nil when it is not cached.
+func (c *RedisCache) Get(key string) ([]byte, error) {
+	reply, err := c.node.do("GET", c.Prefix+key)
+	if s, ok := reply.(string); ok && err == nil {
+		return []byte(s), nil
+	}
+	return nil, err
+}
+
+// Set stores value under key.
+func (c *RedisCache) Set(key string, value []byte) error {
+	cmd := []string{"SET", c.Prefix + key, string(value)}
+	if c.TTL > 0 {
+		cmd = append(cmd, "PX", strconv.FormatInt(c.TTL.Milliseconds(), 10))
+	}
+	_, err := c.node.do(cmd...)
+	return err
+}
+
+// Delete removes key.
+func (c *RedisCache) Delete(key string) error {
+	_, err := c.node.do("DEL", c.Prefix+key)
+	return err
+}
+
+// Close closes the idle connections.
+func (c *RedisCache) Close() error {
+	c.node.close()
+	return nil
+}
+
+// QueuePrefix starts the keys of RedisQueue.
+const QueuePrefix = "chunk-upload:queue:"
+
+// RedisQueuePoll is how long RedisQueue.Pop waits for an item.
+const RedisQueuePoll = time.Second
+
+// RedisQueue is a FIFO list in Redis (LPUSH, BRPOP) that the replicas using
+// it share: each item is popped by one of them.
+type RedisQueue struct {
+	Key string // list key, QueuePrefix and the queue name
+
+	node *redisNode
+}
+
+// NewRedisQueue returns the RedisQueue name on node.
+func NewRedisQueue(node RedisNode, name string) *RedisQueue {
+	return &RedisQueue{Key: QueuePrefix + name, node: &redisNode{RedisNode: node}}
+}
+
+// Push appends value to the queue.
+func (q *RedisQueue) Push(value []byte) error {
+	_, err := q.node.do("LPUSH", q.Key, string(value))
+	return err
+}
+
+// Pop removes and returns the oldest item, waiting up to RedisQueuePoll
+// for one; it is nil when none came.
+func (q *RedisQueue) Pop() ([]byte, error) {
+	reply, err := q.node.do("BRPOP", q.Key, strconv.Itoa(int(RedisQueuePoll/time.Second)))
+	if kv, ok := reply.([]any); ok && err == nil && len(kv) == 2 {
+		if s, ok := kv[1].(string); ok {
+			return []byte(s), nil
+		}
+	}
+	return nil, err
+}
+
+// Close closes the idle connections.
+func (q *RedisQueue) Close() error {
+	q.node.close()
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// A minimal RESP client: the few commands the locks, cache and queue need
+// ---------------------------------------------------------------------
+
+type redisNode struct {
+	RedisNode
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends one command and returns its reply: a string, an int64, an
+// []any of those, nil or an error reply as error.
+func (n *redisNode) do(args ...string) (any, error) {
+	c, err := n.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.Close()
+		return nil, err
+	}
+	n.put(c)
+	return reply, err
+}
+
+func (n *redisNode) get() (*redisConn, error) {
+	n.mu.Lock()
+	if len(n.idle) > 0 {
+		c := n.idle[len(n.idle)-1]
+		n.idle = n.idle[:len(n.idle)-1]
+		n.mu.Unlock()
+		return c, nil
+	}
+	n.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", n.Addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if n.Password != "" {
+		if _, err := c.do("AUTH", n.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if n.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(n.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (n *redisNode) put(c *redisConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.idle) >= redisIdle {
+		c.Close()
+		return
+	}
+	n.idle = append(n.idle, c)
+}
+
+func (n *redisNode) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.idle {
+		c.Close()
+	}
+	n.idle = nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisConn) do(args ...string) (any, error) {
+	c.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch body := line[1:]; line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err // -1: nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err // -1: nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,128 @@
+// Package session tracks uploads in progress: the sessions started by
+// POST /upload/init, a mutex per upload and the chunks received so far.
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/navneetshukl/Chunk-Upload/backend/pkg/storage"
+)
+
+// Session is what POST /upload/init declared. Part files, locks and
+// received-chunk tracking are keyed by ID; only the completed file uses
+// FileName.
+type Session struct {
+	ID          string
+	FileName    string
+	TotalChunks int
+	FileSize    int64 // 0 = not declared
+	CreatedAt   time.Time
+	Retention   time.Duration // keep the completed file this long, 0 = server default
+
+	// Direct is the bucket's multipart upload ID when the client PUTs
+	// TotalChunks parts of PartSize bytes straight to object storage.
+	Direct   string
+	PartSize int64
+
+	// Batch is the batch (POST /batches) the file belongs to, as file
+	// BatchIndex; "" for a file uploaded on its own.
+	Batch      string
+	BatchIndex int
+
+	// Extract is the directory a zip upload is unpacked under once it
+	// completes (extract=true); "" to keep it as it is.
+	Extract string
+
+	// Encryption is the manifest of a file the client encrypts itself,
+	// nil for plaintext.
+	Encryption *storage.EncryptionManifest
+}
+
+// Store holds the sessions of this process by ID.
+type Store struct {
+	mu sync.Mutex
+	m  map[string]*Session
+}
+
+// IDBytes is the length of an upload ID before hex encoding.
+const IDBytes = 16
+
+// NewID returns a random upload ID: IDBytes bytes, hex-encoded.
+func NewID() (string, error) {
+	b := make([]byte, IDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ValidID reports whether id could have come from NewID, so it is safe
+// to use as a storage key.
+func ValidID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == IDBytes
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{m: make(map[string]*Session)}
+}
+
+// Add registers sess under its ID.
+func (st *Store) Add(sess *Session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.m[sess.ID] = sess
+}
+
+// Get returns the session with id.
+func (st *Store) Get(id string) (*Session, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.m[id]
+	return sess, ok
+}
+
+// Len returns the number of sessions.
+func (st *Store) Len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.m)
+}
+
+// List returns a copy of every session, oldest first.
+func (st *Store) List() []Session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	list := make([]Session, 0, len(st.m))
+	for _, sess := range st.m {
+		list = append(list, *sess)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Remove forgets the session with id.
+func (st *Store) Remove(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.m, id)
+}
+
+// Expire drops sessions created before cutoff and returns them.
+func (st *Store) Expire(cutoff time.Time) []*Session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var expired []*Session
+	for id, sess := range st.m {
+		if sess.CreatedAt.Before(cutoff) {
+			delete(st.m, id)
+			expired = append(expired, sess)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,331 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreExpire(t *testing.T) {
+	st := NewStore()
+	now := time.Now()
+	old, err := NewID()
+	if err != nil || !ValidID(old) {
+		t.Fatalf("NewID = %q, %v", old, err)
+	}
+	st.Add(&Session{ID: old, CreatedAt: now.Add(-time.Hour)})
+	st.Add(&Session{ID: "fresh", CreatedAt: now})
+
+	expired := st.Expire(now.Add(-time.Minute))
+	if len(expired) != 1 || expired[0].ID != old {
+		t.Fatalf("expired = %v", expired)
+	}
+	if _, ok := st.Get(old); ok || st.Len() != 1 {
+		t.Errorf("after expire: Len = %d", st.Len())
+	}
+	if ValidID("fresh") || ValidID("../etc") {
+		t.Error("ValidID accepted a name that NewID cannot produce")
+	}
+}
+
+func TestTrackerReserve(t *testing.T) {
+	tr := NewTracker()
+	if total, ok := tr.Reserve("a", 0, 60, 100); !ok || total != 60 {
+		t.Fatalf("Reserve(0) = %d, %v", total, ok)
+	}
+	if total, ok := tr.Reserve("a", 1, 50, 100); ok || total != 110 {
+		t.Fatalf("Reserve over the limit = %d, %v", total, ok)
+	}
+	// Resending chunk 0 replaces its size rather than adding to it.
+	if total, ok := tr.Reserve("a", 0, 40, 100); !ok || total != 40 {
+		t.Fatalf("Reserve(0) again = %d, %v", total, ok)
+	}
+	tr.Mark("a", 2, 10)
+	if missing, ok := tr.Missing("a", 4); !ok || !slices.Equal(missing, []int{1, 3}) {
+		t.Errorf("Missing = %v, %v", missing, ok)
+	}
+	if tr.Count("a") != 2 || tr.Bytes("a") != 50 {
+		t.Errorf("Count = %d, Bytes = %d", tr.Count("a"), tr.Bytes("a"))
+	}
+	tr.Forget("a")
+	if _, ok := tr.Missing("a", 4); ok {
+		t.Error("Missing after Forget reports tracked chunks")
+	}
+}
+
+func TestLocksBounded(t *testing.T) {
+	l := NewLocks()
+	n := 1_000_000
+	if testing.Short() {
+		n = 10_000
+	}
+	// Churn through n names, as a long-running server does.
+	for i := range n {
+		lock := l.Get("file-" + strconv.Itoa(i))
+		lock.Lock()
+		lock.Unlock()
+	}
+	if l.Len() != 0 {
+		t.Fatalf("Len = %d after %d names were released", l.Len(), n)
+	}
+
+	// The entry lives while anyone holds or waits for it, so waiters still
+	// exclude each other.
+	var wg sync.WaitGroup
+	held, overlaps := 0, 0
+	for range 16 {
+		wg.Go(func() {
+			for range 100 {
+				lock := l.Get("same")
+				lock.Lock()
+				if held++; held > 1 {
+					overlaps++
+				}
+				held--
+				lock.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if overlaps > 0 || l.Len() != 0 {
+		t.Errorf("overlaps = %d, Len = %d", overlaps, l.Len())
+	}
+}
+
+// fakeRedis answers the commands RedisLocks, RedisCache and RedisQueue
+// send (GET, SET [NX] [PX], DEL, EVAL of the unlock and extend scripts,
+// LPUSH and BRPOP, which does not block) and records the keys it holds.
+type fakeRedis struct {
+	mu    sync.Mutex
+	keys  map[string]string
+	lists map[string][]string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeRedis{keys: make(map[string]string), lists: make(map[string][]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			size, _ := r.ReadString('\n')
+			n, _ := strconv.Atoi(strings.TrimSpace(size[1:]))
+			arg := make([]byte, n+2)
+			if _, err := io.ReadFull(r, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:n])
+		}
+		fmt.Fprint(conn, f.do(args))
+	}
+}
+
+func (f *fakeRedis) do(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch args[0] {
+	case "GET":
+		v, ok := f.keys[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		if _, ok := f.keys[args[1]]; ok && slices.Contains(args, "NX") {
+			return "$-1\r\n"
+		}
+		f.keys[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.keys[args[1]]
+		delete(f.keys, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EVAL":
+		key, token := args[3], args[4]
+		if f.keys[key] != token {
+			return ":0\r\n"
+		}
+		if strings.Contains(args[1], `"del"`) {
+			delete(f.keys, key)
+		}
+		return ":1\r\n"
+	case "LPUSH":
+		f.lists[args[1]] = append([]string{args[2]}, f.lists[args[1]]...)
+		return fmt.Sprintf(":%d\r\n", len(f.lists[args[1]]))
+	case "BRPOP":
+		list := f.lists[args[1]]
+		if len(list) == 0 {
+			return "*-1\r\n"
+		}
+		v := list[len(list)-1]
+		f.lists[args[1]] = list[:len(list)-1]
+		return fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(v), v)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRedis) held() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestRedisLocks(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	node, err := ParseRedisURL("redis://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two RedisLocks stand for two server processes.
+	a, b := NewRedisLocks([]RedisNode{node}), NewRedisLocks([]RedisNode{node})
+	defer a.Close()
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	held, overlaps := 0, 0
+	var mu sync.Mutex
+	for i := range 8 {
+		locks := a
+		if i%2 == 1 {
+			locks = b
+		}
+		wg.Go(func() {
+			lock := locks.Get("file.bin")
+			lock.Lock()
+			mu.Lock()
+			if held++; held > 1 {
+				overlaps++
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			held--
+			mu.Unlock()
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+	if overlaps > 0 {
+		t.Errorf("lock held by %d holders at once", overlaps+1)
+	}
+	if keys := f.held(); len(keys) != 0 {
+		t.Errorf("keys left after Unlock: %v", keys)
+	}
+
+	// Prefixed keys (tenants) do not contend with each other.
+	lock := Prefixed(a, "acme/").Get("file.bin")
+	lock.Lock()
+	other := b.Get("file.bin")
+	other.Lock()
+	if keys := f.held(); !slices.Contains(keys, LockPrefix+"acme/file.bin") || len(keys) != 2 {
+		t.Errorf("keys = %v", keys)
+	}
+	other.Unlock()
+	lock.Unlock()
+}
+
+func TestRedisCache(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	cache := NewRedisCache(RedisNode{Addr: addr})
+	defer cache.Close()
+
+	if v, err := cache.Get("up1"); v != nil || err != nil {
+		t.Fatalf("Get before Set = %q, %v", v, err)
+	}
+	value := `{"received":{"0":5}}` + "\r\nwith a line break"
+	if err := cache.Set("up1", []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := cache.Get("up1"); string(v) != value || err != nil {
+		t.Errorf("Get = %q, %v", v, err)
+	}
+	if keys := f.held(); !slices.Equal(keys, []string{CachePrefix + "up1"}) {
+		t.Errorf("keys = %v", keys)
+	}
+	if err := cache.Delete("up1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := cache.Get("up1"); v != nil {
+		t.Errorf("Get after Delete = %q", v)
+	}
+}
+
+func TestRedisQueue(t *testing.T) {
+	f, addr := startFakeRedis(t)
+	// Two RedisQueues stand for two replicas sharing the queue.
+	a, b := NewRedisQueue(RedisNode{Addr: addr}, "jobs"), NewRedisQueue(RedisNode{Addr: addr}, "jobs")
+	defer a.Close()
+	defer b.Close()
+
+	for _, v := range []string{"first", "second\r\nline"} {
+		if err := a.Push([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := b.Pop(); string(v) != "first" || err != nil {
+		t.Errorf("Pop = %q, %v", v, err)
+	}
+	if v, err := a.Pop(); string(v) != "second\r\nline" || err != nil {
+		t.Errorf("Pop = %q, %v", v, err)
+	}
+	if v, err := b.Pop(); v != nil || err != nil {
+		t.Errorf("Pop of empty queue = %q, %v", v, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.lists[QueuePrefix+"jobs"]; !ok {
+		t.Errorf("lists = %v", f.lists)
+	}
+}
+
+func TestParseRedisURL(t *testing.T) {
+	n, err := ParseRedisURL("redis://:secret@cache:6380/2")
+	if err != nil || n != (RedisNode{Addr: "cache:6380", Password: "secret", DB: 2}) {
+		t.Errorf("ParseRedisURL = %+v, %v", n, err)
+	}
+	if n, _ := ParseRedisURL("redis://cache"); n.Addr != "cache:6379" {
+		t.Errorf("default port: Addr = %q", n.Addr)
+	}
+	for _, bad := range []string{"cache:6379", "redis://cache/x", "http://cache"} {
+		if _, err := ParseRedisURL(bad); err == nil {
+			t.Errorf("ParseRedisURL(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package session
+
+import "sync"
+
+// ---------------------------------------------------------------------
+// Per-file mutex map (prevents race conditions on the same file name)
+// ---------------------------------------------------------------------
+
+// Locks hands out one mutex per upload key, so chunks of the same upload
+// are written one at a time. An entry exists only while some goroutine
+// holds or waits for its lock, so the map does not grow with every name
+// ever uploaded.
+type Locks struct {
+	mu sync.Mutex
+	m  map[string]*lockEntry
+}
+
+// lockEntry is the mutex for one name and how many goroutines hold or
+// wait for it.
+type lockEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// NewLocks returns an empty Locks.
+func NewLocks() *Locks {
+	return &Locks{m: make(map[string]*lockEntry)}
+}
+
+// Get returns the lock for name. Each Lock must be followed by Unlock on
+// the same value before it is locked again.
+func (l *Locks) Get(name string) sync.Locker {
+	return &heldLock{locks: l, name: name}
+}
+
+// Len returns the number of names locked or waited for.
+func (l *Locks) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.m)
+}
+
+type heldLock struct {
+	locks *Locks
+	name  string
+	entry *lockEntry
+}
+
+func (h *heldLock) Lock() {
+	l := h.locks
+	l.mu.Lock()
+	e := l.m[h.name]
+	if e == nil {
+		e = &lockEntry{}
+		l.m[h.name] = e
+	}
+	e.refs++
+	l.mu.Unlock()
+	e.Lock()
+	h.entry = e
+}
+
+func (h *heldLock) Unlock() {
+	e := h.entry
+	h.entry = nil
+	e.Unlock()
+	l := h.locks
+	l.mu.Lock()
+	if e.refs--; e.refs == 0 {
+		delete(l.m, h.name)
+	}
+	l.mu.Unlock()
+}
+
+// ---------------------------------------------------------------------
+// Received chunk indices (and their sizes) per file; guards the final rename
+// ---------------------------------------------------------------------
+
+// Tracker records the chunks received per upload key and their sizes.
+type Tracker struct {
+	mu sync.Mutex
+	m  map[string]map[int]int64
+}
+
+// NewTracker returns an empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{m: make(map[string]map[int]int64)}
+}
+
+// Mark records that chunk index of name holds size bytes.
+func (c *Tracker) Mark(name string, index int, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m[name] == nil {
+		c.m[name] = make(map[int]int64)
+	}
+	c.m[name][index] = size
+}
+
+// Reserve marks chunk index of name as size bytes unless that would take
+// the total for name past limit (0 = no limit). It returns the total the
+// chunk would make and whether it was marked.
+func (c *Tracker) Reserve(name string, index int, size, limit int64) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := size
+	for i, n := range c.m[name] {
+		if i != index {
+			total += n
+		}
+	}
+	if limit > 0 && total > limit {
+		return total, false
+	}
+	if c.m[name] == nil {
+		c.m[name] = make(map[int]int64)
+	}
+	c.m[name][index] = size
+	return total, true
+}
+
+// Unmark forgets chunk index of name, e.g. after a failed write.
+func (c *Tracker) Unmark(name string, index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m[name], index)
+}
+
+// Size returns the size recorded for chunk index of name and whether it
+// has been stored.
+func (c *Tracker) Size(name string, index int) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.m[name][index]
+	return size, ok
+}
+
+// Count returns how many distinct chunks of name have been stored.
+func (c *Tracker) Count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m[name])
+}
+
+// Restore seeds name from persisted metadata unless it is already tracked
+// (it is empty after a restart).
+func (c *Tracker) Restore(name string, chunks map[int]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[name]; ok || len(chunks) == 0 {
+		return
+	}
+	c.m[name] = make(map[int]int64, len(chunks))
+	for i, size := range chunks {
+		c.m[name][i] = size
+	}
+}
+
+// Replace sets the chunks tracked for name to chunks, e.g. those another
+// process recorded in the upload's metadata while it held the lock.
+func (c *Tracker) Replace(name string, chunks map[int]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(chunks) == 0 {
+		delete(c.m, name)
+		return
+	}
+	c.m[name] = make(map[int]int64, len(chunks))
+	for i, size := range chunks {
+		c.m[name][i] = size
+	}
+}
+
+// Snapshot returns a copy of the chunks tracked for name.
+func (c *Tracker) Snapshot(name string) map[int]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunks := make(map[int]int64, len(c.m[name]))
+	for i, size := range c.m[name] {
+		chunks[i] = size
+	}
+	return chunks
+}
+
+// Bytes returns the total size of the chunks of name stored so far.
+func (c *Tracker) Bytes(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int64
+	for _, size := range c.m[name] {
+		n += size
+	}
+	return n
+}
+
+// Missing lists indices below total not yet received for name; ok is
+// false when nothing is tracked (e.g. after a server restart).
+func (c *Tracker) Missing(name string, total int) (missing []int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	got, ok := c.m[name]
+	if !ok {
+		return nil, false
+	}
+	for i := 0; i < total; i++ {
+		if _, ok := got[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing, true
+}
+
+// Keys returns every name with tracked chunks.
+func (c *Tracker) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.m))
+	for name := range c.m {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Forget drops everything tracked for name.
+func (c *Tracker) Forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, name)
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// ---------------------------------------------------------------------
+// STORAGE_LAYOUT=content: completed files stored under their SHA-256 in
+// sharded directories (ab/cd/abcdef...), with the name table pointing
+// each file name at its content
+// ---------------------------------------------------------------------
+
+// PendingTable is where Addressed counts the objects being written,
+// inside the directory of FileNameTable.
+const PendingTable = ".pending.json"
+
+// Storage layouts (STORAGE_LAYOUT).
+const (
+	LayoutFlat    = "flat"    // completed files under their own names
+	LayoutContent = "content" // under ContentKey of their bytes
+)
+
+// ContentKey is where LayoutContent stores bytes with SHA-256 sum: the
+// hex digest, below two directory levels named after its first two
+// bytes, so no directory holds more than a sliver of the files.
+func ContentKey(sum []byte) string {
+	h := hex.EncodeToString(sum)
+	return h[:2] + "/" + h[2:4] + "/" + h
+}
+
+// Addressed wraps a Storage so completed files live under ContentKey.
+// Names with the same content share one object, removed with the last
+// of them. It keeps the name table of Mapped, so a server switching from
+// MAP_FILE_NAMES still finds the files stored under generated keys.
+type Addressed struct {
+	Mapped
+
+	// pending counts the objects being written per key, by any process
+	// sharing dir, which must not be removed though no name points at
+	// them yet. A process that dies while writing leaves its count, so
+	// the object is kept rather than possibly removed under a name.
+	pending *Table[int]
+}
+
+// NewAddressed stores the completed files of st by content, keeping the
+// name table in FileNameTable and the objects being written in
+// PendingTable inside dir.
+func NewAddressed(st Storage, dir string, mode os.FileMode) Addressed {
+	return Addressed{
+		Mapped:  NewMapped(st, dir, mode),
+		pending: NewTable[int]("pending object table", filepath.Join(dir, PendingTable), mode),
+	}
+}
+
+// Finalize hashes the part file and stores it as the object of its
+// content, which replaces the same bytes if another name already has it.
+func (a Addressed) Finalize(key, name string) (string, error) {
+	in, err := a.Storage.ReadPart(key)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, in)
+	in.Close()
+	if err != nil {
+		return "", err
+	}
+	return a.store(key, name, ContentKey(h.Sum(nil)))
+}
+
+// store finalizes part key as the object storageKey and points name at
+// it, removing the object name had before unless another name uses it.
+// While the object is written it counts as pending, so removing a name
+// with the same content cannot delete it under us.
+func (a Addressed) store(key, name, storageKey string) (string, error) {
+	if err := a.countPending(storageKey, 1); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := a.countPending(storageKey, -1); err != nil {
+			slog.Warn("cannot update pending objects", "key", storageKey, "error", err)
+		}
+	}()
+
+	loc, err := a.Storage.Finalize(key, storageKey)
+	if err != nil {
+		return loc, err
+	}
+	var old string
+	err = a.names.Update(func(names map[string]string) (bool, error) {
+		old = names[name]
+		names[name] = storageKey
+		return true, nil
+	})
+	if err != nil {
+		return loc, err
+	}
+	if old != "" && old != storageKey {
+		if err := a.removeUnused(old); err != nil {
+			slog.Warn("cannot remove replaced file", "file", name, "key", old, "error", err)
+		}
+	}
+	return loc, nil
+}
+
+// countPending adds n to the count of writers of the object key.
+func (a Addressed) countPending(key string, n int) error {
+	return a.pending.Update(func(pending map[string]int) (bool, error) {
+		if pending[key] += n; pending[key] <= 0 {
+			delete(pending, key)
+		}
+		return true, nil
+	})
+}
+
+// removeUnused deletes the object key unless a name points at it or it is
+// being written. It holds the pending table's lock throughout, so no
+// process starts writing key before it is gone.
+func (a Addressed) removeUnused(key string) error {
+	return a.pending.Update(func(pending map[string]int) (bool, error) {
+		if pending[key] > 0 {
+			return false, nil
+		}
+		used := false
+		err := a.names.View(func(names map[string]string) {
+			for _, k := range names {
+				if k == key {
+					used = true
+					return
+				}
+			}
+		})
+		if err != nil || used {
+			return false, err
+		}
+		if err := a.Storage.Remove(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+		return false, nil
+	})
+}
+
+// Create writes to a part file of its own, hashing as it goes, and stores
+// it by content on Close.
+func (a Addressed) Create(name string) (io.WriteCloser, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	key = "create-" + key
+	w, err := a.Storage.OpenPart(key, true)
+	if err != nil {
+		return nil, err
+	}
+	return &addressedWriter{a: a, name: name, key: key, w: w, h: sha256.New()}, nil
+}
+
+type addressedWriter struct {
+	a    Addressed
+	name string
+	key  string // of the part file
+	w    io.WriteCloser
+	h    hash.Hash
+}
+
+func (w *addressedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	return n, err
+}
+
+func (w *addressedWriter) Close() error {
+	err := w.w.Close()
+	if err == nil {
+		_, err = w.a.store(w.key, w.name, ContentKey(w.h.Sum(nil)))
+	}
+	if err != nil {
+		if rmErr := w.a.Storage.RemovePart(w.key); rmErr != nil {
+			slog.Warn("cannot remove part", "key", w.key, "error", rmErr)
+		}
+	}
+	return err
+}
+
+// Remove forgets name and deletes its object unless another name has the
+// same content.
+func (a Addressed) Remove(name string) error {
+	var key string
+	err := a.names.Update(func(names map[string]string) (bool, error) {
+		var ok bool
+		if key, ok = names[name]; !ok {
+			return false, &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+		}
+		delete(names, name)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	return a.removeUnused(key)
+}
@@ -0,0 +1,673 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Azure Blob Storage backend (STORAGE_BACKEND=azure)
+// ---------------------------------------------------------------------
+// Completed files are block blobs. Like Object, part files are assembled
+// on local disk. With StreamBlocks, what each write appends to a part
+// file is staged as one block (Put Block) once written, and Finalize
+// commits the blocks in order (Put Block List), so the blob appears all
+// at once. Otherwise Finalize stages each chunk of the upload as a block
+// and commits them.
+
+const (
+	BackendAzure = "azure"
+
+	AzureAPIVersion = "2020-12-06" // x-ms-version of every request
+
+	AzureAuthKey      = "key"              // Shared Key, with AZURE_STORAGE_KEY
+	AzureAuthSAS      = "sas"              // AZURE_SAS_TOKEN appended to every request
+	AzureAuthIdentity = "managed-identity" // Microsoft Entra tokens of the VM's or app's identity
+
+	AzureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// AzureMaxChunkBlock is the largest chunk staged as a block of its
+	// own; uploads with larger chunks are staged in ObjectPartSize blocks.
+	AzureMaxChunkBlock = 100 << 20
+	AzureMaxBlocks     = 50000 // per blob
+
+	azureResource = "https://storage.azure.com/"
+)
+
+// AzureConfig locates the container for the azure backend.
+type AzureConfig struct {
+	Account   string // AZURE_STORAGE_ACCOUNT
+	Container string // AZURE_CONTAINER
+	Endpoint  string // AZURE_BLOB_ENDPOINT, "" = https://<account>.blob.core.windows.net
+	Prefix    string // AZURE_PREFIX, prepended to every blob name
+	Auth      string // AZURE_AUTH: key, sas or managed-identity
+
+	AccountKey []byte // AZURE_STORAGE_KEY, decoded from base64
+	SASToken   string // AZURE_SAS_TOKEN, without the leading ?
+
+	ClientID         string // AZURE_CLIENT_ID of a user-assigned identity, "" = the system-assigned one
+	IdentityEndpoint string // IDENTITY_ENDPOINT of App Service and Container Apps, "" = AzureIMDSTokenURL
+	IdentityHeader   string // IDENTITY_HEADER sent to IdentityEndpoint
+}
+
+// Azure keeps part files on disk (embedded Disk) and completed files in
+// a blob container.
+type Azure struct {
+	Disk
+	client *azureClient
+
+	// StreamBlocks stages the part files written by appending in the
+	// container as they grow, for the completed file named by their Meta.
+	// Only for callers that finalize them under that name unchanged:
+	// not under Encrypted, Mapped or Addressed.
+	StreamBlocks bool
+}
+
+// NewAzure stores completed files in the container of ac, assembling
+// parts on disk first.
+func NewAzure(ac AzureConfig, parts Disk) Azure {
+	return Azure{Disk: parts, client: &azureClient{cfg: ac, http: &http.Client{Timeout: ObjectReqTimeout}, now: time.Now}}
+}
+
+func (a Azure) key(name string) string { return a.client.cfg.Prefix + name }
+
+func (a Azure) Finalize(key, name string) (string, error) {
+	location := a.client.blobURL(a.key(name), nil).String()
+	if done, err := a.finishStream(key, name); done || err != nil {
+		return location, err
+	}
+	f, err := os.Open(a.partPath(key))
+	if err != nil {
+		return location, err
+	}
+	defer f.Close()
+	var sizes []int64
+	if meta, err := a.Disk.LoadMeta(key); err == nil {
+		sizes = chunkBlocks(meta, f)
+	}
+	if err := a.client.upload(a.key(name), f, sizes); err != nil {
+		return location, err
+	}
+	f.Close()
+	if err := a.RemovePart(key); err != nil {
+		slog.Warn("cannot remove uploaded part", "file", name, "error", err)
+	}
+	return location, nil
+}
+
+// OpenPart opens the part file as Disk does. Starting it over forgets
+// the blocks staged for it; with StreamBlocks, closing the writer stages
+// what was appended.
+func (a Azure) OpenPart(name string, truncate bool) (io.WriteCloser, error) {
+	if truncate {
+		a.dropStream(name)
+	}
+	w, err := a.Disk.OpenPart(name, truncate)
+	if err != nil || !a.StreamBlocks {
+		return w, err
+	}
+	return &streamWriter{WriteCloser: w, name: name, send: func() error {
+		_, err := a.stageBlocks(name)
+		return err
+	}}, nil
+}
+
+// TruncatePart cuts the part file back as Disk does, and forgets the
+// staged blocks that reach past size so they are staged again once
+// rewritten.
+func (a Azure) TruncatePart(name string, size int64) error {
+	if err := a.Disk.TruncatePart(name, size); err != nil {
+		return err
+	}
+	meta, err := a.Disk.LoadMeta(name)
+	if err != nil || meta.Stream == nil {
+		return nil
+	}
+	var end int64
+	for i, n := range meta.Stream.Blocks {
+		if end += n; end > size {
+			meta.Stream.Blocks = meta.Stream.Blocks[:i]
+			return a.Disk.SaveMeta(name, meta)
+		}
+	}
+	return nil
+}
+
+// SaveMeta saves meta as Disk does, keeping the stream stored for name.
+func (a Azure) SaveMeta(name string, meta *Meta) error {
+	return saveKeepingStream(a.Disk, name, meta)
+}
+
+// RemovePart discards the part file and forgets its staged blocks,
+// which Azure drops after a week unless committed.
+func (a Azure) RemovePart(name string) error {
+	a.dropStream(name)
+	return a.Disk.RemovePart(name)
+}
+
+// stageBlocks stages the bytes of part file name past the blocks staged
+// so far, as one block or, past AzureMaxChunkBlock, several; the first
+// starts the stream of the file its Meta names. A blob that would need
+// more than AzureMaxBlocks is left to Finalize to stage whole.
+func (a Azure) stageBlocks(name string) (*PartStream, error) {
+	meta, err := a.Disk.LoadMeta(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil // not an upload's part, e.g. a compressed copy
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(a.partPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	st := meta.Stream
+	if st == nil {
+		if meta.FileName == "" || fi.Size() == 0 {
+			return nil, nil
+		}
+		id, err := newKey()
+		if err != nil {
+			return nil, err
+		}
+		st = &PartStream{Name: meta.FileName, ID: id}
+		meta.Stream = st
+	}
+	var staged int64
+	for _, n := range st.Blocks {
+		staged += n
+	}
+	var buf []byte
+	for staged < fi.Size() {
+		if len(st.Blocks) == AzureMaxBlocks {
+			a.dropStream(name)
+			return nil, nil
+		}
+		n := min(fi.Size()-staged, AzureMaxChunkBlock)
+		if int64(len(buf)) < n {
+			buf = make([]byte, n)
+		}
+		if _, err := f.ReadAt(buf[:n], staged); err != nil {
+			return st, err
+		}
+		if err := a.client.stageBlock(a.key(st.Name), azureBlockID(st.ID, len(st.Blocks)), buf[:n]); err != nil {
+			return st, err
+		}
+		st.Blocks = append(st.Blocks, n)
+		staged += n
+		if err := a.Disk.SaveMeta(name, meta); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+// finishStream commits the blocks staged from part key, reporting
+// whether there were any for name. A stream into another name, as when
+// a wrapper renamed the file, is forgotten for Finalize to stage it whole.
+func (a Azure) finishStream(key, name string) (bool, error) {
+	meta, err := a.Disk.LoadMeta(key)
+	if err != nil || meta.Stream == nil {
+		return false, nil
+	}
+	if meta.Stream.Name != name {
+		a.dropStream(key)
+		return false, nil
+	}
+	st, err := a.stageBlocks(key)
+	if err != nil || st == nil {
+		return err != nil, err
+	}
+	ids := make([]string, len(st.Blocks))
+	for i := range ids {
+		ids[i] = azureBlockID(st.ID, i)
+	}
+	if err := a.client.commitBlocks(a.key(name), ids); err != nil {
+		// The next try starts over, staging the file whole.
+		a.dropStream(key)
+		return true, err
+	}
+	if err := a.Disk.RemovePart(key); err != nil {
+		slog.Warn("cannot remove uploaded part", "file", name, "error", err)
+	}
+	return true, nil
+}
+
+// dropStream forgets the blocks staged from part name, if any.
+func (a Azure) dropStream(name string) {
+	meta, err := a.Disk.LoadMeta(name)
+	if err != nil || meta.Stream == nil {
+		return
+	}
+	meta.Stream = nil
+	if err := a.Disk.SaveMeta(name, meta); err != nil {
+		slog.Warn("cannot save upload metadata", "key", name, "error", err)
+	}
+}
+
+// chunkBlocks returns the sizes of chunks 0..n-1 of meta when they make
+// up the part file f exactly and each fits in a block; otherwise nil. A
+// part that was transformed after upload (e.g. encrypted) does not match.
+func chunkBlocks(meta *Meta, f *os.File) []int64 {
+	n := len(meta.Received)
+	if n == 0 || n > AzureMaxBlocks {
+		return nil
+	}
+	sizes := make([]int64, n)
+	var total int64
+	for i := range sizes {
+		size, ok := meta.Received[i]
+		if !ok || size <= 0 || size > AzureMaxChunkBlock {
+			return nil
+		}
+		sizes[i] = size
+		total += size
+	}
+	if st, err := f.Stat(); err != nil || st.Size() != total {
+		return nil
+	}
+	return sizes
+}
+
+func (a Azure) Open(name string) (io.ReadSeekCloser, error) {
+	size, _, err := a.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	key := a.key(name)
+	return &objectReader{size: size, get: func(pos int64) (io.ReadCloser, error) {
+		resp, err := a.client.do(http.MethodGet, key, nil, http.Header{"X-Ms-Range": {fmt.Sprintf("bytes=%d-", pos)}}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}}, nil
+}
+
+// Create buffers the blob in TempDir and uploads it on Close.
+func (a Azure) Create(name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp(a.TempDir, name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	key := a.key(name)
+	return &objectWriter{File: f, upload: func(r io.Reader) error { return a.client.upload(key, r, nil) }}, nil
+}
+
+func (a Azure) Remove(name string) error {
+	resp, err := a.client.do(http.MethodDelete, a.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (a Azure) Stat(name string) (int64, time.Time, error) {
+	resp, err := a.client.do(http.MethodHead, a.key(name), nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+func (a Azure) List() ([]FileInfo, error) {
+	return a.client.list(a.client.cfg.Prefix)
+}
+
+// Check checks the part directories, then that the container answers an
+// authorized request: a missing blob is fine, a refusal is not.
+func (a Azure) Check() error {
+	if err := a.Disk.Check(); err != nil {
+		return err
+	}
+	_, _, err := a.Stat(WriteCheckPrefix + "probe")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------
+// Minimal Blob service REST client (Shared Key, SAS or bearer tokens)
+// ---------------------------------------------------------------------
+type azureClient struct {
+	cfg  AzureConfig
+	http *http.Client
+	now  func() time.Time
+
+	mu      sync.Mutex // guards the managed identity's token
+	token   string
+	expires time.Time
+}
+
+// azureError is a non-2xx response; Code comes from the XML error body,
+// or from x-ms-error-code for HEAD requests, which have none.
+type azureError struct {
+	Status int
+	Code   string `xml:"Code"`
+	Msg    string `xml:"Message"`
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("blob storage: HTTP %d %s: %s", e.Status, e.Code, e.Msg)
+}
+
+// Is lets callers test a missing blob with errors.Is(err, fs.ErrNotExist)
+// and a refused block list with errors.Is(err, ErrInvalidParts).
+func (e *azureError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Status == http.StatusNotFound
+	case ErrInvalidParts:
+		return e.Code == "InvalidBlockList" || e.Code == "InvalidBlockId"
+	}
+	return false
+}
+
+// blobURL returns the URL of the blob key, or of the container for "".
+func (c *azureClient) blobURL(key string, query url.Values) *url.URL {
+	u, _ := url.Parse(cmp.Or(c.cfg.Endpoint, "https://"+c.cfg.Account+".blob.core.windows.net"))
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.cfg.Container
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	return u
+}
+
+// do sends an authorized request and turns non-2xx responses into
+// *azureError.
+func (c *azureClient) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	if c.cfg.Auth == AzureAuthSAS {
+		sas, err := url.ParseQuery(c.cfg.SASToken)
+		if err != nil {
+			return nil, fmt.Errorf("blob storage: SAS token: %w", err)
+		}
+		if query == nil {
+			query = url.Values{}
+		}
+		for k, v := range sas {
+			query[k] = v
+		}
+	}
+	req, err := http.NewRequest(method, c.blobURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("X-Ms-Version", AzureAPIVersion)
+	req.Header.Set("X-Ms-Date", c.now().UTC().Format(http.TimeFormat))
+	switch c.cfg.Auth {
+	case AzureAuthKey:
+		c.signSharedKey(req)
+	case AzureAuthIdentity:
+		token, err := c.identityToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		e := &azureError{Status: resp.StatusCode}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e)
+		e.Code = cmp.Or(e.Code, resp.Header.Get("X-Ms-Error-Code"))
+		return nil, e
+	}
+	return resp, nil
+}
+
+// signSharedKey adds the Shared Key Authorization header to req, whose
+// x-ms-date is set.
+func (c *azureClient) signSharedKey(req *http.Request) {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var names []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var canon strings.Builder
+	for _, k := range names {
+		canon.WriteString(k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n")
+	}
+	canon.WriteString("/" + c.cfg.Account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		canon.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date: x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canon.String(),
+	}, "\n")
+	mac := hmac.New(sha256.New, c.cfg.AccountKey)
+	mac.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+c.cfg.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// identityToken returns a bearer token for Blob storage from the managed
+// identity endpoint, fetching a new one 5 minutes before it expires.
+func (c *azureClient) identityToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && c.now().Before(c.expires.Add(-credentialRefresh)) {
+		return c.token, nil
+	}
+	q := url.Values{"resource": {azureResource}}
+	if c.cfg.ClientID != "" {
+		q.Set("client_id", c.cfg.ClientID)
+	}
+	endpoint := cmp.Or(c.cfg.IdentityEndpoint, AzureIMDSTokenURL)
+	header := http.Header{"Metadata": {"true"}}
+	q.Set("api-version", "2018-02-01")
+	if c.cfg.IdentityHeader != "" {
+		// App Service, Functions and Container Apps.
+		header = http.Header{"X-Identity-Header": {c.cfg.IdentityHeader}}
+		q.Set("api-version", "2019-08-01")
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = header
+	client := &http.Client{Timeout: credentialTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("managed identity: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("managed identity: %s: HTTP %d", endpoint, resp.StatusCode)
+	}
+	var doc struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresOn   json.RawMessage `json:"expires_on"` // seconds since the epoch, as a string or a number
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&doc); err != nil || doc.AccessToken == "" {
+		return "", fmt.Errorf("managed identity: bad token response: %v", err)
+	}
+	expires, err := strconv.ParseInt(strings.Trim(string(doc.ExpiresOn), `"`), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("managed identity: bad expires_on %s", doc.ExpiresOn)
+	}
+	c.token, c.expires = doc.AccessToken, time.Unix(expires, 0)
+	return c.token, nil
+}
+
+// upload stores r under key: one Put Blob for small files, otherwise a
+// block of each of sizes (ObjectPartSize bytes each for nil) and a
+// Put Block List. Blocks left uncommitted by a failure are discarded by
+// the service after a week, or by the next commit to key.
+func (c *azureClient) upload(key string, r io.Reader, sizes []int64) error {
+	var (
+		buf []byte
+		ids []string
+	)
+	prefix, err := newKey()
+	if err != nil {
+		return err
+	}
+	for i := 0; sizes == nil || i < len(sizes); i++ {
+		want := int64(ObjectPartSize)
+		if sizes != nil {
+			want = sizes[i]
+		}
+		if int64(len(buf)) < want {
+			buf = make([]byte, want)
+		}
+		n, err := io.ReadFull(r, buf[:want])
+		short := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && (!short || sizes != nil) {
+			return err
+		}
+		if i == 0 && (short || len(sizes) == 1) {
+			resp, err := c.do(http.MethodPut, key, nil, http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}, buf[:n])
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		}
+		if n == 0 {
+			break
+		}
+		id := azureBlockID(prefix, i)
+		if err := c.stageBlock(key, id, buf[:n]); err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+		ids = append(ids, id)
+		if short {
+			break
+		}
+	}
+	return c.commitBlocks(key, ids)
+}
+
+// azureBlockID names block i of an upload whose blocks are named after
+// prefix, so uploads of the same blob cannot replace each other's. Every
+// block ID of a blob must have the same length.
+func azureBlockID(prefix string, i int) string {
+	return base64.StdEncoding.EncodeToString(fmt.Appendf(nil, "%s-%06d", prefix, i))
+}
+
+// stageBlock stores body as the uncommitted block id of the blob key.
+func (c *azureClient) stageBlock(key, id string, body []byte) error {
+	resp, err := c.do(http.MethodPut, key, url.Values{"comp": {"block"}, "blockid": {id}}, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// commitBlocks joins the staged blocks ids, in order, into the blob key.
+func (c *azureClient) commitBlocks(key string, ids []string) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPut, key, url.Values{"comp": {"blocklist"}}, nil, append([]byte(xml.Header), body...))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns the blobs under prefix, with prefix stripped from their
+// names, following NextMarker.
+func (c *azureClient) list(prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := c.do(http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name         string `xml:"Name"`
+				Size         int64  `xml:"Properties>Content-Length"`
+				LastModified string `xml:"Properties>Last-Modified"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("blob storage: bad List Blobs response: %v", err)
+		}
+		for _, b := range result.Blobs {
+			modTime, _ := http.ParseTime(b.LastModified)
+			files = append(files, FileInfo{Name: strings.TrimPrefix(b.Name, prefix), Size: b.Size, ModTime: modTime})
+		}
+		if result.NextMarker == "" {
+			return files, nil
+		}
+		marker = result.NextMarker
+	}
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Credential chain (S3_CREDENTIALS): where the object storage and KMS
+// clients get their keys, tried in order until one has them
+// ---------------------------------------------------------------------
+
+const (
+	CredentialsKeys      = "keys"      // S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and S3_SESSION_TOKEN
+	CredentialsFile      = "file"      // a profile of the shared credentials file
+	CredentialsContainer = "container" // the ECS / EKS Pod Identity credentials endpoint
+	CredentialsIMDS      = "imds"      // the EC2 instance role, through IMDSv2
+
+	DefaultMetadataURL = "http://169.254.169.254"
+	DefaultProfile     = "default"
+
+	credentialTimeout = 2 * time.Second
+	credentialRefresh = 5 * time.Minute // before expiry
+)
+
+// DefaultCredentials is the chain used when S3_CREDENTIALS is unset.
+var DefaultCredentials = []string{CredentialsKeys, CredentialsFile, CredentialsContainer, CredentialsIMDS}
+
+// CredentialConfig says where to look for keys besides the static ones.
+type CredentialConfig struct {
+	Sources        []string // S3_CREDENTIALS, nil = the static keys only
+	Profile        string   // S3_PROFILE / AWS_PROFILE, "" = default
+	File           string   // S3_CREDENTIALS_FILE / AWS_SHARED_CREDENTIALS_FILE, "" = ~/.aws/credentials
+	ContainerURI   string   // AWS_CONTAINER_CREDENTIALS_FULL_URI, or RELATIVE_URI on 169.254.170.2
+	ContainerToken string   // AWS_CONTAINER_AUTHORIZATION_TOKEN
+	TokenFile      string   // AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE, read on each fetch
+	MetadataURL    string   // AWS_EC2_METADATA_SERVICE_ENDPOINT, "" = DefaultMetadataURL
+}
+
+// Credentials sign requests. Temporary ones carry a SessionToken and
+// expire.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expires      time.Time // zero = never
+	Source       string    // the chain entry they came from
+}
+
+// errNoCredentials means a source has nothing to offer, so the next one
+// is tried.
+var errNoCredentials = errors.New("no credentials")
+
+// credentialChain resolves and caches credentials, fetching new ones
+// shortly before temporary ones expire.
+type credentialChain struct {
+	static Credentials
+	cfg    CredentialConfig
+	http   *http.Client
+	now    func() time.Time
+
+	mu  sync.Mutex
+	cur Credentials
+}
+
+func newCredentialChain(static Credentials, cfg CredentialConfig) *credentialChain {
+	return &credentialChain{static: static, cfg: cfg, http: &http.Client{Timeout: credentialTimeout}, now: time.Now}
+}
+
+// get returns the cached credentials while they are valid, else walks the
+// chain again.
+func (c *credentialChain) get() (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cur.AccessKey != "" && (c.cur.Expires.IsZero() || c.now().Before(c.cur.Expires.Add(-credentialRefresh))) {
+		return c.cur, nil
+	}
+	sources := c.cfg.Sources
+	if len(sources) == 0 {
+		sources = []string{CredentialsKeys}
+	}
+	var errs []error
+	for _, source := range sources {
+		creds, err := c.fetch(source)
+		if err == nil && (creds.AccessKey == "" || creds.SecretKey == "") {
+			err = errNoCredentials
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+			continue
+		}
+		if source != CredentialsKeys && source != c.cur.Source {
+			slog.Info("object store credentials", "source", source, "expires", creds.Expires)
+		}
+		creds.Source = source
+		c.cur = creds
+		return creds, nil
+	}
+	return Credentials{}, fmt.Errorf("object store credentials: %w", errors.Join(errs...))
+}
+
+func (c *credentialChain) fetch(source string) (Credentials, error) {
+	switch source {
+	case CredentialsKeys:
+		return c.static, nil
+	case CredentialsFile:
+		return c.fromFile()
+	case CredentialsContainer:
+		return c.fromContainer()
+	case CredentialsIMDS:
+		return c.fromIMDS()
+	}
+	return Credentials{}, fmt.Errorf("unknown source %q", source)
+}
+
+// fromFile reads the profile's keys from the shared credentials file, an
+// INI file of [profile] sections.
+func (c *credentialChain) fromFile() (Credentials, error) {
+	path := c.cfg.File
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, errNoCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Credentials{}, errNoCredentials
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer f.Close()
+	profile := cmp.Or(c.cfg.Profile, DefaultProfile)
+	var creds Credentials
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			k, v, _ := strings.Cut(line, "=")
+			switch strings.TrimSpace(k) {
+			case "aws_access_key_id":
+				creds.AccessKey = strings.TrimSpace(v)
+			case "aws_secret_access_key":
+				creds.SecretKey = strings.TrimSpace(v)
+			case "aws_session_token":
+				creds.SessionToken = strings.TrimSpace(v)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return Credentials{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// fromContainer asks the credentials endpoint ECS and EKS Pod Identity
+// give each task.
+func (c *credentialChain) fromContainer() (Credentials, error) {
+	if c.cfg.ContainerURI == "" {
+		return Credentials{}, errNoCredentials
+	}
+	req, err := http.NewRequest(http.MethodGet, c.cfg.ContainerURI, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	token := c.cfg.ContainerToken
+	if c.cfg.TokenFile != "" {
+		// EKS Pod Identity rotates the file.
+		b, err := os.ReadFile(c.cfg.TokenFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return c.fetchJSON(req)
+}
+
+// fromIMDS gets the instance role's credentials from the EC2 instance
+// metadata service, with an IMDSv2 session token.
+func (c *credentialChain) fromIMDS() (Credentials, error) {
+	base := strings.TrimSuffix(cmp.Or(c.cfg.MetadataURL, DefaultMetadataURL), "/")
+	req, err := http.NewRequest(http.MethodPut, base+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := c.read(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	roles := base + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest(http.MethodGet, roles, nil)
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	role, err := c.read(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	if name == "" {
+		return Credentials{}, errNoCredentials
+	}
+	req, _ = http.NewRequest(http.MethodGet, roles+name, nil)
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+	return c.fetchJSON(req)
+}
+
+// fetchJSON reads the credentials document the container endpoint and
+// IMDS both return.
+func (c *credentialChain) fetchJSON(req *http.Request) (Credentials, error) {
+	body, err := c.read(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var doc struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return Credentials{}, fmt.Errorf("%s: %w", req.URL, err)
+	}
+	return Credentials{AccessKey: doc.AccessKeyID, SecretKey: doc.SecretAccessKey, SessionToken: doc.Token, Expires: doc.Expiration}, nil
+}
+
+func (c *credentialChain) read(req *http.Request) ([]byte, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: HTTP %d", req.Method, req.URL, resp.StatusCode)
+	}
+	return body, nil
+}
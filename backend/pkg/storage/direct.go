@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Direct uploads (DIRECT_UPLOAD): clients PUT the parts of a multipart
+// upload straight to the bucket through pre-signed URLs, and the server
+// only starts and completes it
+// ---------------------------------------------------------------------
+
+// Multipart limits of S3 (GCS's XML API has the same).
+const (
+	MinMultipartPart  = 5 << 20 // bytes in every part but the last
+	MaxMultipartParts = 10000
+	MaxPresignTTL     = 7 * 24 * time.Hour // longest X-Amz-Expires allowed
+)
+
+// ErrInvalidParts is matched by errors.Is when the object store refuses
+// to complete a multipart upload because of its parts: unknown or
+// mismatched ETags, parts out of order or too small.
+var ErrInvalidParts = errors.New("object store: invalid parts")
+
+// ObjectPart is one uploaded part of a multipart upload.
+type ObjectPart struct {
+	PartNumber int    `json:"partNumber"`     // 1-based
+	ETag       string `json:"etag,omitempty"` // as returned by the part's PUT
+}
+
+// DirectUploader runs multipart uploads whose parts clients send to the
+// bucket themselves.
+type DirectUploader interface {
+	// CreateMultipart starts a multipart upload of the completed file name
+	// and returns its ID.
+	CreateMultipart(name string) (string, error)
+	// PresignPart returns a URL a client can PUT part number of uploadID
+	// to, without credentials, for ttl.
+	PresignPart(name, uploadID string, number int, ttl time.Duration) (string, error)
+	// CompleteMultipart joins parts into the completed file name and
+	// returns its location.
+	CompleteMultipart(name, uploadID string, parts []ObjectPart) (string, error)
+	// AbortMultipart discards uploadID and the parts stored so far.
+	AbortMultipart(name, uploadID string) error
+}
+
+// DirectUploads returns st as a DirectUploader, looking through Cached:
+// ok is false for backends whose files are not in a bucket, and for
+// wrappers that must see every byte (Encrypted, Mapped, Addressed).
+func DirectUploads(st Storage) (DirectUploader, bool) {
+	if c, ok := st.(Cached); ok {
+		st = c.Storage
+	}
+	d, ok := st.(DirectUploader)
+	return d, ok
+}
+
+// MultipartLayout returns the part size and count for a direct upload of
+// size bytes: partSize rounded up to MinMultipartPart, and larger still
+// when MaxMultipartParts parts would not hold size.
+func MultipartLayout(size, partSize int64) (int64, int) {
+	partSize = max(partSize, MinMultipartPart, (size+MaxMultipartParts-1)/MaxMultipartParts)
+	parts := max(int((size+partSize-1)/partSize), 1)
+	return partSize, parts
+}
+
+func (o Object) CreateMultipart(name string) (string, error) {
+	return o.client.createMultipart(o.key(name))
+}
+
+func (o Object) PresignPart(name, uploadID string, number int, ttl time.Duration) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	return o.client.presign(http.MethodPut, o.key(name), q, ttl)
+}
+
+func (o Object) CompleteMultipart(name, uploadID string, parts []ObjectPart) (string, error) {
+	location := o.scheme + "://" + o.client.cfg.Bucket + "/" + o.key(name)
+	return location, o.client.completeMultipart(o.key(name), uploadID, parts)
+}
+
+func (o Object) AbortMultipart(name, uploadID string) error {
+	return o.client.abortMultipart(o.key(name), uploadID)
+}
+
+// presign returns a URL for method on key with query that works without
+// credentials for ttl (SigV4 query-string authentication). The payload is
+// unsigned, so the URL accepts any body.
+func (c *s3Client) presign(method, key string, query url.Values, ttl time.Duration) (string, error) {
+	creds, err := c.credentials()
+	if err != nil {
+		return "", err
+	}
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	service := cmp.Or(c.service, "s3")
+	scope := amzDate[:8] + "/" + c.cfg.Region + "/" + service + "/aws4_request"
+
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", creds.AccessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(min(ttl, MaxPresignTTL)/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if creds.SessionToken != "" {
+		q.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	u := c.objectURL(key, nil)
+	canonical := strings.Join([]string{
+		method,
+		sigv4Escape(u.Path, false),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	canonSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonSum[:])
+	q.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(c.signingKey(creds, amzDate[:8], service), toSign)))
+
+	u.RawPath = sigv4Escape(u.Path, false)
+	u.RawQuery = canonicalQuery(q)
+	return u.String(), nil
+}
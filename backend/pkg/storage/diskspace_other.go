@@ -0,0 +1,8 @@
+//go:build !unix
+
+package storage
+
+// freeSpace is not implemented on this platform; -1 means unknown.
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
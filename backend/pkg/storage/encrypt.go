@@ -0,0 +1,598 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Encryption at rest (ENCRYPTION_KEY, ENCRYPTION_KEY_FILE or KMS_KEY_ID)
+// ---------------------------------------------------------------------
+// Every completed file is encrypted with its own random AES-256 data key
+// and stored as name.enc. Data keys are wrapped by the master key (or by
+// AWS KMS) and kept in KeyTable; the master key itself is never stored.
+// Downloads, hashing and compression see the plaintext, so everything
+// above Storage is unaware of encryption. Files stored before it was
+// enabled stay readable as they are.
+
+const (
+	KeyTable     = ".keys.json"
+	EncryptedExt = ".enc"
+
+	// Files are sealed in segments so a Range request decrypts only the
+	// segments it covers.
+	encSegmentSize = 64 << 10
+	encTagSize     = 16
+	encIDSize      = 16
+	encHeaderSize  = len(encMagic) + encIDSize
+
+	KMSReqTimeout = 30 * time.Second
+)
+
+// encMagic starts every encrypted file; the version implies the segment
+// size.
+const encMagic = "CUE1"
+
+// KeyWrapper protects data keys with a master key held elsewhere, e.g. a
+// KMS. NewLocalKeyWrapper and NewKMSKeyWrapper are built in.
+type KeyWrapper interface {
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// ParseEncryptionKey reads a 32-byte master key given as hex or base64.
+func ParseEncryptionKey(v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	key, err := hex.DecodeString(v)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return nil, fmt.Errorf("want 32 bytes, hex or base64 encoded")
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("got %d bytes, want 32 (AES-256)", len(key))
+	}
+	return key, nil
+}
+
+// localKeyWrapper wraps data keys with AES-256-GCM under the configured
+// master key.
+type localKeyWrapper struct {
+	aead cipher.AEAD
+	err  error // a master key of the wrong size fails every call
+}
+
+// NewLocalKeyWrapper wraps data keys with master, a 32-byte key.
+func NewLocalKeyWrapper(master []byte) KeyWrapper {
+	aead, err := newGCM(master)
+	return localKeyWrapper{aead: aead, err: err}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (l localKeyWrapper) WrapKey(key []byte) ([]byte, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (l localKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	n := l.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, errors.New("wrapped key too short")
+	}
+	key, err := l.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, errors.New("cannot unwrap data key: wrong master key?")
+	}
+	return key, nil
+}
+
+// KMSConfig selects the AWS KMS key that wraps data keys.
+type KMSConfig struct {
+	KeyID        string // KMS_KEY_ID: key ID, ARN or alias/name
+	Region       string // KMS_REGION, default S3_REGION or us-east-1
+	Endpoint     string // KMS_ENDPOINT, "" = https://kms.<region>.amazonaws.com
+	AccessKey    string // S3_ACCESS_KEY_ID / AWS_ACCESS_KEY_ID
+	SecretKey    string // S3_SECRET_ACCESS_KEY / AWS_SECRET_ACCESS_KEY
+	SessionToken string // S3_SESSION_TOKEN / AWS_SESSION_TOKEN
+	Chain        CredentialConfig
+}
+
+// kmsKeyWrapper calls the KMS Encrypt and Decrypt actions, signed with
+// SigV4 like the object storage requests.
+type kmsKeyWrapper struct {
+	keyID    string
+	endpoint string
+	client   *s3Client
+}
+
+// NewKMSKeyWrapper wraps data keys with the AWS KMS key kc.KeyID.
+func NewKMSKeyWrapper(kc KMSConfig) KeyWrapper {
+	endpoint := kc.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + kc.Region + ".amazonaws.com"
+	}
+	return kmsKeyWrapper{
+		keyID:    kc.KeyID,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/",
+		client: &s3Client{
+			cfg:     ObjectConfig{Region: kc.Region},
+			creds:   newCredentialChain(Credentials{AccessKey: kc.AccessKey, SecretKey: kc.SecretKey, SessionToken: kc.SessionToken}, kc.Chain),
+			http:    &http.Client{Timeout: KMSReqTimeout},
+			now:     time.Now,
+			service: "kms",
+		},
+	}
+}
+
+func (k kmsKeyWrapper) WrapKey(key []byte) ([]byte, error) {
+	var out struct{ CiphertextBlob []byte }
+	err := k.call("Encrypt", map[string]any{"KeyId": k.keyID, "Plaintext": key}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (k kmsKeyWrapper) UnwrapKey(wrapped []byte) ([]byte, error) {
+	var out struct{ Plaintext []byte }
+	err := k.call("Decrypt", map[string]any{"KeyId": k.keyID, "CiphertextBlob": wrapped}, &out)
+	return out.Plaintext, err
+}
+
+// call sends one KMS JSON request. []byte fields travel as base64, which
+// is how KMS encodes blobs.
+func (k kmsKeyWrapper) call(action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	sum := sha256.Sum256(body)
+	if err := k.client.sign(req, hex.EncodeToString(sum[:]), k.client.now().UTC()); err != nil {
+		return fmt.Errorf("kms %s: %w", action, err)
+	}
+
+	resp, err := k.client.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+		return fmt.Errorf("kms %s: HTTP %d %s: %s", action, resp.StatusCode, e.Type, e.Message)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("kms %s: %w", action, err)
+	}
+	return nil
+}
+
+// keyEntry is the wrapped data key of one encrypted file.
+type keyEntry struct {
+	Name string `json:"name"` // file it encrypts, as named in storage
+	Key  []byte `json:"key"`  // wrapped by the master key
+}
+
+// keyTable maps the ID in each encrypted file's header to its data key.
+// Being a Table, replicas sharing dir add and drop keys without losing
+// each other's.
+type keyTable struct {
+	*Table[keyEntry]
+}
+
+func newKeyTable(dir string, mode os.FileMode) *keyTable {
+	return &keyTable{NewTable[keyEntry]("key table", filepath.Join(dir, KeyTable), mode)}
+}
+
+// add records a data key before the file using it is written, so a crash
+// never leaves a file without its key.
+func (t *keyTable) add(id string, e keyEntry) error {
+	return t.Set(id, e)
+}
+
+func (t *keyTable) lookup(id string) (keyEntry, bool, error) {
+	return t.Get(id)
+}
+
+// drop forgets the keys of name, except keep (the file now stored under
+// it, "" = none).
+func (t *keyTable) drop(name, keep string) error {
+	return t.Update(func(keys map[string]keyEntry) (bool, error) {
+		changed := false
+		for id, e := range keys {
+			if e.Name == name && id != keep {
+				delete(keys, id)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// Encrypted wraps a Storage so completed files are encrypted at
+// rest. Part files are unaffected.
+type Encrypted struct {
+	Storage
+	keys    *keyTable
+	wrapper KeyWrapper
+}
+
+// NewEncrypted encrypts the completed files of st, keeping their data
+// keys in KeyTable inside dir.
+func NewEncrypted(st Storage, wrapper KeyWrapper, dir string, mode os.FileMode) Encrypted {
+	return Encrypted{Storage: st, keys: newKeyTable(dir, mode), wrapper: wrapper}
+}
+
+// newDataKey generates, wraps and records a data key for name.
+func (e Encrypted) newDataKey(name string) (id string, aead cipher.AEAD, err error) {
+	key := make([]byte, 32)
+	rawID := make([]byte, encIDSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(rawID); err != nil {
+		return "", nil, err
+	}
+	wrapped, err := e.wrapper.WrapKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	id = hex.EncodeToString(rawID)
+	if err := e.keys.add(id, keyEntry{Name: name, Key: wrapped}); err != nil {
+		return "", nil, err
+	}
+	aead, err = newGCM(key)
+	return id, aead, err
+}
+
+// encrypt writes the header of a new file for name to w and returns a
+// writer sealing everything written to it.
+func (e Encrypted) encrypt(w io.WriteCloser, name string) (*encryptWriter, string, error) {
+	id, aead, err := e.newDataKey(name)
+	if err != nil {
+		return nil, "", err
+	}
+	rawID, _ := hex.DecodeString(id)
+	if _, err := w.Write(append([]byte(encMagic), rawID...)); err != nil {
+		return nil, id, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encSegmentSize+encTagSize)}, id, nil
+}
+
+// stored records that the file for name now uses data key id: older keys
+// of name and a plaintext copy from before encryption are dropped.
+func (e Encrypted) stored(name, id string) error {
+	if err := e.Storage.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return e.keys.drop(name, id)
+}
+
+// Finalize encrypts the part into a second part, key.enc, and finalizes
+// that. The plaintext part is kept until this succeeds, so a failed
+// Finalize can be retried.
+func (e Encrypted) Finalize(key, name string) (string, error) {
+	in, err := e.ReadPart(key)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	encKey := key + EncryptedExt
+	out, err := e.OpenPart(encKey, true)
+	if err != nil {
+		return "", err
+	}
+	w, id, err := e.encrypt(out, name)
+	if err == nil {
+		_, err = io.Copy(w, in)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	} else {
+		out.Close()
+	}
+	in.Close()
+	if err != nil {
+		e.RemovePart(encKey)
+		return "", fmt.Errorf("encrypt: %w", err)
+	}
+	path, err := e.Storage.Finalize(encKey, name+EncryptedExt)
+	if err != nil {
+		e.RemovePart(encKey)
+		return path, err
+	}
+	if err := e.stored(name, id); err != nil {
+		return path, err
+	}
+	return path, e.RemovePart(key)
+}
+
+// Open decrypts name.enc, or opens a plaintext file stored before
+// encryption was enabled.
+func (e Encrypted) Open(name string) (io.ReadSeekCloser, error) {
+	f, err := e.Storage.Open(name + EncryptedExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return e.Storage.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.decrypt(f, name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// decrypt reads the header of f and returns a reader of its plaintext.
+func (e Encrypted) decrypt(f io.ReadSeekCloser, name string) (*decryptReader, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	plain, ok := plainSize(size)
+	if !ok {
+		return nil, fmt.Errorf("%s: truncated encrypted file", name)
+	}
+	header := make([]byte, encHeaderSize)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("%s: not an encrypted file", name)
+	}
+	id := hex.EncodeToString(header[len(encMagic):])
+	entry, ok, err := e.keys.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: no data key %s in %s", name, id, KeyTable)
+	}
+	key, err := e.wrapper.UnwrapKey(entry.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{f: f, aead: aead, size: plain, stored: size, seg: -1}, nil
+}
+
+// Create writes an encrypted name.enc; the plaintext copy and old key of
+// name, if any, are dropped on Close.
+func (e Encrypted) Create(name string) (io.WriteCloser, error) {
+	out, err := e.Storage.Create(name + EncryptedExt)
+	if err != nil {
+		return nil, err
+	}
+	w, id, err := e.encrypt(out, name)
+	if err != nil {
+		out.Close()
+		e.Storage.Remove(name + EncryptedExt)
+		return nil, err
+	}
+	w.done = func() error { return e.stored(name, id) }
+	return w, nil
+}
+
+// Remove deletes name.enc and any plaintext name, and forgets their key.
+func (e Encrypted) Remove(name string) error {
+	encErr := e.Storage.Remove(name + EncryptedExt)
+	err := e.Storage.Remove(name)
+	switch {
+	case encErr != nil && !errors.Is(encErr, fs.ErrNotExist):
+		return encErr
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return err
+	case encErr != nil && err != nil:
+		return encErr // neither existed
+	}
+	return e.keys.drop(name, "")
+}
+
+// Stat reports the plaintext size.
+func (e Encrypted) Stat(name string) (int64, time.Time, error) {
+	size, modTime, err := e.Storage.Stat(name + EncryptedExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return e.Storage.Stat(name)
+	}
+	plain, _ := plainSize(size)
+	return plain, modTime, err
+}
+
+func (e Encrypted) List() ([]FileInfo, error) {
+	files, err := e.Storage.List()
+	for i, f := range files {
+		if name, ok := strings.CutSuffix(f.Name, EncryptedExt); ok && name != "" {
+			files[i].Name = name
+			files[i].Size, _ = plainSize(f.Size)
+		}
+	}
+	return files, err
+}
+
+// plainSize is the plaintext size of an encrypted file of size bytes.
+// Every file has at least one (possibly empty) segment.
+func plainSize(size int64) (int64, bool) {
+	body := size - int64(encHeaderSize)
+	if body < encTagSize {
+		return 0, false
+	}
+	const sealed = encSegmentSize + encTagSize
+	segs := (body + sealed - 1) / sealed
+	plain := body - segs*encTagSize
+	if plain < 0 || (segs > 1 && plain <= (segs-1)*encSegmentSize) {
+		return 0, false
+	}
+	return plain, true
+}
+
+// segmentNonce numbers segments and marks the last, so reordered,
+// dropped or truncated segments fail to open.
+func segmentNonce(seg int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(seg))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals each encSegmentSize bytes written to it. A full
+// segment is held back until more data arrives, since only Close knows
+// which segment is last.
+type encryptWriter struct {
+	w    io.WriteCloser
+	aead cipher.AEAD
+	buf  []byte
+	seg  int64
+	done func() error // after a successful Close
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == encSegmentSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(w.buf[len(w.buf):encSegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	sealed := w.aead.Seal(w.buf[:0], segmentNonce(w.seg, last), w.buf, nil)
+	w.seg++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+func (w *encryptWriter) Close() error {
+	err := w.seal(true)
+	if cerr := w.w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && w.done != nil {
+		err = w.done()
+	}
+	return err
+}
+
+// decryptReader presents an encrypted file as its plaintext, decrypting
+// one segment at a time, so http.ServeContent can answer Range requests
+// without reading the whole file.
+type decryptReader struct {
+	f      io.ReadSeekCloser
+	aead   cipher.AEAD
+	size   int64 // plaintext
+	stored int64 // ciphertext, header included
+	pos    int64
+	seg    int64  // segment held in plain, -1 = none
+	plain  []byte // decrypted segment seg
+	sealed []byte
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("decrypt seek: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	seg := r.pos / encSegmentSize
+	if seg != r.seg {
+		if err := r.load(seg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-seg*encSegmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// load reads and opens segment seg.
+func (r *decryptReader) load(seg int64) error {
+	const sealed = encSegmentSize + encTagSize
+	start := int64(encHeaderSize) + seg*sealed
+	n := min(sealed, r.stored-start)
+	last := start+n == r.stored
+	if _, err := r.f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if r.sealed == nil {
+		r.sealed = make([]byte, sealed)
+	}
+	if _, err := io.ReadFull(r.f, r.sealed[:n]); err != nil {
+		return err
+	}
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(seg, last), r.sealed[:n], nil)
+	if err != nil {
+		r.seg = -1
+		return fmt.Errorf("decrypt segment %d: %w", seg, err)
+	}
+	r.plain, r.seg = plain, seg
+	return nil
+}
+
+func (r *decryptReader) Close() error { return r.f.Close() }
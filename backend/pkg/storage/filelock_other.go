@@ -0,0 +1,11 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable: tables are then only
+// safe within one process.
+func lockFile(path string, mode os.FileMode) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+// ---------------------------------------------------------------------
+// SESSION_CACHE: upload metadata (received chunks, sizes, sessions) read
+// from a cache shared by replicas, e.g. Redis, instead of the part's
+// .part.meta file
+// ---------------------------------------------------------------------
+
+// MetaCache stores encoded Meta by upload key.
+type MetaCache interface {
+	// Get returns the value cached for key, nil when there is none.
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+// Cached wraps a Storage so LoadMeta is answered from Cache. SaveMeta
+// still writes the metadata file first, which stays the record the cache
+// is refilled from; a cache that fails is logged and bypassed.
+type Cached struct {
+	Storage
+	Cache MetaCache
+}
+
+// NewCached returns st with its metadata cached in cache.
+func NewCached(st Storage, cache MetaCache) Cached {
+	return Cached{Storage: st, Cache: cache}
+}
+
+func (c Cached) LoadMeta(name string) (*Meta, error) {
+	data, err := c.Cache.Get(name)
+	if err != nil {
+		slog.Warn("metadata cache: get", "key", name, "error", err)
+	}
+	if data != nil {
+		var meta Meta
+		if err := json.Unmarshal(data, &meta); err == nil {
+			return &meta, nil
+		}
+	}
+	meta, err := c.Storage.LoadMeta(name)
+	if err == nil && data == nil {
+		c.fill(name, meta)
+	}
+	return meta, err
+}
+
+func (c Cached) SaveMeta(name string, meta *Meta) error {
+	if err := c.Storage.SaveMeta(name, meta); err != nil {
+		c.forget(name)
+		return err
+	}
+	c.fill(name, meta)
+	return nil
+}
+
+func (c Cached) RemovePart(name string) error {
+	c.forget(name)
+	return c.Storage.RemovePart(name)
+}
+
+func (c Cached) Finalize(key, name string) (string, error) {
+	path, err := c.Storage.Finalize(key, name)
+	if err == nil {
+		c.forget(key)
+	}
+	return path, err
+}
+
+// fill caches meta for name; when that fails the entry is dropped so it
+// cannot be served stale.
+func (c Cached) fill(name string, meta *Meta) {
+	data, err := json.Marshal(meta)
+	if err == nil {
+		err = c.Cache.Set(name, data)
+	}
+	if err != nil {
+		slog.Warn("metadata cache: set", "key", name, "error", err)
+		c.forget(name)
+	}
+}
+
+func (c Cached) forget(name string) {
+	if err := c.Cache.Delete(name); err != nil {
+		slog.Warn("metadata cache: delete", "key", name, "error", err)
+	}
+}
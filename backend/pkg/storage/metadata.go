@@ -0,0 +1,116 @@
+package storage
+
+import "time"
+
+// ---------------------------------------------------------------------
+// Per-upload metadata (stored next to the .part file)
+// ---------------------------------------------------------------------
+
+// Meta is written when chunk 0 arrives and lives as long as the part
+// file does.
+type Meta struct {
+	UploadID    string    `json:"uploadID,omitempty"` // correlates the upload's log lines
+	Owner       string    `json:"owner,omitempty"`    // authenticated user who started it
+	CreatedAt   time.Time `json:"createdAt"`
+	FileName    string    `json:"fileName,omitempty"`
+	FileSize    int64     `json:"fileSize,omitempty"` // declared by the client, 0 = unknown
+	TotalChunks int       `json:"totalChunks,omitempty"`
+
+	// Retention is how long the completed file is kept, 0 = the server
+	// default.
+	Retention time.Duration `json:"retention,omitempty"`
+
+	// DirectUploadID is the bucket's multipart upload ID of a direct
+	// upload, whose TotalChunks parts of PartSize bytes never reach the
+	// server.
+	DirectUploadID string `json:"directUploadID,omitempty"`
+	PartSize       int64  `json:"partSize,omitempty"`
+
+	// Received maps each stored chunk index to its size, so the set
+	// survives a server restart.
+	Received map[int]int64 `json:"received,omitempty"`
+
+	// Batch and BatchIndex place an upload in a batch (POST /batches),
+	// whose own record lists its files in BatchFiles.
+	Batch      string      `json:"batch,omitempty"`
+	BatchIndex int         `json:"batchIndex,omitempty"`
+	BatchFiles []BatchFile `json:"batchFiles,omitempty"`
+
+	// Extract is the directory the completed zip is unpacked under, ""
+	// for none.
+	Extract string `json:"extract,omitempty"`
+
+	// PausedAt is when POST /upload/{uploadID}/pause stopped the upload,
+	// nil while it takes chunks.
+	PausedAt *time.Time `json:"pausedAt,omitempty"`
+
+	// Encryption is the client-side encryption manifest sent at init, nil
+	// for a plaintext upload. The server stores it but never the key.
+	Encryption *EncryptionManifest `json:"encryption,omitempty"`
+
+	// Stream is the upload of the completed file the backend sends the
+	// part file into while it grows (Object.StreamParts,
+	// Azure.StreamBlocks), nil for none. Only the backend sets it;
+	// SaveMeta keeps the stored one.
+	Stream *PartStream `json:"stream,omitempty"`
+}
+
+// PartStream is a completed file being uploaded piece by piece. In a
+// bucket every part but the last holds ObjectPartSize bytes of the part
+// file; in a container each block holds what one write appended.
+type PartStream struct {
+	Name   string       `json:"name"`               // the completed file
+	ID     string       `json:"uploadID,omitempty"` // the multipart upload ID, or the block IDs' prefix
+	Parts  []ObjectPart `json:"parts,omitempty"`    // stored so far, from part 1 on
+	Blocks []int64      `json:"blocks,omitempty"`   // sizes of the blocks staged so far
+}
+
+// EncryptionManifest describes a file the client encrypted chunk by
+// chunk before uploading it. The key is wrapped (encrypted) by the
+// client, so the server can hand the manifest back on download without
+// being able to decrypt the file.
+type EncryptionManifest struct {
+	Algorithm  string   `json:"algorithm"`       // AEAD applied to each chunk, e.g. AES-256-GCM
+	KeyID      string   `json:"keyID,omitempty"` // names the key that wraps WrappedKey, for the client
+	WrappedKey string   `json:"wrappedKey"`      // base64
+	IVs        []string `json:"ivs"`             // base64, one per chunk in index order
+
+	// PlaintextSize is the size of the file before encryption, 0 = not
+	// declared.
+	PlaintextSize int64 `json:"plaintextSize,omitempty"`
+}
+
+// BatchFile is one file of a batch: what the client declared and, once
+// it is stored, what the final-chunk response said.
+type BatchFile struct {
+	Path        string `json:"path"`     // relative, "/"-separated
+	FileName    string `json:"fileName"` // the name it is stored under
+	UploadID    string `json:"uploadID"`
+	TotalChunks int    `json:"totalChunks"`
+	FileSize    int64  `json:"fileSize,omitempty"`
+
+	Done        bool   `json:"done,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Stored      string `json:"stored,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// Expired reports whether the upload is older than ttl (0 = never expires).
+func (m *Meta) Expired(ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(m.CreatedAt) > ttl
+}
+
+// Progress returns the average throughput since the upload started and
+// the estimated seconds left to reach expectedTotal. Both are zero when
+// no meaningful estimate is possible yet (first chunk, no elapsed time).
+func (m *Meta) Progress(received, expectedTotal int64, now time.Time) (bytesPerSec, etaSec float64) {
+	elapsed := now.Sub(m.CreatedAt).Seconds()
+	if elapsed <= 0 || received <= 0 {
+		return 0, 0
+	}
+	bytesPerSec = float64(received) / elapsed
+	if remaining := expectedTotal - received; remaining > 0 {
+		etaSec = float64(remaining) / bytesPerSec
+	}
+	return bytesPerSec, etaSec
+}
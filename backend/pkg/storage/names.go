@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// MAP_FILE_NAMES: completed files stored under server-generated keys,
+// with a lookup table from the user's file name
+// ---------------------------------------------------------------------
+
+// FileNameTable is the lookup table's file inside UploadDir.
+const FileNameTable = ".filenames.json"
+
+// Mapped wraps a Storage so completed files live under random keys;
+// user file names never reach the filesystem or bucket. Part files are
+// unaffected (they are keyed by upload).
+type Mapped struct {
+	Storage
+	names *nameTable
+}
+
+// nameTable maps file names to storage keys. Being a Table, replicas
+// sharing dir assign and drop names without losing each other's.
+type nameTable struct {
+	*Table[string]
+}
+
+// NewMapped stores the completed files of st under generated keys,
+// keeping the name table in FileNameTable inside dir.
+func NewMapped(st Storage, dir string, mode os.FileMode) Mapped {
+	return Mapped{Storage: st, names: &nameTable{NewTable[string]("file name table", filepath.Join(dir, FileNameTable), mode)}}
+}
+
+// lookup returns the key of name, or an fs.ErrNotExist error.
+func (t *nameTable) lookup(name string) (string, error) {
+	key, ok, err := t.Get(name)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", &fs.PathError{Op: "lookup", Path: name, Err: fs.ErrNotExist}
+	}
+	return key, nil
+}
+
+// assign returns the key of name, generating and saving a new one if it
+// has none. Re-uploading a name reuses its key and so replaces the file.
+func (t *nameTable) assign(name string) (string, error) {
+	var key string
+	err := t.Update(func(names map[string]string) (bool, error) {
+		var ok bool
+		if key, ok = names[name]; ok {
+			return false, nil
+		}
+		var err error
+		if key, err = newKey(); err != nil {
+			return false, err
+		}
+		names[name] = key
+		return true, nil
+	})
+	return key, err
+}
+
+// drop forgets name once its file is gone.
+func (t *nameTable) drop(name string) error {
+	return t.Delete(name)
+}
+
+func (m Mapped) Finalize(key, name string) (string, error) {
+	storageKey, err := m.names.assign(name)
+	if err != nil {
+		return "", err
+	}
+	return m.Storage.Finalize(key, storageKey)
+}
+
+func (m Mapped) Open(name string) (io.ReadSeekCloser, error) {
+	key, err := m.names.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.Storage.Open(key)
+}
+
+func (m Mapped) Create(name string) (io.WriteCloser, error) {
+	key, err := m.names.assign(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.Storage.Create(key)
+}
+
+func (m Mapped) Remove(name string) error {
+	key, err := m.names.lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := m.Storage.Remove(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return m.names.drop(name)
+}
+
+func (m Mapped) List() ([]FileInfo, error) {
+	var keys map[string]string
+	err := m.names.View(func(names map[string]string) { keys = maps.Clone(names) })
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileInfo
+	for name, key := range keys {
+		size, modTime, err := m.Storage.Stat(key)
+		if err != nil {
+			continue // assigned, but not stored yet
+		}
+		files = append(files, FileInfo{Name: name, Size: size, ModTime: modTime})
+	}
+	return files, nil
+}
+
+func (m Mapped) Stat(name string) (int64, time.Time, error) {
+	key, err := m.names.lookup(name)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return m.Storage.Stat(key)
+}
+
+// newKey returns a random 32-digit hex storage key.
+func newKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IsState reports whether name is one of the tables this package keeps in
+// Dir (FileNameTable, PendingTable, KeyTable), a temp or lock file of
+// one, or the file of a Check.
+func IsState(name string) bool {
+	if strings.HasPrefix(name, WriteCheckPrefix) {
+		return true
+	}
+	switch TableFile(name) {
+	case FileNameTable, PendingTable, KeyTable:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,758 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Object storage backend (STORAGE_BACKEND=s3 or gcs)
+// ---------------------------------------------------------------------
+// Both speak the S3 REST API with SigV4 signing: S3 and compatible
+// servers (MinIO, Ceph) natively, GCS through its XML interoperability
+// API with HMAC keys. Part files are still assembled on local disk under
+// TempDir. With StreamParts, each ObjectPartSize piece of a part file is
+// sent as a part of a multipart upload once written, and Finalize sends
+// the rest and completes it; otherwise Finalize pushes the whole file.
+// Either way the local copy is deleted, so completed files live only in
+// the bucket.
+
+const (
+	BackendDisk = "disk"
+	BackendS3   = "s3"
+	BackendGCS  = "gcs"
+
+	ObjectPartSize   = 8 << 20 // bytes per multipart part (S3 minimum is 5 MB)
+	ObjectReqTimeout = 5 * time.Minute
+
+	AddressingPath    = "path"    // <endpoint>/<bucket>/<key>
+	AddressingVirtual = "virtual" // <bucket>.<endpoint host>/<key>
+)
+
+// ObjectConfig locates the bucket for the s3 and gcs backends.
+type ObjectConfig struct {
+	Bucket       string // S3_BUCKET
+	Region       string // S3_REGION, "auto" for GCS
+	Endpoint     string // S3_ENDPOINT, "" = AWS
+	Addressing   string // S3_ADDRESSING, "" = path with an Endpoint, virtual on AWS
+	Prefix       string // S3_PREFIX, prepended to every object key
+	AccessKey    string // S3_ACCESS_KEY_ID / AWS_ACCESS_KEY_ID (HMAC id on GCS)
+	SecretKey    string // S3_SECRET_ACCESS_KEY / AWS_SECRET_ACCESS_KEY
+	SessionToken string // S3_SESSION_TOKEN / AWS_SESSION_TOKEN
+	Chain        CredentialConfig
+}
+
+// pathStyle reports whether the bucket goes in the URL path rather than
+// the host name.
+func (oc ObjectConfig) pathStyle() bool {
+	if oc.Addressing == "" {
+		return oc.Endpoint != ""
+	}
+	return oc.Addressing == AddressingPath
+}
+
+// Object keeps part files on disk (embedded Disk) and
+// completed files in a bucket.
+type Object struct {
+	Disk
+	client *s3Client
+	scheme string // for the location returned by Finalize: s3 or gs
+
+	// StreamParts sends the part files written by appending to the
+	// bucket as they grow, into the completed file named by their Meta.
+	// Only for callers that finalize them under that name unchanged:
+	// not under Encrypted, Mapped or Addressed.
+	StreamParts bool
+}
+
+// NewObject stores completed files in the bucket oc of backend
+// (BackendS3 or BackendGCS), assembling parts on disk first.
+func NewObject(backend string, oc ObjectConfig, parts Disk) Object {
+	scheme := "s3"
+	if backend == BackendGCS {
+		scheme = "gs"
+	}
+	return Object{
+		Disk: parts,
+		client: &s3Client{
+			cfg:   oc,
+			creds: newCredentialChain(Credentials{AccessKey: oc.AccessKey, SecretKey: oc.SecretKey, SessionToken: oc.SessionToken}, oc.Chain),
+			http:  &http.Client{Timeout: ObjectReqTimeout},
+			now:   time.Now,
+		},
+		scheme: scheme,
+	}
+}
+
+func (o Object) key(name string) string { return o.client.cfg.Prefix + name }
+
+func (o Object) Finalize(key, name string) (string, error) {
+	location := o.scheme + "://" + o.client.cfg.Bucket + "/" + o.key(name)
+	if done, err := o.finishStream(key, name); done || err != nil {
+		return location, err
+	}
+	f, err := os.Open(o.partPath(key))
+	if err != nil {
+		return location, err
+	}
+	defer f.Close()
+	if err := o.client.upload(o.key(name), f); err != nil {
+		return location, err
+	}
+	f.Close()
+	if err := o.RemovePart(key); err != nil {
+		slog.Warn("cannot remove uploaded part", "file", name, "error", err)
+	}
+	return location, nil
+}
+
+// OpenPart opens the part file as Disk does. Starting it over discards
+// what was streamed of it; with StreamParts, closing the writer sends
+// the pieces completed so far.
+func (o Object) OpenPart(name string, truncate bool) (io.WriteCloser, error) {
+	if truncate {
+		o.abortStream(name)
+	}
+	w, err := o.Disk.OpenPart(name, truncate)
+	if err != nil || !o.StreamParts {
+		return w, err
+	}
+	return &streamWriter{WriteCloser: w, name: name, send: func() error {
+		_, err := o.sendParts(name, false)
+		return err
+	}}, nil
+}
+
+// TruncatePart cuts the part file back as Disk does, and forgets the
+// streamed pieces past size so they are sent again once rewritten.
+func (o Object) TruncatePart(name string, size int64) error {
+	if err := o.Disk.TruncatePart(name, size); err != nil {
+		return err
+	}
+	meta, err := o.Disk.LoadMeta(name)
+	if err != nil || meta.Stream == nil || len(meta.Stream.Parts) <= int(size/ObjectPartSize) {
+		return nil
+	}
+	meta.Stream.Parts = meta.Stream.Parts[:size/ObjectPartSize]
+	return o.Disk.SaveMeta(name, meta)
+}
+
+// SaveMeta saves meta as Disk does, keeping the stream stored for name.
+func (o Object) SaveMeta(name string, meta *Meta) error {
+	return saveKeepingStream(o.Disk, name, meta)
+}
+
+// RemovePart discards the part file and what was streamed of it.
+func (o Object) RemovePart(name string) error {
+	o.abortStream(name)
+	return o.Disk.RemovePart(name)
+}
+
+// sendParts uploads the pieces of part file name that are not in the
+// bucket yet: every complete one, and with last the rest as well. The
+// first starts the multipart upload of the file its Meta names.
+func (o Object) sendParts(name string, last bool) (*PartStream, error) {
+	meta, err := o.Disk.LoadMeta(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil // not an upload's part, e.g. a compressed copy
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(o.partPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	st := meta.Stream
+	if st == nil {
+		if meta.FileName == "" || fi.Size() < ObjectPartSize {
+			return nil, nil
+		}
+		id, err := o.client.createMultipart(o.key(meta.FileName))
+		if err != nil {
+			return nil, err
+		}
+		st = &PartStream{Name: meta.FileName, ID: id}
+		meta.Stream = st
+		if err := o.Disk.SaveMeta(name, meta); err != nil {
+			if aerr := o.client.abortMultipart(o.key(st.Name), id); aerr != nil {
+				slog.Warn("cannot abort multipart upload", "key", o.key(st.Name), "error", aerr)
+			}
+			return nil, err
+		}
+	}
+	var buf []byte
+	for {
+		off := int64(len(st.Parts)) * ObjectPartSize
+		n := min(fi.Size()-off, ObjectPartSize)
+		if n <= 0 || n < ObjectPartSize && !last {
+			return st, nil
+		}
+		if buf == nil {
+			buf = make([]byte, ObjectPartSize)
+		}
+		if _, err := f.ReadAt(buf[:n], off); err != nil {
+			return st, err
+		}
+		part, err := o.client.uploadPart(o.key(st.Name), st.ID, len(st.Parts)+1, buf[:n])
+		if err != nil {
+			return st, err
+		}
+		st.Parts = append(st.Parts, part)
+		if err := o.Disk.SaveMeta(name, meta); err != nil {
+			return st, err
+		}
+	}
+}
+
+// finishStream completes the upload streamed from part key, reporting
+// whether there was one for name. A stream into another name, as when a
+// wrapper renamed the file, is discarded for Finalize to send it whole.
+func (o Object) finishStream(key, name string) (bool, error) {
+	meta, err := o.Disk.LoadMeta(key)
+	if err != nil || meta.Stream == nil {
+		return false, nil
+	}
+	if meta.Stream.Name != name {
+		o.abortStream(key)
+		return false, nil
+	}
+	st, err := o.sendParts(key, true)
+	if err != nil {
+		return true, err
+	}
+	if err := o.client.completeMultipart(o.key(name), st.ID, st.Parts); err != nil {
+		// The next try starts over with a whole upload.
+		o.abortStream(key)
+		return true, err
+	}
+	if err := o.Disk.RemovePart(key); err != nil {
+		slog.Warn("cannot remove uploaded part", "file", name, "error", err)
+	}
+	return true, nil
+}
+
+// abortStream discards the upload streamed from part name, if any.
+func (o Object) abortStream(name string) {
+	meta, err := o.Disk.LoadMeta(name)
+	if err != nil || meta.Stream == nil {
+		return
+	}
+	if err := o.client.abortMultipart(o.key(meta.Stream.Name), meta.Stream.ID); err != nil {
+		slog.Warn("cannot abort multipart upload", "key", o.key(meta.Stream.Name), "error", err)
+	}
+	meta.Stream = nil
+	if err := o.Disk.SaveMeta(name, meta); err != nil {
+		slog.Warn("cannot save upload metadata", "key", name, "error", err)
+	}
+}
+
+func (o Object) Open(name string) (io.ReadSeekCloser, error) {
+	size, _, err := o.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	key := o.key(name)
+	return &objectReader{size: size, get: func(pos int64) (io.ReadCloser, error) {
+		resp, err := o.client.do(http.MethodGet, key, nil, http.Header{"Range": {fmt.Sprintf("bytes=%d-", pos)}}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}}, nil
+}
+
+// Create buffers the object in TempDir and uploads it on Close.
+func (o Object) Create(name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp(o.TempDir, name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	key := o.key(name)
+	return &objectWriter{File: f, upload: func(r io.Reader) error { return o.client.upload(key, r) }}, nil
+}
+
+func (o Object) Remove(name string) error {
+	resp, err := o.client.do(http.MethodDelete, o.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (o Object) Stat(name string) (int64, time.Time, error) {
+	resp, err := o.client.do(http.MethodHead, o.key(name), nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+func (o Object) List() ([]FileInfo, error) {
+	return o.client.list(o.client.cfg.Prefix)
+}
+
+// Check checks the part directories, then that the bucket answers a
+// signed request: a missing object is fine, a refusal is not.
+func (o Object) Check() error {
+	if err := o.Disk.Check(); err != nil {
+		return err
+	}
+	_, _, err := o.Stat(WriteCheckPrefix + "probe")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// objectReader serves an object through ranged GETs so http.ServeContent
+// can seek in it.
+type objectReader struct {
+	size int64
+	pos  int64
+	body io.ReadCloser
+	get  func(pos int64) (io.ReadCloser, error) // the object from pos on
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.get(r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("objectReader: negative position")
+	}
+	if offset != r.pos && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *objectReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// objectWriter buffers an object in a temp file and uploads it on Close.
+type objectWriter struct {
+	*os.File
+	upload func(r io.Reader) error
+}
+
+func (w *objectWriter) Close() error {
+	defer os.Remove(w.Name())
+	defer w.File.Close()
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.upload(w.File)
+}
+
+// streamWriter is a part file opened for appending whose complete pieces
+// are sent to the bucket once it is closed. Finalize sends what could not
+// be sent then, so that failure is only logged.
+type streamWriter struct {
+	io.WriteCloser
+	name string
+	send func() error
+}
+
+func (w *streamWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := w.send(); err != nil {
+		slog.Warn("cannot stream part to the bucket yet", "key", w.name, "error", err)
+	}
+	return nil
+}
+
+// saveKeepingStream saves meta in d with the stream stored for name in
+// place of its own, which callers only have a copy of.
+func saveKeepingStream(d Disk, name string, meta *Meta) error {
+	m := *meta
+	m.Stream = nil
+	if old, err := d.LoadMeta(name); err == nil {
+		m.Stream = old.Stream
+	}
+	return d.SaveMeta(name, &m)
+}
+
+// ---------------------------------------------------------------------
+// Minimal S3 REST client (SigV4, path-style or virtual-hosted URLs)
+// ---------------------------------------------------------------------
+type s3Client struct {
+	cfg     ObjectConfig
+	creds   *credentialChain // nil = cfg's keys
+	http    *http.Client
+	now     func() time.Time
+	service string // SigV4 service name, "" = s3
+}
+
+// credentials returns the keys to sign with.
+func (c *s3Client) credentials() (Credentials, error) {
+	if c.creds == nil {
+		return Credentials{AccessKey: c.cfg.AccessKey, SecretKey: c.cfg.SecretKey, SessionToken: c.cfg.SessionToken}, nil
+	}
+	return c.creds.get()
+}
+
+// s3Error is a non-2xx response; Code comes from the XML error body.
+type s3Error struct {
+	Status int
+	Code   string `xml:"Code"`
+	Msg    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("object store: HTTP %d %s: %s", e.Status, e.Code, e.Msg)
+}
+
+// Is lets callers test a missing object with errors.Is(err, fs.ErrNotExist)
+// and refused parts with errors.Is(err, ErrInvalidParts).
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Status == http.StatusNotFound
+	case ErrInvalidParts:
+		return e.Code == "InvalidPart" || e.Code == "InvalidPartOrder" || e.Code == "EntityTooSmall"
+	}
+	return false
+}
+
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	ep := &url.URL{Scheme: "https", Host: "s3." + c.cfg.Region + ".amazonaws.com"}
+	if c.cfg.Endpoint != "" {
+		ep, _ = url.Parse(c.cfg.Endpoint)
+	}
+	u := &url.URL{Scheme: ep.Scheme, Host: c.cfg.Bucket + "." + ep.Host, Path: strings.TrimSuffix(ep.Path, "/") + "/" + key}
+	if c.cfg.pathStyle() {
+		u.Host, u.Path = ep.Host, strings.TrimSuffix(ep.Path, "/")+"/"+c.cfg.Bucket+"/"+key
+	}
+	u.RawQuery = query.Encode()
+	return u
+}
+
+// do sends a signed request and turns non-2xx responses into *s3Error.
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	if err := c.sign(req, hex.EncodeToString(sum[:]), c.now().UTC()); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		e := &s3Error{Status: resp.StatusCode}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// upload stores r under key: one PUT for small files, otherwise a
+// multipart upload in ObjectPartSize pieces that is aborted on failure.
+func (c *s3Client) upload(key string, r io.Reader) error {
+	buf := make([]byte, ObjectPartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := c.do(http.MethodPut, key, nil, nil, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := c.createMultipart(key)
+	if err != nil {
+		return err
+	}
+	var parts []ObjectPart
+	abort := func(cause error) error {
+		if err := c.abortMultipart(key, uploadID); err != nil {
+			slog.Warn("cannot abort multipart upload", "key", key, "error", err)
+		}
+		return cause
+	}
+	for num := 1; n > 0; num++ {
+		part, err := c.uploadPart(key, uploadID, num, buf[:n])
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, part)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+	}
+	if err := c.completeMultipart(key, uploadID, parts); err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// createMultipart starts a multipart upload of key and returns its ID.
+func (c *s3Client) createMultipart(key string) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("object store: bad CreateMultipartUpload response: %v", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart stores body as part num of multipart upload uploadID.
+func (c *s3Client) uploadPart(key, uploadID string, num int, body []byte) (ObjectPart, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, q, nil, body)
+	if err != nil {
+		return ObjectPart{}, err
+	}
+	resp.Body.Close()
+	return ObjectPart{num, resp.Header.Get("ETag")}, nil
+}
+
+// completeMultipart joins parts, in order, into the object key.
+func (c *s3Client) completeMultipart(key, uploadID string, parts []ObjectPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name     `xml:"CompleteMultipartUpload"`
+		Parts   []ObjectPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A failure after the 200 status line comes as an <Error> body.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+// abortMultipart discards a multipart upload and the parts stored so far.
+func (c *s3Client) abortMultipart(key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns the objects under prefix, with prefix stripped from their
+// names, following ListObjectsV2 continuation tokens.
+func (c *s3Client) list(prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated bool   `xml:"IsTruncated"`
+			NextToken   string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("object store: bad ListObjectsV2 response: %w", err)
+		}
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue // not one of ours
+			}
+			files = append(files, FileInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !result.IsTruncated || result.NextToken == "" {
+			return files, nil
+		}
+		token = result.NextToken
+	}
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) error {
+	creds, err := c.credentials()
+	if err != nil {
+		return err
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// Sign host, range and every x-amz-* header.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		sigv4Escape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	service := cmp.Or(c.service, "s3")
+	canonSum := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + c.cfg.Region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonSum[:])
+
+	signature := hex.EncodeToString(hmacSHA256(c.signingKey(creds, date, service), toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+
+// signingKey derives the SigV4 key for date (YYYYMMDD) and service.
+func (c *s3Client) signingKey(creds Credentials, date, service string) []byte {
+	key := []byte("AWS4" + creds.SecretKey)
+	for _, part := range []string{date, c.cfg.Region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			pairs = append(pairs, sigv4Escape(k, true)+"="+sigv4Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// sigv4Escape percent-encodes everything but unreserved characters (and
+// '/' in paths), as SigV4 requires.
+func sigv4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// preallocate is a no-op where fallocate(2) is unavailable.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,425 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ---------------------------------------------------------------------
+// SFTP backend (STORAGE_BACKEND=sftp)
+// ---------------------------------------------------------------------
+// Completed files are written to a directory of a remote server, for
+// ingestion systems that pick files up from there. Like Object, part
+// files are assembled on local disk; Finalize writes the file under a
+// hidden temporary name beside its final one and renames it when it is
+// complete, so the remote side never sees a partial file.
+
+const (
+	BackendSFTP = "sftp"
+
+	DefaultSFTPConns   = 4
+	DefaultSFTPRetries = 3
+
+	sftpDialTimeout = 10 * time.Second
+	sftpKeepAlive   = 15 * time.Second // between keepalive requests
+	sftpTimeout     = time.Minute      // a server that answers none for this long is taken as gone
+	sftpRetryDelay  = 500 * time.Millisecond
+	sftpPacketData  = 32 << 10 // bytes per READ and WRITE, which every server accepts
+	sftpInflight    = 16       // READs or WRITEs sent ahead of their replies
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+// SFTPConfig locates the directory for the sftp backend.
+type SFTPConfig struct {
+	Addr    string // SFTP_ADDR, host:port
+	User    string // SFTP_USER
+	Dir     string // SFTP_DIR, "" = the login directory
+	Conns   int    // SFTP_CONNECTIONS kept open and shared
+	Retries int    // SFTP_RETRIES of an operation cut off by a broken connection
+
+	Auth    []ssh.AuthMethod    // from SFTP_PASSWORD and SFTP_KEY_FILE
+	HostKey ssh.HostKeyCallback // from SFTP_KNOWN_HOSTS
+}
+
+// SFTP keeps part files on disk (embedded Disk) and completed files in a
+// directory of an SFTP server.
+type SFTP struct {
+	Disk
+	pool *sftpPool
+}
+
+// NewSFTP stores completed files in the remote directory of sc,
+// assembling parts on disk first. Connections are opened on first use.
+func NewSFTP(sc SFTPConfig, parts Disk) SFTP {
+	return SFTP{Disk: parts, pool: &sftpPool{cfg: sc, dial: func() (*sftpConn, error) { return dialSFTP(sc) }}}
+}
+
+func (s SFTP) path(name string) string { return path.Join(s.pool.cfg.Dir, name) }
+
+func (s SFTP) Finalize(key, name string) (string, error) {
+	p := s.path(name)
+	location := "sftp://" + s.pool.cfg.User + "@" + s.pool.cfg.Addr + "/" + strings.TrimPrefix(p, "/")
+	f, err := os.Open(s.partPath(key))
+	if err != nil {
+		return location, err
+	}
+	defer f.Close()
+	if err := s.pool.put(p, f); err != nil {
+		return location, err
+	}
+	f.Close()
+	if err := s.RemovePart(key); err != nil {
+		slog.Warn("cannot remove uploaded part", "file", name, "error", err)
+	}
+	return location, nil
+}
+
+func (s SFTP) Open(name string) (io.ReadSeekCloser, error) {
+	size, _, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	p := s.path(name)
+	return &objectReader{size: size, get: func(pos int64) (io.ReadCloser, error) {
+		var f *sftp.File
+		err := s.pool.retry(func(c *sftpConn) (err error) {
+			f, err = c.Open(p)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(pos, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}}, nil
+}
+
+// Create buffers the file in TempDir and uploads it on Close.
+func (s SFTP) Create(name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp(s.TempDir, name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	p := s.path(name)
+	return &objectWriter{File: f, upload: func(r io.Reader) error { return s.pool.put(p, r.(*os.File)) }}, nil
+}
+
+func (s SFTP) Remove(name string) error {
+	return s.pool.retry(func(c *sftpConn) error { return c.Remove(s.path(name)) })
+}
+
+func (s SFTP) Stat(name string) (int64, time.Time, error) {
+	var fi fs.FileInfo
+	err := s.pool.retry(func(c *sftpConn) (err error) {
+		fi, err = c.Stat(s.path(name))
+		return err
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+// List walks the remote directory, leaving out the temporary files of
+// uploads in progress.
+func (s SFTP) List() ([]FileInfo, error) {
+	var files []FileInfo
+	err := s.pool.retry(func(c *sftpConn) error {
+		files = nil
+		return c.walk(sftpDir(s.pool.cfg.Dir), "", &files)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil // nothing was uploaded yet
+	}
+	return files, err
+}
+
+// Check checks the part directories, then that the server answers: a
+// missing file is fine, a refusal is not.
+func (s SFTP) Check() error {
+	if err := s.Disk.Check(); err != nil {
+		return err
+	}
+	_, _, err := s.Stat(WriteCheckPrefix + "probe")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sftpTemp reports whether a remote file name is one of put's temporary
+// files.
+func sftpTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".sftp-tmp")
+}
+
+// ---------------------------------------------------------------------
+// Connection pool: SFTP_CONNECTIONS connections, used round robin; each
+// carries any number of concurrent requests
+// ---------------------------------------------------------------------
+type sftpPool struct {
+	cfg  SFTPConfig
+	dial func() (*sftpConn, error)
+
+	mu    sync.Mutex
+	conns []*sftpConn
+	next  int
+}
+
+// get returns the next connection, replacing it first when it broke.
+// Dialing holds the lock, so a server that is down is not hammered by
+// every waiting request at once.
+func (p *sftpPool) get() (*sftpConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		p.conns = make([]*sftpConn, max(p.cfg.Conns, 1))
+	}
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if c := p.conns[i]; c != nil && !c.broken() {
+		return c, nil
+	}
+	c, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	p.conns[i] = c
+	return c, nil
+}
+
+// retry runs op on a pooled connection. When the connection could not
+// be made, or op failed with anything but an answer from the server, the
+// connection is dropped and op is run again on a new one up to
+// SFTP_RETRIES times, waiting twice as long each time; errors the server
+// answered with are returned at once.
+func (p *sftpPool) retry(op func(c *sftpConn) error) error {
+	delay := sftpRetryDelay
+	for attempt := 0; ; attempt++ {
+		c, err := p.get()
+		if err == nil {
+			if err = op(c); err == nil || sftpAnswered(err) {
+				return err
+			}
+			c.close()
+		}
+		if attempt >= p.cfg.Retries {
+			return err
+		}
+		slog.Warn("sftp: retrying", "attempt", attempt+1, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// sftpAnswered reports whether err is a status the server replied with,
+// rather than a connection that broke.
+func sftpAnswered(err error) bool {
+	var status *sftp.StatusError
+	return errors.As(err, &status) || errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission)
+}
+
+// put writes r to dst through a temporary file in the same directory,
+// renamed over dst once complete. A retry starts over from the
+// beginning of r under the same temporary name.
+func (p *sftpPool) put(dst string, r io.ReadSeeker) error {
+	var rnd [6]byte
+	rand.Read(rnd[:])
+	tmp := path.Join(path.Dir(dst), "."+path.Base(dst)+"."+hex.EncodeToString(rnd[:])+".sftp-tmp")
+	return p.retry(func(c *sftpConn) error {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return c.put(tmp, dst, r)
+	})
+}
+
+func dialSFTP(cfg SFTPConfig) (*sftpConn, error) {
+	client, err := ssh.Dial("tcp", cfg.Addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            cfg.Auth,
+		HostKeyCallback: cfg.HostKey,
+		Timeout:         sftpDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(client, sftp.MaxPacket(sftpPacketData),
+		sftp.MaxConcurrentRequestsPerFile(sftpInflight), sftp.UseConcurrentWrites(true))
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	c := &sftpConn{Client: sc, ssh: client, done: make(chan struct{})}
+	go func() {
+		client.Wait()
+		c.close()
+	}()
+	go c.keepAlive()
+	return c, nil
+}
+
+// ---------------------------------------------------------------------
+// One SSH connection and its SFTP session
+// ---------------------------------------------------------------------
+
+// sftpConn is an SFTP session on its own SSH connection.
+type sftpConn struct {
+	*sftp.Client
+	ssh *ssh.Client
+
+	once sync.Once
+	done chan struct{} // closed once the connection is gone
+}
+
+// close drops the connection, failing the requests waiting on it.
+func (c *sftpConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.ssh.Close()
+	})
+}
+
+func (c *sftpConn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepAlive sends an SSH keepalive every sftpKeepAlive and drops the
+// connection when one goes unanswered for sftpTimeout, so requests on a
+// server that vanished fail rather than hang.
+func (c *sftpConn) keepAlive() {
+	tick := time.NewTicker(sftpKeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := c.ssh.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		timeout := time.NewTimer(sftpTimeout)
+		select {
+		case err := <-reply:
+			timeout.Stop()
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-timeout.C:
+			slog.Warn("sftp: server stopped answering", "timeout", sftpTimeout)
+			c.close()
+			return
+		case <-c.done:
+			timeout.Stop()
+			return
+		}
+	}
+}
+
+// rename moves oldPath over newPath atomically with OpenSSH's
+// posix-rename extension. Plain RENAME refuses to replace a file, so
+// servers without the extension have newPath removed first.
+func (c *sftpConn) rename(oldPath, newPath string) error {
+	if _, ok := c.HasExtension(sftpPosixRename); ok {
+		err := c.PosixRename(oldPath, newPath)
+		var status *sftp.StatusError
+		if !errors.As(err, &status) || status.FxCode() != sftp.ErrSSHFxOpUnsupported {
+			return err
+		}
+	}
+	err := c.Rename(oldPath, newPath)
+	if sftpAnswered(err) {
+		if _, serr := c.Stat(newPath); serr == nil {
+			if err := c.Remove(newPath); err != nil {
+				return err
+			}
+			return c.Rename(oldPath, newPath)
+		}
+	}
+	return err
+}
+
+// put writes r to tmp, creating its directory if need be, and renames it
+// to dst. On failure tmp is removed, unless the connection broke.
+func (c *sftpConn) put(tmp, dst string, r io.Reader) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	f, err := c.OpenFile(tmp, flags)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err = c.MkdirAll(path.Dir(tmp)); err == nil {
+			f, err = c.OpenFile(tmp, flags)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadFrom(r)
+	// The server may only report a failed write when closing.
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = c.rename(tmp, dst)
+	}
+	if err != nil && sftpAnswered(err) {
+		c.Remove(tmp)
+	}
+	return err
+}
+
+// walk appends the files under dir to files, named relative to the
+// listed root with rel as prefix.
+func (c *sftpConn) walk(dir, rel string, files *[]FileInfo) error {
+	entries, err := c.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var subdirs []string
+	for _, fi := range entries {
+		switch name := fi.Name(); {
+		case name == "." || name == "..":
+		case fi.IsDir():
+			subdirs = append(subdirs, name)
+		case fi.Mode().IsRegular() && !sftpTemp(name):
+			*files = append(*files, FileInfo{Name: rel + name, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+	}
+	for _, sub := range subdirs {
+		if err := c.walk(path.Join(dir, sub), rel+sub+"/", files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpDir is dir, or the login directory for "".
+func sftpDir(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
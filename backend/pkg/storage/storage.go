@@ -0,0 +1,537 @@
+// Package storage keeps part files and completed uploads: on local disk
+// (Disk), in an S3 or GCS bucket (Object) or an Azure blob container
+// (Azure), encrypted at rest (Encrypted), under generated names (Mapped)
+// or by content (Addressed).
+package storage
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// Storage backend (local disk by default)
+// ---------------------------------------------------------------------
+
+// Storage abstracts where part files are assembled and completed files live.
+// A cloud backend can buffer parts locally and push the whole object on
+// Finalize (e.g. an S3 multipart upload).
+type Storage interface {
+	// OpenPart opens the part file for appending; truncate starts it over.
+	OpenPart(name string, truncate bool) (io.WriteCloser, error)
+	// OpenPartAt opens the part file for positional writes, creating it
+	// (sparse where supported) with a length of size bytes if it is shorter.
+	OpenPartAt(name string, size int64) (PartFile, error)
+	// ReservePart pre-allocates size bytes for the part file without
+	// changing its length. Backends that cannot do this return nil.
+	ReservePart(name string, size int64) error
+	// ReadPart opens the part file for reading, e.g. to verify it.
+	ReadPart(name string) (io.ReadCloser, error)
+	// PartSize reports how many bytes of the part file are stored so far.
+	PartSize(name string) (int64, error)
+	// RemovePart discards the part file and its metadata.
+	RemovePart(name string) error
+	// TruncatePart cuts the part file back to size bytes.
+	TruncatePart(name string, size int64) error
+	// OpenChunk creates (or replaces) the separate file for one chunk.
+	OpenChunk(name string, index int) (io.WriteCloser, error)
+	// MissingChunks lists the chunk indices below total with no chunk file.
+	MissingChunks(name string, total int) []int
+	// AssembleChunks concatenates chunk files 0..total-1 into the part file,
+	// also writing every byte to h.
+	AssembleChunks(name string, total int, h io.Writer) error
+	// RemoveChunks deletes the given chunk files.
+	RemoveChunks(name string, indices []int) error
+	// LoadMeta returns the metadata saved for an in-progress upload.
+	LoadMeta(name string) (*Meta, error)
+	// SaveMeta stores metadata for an in-progress upload.
+	SaveMeta(name string, meta *Meta) error
+	// ListParts describes every in-progress upload, e.g. to find stale ones.
+	ListParts() ([]PartInfo, error)
+	// Available reports free space in bytes, or -1 if unknown.
+	Available() (int64, error)
+	// Finalize turns the part file stored under key into the completed
+	// file name and returns its location.
+	Finalize(key, name string) (string, error)
+	// Open opens a completed file for reading.
+	Open(name string) (io.ReadSeekCloser, error)
+	// Create creates (or replaces) a completed file, e.g. a compressed copy.
+	Create(name string) (io.WriteCloser, error)
+	// Remove deletes a completed file.
+	Remove(name string) error
+	// Stat returns the size and modification time of a completed file.
+	Stat(name string) (int64, time.Time, error)
+	// List describes every completed file.
+	List() ([]FileInfo, error)
+	// Check reports whether files can be stored now: the directories are
+	// writable and the bucket, if any, answers.
+	Check() error
+}
+
+// FileInfo describes one completed file.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// PartFile is a part file opened for out-of-order writes.
+type PartFile interface {
+	io.WriterAt
+	io.Closer
+}
+
+// PartInfo describes the files of one in-progress upload.
+type PartInfo struct {
+	Key     string
+	Size    int64     // bytes in its part, metadata and chunk files
+	ModTime time.Time // latest write to any of them
+	Chunks  []int     // indices of mode=separate chunk files
+}
+
+// Disk assembles part files in TempDir (which may live on a different
+// filesystem) and moves completed files into Dir.
+type Disk struct {
+	Dir      string
+	TempDir  string
+	FileMode os.FileMode
+	// NoSync skips the fsyncs that make Finalize crash-safe: faster, but
+	// after a power loss a completed file may be missing or truncated.
+	NoSync bool
+	// Hidden names files in Dir that are not uploads, such as the
+	// caller's own state tables; List skips them. nil = none.
+	Hidden func(name string) bool
+	// DirMode is the mode of the subdirectories made for names with a
+	// slash, such as ContentKey shards. 0 = 0o755.
+	DirMode os.FileMode
+}
+
+func (d Disk) partPath(name string) string  { return filepath.Join(d.TempDir, name+".part") }
+func (d Disk) finalPath(name string) string { return filepath.Join(d.Dir, name) }
+func (d Disk) metaPath(name string) string  { return filepath.Join(d.TempDir, name+".part.meta") }
+func (d Disk) chunkPath(name string, index int) string {
+	return filepath.Join(d.TempDir, name+".chunk."+strconv.Itoa(index))
+}
+
+// legacyChunkPath is where chunk files were kept before they were renamed
+// to key.chunk.N; uploads begun by an older server still find them.
+func (d Disk) legacyChunkPath(name string, index int) string {
+	return filepath.Join(d.TempDir, name+".part."+strconv.Itoa(index))
+}
+
+// existingChunkPath returns the path of chunk index, preferring the
+// current name.
+func (d Disk) existingChunkPath(name string, index int) (string, error) {
+	path := d.chunkPath(name, index)
+	_, err := os.Stat(path)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return path, err
+	}
+	legacy := d.legacyChunkPath(name, index)
+	if _, lerr := os.Stat(legacy); lerr == nil {
+		return legacy, nil
+	}
+	return path, err
+}
+
+// mkdirFor creates the directory of the completed file at path when its
+// name has a slash.
+func (d Disk) mkdirFor(path string) error {
+	dir := filepath.Dir(path)
+	if dir == filepath.Clean(d.Dir) {
+		return nil
+	}
+	return os.MkdirAll(dir, cmp.Or(d.DirMode, 0o755))
+}
+
+// PartKey reports whether file is one of the files Disk keeps for
+// an in-progress upload: key.part, key.part.meta or chunk file key.chunk.N
+// (or its legacy name key.part.N); chunk is -1 for the first two.
+func PartKey(file string) (key string, chunk int, ok bool) {
+	if key, ok := strings.CutSuffix(file, ".part"); ok && key != "" {
+		return key, -1, true
+	}
+	if key, ok := strings.CutSuffix(file, ".part.meta"); ok && key != "" {
+		return key, -1, true
+	}
+	for _, sep := range []string{".chunk.", ".part."} {
+		if i := strings.LastIndex(file, sep); i > 0 {
+			n, err := strconv.Atoi(file[i+len(sep):])
+			if err == nil && n >= 0 && strconv.Itoa(n) == file[i+len(sep):] {
+				return file[:i], n, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+func (d Disk) OpenPart(name string, truncate bool) (io.WriteCloser, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags = os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	}
+	f, err := os.OpenFile(d.partPath(name), flags, d.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	// The create mode is masked by the umask; set it explicitly on a fresh
+	// upload so group-writable modes survive.
+	if truncate {
+		if err := f.Chmod(d.FileMode); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (d Disk) OpenPartAt(name string, size int64) (PartFile, error) {
+	f, err := os.OpenFile(d.partPath(name), os.O_CREATE|os.O_WRONLY, d.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() < size {
+		// Extending with Truncate leaves a hole instead of writing zeros.
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Chmod(d.FileMode); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (d Disk) ReservePart(name string, size int64) error {
+	f, err := os.OpenFile(d.partPath(name), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return preallocate(f, size)
+}
+
+func (d Disk) ReadPart(name string) (io.ReadCloser, error) {
+	return os.Open(d.partPath(name))
+}
+
+func (d Disk) PartSize(name string) (int64, error) {
+	fi, err := os.Stat(d.partPath(name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (d Disk) RemovePart(name string) error {
+	for _, path := range []string{d.partPath(name), d.metaPath(name)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Disk) OpenChunk(name string, index int) (io.WriteCloser, error) {
+	return os.OpenFile(d.chunkPath(name, index), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, d.FileMode)
+}
+
+func (d Disk) MissingChunks(name string, total int) []int {
+	var missing []int
+	for i := 0; i < total; i++ {
+		if _, err := d.existingChunkPath(name, i); err != nil {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func (d Disk) AssembleChunks(name string, total int, h io.Writer) error {
+	out, err := os.OpenFile(d.partPath(name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, d.FileMode)
+	if err != nil {
+		return err
+	}
+	dst := io.MultiWriter(out, h)
+	for i := 0; i < total; i++ {
+		path, err := d.existingChunkPath(name, i)
+		if err == nil {
+			err = appendFile(dst, path)
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func appendFile(dst io.Writer, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(dst, in)
+	return err
+}
+
+func (d Disk) RemoveChunks(name string, indices []int) error {
+	for _, i := range indices {
+		for _, path := range []string{d.chunkPath(name, i), d.legacyChunkPath(name, i)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d Disk) LoadMeta(name string) (*Meta, error) {
+	data, err := os.ReadFile(d.metaPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (d Disk) SaveMeta(name string, meta *Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.metaPath(name), data, d.FileMode)
+}
+
+func (d Disk) ListParts() ([]PartInfo, error) {
+	entries, err := os.ReadDir(d.TempDir)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*PartInfo)
+	for _, e := range entries {
+		key, chunk, ok := PartKey(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		p := byKey[key]
+		if p == nil {
+			p = &PartInfo{Key: key}
+			byKey[key] = p
+		}
+		p.Size += fi.Size()
+		if fi.ModTime().After(p.ModTime) {
+			p.ModTime = fi.ModTime()
+		}
+		if chunk >= 0 {
+			p.Chunks = append(p.Chunks, chunk)
+		}
+	}
+	parts := make([]PartInfo, 0, len(byKey))
+	for _, p := range byKey {
+		sort.Ints(p.Chunks)
+		parts = append(parts, *p)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Key < parts[j].Key })
+	return parts, nil
+}
+
+func (d Disk) TruncatePart(name string, size int64) error {
+	return os.Truncate(d.partPath(name), size)
+}
+
+func (d Disk) Available() (int64, error) {
+	return freeSpace(d.TempDir)
+}
+
+// WriteCheckPrefix starts the name of the file Check writes and removes
+// in each directory; List skips it like the tables.
+const WriteCheckPrefix = ".write-check-"
+
+// Check creates and removes a file in Dir and TempDir.
+func (d Disk) Check() error {
+	for _, dir := range []string{d.Dir, d.TempDir} {
+		f, err := os.CreateTemp(dir, WriteCheckPrefix+"*.tmp")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte{0})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if rerr := os.Remove(f.Name()); err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// Finalize renames the part file, the upload's temporary name, to name.
+// Unless NoSync is set its data is fsynced first and the directory entry
+// after, so a crash leaves either the part or the whole file, never a
+// truncated one under the final name.
+func (d Disk) Finalize(key, name string) (string, error) {
+	finalPath := d.finalPath(name)
+	if err := d.mkdirFor(finalPath); err != nil {
+		return finalPath, err
+	}
+	if !d.NoSync {
+		if err := syncFile(d.partPath(key)); err != nil {
+			return finalPath, err
+		}
+	}
+	if err := moveFile(d.partPath(key), finalPath, d.FileMode, !d.NoSync); err != nil {
+		return finalPath, err
+	}
+	if !d.NoSync {
+		// The file is in place either way; only a crash could undo it.
+		if err := syncDir(filepath.Dir(finalPath)); err != nil {
+			slog.Warn("cannot sync directory", "dir", filepath.Dir(finalPath), "error", err)
+		}
+	}
+	if err := os.Remove(d.metaPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("cannot remove metadata", "file", name, "error", err)
+	}
+	return finalPath, nil
+}
+
+func (d Disk) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(d.finalPath(name))
+}
+
+func (d Disk) Create(name string) (io.WriteCloser, error) {
+	if err := d.mkdirFor(d.finalPath(name)); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(d.finalPath(name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, d.FileMode)
+}
+
+func (d Disk) Remove(name string) error {
+	return os.Remove(d.finalPath(name))
+}
+
+func (d Disk) Stat(name string) (int64, time.Time, error) {
+	fi, err := os.Stat(d.finalPath(name))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+// List skips state files (IsState and Hidden) and, when parts share the
+// directory, in-progress uploads.
+func (d Disk) List() ([]FileInfo, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() || IsState(e.Name()) || (d.Hidden != nil && d.Hidden(e.Name())) {
+			continue
+		}
+		if _, _, ok := PartKey(e.Name()); ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		files = append(files, FileInfo{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return files, nil
+}
+
+// moveFile renames src to dst, falling back to copy+remove when the two
+// paths are on different filesystems; the copy is fsynced if sync is set.
+func moveFile(src, dst string, mode os.FileMode, sync bool) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(mode); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Same filesystem now, so this rename is atomic.
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// syncFile flushes the data of the file at path to stable storage.
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package storage
+
+// syncDir is a no-op where directories cannot be fsynced; a rename is
+// made durable by the filesystem itself.
+func syncDir(dir string) error {
+	return nil
+}
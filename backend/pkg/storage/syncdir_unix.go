@@ -0,0 +1,18 @@
+//go:build unix
+
+package storage
+
+import "os"
+
+// syncDir flushes the entries of dir, such as a file just renamed into it.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ---------------------------------------------------------------------
+// Tables: small maps kept as JSON files beside the uploads (file names,
+// data keys, hashes, content types, ...), shared by every process that
+// uses the directory
+// ---------------------------------------------------------------------
+
+// Table is a map from names to V persisted as JSON in one file. Every
+// call re-reads the file if another process has replaced it since, and
+// Update runs under an exclusive lock on the file path + ".lock", so
+// replicas sharing the directory see each other's rows and never write
+// over them. A file that cannot be read fails the call rather than being
+// overwritten.
+type Table[V any] struct {
+	what string // "file name table", for errors
+	path string
+	mode os.FileMode
+
+	mu   sync.Mutex
+	rows map[string]V // nil until read
+	file *os.File     // rows came from, nil if there was none
+	read os.FileInfo  // of file when rows were read
+}
+
+// NewTable returns the table kept in the file path, which is created on
+// the first Update. what names it in errors.
+func NewTable[V any](what, path string, mode os.FileMode) *Table[V] {
+	return &Table[V]{what: what, path: path, mode: mode}
+}
+
+// refresh reads the file unless rows already came from it; the caller
+// holds t.mu. Each save renames a new file into place, and t.file stays
+// open so that its inode is not reused for a later one.
+func (t *Table[V]) refresh() error {
+	f, err := os.Open(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if t.rows == nil || t.file != nil {
+			t.forget()
+			t.rows = make(map[string]V)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	if t.rows != nil && t.file != nil && sameVersion(t.read, fi) {
+		f.Close()
+		return nil
+	}
+	data, err := io.ReadAll(f)
+	rows := make(map[string]V)
+	if err == nil {
+		err = json.Unmarshal(data, &rows)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s %s: %w", t.what, t.path, err)
+	}
+	t.keep(rows, f, fi)
+	return nil
+}
+
+// keep records that rows are the contents of f, whose FileInfo is fi.
+func (t *Table[V]) keep(rows map[string]V, f *os.File, fi os.FileInfo) {
+	t.forget()
+	t.rows, t.file, t.read = rows, f, fi
+}
+
+// forget drops the cached rows, so the next call reads the file again.
+func (t *Table[V]) forget() {
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.rows, t.file, t.read = nil, nil, nil
+}
+
+// sameVersion reports whether a and b describe the same write of a table
+// file: the same inode, not since written in place.
+func sameVersion(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// View calls fn with the current rows, which fn must neither modify nor
+// keep.
+func (t *Table[V]) View(fn func(rows map[string]V)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	fn(t.rows)
+	return nil
+}
+
+// Get returns the row of name.
+func (t *Table[V]) Get(name string) (V, bool, error) {
+	var v V
+	var ok bool
+	err := t.View(func(rows map[string]V) { v, ok = rows[name] })
+	return v, ok, err
+}
+
+// Update calls fn with the current rows under the table's lock and saves
+// them if fn reports a change. No other process changes the table in
+// between, so fn sees every row written before it.
+func (t *Table[V]) Update(fn func(rows map[string]V) (bool, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unlock, err := lockFile(t.path+".lock", t.mode)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	defer unlock()
+	if err := t.refresh(); err != nil {
+		return err
+	}
+	changed, err := fn(t.rows)
+	if err == nil && changed {
+		err = t.save()
+	}
+	if err != nil {
+		t.forget() // fn may have changed rows
+	}
+	return err
+}
+
+// save writes the rows via a temp file and rename, so a crash never
+// leaves the table half written; the caller holds the table's lock.
+func (t *Table[V]) save() error {
+	data, err := json.MarshalIndent(t.rows, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, t.mode); err != nil {
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	// Some systems refuse to replace an open file. tmp already exists, so
+	// the old file's inode is not reused for it.
+	rows := t.rows
+	t.forget()
+	t.rows = rows
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	// The rows are now what the file holds; keep it open as if read.
+	f, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", t.what, err)
+	}
+	t.keep(rows, f, fi)
+	return nil
+}
+
+// Set stores v as the row of name.
+func (t *Table[V]) Set(name string, v V) error {
+	return t.Update(func(rows map[string]V) (bool, error) {
+		rows[name] = v
+		return true, nil
+	})
+}
+
+// Delete removes the row of name, if any.
+func (t *Table[V]) Delete(name string) error {
+	return t.Update(func(rows map[string]V) (bool, error) {
+		if _, ok := rows[name]; !ok {
+			return false, nil
+		}
+		delete(rows, name)
+		return true, nil
+	})
+}
+
+// TableFile returns the table file name belongs to: name itself, or the
+// table whose temp or lock file it is.
+func TableFile(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, ".tmp"), ".lock")
+}
@@ -0,0 +1,465 @@
+// The gRPC face of the upload server, served on the HTTP port (h2c on a
+// plain listener, h2 with TLS). Chunks go through the same sessions,
+// checks and storage as PUT /upload/{uploadID}/chunk/{index}.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: chunkupload/v1/upload.proto
+
+package uploadv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Chunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UploadId      string                 `protobuf:"bytes,1,opt,name=upload_id,json=uploadId,proto3" json:"upload_id,omitempty"`
+	FileName      string                 `protobuf:"bytes,2,opt,name=file_name,json=fileName,proto3" json:"file_name,omitempty"`           // to start a session
+	TotalChunks   int32                  `protobuf:"varint,3,opt,name=total_chunks,json=totalChunks,proto3" json:"total_chunks,omitempty"` // to start a session
+	FileSize      int64                  `protobuf:"varint,4,opt,name=file_size,json=fileSize,proto3" json:"file_size,omitempty"`          // optional, to start a session
+	Index         int32                  `protobuf:"varint,5,opt,name=index,proto3" json:"index,omitempty"`
+	Data          []byte                 `protobuf:"bytes,6,opt,name=data,proto3" json:"data,omitempty"`
+	Sha256        string                 `protobuf:"bytes,7,opt,name=sha256,proto3" json:"sha256,omitempty"`                           // optional hex digest of data, checked before storing
+	FileSha256    string                 `protobuf:"bytes,8,opt,name=file_sha256,json=fileSha256,proto3" json:"file_sha256,omitempty"` // optional hex digest of the file, with the last chunk
+	Retention     string                 `protobuf:"bytes,9,opt,name=retention,proto3" json:"retention,omitempty"`                     // optional, to start a session: e.g. "720h"
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_chunkupload_v1_upload_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Chunk) GetUploadId() string {
+	if x != nil {
+		return x.UploadId
+	}
+	return ""
+}
+
+func (x *Chunk) GetFileName() string {
+	if x != nil {
+		return x.FileName
+	}
+	return ""
+}
+
+func (x *Chunk) GetTotalChunks() int32 {
+	if x != nil {
+		return x.TotalChunks
+	}
+	return 0
+}
+
+func (x *Chunk) GetFileSize() int64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *Chunk) GetIndex() int32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *Chunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Chunk) GetSha256() string {
+	if x != nil {
+		return x.Sha256
+	}
+	return ""
+}
+
+func (x *Chunk) GetFileSha256() string {
+	if x != nil {
+		return x.FileSha256
+	}
+	return ""
+}
+
+func (x *Chunk) GetRetention() string {
+	if x != nil {
+		return x.Retention
+	}
+	return ""
+}
+
+type UploadResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UploadId      string                 `protobuf:"bytes,1,opt,name=upload_id,json=uploadId,proto3" json:"upload_id,omitempty"`
+	Done          bool                   `protobuf:"varint,2,opt,name=done,proto3" json:"done,omitempty"`
+	FileName      string                 `protobuf:"bytes,3,opt,name=file_name,json=fileName,proto3" json:"file_name,omitempty"`
+	Path          string                 `protobuf:"bytes,4,opt,name=path,proto3" json:"path,omitempty"`                                  // where the file was stored, once done
+	Size          int64                  `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`                                 // once done
+	Received      int64                  `protobuf:"varint,6,opt,name=received,proto3" json:"received,omitempty"`                         // bytes stored so far
+	ContentType   string                 `protobuf:"bytes,7,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"` // once done
+	DuplicateOf   string                 `protobuf:"bytes,8,opt,name=duplicate_of,json=duplicateOf,proto3" json:"duplicate_of,omitempty"` // set when DEDUPLICATE found the same content
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadResult) Reset() {
+	*x = UploadResult{}
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadResult) ProtoMessage() {}
+
+func (x *UploadResult) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadResult.ProtoReflect.Descriptor instead.
+func (*UploadResult) Descriptor() ([]byte, []int) {
+	return file_chunkupload_v1_upload_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *UploadResult) GetUploadId() string {
+	if x != nil {
+		return x.UploadId
+	}
+	return ""
+}
+
+func (x *UploadResult) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+func (x *UploadResult) GetFileName() string {
+	if x != nil {
+		return x.FileName
+	}
+	return ""
+}
+
+func (x *UploadResult) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *UploadResult) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *UploadResult) GetReceived() int64 {
+	if x != nil {
+		return x.Received
+	}
+	return 0
+}
+
+func (x *UploadResult) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *UploadResult) GetDuplicateOf() string {
+	if x != nil {
+		return x.DuplicateOf
+	}
+	return ""
+}
+
+type StatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UploadId      string                 `protobuf:"bytes,1,opt,name=upload_id,json=uploadId,proto3" json:"upload_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusRequest) Reset() {
+	*x = StatusRequest{}
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusRequest) ProtoMessage() {}
+
+func (x *StatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusRequest.ProtoReflect.Descriptor instead.
+func (*StatusRequest) Descriptor() ([]byte, []int) {
+	return file_chunkupload_v1_upload_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *StatusRequest) GetUploadId() string {
+	if x != nil {
+		return x.UploadId
+	}
+	return ""
+}
+
+type UploadStatus struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	UploadId       string                 `protobuf:"bytes,1,opt,name=upload_id,json=uploadId,proto3" json:"upload_id,omitempty"`
+	FileName       string                 `protobuf:"bytes,2,opt,name=file_name,json=fileName,proto3" json:"file_name,omitempty"`
+	TotalChunks    int32                  `protobuf:"varint,3,opt,name=total_chunks,json=totalChunks,proto3" json:"total_chunks,omitempty"`
+	FileSize       int64                  `protobuf:"varint,4,opt,name=file_size,json=fileSize,proto3" json:"file_size,omitempty"`
+	Received       int64                  `protobuf:"varint,5,opt,name=received,proto3" json:"received,omitempty"`
+	ReceivedChunks []int32                `protobuf:"varint,6,rep,packed,name=received_chunks,json=receivedChunks,proto3" json:"received_chunks,omitempty"`
+	MissingChunks  []int32                `protobuf:"varint,7,rep,packed,name=missing_chunks,json=missingChunks,proto3" json:"missing_chunks,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *UploadStatus) Reset() {
+	*x = UploadStatus{}
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadStatus) ProtoMessage() {}
+
+func (x *UploadStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_chunkupload_v1_upload_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadStatus.ProtoReflect.Descriptor instead.
+func (*UploadStatus) Descriptor() ([]byte, []int) {
+	return file_chunkupload_v1_upload_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *UploadStatus) GetUploadId() string {
+	if x != nil {
+		return x.UploadId
+	}
+	return ""
+}
+
+func (x *UploadStatus) GetFileName() string {
+	if x != nil {
+		return x.FileName
+	}
+	return ""
+}
+
+func (x *UploadStatus) GetTotalChunks() int32 {
+	if x != nil {
+		return x.TotalChunks
+	}
+	return 0
+}
+
+func (x *UploadStatus) GetFileSize() int64 {
+	if x != nil {
+		return x.FileSize
+	}
+	return 0
+}
+
+func (x *UploadStatus) GetReceived() int64 {
+	if x != nil {
+		return x.Received
+	}
+	return 0
+}
+
+func (x *UploadStatus) GetReceivedChunks() []int32 {
+	if x != nil {
+		return x.ReceivedChunks
+	}
+	return nil
+}
+
+func (x *UploadStatus) GetMissingChunks() []int32 {
+	if x != nil {
+		return x.MissingChunks
+	}
+	return nil
+}
+
+var File_chunkupload_v1_upload_proto protoreflect.FileDescriptor
+
+const file_chunkupload_v1_upload_proto_rawDesc = "" +
+	"\n" +
+	"\x1bchunkupload/v1/upload.proto\x12\x0echunkupload.v1\"\x82\x02\n" +
+	"\x05Chunk\x12\x1b\n" +
+	"\tupload_id\x18\x01 \x01(\tR\buploadId\x12\x1b\n" +
+	"\tfile_name\x18\x02 \x01(\tR\bfileName\x12!\n" +
+	"\ftotal_chunks\x18\x03 \x01(\x05R\vtotalChunks\x12\x1b\n" +
+	"\tfile_size\x18\x04 \x01(\x03R\bfileSize\x12\x14\n" +
+	"\x05index\x18\x05 \x01(\x05R\x05index\x12\x12\n" +
+	"\x04data\x18\x06 \x01(\fR\x04data\x12\x16\n" +
+	"\x06sha256\x18\a \x01(\tR\x06sha256\x12\x1f\n" +
+	"\vfile_sha256\x18\b \x01(\tR\n" +
+	"fileSha256\x12\x1c\n" +
+	"\tretention\x18\t \x01(\tR\tretention\"\xe6\x01\n" +
+	"\fUploadResult\x12\x1b\n" +
+	"\tupload_id\x18\x01 \x01(\tR\buploadId\x12\x12\n" +
+	"\x04done\x18\x02 \x01(\bR\x04done\x12\x1b\n" +
+	"\tfile_name\x18\x03 \x01(\tR\bfileName\x12\x12\n" +
+	"\x04path\x18\x04 \x01(\tR\x04path\x12\x12\n" +
+	"\x04size\x18\x05 \x01(\x03R\x04size\x12\x1a\n" +
+	"\breceived\x18\x06 \x01(\x03R\breceived\x12!\n" +
+	"\fcontent_type\x18\a \x01(\tR\vcontentType\x12!\n" +
+	"\fduplicate_of\x18\b \x01(\tR\vduplicateOf\",\n" +
+	"\rStatusRequest\x12\x1b\n" +
+	"\tupload_id\x18\x01 \x01(\tR\buploadId\"\xf4\x01\n" +
+	"\fUploadStatus\x12\x1b\n" +
+	"\tupload_id\x18\x01 \x01(\tR\buploadId\x12\x1b\n" +
+	"\tfile_name\x18\x02 \x01(\tR\bfileName\x12!\n" +
+	"\ftotal_chunks\x18\x03 \x01(\x05R\vtotalChunks\x12\x1b\n" +
+	"\tfile_size\x18\x04 \x01(\x03R\bfileSize\x12\x1a\n" +
+	"\breceived\x18\x05 \x01(\x03R\breceived\x12'\n" +
+	"\x0freceived_chunks\x18\x06 \x03(\x05R\x0ereceivedChunks\x12%\n" +
+	"\x0emissing_chunks\x18\a \x03(\x05R\rmissingChunks2\xa6\x01\n" +
+	"\rUploadService\x12E\n" +
+	"\fUploadChunks\x12\x15.chunkupload.v1.Chunk\x1a\x1c.chunkupload.v1.UploadResult(\x01\x12N\n" +
+	"\x0fGetUploadStatus\x12\x1d.chunkupload.v1.StatusRequest\x1a\x1c.chunkupload.v1.UploadStatusBv\n" +
+	"&com.github.navneetshukl.chunkupload.v1P\x01ZJgithub.com/navneetshukl/Chunk-Upload/backend/proto/chunkupload/v1;uploadv1b\x06proto3"
+
+var (
+	file_chunkupload_v1_upload_proto_rawDescOnce sync.Once
+	file_chunkupload_v1_upload_proto_rawDescData []byte
+)
+
+func file_chunkupload_v1_upload_proto_rawDescGZIP() []byte {
+	file_chunkupload_v1_upload_proto_rawDescOnce.Do(func() {
+		file_chunkupload_v1_upload_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_chunkupload_v1_upload_proto_rawDesc), len(file_chunkupload_v1_upload_proto_rawDesc)))
+	})
+	return file_chunkupload_v1_upload_proto_rawDescData
+}
+
+var file_chunkupload_v1_upload_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_chunkupload_v1_upload_proto_goTypes = []any{
+	(*Chunk)(nil),         // 0: chunkupload.v1.Chunk
+	(*UploadResult)(nil),  // 1: chunkupload.v1.UploadResult
+	(*StatusRequest)(nil), // 2: chunkupload.v1.StatusRequest
+	(*UploadStatus)(nil),  // 3: chunkupload.v1.UploadStatus
+}
+var file_chunkupload_v1_upload_proto_depIdxs = []int32{
+	0, // 0: chunkupload.v1.UploadService.UploadChunks:input_type -> chunkupload.v1.Chunk
+	2, // 1: chunkupload.v1.UploadService.GetUploadStatus:input_type -> chunkupload.v1.StatusRequest
+	1, // 2: chunkupload.v1.UploadService.UploadChunks:output_type -> chunkupload.v1.UploadResult
+	3, // 3: chunkupload.v1.UploadService.GetUploadStatus:output_type -> chunkupload.v1.UploadStatus
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_chunkupload_v1_upload_proto_init() }
+func file_chunkupload_v1_upload_proto_init() {
+	if File_chunkupload_v1_upload_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_chunkupload_v1_upload_proto_rawDesc), len(file_chunkupload_v1_upload_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_chunkupload_v1_upload_proto_goTypes,
+		DependencyIndexes: file_chunkupload_v1_upload_proto_depIdxs,
+		MessageInfos:      file_chunkupload_v1_upload_proto_msgTypes,
+	}.Build()
+	File_chunkupload_v1_upload_proto = out.File
+	file_chunkupload_v1_upload_proto_goTypes = nil
+	file_chunkupload_v1_upload_proto_depIdxs = nil
+}
@@ -1,8 +1,34 @@
 import React, { useState } from 'react';
 
+// Ask the server which chunk size it wants (GET /upload/config); fall
+// back to 1MB for servers without the endpoint.
+const negotiateChunkSize = async (uploadUrl) => {
+  try {
+    const response = await fetch(`${uploadUrl}/config`);
+    if (response.ok) {
+      const config = await response.json();
+      if (config.chunkSize > 0) return config.chunkSize;
+    }
+  } catch {
+    // Unreachable or an older server: use the default.
+  }
+  return 1024*1024; // 1MB
+};
+
 const uploadFileInChunks = async (file, uploadUrl, onProgress) => {
-  const chunkSize = 1024*1024; // 1MB
-  const totalChunks = Math.ceil(file.size / chunkSize);
+  const chunkSize = await negotiateChunkSize(uploadUrl);
+  const totalChunks = Math.max(1, Math.ceil(file.size / chunkSize)); // empty files still send one chunk
+
+  // Start a session, so another upload of the same name cannot mix its
+  // chunks into this one.
+  const init = await fetch(`${uploadUrl}/init`, {
+    method: 'POST',
+    body: new URLSearchParams({ fileName: file.name, totalChunks, fileSize: file.size }),
+  });
+  if (!init.ok) {
+    throw new Error(await init.text());
+  }
+  const { uploadID } = await init.json();
 
   for (let i = 0; i < totalChunks; i++) {
     const start = i * chunkSize;
@@ -14,11 +40,15 @@ const uploadFileInChunks = async (file, uploadUrl, onProgress) => {
       lastModified: file.lastModified,
     });
 
+    // Fields first, then the chunk with its length, so the server can
+    // stream it to disk instead of buffering it.
     const formData = new FormData();
-    formData.append('chunk', chunkFile);
+    formData.append('uploadID', uploadID);
     formData.append('index', i);
     formData.append('totalChunks', totalChunks);
     formData.append('fileName', file.name); // ✅ correct field
+    formData.append('chunkLength', chunkFile.size);
+    formData.append('chunk', chunkFile);
 
     const response = await fetch(uploadUrl, {
       method: 'POST',